@@ -0,0 +1,90 @@
+package assets
+
+// The assets package serves the static files embedded in the binary under
+// names that include a hash of their content (e.g. app.3f2a9c1b.css), so
+// they can be cached forever by browsers and every deploy that changes a
+// file also changes its URL.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var files embed.FS
+
+// Prefix is the URL path assets are served under
+const Prefix = "/assets/"
+
+// Length of the content hash in file names
+const hashLength = 8
+
+type asset struct {
+	name    string
+	content []byte
+}
+
+var (
+	// hashed maps file names such as "app.css" to hashed names such as
+	// "app.3f2a9c1b.css"
+	hashed = make(map[string]string)
+	// byHashed maps hashed names back to the files
+	byHashed = make(map[string]asset)
+	// startup is used as the modification time of every asset
+	startup = time.Now()
+)
+
+func init() {
+	err := fs.WalkDir(files, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := files.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(p, "static/")
+		sum := sha256.Sum256(content)
+		ext := path.Ext(name)
+		h := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:])[:hashLength] + ext
+		hashed[name] = h
+		byHashed[h] = asset{name: name, content: content}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Path returns the URL path of an asset, e.g. Path("app.css") returns
+// "/assets/app.3f2a9c1b.css". It is available in templates as assetPath.
+// Unknown names are returned unhashed, so a typo shows up as a 404.
+func Path(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if h, ok := hashed[name]; ok {
+		return Prefix + h
+	}
+	return Prefix + name
+}
+
+// Handler serves assets by hashed name with far-future cache headers.
+// It must be mounted at Prefix.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, Prefix)
+		a, ok := byHashed[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(w, r, a.name, startup, bytes.NewReader(a.content))
+	})
+}
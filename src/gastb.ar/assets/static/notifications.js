@@ -0,0 +1,31 @@
+// Shows notifications streamed from /notifications/stream as dismissible
+// alerts at the top of the page. EventSource reconnects on its own when
+// the stream drops.
+(function () {
+	if (!window.EventSource) {
+		return;
+	}
+	var container = document.querySelector(".container-fluid");
+	var source = new EventSource("/notifications/stream");
+
+	function show(e) {
+		var n = JSON.parse(e.data);
+		var alert = document.createElement("div");
+		alert.className = "alert alert-info alert-dismissible";
+		alert.setAttribute("role", "alert");
+		var close = document.createElement("button");
+		close.type = "button";
+		close.className = "close";
+		close.setAttribute("data-dismiss", "alert");
+		close.setAttribute("aria-label", "Close");
+		close.innerHTML = "<span aria-hidden=\"true\">&times;</span>";
+		alert.appendChild(close);
+		alert.appendChild(document.createTextNode(
+			(n.data && n.data.message) || n.type));
+		container.insertBefore(alert, container.firstChild);
+	}
+
+	["alert.triggered", "collaboration.invite"].forEach(function (type) {
+		source.addEventListener(type, show);
+	});
+})();
@@ -0,0 +1,138 @@
+package atom
+
+// The atom package writes Atom (RFC 4287) feeds and serves them with
+// the caching headers feed readers rely on, so that polling a feed that
+// hasn't changed costs a 304 instead of the whole document.
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxAge is how long clients and proxies may cache a feed
+const MaxAge = 15 * time.Minute
+
+// Feed is an Atom feed. Updated should be the time of the latest entry,
+// which is what Last-Modified is set to.
+type Feed struct {
+	// ID is a permanent URI identifying the feed, usually its URL
+	ID      string
+	Title   string
+	Updated time.Time
+	// Link is the URL of the page the feed is about, and Self the URL
+	// of the feed itself
+	Link    string
+	Self    string
+	Author  string
+	Entries []Entry
+}
+
+// Entry is an entry of a feed
+type Entry struct {
+	// ID is a permanent URI identifying the entry, e.g. a tag: URI
+	ID      string
+	Title   string
+	Updated time.Time
+	Link    string
+	// Summary is plain text
+	Summary string
+}
+
+type xmlLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type xmlText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type xmlAuthor struct {
+	Name string `xml:"name"`
+}
+
+type xmlEntry struct {
+	ID      string    `xml:"id"`
+	Title   xmlText   `xml:"title"`
+	Updated string    `xml:"updated"`
+	Links   []xmlLink `xml:"link"`
+	Summary *xmlText  `xml:"summary"`
+}
+
+type xmlFeed struct {
+	XMLName xml.Name   `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string     `xml:"id"`
+	Title   xmlText    `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []xmlLink  `xml:"link"`
+	Author  *xmlAuthor `xml:"author"`
+	Entries []xmlEntry `xml:"entry"`
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Write writes a feed as XML
+func Write(w io.Writer, f *Feed) error {
+	xf := xmlFeed{
+		ID:      f.ID,
+		Title:   xmlText{Type: "text", Body: f.Title},
+		Updated: timestamp(f.Updated),
+	}
+	if f.Self != "" {
+		xf.Links = append(xf.Links, xmlLink{Rel: "self", Href: f.Self, Type: "application/atom+xml"})
+	}
+	if f.Link != "" {
+		xf.Links = append(xf.Links, xmlLink{Rel: "alternate", Href: f.Link, Type: "text/html"})
+	}
+	if f.Author != "" {
+		xf.Author = &xmlAuthor{Name: f.Author}
+	}
+	for _, e := range f.Entries {
+		xe := xmlEntry{
+			ID:      e.ID,
+			Title:   xmlText{Type: "text", Body: e.Title},
+			Updated: timestamp(e.Updated),
+		}
+		if e.Link != "" {
+			xe.Links = []xmlLink{{Rel: "alternate", Href: e.Link}}
+		}
+		if e.Summary != "" {
+			xe.Summary = &xmlText{Type: "text", Body: e.Summary}
+		}
+		xf.Entries = append(xf.Entries, xe)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(xf)
+}
+
+// Serve writes a feed as the response to r, with Last-Modified and an
+// ETag, answering 304 Not Modified to conditional requests for the
+// version the client already has
+func Serve(w http.ResponseWriter, r *http.Request, f *Feed) {
+	var b strings.Builder
+	if err := Write(&b, f); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	body := b.String()
+	sum := sha256.Sum256([]byte(body))
+	h := w.Header()
+	h.Set("ETag", fmt.Sprintf(`"atom-%x"`, sum[:12]))
+	h.Set("Content-Type", "application/atom+xml; charset=utf-8")
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(MaxAge.Seconds())))
+	http.ServeContent(w, r, "", f.Updated, strings.NewReader(body))
+}
@@ -0,0 +1,49 @@
+package atom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	updated := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := &Feed{
+		ID:      "https://gastb.ar/feed",
+		Title:   "Q&A",
+		Updated: updated,
+		Self:    "https://gastb.ar/feed",
+		Entries: []Entry{{ID: "https://gastb.ar/feed#1", Title: "<b>", Updated: updated}},
+	}
+	w := httptest.NewRecorder()
+	Serve(w, httptest.NewRequest("GET", "/feed", nil), f)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `<title type="text">Q&amp;A</title>`) ||
+		!strings.Contains(body, "&lt;b&gt;") || !strings.Contains(body, "2024-01-02T03:04:05Z") {
+		t.Fatalf("got %d:\n%s", w.Code, body)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Last-Modified") == "" ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "application/atom+xml") {
+		t.Errorf("headers = %v", w.Header())
+	}
+
+	// Readers that have this version get 304
+	r := httptest.NewRequest("GET", "/feed", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	Serve(w, r, f)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional request got %d, want 304", w.Code)
+	}
+
+	// A changed feed has another ETag
+	f.Title = "Other"
+	w = httptest.NewRecorder()
+	Serve(w, r, f)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("changed feed got %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+}
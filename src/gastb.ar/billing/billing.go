@@ -0,0 +1,314 @@
+package billing
+
+// The billing package sells plans through Stripe. Plans are set in the
+// configuration with the limits they come with; users pay for one in a
+// Stripe Checkout page, and Stripe reports the state of their
+// subscription to a webhook, whose events are verified and decoded here.
+// The Stripe API is called over plain HTTP, like the captcha providers.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gastb.ar/tracing"
+)
+
+var (
+	// ErrBadSignature is returned for webhook events that were not
+	// signed with the webhook secret, or were signed too long ago
+	ErrBadSignature = errors.New("billing: invalid event signature")
+	// ErrUnknownPlan is returned for plans that aren't configured, or
+	// can't be bought
+	ErrUnknownPlan = errors.New("billing: no such plan")
+)
+
+// Plan is what a subscription pays for
+type Plan struct {
+	Name string
+	// StripePrice is the ID of the recurring Stripe price of the plan;
+	// plans without one can't be bought
+	StripePrice string
+	// MaxStocklists is how many personal stocklists users can have; 0
+	// means no limit
+	MaxStocklists int
+	// APIRequestsPerMinute is the rate limit of the user's API
+	// requests; 0 keeps the site's default
+	APIRequestsPerMinute int
+	// APIRequestsPerDay is the quota of the user's API requests, across
+	// their keys; 0 means no quota
+	APIRequestsPerDay int
+}
+
+// Config configures billing. Without a Stripe secret key, nothing can be
+// bought, but the default plan's limits still apply.
+type Config struct {
+	StripeSecretKey string
+	// StripeWebhookSecret verifies the events Stripe posts to
+	// /api/v1/billing/stripe
+	StripeWebhookSecret string
+	Plans               []Plan
+	// DefaultPlan is the plan of users without an active subscription
+	DefaultPlan string
+}
+
+// Plan returns the plan called name, or the default plan if there is no
+// such plan. Without a default plan, it is an unlimited plan named after
+// DefaultPlan.
+func (c Config) Plan(name string) Plan {
+	for _, p := range c.Plans {
+		if p.Name == name {
+			return p
+		}
+	}
+	for _, p := range c.Plans {
+		if p.Name == c.DefaultPlan {
+			return p
+		}
+	}
+	return Plan{Name: c.DefaultPlan}
+}
+
+// PlanForPrice returns the plan sold at a Stripe price
+func (c Config) PlanForPrice(price string) (Plan, bool) {
+	for _, p := range c.Plans {
+		if price != "" && p.StripePrice == price {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// Stripe creates checkout sessions and reads webhook events
+type Stripe struct {
+	endpoint      string
+	secretKey     string
+	webhookSecret string
+	client        *http.Client
+}
+
+// New creates a Stripe client from cfg, or returns nil if there is no
+// secret key
+func New(cfg Config) (*Stripe, error) {
+	if cfg.StripeSecretKey == "" {
+		return nil, nil
+	}
+	if cfg.StripeWebhookSecret == "" {
+		return nil, errors.New("billing: a Stripe webhook secret is required")
+	}
+	return &Stripe{
+		endpoint:      "https://api.stripe.com/v1",
+		secretKey:     cfg.StripeSecretKey,
+		webhookSecret: cfg.StripeWebhookSecret,
+		client:        &http.Client{Timeout: 10 * time.Second, Transport: &tracing.Transport{}},
+	}, nil
+}
+
+// Checkout describes a checkout session for a user to subscribe to a
+// plan
+type Checkout struct {
+	UserID uint
+	Plan   Plan
+	// Customer is the user's Stripe customer, if they had a
+	// subscription before; otherwise Email prefills the page
+	Customer string
+	Email    string
+	// SuccessURL and CancelURL are where Stripe sends the user back to
+	SuccessURL string
+	CancelURL  string
+}
+
+// CheckoutURL creates a Stripe Checkout session and returns the URL of
+// its page. The user ID and plan go in the subscription's metadata, so
+// that webhook events can be matched to the user.
+func (s *Stripe) CheckoutURL(ctx context.Context, c Checkout) (string, error) {
+	if c.Plan.StripePrice == "" {
+		return "", ErrUnknownPlan
+	}
+	userID := strconv.FormatUint(uint64(c.UserID), 10)
+	form := url.Values{
+		"mode":                                 {"subscription"},
+		"line_items[0][price]":                 {c.Plan.StripePrice},
+		"line_items[0][quantity]":              {"1"},
+		"client_reference_id":                  {userID},
+		"subscription_data[metadata][user_id]": {userID},
+		"subscription_data[metadata][plan]":    {c.Plan.Name},
+		"success_url":                          {c.SuccessURL},
+		"cancel_url":                           {c.CancelURL},
+	}
+	if c.Customer != "" {
+		form.Set("customer", c.Customer)
+	} else if c.Email != "" {
+		form.Set("customer_email", c.Email)
+	}
+	var session struct {
+		URL string `json:"url"`
+	}
+	if err := s.post(ctx, "/checkout/sessions", form, &session); err != nil {
+		return "", err
+	}
+	return session.URL, nil
+}
+
+// post calls the Stripe API and decodes its response into v
+func (s *Stripe) post(ctx context.Context, path string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.secretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("billing: Stripe responded %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("billing: decoding Stripe response: %w", err)
+	}
+	return nil
+}
+
+// Event is a webhook event. Subscription is set for subscription events,
+// which are the only ones the site acts on.
+type Event struct {
+	ID      string
+	Type    string
+	Created time.Time
+	// Subscription is the state of the subscription after the event
+	Subscription *Subscription
+}
+
+// Subscription is a Stripe subscription
+type Subscription struct {
+	ID       string
+	Customer string
+	// Status is one of Stripe's subscription statuses, such as active,
+	// past_due or canceled
+	Status string
+	// Price is the price of the first item, which tells the plan
+	Price            string
+	CurrentPeriodEnd time.Time
+	// UserID and Plan come from the metadata set by CheckoutURL
+	UserID uint
+	Plan   string
+}
+
+// stripeEvent is the body of a webhook event
+type stripeEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// stripeSubscription is the object of subscription events
+type stripeSubscription struct {
+	ID               string            `json:"id"`
+	Customer         string            `json:"customer"`
+	Status           string            `json:"status"`
+	CurrentPeriodEnd int64             `json:"current_period_end"`
+	Metadata         map[string]string `json:"metadata"`
+	Items            struct {
+		Data []struct {
+			Price struct {
+				ID string `json:"id"`
+			} `json:"price"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+// maxEventAge is how old a signed event may be; older ones are rejected
+// so captured events can't be replayed
+const maxEventAge = 5 * time.Minute
+
+// ParseEvent checks that payload, the body of a webhook request, was
+// signed as its Stripe-Signature header says, and decodes it.
+func (s *Stripe) ParseEvent(payload []byte, signature string) (*Event, error) {
+	if !validSignature(s.webhookSecret, payload, signature, time.Now()) {
+		return nil, ErrBadSignature
+	}
+	var body stripeEvent
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, errors.New("billing: invalid event: " + err.Error())
+	}
+	event := &Event{
+		ID:      body.ID,
+		Type:    body.Type,
+		Created: time.Unix(body.Created, 0),
+	}
+	if !strings.HasPrefix(body.Type, "customer.subscription.") {
+		return event, nil
+	}
+	var sub stripeSubscription
+	if err := json.Unmarshal(body.Data.Object, &sub); err != nil {
+		return nil, errors.New("billing: invalid subscription: " + err.Error())
+	}
+	event.Subscription = &Subscription{
+		ID:               sub.ID,
+		Customer:         sub.Customer,
+		Status:           sub.Status,
+		CurrentPeriodEnd: time.Unix(sub.CurrentPeriodEnd, 0),
+		Plan:             sub.Metadata["plan"],
+	}
+	if len(sub.Items.Data) > 0 {
+		event.Subscription.Price = sub.Items.Data[0].Price.ID
+	}
+	if id, err := strconv.ParseUint(sub.Metadata["user_id"], 10, 64); err == nil {
+		event.Subscription.UserID = uint(id)
+	}
+	return event, nil
+}
+
+// validSignature checks a Stripe-Signature header, "t=TIMESTAMP,v1=SIG"
+// with possibly several v1 signatures, holds the HMAC-SHA256 of the
+// timestamp, a dot and the payload, and the timestamp is recent
+func validSignature(secret string, payload []byte, header string, now time.Time) bool {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			if sig, err := hex.DecodeString(v); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(sec, 0))
+	if age > maxEventAge || age < -maxEventAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValidSignature(t *testing.T) {
+	const secret = "whsec_test"
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	payload := []byte(`{"id":"evt_1","type":"customer.subscription.updated"}`)
+	// sig signs payload as sent at ts with key
+	sig := func(key string, ts time.Time, payload []byte) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(strconv.FormatInt(ts.Unix(), 10) + "."))
+		mac.Write(payload)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	t0 := "t=" + strconv.FormatInt(now.Unix(), 10)
+	good := sig(secret, now, payload)
+	stale := now.Add(-maxEventAge - time.Second)
+	future := now.Add(maxEventAge + time.Second)
+
+	cases := []struct {
+		name    string
+		header  string
+		payload []byte
+		want    bool
+	}{
+		{"valid", t0 + ",v1=" + good, payload, true},
+		{"spaces after commas", t0 + ", v1=" + good, payload, true},
+		{"signed a while ago", "t=" + strconv.FormatInt(now.Add(-4*time.Minute).Unix(), 10) +
+			",v1=" + sig(secret, now.Add(-4*time.Minute), payload), payload, true},
+		{"one of several v1 signatures", t0 + ",v1=" + sig("whsec_old", now, payload) + ",v1=" + good, payload, true},
+		{"v0 signature ignored", t0 + ",v0=" + good + ",v1=" + good, payload, true},
+
+		{"stale timestamp", "t=" + strconv.FormatInt(stale.Unix(), 10) + ",v1=" + sig(secret, stale, payload), payload, false},
+		{"future timestamp", "t=" + strconv.FormatInt(future.Unix(), 10) + ",v1=" + sig(secret, future, payload), payload, false},
+		{"replayed with a new timestamp", "t=" + strconv.FormatInt(now.Add(time.Second).Unix(), 10) + ",v1=" + good, payload, false},
+		{"tampered payload", t0 + ",v1=" + good, []byte(`{"id":"evt_1","type":"customer.subscription.deleted"}`), false},
+		{"wrong secret", t0 + ",v1=" + sig("whsec_other", now, payload), payload, false},
+		{"several v1 signatures, none valid", t0 + ",v1=" + sig("a", now, payload) + ",v1=" + sig("b", now, payload), payload, false},
+		{"only a v0 signature", t0 + ",v0=" + good, payload, false},
+		{"truncated signature", t0 + ",v1=" + good[:32], payload, false},
+		{"signature not hex", t0 + ",v1=zz" + good[2:], payload, false},
+		{"no timestamp", "v1=" + good, payload, false},
+		{"timestamp not a number", "t=now,v1=" + good, payload, false},
+		{"no signature", t0, payload, false},
+		{"empty header", "", payload, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := validSignature(secret, c.payload, c.header, now); got != c.want {
+				t.Errorf("validSignature(%q) = %v, want %v", c.header, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	s, err := New(Config{StripeSecretKey: "sk_test", StripeWebhookSecret: "whsec_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"id":"evt_1","type":"customer.subscription.updated","created":1714564800,
+		"data":{"object":{"id":"sub_1","customer":"cus_1","status":"active","current_period_end":1717243200,
+		"metadata":{"plan":"pro","user_id":"7"},"items":{"data":[{"price":{"id":"price_pro"}}]}}}}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	header := "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	event, err := s.ParseEvent(payload, header)
+	if err != nil {
+		t.Fatalf("ParseEvent: %v", err)
+	}
+	sub := event.Subscription
+	if sub == nil || sub.UserID != 7 || sub.Plan != "pro" || sub.Price != "price_pro" || sub.Status != "active" {
+		t.Errorf("subscription = %+v", sub)
+	}
+	if _, err := s.ParseEvent(append(payload, ' '), header); err != ErrBadSignature {
+		t.Errorf("ParseEvent of a changed payload: %v, want ErrBadSignature", err)
+	}
+}
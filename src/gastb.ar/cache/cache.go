@@ -0,0 +1,154 @@
+package cache
+
+// The cache package stores short-lived values by key, such as rendered
+// pages. Values are kept in a Cache, so that they can live in memory for
+// a single instance or in a shared backend such as Redis for several
+// instances.
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Cache keeps values by key until their TTL runs out. Get reports
+// whether the key was found; a missing or expired key is not an error.
+type Cache interface {
+	Get(key string) (value []byte, ok bool, err error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(keys ...string) error
+}
+
+// Config selects and configures a Cache
+type Config struct {
+	// Backend is "memory" or "redis"
+	Backend string
+	// MaxEntries caps the memory backend, see MemoryCache
+	MaxEntries int
+	Redis      RedisConfig
+}
+
+// New creates the Cache selected by cfg
+func New(cfg Config) (Cache, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		mc := NewMemoryCache()
+		mc.MaxEntries = cfg.MaxEntries
+		return mc, nil
+	case "redis":
+		return NewRedis(cfg.Redis)
+	}
+	return nil, errors.New("cache: unknown backend " + cfg.Backend)
+}
+
+// GetJSON decodes the value of key into v and reports whether it was
+// found
+func GetJSON(c Cache, key string, v interface{}) (bool, error) {
+	b, ok, err := c.Get(key)
+	if !ok || err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetJSON stores v as JSON under key
+func SetJSON(c Cache, key string, v interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Set(key, b, ttl)
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryCache is a Cache that keeps values in memory. It is safe for
+// concurrent use, but values are not shared between instances.
+type MemoryCache struct {
+	// MaxEntries caps how many values are kept; once it is reached,
+	// expired values are swept and, if that is not enough, an arbitrary
+	// value is dropped for each new one. Zero means no cap.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]entry
+	sets    int
+	now     func() time.Time
+}
+
+var _ Cache = &MemoryCache{}
+
+// Number of calls to Set between sweeps of expired values
+const sweepEvery = 1024
+
+// NewMemoryCache creates an empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		entries: make(map[string]entry),
+		now:     time.Now,
+	}
+}
+
+// Get implements Cache
+func (mc *MemoryCache) Get(key string) ([]byte, bool, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	e, ok := mc.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !mc.now().Before(e.expires) {
+		delete(mc.entries, key)
+		return nil, false, nil
+	}
+	return e.value, true, nil
+}
+
+// Set implements Cache. The value is kept as is, so the caller must not
+// modify it afterwards.
+func (mc *MemoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	now := mc.now()
+	mc.sets++
+	if mc.sets%sweepEvery == 0 {
+		mc.sweep(now)
+	}
+	if _, ok := mc.entries[key]; !ok && mc.MaxEntries > 0 && len(mc.entries) >= mc.MaxEntries {
+		mc.sweep(now)
+		for k := range mc.entries {
+			if len(mc.entries) < mc.MaxEntries {
+				break
+			}
+			delete(mc.entries, k)
+		}
+	}
+	mc.entries[key] = entry{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+// Delete implements Cache
+func (mc *MemoryCache) Delete(keys ...string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, k := range keys {
+		delete(mc.entries, k)
+	}
+	return nil
+}
+
+// sweep deletes expired values. mc.mu must be held.
+func (mc *MemoryCache) sweep(now time.Time) {
+	for k, e := range mc.entries {
+		if !now.Before(e.expires) {
+			delete(mc.entries, k)
+		}
+	}
+}
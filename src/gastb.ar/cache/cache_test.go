@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// clock is a settable time for MemoryCache.now
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestCache() (*MemoryCache, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mc := NewMemoryCache()
+	mc.now = c.now
+	return mc, c
+}
+
+func TestMemoryCache(t *testing.T) {
+	mc, clk := newTestCache()
+
+	if _, ok, err := mc.Get("a"); ok || err != nil {
+		t.Errorf("Get of a missing key = %v, %v, want not found", ok, err)
+	}
+	if err := mc.Set("a", []byte("1"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if v, ok, err := mc.Get("a"); !ok || err != nil || string(v) != "1" {
+		t.Errorf("Get = %q, %v, %v, want %q", v, ok, err, "1")
+	}
+
+	clk.t = clk.t.Add(time.Minute)
+	if _, ok, _ := mc.Get("a"); ok {
+		t.Error("Get found a value once its TTL was over")
+	}
+	if len(mc.entries) != 0 {
+		t.Errorf("the expired value is still kept: %v", mc.entries)
+	}
+
+	mc.Set("a", []byte("1"), time.Minute)
+	mc.Set("b", []byte("2"), time.Minute)
+	if err := mc.Delete("a", "b", "missing"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if _, ok, _ := mc.Get(k); ok {
+			t.Errorf("Get(%q) found a deleted value", k)
+		}
+	}
+}
+
+func TestMemoryCacheMaxEntries(t *testing.T) {
+	mc, clk := newTestCache()
+	mc.MaxEntries = 3
+
+	mc.Set("old", []byte("x"), time.Second)
+	mc.Set("a", []byte("x"), time.Hour)
+	mc.Set("b", []byte("x"), time.Hour)
+	clk.t = clk.t.Add(time.Minute)
+	// The expired value makes room for the new one
+	mc.Set("c", []byte("x"), time.Hour)
+	for _, k := range []string{"a", "b", "c"} {
+		if _, ok, _ := mc.Get(k); !ok {
+			t.Errorf("%q was dropped while an expired value could go", k)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		mc.Set(fmt.Sprint(i), []byte("x"), time.Hour)
+	}
+	if n := len(mc.entries); n != 3 {
+		t.Errorf("the cache keeps %d values, want at most 3", n)
+	}
+	if _, ok, _ := mc.Get("9"); !ok {
+		t.Error("the latest value was dropped")
+	}
+	// Replacing a value doesn't drop another one
+	mc.Set("9", []byte("y"), time.Hour)
+	if n := len(mc.entries); n != 3 {
+		t.Errorf("replacing a value left %d values, want 3", n)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	mc := NewMemoryCache()
+	type value struct{ N int }
+
+	var v value
+	if ok, err := GetJSON(mc, "k", &v); ok || err != nil {
+		t.Errorf("GetJSON of a missing key = %v, %v", ok, err)
+	}
+	if err := SetJSON(mc, "k", value{N: 7}, time.Minute); err != nil {
+		t.Fatalf("SetJSON: %v", err)
+	}
+	if ok, err := GetJSON(mc, "k", &v); !ok || err != nil || v.N != 7 {
+		t.Errorf("GetJSON = %+v, %v, %v, want N 7", v, ok, err)
+	}
+	mc.Set("bad", []byte("{"), time.Minute)
+	if ok, err := GetJSON(mc, "bad", &v); ok || err == nil {
+		t.Errorf("GetJSON of invalid JSON = %v, %v, want an error", ok, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	c, err := New(Config{MaxEntries: 5})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if mc, ok := c.(*MemoryCache); !ok || mc.MaxEntries != 5 {
+		t.Errorf("New with no backend = %#v, want a MemoryCache of 5 entries", c)
+	}
+	if _, err := New(Config{Backend: "memcached"}); err == nil {
+		t.Error("New accepted an unknown backend")
+	}
+}
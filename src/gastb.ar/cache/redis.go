@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisConfig configures a Redis server shared by several instances
+type RedisConfig struct {
+	// Addr is the host:port of the server
+	Addr     string
+	Password string
+	DB       int
+	// Prefix namespaces the keys, so that several apps or environments
+	// can share a server, e.g. "gastb:prod:"
+	Prefix string
+	// Timeout bounds dialing and each command; it defaults to a second
+	Timeout time.Duration
+	// MaxIdle is how many connections are kept open between commands;
+	// it defaults to 8
+	MaxIdle int
+}
+
+// Redis is a Cache in a Redis server. It speaks the Redis protocol
+// directly and needs only GET, SET with PX and DEL, so it also works with
+// compatible servers such as Valkey or KeyDB.
+type Redis struct {
+	cfg RedisConfig
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+var _ Cache = &Redis{}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "cache: redis: " + string(e)
+}
+
+// NewRedis creates a Redis cache. Connections are opened as needed.
+func NewRedis(cfg RedisConfig) (*Redis, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("cache: Redis address is required")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = 8
+	}
+	return &Redis{cfg: cfg}, nil
+}
+
+// Get implements Cache
+func (rc *Redis) Get(key string) ([]byte, bool, error) {
+	reply, err := rc.do("GET", rc.cfg.Prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("cache: redis: unexpected reply to GET: %v", reply)
+	}
+	return b, true, nil
+}
+
+// Set implements Cache. Redis expires keys in whole milliseconds, so
+// shorter TTLs are rounded up to one.
+func (rc *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	ms := max(ttl.Milliseconds(), 1)
+	_, err := rc.do("SET", rc.cfg.Prefix+key, value, "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// Delete implements Cache
+func (rc *Redis) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, "DEL")
+	for _, k := range keys {
+		args = append(args, rc.cfg.Prefix+k)
+	}
+	_, err := rc.do(args...)
+	return err
+}
+
+// Ping checks that the server answers; it is a health.Check
+func (rc *Redis) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := rc.do("PING")
+	return err
+}
+
+// Close closes the idle connections
+func (rc *Redis) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, c := range rc.idle {
+		c.conn.Close()
+	}
+	rc.idle = nil
+	return nil
+}
+
+// do sends a command on an idle or new connection and reads its reply.
+// Connections that fail are closed rather than reused, since a reply
+// may be left unread on them; error replies leave them usable.
+func (rc *Redis) do(args ...interface{}) (interface{}, error) {
+	c, err := rc.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(rc.cfg.Timeout, args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.conn.Close()
+		return nil, err
+	}
+	rc.put(c)
+	return reply, err
+}
+
+func (rc *Redis) get() (*redisConn, error) {
+	rc.mu.Lock()
+	if n := len(rc.idle); n > 0 {
+		c := rc.idle[n-1]
+		rc.idle = rc.idle[:n-1]
+		rc.mu.Unlock()
+		return c, nil
+	}
+	rc.mu.Unlock()
+	return rc.dial()
+}
+
+func (rc *Redis) put(c *redisConn) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.idle) >= rc.cfg.MaxIdle {
+		c.conn.Close()
+		return
+	}
+	rc.idle = append(rc.idle, c)
+}
+
+// dial opens a connection, authenticating and selecting the database
+func (rc *Redis) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", rc.cfg.Addr, rc.cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("cache: redis: %v", err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if rc.cfg.Password != "" {
+		if _, err := c.do(rc.cfg.Timeout, "AUTH", rc.cfg.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if rc.cfg.DB != 0 {
+		if _, err := c.do(rc.cfg.Timeout, "SELECT", strconv.Itoa(rc.cfg.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisConn is a connection speaking RESP, the Redis protocol
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// do writes a command as an array of bulk strings and reads the reply.
+// Arguments are strings or []byte.
+func (c *redisConn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		var b []byte
+		switch a := a.(type) {
+		case string:
+			b = []byte(a)
+		case []byte:
+			b = a
+		default:
+			panic(fmt.Sprintf("cache: redis argument of type %T", a))
+		}
+		fmt.Fprintf(c.w, "$%d\r\n", len(b))
+		c.w.Write(b)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, fmt.Errorf("cache: redis: %v", err)
+	}
+	return c.read()
+}
+
+// read reads a reply: a string for simple strings, an int64 for
+// integers, []byte for bulk strings, nil for a missing value, and a
+// redisError for errors. Arrays are not needed by the commands above.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("cache: redis: %v", err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("cache: redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errors.New("cache: redis: malformed bulk length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, fmt.Errorf("cache: redis: %v", err)
+		}
+		return b[:n], nil
+	}
+	return nil, fmt.Errorf("cache: redis: unexpected reply type %q", kind)
+}
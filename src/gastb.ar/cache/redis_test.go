@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server of one database answering the commands
+// Redis uses, asking for a password unless it is empty. It records the
+// commands it got and counts connections.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	commands []string
+	conns    int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{ln: ln, password: password, values: make(map[string]string)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fr.mu.Lock()
+			fr.conns++
+			fr.mu.Unlock()
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) addr() string {
+	return fr.ln.Addr().String()
+}
+
+// log returns the commands received, with their arguments
+func (fr *fakeRedis) log() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return append([]string(nil), fr.commands...)
+}
+
+func (fr *fakeRedis) connections() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.conns
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := fr.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		fr.mu.Lock()
+		fr.commands = append(fr.commands, strings.Join(args, " "))
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			if args[1] == fr.password {
+				authed, reply = true, "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "PING":
+			reply = "+PONG\r\n"
+		case args[0] == "SELECT":
+			reply = "+OK\r\n"
+		case args[0] == "GET":
+			if v, ok := fr.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case args[0] == "SET":
+			fr.values[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case args[0] == "DEL":
+			n := 0
+			for _, k := range args[1:] {
+				if _, ok := fr.values[k]; ok {
+					delete(fr.values, k)
+					n++
+				}
+			}
+			reply = fmt.Sprintf(":%d\r\n", n)
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		fr.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestRedis(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	rc, err := NewRedis(RedisConfig{Addr: fr.addr(), Prefix: "gastb:test:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	if _, ok, err := rc.Get("a"); ok || err != nil {
+		t.Errorf("Get of a missing key = %v, %v, want not found", ok, err)
+	}
+	value := []byte("line\r\nwith CRLF")
+	if err := rc.Set("a", value, 500*time.Microsecond); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if v, ok, err := rc.Get("a"); !ok || err != nil || string(v) != string(value) {
+		t.Errorf("Get = %q, %v, %v, want %q", v, ok, err, value)
+	}
+	if err := rc.Delete("a", "b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok, _ := rc.Get("a"); ok {
+		t.Error("Get found a deleted value")
+	}
+	if err := rc.Ping(context.Background()); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+
+	want := []string{
+		"GET gastb:test:a",
+		"SET gastb:test:a line\r\nwith CRLF PX 1",
+		"GET gastb:test:a",
+		"DEL gastb:test:a gastb:test:b",
+		"GET gastb:test:a",
+		"PING",
+	}
+	if got := fr.log(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+	if n := fr.connections(); n != 1 {
+		t.Errorf("%d connections for sequential commands, want 1", n)
+	}
+}
+
+func TestRedisDial(t *testing.T) {
+	fr := newFakeRedis(t, "secret")
+
+	rc, _ := NewRedis(RedisConfig{Addr: fr.addr(), Password: "secret", DB: 2})
+	defer rc.Close()
+	if err := rc.Set("a", []byte("1"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	want := []string{"AUTH secret", "SELECT 2", "SET a 1 PX 60000"}
+	if got := fr.log(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	wrong, _ := NewRedis(RedisConfig{Addr: fr.addr(), Password: "wrong"})
+	defer wrong.Close()
+	if _, _, err := wrong.Get("a"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Get with a wrong password returned %v, want the server's error", err)
+	}
+
+	if _, err := NewRedis(RedisConfig{}); err == nil {
+		t.Error("NewRedis accepted a config without an address")
+	}
+}
+
+func TestRedisErrors(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	rc, _ := NewRedis(RedisConfig{Addr: fr.addr()})
+	defer rc.Close()
+
+	// An error reply leaves the connection usable
+	if _, err := rc.do("FLUSHALL"); err == nil {
+		t.Error("an unknown command succeeded")
+	}
+	if err := rc.Ping(context.Background()); err != nil {
+		t.Errorf("Ping after an error reply: %v", err)
+	}
+	if n := fr.connections(); n != 1 {
+		t.Errorf("an error reply closed the connection: %d connections, want 1", n)
+	}
+
+	// A server that went away is an error, not a miss
+	fr.ln.Close()
+	rc.Close()
+	if _, ok, err := rc.Get("a"); ok || err == nil {
+		t.Errorf("Get without a server = %v, %v, want an error", ok, err)
+	}
+}
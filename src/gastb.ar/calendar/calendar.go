@@ -0,0 +1,110 @@
+package calendar
+
+// The calendar package writes iCalendar (RFC 5545) feeds of portfolio
+// events, such as dividend and earnings dates, which calendar apps like
+// Google Calendar subscribe to and fetch periodically.
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Refresh is how often calendar apps are asked to fetch a feed again.
+// Google Calendar ignores it and refreshes about twice a day anyway.
+const Refresh = 12 * time.Hour
+
+// Event is an all-day event
+type Event struct {
+	// UID identifies the event across fetches, so that apps update it
+	// instead of adding a copy when it changes
+	UID         string
+	Date        time.Time
+	Summary     string
+	Description string
+}
+
+// Source lists the events of a user between two dates
+type Source interface {
+	Events(ctx context.Context, userID uint, from, to time.Time) ([]Event, error)
+}
+
+type none struct{}
+
+func (none) Events(ctx context.Context, userID uint, from, to time.Time) ([]Event, error) {
+	return nil, nil
+}
+
+// None is a Source without any events
+var None Source = none{}
+
+// Write writes a calendar named name with events. now is the time the
+// feed is generated at, which every event is stamped with.
+func Write(w io.Writer, name string, events []Event, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	write := func(line string) {
+		bw.WriteString(fold(line))
+	}
+	write("BEGIN:VCALENDAR")
+	write("VERSION:2.0")
+	write("PRODID:-//gastb.ar//Portfolio events//EN")
+	write("CALSCALE:GREGORIAN")
+	write("METHOD:PUBLISH")
+	write("X-WR-CALNAME:" + escape(name))
+	write("REFRESH-INTERVAL;VALUE=DURATION:" + duration(Refresh))
+	write("X-PUBLISHED-TTL:" + duration(Refresh))
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, e := range events {
+		write("BEGIN:VEVENT")
+		write("UID:" + escape(e.UID))
+		write("DTSTAMP:" + stamp)
+		write("DTSTART;VALUE=DATE:" + e.Date.Format("20060102"))
+		write("DTEND;VALUE=DATE:" + e.Date.AddDate(0, 0, 1).Format("20060102"))
+		write("SUMMARY:" + escape(e.Summary))
+		if e.Description != "" {
+			write("DESCRIPTION:" + escape(e.Description))
+		}
+		// All-day events shouldn't show the user as busy
+		write("TRANSP:TRANSPARENT")
+		write("END:VEVENT")
+	}
+	write("END:VCALENDAR")
+	return bw.Flush()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "")
+
+// escape escapes a text value
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// fold ends a content line with CRLF, breaking it into lines of at most
+// 75 bytes, without splitting UTF-8 sequences. Continuation lines start
+// with a space.
+func fold(line string) string {
+	var b strings.Builder
+	max := 75
+	for len(line) > max {
+		i := max
+		for i > 0 && line[i]&0xC0 == 0x80 {
+			i--
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n ")
+		line = line[i:]
+		// The leading space counts towards the next line's length
+		max = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// duration formats a whole number of hours as an iCalendar duration
+func duration(d time.Duration) string {
+	return "PT" + strconv.Itoa(int(d/time.Hour)) + "H"
+}
@@ -0,0 +1,191 @@
+package captcha
+
+// The captcha package checks that forms were filled in by people, to slow
+// down scripts creating accounts or requesting password resets. Pages
+// show the provider's widget, which posts a response token along with
+// the form; a Verifier asks the provider whether the token is good.
+// hCaptcha and Cloudflare Turnstile are supported, through Config.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gastb.ar/tracing"
+)
+
+var (
+	// ErrMissing is returned when a form was posted without a response,
+	// as scripts ignoring the widget do
+	ErrMissing = errors.New("captcha: response is missing")
+
+	// ErrFailed is returned when the provider rejects a response
+	ErrFailed = errors.New("captcha: verification failed")
+)
+
+// Verifier checks captcha responses with a provider
+type Verifier interface {
+	// Verify returns nil if response, posted by a client at remoteIP,
+	// is good, and ErrMissing or ErrFailed if not. Other errors mean the
+	// provider could not be asked.
+	Verify(ctx context.Context, response, remoteIP string) error
+	// Widget describes what pages show for the provider
+	Widget() Widget
+}
+
+// Widget is what a page needs to show a provider's widget
+type Widget struct {
+	// Script is the URL of the provider's script
+	Script string
+	// Class is the class of the element the script turns into the widget
+	Class   string
+	SiteKey string
+	// Field is the form field the widget posts its response in
+	Field string
+	// Sources are the origins the widget loads scripts, styles and
+	// frames from, which the Content-Security-Policy must allow
+	Sources []string
+}
+
+// Config selects and configures a Verifier
+type Config struct {
+	// Provider is "hcaptcha", "turnstile", or "" for no captcha
+	Provider string
+	// SiteKey is public and shown in pages; Secret is used to verify
+	// responses
+	SiteKey string
+	Secret  string
+}
+
+// New creates the Verifier selected by cfg, or nil if there is none
+func New(cfg Config) (Verifier, error) {
+	if cfg.Provider == "" {
+		return nil, nil
+	}
+	if cfg.SiteKey == "" || cfg.Secret == "" {
+		return nil, errors.New("captcha: site key and secret are required")
+	}
+	switch cfg.Provider {
+	case "hcaptcha":
+		return &siteVerify{
+			endpoint: "https://api.hcaptcha.com/siteverify",
+			secret:   cfg.Secret,
+			widget: Widget{
+				Script:  "https://js.hcaptcha.com/1/api.js",
+				Class:   "h-captcha",
+				SiteKey: cfg.SiteKey,
+				Field:   "h-captcha-response",
+				Sources: []string{"https://hcaptcha.com", "https://*.hcaptcha.com"},
+			},
+			client: newClient(),
+		}, nil
+	case "turnstile":
+		return &siteVerify{
+			endpoint: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+			secret:   cfg.Secret,
+			widget: Widget{
+				Script:  "https://challenges.cloudflare.com/turnstile/v0/api.js",
+				Class:   "cf-turnstile",
+				SiteKey: cfg.SiteKey,
+				Field:   "cf-turnstile-response",
+				Sources: []string{"https://challenges.cloudflare.com"},
+			},
+			client: newClient(),
+		}, nil
+	}
+	return nil, errors.New("captcha: unknown provider " + cfg.Provider)
+}
+
+func newClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second, Transport: &tracing.Transport{}}
+}
+
+// siteVerify verifies responses with the siteverify API that hCaptcha and
+// Turnstile share
+type siteVerify struct {
+	endpoint string
+	secret   string
+	widget   Widget
+	client   *http.Client
+}
+
+// Widget implements Verifier
+func (sv *siteVerify) Widget() Widget {
+	return sv.widget
+}
+
+// Verify implements Verifier
+func (sv *siteVerify) Verify(ctx context.Context, response, remoteIP string) error {
+	if response == "" {
+		return ErrMissing
+	}
+	form := url.Values{
+		"secret":   {sv.secret},
+		"response": {response},
+	}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sv.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := sv.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("captcha: siteverify responded %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return fmt.Errorf("captcha: decoding siteverify response: %w", err)
+	}
+	if !result.Success {
+		return ErrFailed
+	}
+	return nil
+}
+
+// directives the widget's sources are added to by AllowIn
+var directives = []string{"script-src", "style-src", "frame-src", "connect-src"}
+
+// AllowIn returns csp, a Content-Security-Policy, allowing the widget's
+// sources to load scripts, styles and frames and be connected to.
+// Directives csp lacks are added, allowing 'self' as well.
+func (w Widget) AllowIn(csp string) string {
+	sources := strings.Join(w.Sources, " ")
+	found := make(map[string]bool)
+	var out []string
+	for _, d := range strings.Split(csp, ";") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		name := strings.Fields(d)[0]
+		for _, dir := range directives {
+			if name == dir {
+				d += " " + sources
+				found[dir] = true
+			}
+		}
+		out = append(out, d)
+	}
+	for _, dir := range directives {
+		if !found[dir] {
+			out = append(out, dir+" 'self' "+sources)
+		}
+	}
+	return strings.Join(out, "; ")
+}
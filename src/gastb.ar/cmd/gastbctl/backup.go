@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+	"gastb.ar/storage"
+)
+
+// Archives are stored under backupPrefix, named after the UTC time they
+// were taken at, so sorting keys sorts them by age
+const (
+	backupPrefix = "gastb-"
+	backupExt    = ".dump"
+	backupTime   = "20060102T150405Z"
+)
+
+// backup dumps the database with pg_dump, stores the archive and deletes
+// archives beyond the retention policy. With -link, it prints a presigned
+// link to download the archive, for storages that have them.
+func backup(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("backup")
+	keep := fs.Int("keep", cfg.Backup.Keep, "number of archives to keep; 0 keeps all")
+	link := fs.Duration("link", 0, "print a download link to the archive working for this long")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	store, err := storage.New(cfg.Backup.Storage)
+	if err != nil {
+		return err
+	}
+	presigner, ok := store.(storage.Presigner)
+	if *link > 0 && !ok {
+		return errors.New("the backup storage has no download links")
+	}
+	ctx := context.Background()
+
+	f, err := os.CreateTemp("", "gastb-*.dump")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	err = pgTool(ctx, "pg_dump", "--format=custom", "--file="+f.Name())
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	key := backupPrefix + time.Now().UTC().Format(backupTime) + backupExt
+	err = store.Put(ctx, key, f, info.Size(), "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stored %s (%s).\n", key, humanSize(info.Size()))
+	if *link > 0 {
+		url, err := presigner.Presign(key, *link, key)
+		if err != nil {
+			return err
+		}
+		fmt.Println(url)
+	}
+
+	if *keep <= 0 {
+		return nil
+	}
+	archives, err := listBackups(ctx, store)
+	if err != nil {
+		return err
+	}
+	for len(archives) > *keep {
+		if err := store.Delete(ctx, archives[0].Key); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s.\n", archives[0].Key)
+		archives = archives[1:]
+	}
+	return nil
+}
+
+// restore replaces the database contents with an archive. It refuses to
+// run without -force; -list shows the archives instead.
+func restore(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("restore")
+	list := fs.Bool("list", false, "list the archives")
+	force := fs.Bool("force", false, "really replace the database contents")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store, err := storage.New(cfg.Backup.Storage)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	archives, err := listBackups(ctx, store)
+	if err != nil {
+		return err
+	}
+	if *list {
+		for _, a := range archives {
+			fmt.Printf("%s  %8s  %s\n", a.Key, humanSize(a.Size),
+				a.Modified.Local().Format("2006-01-02 15:04"))
+		}
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	key := fs.Arg(0)
+	if key == "latest" {
+		if len(archives) == 0 {
+			return errors.New("there are no backups")
+		}
+		key = archives[len(archives)-1].Key
+	}
+	if !*force {
+		return fmt.Errorf("restoring %s replaces the database contents; run it with -force", key)
+	}
+
+	r, err := store.Get(ctx, key)
+	if err == storage.ErrNotFound {
+		return fmt.Errorf("no backup %s; see gastbctl restore -list", key)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.CreateTemp("", "gastb-*.dump")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = pgTool(ctx, "pg_restore", "--clean", "--if-exists", "--no-owner",
+		"--single-transaction", f.Name())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s.\n", key)
+	return nil
+}
+
+// listBackups returns the stored archives, oldest first
+func listBackups(ctx context.Context, store storage.Storage) ([]storage.Object, error) {
+	objects, err := store.List(ctx, backupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var archives []storage.Object
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, backupExt) {
+			archives = append(archives, o)
+		}
+	}
+	return archives, nil
+}
+
+// pgTool runs pg_dump or pg_restore on the configured database. The
+// password goes in the environment rather than the command line, where
+// other users of the host could see it.
+func pgTool(ctx context.Context, name string, args ...string) error {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s is needed; install the Postgres client tools", name)
+	}
+	pg := config.DefaultPostgresConfig()
+	args = append([]string{
+		"--host=" + pg.Host,
+		"--port=" + strconv.Itoa(pg.Port),
+		"--username=" + pg.User,
+		"--dbname=" + pg.Name,
+		"--no-password",
+	}, args...)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+pg.Password)
+	if pg.TargetSessionAttrs != "" {
+		// The tools take the host list as it is, and this from the
+		// environment
+		cmd.Env = append(cmd.Env, "PGTARGETSESSIONATTRS="+pg.TargetSessionAttrs)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+	return nil
+}
+
+// humanSize formats a size in bytes, e.g. "1.5MB"
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
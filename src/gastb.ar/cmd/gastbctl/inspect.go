@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// Secrets such as password, token and key hashes are never printed.
+// Webhook URLs are shown without credentials or query strings, which
+// often carry tokens.
+
+// Number of audit entries inspect user shows
+const inspectAuditEntries = 20
+
+// inspectUser prints a user with their settings, stocklists, API keys,
+// webhooks and latest audit entries
+func inspectUser(s *models.Services, cfg config.Config, args []string) error {
+	email, err := oneArg(flags("inspect user"), args)
+	if err != nil {
+		return err
+	}
+	user, err := s.UserService.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	ns, err := s.NotificationSettingService.ForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	stocklists, err := s.StocklistService.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	keys, err := s.APIKeyService.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	hooks, err := s.WebhookService.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	audit, err := s.AuditService.ByUserID(user.ID, inspectAuditEntries)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "User\t%d\n", user.ID)
+	fmt.Fprintf(w, "Name\t%s\n", orNone(user.Name))
+	fmt.Fprintf(w, "Email\t%s\n", user.Email)
+	fmt.Fprintf(w, "Role\t%s\n", user.Role)
+	fmt.Fprintf(w, "Signed up\t%s\n", when(user.CreatedAt))
+	fmt.Fprintf(w, "Updated\t%s\n", when(user.UpdatedAt))
+	fmt.Fprintf(w, "Email verified\t%s\n", whenPtr(user.EmailVerifiedAt))
+	fmt.Fprintf(w, "Failed logins\t%d\n", user.FailedLogins)
+	if user.IsLocked() {
+		fmt.Fprintf(w, "Locked until\t%s\n", when(*user.LockedUntil))
+	}
+	fmt.Fprintf(w, "Reset required\t%t\n", user.ResetRequired)
+	if user.IsDeactivated() {
+		fmt.Fprintf(w, "Deactivated\t%s\n", whenPtr(user.DeactivatedAt))
+	}
+	if user.Undeliverable != "" {
+		fmt.Fprintf(w, "Email suppressed\t%s since %s\n", user.Undeliverable,
+			whenPtr(user.UndeliverableAt))
+	}
+	fmt.Fprintf(w, "Locale\t%s\n", orNone(user.Locale))
+	fmt.Fprintf(w, "Avatar\t%t\n", user.AvatarKey != "")
+	fmt.Fprintf(w, "Notifications\talerts=%t digest=%t security=%t webhooks=%t\n",
+		ns.EmailAlerts, ns.Digest, ns.SecurityNotices, ns.Webhooks)
+	w.Flush()
+
+	fmt.Printf("\nStocklists (%d)\n", len(stocklists))
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, sl := range stocklists {
+		fmt.Fprintf(w, "  %d\t%s\tv%d\tupdated %s\n", sl.ID, sl.Name, sl.Version,
+			when(sl.UpdatedAt))
+	}
+	w.Flush()
+
+	fmt.Printf("\nAPI keys (%d)\n", len(keys))
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %d\t%s\tcreated %s\n", k.ID, orNone(k.Name), when(k.CreatedAt))
+	}
+	w.Flush()
+
+	fmt.Printf("\nWebhooks (%d)\n", len(hooks))
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, h := range hooks {
+		fmt.Fprintf(w, "  %d\t%s\t%s\n", h.ID, redactURL(h.URL), h.Events)
+	}
+	w.Flush()
+
+	fmt.Printf("\nAudit log (latest %d)\n", len(audit))
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, e := range audit {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", when(e.CreatedAt), e.Action, e.Detail)
+	}
+	return w.Flush()
+}
+
+// inspectStocklist prints a stocklist with its owner and attachments
+func inspectStocklist(s *models.Services, cfg config.Config, args []string) error {
+	arg, err := oneArg(flags("inspect stocklist"), args)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	sl, err := s.StocklistService.ByID(uint(id))
+	if err != nil {
+		return err
+	}
+	owner := "(deleted)"
+	if user, err := s.UserService.ByID(sl.UserID); err == nil {
+		owner = user.Email
+	} else if err != models.ErrNotFound {
+		return err
+	}
+	attachments, err := s.AttachmentService.ByStocklistID(sl.ID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Stocklist\t%d\n", sl.ID)
+	fmt.Fprintf(w, "Name\t%s\n", sl.Name)
+	fmt.Fprintf(w, "Owner\t%d %s\n", sl.UserID, owner)
+	fmt.Fprintf(w, "Version\t%d\n", sl.Version)
+	fmt.Fprintf(w, "Created\t%s\n", when(sl.CreatedAt))
+	fmt.Fprintf(w, "Updated\t%s\n", when(sl.UpdatedAt))
+	w.Flush()
+
+	fmt.Printf("\nAttachments (%d)\n", len(attachments))
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, a := range attachments {
+		fmt.Fprintf(w, "  %d\t%s\t%s\t%s\n", a.ID, a.Name, a.ContentType, humanSize(a.Size))
+	}
+	return w.Flush()
+}
+
+// redactURL drops credentials, query and fragment from a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	u.User = nil
+	if u.RawQuery != "" {
+		u.RawQuery = "…"
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+func when(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func whenPtr(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return when(*t)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// inviteCreate creates an invite and prints its signup link. Invites made
+// here are not created by any user, so their CreatedBy is 0.
+func inviteCreate(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("invite create")
+	email := fs.String("email", "", "address the invite is meant for, if any")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	invite, err := s.InviteService.Create(0, *email)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signup link, valid until %s:\n%s/signup?invite=%s\n",
+		invite.ExpiresAt.Format("2006-01-02 15:04"),
+		strings.TrimSuffix(cfg.BaseURL, "/"), invite.Code)
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// loadgen sends a mix of API reads and writes to a running instance as
+// the owner of an API key, and reports latencies per operation. Writes
+// only touch stocklists it created, and those are deleted at the end.
+// Rate limiting on the instance shows up as errors.
+func loadgen(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("loadgen")
+	base := fs.String("url", cfg.BaseURL, "base URL of the instance")
+	key := fs.String("key", "", "API key to authenticate with")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run")
+	workers := fs.Int("c", 10, "number of concurrent clients")
+	writes := fs.Float64("writes", 0.2, "fraction of requests that write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" || *workers < 1 || *writes < 0 || *writes > 1 || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	lg := &loadGen{
+		base:   strings.TrimSuffix(*base, "/") + "/api/v1",
+		key:    *key,
+		client: &http.Client{Timeout: 10 * time.Second},
+		stats:  make(map[string]*opStats),
+	}
+	if _, err := lg.do("GET", "/users/me", nil, nil); err != nil {
+		return fmt.Errorf("checking the API key: %v", err)
+	}
+	fmt.Printf("Running %d clients for %s against %s...\n", *workers, *duration, lg.base)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			lg.run(ctx, mrand.New(mrand.NewSource(seed)), *writes)
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	lg.cleanup()
+	lg.report(elapsed)
+	return nil
+}
+
+// loadGen holds the state shared by the clients
+type loadGen struct {
+	base   string
+	key    string
+	client *http.Client
+
+	mu    sync.Mutex
+	stats map[string]*opStats
+	// created holds the IDs of the stocklists the run created and did
+	// not delete yet
+	created []uint
+}
+
+// opStats are the results of one kind of operation
+type opStats struct {
+	latencies []time.Duration
+	errors    int
+}
+
+// run sends requests until ctx is done
+func (lg *loadGen) run(ctx context.Context, rnd *mrand.Rand, writes float64) {
+	for ctx.Err() == nil {
+		if rnd.Float64() < writes {
+			lg.write(rnd)
+		} else {
+			lg.read(rnd)
+		}
+	}
+}
+
+func (lg *loadGen) read(rnd *mrand.Rand) {
+	id, ok := lg.pick(rnd)
+	switch n := rnd.Intn(3); {
+	case n == 0:
+		lg.measure("GET /users/me", "GET", "/users/me", nil, nil)
+	case n == 1 && ok:
+		lg.measure("GET /stocklists/{id}", "GET", fmt.Sprintf("/stocklists/%d", id), nil, nil)
+	default:
+		lg.measure("GET /stocklists", "GET", "/stocklists", nil, nil)
+	}
+}
+
+func (lg *loadGen) write(rnd *mrand.Rand) {
+	id, ok := lg.pick(rnd)
+	switch n := rnd.Intn(10); {
+	case n < 5 || !ok:
+		var created struct {
+			ID uint `json:"id"`
+		}
+		name := fmt.Sprintf("loadgen %d", rnd.Int63())
+		if lg.measure("POST /stocklists", "POST", "/stocklists",
+			map[string]string{"name": name}, &created) {
+			lg.mu.Lock()
+			lg.created = append(lg.created, created.ID)
+			lg.mu.Unlock()
+		}
+	case n < 8:
+		name := fmt.Sprintf("loadgen %d", rnd.Int63())
+		lg.measure("PUT /stocklists/{id}", "PUT", fmt.Sprintf("/stocklists/%d", id),
+			map[string]string{"name": name}, nil)
+	default:
+		if lg.forget(id) {
+			lg.measure("DELETE /stocklists/{id}", "DELETE",
+				fmt.Sprintf("/stocklists/%d", id), nil, nil)
+		}
+	}
+}
+
+// pick returns a random stocklist created by the run, if any
+func (lg *loadGen) pick(rnd *mrand.Rand) (uint, bool) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if len(lg.created) == 0 {
+		return 0, false
+	}
+	return lg.created[rnd.Intn(len(lg.created))], true
+}
+
+// forget removes a stocklist from the created ones, reporting whether
+// it was still there, so two clients don't delete the same one
+func (lg *loadGen) forget(id uint) bool {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	for i, c := range lg.created {
+		if c == id {
+			lg.created = append(lg.created[:i], lg.created[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// measure sends a request and records its latency under op, reporting
+// whether it succeeded
+func (lg *loadGen) measure(op, method, path string, body, dst interface{}) bool {
+	start := time.Now()
+	_, err := lg.do(method, path, body, dst)
+	elapsed := time.Since(start)
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	st := lg.stats[op]
+	if st == nil {
+		st = &opStats{}
+		lg.stats[op] = st
+	}
+	if err != nil {
+		st.errors++
+		return false
+	}
+	st.latencies = append(st.latencies, elapsed)
+	return true
+}
+
+// do sends an API request, decoding the data of the envelope into dst
+func (lg *loadGen) do(method, path string, body, dst interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, lg.base+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+lg.key)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := lg.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if dst == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, err
+	}
+	env := struct {
+		Data interface{} `json:"data"`
+	}{Data: dst}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(&env)
+}
+
+// cleanup deletes the stocklists the run left behind
+func (lg *loadGen) cleanup() {
+	for _, id := range lg.created {
+		lg.do("DELETE", fmt.Sprintf("/stocklists/%d", id), nil, nil)
+	}
+	if len(lg.created) > 0 {
+		fmt.Printf("Deleted the %d stocklists left by the run.\n", len(lg.created))
+	}
+	lg.created = nil
+}
+
+// report prints throughput and latency percentiles per operation
+func (lg *loadGen) report(elapsed time.Duration) {
+	var ops []string
+	total := 0
+	for op, st := range lg.stats {
+		ops = append(ops, op)
+		total += len(st.latencies) + st.errors
+	}
+	sort.Strings(ops)
+	fmt.Printf("\n%d requests in %s (%.1f/s)\n\n", total, elapsed.Round(time.Millisecond),
+		float64(total)/elapsed.Seconds())
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "operation\tok\terrors\tp50\tp95\tp99\tmax\t")
+	for _, op := range ops {
+		st := lg.stats[op]
+		l := st.latencies
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n", op, len(l), st.errors,
+			percentile(l, 50), percentile(l, 95), percentile(l, 99), percentile(l, 100))
+	}
+	w.Flush()
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) string {
+	if len(sorted) == 0 {
+		return "-"
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(10 * time.Microsecond).String()
+}
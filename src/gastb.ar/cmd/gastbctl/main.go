@@ -0,0 +1,198 @@
+package main
+
+// gastbctl is the command line admin tool of gastb. It connects to the
+// database with the same settings as the web server and goes through the
+// models services, so validation and hashing work as they do on the site.
+//
+// Usage:
+//
+//	gastbctl migrate up|down|status
+//	gastbctl user create|promote|lock|delete|import|merge ...
+//	gastbctl invite create ...
+//	gastbctl org seats ID [LIMIT]
+//	gastbctl token purge
+//	gastbctl secrets rotate
+//	gastbctl inspect user EMAIL | stocklist ID
+//	gastbctl seed
+//	gastbctl backup
+//	gastbctl restore -list | -force KEY|latest
+//	gastbctl loadgen -key API_KEY
+//	gastbctl profile heap|goroutine|profile|...
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// command is a subcommand, run with the arguments that follow its name
+type command struct {
+	usage string
+	run   func(s *models.Services, cfg config.Config, args []string) error
+	// offline commands don't connect to the database; they are run with
+	// nil services
+	offline bool
+}
+
+var commands = map[string]map[string]command{
+	"migrate": {
+		"up":     {usage: "migrate up", run: migrateUp},
+		"down":   {usage: "migrate down -force", run: migrateDown},
+		"status": {usage: "migrate status", run: migrateStatus},
+	},
+	"user": {
+		"create":  {usage: "user create -email EMAIL [-name NAME] [-password PASSWORD] [-admin]", run: userCreate},
+		"promote": {usage: "user promote EMAIL", run: userPromote},
+		"lock":    {usage: "user lock [-for DURATION] EMAIL", run: userLock},
+		"delete":  {usage: "user delete EMAIL", run: userDelete},
+		"import":  {usage: "user import [-dry-run] [-invite] [-batch N] FILE", run: userImport},
+		"merge":   {usage: "user merge [-force] PRIMARY_EMAIL DUPLICATE_EMAIL", run: userMerge},
+		"purges":  {usage: "user purges [-n N]", run: userPurges},
+	},
+	"invite": {
+		"create": {usage: "invite create [-email EMAIL]", run: inviteCreate},
+	},
+	"org": {
+		"seats": {usage: "org seats ID [LIMIT]", run: orgSeats},
+	},
+	"token": {
+		"purge": {usage: "token purge", run: tokenPurge},
+	},
+	"secrets": {
+		"rotate": {usage: "secrets rotate", run: secretsRotate},
+	},
+	"seed": {
+		"": {usage: "seed", run: seed},
+	},
+	"inspect": {
+		"user":      {usage: "inspect user EMAIL", run: inspectUser},
+		"stocklist": {usage: "inspect stocklist ID", run: inspectStocklist},
+	},
+	"loadgen": {
+		"": {usage: "loadgen -key API_KEY [-url URL] [-duration D] [-c N] [-writes RATIO]",
+			run: loadgen, offline: true},
+	},
+	"profile": {
+		"": {usage: "profile [-url URL] [-seconds N] [-o FILE] [-stacks] heap|allocs|goroutine|block|mutex|threadcreate|profile|trace",
+			run: profile, offline: true},
+	},
+	"backup": {
+		"": {usage: "backup [-keep N] [-link DURATION]", run: backup},
+	},
+	"restore": {
+		"": {usage: "restore -list | restore -force KEY|latest", run: restore},
+	},
+}
+
+// errUsage makes main print the usage of the command that returned it
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	group, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	name, args := "", os.Args[2:]
+	if _, single := group[""]; !single {
+		if len(args) == 0 {
+			usage()
+			os.Exit(2)
+		}
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := group[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	cfg := config.DefaultConfig()
+	var services *models.Services
+	if !cmd.offline {
+		var err error
+		pgCfg := config.DefaultPostgresConfig()
+		if os.Args[1] == "migrate" {
+			// Index builds may run much longer than any request
+			pgCfg.StatementTimeout = 0
+		}
+		// gastbctl works on any user's data, past row level security
+		services, err = models.NewServices(pgCfg.AdminConnectionInfo(), cfg.HMAC)
+		if err != nil {
+			fatal(err)
+		}
+		defer services.Close()
+		if err := services.WaitForDB(context.Background(), pgCfg.WaitTimeout); err != nil {
+			fatal(err)
+		}
+		services.SetPreparedStatements(pgCfg.PreparedStatements)
+		services.SetRowLevelSecurity(pgCfg.RowLevelSecurity)
+		if err := services.SetLogLevel(cfg.DBLogLevel); err != nil {
+			fatal(err)
+		}
+		keyring, err := cfg.Keyring()
+		if err != nil {
+			fatal(err)
+		}
+		services.SetKeyring(keyring)
+		services.SubscriptionService.SetPlans(cfg.Billing)
+	}
+
+	err := cmd.run(services, cfg, args)
+	if err == errUsage || err == flag.ErrHelp {
+		fmt.Fprintln(os.Stderr, "usage: gastbctl "+cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// usage prints every command
+func usage() {
+	var lines []string
+	for _, group := range commands {
+		for _, cmd := range group {
+			lines = append(lines, "  gastbctl "+cmd.usage)
+		}
+	}
+	sort.Strings(lines)
+	fmt.Fprintln(os.Stderr, "usage:\n"+strings.Join(lines, "\n"))
+}
+
+// fatal prints an error without the package prefix of models errors and
+// exits
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "gastbctl: "+strings.TrimPrefix(err.Error(), "models: "))
+	os.Exit(1)
+}
+
+// flags returns a flag set for a command that reports errors instead of
+// exiting, so main can print the command's usage
+func flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {}
+	return fs
+}
+
+// oneArg parses fs and returns its only positional argument
+func oneArg(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
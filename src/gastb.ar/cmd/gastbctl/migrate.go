@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// migrateUp creates missing tables, columns and indexes
+func migrateUp(s *models.Services, cfg config.Config, args []string) error {
+	if err := flags("migrate up").Parse(args); err != nil {
+		return err
+	}
+	if err := s.AutoMigrate(); err != nil {
+		return err
+	}
+	fmt.Println("Database migrated.")
+	return nil
+}
+
+// migrateDown drops every table. It refuses to run without -force.
+func migrateDown(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("migrate down")
+	force := fs.Bool("force", false, "really drop every table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*force {
+		return fmt.Errorf("migrate down deletes all data; run it with -force")
+	}
+	if err := s.DropTables(); err != nil {
+		return err
+	}
+	fmt.Println("Every table was dropped.")
+	return nil
+}
+
+// migrateStatus lists the tables and explicit indexes, and whether they
+// exist
+func migrateStatus(s *models.Services, cfg config.Config, args []string) error {
+	if err := flags("migrate status").Parse(args); err != nil {
+		return err
+	}
+	missing := 0
+	for _, t := range s.MigrationStatus() {
+		state := "ok"
+		if !t.Exists {
+			state = "missing"
+			missing++
+		}
+		fmt.Printf("%-28s %s\n", t.Table, state)
+	}
+	indexes, err := s.IndexStatus()
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	for _, idx := range indexes {
+		state := "ok"
+		switch {
+		case !idx.Exists:
+			state = "missing"
+			missing++
+		case !idx.Valid:
+			state = "invalid"
+			missing++
+		}
+		fmt.Printf("%-28s %s\n", idx.Name, state)
+	}
+	if missing > 0 {
+		fmt.Printf("\n%d tables or indexes missing; run gastbctl migrate up\n", missing)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// orgSeats prints the seats an organization uses, after setting how many
+// it pays for if a limit is given; 0 removes the limit. Billing is done
+// outside the site, which is told the result here.
+func orgSeats(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("org seats")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+	id, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	if fs.NArg() == 2 {
+		limit, err := strconv.Atoi(fs.Arg(1))
+		if err != nil || limit < 0 {
+			return errUsage
+		}
+		if err := s.OrganizationService.SetSeatLimit(uint(id), limit); err != nil {
+			return err
+		}
+	}
+	seats, err := s.OrganizationService.Seats(uint(id))
+	if err != nil {
+		return err
+	}
+	limit := "unlimited"
+	if seats.Limit > 0 {
+		limit = strconv.Itoa(seats.Limit)
+	}
+	fmt.Printf("%d members, %d pending invitations, limit %s\n",
+		seats.Used, seats.Pending, limit)
+	return nil
+}
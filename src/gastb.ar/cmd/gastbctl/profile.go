@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// profiles are the snapshots profile can take, by the name of their
+// endpoint under /debug/pprof
+var profiles = map[string]bool{
+	"heap": true, "allocs": true, "goroutine": true, "block": true,
+	"mutex": true, "threadcreate": true, "profile": true, "trace": true,
+}
+
+// profile saves a profile of a running instance, taken from pprof on its
+// internal listener. CPU profiles ("profile") and traces run for
+// -seconds; the others are snapshots. With -stacks, goroutines are saved
+// as readable stack traces instead of a pprof file.
+func profile(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("profile")
+	base := fs.String("url", fmt.Sprintf("http://localhost:%d", cfg.InternalPort),
+		"base URL of the internal listener")
+	seconds := fs.Int("seconds", 30, "how long CPU profiles and traces run")
+	out := fs.String("o", "", "file to write, by default NAME-TIME.pprof")
+	stacks := fs.Bool("stacks", false, "save goroutines as text stack traces")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || !profiles[fs.Arg(0)] || *seconds < 1 {
+		return errUsage
+	}
+	name := fs.Arg(0)
+
+	q := url.Values{}
+	ext := "pprof"
+	switch {
+	case name == "profile" || name == "trace":
+		q.Set("seconds", fmt.Sprint(*seconds))
+		if name == "trace" {
+			ext = "trace"
+		}
+	case *stacks && name == "goroutine":
+		q.Set("debug", "2")
+		ext = "txt"
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102-150405"), ext)
+	}
+
+	u := strings.TrimSuffix(*base, "/") + "/debug/pprof/" + name + "?" + q.Encode()
+	client := &http.Client{Timeout: time.Duration(*seconds)*time.Second + 30*time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", u, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	fmt.Printf("Wrote %s (%d bytes)\n", *out, n)
+	if ext == "pprof" {
+		fmt.Printf("Inspect it with: go tool pprof %s\n", *out)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gastb.ar/config"
+)
+
+// newPprofServer serves pprof like the internal listener, recording the
+// requests it gets
+func newPprofServer(t *testing.T) (*httptest.Server, *[]string) {
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestProfile(t *testing.T) {
+	srv, requests := newPprofServer(t)
+	dir := t.TempDir()
+	cfg := config.DefaultConfig()
+
+	heap := filepath.Join(dir, "heap.pprof")
+	if err := profile(nil, cfg, []string{"-url", srv.URL, "-o", heap, "heap"}); err != nil {
+		t.Fatalf("profile heap: %v", err)
+	}
+	if fi, err := os.Stat(heap); err != nil || fi.Size() == 0 {
+		t.Errorf("the heap profile wasn't written: %v", err)
+	}
+
+	stacks := filepath.Join(dir, "goroutines.txt")
+	if err := profile(nil, cfg, []string{"-url", srv.URL, "-o", stacks, "-stacks", "goroutine"}); err != nil {
+		t.Fatalf("profile goroutine: %v", err)
+	}
+	if b, err := os.ReadFile(stacks); err != nil || !strings.Contains(string(b), "goroutine ") {
+		t.Errorf("the goroutine stacks weren't written as text: %v", err)
+	}
+
+	cpu := filepath.Join(dir, "cpu.pprof")
+	if err := profile(nil, cfg, []string{"-url", srv.URL + "/", "-o", cpu, "-seconds", "1", "profile"}); err != nil {
+		t.Fatalf("profile profile: %v", err)
+	}
+
+	want := []string{
+		"/debug/pprof/heap?",
+		"/debug/pprof/goroutine?debug=2",
+		"/debug/pprof/profile?seconds=1",
+	}
+	if strings.Join(*requests, " ") != strings.Join(want, " ") {
+		t.Errorf("requests = %q, want %q", *requests, want)
+	}
+}
+
+func TestProfileErrors(t *testing.T) {
+	srv, _ := newPprofServer(t)
+	dir := t.TempDir()
+	cfg := config.DefaultConfig()
+
+	for _, args := range [][]string{
+		{},
+		{"cmdline"},
+		{"-seconds", "0", "profile"},
+		{"heap", "goroutine"},
+	} {
+		if err := profile(nil, cfg, args); err != errUsage {
+			t.Errorf("profile %q returned %v, want errUsage", args, err)
+		}
+	}
+
+	// A profile the server doesn't have leaves no file behind
+	out := filepath.Join(dir, "missing.pprof")
+	err := profile(nil, cfg, []string{"-url", srv.URL + "/nowhere", "-o", out, "heap"})
+	if err == nil {
+		t.Error("profile of a missing endpoint succeeded")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("a file was written for a failed download: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// secretsRotate encrypts the sensitive columns with the current key of
+// the config, after which the old keys can be dropped from it
+func secretsRotate(s *models.Services, cfg config.Config, args []string) error {
+	if err := flags("secrets rotate").Parse(args); err != nil {
+		return err
+	}
+	n, err := s.Reencrypt()
+	fmt.Printf("re-encrypted %d records\n", n)
+	return err
+}
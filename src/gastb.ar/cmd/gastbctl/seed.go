@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"gastb.ar/config"
+	"gastb.ar/models"
+)
+
+// seedPassword is the password of every seeded user
+const seedPassword = "password"
+
+// seedUsers are created by seed, with their stocklists
+var seedUsers = []struct {
+	user       models.User
+	stocklists []string
+}{
+	{models.User{Name: "Admin", Email: "admin@example.com", Role: models.RoleAdmin},
+		nil},
+	{models.User{Name: "Ana Acosta", Email: "ana@example.com"},
+		[]string{"Tech", "Dividends"}},
+	{models.User{Name: "Bruno Benítez", Email: "bruno@example.com"},
+		[]string{"Energy"}},
+}
+
+// seed creates demo users and stocklists for development. Users that
+// already exist are left alone, so it can be run again.
+func seed(s *models.Services, cfg config.Config, args []string) error {
+	if err := flags("seed").Parse(args); err != nil {
+		return err
+	}
+	if cfg.IsProd() {
+		return fmt.Errorf("refusing to seed a production database")
+	}
+	for _, su := range seedUsers {
+		if _, err := s.UserService.ByEmail(su.user.Email); err == nil {
+			fmt.Printf("%s exists, skipped\n", su.user.Email)
+			continue
+		} else if err != models.ErrNotFound {
+			return err
+		}
+		user := su.user
+		user.Password = seedPassword
+		if err := s.UserService.Create(&user); err != nil {
+			return err
+		}
+		for _, name := range su.stocklists {
+			list := &models.Stocklist{UserID: user.ID, Name: name}
+			if err := s.StocklistService.Create(list); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Created %s with %d stocklists\n", user.Email, len(su.stocklists))
+	}
+	fmt.Printf("Every seeded user has the password %q.\n", seedPassword)
+	return nil
+}
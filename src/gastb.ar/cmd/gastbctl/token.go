@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+
+	"gastb.ar/config"
+	"gastb.ar/jobs"
+	"gastb.ar/models"
+)
+
+// tokenPurge runs the tokens.purge job right away, deleting expired
+// invites, user tokens and codes, guests, idempotency keys, and old
+// changes and finished jobs
+func tokenPurge(s *models.Services, cfg config.Config, args []string) error {
+	if err := flags("token purge").Parse(args); err != nil {
+		return err
+	}
+	purge := jobs.PurgeHandler(s.InviteService, s.UserService, s.GuestService,
+		s.IdempotencyKeyService, s.ChangeService, s.JobService)
+	return purge(context.Background(), &models.Job{Kind: jobs.PurgeKind})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gastb.ar/config"
+	"gastb.ar/jobs"
+	"gastb.ar/models"
+	"gastb.ar/rand"
+	"gastb.ar/storage"
+	"gastb.ar/webhooks"
+)
+
+// Locks without -for last this long, which is as good as forever
+const lockForever = 100 * 365 * 24 * time.Hour
+
+// userCreate creates a user, with a random password if none is given
+func userCreate(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("user create")
+	email := fs.String("email", "", "email address")
+	name := fs.String("name", "", "name")
+	password := fs.String("password", "", "password; a random one is printed if empty")
+	admin := fs.Bool("admin", false, "make the user an admin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" || fs.NArg() != 0 {
+		return errUsage
+	}
+	generated := *password == ""
+	if generated {
+		p, err := rand.String(12)
+		if err != nil {
+			return err
+		}
+		*password = p
+	}
+	user := &models.User{Name: *name, Email: *email, Password: *password}
+	if *admin {
+		user.Role = models.RoleAdmin
+	}
+	if err := s.UserService.Create(user); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s %s (ID %d).\n", user.Role, user.Email, user.ID)
+	if generated {
+		fmt.Println("Password: " + *password)
+	}
+	return nil
+}
+
+// userPromote makes a user an admin
+func userPromote(s *models.Services, cfg config.Config, args []string) error {
+	email, err := oneArg(flags("user promote"), args)
+	if err != nil {
+		return err
+	}
+	user, err := s.UserService.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	user.Role = models.RoleAdmin
+	if err := s.UserService.Update(user); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now an admin.\n", user.Email)
+	return nil
+}
+
+// userLock keeps a user from logging in and logs them out
+func userLock(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("user lock")
+	d := fs.Duration("for", 0, "how long to lock the account; forever if 0")
+	email, err := oneArg(fs, args)
+	if err != nil {
+		return err
+	}
+	user, err := s.UserService.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	if *d <= 0 {
+		*d = lockForever
+	}
+	until := time.Now().Add(*d)
+	if err := s.UserService.Lock(user.ID, until); err != nil {
+		return err
+	}
+	if *d == lockForever {
+		fmt.Printf("%s is locked until unlocked from /admin/users.\n", user.Email)
+	} else {
+		fmt.Printf("%s is locked until %s.\n", user.Email, until.Format(time.RFC1123))
+	}
+	return nil
+}
+
+// hooks returns a dispatcher enqueueing webhook deliveries for the
+// server's workers to make, since commands don't run the queue
+func hooks(s *models.Services) *webhooks.Dispatcher {
+	return webhooks.NewDispatcher(s.WebhookService, s.NotificationSettingService,
+		jobs.New(s.JobService, slog.Default()))
+}
+
+// userDelete soft deletes a user and has their data purged
+func userDelete(s *models.Services, cfg config.Config, args []string) error {
+	email, err := oneArg(flags("user delete"), args)
+	if err != nil {
+		return err
+	}
+	user, err := s.UserService.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	// The server's workers run the purge
+	queue := jobs.New(s.JobService, slog.Default())
+	s.UserService.SetPurger(jobs.NewUserPurges(s.UserPurgeService, store, queue))
+	if err := s.UserService.Delete(user.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %s (ID %d); their data is being purged.\n", user.Email, user.ID)
+	if err := hooks(s).UserDeleted(user, webhooks.DeletedByAdmin, 0); err != nil {
+		return fmt.Errorf("notifying webhooks: %w", err)
+	}
+	return nil
+}
+
+// userMerge merges a duplicate account into a primary one. Without
+// -force it only shows what would move.
+func userMerge(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("user merge")
+	force := fs.Bool("force", false, "really merge the accounts")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	primary, err := s.UserService.ByEmail(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+	duplicate, err := s.UserService.ByEmail(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(1), err)
+	}
+	if !*force {
+		stocklists, err := s.StocklistService.ByUserID(duplicate.ID)
+		if err != nil {
+			return err
+		}
+		keys, err := s.APIKeyService.ByUserID(duplicate.ID)
+		if err != nil {
+			return err
+		}
+		hooks, err := s.WebhookService.ByUserID(duplicate.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Would move %d stocklists, %d API keys and %d webhooks of %s (ID %d)\n"+
+			"to %s (ID %d) and delete %s. Run again with -force to merge.\n",
+			len(stocklists), len(keys), len(hooks), duplicate.Email, duplicate.ID,
+			primary.Email, primary.ID, duplicate.Email)
+		return nil
+	}
+	if err := s.UserService.Merge(primary.ID, duplicate.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Merged %s (ID %d) into %s (ID %d).\n", duplicate.Email, duplicate.ID,
+		primary.Email, primary.ID)
+	err = hooks(s).UserDeleted(duplicate, webhooks.DeletedByMerge, primary.ID)
+	if err != nil {
+		return fmt.Errorf("notifying webhooks: %w", err)
+	}
+	return nil
+}
+
+// userPurges shows the progress of the latest purges of deleted users'
+// data
+func userPurges(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("user purges")
+	n := fs.Int("n", 20, "number of purges to show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	purges, err := s.UserPurgeService.LatestPurges(*n)
+	if err != nil {
+		return err
+	}
+	if len(purges) == 0 {
+		fmt.Println("No purges.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tSTARTED\tSTATUS\tSTOCKLISTS\tATTACHMENTS\tWEBHOOKS\tAPI KEYS\tSESSIONS")
+	for _, p := range purges {
+		status := "done"
+		if p.FinishedAt == nil {
+			status = "running: " + p.Step
+			if p.Step == "" {
+				status = "pending"
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", p.UserID,
+			p.CreatedAt.Format(time.RFC3339), status, p.Stocklists, p.Attachments,
+			p.Webhooks, p.APIKeys, p.Sessions)
+	}
+	return w.Flush()
+}
+
+// userImport creates or invites the users of a CSV file with an email
+// column and optional name and role columns. Every row is checked first;
+// if any is invalid, nothing is imported. -dry-run stops after the
+// report.
+func userImport(s *models.Services, cfg config.Config, args []string) error {
+	fs := flags("user import")
+	dryRun := fs.Bool("dry-run", false, "report what would change without changing anything")
+	invite := fs.Bool("invite", false, "invite the users rather than creating accounts")
+	batch := fs.Int("batch", 100, "rows imported per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// Flags may follow the file too
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+	file := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	rows, err := readImportFile(file)
+	if err != nil {
+		return err
+	}
+	results, err := s.CheckImport(rows, *invite)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, res := range results {
+		counts[res.Action]++
+		switch res.Action {
+		case models.ImportInvalid:
+			fmt.Printf("line %d: %s: %s\n", res.Row.Line, res.Row.Email,
+				strings.TrimPrefix(res.Err.Error(), "models: "))
+		case models.ImportSkip:
+			fmt.Printf("line %d: %s: already has an account\n", res.Row.Line, res.Row.Email)
+		}
+	}
+	fmt.Printf("%d to create, %d to invite, %d to skip, %d invalid.\n",
+		counts[models.ImportCreate], counts[models.ImportInvite],
+		counts[models.ImportSkip], counts[models.ImportInvalid])
+	if counts[models.ImportInvalid] > 0 {
+		return errors.New("fix the invalid rows first; nothing was imported")
+	}
+	if *dryRun {
+		return nil
+	}
+
+	if err := s.Import(results, *batch); err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(cfg.BaseURL, "/")
+	for _, res := range results {
+		switch {
+		case res.User != nil:
+			fmt.Printf("Created %s %s (ID %d).\n", res.User.Role, res.User.Email, res.User.ID)
+		case res.Invite != nil:
+			fmt.Printf("Invited %s: %s/signup?invite=%s\n", res.Row.Email, base, res.Invite.Code)
+		}
+	}
+	return nil
+}
+
+// readImportFile reads the rows of a CSV import file. The first line
+// names the columns, in any order and case.
+func readImportFile(name string) ([]models.ImportRow, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading the header: %w", name, err)
+	}
+	columns := map[string]int{"email": -1, "name": -1, "role": -1}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		if _, ok := columns[h]; ok {
+			columns[h] = i
+		}
+	}
+	if columns["email"] < 0 {
+		return nil, fmt.Errorf("%s: the header has no email column", name)
+	}
+	field := func(record []string, column string) string {
+		i := columns[column]
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	var rows []models.ImportRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		line, _ := r.FieldPos(0)
+		rows = append(rows, models.ImportRow{
+			Line:  line,
+			Email: field(record, "email"),
+			Name:  field(record, "name"),
+			Role:  field(record, "role"),
+		})
+	}
+}
@@ -1,47 +0,0 @@
-package main
-
-import "fmt"
-
-type PostgresConfig struct {
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	User     string `json:"user"`
-	Password string `json:"password"`
-	Name     string `json:"name"`
-}
-
-func (c PostgresConfig) Dialect() string {
-	return "postgres"
-}
-
-func (c PostgresConfig) ConnectionInfo() string {
-	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", c.Host, c.Port, c.User, c.Password, c.Name)
-}
-
-func DefaultPostgresConfig() PostgresConfig {
-	return PostgresConfig{
-		Host:     "localhost",
-		Port:     5432,
-		User:     "postgres",
-		Password: "password-here",
-		Name:     "gastb",
-	}
-}
-
-type Config struct {
-	Port int
-	Env  string
-	HMAC string
-}
-
-func (c Config) IsProd() bool {
-	return c.Env == "prod"
-}
-
-func DefaultConfig() Config {
-	return Config{
-		Port: 8501,
-		Env:  "dev",
-		HMAC: "secret-key-here",
-	}
-}
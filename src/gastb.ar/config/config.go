@@ -0,0 +1,360 @@
+package config
+
+// The config package holds the settings shared by the web server and the
+// gastbctl admin tool.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gastb.ar/billing"
+	"gastb.ar/cache"
+	"gastb.ar/captcha"
+	"gastb.ar/email"
+	"gastb.ar/encrypt"
+	"gastb.ar/errreport"
+	"gastb.ar/eventbus"
+	"gastb.ar/hash"
+	"gastb.ar/metrics"
+	"gastb.ar/storage"
+)
+
+type PostgresConfig struct {
+	// Host may list several hosts separated by commas, such as a primary
+	// and its standbys; connections go to the first one that is usable
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Ports, if set, are the ports of the hosts in Host, one for each in
+	// the same order, for hosts that don't all listen on Port
+	Ports    []int  `json:"ports"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+	// PreparedStatements reuses prepared statements for the hot user
+	// lookups. Turn it off behind a pooler in transaction mode, such as
+	// PgBouncer, which can't keep statements across transactions.
+	PreparedStatements bool `json:"prepared_statements"`
+	// StatementTimeout makes Postgres cancel statements running longer,
+	// so a runaway query can't hold a connection forever. Zero means no
+	// timeout.
+	StatementTimeout time.Duration `json:"statement_timeout"`
+	// RowLevelSecurity has Postgres enforce that requests only reach
+	// the stocklists of their user, with policies created by the
+	// migration, as a safety net under the application's checks. The
+	// site's connections only see the stocklists of the user a query
+	// runs for, and public ones; those of AdminConnectionInfo, for
+	// migrations and gastbctl, see them all.
+	RowLevelSecurity bool `json:"row_level_security"`
+	// TargetSessionAttrs is "read-write" to skip hosts that only take
+	// reads, so that after a failover connections go to the new
+	// primary; empty or "any" takes any host
+	TargetSessionAttrs string `json:"target_session_attrs"`
+	// WaitTimeout is how long startup waits for the database to take
+	// connections before giving up
+	WaitTimeout time.Duration `json:"wait_timeout"`
+}
+
+func (c PostgresConfig) Dialect() string {
+	return "postgres"
+}
+
+func (c PostgresConfig) ConnectionInfo() string {
+	port := strconv.Itoa(c.Port)
+	if len(c.Ports) > 0 {
+		ports := make([]string, len(c.Ports))
+		for i, p := range c.Ports {
+			ports[i] = strconv.Itoa(p)
+		}
+		port = strings.Join(ports, ",")
+	}
+	info := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		quoteConnectionValue(c.Host), port, quoteConnectionValue(c.User),
+		quoteConnectionValue(c.Password), quoteConnectionValue(c.Name))
+	if c.StatementTimeout > 0 {
+		// lib/pq passes settings it doesn't know on to the server
+		info += fmt.Sprintf(" statement_timeout=%d", c.StatementTimeout.Milliseconds())
+	}
+	if c.TargetSessionAttrs != "" {
+		info += " target_session_attrs=" + c.TargetSessionAttrs
+	}
+	return info
+}
+
+// AdminConnectionInfo is ConnectionInfo for the work spanning users,
+// such as migrations and gastbctl: with RowLevelSecurity, it sets
+// app.bypass_rls, which the policies let through
+func (c PostgresConfig) AdminConnectionInfo() string {
+	info := c.ConnectionInfo()
+	if c.RowLevelSecurity {
+		// See tenantPolicies in models
+		info += " app.bypass_rls=on"
+	}
+	return info
+}
+
+// quoteConnectionValue single-quotes a value of a connection string,
+// escaping backslashes and quotes, so that spaces and quotes in it can't
+// end it or add other settings
+func quoteConnectionValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+func DefaultPostgresConfig() PostgresConfig {
+	return PostgresConfig{
+		Host:     "localhost",
+		Port:     5432,
+		User:     "postgres",
+		Password: "password-here",
+		Name:     "gastb",
+
+		PreparedStatements: true,
+		StatementTimeout:   30 * time.Second,
+		WaitTimeout:        time.Minute,
+	}
+}
+
+type Config struct {
+	Port int
+	// InternalPort serves operational endpoints (health checks,
+	// metrics) that should not be exposed to the internet
+	InternalPort int
+	// RPCToken is the bearer token other backend services send to the
+	// gRPC API on InternalPort, see the rpc package; empty turns it off
+	RPCToken string
+	Env      string
+	HMAC     string
+	// Encryption holds the keys sensitive columns are encrypted with
+	Encryption EncryptionConfig
+	// LogLevel is one of debug, info, warn or error. It can be changed at
+	// runtime on the internal listener's /loglevel endpoint.
+	LogLevel string
+	// OTLPEndpoint is the OTLP/HTTP traces URL of an OpenTelemetry
+	// collector; empty disables tracing
+	OTLPEndpoint string
+	// TraceSampleRatio is the fraction of new traces that are recorded
+	TraceSampleRatio float64
+	// StatsD pushes metrics to a StatsD or DogStatsD agent, besides
+	// serving them on the internal listener's /metrics
+	StatsD metrics.StatsDConfig
+	// ErrorReporting sends panics and server errors to Sentry or a
+	// compatible service; its environment defaults to Env
+	ErrorReporting errreport.Config
+	// CORS settings for the /api routes. No origins means browsers on
+	// other origins can not call the API.
+	CORSOrigins          []string
+	CORSMethods          []string
+	CORSAllowCredentials bool
+	// RememberTTL is how long users stay logged in
+	RememberTTL time.Duration
+	// CookieSameSite is the SameSite attribute of the remember cookie:
+	// lax, strict or none
+	CookieSameSite string
+	// InviteOnly requires an invite from an admin to sign up
+	InviteOnly bool
+	// BlockDisposableEmail refuses email addresses whose domain is on the
+	// blocklist admins keep through the API
+	BlockDisposableEmail bool
+	// PasswordHistory is how many of a user's latest passwords, the
+	// current one included, they can't change back to; 0 allows any
+	PasswordHistory int
+	// PasswordResetLimit is how many password reset emails one address,
+	// and one IP address, can ask for per hour; 0 allows any number
+	PasswordResetLimit int
+	// SudoWindow is how long after confirming their password, or
+	// logging in, users can take sensitive actions such as changing
+	// their email address without confirming it again
+	SudoWindow time.Duration
+	// Schedules maps job kinds to the cron expressions they run on
+	Schedules map[string]string
+	// Maintenance starts the site in maintenance mode until an admin
+	// turns it off; once toggled, the setting in the database wins
+	Maintenance bool
+	// Storage holds uploaded avatars and attachments
+	Storage storage.Config
+	// Mail configures outgoing email; with no backend, messages are
+	// only logged
+	Mail email.Config
+	// BaseURL is the public address of the site, used in links sent by
+	// email
+	BaseURL string
+	// Backup configures gastbctl backup and restore
+	Backup BackupConfig
+	// Exports configures where data exports are kept
+	Exports ExportConfig
+	// PoliciesDir holds the versions of the policy documents users must
+	// accept, see the policies package. Without documents, nothing is
+	// asked of users.
+	PoliciesDir string
+	// GeoIPFile lists the countries of IP address ranges, see the geoip
+	// package, to show where sessions are from; empty shows no locations
+	GeoIPFile string
+	// SlowQueryThreshold is how long a database operation takes before
+	// it is logged and listed on the admin dashboard; 0 turns it off.
+	SlowQueryThreshold time.Duration
+	// ExplainSlowQueries captures the plans of slow queries for the
+	// dashboard. Slow reads are run again under EXPLAIN ANALYZE, adding
+	// load when the database is already slow, so it is off by default.
+	ExplainSlowQueries bool
+	// DBLogLevel is what the database layer logs: silent for nothing,
+	// error for failed operations, warn for those and the operations
+	// slower than SlowQueryThreshold, and info for every query too
+	DBLogLevel string
+	// OIDC configures single sign-on through an OpenID Connect
+	// provider; it is off without an issuer
+	OIDC OIDCConfig
+	// Captcha adds hCaptcha or Turnstile to signup and password reset
+	// requests; it is off without a provider
+	Captcha captcha.Config
+	// Billing sets the plans users can be on, and sells them through
+	// Stripe if it has a secret key
+	Billing billing.Config
+	// IdempotencyRetention is how long the responses of API requests
+	// made with an Idempotency-Key header are kept, for retries to get
+	// them again instead of repeating the request
+	IdempotencyRetention time.Duration
+	// EventBus publishes the changes of the outbox to NATS or Kafka; it
+	// is off without a backend
+	EventBus eventbus.Config
+	// Cache keeps short-lived values in memory, or in Redis so that
+	// several instances share them
+	Cache cache.Config
+	// SessionCacheTTL is how long sessions looked up by remember token
+	// are cached, saving a query on most requests; 0 turns it off. With
+	// several instances, Cache must be Redis, or logging out on one
+	// leaves the session usable on the others for up to the TTL.
+	SessionCacheTTL time.Duration
+	// ProfileCacheTTL is how long public profile pages are cached for
+	// visitors who aren't logged in; 0 turns it off. Like sessions, the
+	// pages are only dropped from the other instances with Redis.
+	ProfileCacheTTL time.Duration
+}
+
+// OIDCConfig configures single sign-on. The provider must have
+// BaseURL + "/login/sso/callback" registered as a redirect URI.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Domain limits single sign-on to email addresses of a domain, whose
+	// users get an account on their first sign-in; empty lets anyone the
+	// provider verified sign in
+	Domain string
+	// Enforce disables password logins for addresses of Domain
+	Enforce bool
+	// SCIMToken is the bearer token the provider sends to /scim/v2 to
+	// create, update and deactivate users; empty turns SCIM off
+	SCIMToken string
+}
+
+// EncryptionConfig holds the master keys of column encryption, see the
+// encrypt package. To rotate keys, add a new one, make it Current,
+// run gastbctl secrets rotate, then drop the old one.
+type EncryptionConfig struct {
+	// Keys maps key IDs to base64 encoded 32 byte keys. Without keys,
+	// a key derived from HMAC is used, under the ID "hmac".
+	Keys map[string]string
+	// Current is the ID of the key new values are encrypted with
+	Current string
+}
+
+// Keyring returns the keyring of column encryption
+func (c Config) Keyring() (*encrypt.Keyring, error) {
+	if len(c.Encryption.Keys) == 0 {
+		return encrypt.NewKeyring(encrypt.Key{ID: "hmac", Secret: hash.DeriveKey(c.HMAC, "columns")})
+	}
+	var current encrypt.Key
+	var old []encrypt.Key
+	for id, encoded := range c.Encryption.Keys {
+		key, err := encrypt.ParseKey(id, encoded)
+		if err != nil {
+			return nil, err
+		}
+		if id == c.Encryption.Current {
+			current = key
+		} else {
+			old = append(old, key)
+		}
+	}
+	if current.ID == "" {
+		return nil, fmt.Errorf("config: no encryption key %q", c.Encryption.Current)
+	}
+	return encrypt.NewKeyring(current, old...)
+}
+
+// BackupConfig configures database backups
+type BackupConfig struct {
+	// Storage keeps the archives: a local directory, or an S3 bucket to
+	// get them off the database host
+	Storage storage.Config
+	// Keep is how many archives are kept; older ones are deleted after
+	// every backup. 0 keeps them all.
+	Keep int
+}
+
+// ExportConfig configures data exports
+type ExportConfig struct {
+	// Storage keeps exports for clients to download straight from it. It
+	// must be an S3 bucket; with no Backend, exports are streamed
+	// through the server instead.
+	Storage storage.Config
+	// LinkTTL is how long download links work, at most 7 days
+	LinkTTL time.Duration
+}
+
+func (c Config) IsProd() bool {
+	return c.Env == "prod"
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:         8501,
+		InternalPort: 8502,
+		Env:          "dev",
+		HMAC:         "secret-key-here",
+		LogLevel:     "info",
+
+		TraceSampleRatio: 1,
+		CORSMethods:      []string{"GET", "POST", "PUT", "DELETE"},
+		RememberTTL:      30 * 24 * time.Hour,
+		CookieSameSite:   "lax",
+		Schedules: map[string]string{
+			"tokens.purge": "0 3 * * *",
+			"digest.send":  "0 8 * * 1",
+		},
+		Storage: storage.Config{
+			Backend: "local",
+			Dir:     "uploads",
+		},
+		Mail: email.Config{
+			From: "Gastb <no-reply@gastb.ar>",
+		},
+		BaseURL: "http://localhost:8501",
+		Backup: BackupConfig{
+			Storage: storage.Config{
+				Backend: "local",
+				Dir:     "backups",
+			},
+			Keep: 14,
+		},
+		Exports: ExportConfig{
+			LinkTTL: 15 * time.Minute,
+		},
+		PasswordHistory:    5,
+		PasswordResetLimit: 3,
+		SudoWindow:         10 * time.Minute,
+		PoliciesDir:        "policies",
+		SlowQueryThreshold: 200 * time.Millisecond,
+		DBLogLevel:         "warn",
+		Billing: billing.Config{
+			Plans:       []billing.Plan{{Name: "free"}},
+			DefaultPlan: "free",
+		},
+		IdempotencyRetention: 24 * time.Hour,
+		Cache: cache.Config{
+			Backend: "memory",
+		},
+		ProfileCacheTTL: 30 * time.Second,
+	}
+}
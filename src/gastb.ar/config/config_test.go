@@ -0,0 +1,35 @@
+package config
+
+import "testing"
+
+func TestConnectionInfo(t *testing.T) {
+	c := PostgresConfig{
+		Host:     "db1,db2",
+		Port:     5432,
+		User:     "gastb",
+		Password: `it's a \secret sslmode=require`,
+		Name:     "gastb",
+	}
+	want := `host='db1,db2' port=5432 user='gastb' ` +
+		`password='it\'s a \\secret sslmode=require' dbname='gastb' sslmode=disable`
+	if got := c.ConnectionInfo(); got != want {
+		t.Errorf("ConnectionInfo() =\n%s\nwant\n%s", got, want)
+	}
+
+	c.Password = ""
+	c.Ports = []int{5432, 6432}
+	c.RowLevelSecurity = true
+	c.TargetSessionAttrs = "read-write"
+	want = `host='db1,db2' port=5432,6432 user='gastb' password='' dbname='gastb' sslmode=disable` +
+		` target_session_attrs=read-write`
+	if got := c.ConnectionInfo(); got != want {
+		t.Errorf("ConnectionInfo() =\n%s\nwant\n%s", got, want)
+	}
+	if got := c.AdminConnectionInfo(); got != want+" app.bypass_rls=on" {
+		t.Errorf("AdminConnectionInfo() = %s, want the bypass", got)
+	}
+	c.RowLevelSecurity = false
+	if got := c.AdminConnectionInfo(); got != want {
+		t.Errorf("AdminConnectionInfo() without row level security = %s", got)
+	}
+}
@@ -1,7 +1,7 @@
 package context
 
 // The context package wraps the standard context package to add 
-// user information, stored in private keys, to requests.
+// user information and request IDs, stored in private keys, to requests.
 
 import (
 	"context"
@@ -13,7 +13,12 @@ type privateKey string
 
 // Declare unexported private keys
 const (
-	userKey privateKey = "user"
+	userKey      privateKey = "user"
+	sessionKey   privateKey = "session"
+	apiKeyKey    privateKey = "api_key"
+	requestIDKey privateKey = "request_id"
+	cspNonceKey  privateKey = "csp_nonce"
+	localeKey    privateKey = "locale"
 )
 
 // WithUser adds user information to context.userKey
@@ -30,3 +35,78 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithSession adds the session the user is logged in with to
+// context.sessionKey
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session allows the session of the current request to be read from
+// context. It returns nil for requests not made with the remember cookie,
+// such as those with API keys.
+func Session(ctx context.Context) *models.Session {
+	if session, ok := ctx.Value(sessionKey).(*models.Session); ok {
+		return session
+	}
+	return nil
+}
+
+// WithAPIKey adds the API key a request was authenticated with to
+// context.apiKeyKey
+func WithAPIKey(ctx context.Context, apiKey *models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey, apiKey)
+}
+
+// APIKey allows the API key of the current request to be read from
+// context. It returns nil for requests not made with an API key.
+func APIKey(ctx context.Context) *models.APIKey {
+	if apiKey, ok := ctx.Value(apiKeyKey).(*models.APIKey); ok {
+		return apiKey
+	}
+	return nil
+}
+
+// WithRequestID adds the ID of the current request to context.requestIDKey
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID allows the ID of the current request to be read from context.
+// It returns an empty string if none was set.
+func RequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// WithCSPNonce adds the Content-Security-Policy nonce of the current
+// request to context.cspNonceKey
+func WithCSPNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, cspNonceKey, nonce)
+}
+
+// CSPNonce allows the Content-Security-Policy nonce of the current request
+// to be read from context. It returns an empty string if none was set.
+func CSPNonce(ctx context.Context) string {
+	if nonce, ok := ctx.Value(cspNonceKey).(string); ok {
+		return nonce
+	}
+	return ""
+}
+
+// WithLocale adds the language the current request is answered in to
+// context.localeKey
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey, locale)
+}
+
+// Locale allows the language of the current request to be read from
+// context. It returns an empty string if none was set.
+func Locale(ctx context.Context) string {
+	if locale, ok := ctx.Value(localeKey).(string); ok {
+		return locale
+	}
+	return ""
+}
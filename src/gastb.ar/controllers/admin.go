@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/context"
+	"gastb.ar/flash"
+	"gastb.ar/forms"
+	"gastb.ar/jobs"
+	"gastb.ar/middleware"
+	"gastb.ar/models"
+	"gastb.ar/views"
+)
+
+// Maximum number of rows in admin listings
+const adminPageSize = 50
+
+// AdminController serves the /admin dashboard. Its routes must be wrapped
+// in the RequireAdmin middleware.
+type AdminController struct {
+	IndexView      *views.View
+	UsersView      *views.View
+	EmailsView     *views.View
+	SuppressedView *views.View
+	services  *models.Services
+	scheduler *jobs.Scheduler
+	maintenance *middleware.Maintenance
+}
+
+// NewAdminController creates a controller on top of initialized services,
+// the job scheduler and the maintenance mode middleware.
+func NewAdminController(services *models.Services, scheduler *jobs.Scheduler,
+	maintenance *middleware.Maintenance) *AdminController {
+	return &AdminController {
+		IndexView:      views.NewView("bootstrap", "admin/index"),
+		UsersView:      views.NewView("bootstrap", "admin/users"),
+		EmailsView:     views.NewView("bootstrap", "admin/emails"),
+		SuppressedView: views.NewView("bootstrap", "admin/suppressed"),
+		services:       services,
+		scheduler:      scheduler,
+		maintenance:    maintenance,
+	}
+}
+
+// InviteForm is posted to create an invite
+type InviteForm struct {
+	Email string `schema:"email" validate:"email"`
+}
+
+// Index handles GET /admin, showing basic metrics, recent invites and
+// the status of scheduled jobs
+func (aC *AdminController) Index(w http.ResponseWriter, r *http.Request) {
+	stats, err := aC.services.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invites, err := aC.services.InviteService.Recent(10)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	schedule, err := aC.scheduler.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Stats       models.Stats
+		Invites     []models.Invite
+		Schedule    []jobs.Status
+		SlowQueries []models.SlowQuery
+		Now         time.Time
+	}{stats, invites, schedule, aC.services.SlowQueries(), time.Now()}
+	if err := aC.IndexView.Render(w, r, data); err != nil {
+		panic(err)
+	}
+}
+
+// UserFilters are the filters of the admin user search, read from the
+// query string. Verified and Locked are "yes", "no" or empty, and dates
+// are YYYY-MM-DD in UTC, the days included. Empty filters match every
+// user.
+type UserFilters struct {
+	Q           string
+	Verified    string
+	Role        string
+	Locked      string
+	CreatedFrom string
+	CreatedTo   string
+	LoginFrom   string
+	LoginTo     string
+}
+
+// errInvalidDate is returned for user filters with a malformed date
+var errInvalidDate = errors.New("controllers: dates must be YYYY-MM-DD")
+
+func newUserFilters(v url.Values) UserFilters {
+	return UserFilters{
+		Q:           v.Get("q"),
+		Verified:    v.Get("verified"),
+		Role:        v.Get("role"),
+		Locked:      v.Get("locked"),
+		CreatedFrom: v.Get("created_from"),
+		CreatedTo:   v.Get("created_to"),
+		LoginFrom:   v.Get("login_from"),
+		LoginTo:     v.Get("login_to"),
+	}
+}
+
+// query turns the filters into a search query
+func (f UserFilters) query() (models.SearchQuery, error) {
+	q := models.SearchQuery{Text: f.Q, Role: f.Role, Limit: adminPageSize}
+	q.Verified = yesNo(f.Verified)
+	q.Locked = yesNo(f.Locked)
+	// The To dates include their day, so the ranges end the day after
+	dates := []struct {
+		value   string
+		dst     *time.Time
+		nextDay bool
+	}{
+		{f.CreatedFrom, &q.CreatedAfter, false},
+		{f.CreatedTo, &q.CreatedBefore, true},
+		{f.LoginFrom, &q.LastLoginAfter, false},
+		{f.LoginTo, &q.LastLoginBefore, true},
+	}
+	for _, d := range dates {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", d.value)
+		if err != nil {
+			return q, errInvalidDate
+		}
+		if d.nextDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		*d.dst = t
+	}
+	return q, nil
+}
+
+// yesNo returns a pointer to true for "yes", to false for "no", and nil
+// otherwise
+func yesNo(s string) *bool {
+	switch s {
+	case "yes":
+		b := true
+		return &b
+	case "no":
+		b := false
+		return &b
+	}
+	return nil
+}
+
+// Users handles GET /admin/users, listing the users matching the
+// filters in the query string
+func (aC *AdminController) Users(w http.ResponseWriter, r *http.Request) {
+	filters := newUserFilters(r.URL.Query())
+	var users []models.User
+	var message string
+	query, err := filters.query()
+	if err == nil {
+		users, err = aC.services.UserService.Search(query)
+	}
+	switch err {
+	case nil:
+	case errInvalidDate:
+		message = "Dates must be written as YYYY-MM-DD."
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Filters UserFilters
+		Roles   []string
+		Error   string
+		Users   []models.User
+	}{filters, []string{models.RoleUser, models.RoleAdmin}, message, users}
+	if err := aC.UsersView.Render(w, r, data); err != nil {
+		panic(err)
+	}
+}
+
+// Emails handles GET /admin/emails, listing recent email deliveries,
+// optionally only those with the status in the status parameter
+func (aC *AdminController) Emails(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	emails, err := aC.services.EmailDeliveryService.Recent(status, adminPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Status   string
+		Statuses []string
+		Emails   []models.EmailDelivery
+	}{status, models.EmailStatuses, emails}
+	if err := aC.EmailsView.Render(w, r, data); err != nil {
+		panic(err)
+	}
+}
+
+// Suppressed handles GET /admin/suppressed, listing the users whose email
+// address is undeliverable
+func (aC *AdminController) Suppressed(w http.ResponseWriter, r *http.Request) {
+	users, err := aC.services.UserService.Undeliverable(adminPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Users []models.User
+	}{users}
+	if err := aC.SuppressedView.Render(w, r, data); err != nil {
+		panic(err)
+	}
+}
+
+// AllowEmail handles POST /admin/users/{id}/allow-email, sending email to
+// a suppressed address again
+func (aC *AdminController) AllowEmail(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err := aC.services.UserService.AllowEmail(id); err {
+	case nil:
+		flash.Success(w, "Email allowed again.")
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/suppressed", http.StatusFound)
+}
+
+// Unlock handles POST /admin/users/{id}/unlock, releasing an account locked
+// after too many failed logins
+func (aC *AdminController) Unlock(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err := aC.services.UserService.Unlock(id); err {
+	case nil:
+		flash.Success(w, "Account unlocked.")
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// CreateInvite handles POST /admin/invites. The signup link is shown once,
+// in a flash message.
+func (aC *AdminController) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	var form InviteForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs != nil {
+		flash.Error(w, "Email "+errs["email"])
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+	admin := context.User(r.Context())
+	invite, err := aC.services.InviteService.Create(admin.ID, form.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flash.Success(w, "Invite created. Signup link: /signup?invite="+invite.Code)
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+//
+// Admin API
+//
+
+type maintenanceJSON struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// Maintenance handles GET /api/v1/admin/maintenance
+func (aC *AdminController) Maintenance(w http.ResponseWriter, r *http.Request) {
+	on, message := aC.maintenance.State()
+	writeJSON(w, http.StatusOK, maintenanceJSON{Enabled: on, Message: message})
+}
+
+// SetMaintenance handles PUT /api/v1/admin/maintenance, turning
+// maintenance mode on or off. Other instances follow within seconds.
+func (aC *AdminController) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceJSON
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	value := "off"
+	if req.Enabled {
+		value = "on"
+	}
+	settings := aC.services.SettingService
+	if err := settings.Set(models.SettingMaintenanceMessage, req.Message); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := settings.Set(models.SettingMaintenance, value); err != nil {
+		writeError(w, err)
+		return
+	}
+	aC.maintenance.Forget()
+	writeJSON(w, http.StatusOK, req)
+}
+
+// blockedDomainsRequest is the body of POST /api/v1/admin/blocked-domains
+type blockedDomainsRequest struct {
+	Domains []string `json:"domains"`
+}
+
+type blockedDomainJSON struct {
+	Domain    string    `json:"domain"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlockedDomains handles GET /api/v1/admin/blocked-domains
+func (aC *AdminController) BlockedDomains(w http.ResponseWriter, r *http.Request) {
+	domains, err := aC.services.BlockedDomainService.BlockedDomains()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]blockedDomainJSON, 0, len(domains))
+	for _, d := range domains {
+		data = append(data, blockedDomainJSON{d.Domain, d.CreatedAt})
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// BlockDomains handles POST /api/v1/admin/blocked-domains, adding domains
+// to the blocklist, and responds with the whole list
+func (aC *AdminController) BlockDomains(w http.ResponseWriter, r *http.Request) {
+	var req blockedDomainsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(req.Domains) == 0 {
+		writeError(w, requestError("domains must list the domains to block"))
+		return
+	}
+	if err := aC.services.BlockedDomainService.BlockDomains(req.Domains); err != nil {
+		writeError(w, err)
+		return
+	}
+	aC.BlockedDomains(w, r)
+}
+
+// UnblockDomain handles DELETE /api/v1/admin/blocked-domains/{domain}
+func (aC *AdminController) UnblockDomain(w http.ResponseWriter, r *http.Request) {
+	err := aC.services.BlockedDomainService.UnblockDomain(mux.Vars(r)["domain"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
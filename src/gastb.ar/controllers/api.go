@@ -0,0 +1,797 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/billing"
+	"gastb.ar/captcha"
+	"gastb.ar/context"
+	"gastb.ar/errreport"
+	"gastb.ar/httperror"
+	"gastb.ar/images"
+	"gastb.ar/models"
+	"gastb.ar/rand"
+	"gastb.ar/storage"
+	"gastb.ar/webhooks"
+)
+
+// APIController serves the versioned JSON API under /api/v1.
+//
+// Every response is a JSON envelope {"data": ..., "error": ...} where
+// exactly one of the two fields is non-null. Errors are RFC 7807 problem
+// details that also carry the envelope fields.
+type APIController struct {
+	us *models.UserService
+	ss *models.StocklistService
+	as *models.APIKeyService
+	hooks *webhooks.Dispatcher
+
+	// exports, if set, keeps exports for clients to download with a
+	// presigned link that works for exportTTL
+	exports   storage.Storage
+	exportTTL time.Duration
+
+	// captcha, if set, checks signups
+	captcha captcha.Verifier
+	// referrals, if set, attributes signups to referral codes
+	referrals *models.ReferralService
+	// profileCache, if set, caches public profile pages
+	profileCache *ProfileCache
+}
+
+// NewAPIController creates a controller on top of initialized services.
+func NewAPIController(us *models.UserService, ss *models.StocklistService,
+	as *models.APIKeyService, hooks *webhooks.Dispatcher) *APIController {
+	return &APIController {
+		us:    us,
+		ss:    ss,
+		as:    as,
+		hooks: hooks,
+	}
+}
+
+// SetCaptcha makes signups through the API pass a captcha checked by v
+func (a *APIController) SetCaptcha(v captcha.Verifier) {
+	a.captcha = v
+}
+
+// SetReferrals makes signups through the API with a referral code count
+// towards its owner's rewards
+func (a *APIController) SetReferrals(rs *models.ReferralService) {
+	a.referrals = rs
+}
+
+// SetProfileCache drops cached profile pages when a username or a
+// public stocklist changes through the API
+func (a *APIController) SetProfileCache(pc *ProfileCache) {
+	a.profileCache = pc
+}
+
+// SetExportStorage makes exports be written to store, a storage that
+// hands out presigned links such as an S3 bucket, and clients redirected
+// to a link that works for ttl, rather than streamed through the server
+func (a *APIController) SetExportStorage(store storage.Storage, ttl time.Duration) error {
+	if _, ok := store.(storage.Presigner); !ok {
+		return errors.New("controllers: export storage can't presign download links")
+	}
+	a.exports, a.exportTTL = store, ttl
+	return nil
+}
+
+//
+// 1. Envelope, errors and request helpers
+//
+
+type envelope struct {
+	Data  interface{} `json:"data"`
+	Error *apiError   `json:"error"`
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// Maximum size in bytes of a JSON request body
+const maxBodyBytes = 1 << 20
+
+// writeJSON writes data wrapped in an envelope with the given status code
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(envelope{Data: data})
+}
+
+// writeError writes an error envelope. The status code is picked from the
+// error with statusFor; unexpected errors are not exposed to clients.
+func writeError(w http.ResponseWriter, err error) {
+	status := statusFor(err)
+	msg := http.StatusText(status)
+	if status != http.StatusInternalServerError {
+		msg = publicMessage(err)
+	} else {
+		errreport.SetCause(w, err)
+	}
+	writeErrorStatus(w, status, msg)
+}
+
+// writeErrorStatus writes an RFC 7807 problem, which carries the error
+// member of the envelope too
+func writeErrorStatus(w http.ResponseWriter, status int, msg string) {
+	httperror.Write(w, httperror.New(status, msg))
+}
+
+// requestError is returned when a request can not be decoded or is
+// missing parameters
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+// statusFor maps errors returned by the models package to HTTP status codes
+func statusFor(err error) int {
+	switch err {
+	case models.ErrNotFound, models.ErrNotMember:
+		return http.StatusNotFound
+	case models.ErrInvalidID, models.ErrQueryRequired:
+		return http.StatusBadRequest
+	case models.ErrInvalidPassword, models.ErrInvalidAPIKey:
+		return http.StatusUnauthorized
+	case models.ErrAccountLocked, models.ErrEventAdminOnly, models.ErrSSORequired,
+		models.ErrAccountDeactivated, models.ErrOrgForbidden, models.ErrOrgInviteEmail:
+		return http.StatusForbidden
+	case models.ErrEmailTaken, models.ErrUsernameTaken, models.ErrConflict,
+		models.ErrLastOwner, models.ErrNoSeats, models.ErrAlreadyMember:
+		return http.StatusConflict
+	case models.ErrEmailRequired, models.ErrEmailInvalid, models.ErrEmailNotAllowed,
+		models.ErrUsernameRequired,
+		models.ErrDomainInvalid, models.ErrUsernameInvalid, models.ErrUsernameReserved,
+		models.ErrPasswordTooShort, models.ErrNameRequired,
+		models.ErrURLInvalid, models.ErrURLNotPublic, models.ErrEventsInvalid,
+		models.ErrInvalidCode, models.ErrCodeExpired,
+		models.ErrSlackURL, models.ErrDiscordURL,
+		models.ErrThemeInvalid, models.ErrCurrencyInvalid,
+		models.ErrRowsPerPageInvalid, models.ErrDefaultStocklist,
+		models.ErrInvalidGuest, models.ErrGuestLimit,
+		models.ErrOrgRoleInvalid, models.ErrInvalidOrgInvite,
+		models.ErrQuotaExceeded, billing.ErrUnknownPlan,
+		captcha.ErrMissing, captcha.ErrFailed,
+		images.ErrUnsupported, images.ErrDimensions, errFileType:
+		return http.StatusUnprocessableEntity
+	case images.ErrTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case models.ErrCursorExpired:
+		return http.StatusGone
+	}
+	if _, ok := err.(requestError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// publicMessage strips the package prefix from models, images and
+// captcha errors
+func publicMessage(err error) string {
+	msg := strings.TrimPrefix(err.Error(), "models: ")
+	msg = strings.TrimPrefix(msg, "images: ")
+	return strings.TrimPrefix(msg, "captcha: ")
+}
+
+// decodeJSON decodes a JSON request body into dst, rejecting unknown fields
+func decodeJSON(r *http.Request, dst interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return requestError("invalid JSON body: " + err.Error())
+	}
+	return nil
+}
+
+// idParam parses the {id} route variable
+func idParam(r *http.Request) (uint, error) {
+	return uintParam(r, "id")
+}
+
+// uintParam parses a numeric ID route variable
+func uintParam(r *http.Request, name string) (uint, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)[name], 10, 64)
+	if err != nil || id == 0 {
+		return 0, models.ErrInvalidID
+	}
+	return uint(id), nil
+}
+
+// requireUser returns the authenticated user of a request. If there is
+// none, it responds with 401 Unauthorized and returns nil.
+func requireUser(w http.ResponseWriter, r *http.Request) *models.User {
+	user := context.User(r.Context())
+	if user == nil {
+		writeErrorStatus(w, http.StatusUnauthorized, "a valid API key is required")
+	}
+	return user
+}
+
+// notModified sets the ETag of a response and reports whether the
+// client's If-None-Match already holds it, in which case it responds with
+// 304 Not Modified
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// preconditionFailed reports whether a request has an If-Match header
+// that does not hold etag, in which case it responds with 412
+// Precondition Failed. Requests without If-Match are let through.
+func preconditionFailed(w http.ResponseWriter, r *http.Request, etag string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || matchesETag(ifMatch, etag) {
+		return false
+	}
+	writeErrorStatus(w, http.StatusPreconditionFailed,
+		"the resource was changed since it was read")
+	return true
+}
+
+// matchesETag reports whether a list of entity tags from an If-Match or
+// If-None-Match header holds etag
+func matchesETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// 2. Resource representations
+//
+
+// userETag changes whenever the user is saved
+func userETag(user *models.User) string {
+	return fmt.Sprintf(`"user-%d-%d"`, user.ID, user.UpdatedAt.UnixNano())
+}
+
+type userJSON struct {
+	ID            uint      `json:"id"`
+	Name          string    `json:"name"`
+	// Username is null for users who didn't pick one
+	Username      *string   `json:"username"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func newUserJSON(user *models.User) userJSON {
+	return userJSON{
+		ID:            user.ID,
+		Name:          user.Name,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		CreatedAt:     user.CreatedAt,
+	}
+}
+
+// stocklistETag changes with the version of the stocklist
+func stocklistETag(stocklist *models.Stocklist) string {
+	return fmt.Sprintf(`"stocklist-%d-v%d"`, stocklist.ID, stocklist.Version)
+}
+
+// stocklistsETag changes whenever a stocklist is added to, removed from
+// or changed in a list
+func stocklistsETag(stocklists []models.Stocklist) string {
+	h := sha256.New()
+	for _, s := range stocklists {
+		fmt.Fprintf(h, "%d-%d,", s.ID, s.Version)
+	}
+	return fmt.Sprintf(`"stocklists-%x"`, h.Sum(nil)[:12])
+}
+
+type stocklistJSON struct {
+	ID             uint      `json:"id"`
+	Name           string    `json:"name"`
+	Version        uint      `json:"version"`
+	// Public stocklists are listed on the owner's public profile
+	Public         bool      `json:"public"`
+	// OrganizationID is set on stocklists of an organization
+	OrganizationID *uint     `json:"organization_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func newStocklistJSON(stocklist *models.Stocklist) stocklistJSON {
+	return stocklistJSON{
+		ID:             stocklist.ID,
+		Name:           stocklist.Name,
+		Version:        stocklist.Version,
+		Public:         stocklist.Public,
+		OrganizationID: stocklist.OrganizationID,
+		CreatedAt:      stocklist.CreatedAt,
+		UpdatedAt:      stocklist.UpdatedAt,
+	}
+}
+
+//
+// 3. Users and API keys
+//
+
+// broadcastUserCreated notifies admin webhooks of a signup. Failing to
+// do so is logged rather than failing the signup.
+func broadcastUserCreated(r *http.Request, hooks *webhooks.Dispatcher, user *models.User) {
+	if err := hooks.UserCreated(user); err != nil {
+		slog.ErrorContext(r.Context(), "broadcasting user.created", "error", err)
+	}
+}
+
+// broadcastUserVerified notifies admin webhooks that a user confirmed
+// their email address, logging failures like broadcastUserCreated
+func broadcastUserVerified(r *http.Request, hooks *webhooks.Dispatcher, user *models.User) {
+	if err := hooks.UserVerified(user); err != nil {
+		slog.ErrorContext(r.Context(), "broadcasting user.verified", "error", err)
+	}
+}
+
+type createUserRequest struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// CaptchaResponse is the token of the captcha widget, required when
+	// the server has a captcha
+	CaptchaResponse string `json:"captcha_response,omitempty"`
+	// GuestToken moves the stocklists of a guest session to the new
+	// account
+	GuestToken string `json:"guest_token,omitempty"`
+	// ReferralCode attributes the signup to the user who shared it
+	ReferralCode string `json:"referral_code,omitempty"`
+}
+
+// CreateUser handles POST /api/v1/users
+func (a *APIController) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req createUserRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if a.captcha != nil {
+		err := a.captcha.Verify(r.Context(), req.CaptchaResponse, clientOf(r).IP)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	user := &models.User{
+		Name:     req.Name,
+		Email:    req.Email,
+		Password: req.Password,
+	}
+	if err := a.us.Create(user); err != nil {
+		writeError(w, err)
+		return
+	}
+	broadcastUserCreated(r, a.hooks, user)
+	attributeReferral(r, a.referrals, req.ReferralCode, user)
+	// The account exists either way, so a guest session that can't be
+	// claimed doesn't fail the signup
+	if req.GuestToken != "" {
+		if err := a.us.ClaimGuest(req.GuestToken, user); err != nil {
+			slog.WarnContext(r.Context(), "claiming guest session at signup failed",
+				"user_id", user.ID, "error", err)
+		}
+	}
+	writeJSON(w, http.StatusCreated, newUserJSON(user))
+}
+
+type claimGuestRequest struct {
+	GuestToken string `json:"guest_token"`
+}
+
+// ClaimGuest handles POST /api/v1/users/me/guest, moving the stocklists
+// of a guest session to the account of a user who logged in rather than
+// signing up
+func (a *APIController) ClaimGuest(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req claimGuestRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := a.us.ClaimGuest(req.GuestToken, user); err != nil {
+		writeError(w, err)
+		return
+	}
+	stocklists, err := a.ss.AsTenant(user.ID).ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]stocklistJSON, 0, len(stocklists))
+	for i := range stocklists {
+		data = append(data, newStocklistJSON(&stocklists[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// Me handles GET /api/v1/users/me
+func (a *APIController) Me(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if notModified(w, r, userETag(user)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+// usernameRequest is the body of PUT /api/v1/users/me/username
+type usernameRequest struct {
+	// An empty username removes it
+	Username string `json:"username"`
+}
+
+// SetUsername handles PUT /api/v1/users/me/username
+func (a *APIController) SetUsername(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req usernameRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	oldName := user.GetUsername()
+	if err := a.us.ChangeUsername(user, req.Username); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.profileCache.Invalidate(oldName)
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+type verifyRequest struct {
+	Code string `json:"code"`
+}
+
+// VerifyEmail handles POST /api/v1/users/me/verify, confirming the user's
+// email address with the code emailed to them
+func (a *APIController) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req verifyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Code == "" {
+		writeError(w, requestError("code is required"))
+		return
+	}
+	verified := user.EmailVerifiedAt != nil
+	if err := a.us.VerifyCode(user, req.Code); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !verified {
+		broadcastUserVerified(r, a.hooks, user)
+	}
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+// ResendVerification handles POST /api/v1/users/me/verify/resend,
+// emailing the user a new verification link and code
+func (a *APIController) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := a.us.RequestVerification(user); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newUserJSON(user))
+}
+
+type createKeyRequest struct {
+	// Email or Username identifies the user
+	Email    string `json:"email"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+type keyJSON struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// CreateKey handles POST /api/v1/keys. It exchanges an email or username
+// and password for a new API key, which is only ever shown in this
+// response.
+func (a *APIController) CreateKey(w http.ResponseWriter, r *http.Request) {
+	var req createKeyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	login := req.Email
+	if login == "" {
+		login = req.Username
+	}
+	user, err := a.us.Authenticate(login, req.Password)
+	if err != nil {
+		// Do not tell clients which of the two was wrong.
+		if err == models.ErrNotFound {
+			err = models.ErrInvalidPassword
+		}
+		writeError(w, err)
+		return
+	}
+	apiKey, err := a.as.Create(user.ID, req.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, keyJSON{
+		ID:   apiKey.ID,
+		Name: apiKey.Name,
+		Key:  apiKey.Key,
+	})
+}
+
+//
+// 4. Stocklists
+//
+
+type stocklistRequest struct {
+	Name string `json:"name"`
+	// Public is left as it was when omitted
+	Public *bool `json:"public"`
+}
+
+// ownedStocklist looks up the stocklist in the {id} route variable,
+// returning ErrNotFound if the user can't see it, and ErrOrgForbidden if
+// it belongs to an organization where the user's role is below role.
+// Reads need models.OrgRoleViewer, changes models.OrgRoleMember.
+func ownedStocklist(ss *models.StocklistService, r *http.Request, user *models.User, role string) (*models.Stocklist, error) {
+	id, err := idParam(r)
+	if err != nil {
+		return nil, err
+	}
+	stocklist, err := ss.AsTenant(user.ID).ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	have, err := ss.RoleOf(stocklist, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if have == "" {
+		return nil, models.ErrNotFound
+	}
+	if !models.OrgRoleAllows(have, role) {
+		return nil, models.ErrOrgForbidden
+	}
+	return stocklist, nil
+}
+
+// Stocklists handles GET /api/v1/stocklists
+func (a *APIController) Stocklists(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	stocklists, err := a.ss.AsTenant(user.ID).ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if notModified(w, r, stocklistsETag(stocklists)) {
+		return
+	}
+	data := make([]stocklistJSON, 0, len(stocklists))
+	for i := range stocklists {
+		data = append(data, newStocklistJSON(&stocklists[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// ExportStocklists handles GET /api/v1/stocklists/export.csv, streaming
+// the user's stocklists as CSV. Once rows are written the status can't
+// change, so errors after that are logged and cut the download short.
+// With an export storage, the file is stored and the client redirected
+// to it instead.
+func (a *APIController) ExportStocklists(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if a.exports != nil {
+		url, err := a.storeExport(r, user.ID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, url, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="stocklists.csv"`)
+	if err := a.ss.AsTenant(user.ID).ExportCSV(flushWriter{w}, user.ID); err != nil {
+		slog.ErrorContext(r.Context(), "exporting stocklists failed", "error", err)
+	}
+}
+
+// storeExport writes a user's CSV export to the export storage and
+// returns a presigned link to it. The file goes through a temporary file
+// first, as S3 needs the size of uploads up front. Stored exports are
+// never deleted by the site; an expiration rule on the exports/ prefix of
+// the bucket should do it.
+func (a *APIController) storeExport(r *http.Request, userID uint) (string, error) {
+	f, err := os.CreateTemp("", "gastb-export-*.csv")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := a.ss.AsTenant(userID).ExportCSV(f, userID); err != nil {
+		return "", err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// A random suffix keeps keys from being guessed
+	suffix, err := rand.String(12)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("exports/stocklists/%d-%s.csv", userID, strings.TrimRight(suffix, "="))
+	err = a.exports.Put(r.Context(), key, f, size, "text/csv; charset=utf-8")
+	if err != nil {
+		return "", err
+	}
+	return a.exports.(storage.Presigner).Presign(key, a.exportTTL, "stocklists.csv")
+}
+
+// flushWriter sends what is written to the client right away, if the
+// response writer can flush
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// CreateStocklist handles POST /api/v1/stocklists
+func (a *APIController) CreateStocklist(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req stocklistRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	stocklist := &models.Stocklist{
+		UserID: user.ID,
+		Name:   strings.TrimSpace(req.Name),
+		Public: req.Public != nil && *req.Public,
+	}
+	if err := a.ss.AsTenant(user.ID).Create(stocklist); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.profileCache.InvalidateStocklist(r.Context(), stocklist, false)
+	writeJSON(w, http.StatusCreated, newStocklistJSON(stocklist))
+}
+
+// Stocklist handles GET /api/v1/stocklists/{id}
+func (a *APIController) Stocklist(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	stocklist, err := ownedStocklist(a.ss, r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if notModified(w, r, stocklistETag(stocklist)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newStocklistJSON(stocklist))
+}
+
+// UpdateStocklist handles PUT /api/v1/stocklists/{id}. With If-Match,
+// the update only happens if the stocklist is still at that ETag; in any
+// case, a concurrent update makes it fail with 409 Conflict.
+func (a *APIController) UpdateStocklist(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	stocklist, err := ownedStocklist(a.ss, r, user, models.OrgRoleMember)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if preconditionFailed(w, r, stocklistETag(stocklist)) {
+		return
+	}
+	var req stocklistRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	wasPublic := stocklist.Public
+	stocklist.Name = strings.TrimSpace(req.Name)
+	if req.Public != nil {
+		stocklist.Public = *req.Public
+	}
+	if err := a.ss.AsTenant(user.ID).Update(stocklist); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.profileCache.InvalidateStocklist(r.Context(), stocklist, wasPublic)
+	w.Header().Set("ETag", stocklistETag(stocklist))
+	writeJSON(w, http.StatusOK, newStocklistJSON(stocklist))
+}
+
+// DeleteStocklist handles DELETE /api/v1/stocklists/{id}, honoring
+// If-Match like UpdateStocklist
+func (a *APIController) DeleteStocklist(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	stocklist, err := ownedStocklist(a.ss, r, user, models.OrgRoleMember)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if preconditionFailed(w, r, stocklistETag(stocklist)) {
+		return
+	}
+	if err := a.ss.AsTenant(user.ID).Delete(stocklist.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.profileCache.InvalidateStocklist(r.Context(), stocklist, false)
+	writeJSON(w, http.StatusOK, nil)
+}
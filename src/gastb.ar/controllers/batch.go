@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxBatchOperations is how many operations a batch can hold
+const maxBatchOperations = 20
+
+// batchPrefix is the prefix of the paths operations can call
+const batchPrefix = "/api/v1/"
+
+// BatchController runs several API requests sent in one, so that clients
+// on slow connections, such as phones syncing changes made offline, save
+// round trips.
+type BatchController struct {
+	api http.Handler
+}
+
+// NewBatchController creates a controller running operations through
+// api, the router of the API the batch route is on
+func NewBatchController(api http.Handler) *BatchController {
+	return &BatchController{
+		api: api,
+	}
+}
+
+type batchOperation struct {
+	Method string `json:"method"`
+	// Path is that of an API route, such as /api/v1/stocklists
+	Path string `json:"path"`
+	// Headers are added to the operation's request, e.g. If-Match
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+	// StopOnError skips the operations after the first one that fails.
+	// Operations that succeeded before are not undone.
+	StopOnError bool `json:"stop_on_error"`
+}
+
+type batchResultJSON struct {
+	// Status is 424 Failed Dependency for operations skipped after a
+	// failure
+	Status int    `json:"status"`
+	ETag   string `json:"etag,omitempty"`
+	// Body is the operation's response: the JSON envelope, or a string
+	// for other content
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// validate checks an operation can be run in a batch, and replaces its
+// path with the decoded and cleaned one the router will see, so that
+// escapes or dot segments can't get a path past the checks
+func (op *batchOperation) validate() error {
+	switch op.Method {
+	case "GET", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return requestError("method must be GET, POST, PUT, PATCH or DELETE")
+	}
+	u, err := url.Parse(op.Path)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return requestError("path must start with " + batchPrefix)
+	}
+	p := path.Clean(u.Path)
+	if strings.HasSuffix(u.Path, "/") && p != "/" {
+		p += "/"
+	}
+	if !strings.HasPrefix(p, batchPrefix) {
+		return requestError("path must start with " + batchPrefix)
+	}
+	if strings.HasPrefix(p, batchPrefix+"batch") {
+		return requestError("batches can't be nested")
+	}
+	u.Path, u.RawPath = p, ""
+	op.Path = u.String()
+	return nil
+}
+
+// Batch handles POST /api/v1/batch, running its operations in order as
+// the user making it, and responding with the status and body of each
+func (bc *BatchController) Batch(w http.ResponseWriter, r *http.Request) {
+	if requireUser(w, r) == nil {
+		return
+	}
+	var req batchRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > maxBatchOperations {
+		writeError(w, requestError("a batch holds 1 to "+strconv.Itoa(maxBatchOperations)+" operations"))
+		return
+	}
+	for i := range req.Operations {
+		if err := req.Operations[i].validate(); err != nil {
+			writeError(w, requestError("operation "+strconv.Itoa(i)+": "+err.Error()))
+			return
+		}
+	}
+	results := make([]batchResultJSON, len(req.Operations))
+	failed := false
+	for i, op := range req.Operations {
+		if failed && req.StopOnError {
+			results[i] = batchResultJSON{Status: http.StatusFailedDependency}
+			continue
+		}
+		results[i] = bc.run(r, op)
+		failed = failed || results[i].Status >= http.StatusBadRequest
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// run runs an operation with the context, and so the user, of the batch
+func (bc *BatchController) run(r *http.Request, op batchOperation) batchResultJSON {
+	sub, err := http.NewRequestWithContext(r.Context(), op.Method, op.Path, bytes.NewReader(op.Body))
+	if err != nil {
+		return batchResultJSON{Status: http.StatusBadRequest}
+	}
+	for k, v := range op.Headers {
+		sub.Header.Set(k, v)
+	}
+	if len(op.Body) > 0 {
+		sub.Header.Set("Content-Type", "application/json")
+	}
+	sub.Header.Set("Accept", "application/json")
+	sub.RemoteAddr = r.RemoteAddr
+	rec := &batchRecorder{header: http.Header{}}
+	bc.api.ServeHTTP(rec, sub)
+	result := batchResultJSON{Status: rec.status, ETag: rec.header.Get("ETag")}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	if rec.body.Len() > 0 {
+		if strings.Contains(rec.header.Get("Content-Type"), "json") && json.Valid(rec.body.Bytes()) {
+			result.Body = rec.body.Bytes()
+		} else {
+			result.Body, _ = json.Marshal(rec.body.String())
+		}
+	}
+	return result
+}
+
+// batchRecorder keeps the response to an operation. It can't flush, so
+// streaming routes refuse to run in a batch.
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *batchRecorder) Header() http.Header {
+	return br.header
+}
+
+func (br *batchRecorder) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+func (br *batchRecorder) Write(b []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.body.Write(b)
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/context"
+	"gastb.ar/middleware"
+	"gastb.ar/models"
+	"gastb.ar/ratelimit"
+)
+
+func TestBatchOperationValidate(t *testing.T) {
+	cases := []struct {
+		path string
+		want string // the path run, or the error
+	}{
+		{"/api/v1/stocklists", "/api/v1/stocklists"},
+		{"/api/v1/stocklists/1?fields=name", "/api/v1/stocklists/1?fields=name"},
+		{"/api/v1/./stocklists//1", "/api/v1/stocklists/1"},
+		{"/api/v1/%73tocklists", "/api/v1/stocklists"},
+		{"/api/v1/batch", "batches can't be nested"},
+		{"/api/v1/%62atch", "batches can't be nested"},
+		{"/api/v1/stocklists/../batch", "batches can't be nested"},
+		{"/api/v1/stocklists%2F..%2Fbatch", "batches can't be nested"},
+		{"/api/v1/../../admin", "path must start with"},
+		{"/api/v1/%2e%2e/admin", "path must start with"},
+		{"/login", "path must start with"},
+		{"https://example.com/api/v1/stocklists", "path must start with"},
+	}
+	for _, c := range cases {
+		op := batchOperation{Method: "GET", Path: c.path}
+		if err := op.validate(); err != nil {
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("validate(%q) = %v, want %q", c.path, err, c.want)
+			}
+		} else if op.Path != c.want {
+			t.Errorf("validate(%q) ran %q, want %q", c.path, op.Path, c.want)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/batch", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("a batched operation ran the batch route")
+	})
+	router.HandleFunc("/api/v1/ping", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, "pong")
+	})
+	limit := &middleware.RateLimit{
+		Store:   ratelimit.NewMemoryStore(),
+		Group:   "api",
+		PerIP:   ratelimit.PerMinute(100),
+		PerUser: ratelimit.PerMinute(2),
+	}
+	bc := NewBatchController(limit.Apply(router))
+	user := &models.User{}
+	user.ID = 1
+	batch := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/batch", strings.NewReader(body))
+		r = r.WithContext(context.WithUser(r.Context(), user))
+		rec := httptest.NewRecorder()
+		bc.Batch(rec, r)
+		return rec
+	}
+
+	if rec := batch(`{"operations":[{"method":"POST","path":"/api/v1/%62atch"}]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("nested batch through an escaped path: status %d, want 400", rec.Code)
+	}
+
+	// Each operation is taken from the user's rate limit
+	rec := batch(`{"operations":[{"method":"GET","path":"/api/v1/ping"},
+		{"method":"GET","path":"/api/v1/ping"},{"method":"GET","path":"/api/v1/ping"}]}`)
+	var resp struct {
+		Data []batchResultJSON `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding the results: %v", err)
+	}
+	var statuses []int
+	for _, res := range resp.Data {
+		statuses = append(statuses, res.Status)
+	}
+	if len(statuses) != 3 || statuses[0] != 200 || statuses[1] != 200 || statuses[2] != http.StatusTooManyRequests {
+		t.Errorf("statuses = %v, want the third operation limited", statuses)
+	}
+}
@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gastb.ar/billing"
+	"gastb.ar/models"
+)
+
+// BillingController shows users their plan and sells them others
+// through Stripe Checkout, and receives Stripe's subscription events.
+type BillingController struct {
+	subs    *models.SubscriptionService
+	ss      *models.StocklistService
+	usage   *models.APIUsageService
+	plans   billing.Config
+	stripe  *billing.Stripe
+	baseURL string
+}
+
+// NewBillingController creates a controller on top of initialized
+// subscription, stocklist and API usage services, with the configured
+// plans. With no Stripe client, plans can't be bought.
+func NewBillingController(subs *models.SubscriptionService, ss *models.StocklistService,
+	usage *models.APIUsageService, plans billing.Config, stripe *billing.Stripe,
+	baseURL string) *BillingController {
+	return &BillingController{
+		subs:    subs,
+		ss:      ss,
+		usage:   usage,
+		plans:   plans,
+		stripe:  stripe,
+		baseURL: baseURL,
+	}
+}
+
+type planJSON struct {
+	Name string `json:"name"`
+	// MaxStocklists is 0 when stocklists are unlimited
+	MaxStocklists        int `json:"max_stocklists"`
+	APIRequestsPerMinute int `json:"api_requests_per_minute,omitempty"`
+	// APIRequestsPerDay is 0 when API requests are unlimited
+	APIRequestsPerDay int `json:"api_requests_per_day"`
+}
+
+func newPlanJSON(plan billing.Plan) planJSON {
+	return planJSON{
+		Name:                 plan.Name,
+		MaxStocklists:        plan.MaxStocklists,
+		APIRequestsPerMinute: plan.APIRequestsPerMinute,
+		APIRequestsPerDay:    plan.APIRequestsPerDay,
+	}
+}
+
+type billingJSON struct {
+	Plan planJSON `json:"plan"`
+	// Status is that of the user's Stripe subscription, if they have one
+	Status           string     `json:"status,omitempty"`
+	CurrentPeriodEnd *time.Time `json:"current_period_end,omitempty"`
+	// Stocklists counts the user's personal stocklists, and
+	// APIRequestsToday their API requests today, which the plan limits
+	Stocklists       int   `json:"stocklists"`
+	APIRequestsToday int64 `json:"api_requests_today"`
+	// Plans are the plans that can be bought
+	Plans []planJSON `json:"plans"`
+}
+
+type checkoutRequest struct {
+	Plan string `json:"plan"`
+}
+
+type checkoutJSON struct {
+	// URL is the Stripe Checkout page to send the user to
+	URL string `json:"url"`
+}
+
+// Billing handles GET /api/v1/billing
+func (bc *BillingController) Billing(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	plan, err := bc.subs.PlanFor(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	stocklists, err := bc.ss.AsTenant(user.ID).ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	requests, err := bc.usage.RequestsToday(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := billingJSON{
+		Plan:             newPlanJSON(plan),
+		Stocklists:       len(stocklists),
+		APIRequestsToday: requests,
+		Plans:            []planJSON{},
+	}
+	sub, err := bc.subs.ByUserID(user.ID)
+	switch err {
+	case nil:
+		data.Status = sub.Status
+		data.CurrentPeriodEnd = &sub.CurrentPeriodEnd
+	case models.ErrNotFound:
+	default:
+		writeError(w, err)
+		return
+	}
+	if bc.stripe != nil {
+		for _, p := range bc.plans.Plans {
+			if p.StripePrice != "" {
+				data.Plans = append(data.Plans, newPlanJSON(p))
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// Checkout handles POST /api/v1/billing/checkout, starting a Stripe
+// Checkout session for the user to subscribe to a plan. Stripe sends
+// them back to the home page.
+func (bc *BillingController) Checkout(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if bc.stripe == nil {
+		writeErrorStatus(w, http.StatusNotFound, "billing is not enabled")
+		return
+	}
+	var req checkoutRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	plan := bc.plans.Plan(req.Plan)
+	if plan.Name != req.Plan {
+		writeError(w, billing.ErrUnknownPlan)
+		return
+	}
+	checkout := billing.Checkout{
+		UserID:     user.ID,
+		Plan:       plan,
+		Email:      user.Email,
+		SuccessURL: bc.baseURL + "/?checkout=success",
+		CancelURL:  bc.baseURL + "/?checkout=canceled",
+	}
+	sub, err := bc.subs.ByUserID(user.ID)
+	switch err {
+	case nil:
+		checkout.Customer = sub.StripeCustomerID
+	case models.ErrNotFound:
+	default:
+		writeError(w, err)
+		return
+	}
+	url, err := bc.stripe.CheckoutURL(r.Context(), checkout)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, checkoutJSON{URL: url})
+}
+
+// StripeEvents handles POST /api/v1/billing/stripe, the Stripe webhook.
+// Subscription events update the user's subscription; other events are
+// acknowledged and ignored, so that Stripe doesn't retry them.
+func (bc *BillingController) StripeEvents(w http.ResponseWriter, r *http.Request) {
+	if bc.stripe == nil {
+		writeErrorStatus(w, http.StatusNotFound, "billing is not enabled")
+		return
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	event, err := bc.stripe.ParseEvent(payload, r.Header.Get("Stripe-Signature"))
+	switch err {
+	case nil:
+	case billing.ErrBadSignature:
+		writeErrorStatus(w, http.StatusUnauthorized, "invalid signature")
+		return
+	default:
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if event.Subscription == nil {
+		writeJSON(w, http.StatusOK, eventJSON{Result: "ignored"})
+		return
+	}
+	if err := bc.subs.Apply(event.Subscription, event.Created); err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.Info("subscription updated", "event", event.ID, "type", event.Type,
+		"user_id", event.Subscription.UserID, "status", event.Subscription.Status)
+	writeJSON(w, http.StatusOK, eventJSON{Result: "applied"})
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gastb.ar/calendar"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+)
+
+// How far ahead calendar feeds list events
+const calendarHorizon = 180 * 24 * time.Hour
+
+// CalendarController serves each user an iCalendar feed of upcoming
+// portfolio events at a URL with a secret token, since calendar apps
+// can't log in, and the URL itself to API clients.
+type CalendarController struct {
+	feeds   *models.CalendarFeedService
+	source  calendar.Source
+	baseURL string
+}
+
+// NewCalendarController creates a controller serving the events of source
+// on top of an initialized calendar feed service
+func NewCalendarController(feeds *models.CalendarFeedService,
+	source calendar.Source, baseURL string) *CalendarController {
+	return &CalendarController {
+		feeds:   feeds,
+		source:  source,
+		baseURL: baseURL,
+	}
+}
+
+type calendarFeedJSON struct {
+	URL string `json:"url"`
+}
+
+// feedURL returns the URL of a calendar feed
+func (cc *CalendarController) feedURL(feed *models.CalendarFeed) calendarFeedJSON {
+	return calendarFeedJSON{
+		URL: cc.baseURL + "/calendar.ics?" + url.Values{"token": {feed.Token}}.Encode(),
+	}
+}
+
+// Feed handles GET /calendar.ics?token=..., the feed calendar apps
+// subscribe to
+func (cc *CalendarController) Feed(w http.ResponseWriter, r *http.Request) {
+	feed, err := cc.feeds.ByToken(r.URL.Query().Get("token"))
+	switch err {
+	case nil:
+	case models.ErrInvalidToken:
+		httperror.Render(w, r, http.StatusNotFound, "")
+		return
+	default:
+		slog.ErrorContext(r.Context(), "looking up calendar feed failed", "error", err)
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	now := time.Now()
+	events, err := cc.source.Events(r.Context(), feed.UserID, now, now.Add(calendarHorizon))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing calendar events failed", "error", err)
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	calendar.Write(w, "gastb.ar portfolio", events, now)
+}
+
+// CalendarFeed handles GET /api/v1/users/me/calendar, returning the URL
+// of the user's feed
+func (cc *CalendarController) CalendarFeed(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	feed, err := cc.feeds.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cc.feedURL(feed))
+}
+
+// ResetCalendarFeed handles POST /api/v1/users/me/calendar/reset, giving
+// the feed a new URL; the old one stops working
+func (cc *CalendarController) ResetCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	feed, err := cc.feeds.Reset(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cc.feedURL(feed))
+}
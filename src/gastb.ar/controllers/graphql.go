@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	ctxpkg "context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gastb.ar/context"
+	"gastb.ar/graphql"
+	"gastb.ar/models"
+)
+
+// GraphQLController serves the GraphQL API at /graphql. It exposes the
+// same data as the JSON API, with the same API key authentication, to
+// clients that want to pick fields and fetch related records in one
+// request.
+type GraphQLController struct {
+	ss     *models.StocklistService
+	as     *models.AttachmentService
+	schema *graphql.Schema
+	// profileCache, if set, caches public profile pages
+	profileCache *ProfileCache
+}
+
+// NewGraphQLController creates a controller on top of initialized
+// services
+func NewGraphQLController(ss *models.StocklistService,
+	as *models.AttachmentService) *GraphQLController {
+	gc := &GraphQLController {
+		ss: ss,
+		as: as,
+	}
+	gc.schema = gc.newSchema()
+	return gc
+}
+
+// SetProfileCache drops the cached profile page of users who rename or
+// delete a public stocklist
+func (gc *GraphQLController) SetProfileCache(pc *ProfileCache) {
+	gc.profileCache = pc
+}
+
+// Serve handles POST /graphql, with a JSON request body, and GET /graphql
+// with query, variables and operationName parameters. Mutations are only
+// run on POST. Responses are GraphQL responses rather than envelopes.
+func (gc *GraphQLController) Serve(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req graphql.Request
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := decodeVariables(strings.NewReader(vars), &req.Variables); err != nil {
+				writeGraphQLError(w, "invalid variables: "+err.Error())
+				return
+			}
+		}
+	} else {
+		err := decodeVariables(http.MaxBytesReader(w, r.Body, maxBodyBytes), &req)
+		if err != nil {
+			writeGraphQLError(w, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	resp := gc.schema.Execute(r.Context(), req, r.Method == http.MethodPost, graphQLMessage)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// decodeVariables decodes JSON keeping numbers as json.Number, so that
+// large IDs are not rounded through float64
+func decodeVariables(r io.Reader, dst interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec.Decode(dst)
+}
+
+func writeGraphQLError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(&graphql.Response{Errors: []*graphql.Error{{Message: msg}}})
+}
+
+// graphQLMessage shows clients the same errors as the JSON API and hides
+// unexpected ones
+func graphQLMessage(ctx ctxpkg.Context, err error) string {
+	if statusFor(err) == http.StatusInternalServerError {
+		slog.ErrorContext(ctx, "resolving graphql field failed", "error", err)
+		return http.StatusText(http.StatusInternalServerError)
+	}
+	return publicMessage(err)
+}
+
+// graphQLID formats a record ID as a GraphQL ID
+func graphQLID(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// parseGraphQLID parses an ID argument
+func parseGraphQLID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		return 0, models.ErrInvalidID
+	}
+	return uint(id), nil
+}
+
+// field returns a field whose value is computed from its source alone
+func field(fn func(src interface{}) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Resolve: func(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+			return fn(src), nil
+		},
+	}
+}
+
+// ownedStocklist looks up the stocklist in the id argument,
+// returning ErrNotFound if it belongs to somebody else. Stocklists of
+// organizations are only reached through the REST API.
+func (gc *GraphQLController) ownedStocklist(ctx ctxpkg.Context, args graphql.Args) (*models.Stocklist, error) {
+	id, err := parseGraphQLID(args.String("id"))
+	if err != nil {
+		return nil, err
+	}
+	stocklist, err := gc.ss.AsTenant(context.User(ctx).ID).ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if stocklist.UserID != context.User(ctx).ID || stocklist.OrganizationID != nil {
+		return nil, models.ErrNotFound
+	}
+	if args.Has("version") && uint(args.Int("version")) != stocklist.Version {
+		return nil, models.ErrConflict
+	}
+	return stocklist, nil
+}
+
+// newSchema defines the types of the API. Stocklists are passed between
+// resolvers as *models.Stocklist, users as *models.User and attachments
+// as *models.Attachment.
+func (gc *GraphQLController) newSchema() *graphql.Schema {
+	attachmentType := &graphql.Object{
+		Name: "Attachment",
+		Fields: map[string]*graphql.Field{
+			"id":          field(func(src interface{}) interface{} { return graphQLID(src.(*models.Attachment).ID) }),
+			"name":        field(func(src interface{}) interface{} { return src.(*models.Attachment).Name }),
+			"contentType": field(func(src interface{}) interface{} { return src.(*models.Attachment).ContentType }),
+			"size":        field(func(src interface{}) interface{} { return src.(*models.Attachment).Size }),
+			"createdAt":   field(func(src interface{}) interface{} { return src.(*models.Attachment).CreatedAt }),
+		},
+	}
+	stocklistType := &graphql.Object{
+		Name: "Stocklist",
+		Fields: map[string]*graphql.Field{
+			"id":        field(func(src interface{}) interface{} { return graphQLID(src.(*models.Stocklist).ID) }),
+			"name":      field(func(src interface{}) interface{} { return src.(*models.Stocklist).Name }),
+			"version":   field(func(src interface{}) interface{} { return src.(*models.Stocklist).Version }),
+			"public":    field(func(src interface{}) interface{} { return src.(*models.Stocklist).Public }),
+			"createdAt": field(func(src interface{}) interface{} { return src.(*models.Stocklist).CreatedAt }),
+			"updatedAt": field(func(src interface{}) interface{} { return src.(*models.Stocklist).UpdatedAt }),
+			"attachments": {
+				Type:  attachmentType,
+				Batch: gc.attachments,
+			},
+		},
+	}
+	userType := &graphql.Object{
+		Name: "User",
+		Fields: map[string]*graphql.Field{
+			"id":            field(func(src interface{}) interface{} { return graphQLID(src.(*models.User).ID) }),
+			"name":          field(func(src interface{}) interface{} { return src.(*models.User).Name }),
+			"username": field(func(src interface{}) interface{} {
+				if u := src.(*models.User); u.Username != nil {
+					return *u.Username
+				}
+				return nil
+			}),
+			"email":         field(func(src interface{}) interface{} { return src.(*models.User).Email }),
+			"emailVerified": field(func(src interface{}) interface{} { return src.(*models.User).EmailVerifiedAt != nil }),
+			"createdAt":     field(func(src interface{}) interface{} { return src.(*models.User).CreatedAt }),
+			"stocklists": {
+				Type: stocklistType,
+				Resolve: func(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+					return gc.stocklists(src.(*models.User).ID)
+				},
+			},
+		},
+	}
+
+	query := &graphql.Object{
+		Name: "Query",
+		Fields: map[string]*graphql.Field{
+			"me": {
+				Type: userType,
+				Resolve: func(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+					return context.User(ctx), nil
+				},
+			},
+			"stocklists": {
+				Type: stocklistType,
+				Resolve: func(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+					return gc.stocklists(context.User(ctx).ID)
+				},
+			},
+			"stocklist": {
+				Type: stocklistType,
+				Args: map[string]string{"id": "ID!"},
+				Resolve: func(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+					return gc.ownedStocklist(ctx, args)
+				},
+			},
+		},
+	}
+	mutation := &graphql.Object{
+		Name: "Mutation",
+		Fields: map[string]*graphql.Field{
+			"createStocklist": {
+				Type:    stocklistType,
+				Args:    map[string]string{"name": "String!"},
+				Resolve: gc.createStocklist,
+			},
+			// With version, renameStocklist and deleteStocklist fail with a
+			// conflict unless the stocklist is still at that version, like
+			// If-Match in the JSON API
+			"renameStocklist": {
+				Type:    stocklistType,
+				Args:    map[string]string{"id": "ID!", "name": "String!", "version": "Int"},
+				Resolve: gc.renameStocklist,
+			},
+			"deleteStocklist": {
+				Args:    map[string]string{"id": "ID!", "version": "Int"},
+				Resolve: gc.deleteStocklist,
+			},
+		},
+	}
+	return &graphql.Schema{Query: query, Mutation: mutation}
+}
+
+// stocklists returns the stocklists of a user
+func (gc *GraphQLController) stocklists(userID uint) ([]*models.Stocklist, error) {
+	stocklists, err := gc.ss.AsTenant(userID).ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*models.Stocklist, len(stocklists))
+	for i := range stocklists {
+		out[i] = &stocklists[i]
+	}
+	return out, nil
+}
+
+// attachments loads the attachments of every stocklist in a response
+// with one query
+func (gc *GraphQLController) attachments(ctx ctxpkg.Context, srcs []interface{}, args graphql.Args) ([]interface{}, error) {
+	ids := make([]uint, len(srcs))
+	for i, src := range srcs {
+		ids[i] = src.(*models.Stocklist).ID
+	}
+	byStocklist, err := gc.as.ByStocklistIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(srcs))
+	for i, id := range ids {
+		attachments := byStocklist[id]
+		out := make([]*models.Attachment, len(attachments))
+		for j := range attachments {
+			out[j] = &attachments[j]
+		}
+		values[i] = out
+	}
+	return values, nil
+}
+
+func (gc *GraphQLController) createStocklist(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+	stocklist := &models.Stocklist{
+		UserID: context.User(ctx).ID,
+		Name:   strings.TrimSpace(args.String("name")),
+	}
+	if err := gc.ss.AsTenant(stocklist.UserID).Create(stocklist); err != nil {
+		return nil, err
+	}
+	return stocklist, nil
+}
+
+func (gc *GraphQLController) renameStocklist(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+	stocklist, err := gc.ownedStocklist(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	stocklist.Name = strings.TrimSpace(args.String("name"))
+	if err := gc.ss.AsTenant(stocklist.UserID).Update(stocklist); err != nil {
+		return nil, err
+	}
+	gc.profileCache.InvalidateStocklist(ctx, stocklist, false)
+	return stocklist, nil
+}
+
+// deleteStocklist returns the ID of the deleted stocklist
+func (gc *GraphQLController) deleteStocklist(ctx ctxpkg.Context, src interface{}, args graphql.Args) (interface{}, error) {
+	stocklist, err := gc.ownedStocklist(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := gc.ss.AsTenant(stocklist.UserID).Delete(stocklist.ID); err != nil {
+		return nil, err
+	}
+	gc.profileCache.InvalidateStocklist(ctx, stocklist, false)
+	return graphQLID(stocklist.ID), nil
+}
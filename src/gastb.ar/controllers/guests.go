@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// GuestTokenHeader carries the token of a guest session to the
+// /api/v1/guest routes
+const GuestTokenHeader = "X-Guest-Token"
+
+// GuestsController lets visitors try the API without an account: they
+// start a guest session and build stocklists against its token, which
+// move to their account when they sign up or log in.
+type GuestsController struct {
+	gs *models.GuestService
+}
+
+// NewGuestsController creates a controller on top of an initialized
+// guest service
+func NewGuestsController(gs *models.GuestService) *GuestsController {
+	return &GuestsController{
+		gs: gs,
+	}
+}
+
+type guestJSON struct {
+	// Token goes in the X-Guest-Token header of guest requests, and in
+	// the guest_token field of the signup
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type guestStocklistJSON struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newGuestStocklistJSON(stocklist *models.GuestStocklist) guestStocklistJSON {
+	return guestStocklistJSON{
+		ID:        stocklist.ID,
+		Name:      stocklist.Name,
+		CreatedAt: stocklist.CreatedAt,
+	}
+}
+
+type guestStocklistRequest struct {
+	Name string `json:"name"`
+}
+
+// requireGuest returns the guest whose token is in the X-Guest-Token
+// header of a request. If there is none, it responds with 401
+// Unauthorized and returns nil.
+func (gc *GuestsController) requireGuest(w http.ResponseWriter, r *http.Request) *models.Guest {
+	token := r.Header.Get(GuestTokenHeader)
+	if token == "" {
+		writeErrorStatus(w, http.StatusUnauthorized, "a guest token is required")
+		return nil
+	}
+	guest, err := gc.gs.ByToken(token)
+	if err == models.ErrInvalidGuest {
+		writeErrorStatus(w, http.StatusUnauthorized, publicMessage(err))
+		return nil
+	}
+	if err != nil {
+		writeError(w, err)
+		return nil
+	}
+	return guest
+}
+
+// Create handles POST /api/v1/guests
+func (gc *GuestsController) Create(w http.ResponseWriter, r *http.Request) {
+	guest, err := gc.gs.Create()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, guestJSON{
+		Token:     guest.Token,
+		ExpiresAt: guest.ExpiresAt,
+	})
+}
+
+// Stocklists handles GET /api/v1/guest/stocklists
+func (gc *GuestsController) Stocklists(w http.ResponseWriter, r *http.Request) {
+	guest := gc.requireGuest(w, r)
+	if guest == nil {
+		return
+	}
+	stocklists, err := gc.gs.Stocklists(guest.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]guestStocklistJSON, 0, len(stocklists))
+	for i := range stocklists {
+		data = append(data, newGuestStocklistJSON(&stocklists[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// CreateStocklist handles POST /api/v1/guest/stocklists
+func (gc *GuestsController) CreateStocklist(w http.ResponseWriter, r *http.Request) {
+	guest := gc.requireGuest(w, r)
+	if guest == nil {
+		return
+	}
+	var req guestStocklistRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	stocklist := &models.GuestStocklist{
+		GuestID: guest.ID,
+		Name:    req.Name,
+	}
+	if err := gc.gs.AddStocklist(stocklist); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newGuestStocklistJSON(stocklist))
+}
+
+// DeleteStocklist handles DELETE /api/v1/guest/stocklists/{id}
+func (gc *GuestsController) DeleteStocklist(w http.ResponseWriter, r *http.Request) {
+	guest := gc.requireGuest(w, r)
+	if guest == nil {
+		return
+	}
+	id, err := idParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := gc.gs.DeleteStocklist(guest.ID, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
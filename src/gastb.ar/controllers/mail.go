@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"gastb.ar/email"
+	"gastb.ar/models"
+)
+
+// MailController receives delivery events from the mail provider.
+type MailController struct {
+	us         *models.UserService
+	signingKey string
+}
+
+// NewMailController creates a controller on top of an initialized user
+// service. signingKey verifies the provider's callbacks.
+func NewMailController(us *models.UserService, signingKey string) *MailController {
+	return &MailController {
+		us:         us,
+		signingKey: signingKey,
+	}
+}
+
+// eventJSON is the response to a provider's event
+type eventJSON struct {
+	// Result is "suppressed" if the recipient of a delivery event is now
+	// undeliverable, "applied" if a billing event updated a
+	// subscription, otherwise "ignored"
+	Result string `json:"result"`
+}
+
+// Events handles POST /api/v1/mail/events, the Mailgun webhook for
+// permanent failures and spam complaints. The recipient's address is
+// marked undeliverable and no more email is sent to it. Events about
+// addresses that don't belong to a user are acknowledged and ignored, so
+// the provider does not retry them.
+func (mC *MailController) Events(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	event, err := email.ParseMailgunEvent(mC.signingKey, body)
+	switch err {
+	case nil:
+	case email.ErrBadSignature:
+		writeErrorStatus(w, http.StatusUnauthorized, "invalid signature")
+		return
+	default:
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var reason string
+	switch event.Type {
+	case email.EventBounce:
+		reason = models.UndeliverableBounce
+	case email.EventComplaint:
+		reason = models.UndeliverableComplaint
+	default:
+		writeJSON(w, http.StatusOK, eventJSON{Result: "ignored"})
+		return
+	}
+	switch err := mC.us.MarkUndeliverable(event.Recipient, reason); err {
+	case nil:
+		slog.Info("email address suppressed", "reason", reason,
+			"detail", event.Reason)
+		writeJSON(w, http.StatusOK, eventJSON{Result: "suppressed"})
+	case models.ErrNotFound:
+		writeJSON(w, http.StatusOK, eventJSON{Result: "ignored"})
+	default:
+		writeError(w, err)
+	}
+}
@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"time"
+
+	"gastb.ar/context"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+	"gastb.ar/notify"
+)
+
+// Interval between keep-alive comments on idle streams, so proxies do
+// not close them
+const streamKeepAlive = 25 * time.Second
+
+// Range of the delay after which clients are told to reconnect when the
+// server ends their stream, spread so they don't all come back at once
+const (
+	streamReconnectMin = 1 * time.Second
+	streamReconnectMax = 10 * time.Second
+)
+
+// NotificationsController streams notifications to logged in users as
+// server-sent events, and serves their notification settings to API
+// clients.
+type NotificationsController struct {
+	broker notify.Broker
+	nss    *models.NotificationSettingService
+}
+
+// NewNotificationsController creates a controller streaming from a broker
+// on top of an initialized notification setting service
+func NewNotificationsController(broker notify.Broker,
+	nss *models.NotificationSettingService) *NotificationsController {
+	return &NotificationsController {
+		broker: broker,
+		nss:    nss,
+	}
+}
+
+// Stream handles GET /notifications/stream and
+// GET /api/v1/notifications/stream. Each notification is sent as an
+// event named after its type, with the notification as JSON data. The
+// stream ends when the client goes away or the server shuts down; in the
+// latter case, it ends with a "reconnect" event and a retry delay, which
+// EventSource follows on its own.
+func (nC *NotificationsController) Stream(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user == nil {
+		httperror.Render(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	ch, unsubscribe := nC.broker.Subscribe(user.ID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case n, ok := <-ch:
+			if !ok {
+				delay := streamReconnectMin +
+					time.Duration(mrand.Int63n(int64(streamReconnectMax-streamReconnectMin)))
+				fmt.Fprintf(w, "retry: %d\nevent: reconnect\ndata: {}\n\n", delay.Milliseconds())
+				flusher.Flush()
+				return
+			}
+			b, err := json.Marshal(n)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", n.Type, b)
+		}
+		flusher.Flush()
+	}
+}
+
+type notificationSettingsJSON struct {
+	EmailAlerts     bool `json:"email_alerts"`
+	Digest          bool `json:"digest"`
+	SecurityNotices bool `json:"security_notices"`
+	Webhooks        bool `json:"webhooks"`
+	// Incoming webhook URLs of chat channels, empty if unset
+	SlackWebhookURL   string `json:"slack_webhook_url"`
+	DiscordWebhookURL string `json:"discord_webhook_url"`
+}
+
+func newNotificationSettingsJSON(ns *models.NotificationSettings) notificationSettingsJSON {
+	return notificationSettingsJSON{
+		EmailAlerts:       ns.EmailAlerts,
+		Digest:            ns.Digest,
+		SecurityNotices:   ns.SecurityNotices,
+		Webhooks:          ns.Webhooks,
+		SlackWebhookURL:   ns.SlackWebhookURL,
+		DiscordWebhookURL: ns.DiscordWebhookURL,
+	}
+}
+
+// updateNotificationSettingsRequest is the body of
+// PUT /api/v1/users/me/notifications; omitted settings are left alone
+type updateNotificationSettingsRequest struct {
+	EmailAlerts     *bool `json:"email_alerts"`
+	Digest          *bool `json:"digest"`
+	SecurityNotices *bool `json:"security_notices"`
+	Webhooks        *bool `json:"webhooks"`
+	// An empty URL removes the channel
+	SlackWebhookURL   *string `json:"slack_webhook_url"`
+	DiscordWebhookURL *string `json:"discord_webhook_url"`
+}
+
+// Settings handles GET /api/v1/users/me/notifications
+func (nC *NotificationsController) Settings(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	ns, err := nC.nss.ForUser(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newNotificationSettingsJSON(ns))
+}
+
+// UpdateSettings handles PUT /api/v1/users/me/notifications
+func (nC *NotificationsController) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req updateNotificationSettingsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	ns, err := nC.nss.ForUser(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, f := range []struct {
+		dst *bool
+		src *bool
+	}{
+		{&ns.EmailAlerts, req.EmailAlerts},
+		{&ns.Digest, req.Digest},
+		{&ns.SecurityNotices, req.SecurityNotices},
+		{&ns.Webhooks, req.Webhooks},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	if req.SlackWebhookURL != nil {
+		ns.SlackWebhookURL = *req.SlackWebhookURL
+	}
+	if req.DiscordWebhookURL != nil {
+		ns.DiscordWebhookURL = *req.DiscordWebhookURL
+	}
+	if err := nC.nss.Update(ns); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newNotificationSettingsJSON(ns))
+}
@@ -0,0 +1,817 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gastb.ar/httperror"
+	"gastb.ar/middleware"
+	"gastb.ar/models"
+	"gastb.ar/openapi"
+	"gastb.ar/webhooks"
+)
+
+// OpenAPIController serves an OpenAPI description of the JSON API, for
+// generating client SDKs. Schemas are derived from the types the
+// handlers encode and decode, so fields added to them show up on their
+// own; routes added to the API have to be added to newAPIDocument.
+type OpenAPIController struct {
+	doc []byte
+}
+
+// NewOpenAPIController creates a controller, building the document once
+func NewOpenAPIController() *OpenAPIController {
+	doc, err := json.Marshal(newAPIDocument())
+	if err != nil {
+		panic(err)
+	}
+	return &OpenAPIController{doc: doc}
+}
+
+// Document handles GET /api/v1/openapi.json. It needs no API key, and the
+// document is served as is rather than in an envelope.
+func (oc *OpenAPIController) Document(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(oc.doc)
+}
+
+// Media types of the API
+const (
+	jsonType      = "application/json"
+	multipartType = "multipart/form-data"
+)
+
+// apiDoc adds the operations of the API to an OpenAPI document
+type apiDoc struct {
+	*openapi.Document
+}
+
+// envelope returns the schema of a successful response holding data
+func (d apiDoc) envelope(data *openapi.Schema) *openapi.Schema {
+	return &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"data":  data,
+			"error": {Type: "object", Nullable: true, Description: "Always null on success"},
+		},
+		Required: []string{"data", "error"},
+	}
+}
+
+// ok returns a JSON response holding data in an envelope, or null data
+// if schema is nil
+func (d apiDoc) ok(description string, data *openapi.Schema) *openapi.Response {
+	if data == nil {
+		data = &openapi.Schema{Type: "object", Nullable: true, Description: "Always null"}
+	}
+	return &openapi.Response{
+		Description: description,
+		Content:     map[string]openapi.MediaType{jsonType: {Schema: d.envelope(data)}},
+	}
+}
+
+// list returns the schema of an array of a named schema
+func (d apiDoc) list(name string) *openapi.Schema {
+	return &openapi.Schema{Type: "array", Items: d.Ref(name, nil)}
+}
+
+// body returns a required JSON request body
+func (d apiDoc) body(schema *openapi.Schema) *openapi.RequestBody {
+	return &openapi.RequestBody{
+		Required: true,
+		Content:  map[string]openapi.MediaType{jsonType: {Schema: schema}},
+	}
+}
+
+// fileBody returns a multipart request body with a file field
+func (d apiDoc) fileBody(description string) *openapi.RequestBody {
+	return &openapi.RequestBody{
+		Required: true,
+		Content: map[string]openapi.MediaType{multipartType: {Schema: &openapi.Schema{
+			Type: "object",
+			Properties: map[string]*openapi.Schema{
+				"file": {Type: "string", Format: "binary", Description: description},
+			},
+			Required: []string{"file"},
+		}}},
+	}
+}
+
+// add adds an operation, with responses for errors, the parameters of
+// the route variables of path, and the Idempotency-Key of authenticated
+// POST requests
+func (d apiDoc) add(method, path string, op *openapi.Operation) {
+	for _, name := range []string{"id", "aid", "uid", "iid"} {
+		if strings.Contains(path, "{"+name+"}") {
+			op.Parameters = append(op.Parameters, openapi.Parameter{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   &openapi.Schema{Type: "integer", Format: "int64"},
+			})
+		}
+	}
+	if method == "POST" && op.Security == nil {
+		op.Parameters = append(op.Parameters, header(middleware.IdempotencyKeyHeader,
+			"A key of the client's choosing, at most 255 characters, to retry the request "+
+				"safely with: for 24 hours by default, requests with the same key get the "+
+				"first response again, with Idempotent-Replayed: true, instead of being handled. "+
+				"Reusing a key for another request fails with 422, and while the first "+
+				"request is in progress with 409."))
+	}
+	op.Responses["default"] = &openapi.Response{
+		Description: "An error, as an RFC 7807 problem that also carries the envelope fields",
+		Content:     map[string]openapi.MediaType{httperror.ContentType: {Schema: d.Ref("Problem", nil)}},
+	}
+	d.Add(method, path, op)
+}
+
+// header returns a header parameter
+func header(name, description string) openapi.Parameter {
+	return openapi.Parameter{
+		Name:        name,
+		In:          "header",
+		Description: description,
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+}
+
+// etagHeaders are the headers of responses carrying an ETag
+var etagHeaders = map[string]openapi.Header{
+	"ETag": {Schema: &openapi.Schema{Type: "string"}},
+}
+
+// withHeaders returns r with headers
+func withHeaders(r *openapi.Response, headers map[string]openapi.Header) *openapi.Response {
+	r.Headers = headers
+	return r
+}
+
+// event describes the payloads posted to webhooks subscribed to an
+// event, whose data has a schema
+func (d apiDoc) event(name, operationID, summary string, data *openapi.Schema) {
+	payload := openapi.SchemaOf(webhooks.Payload{})
+	payload.Properties["event"].Enum = []string{name}
+	payload.Properties["data"] = data
+	d.AddWebhook(name, &openapi.Operation{
+		OperationID: operationID,
+		Summary:     summary,
+		Tags:        []string{"webhooks"},
+		Parameters: []openapi.Parameter{
+			header(webhooks.EventHeader, "The event name"),
+			header(webhooks.DeliveryHeader, "The payload ID, the same on every attempt"),
+			header(webhooks.SignatureHeader, "t=<unix time>,v1=<hex HMAC-SHA256 of t.body> "+
+				"with the webhook's secret"),
+		},
+		RequestBody: d.body(payload),
+		Responses: map[string]*openapi.Response{"2XX": {
+			Description: "Acknowledges the delivery; other responses are retried",
+		}},
+		Security: openapi.Public,
+	})
+}
+
+// newAPIDocument describes the routes under /api/v1
+func newAPIDocument() *openapi.Document {
+	d := apiDoc{openapi.New(openapi.Info{
+		Title:   "gastb.ar API",
+		Version: "1",
+		Description: "Every JSON response is an envelope {\"data\": ..., \"error\": ...} " +
+			"where exactly one of the two fields is non-null.",
+	})}
+	d.Servers = []openapi.Server{{URL: "/api/v1"}}
+	d.Components.SecuritySchemes["apiKey"] = openapi.SecurityScheme{
+		Type:        "http",
+		Scheme:      "bearer",
+		Description: "An API key created with POST /keys",
+	}
+	d.Security = []map[string][]string{{"apiKey": {}}}
+	d.Components.SecuritySchemes["guestToken"] = openapi.SecurityScheme{
+		Type:        "apiKey",
+		In:          "header",
+		Name:        GuestTokenHeader,
+		Description: "The token of a guest session created with POST /guests",
+	}
+	guestSecurity := []map[string][]string{{"guestToken": {}}}
+
+	d.Ref("Problem", httperror.Problem{})
+	user := d.Ref("User", userJSON{})
+	stocklist := d.Ref("Stocklist", stocklistJSON{})
+	attachment := d.Ref("Attachment", attachmentJSON{})
+	webhook := d.Ref("Webhook", webhookJSON{})
+	d.Ref("Delivery", deliveryJSON{})
+	settings := d.Ref("NotificationSettings", notificationSettingsJSON{})
+	maintenance := d.Ref("Maintenance", maintenanceJSON{})
+	stocklistReq := d.Ref("StocklistRequest", stocklistRequest{})
+	webhookReq := d.Ref("WebhookRequest", webhookRequest{})
+
+	ifNoneMatch := header("If-None-Match", "An ETag; if it still matches, the response is 304 Not Modified")
+	ifMatch := header("If-Match", "An ETag; unless it still matches, the request fails with 412 Precondition Failed")
+	notModified := &openapi.Response{Description: "Not modified since the ETag in If-None-Match"}
+
+	// Keys and users
+	d.add("POST", "/keys", &openapi.Operation{
+		OperationID: "createKey",
+		Summary:     "Exchange an email or username and password for a new API key",
+		Tags:        []string{"users"},
+		Security:    openapi.Public,
+		RequestBody: d.body(d.Ref("CreateKeyRequest", createKeyRequest{})),
+		Responses: map[string]*openapi.Response{
+			"201": d.ok("The key, which is only ever shown in this response", d.Ref("Key", keyJSON{})),
+		},
+	})
+	d.add("POST", "/users", &openapi.Operation{
+		OperationID: "createUser",
+		Summary:     "Sign up",
+		Tags:        []string{"users"},
+		Security:    openapi.Public,
+		RequestBody: d.body(d.Ref("CreateUserRequest", createUserRequest{})),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The new user", user)},
+	})
+	d.add("POST", "/batch", &openapi.Operation{
+		OperationID: "batch",
+		Summary:     "Run up to 20 API requests in order, in one round trip",
+		Description: "Each operation is run as the user making the batch, and gets the " +
+			"status and body it would have gotten on its own, in the order sent. With " +
+			"stop_on_error, the operations after the first that fails are skipped with " +
+			"status 424; the ones that succeeded are not undone. Operations can't be " +
+			"batches, or stream.",
+		Tags:        []string{"batch"},
+		RequestBody: d.body(d.Ref("BatchRequest", batchRequest{})),
+		Responses: map[string]*openapi.Response{"200": d.ok("The result of each operation",
+			&openapi.Schema{Type: "array", Items: d.Ref("BatchResult", batchResultJSON{})})},
+	})
+	d.add("GET", "/sync", &openapi.Operation{
+		OperationID: "sync",
+		Summary:     "Get the stocklists the user can see that changed since the last sync",
+		Description: "Without since, every stocklist the user can see is returned as updated. " +
+			"Pass the cursor of each response as since next time; while has_more is set, " +
+			"sync again right away. Changes are kept for 30 days: older cursors get 410 Gone, " +
+			"and the client should sync without since.",
+		Tags: []string{"stocklists"},
+		Parameters: []openapi.Parameter{{
+			Name:        "since",
+			In:          "query",
+			Description: "The cursor of the previous sync",
+			Schema:      &openapi.Schema{Type: "string"},
+		}},
+		Responses: map[string]*openapi.Response{"200": d.ok("The changes", d.Ref("Sync", syncJSON{}))},
+	})
+	d.Ref("SearchResult", searchResultJSON{})
+	d.add("GET", "/search", &openapi.Operation{
+		OperationID: "search",
+		Summary:     "Search the stocklists the user can see",
+		Description: "Stocklist names are matched with full text search; results come best " +
+			"first, at most 50. In the snippet, matching words are in <mark> tags and the " +
+			"rest is escaped HTML.",
+		Tags: []string{"stocklists"},
+		Parameters: []openapi.Parameter{{
+			Name: "q",
+			In:   "query",
+			Description: "Words to match, all of them by default. \"Quoted phrases\" match in " +
+				"order, or separates alternatives and a leading - excludes a word.",
+			Required: true,
+			Schema:   &openapi.Schema{Type: "string"},
+		}},
+		Responses: map[string]*openapi.Response{"200": d.ok("The matching documents",
+			d.list("SearchResult"))},
+	})
+	d.add("GET", "/users/me", &openapi.Operation{
+		OperationID: "getMe",
+		Summary:     "Get the authenticated user",
+		Tags:        []string{"users"},
+		Parameters:  []openapi.Parameter{ifNoneMatch},
+		Responses: map[string]*openapi.Response{
+			"200": withHeaders(d.ok("The user", user), etagHeaders),
+			"304": notModified,
+		},
+	})
+	d.add("PUT", "/users/me/username", &openapi.Operation{
+		OperationID: "setUsername",
+		Summary:     "Pick the user's username, which logins accept too; an empty one removes it",
+		Tags:        []string{"users"},
+		RequestBody: d.body(d.Ref("UsernameRequest", usernameRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The user", user)},
+	})
+	d.add("POST", "/users/me/verify", &openapi.Operation{
+		OperationID: "verifyEmail",
+		Summary:     "Confirm the user's email address with the code emailed to them",
+		Tags:        []string{"users"},
+		RequestBody: d.body(d.Ref("VerifyRequest", verifyRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The verified user", user)},
+	})
+	d.add("POST", "/users/me/verify/resend", &openapi.Operation{
+		OperationID: "resendVerification",
+		Summary:     "Email a new verification code",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"202": d.ok("The user", user)},
+	})
+	d.add("POST", "/users/me/guest", &openapi.Operation{
+		OperationID: "claimGuest",
+		Summary:     "Move the stocklists of a guest session to the user's account",
+		Tags:        []string{"guests"},
+		RequestBody: d.body(d.Ref("ClaimGuestRequest", claimGuestRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("All the user's stocklists", d.list("Stocklist"))},
+	})
+	d.add("GET", "/users/me/referrals", &openapi.Operation{
+		OperationID: "getReferrals",
+		Summary:     "Get the user's referral code and the signups it brought in",
+		Description: "Signups pass the code as referral_code, or come from the signup link. " +
+			"Referring oneself, or signing up from an IP address the referrer or another " +
+			"of their referrals used, counts as a signup but earns no reward.",
+		Tags:      []string{"users"},
+		Responses: map[string]*openapi.Response{"200": d.ok("The referrals", d.Ref("Referrals", referralsJSON{}))},
+	})
+	d.Ref("APIUsage", usageJSON{})
+	d.add("GET", "/users/me/usage", &openapi.Operation{
+		OperationID: "getAPIUsage",
+		Summary:     "List the requests and bytes of the user's API keys per day, oldest first",
+		Description: "Requests made with an API key count towards the daily quota of the " +
+			"user's plan; past it, they are answered 429 until midnight UTC. " +
+			"The last few seconds of requests may not be counted yet.",
+		Tags: []string{"users"},
+		Parameters: []openapi.Parameter{{
+			Name:        "days",
+			In:          "query",
+			Description: "How many days to list, today included: 30 by default, up to 90",
+			Schema:      &openapi.Schema{Type: "integer"},
+		}},
+		Responses: map[string]*openapi.Response{"200": d.ok("The usage", d.list("APIUsage"))},
+	})
+	d.add("GET", "/users/me/notifications", &openapi.Operation{
+		OperationID: "getNotificationSettings",
+		Summary:     "Get the user's notification settings",
+		Tags:        []string{"notifications"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The settings", settings)},
+	})
+	d.add("PUT", "/users/me/notifications", &openapi.Operation{
+		OperationID: "updateNotificationSettings",
+		Summary:     "Change the user's notification settings; omitted ones are kept",
+		Tags:        []string{"notifications"},
+		RequestBody: d.body(d.Ref("NotificationSettingsRequest", updateNotificationSettingsRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The settings", settings)},
+	})
+	preferences := d.Ref("Preferences", preferencesJSON{})
+	d.add("GET", "/users/me/preferences", &openapi.Operation{
+		OperationID: "getPreferences",
+		Summary:     "Get the user's interface preferences",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The preferences", preferences)},
+	})
+	d.add("PUT", "/users/me/preferences", &openapi.Operation{
+		OperationID: "updatePreferences",
+		Summary:     "Change the user's interface preferences; omitted ones are kept",
+		Tags:        []string{"users"},
+		RequestBody: d.body(d.Ref("PreferencesRequest", updatePreferencesRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The preferences", preferences)},
+	})
+	profileSettings := d.Ref("ProfileSettings", profileSettingsJSON{})
+	d.add("GET", "/users/me/profile", &openapi.Operation{
+		OperationID: "getProfileSettings",
+		Summary:     "Get the settings of the user's public profile",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The settings", profileSettings)},
+	})
+	d.add("PUT", "/users/me/profile", &openapi.Operation{
+		OperationID: "updateProfileSettings",
+		Summary:     "Change the settings of the user's public profile; omitted ones are kept",
+		Tags:        []string{"users"},
+		RequestBody: d.body(d.Ref("ProfileSettingsRequest", updateProfileSettingsRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The settings", profileSettings)},
+	})
+	policyStatus := d.Ref("Policies", policiesJSON{})
+	d.add("GET", "/users/me/policies", &openapi.Operation{
+		OperationID: "getPolicies",
+		Summary:     "List the current policy documents and which the user accepted",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The policies", policyStatus)},
+	})
+	d.add("POST", "/users/me/policies", &openapi.Operation{
+		OperationID: "acceptPolicies",
+		Summary:     "Record that the user accepted current versions of policy documents",
+		Tags:        []string{"users"},
+		RequestBody: d.body(d.Ref("AcceptPoliciesRequest", acceptPoliciesRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The policies", policyStatus)},
+	})
+	calendarFeed := d.Ref("CalendarFeed", calendarFeedJSON{})
+	d.add("GET", "/users/me/calendar", &openapi.Operation{
+		OperationID: "getCalendarFeed",
+		Summary:     "Get the URL of the user's iCalendar feed of portfolio events",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The feed", calendarFeed)},
+	})
+	d.add("POST", "/users/me/calendar/reset", &openapi.Operation{
+		OperationID: "resetCalendarFeed",
+		Summary:     "Give the calendar feed a new URL; the old one stops working",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The feed", calendarFeed)},
+	})
+	d.add("GET", "/users/me/avatar", &openapi.Operation{
+		OperationID: "getAvatar",
+		Summary:     "Download the user's avatar",
+		Tags:        []string{"users"},
+		Responses: map[string]*openapi.Response{"200": {
+			Description: "The image",
+			Content: map[string]openapi.MediaType{
+				"image/jpeg": {Schema: &openapi.Schema{Type: "string", Format: "binary"}},
+				"image/png":  {Schema: &openapi.Schema{Type: "string", Format: "binary"}},
+			},
+		}},
+	})
+	d.add("PUT", "/users/me/avatar", &openapi.Operation{
+		OperationID: "setAvatar",
+		Summary:     "Upload an avatar, cropped to a square and scaled down",
+		Tags:        []string{"users"},
+		RequestBody: d.fileBody("A JPEG or PNG image"),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The user", user)},
+	})
+	d.add("DELETE", "/users/me/avatar", &openapi.Operation{
+		OperationID: "deleteAvatar",
+		Summary:     "Remove the user's avatar",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("Removed", nil)},
+	})
+	d.Ref("Session", SessionInfo{})
+	d.add("GET", "/users/me/sessions", &openapi.Operation{
+		OperationID: "listSessions",
+		Summary:     "List the browsers the user is logged in from, the most recently used first",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The sessions", d.list("Session"))},
+	})
+	d.add("DELETE", "/users/me/sessions", &openapi.Operation{
+		OperationID: "endOtherSessions",
+		Summary:     "Log out of all sessions but the current one; with an API key, of all of them",
+		Tags:        []string{"users"},
+		Responses: map[string]*openapi.Response{
+			"200": d.ok("How many sessions ended", d.Ref("EndedSessions", endSessionsJSON{}))},
+	})
+	d.add("DELETE", "/users/me/sessions/{id}", &openapi.Operation{
+		OperationID: "endSession",
+		Summary:     "Log out of a session",
+		Tags:        []string{"users"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("Ended", nil)},
+	})
+
+	// Stocklists and attachments
+	d.add("GET", "/stocklists", &openapi.Operation{
+		OperationID: "listStocklists",
+		Summary:     "List the user's stocklists",
+		Tags:        []string{"stocklists"},
+		Parameters:  []openapi.Parameter{ifNoneMatch},
+		Responses: map[string]*openapi.Response{
+			"200": withHeaders(d.ok("The stocklists", d.list("Stocklist")), etagHeaders),
+			"304": notModified,
+		},
+	})
+	d.add("POST", "/stocklists", &openapi.Operation{
+		OperationID: "createStocklist",
+		Summary:     "Create a stocklist",
+		Tags:        []string{"stocklists"},
+		RequestBody: d.body(stocklistReq),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The new stocklist", stocklist)},
+	})
+	d.add("GET", "/stocklists/export.csv", &openapi.Operation{
+		OperationID: "exportStocklists",
+		Summary:     "Download the user's stocklists as CSV",
+		Tags:        []string{"stocklists"},
+		Responses: map[string]*openapi.Response{
+			"200": {
+				Description: "The stocklists",
+				Content:     map[string]openapi.MediaType{"text/csv": {Schema: &openapi.Schema{Type: "string"}}},
+			},
+			"303": withHeaders(&openapi.Response{
+				Description: "With an export bucket configured, a temporary link to the stocklists in it",
+			}, map[string]openapi.Header{"Location": {Schema: &openapi.Schema{Type: "string"}}}),
+		},
+	})
+	d.add("GET", "/stocklists/{id}", &openapi.Operation{
+		OperationID: "getStocklist",
+		Summary:     "Get a stocklist",
+		Tags:        []string{"stocklists"},
+		Parameters:  []openapi.Parameter{ifNoneMatch},
+		Responses: map[string]*openapi.Response{
+			"200": withHeaders(d.ok("The stocklist", stocklist), etagHeaders),
+			"304": notModified,
+		},
+	})
+	d.add("PUT", "/stocklists/{id}", &openapi.Operation{
+		OperationID: "updateStocklist",
+		Summary:     "Rename a stocklist",
+		Description: "Fails with 409 Conflict if the stocklist is changed concurrently.",
+		Tags:        []string{"stocklists"},
+		Parameters:  []openapi.Parameter{ifMatch},
+		RequestBody: d.body(stocklistReq),
+		Responses: map[string]*openapi.Response{
+			"200": withHeaders(d.ok("The stocklist", stocklist), etagHeaders),
+		},
+	})
+	d.add("DELETE", "/stocklists/{id}", &openapi.Operation{
+		OperationID: "deleteStocklist",
+		Summary:     "Delete a stocklist",
+		Tags:        []string{"stocklists"},
+		Parameters:  []openapi.Parameter{ifMatch},
+		Responses:   map[string]*openapi.Response{"200": d.ok("Deleted", nil)},
+	})
+	d.add("GET", "/stocklists/{id}/attachments", &openapi.Operation{
+		OperationID: "listAttachments",
+		Summary:     "List the attachments of a stocklist",
+		Tags:        []string{"attachments"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The attachments", d.list("Attachment"))},
+	})
+	d.add("POST", "/stocklists/{id}/attachments", &openapi.Operation{
+		OperationID: "createAttachment",
+		Summary:     "Attach a file to a stocklist",
+		Tags:        []string{"attachments"},
+		RequestBody: d.fileBody("An image, PDF or text file"),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The attachment", attachment)},
+	})
+	d.add("GET", "/stocklists/{id}/attachments/{aid}", &openapi.Operation{
+		OperationID: "getAttachment",
+		Summary:     "Download an attachment",
+		Tags:        []string{"attachments"},
+		Responses: map[string]*openapi.Response{"200": {
+			Description: "The file, with the content type it was uploaded with",
+			Content: map[string]openapi.MediaType{
+				"application/octet-stream": {Schema: &openapi.Schema{Type: "string", Format: "binary"}},
+			},
+		}},
+	})
+	d.add("DELETE", "/stocklists/{id}/attachments/{aid}", &openapi.Operation{
+		OperationID: "deleteAttachment",
+		Summary:     "Delete an attachment",
+		Tags:        []string{"attachments"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("Deleted", nil)},
+	})
+
+	// Guest sessions
+	guestStocklist := d.Ref("GuestStocklist", guestStocklistJSON{})
+	d.add("POST", "/guests", &openapi.Operation{
+		OperationID: "createGuest",
+		Summary:     "Start a guest session, to build stocklists before signing up",
+		Description: fmt.Sprintf("Guest sessions last %d days. Their stocklists move to the "+
+			"account of the guest_token passed when signing up, or to POST /users/me/guest.",
+			models.GuestTTL/(24*time.Hour)),
+		Tags:      []string{"guests"},
+		Security:  openapi.Public,
+		Responses: map[string]*openapi.Response{"201": d.ok("The guest session", d.Ref("Guest", guestJSON{}))},
+	})
+	d.add("GET", "/guest/stocklists", &openapi.Operation{
+		OperationID: "listGuestStocklists",
+		Summary:     "List the guest's stocklists",
+		Tags:        []string{"guests"},
+		Security:    guestSecurity,
+		Responses:   map[string]*openapi.Response{"200": d.ok("The stocklists", d.list("GuestStocklist"))},
+	})
+	d.add("POST", "/guest/stocklists", &openapi.Operation{
+		OperationID: "createGuestStocklist",
+		Summary:     fmt.Sprintf("Create a stocklist of the guest, up to %d", models.MaxGuestStocklists),
+		Tags:        []string{"guests"},
+		Security:    guestSecurity,
+		RequestBody: d.body(d.Ref("GuestStocklistRequest", guestStocklistRequest{})),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The new stocklist", guestStocklist)},
+	})
+	d.add("DELETE", "/guest/stocklists/{id}", &openapi.Operation{
+		OperationID: "deleteGuestStocklist",
+		Summary:     "Delete a stocklist of the guest",
+		Tags:        []string{"guests"},
+		Security:    guestSecurity,
+		Responses:   map[string]*openapi.Response{"200": d.ok("Deleted", nil)},
+	})
+
+	// Organizations
+	organization := d.Ref("Organization", organizationJSON{})
+	orgReq := d.Ref("OrganizationRequest", organizationRequest{})
+	member := d.Ref("Member", memberJSON{})
+	d.add("GET", "/orgs", &openapi.Operation{
+		OperationID: "listOrganizations",
+		Summary:     "List the organizations the user is a member of, with their role",
+		Tags:        []string{"organizations"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The organizations", d.list("Organization"))},
+	})
+	d.add("POST", "/orgs", &openapi.Operation{
+		OperationID: "createOrganization",
+		Summary:     "Create an organization, with the user as its owner",
+		Tags:        []string{"organizations"},
+		RequestBody: d.body(orgReq),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The new organization", organization)},
+	})
+	d.add("GET", "/orgs/{id}", &openapi.Operation{
+		OperationID: "getOrganization",
+		Summary:     "Get an organization, with the seats it uses",
+		Description: "Members and pending invitations each take a seat. " +
+			"Organizations the user isn't a member of are not found.",
+		Tags: []string{"organizations"},
+		Responses: map[string]*openapi.Response{
+			"200": d.ok("The organization", d.Ref("OrganizationDetail", organizationDetailJSON{})),
+		},
+	})
+	d.add("PUT", "/orgs/{id}", &openapi.Operation{
+		OperationID: "updateOrganization",
+		Summary:     "Rename an organization; admins and owners only",
+		Tags:        []string{"organizations"},
+		RequestBody: d.body(orgReq),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The organization", organization)},
+	})
+	d.add("GET", "/orgs/{id}/members", &openapi.Operation{
+		OperationID: "listMembers",
+		Summary:     "List the members of an organization",
+		Tags:        []string{"organizations"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The members", d.list("Member"))},
+	})
+	d.add("PUT", "/orgs/{id}/members/{uid}", &openapi.Operation{
+		OperationID: "setMemberRole",
+		Summary:     "Change the role of a member",
+		Description: "Roles are, from the least to the most powerful, " +
+			strings.Join(models.OrgRoles, ", ") + ". Admins change the roles of " +
+			"non-owners; only owners make or unmake owners, and the last owner keeps the role.",
+		Tags:        []string{"organizations"},
+		RequestBody: d.body(d.Ref("RoleRequest", roleRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The member", member)},
+	})
+	d.add("DELETE", "/orgs/{id}/members/{uid}", &openapi.Operation{
+		OperationID: "removeMember",
+		Summary:     "Remove a member, or leave the organization",
+		Description: "Members remove themselves to leave; the last owner can't. " +
+			"The stocklists they created stay with the organization.",
+		Tags:      []string{"organizations"},
+		Responses: map[string]*openapi.Response{"200": d.ok("Removed", nil)},
+	})
+	d.add("GET", "/orgs/{id}/invites", &openapi.Operation{
+		OperationID: "listOrganizationInvites",
+		Summary:     "List the pending invitations to an organization; admins and owners only",
+		Tags:        []string{"organizations"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The invitations", d.list("OrganizationInvite"))},
+	})
+	d.add("POST", "/orgs/{id}/invites", &openapi.Operation{
+		OperationID: "inviteToOrganization",
+		Summary:     "Invite an email address to an organization; admins and owners only",
+		Description: fmt.Sprintf("The role defaults to member. The token is returned once, "+
+			"for the invitee to accept within %d days; the invitation takes a seat until then. "+
+			"Fails with 409 Conflict when the organization has no seats left.",
+			models.OrgInviteTTL/(24*time.Hour)),
+		Tags:        []string{"organizations"},
+		RequestBody: d.body(d.Ref("OrganizationInviteRequest", orgInviteRequest{})),
+		Responses: map[string]*openapi.Response{
+			"201": d.ok("The invitation", d.Ref("OrganizationInvite", orgInviteJSON{})),
+		},
+	})
+	d.add("DELETE", "/orgs/{id}/invites/{iid}", &openapi.Operation{
+		OperationID: "revokeOrganizationInvite",
+		Summary:     "Revoke a pending invitation; admins and owners only",
+		Tags:        []string{"organizations"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("Revoked", nil)},
+	})
+	d.add("POST", "/orgs/invites/accept", &openapi.Operation{
+		OperationID: "acceptOrganizationInvite",
+		Summary:     "Join an organization with an invitation token",
+		Description: "The invitation must have been sent to the user's email address.",
+		Tags:        []string{"organizations"},
+		RequestBody: d.body(d.Ref("AcceptOrganizationInviteRequest", acceptOrgInviteRequest{})),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The organization joined", organization)},
+	})
+	d.add("GET", "/orgs/{id}/stocklists", &openapi.Operation{
+		OperationID: "listOrganizationStocklists",
+		Summary:     "List the stocklists of an organization",
+		Description: "Members reach them at /stocklists/{id} too: viewers can read them, " +
+			"members and above change them.",
+		Tags:      []string{"organizations"},
+		Responses: map[string]*openapi.Response{"200": d.ok("The stocklists", d.list("Stocklist"))},
+	})
+	d.add("POST", "/orgs/{id}/stocklists", &openapi.Operation{
+		OperationID: "createOrganizationStocklist",
+		Summary:     "Create a stocklist of an organization; members and above",
+		Tags:        []string{"organizations"},
+		RequestBody: d.body(stocklistReq),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The new stocklist", stocklist)},
+	})
+
+	// Notifications, administration and webhooks
+	d.add("GET", "/notifications/stream", &openapi.Operation{
+		OperationID: "streamNotifications",
+		Summary:     "Receive notifications as server-sent events",
+		Description: "Each event is named after the notification type and carries the " +
+			"notification as JSON data. A \"reconnect\" event asks the client to reconnect.",
+		Tags: []string{"notifications"},
+		Responses: map[string]*openapi.Response{"200": {
+			Description: "The event stream",
+			Content:     map[string]openapi.MediaType{"text/event-stream": {Schema: &openapi.Schema{Type: "string"}}},
+		}},
+	})
+	d.add("GET", "/admin/maintenance", &openapi.Operation{
+		OperationID: "getMaintenance",
+		Summary:     "Get the maintenance mode; admins only",
+		Tags:        []string{"admin"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The maintenance mode", maintenance)},
+	})
+	d.add("PUT", "/admin/maintenance", &openapi.Operation{
+		OperationID: "setMaintenance",
+		Summary:     "Turn maintenance mode on or off; admins only",
+		Tags:        []string{"admin"},
+		RequestBody: d.body(maintenance),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The maintenance mode", maintenance)},
+	})
+	d.Ref("BlockedDomain", blockedDomainJSON{})
+	blockedDomains := d.ok("The blocked domains", d.list("BlockedDomain"))
+	d.add("GET", "/admin/blocked-domains", &openapi.Operation{
+		OperationID: "listBlockedDomains",
+		Summary:     "List the email domains signups can't use; admins only",
+		Tags:        []string{"admin"},
+		Responses:   map[string]*openapi.Response{"200": blockedDomains},
+	})
+	d.add("POST", "/admin/blocked-domains", &openapi.Operation{
+		OperationID: "blockDomains",
+		Summary:     "Block email domains and their subdomains; admins only",
+		Tags:        []string{"admin"},
+		RequestBody: d.body(d.Ref("BlockedDomainsRequest", blockedDomainsRequest{})),
+		Responses:   map[string]*openapi.Response{"200": blockedDomains},
+	})
+	d.add("DELETE", "/admin/blocked-domains/{domain}", &openapi.Operation{
+		OperationID: "unblockDomain",
+		Summary:     "Unblock an email domain; admins only",
+		Tags:        []string{"admin"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("Unblocked", nil)},
+	})
+	d.add("POST", "/mail/events", &openapi.Operation{
+		OperationID: "mailEvent",
+		Summary:     "Mailgun webhook for bounces and complaints, authenticated by its signature",
+		Tags:        []string{"mail"},
+		Security:    openapi.Public,
+		RequestBody: d.body(&openapi.Schema{Type: "object", Description: "A Mailgun event"}),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The event was handled", d.Ref("EventResult", eventJSON{}))},
+	})
+	d.add("GET", "/billing", &openapi.Operation{
+		OperationID: "getBilling",
+		Summary:     "Get the user's plan, subscription and the plans they can buy",
+		Tags:        []string{"billing"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The billing state", d.Ref("Billing", billingJSON{}))},
+	})
+	d.add("POST", "/billing/checkout", &openapi.Operation{
+		OperationID: "checkout",
+		Summary:     "Start a Stripe Checkout session to subscribe to a plan",
+		Description: "The client sends the user to the returned URL. The plan " +
+			"applies once Stripe reports the subscription as active.",
+		Tags:        []string{"billing"},
+		RequestBody: d.body(d.Ref("CheckoutRequest", checkoutRequest{})),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The checkout page", d.Ref("Checkout", checkoutJSON{}))},
+	})
+	d.add("POST", "/billing/stripe", &openapi.Operation{
+		OperationID: "stripeEvent",
+		Summary:     "Stripe webhook for subscription events, authenticated by its signature",
+		Tags:        []string{"billing"},
+		Security:    openapi.Public,
+		Parameters:  []openapi.Parameter{header("Stripe-Signature", "Stripe's signature of the event")},
+		RequestBody: d.body(&openapi.Schema{Type: "object", Description: "A Stripe event"}),
+		Responses:   map[string]*openapi.Response{"200": d.ok("The event was handled", d.Ref("EventResult", nil))},
+	})
+	d.add("GET", "/webhooks", &openapi.Operation{
+		OperationID: "listWebhooks",
+		Summary:     "List the user's webhooks",
+		Tags:        []string{"webhooks"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The webhooks", d.list("Webhook"))},
+	})
+	d.add("POST", "/webhooks", &openapi.Operation{
+		OperationID: "createWebhook",
+		Summary:     "Subscribe a URL to events",
+		Tags:        []string{"webhooks"},
+		RequestBody: d.body(webhookReq),
+		Responses:   map[string]*openapi.Response{"201": d.ok("The webhook, with its signing secret", webhook)},
+	})
+	d.add("DELETE", "/webhooks/{id}", &openapi.Operation{
+		OperationID: "deleteWebhook",
+		Summary:     "Delete a webhook",
+		Tags:        []string{"webhooks"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("Deleted", nil)},
+	})
+	d.add("GET", "/webhooks/{id}/deliveries", &openapi.Operation{
+		OperationID: "listDeliveries",
+		Summary:     "List the latest delivery attempts of a webhook",
+		Tags:        []string{"webhooks"},
+		Responses:   map[string]*openapi.Response{"200": d.ok("The attempts", d.list("Delivery"))},
+	})
+	d.Components.Schemas["WebhookRequest"].Properties["events"].Items.Enum = models.WebhookEvents
+
+	// Events posted to webhooks. User events go to admins' webhooks only.
+	userEvent := d.Ref("UserEvent", webhooks.UserData{})
+	deleted := openapi.SchemaOf(webhooks.DeletedUserData{})
+	deleted.Properties["reason"].Enum = webhooks.DeletedReasons
+	deleted.Properties["merged_into"].Description = "The ID of the account a merged duplicate went into"
+	d.Components.Schemas["UserDeletedEvent"] = deleted
+	d.event(models.EventUserCreated, "userCreated", "A user signed up or was created", userEvent)
+	d.event(models.EventUserVerified, "userVerified", "A user confirmed their email address", userEvent)
+	d.event(models.EventUserDeleted, "userDeleted",
+		"A user was deleted, merged into another account or deprovisioned by the identity provider",
+		d.Ref("UserDeletedEvent", nil))
+	// Stocklist events go to the webhooks of the stocklist's owner, or
+	// its creator in an organization
+	stocklistEvent := d.Ref("StocklistEvent", models.StocklistPayload{})
+	d.event(models.EventStocklistCreated, "stocklistCreated", "A stocklist was created", stocklistEvent)
+	d.event(models.EventStocklistUpdated, "stocklistUpdated",
+		"A stocklist was renamed, shared or unshared, or moved to another account", stocklistEvent)
+	d.event(models.EventStocklistDeleted, "stocklistDeleted",
+		"A stocklist was deleted; the data is the stocklist before the deletion", stocklistEvent)
+	return d.Document
+}
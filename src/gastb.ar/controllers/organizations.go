@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// OrganizationsController lets users create organizations, manage their
+// members and invitations, and share stocklists with them.
+type OrganizationsController struct {
+	orgs *models.OrganizationService
+	ss   *models.StocklistService
+	// profileCache, if set, caches public profile pages
+	profileCache *ProfileCache
+}
+
+// NewOrganizationsController creates a controller on top of initialized
+// organization and stocklist services
+func NewOrganizationsController(orgs *models.OrganizationService,
+	ss *models.StocklistService) *OrganizationsController {
+	return &OrganizationsController{
+		orgs: orgs,
+		ss:   ss,
+	}
+}
+
+// SetProfileCache drops the cached profile page of members who create a
+// public stocklist for their organization
+func (oc *OrganizationsController) SetProfileCache(pc *ProfileCache) {
+	oc.profileCache = pc
+}
+
+type organizationJSON struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	// Role is the role of the user making the request
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type seatsJSON struct {
+	Used    int `json:"used"`
+	Pending int `json:"pending"`
+	// Limit is 0 when seats are unlimited
+	Limit int `json:"limit"`
+}
+
+type organizationDetailJSON struct {
+	organizationJSON
+	Seats seatsJSON `json:"seats"`
+}
+
+type memberJSON struct {
+	UserID   uint      `json:"user_id"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type orgInviteJSON struct {
+	ID        uint      `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Token is only returned when the invitation is created, to be
+	// posted to /api/v1/orgs/invites/accept by the invitee
+	Token string `json:"token,omitempty"`
+}
+
+func newOrgInviteJSON(invite *models.OrgInvite) orgInviteJSON {
+	return orgInviteJSON{
+		ID:        invite.ID,
+		Email:     invite.Email,
+		Role:      invite.Role,
+		ExpiresAt: invite.ExpiresAt,
+	}
+}
+
+type organizationRequest struct {
+	Name string `json:"name"`
+}
+
+type orgInviteRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+type acceptOrgInviteRequest struct {
+	Token string `json:"token"`
+}
+
+// membership returns the membership of the user in the organization in
+// the {id} route variable, if their role is role or above. Organizations
+// they are not a member of are not found.
+func (oc *OrganizationsController) membership(r *http.Request, user *models.User, role string) (*models.Membership, error) {
+	id, err := idParam(r)
+	if err != nil {
+		return nil, err
+	}
+	return oc.orgs.Authorize(id, user.ID, role)
+}
+
+// Organizations handles GET /api/v1/orgs
+func (oc *OrganizationsController) Organizations(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	orgs, err := oc.orgs.ForUser(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]organizationJSON, 0, len(orgs))
+	for _, org := range orgs {
+		data = append(data, organizationJSON{
+			ID:        org.ID,
+			Name:      org.Name,
+			Role:      org.Role,
+			CreatedAt: org.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// Create handles POST /api/v1/orgs, making the user its owner
+func (oc *OrganizationsController) Create(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req organizationRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	org := &models.Organization{Name: req.Name}
+	if err := oc.orgs.Create(org, user.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, organizationJSON{
+		ID:        org.ID,
+		Name:      org.Name,
+		Role:      models.OrgRoleOwner,
+		CreatedAt: org.CreatedAt,
+	})
+}
+
+// Organization handles GET /api/v1/orgs/{id}, with the seats it uses
+func (oc *OrganizationsController) Organization(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	org, err := oc.orgs.ByID(m.OrganizationID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	seats, err := oc.orgs.Seats(org.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, organizationDetailJSON{
+		organizationJSON: organizationJSON{
+			ID:        org.ID,
+			Name:      org.Name,
+			Role:      m.Role,
+			CreatedAt: org.CreatedAt,
+		},
+		Seats: seatsJSON{
+			Used:    seats.Used,
+			Pending: seats.Pending,
+			Limit:   seats.Limit,
+		},
+	})
+}
+
+// Update handles PUT /api/v1/orgs/{id}, renaming the organization
+func (oc *OrganizationsController) Update(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleAdmin)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req organizationRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	org, err := oc.orgs.ByID(m.OrganizationID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := oc.orgs.Rename(org, req.Name); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, organizationJSON{
+		ID:        org.ID,
+		Name:      org.Name,
+		Role:      m.Role,
+		CreatedAt: org.CreatedAt,
+	})
+}
+
+// Members handles GET /api/v1/orgs/{id}/members
+func (oc *OrganizationsController) Members(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	members, err := oc.orgs.Members(m.OrganizationID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]memberJSON, 0, len(members))
+	for _, member := range members {
+		data = append(data, memberJSON{
+			UserID:   member.UserID,
+			Role:     member.Role,
+			JoinedAt: member.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// SetRole handles PUT /api/v1/orgs/{id}/members/{uid}
+func (oc *OrganizationsController) SetRole(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	uid, err := uintParam(r, "uid")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req roleRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	member, err := oc.orgs.SetRole(m, uid, strings.TrimSpace(req.Role))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, memberJSON{
+		UserID:   member.UserID,
+		Role:     member.Role,
+		JoinedAt: member.CreatedAt,
+	})
+}
+
+// RemoveMember handles DELETE /api/v1/orgs/{id}/members/{uid}. Members
+// leave by removing themselves.
+func (oc *OrganizationsController) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	uid, err := uintParam(r, "uid")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := oc.orgs.RemoveMember(m, uid); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// Invites handles GET /api/v1/orgs/{id}/invites, listing the pending
+// invitations
+func (oc *OrganizationsController) Invites(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleAdmin)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	invites, err := oc.orgs.PendingInvites(m.OrganizationID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]orgInviteJSON, 0, len(invites))
+	for i := range invites {
+		data = append(data, newOrgInviteJSON(&invites[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// Invite handles POST /api/v1/orgs/{id}/invites. The token is returned
+// once, for the inviter to pass on; like admin invites, it isn't emailed.
+func (oc *OrganizationsController) Invite(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleAdmin)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req orgInviteRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	role := strings.TrimSpace(req.Role)
+	if role == "" {
+		role = models.OrgRoleMember
+	}
+	invite, err := oc.orgs.Invite(m, req.Email, role)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := newOrgInviteJSON(invite)
+	data.Token = invite.Token
+	writeJSON(w, http.StatusCreated, data)
+}
+
+// RevokeInvite handles DELETE /api/v1/orgs/{id}/invites/{iid}
+func (oc *OrganizationsController) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleAdmin)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	iid, err := uintParam(r, "iid")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := oc.orgs.RevokeInvite(m, iid); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// AcceptInvite handles POST /api/v1/orgs/invites/accept
+func (oc *OrganizationsController) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req acceptOrgInviteRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	m, err := oc.orgs.AcceptInvite(strings.TrimSpace(req.Token), user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	org, err := oc.orgs.ByID(m.OrganizationID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, organizationJSON{
+		ID:        org.ID,
+		Name:      org.Name,
+		Role:      m.Role,
+		CreatedAt: org.CreatedAt,
+	})
+}
+
+// Stocklists handles GET /api/v1/orgs/{id}/stocklists
+func (oc *OrganizationsController) Stocklists(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	stocklists, err := oc.ss.AsTenant(user.ID).ByOrganizationID(m.OrganizationID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]stocklistJSON, 0, len(stocklists))
+	for i := range stocklists {
+		data = append(data, newStocklistJSON(&stocklists[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// CreateStocklist handles POST /api/v1/orgs/{id}/stocklists. The
+// stocklist is the organization's; the user is kept as its creator.
+func (oc *OrganizationsController) CreateStocklist(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	m, err := oc.membership(r, user, models.OrgRoleMember)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req stocklistRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	stocklist := &models.Stocklist{
+		UserID:         user.ID,
+		OrganizationID: &m.OrganizationID,
+		Name:           strings.TrimSpace(req.Name),
+		Public:         req.Public != nil && *req.Public,
+	}
+	if err := oc.ss.AsTenant(user.ID).Create(stocklist); err != nil {
+		writeError(w, err)
+		return
+	}
+	oc.profileCache.InvalidateStocklist(r.Context(), stocklist, false)
+	writeJSON(w, http.StatusCreated, newStocklistJSON(stocklist))
+}
@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/context"
+	"gastb.ar/forms"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+	"gastb.ar/policies"
+	"gastb.ar/views"
+)
+
+// PoliciesController shows the site's policy documents and records
+// users accepting them, on the consent page the Policies middleware sends
+// them to and through the API.
+type PoliciesController struct {
+	ShowView    *views.View
+	ConsentView *views.View
+	docs        *policies.Set
+	ps          *models.PolicyService
+}
+
+// NewPoliciesController creates a controller for a set of documents on
+// top of an initialized policy service
+func NewPoliciesController(docs *policies.Set, ps *models.PolicyService) *PoliciesController {
+	return &PoliciesController{
+		ShowView:    views.NewView("bootstrap", "policies/show"),
+		ConsentView: views.NewView("bootstrap", "policies/consent"),
+		docs:        docs,
+		ps:          ps,
+	}
+}
+
+// ConsentForm is submitted from the consent page
+type ConsentForm struct {
+	Next   string `schema:"next"`
+	Accept bool   `schema:"accept"`
+}
+
+// PolicyDocument is a document with its title in the request's language
+type PolicyDocument struct {
+	Title string
+	*policies.Document
+}
+
+// policyTitle returns the title of a kind of document
+func policyTitle(r *http.Request, kind string) string {
+	switch kind {
+	case policies.Terms:
+		return tr(r, "Terms of service")
+	case policies.Privacy:
+		return tr(r, "Privacy policy")
+	}
+	return kind
+}
+
+// Show handles GET /policies/{kind} and /policies/{kind}/{version},
+// which anyone can read
+func (pC *PoliciesController) Show(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	doc, err := pC.docs.Get(vars["kind"], vars["version"])
+	if err != nil {
+		httperror.Render(w, r, http.StatusNotFound, "")
+		return
+	}
+	pC.ShowView.Render(w, r, PolicyDocument{policyTitle(r, doc.Kind), doc})
+}
+
+// Consent handles GET /policies/accept, listing the documents the user
+// has yet to accept
+func (pC *PoliciesController) Consent(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	next := localPath(r.URL.Query().Get("next"))
+	pending, err := pC.ps.Pending(user.ID, pC.docs.Policies())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "checking policy acceptance failed", "error", err)
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if len(pending) == 0 {
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+	pC.renderConsent(w, r, pending, forms.Form{Values: ConsentForm{Next: next}}, nil)
+}
+
+// renderConsent renders the consent page for pending documents
+func (pC *PoliciesController) renderConsent(w http.ResponseWriter, r *http.Request,
+	pending []models.Policy, form forms.Form, errs forms.Errors) {
+	var docs []PolicyDocument
+	for _, d := range pC.docs.Filter(pending) {
+		docs = append(docs, PolicyDocument{policyTitle(r, d.Kind), d})
+	}
+	form.Errors = errs
+	pC.ConsentView.Render(w, r, struct {
+		Documents []PolicyDocument
+		Form      forms.Form
+	}{docs, form})
+}
+
+// Accept handles POST /policies/accept, recording that the user accepted
+// the documents that were pending, and sends them where they were going
+func (pC *PoliciesController) Accept(w http.ResponseWriter, r *http.Request) {
+	var form ConsentForm
+	if _, err := forms.Parse(r, &form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	form.Next = localPath(form.Next)
+	user := context.User(r.Context())
+	pending, err := pC.ps.Pending(user.ID, pC.docs.Policies())
+	if err == nil && len(pending) > 0 {
+		if !form.Accept {
+			pC.renderConsent(w, r, pending, forms.Form{Values: form},
+				forms.Errors{"accept": "must be checked to continue"})
+			return
+		}
+		err = pC.ps.Accept(user.ID, pending, clientOf(r).IP, time.Now())
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "recording policy acceptance failed", "error", err)
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	http.Redirect(w, r, form.Next, http.StatusFound)
+}
+
+// localPath returns next if it is a path on this site, and / otherwise,
+// so that links can't send users elsewhere
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") ||
+		strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+//
+// API
+//
+
+type policyJSON struct {
+	Kind    string `json:"kind"`
+	Version string `json:"version"`
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+}
+
+type policyAcceptanceJSON struct {
+	Kind       string    `json:"kind"`
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	IP         string    `json:"ip"`
+}
+
+type policiesJSON struct {
+	// Current are the versions users must accept, Pending those the
+	// user hasn't
+	Current  []policyJSON           `json:"current"`
+	Pending  []policyJSON           `json:"pending"`
+	Accepted []policyAcceptanceJSON `json:"accepted"`
+}
+
+// acceptPoliciesRequest is the body of POST /api/v1/users/me/policies
+type acceptPoliciesRequest struct {
+	Policies []models.Policy `json:"policies"`
+}
+
+// status returns the policies of a user
+func (pC *PoliciesController) status(r *http.Request, user *models.User) (*policiesJSON, error) {
+	current := pC.docs.Policies()
+	pending, err := pC.ps.Pending(user.ID, current)
+	if err != nil {
+		return nil, err
+	}
+	accepted, err := pC.ps.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	toJSON := func(ps []models.Policy) []policyJSON {
+		out := make([]policyJSON, 0, len(ps))
+		for _, p := range ps {
+			out = append(out, policyJSON{p.Kind, p.Version, policyTitle(r, p.Kind),
+				"/policies/" + p.Kind + "/" + p.Version})
+		}
+		return out
+	}
+	data := &policiesJSON{
+		Current:  toJSON(current),
+		Pending:  toJSON(pending),
+		Accepted: make([]policyAcceptanceJSON, 0, len(accepted)),
+	}
+	for _, a := range accepted {
+		data.Accepted = append(data.Accepted,
+			policyAcceptanceJSON{a.Kind, a.Version, a.AcceptedAt, a.IP})
+	}
+	return data, nil
+}
+
+// Policies handles GET /api/v1/users/me/policies
+func (pC *PoliciesController) Policies(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	data, err := pC.status(r, user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// AcceptPolicies handles POST /api/v1/users/me/policies, recording that
+// the user accepted current versions of documents, with the time and
+// the client's IP address
+func (pC *PoliciesController) AcceptPolicies(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req acceptPoliciesRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(req.Policies) == 0 {
+		writeError(w, requestError("policies must list the documents accepted"))
+		return
+	}
+	current := pC.docs.Policies()
+	for _, p := range req.Policies {
+		if !containsPolicy(current, p) {
+			writeError(w, requestError("only current versions can be accepted: "+
+				p.Kind+" "+p.Version+" is not one"))
+			return
+		}
+	}
+	if err := pC.ps.Accept(user.ID, req.Policies, clientOf(r).IP, time.Now()); err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := pC.status(r, user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+func containsPolicy(ps []models.Policy, p models.Policy) bool {
+	for _, q := range ps {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
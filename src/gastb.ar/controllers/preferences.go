@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"net/http"
+
+	"gastb.ar/models"
+)
+
+// PreferencesController serves the interface preferences of users to API
+// clients, so settings picked on one device apply on the others.
+type PreferencesController struct {
+	ps *models.PreferenceService
+}
+
+// NewPreferencesController creates a controller on top of an initialized
+// preference service
+func NewPreferencesController(ps *models.PreferenceService) *PreferencesController {
+	return &PreferencesController{
+		ps: ps,
+	}
+}
+
+type preferencesJSON struct {
+	// Theme is system, light or dark
+	Theme string `json:"theme"`
+	// Currency is an ISO 4217 code, such as USD
+	Currency string `json:"currency"`
+	// RowsPerPage is 10, 25, 50 or 100
+	RowsPerPage int `json:"rows_per_page"`
+	// DefaultStocklistID is the stocklist opened first, 0 for none
+	DefaultStocklistID uint `json:"default_stocklist_id"`
+}
+
+func newPreferencesJSON(p *models.Preferences) preferencesJSON {
+	return preferencesJSON{
+		Theme:              p.Theme,
+		Currency:           p.Currency,
+		RowsPerPage:        p.RowsPerPage,
+		DefaultStocklistID: p.DefaultStocklistID,
+	}
+}
+
+// updatePreferencesRequest is the body of
+// PUT /api/v1/users/me/preferences; omitted preferences are left alone
+type updatePreferencesRequest struct {
+	Theme       *string `json:"theme"`
+	Currency    *string `json:"currency"`
+	RowsPerPage *int    `json:"rows_per_page"`
+	// 0 clears the default stocklist
+	DefaultStocklistID *uint `json:"default_stocklist_id"`
+}
+
+// Preferences handles GET /api/v1/users/me/preferences
+func (pC *PreferencesController) Preferences(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	p, err := pC.ps.ForUser(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPreferencesJSON(p))
+}
+
+// UpdatePreferences handles PUT /api/v1/users/me/preferences
+func (pC *PreferencesController) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req updatePreferencesRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	p, err := pC.ps.ForUser(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Theme != nil {
+		p.Theme = *req.Theme
+	}
+	if req.Currency != nil {
+		p.Currency = *req.Currency
+	}
+	if req.RowsPerPage != nil {
+		p.RowsPerPage = *req.RowsPerPage
+	}
+	if req.DefaultStocklistID != nil {
+		p.DefaultStocklistID = *req.DefaultStocklistID
+	}
+	if err := pC.ps.Update(user.ID, p); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPreferencesJSON(p))
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	ctxpkg "context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/cache"
+	"gastb.ar/context"
+	"gastb.ar/flash"
+	"gastb.ar/i18n"
+	"gastb.ar/middleware"
+	"gastb.ar/models"
+)
+
+// ProfileCache caches the public profile pages at /u/{username} for
+// visitors who aren't logged in, who all see the same page in their
+// language. Controllers that change what a profile shows drop its pages
+// with Invalidate. A nil ProfileCache caches nothing.
+type ProfileCache struct {
+	rc *middleware.ResponseCache
+	us *models.UserService
+}
+
+// NewProfileCache creates a ProfileCache keeping pages in c for ttl. The
+// user service looks up the owners of changed stocklists.
+func NewProfileCache(c cache.Cache, ttl time.Duration, us *models.UserService) *ProfileCache {
+	pc := &ProfileCache{us: us}
+	pc.rc = &middleware.ResponseCache{Cache: c, TTL: ttl, Key: pc.key}
+	return pc
+}
+
+// profileKey is the cache key of a profile page in a language
+func profileKey(username, locale string) string {
+	return "profile:" + locale + ":" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// key caches the page of anonymous requests only; the page of a logged
+// in user has their navigation bar, and a pending flash message must be
+// shown
+func (pc *ProfileCache) key(r *http.Request) string {
+	if context.User(r.Context()) != nil || flash.Pending(r) {
+		return ""
+	}
+	locale := context.Locale(r.Context())
+	if locale == "" {
+		locale = i18n.Default
+	}
+	return profileKey(mux.Vars(r)["username"], locale)
+}
+
+// ApplyFn takes in the profile page handler function and returns it
+// wrapped in the cache
+func (pc *ProfileCache) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	if pc == nil {
+		return next
+	}
+	return pc.rc.ApplyFn(next)
+}
+
+// Invalidate drops the pages of the profile at username in every
+// language
+func (pc *ProfileCache) Invalidate(username string) {
+	if pc == nil || username == "" {
+		return
+	}
+	var keys []string
+	for _, locale := range i18n.Languages() {
+		keys = append(keys, profileKey(username, locale))
+	}
+	pc.rc.Invalidate(keys...)
+}
+
+// InvalidateStocklist drops the profile pages of the owner of a
+// stocklist that is or was public. Failing to look the owner up is
+// logged; the pages expire with their TTL.
+func (pc *ProfileCache) InvalidateStocklist(ctx ctxpkg.Context, s *models.Stocklist, wasPublic bool) {
+	if pc == nil || !s.Public && !wasPublic {
+		return
+	}
+	owner, err := pc.us.ByID(s.UserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "looking up stocklist owner failed", "error", err)
+		return
+	}
+	pc.Invalidate(owner.GetUsername())
+}
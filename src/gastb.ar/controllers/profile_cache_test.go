@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/cache"
+	"gastb.ar/context"
+	"gastb.ar/models"
+)
+
+func TestProfileCache(t *testing.T) {
+	pc := NewProfileCache(cache.NewMemoryCache(), 0, nil)
+	calls := 0
+	router := mux.NewRouter()
+	router.HandleFunc("/u/{username}", pc.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprintf(w, "call %d", calls)
+	}))
+	get := func(r *http.Request) string {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		return rec.Body.String()
+	}
+
+	anon := httptest.NewRequest("GET", "/u/Ana", nil)
+	get(anon)
+	if got := get(httptest.NewRequest("GET", "/u/ana", nil)); got != "call 1" {
+		t.Errorf("anonymous request got %q, want the cached page", got)
+	}
+
+	es := httptest.NewRequest("GET", "/u/ana", nil)
+	es = es.WithContext(context.WithLocale(es.Context(), "es"))
+	if got := get(es); got != "call 2" {
+		t.Errorf("request in Spanish got %q, want a page of its own", got)
+	}
+
+	loggedIn := httptest.NewRequest("GET", "/u/ana", nil)
+	loggedIn = loggedIn.WithContext(context.WithUser(loggedIn.Context(), &models.User{}))
+	if got := get(loggedIn); got != "call 3" {
+		t.Errorf("logged in request got %q, want an uncached page", got)
+	}
+	flashed := httptest.NewRequest("GET", "/u/ana", nil)
+	flashed.AddCookie(&http.Cookie{Name: "flash", Value: "x"})
+	if got := get(flashed); got != "call 4" {
+		t.Errorf("request with a flash message got %q, want an uncached page", got)
+	}
+
+	pc.Invalidate("ANA")
+	if got := get(anon); got != "call 5" {
+		t.Errorf("after Invalidate the page is %q, want a fresh one", got)
+	}
+	if got := get(es); got != "call 6" {
+		t.Errorf("after Invalidate the Spanish page is %q, want a fresh one", got)
+	}
+}
+
+func TestNilProfileCache(t *testing.T) {
+	var pc *ProfileCache
+	h := func(w http.ResponseWriter, r *http.Request) {}
+	if pc.ApplyFn(h) == nil {
+		t.Error("ApplyFn on a nil ProfileCache returned no handler")
+	}
+	pc.Invalidate("ana")
+	pc.InvalidateStocklist(httptest.NewRequest("GET", "/", nil).Context(), &models.Stocklist{Public: true}, false)
+}
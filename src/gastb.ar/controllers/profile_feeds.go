@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"gastb.ar/atom"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+)
+
+// feedEntries is how many changes the feed of a stocklist shows
+const feedEntries = 50
+
+// stocklistFeedPath is the path of the feed of a public stocklist
+func stocklistFeedPath(username string, id uint) string {
+	return "/u/" + username + "/stocklists/" + strconv.FormatUint(uint64(id), 10) + "/feed"
+}
+
+// StocklistFeed handles GET /u/{username}/stocklists/{id}/feed, an Atom
+// feed of the changes to a stocklist shown on a public profile
+func (pC *ProfilesController) StocklistFeed(w http.ResponseWriter, r *http.Request) {
+	user, settings := pC.publicUser(w, r)
+	if user == nil {
+		return
+	}
+	id, err := idParam(r)
+	var stocklist *models.Stocklist
+	if err == nil {
+		stocklist, err = pC.ss.ByID(id)
+	}
+	var changes []models.Change
+	switch {
+	case err == models.ErrInvalidID, err == models.ErrNotFound:
+	case err != nil:
+		slog.ErrorContext(r.Context(), "looking up public stocklist failed", "error", err)
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	case settings.ShowStocklists && stocklist.Public &&
+		stocklist.UserID == user.ID && stocklist.OrganizationID == nil:
+		changes, err = pC.cs.ByStocklist(stocklist.ID, feedEntries)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "listing stocklist changes failed", "error", err)
+			httperror.Render(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		atom.Serve(w, r, stocklistFeed(pC.baseURL, user, stocklist, changes))
+		return
+	}
+	httperror.Render(w, r, http.StatusNotFound, "")
+}
+
+// stocklistFeed builds the feed of a public stocklist from its changes,
+// latest first. Changes made while the stocklist was private, or owned
+// by someone else before an account merge, are left out.
+func stocklistFeed(baseURL string, user *models.User, s *models.Stocklist,
+	changes []models.Change) *atom.Feed {
+	username := user.GetUsername()
+	self := baseURL + stocklistFeedPath(username, s.ID)
+	feed := &atom.Feed{
+		ID:      self,
+		Title:   s.Name + " (@" + username + ")",
+		Updated: s.UpdatedAt,
+		Link:    baseURL + "/u/" + username,
+		Self:    self,
+		Author:  username,
+	}
+	payloads := make([]*models.StocklistPayload, len(changes))
+	for i, c := range changes {
+		var p models.StocklistPayload
+		if err := json.Unmarshal([]byte(c.Payload), &p); err == nil {
+			payloads[i] = &p
+		}
+	}
+	for i, c := range changes {
+		p := payloads[i]
+		if p == nil || !p.Public || p.UserID != user.ID {
+			continue
+		}
+		// The change before is the next one, if it wasn't purged
+		var prev *models.StocklistPayload
+		if i+1 < len(payloads) {
+			prev = payloads[i+1]
+		}
+		title := p.Name + " was updated"
+		switch {
+		case c.Op == models.ChangeCreate:
+			title = p.Name + " was created"
+		case prev != nil && !prev.Public:
+			title = p.Name + " was made public"
+		case prev != nil && prev.Name != p.Name:
+			title = fmt.Sprintf("%s was renamed to %s", prev.Name, p.Name)
+		}
+		feed.Entries = append(feed.Entries, atom.Entry{
+			ID:      self + "#" + strconv.FormatUint(c.Seq, 10),
+			Title:   title,
+			Updated: c.CreatedAt,
+			Link:    feed.Link,
+		})
+		if c.CreatedAt.After(feed.Updated) {
+			feed.Updated = c.CreatedAt
+		}
+	}
+	return feed
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gastb.ar/models"
+)
+
+func TestStocklistFeed(t *testing.T) {
+	username := "ana"
+	user := &models.User{Username: &username}
+	user.ID = 1
+	s := &models.Stocklist{Name: "Dividends", Public: true}
+	s.ID = 7
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.UpdatedAt = start
+
+	change := func(seq uint64, op string, owner uint, name string, public bool) models.Change {
+		payload, _ := json.Marshal(models.StocklistPayload{
+			ID: 7, UserID: owner, Name: name, Public: public})
+		return models.Change{Seq: seq, Op: op, Payload: string(payload),
+			CreatedAt: start.Add(time.Duration(seq) * time.Hour)}
+	}
+	// Latest first
+	changes := []models.Change{
+		change(6, models.ChangeUpdate, 1, "Dividends", true),
+		change(5, models.ChangeUpdate, 1, "Dividends", true),
+		change(4, models.ChangeUpdate, 1, "Income", true),
+		change(3, models.ChangeUpdate, 1, "Income", false),
+		change(2, models.ChangeUpdate, 1, "Secret", false),
+		change(1, models.ChangeCreate, 2, "Bob's", true),
+	}
+	feed := stocklistFeed("https://gastb.ar", user, s, changes)
+
+	self := "https://gastb.ar/u/ana/stocklists/7/feed"
+	if feed.ID != self || feed.Self != self || feed.Link != "https://gastb.ar/u/ana" {
+		t.Errorf("feed links = %q, %q, %q", feed.ID, feed.Self, feed.Link)
+	}
+	want := []string{
+		"Dividends was updated",
+		"Income was renamed to Dividends",
+		"Income was made public",
+	}
+	if len(feed.Entries) != len(want) {
+		t.Fatalf("%d entries, want %d: %+v", len(feed.Entries), len(want), feed.Entries)
+	}
+	for i, e := range feed.Entries {
+		if e.Title != want[i] {
+			t.Errorf("entry %d = %q, want %q", i, e.Title, want[i])
+		}
+	}
+	if feed.Entries[0].ID != self+"#6" {
+		t.Errorf("entry ID = %q", feed.Entries[0].ID)
+	}
+	if !feed.Updated.Equal(changes[0].CreatedAt) {
+		t.Errorf("feed updated at %v, want the latest change", feed.Updated)
+	}
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+	"gastb.ar/storage"
+	"gastb.ar/views"
+)
+
+// ProfilesController serves the public profile pages of users who opted
+// in, at /u/{username}, the feeds of the stocklists they show, and the
+// settings of profiles to API clients. Only
+// what the user chose to show is on the page; their email address never
+// is.
+type ProfilesController struct {
+	ShowView *views.View
+	us       *models.UserService
+	ps       *models.ProfileService
+	ss       *models.StocklistService
+	cs       *models.ChangeService
+	store    storage.Storage
+	// baseURL is the public address of the site, which feeds link to
+	baseURL string
+	// profileCache, if set, caches the pages Show renders
+	profileCache *ProfileCache
+}
+
+// NewProfilesController creates a controller on top of initialized user,
+// profile, stocklist and change services and the storage avatars are
+// kept in, for the site at baseURL
+func NewProfilesController(us *models.UserService, ps *models.ProfileService,
+	ss *models.StocklistService, cs *models.ChangeService, store storage.Storage,
+	baseURL string) *ProfilesController {
+	return &ProfilesController{
+		ShowView: views.NewView("bootstrap", "profiles/show"),
+		us:       us,
+		ps:       ps,
+		ss:       ss,
+		cs:       cs,
+		store:    store,
+		baseURL:  baseURL,
+	}
+}
+
+// SetProfileCache drops the cached pages of a profile when its
+// settings change through the API
+func (pC *ProfilesController) SetProfileCache(pc *ProfileCache) {
+	pC.profileCache = pc
+}
+
+// PublicProfile is what a public profile page shows; fields the user
+// hides are empty
+type PublicProfile struct {
+	Username string
+	Name     string
+	// AvatarURL is empty without an avatar to show
+	AvatarURL  string
+	Stocklists []models.Stocklist
+}
+
+// publicUser looks up the user whose profile is at the {username} route
+// variable, rendering Not Found and returning nil if there is no such
+// public profile
+func (pC *ProfilesController) publicUser(w http.ResponseWriter, r *http.Request) (*models.User, *models.ProfileSettings) {
+	user, err := pC.us.ByUsername(mux.Vars(r)["username"])
+	var settings *models.ProfileSettings
+	if err == nil {
+		settings, err = pC.ps.ForUser(user.ID)
+	}
+	switch {
+	case err == models.ErrNotFound:
+	case err != nil:
+		slog.ErrorContext(r.Context(), "looking up public profile failed", "error", err)
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return nil, nil
+	case settings.Public && !user.IsDeactivated():
+		return user, settings
+	}
+	httperror.Render(w, r, http.StatusNotFound, "")
+	return nil, nil
+}
+
+// Show handles GET /u/{username}
+func (pC *ProfilesController) Show(w http.ResponseWriter, r *http.Request) {
+	user, settings := pC.publicUser(w, r)
+	if user == nil {
+		return
+	}
+	profile := PublicProfile{Username: user.GetUsername()}
+	if settings.ShowName {
+		profile.Name = user.Name
+	}
+	if settings.ShowAvatar && user.AvatarKey != "" {
+		profile.AvatarURL = "/u/" + profile.Username + "/avatar"
+	}
+	if settings.ShowStocklists {
+		stocklists, err := pC.ss.ByUserID(user.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "listing public stocklists failed", "error", err)
+			httperror.Render(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		for _, s := range stocklists {
+			if s.Public {
+				profile.Stocklists = append(profile.Stocklists, s)
+			}
+		}
+	}
+	pC.ShowView.Render(w, r, profile)
+}
+
+// Avatar handles GET /u/{username}/avatar, the avatar of a public
+// profile that shows it
+func (pC *ProfilesController) Avatar(w http.ResponseWriter, r *http.Request) {
+	user, settings := pC.publicUser(w, r)
+	if user == nil {
+		return
+	}
+	if !settings.ShowAvatar || user.AvatarKey == "" {
+		httperror.Render(w, r, http.StatusNotFound, "")
+		return
+	}
+	body, err := pC.store.Get(r.Context(), user.AvatarKey)
+	if err == storage.ErrNotFound {
+		httperror.Render(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reading avatar failed", "error", err)
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", avatarType(user.AvatarKey))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The address stays the same when the avatar changes or is hidden
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	io.Copy(w, body)
+}
+
+//
+// API
+//
+
+type profileSettingsJSON struct {
+	Public         bool `json:"public"`
+	ShowName       bool `json:"show_name"`
+	ShowAvatar     bool `json:"show_avatar"`
+	ShowStocklists bool `json:"show_stocklists"`
+	// URL is the path of the profile page, empty while it is private
+	URL string `json:"url"`
+}
+
+func newProfileSettingsJSON(user *models.User, ps *models.ProfileSettings) profileSettingsJSON {
+	data := profileSettingsJSON{
+		Public:         ps.Public,
+		ShowName:       ps.ShowName,
+		ShowAvatar:     ps.ShowAvatar,
+		ShowStocklists: ps.ShowStocklists,
+	}
+	if ps.Public {
+		data.URL = "/u/" + user.GetUsername()
+	}
+	return data
+}
+
+// updateProfileSettingsRequest is the body of
+// PUT /api/v1/users/me/profile; omitted settings are left alone
+type updateProfileSettingsRequest struct {
+	Public         *bool `json:"public"`
+	ShowName       *bool `json:"show_name"`
+	ShowAvatar     *bool `json:"show_avatar"`
+	ShowStocklists *bool `json:"show_stocklists"`
+}
+
+// Settings handles GET /api/v1/users/me/profile
+func (pC *ProfilesController) Settings(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	ps, err := pC.ps.ForUser(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newProfileSettingsJSON(user, ps))
+}
+
+// UpdateSettings handles PUT /api/v1/users/me/profile
+func (pC *ProfilesController) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req updateProfileSettingsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	ps, err := pC.ps.ForUser(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, f := range []struct {
+		dst *bool
+		src *bool
+	}{
+		{&ps.Public, req.Public},
+		{&ps.ShowName, req.ShowName},
+		{&ps.ShowAvatar, req.ShowAvatar},
+		{&ps.ShowStocklists, req.ShowStocklists},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	if err := pC.ps.Update(user, ps); err != nil {
+		writeError(w, err)
+		return
+	}
+	pC.profileCache.Invalidate(user.GetUsername())
+	writeJSON(w, http.StatusOK, newProfileSettingsJSON(user, ps))
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"gastb.ar/models"
+)
+
+// ReferralsController shows users their referral code, the signup link
+// going with it and what it brought in.
+type ReferralsController struct {
+	rs      *models.ReferralService
+	baseURL string
+}
+
+// NewReferralsController creates a controller on top of an initialized
+// referral service, with signup links on baseURL
+func NewReferralsController(rs *models.ReferralService, baseURL string) *ReferralsController {
+	return &ReferralsController{
+		rs:      rs,
+		baseURL: baseURL,
+	}
+}
+
+type referralsJSON struct {
+	Code string `json:"code"`
+	// URL is the signup page with the code filled in
+	URL string `json:"url"`
+	// Signups counts the accounts created with the code
+	Signups int `json:"signups"`
+	// Rewards counts the signups that passed the abuse checks
+	Rewards int `json:"rewards"`
+}
+
+// Referrals handles GET /api/v1/users/me/referrals
+func (rc *ReferralsController) Referrals(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	stats, err := rc.rs.StatsFor(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, referralsJSON{
+		Code:    stats.Code,
+		URL:     rc.baseURL + "/signup?" + url.Values{"ref": {stats.Code}}.Encode(),
+		Signups: stats.Signups,
+		Rewards: stats.Rewards,
+	})
+}
+
+// attributeReferral attributes a signup to the referral code it came
+// with, if any. The account exists either way, so failures are logged
+// rather than failing the signup.
+func attributeReferral(r *http.Request, rs *models.ReferralService, code string, user *models.User) {
+	if rs == nil || code == "" {
+		return
+	}
+	referral, err := rs.Attribute(code, user, clientOf(r))
+	if err != nil {
+		slog.WarnContext(r.Context(), "attributing signup to referral code failed",
+			"user_id", user.ID, "error", err)
+		return
+	}
+	if referral.Rejected != "" {
+		slog.InfoContext(r.Context(), "referral earns no reward", "user_id", user.ID,
+			"referrer_id", referral.ReferrerID, "reason", referral.Rejected)
+	}
+}
@@ -0,0 +1,288 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gastb.ar/models"
+	"gastb.ar/scim"
+	"gastb.ar/webhooks"
+)
+
+// Page size of SCIM user lists, unless clients ask for fewer
+const scimMaxCount = 100
+
+// SCIMController lets an identity provider create, update and deactivate
+// accounts through SCIM 2.0, so that people joining or leaving an
+// organization get or lose access without an admin. Providers
+// authenticate with a bearer token shared through the configuration.
+type SCIMController struct {
+	us      *models.UserService
+	hooks   *webhooks.Dispatcher
+	token   [sha256.Size]byte
+	baseURL string
+}
+
+// NewSCIMController creates a controller on top of an initialized user
+// service, accepting requests that carry token
+func NewSCIMController(us *models.UserService, hooks *webhooks.Dispatcher,
+	token, baseURL string) *SCIMController {
+	return &SCIMController{
+		us:      us,
+		hooks:   hooks,
+		token:   sha256.Sum256([]byte(token)),
+		baseURL: baseURL,
+	}
+}
+
+// Authorize only calls next for requests with the provider's token.
+// Both sides are hashed first, so comparing takes the same time whatever
+// the length of the token sent. Empty tokens never pass, even if the
+// controller was created without one.
+func (sc *SCIMController) Authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) ||
+			strings.TrimSpace(auth[len(prefix):]) == "" {
+			scim.WriteError(w, http.StatusUnauthorized, "", "missing bearer token")
+			return
+		}
+		sent := sha256.Sum256([]byte(strings.TrimSpace(auth[len(prefix):])))
+		if subtle.ConstantTimeCompare(sent[:], sc.token[:]) != 1 {
+			scim.WriteError(w, http.StatusUnauthorized, "", "invalid bearer token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// NotFound answers requests for unknown SCIM routes
+func (sc *SCIMController) NotFound(w http.ResponseWriter, r *http.Request) {
+	scim.WriteError(w, http.StatusNotFound, "", "resource not found")
+}
+
+// resource returns the SCIM resource of a user
+func (sc *SCIMController) resource(user *models.User) scim.User {
+	id := strconv.FormatUint(uint64(user.ID), 10)
+	active := !user.IsDeactivated()
+	return scim.User{
+		Schemas:     []string{scim.UserSchema},
+		ID:          id,
+		UserName:    user.Email,
+		Name:        &scim.Name{Formatted: user.Name},
+		DisplayName: user.Name,
+		Emails:      []scim.Email{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     sc.baseURL + "/scim/v2/Users/" + id,
+		},
+	}
+}
+
+// writeError writes the SCIM error for an error of the models package
+func (sc *SCIMController) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case models.ErrNotFound, models.ErrInvalidID:
+		scim.WriteError(w, http.StatusNotFound, "", "user not found")
+	case models.ErrEmailTaken:
+		scim.WriteError(w, http.StatusConflict, scim.Uniqueness, publicMessage(err))
+	case models.ErrEmailRequired, models.ErrEmailInvalid, models.ErrEmailNotAllowed:
+		scim.WriteError(w, http.StatusBadRequest, scim.InvalidValue, publicMessage(err))
+	default:
+		slog.ErrorContext(r.Context(), "SCIM request failed", "error", err)
+		scim.WriteError(w, http.StatusInternalServerError, "",
+			http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+// decode decodes a request body, answering 400 if it is invalid
+func (sc *SCIMController) decode(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	body := http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := json.NewDecoder(body).Decode(dst); err != nil {
+		scim.WriteError(w, http.StatusBadRequest, scim.InvalidSyntax, "invalid JSON body")
+		return false
+	}
+	return true
+}
+
+// Users handles GET /scim/v2/Users. Providers look users up with a
+// userName filter before creating them; without one, users are paged
+// with startIndex and count.
+func (sc *SCIMController) Users(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	list := scim.ListResponse{
+		Schemas:    []string{scim.ListSchema},
+		StartIndex: 1,
+		Resources:  []scim.User{},
+	}
+	if filter := q.Get("filter"); filter != "" {
+		attr, value, err := scim.ParseFilter(filter)
+		if err != nil || (attr != "username" && attr != "emails.value" && attr != "emails") {
+			scim.WriteError(w, http.StatusBadRequest, scim.InvalidFilter,
+				"only userName and emails.value equality filters are supported")
+			return
+		}
+		user, err := sc.us.ByEmail(value)
+		switch err {
+		case nil:
+			list.Resources = append(list.Resources, sc.resource(user))
+		case models.ErrNotFound:
+		default:
+			sc.writeError(w, r, err)
+			return
+		}
+		list.TotalResults = len(list.Resources)
+		list.ItemsPerPage = len(list.Resources)
+		scim.Write(w, http.StatusOK, list)
+		return
+	}
+
+	start, err := strconv.Atoi(q.Get("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(q.Get("count"))
+	if err != nil || count < 0 || count > scimMaxCount {
+		count = scimMaxCount
+	}
+	users, total, err := sc.us.Page(start-1, count)
+	if err != nil {
+		sc.writeError(w, r, err)
+		return
+	}
+	for i := range users {
+		list.Resources = append(list.Resources, sc.resource(&users[i]))
+	}
+	list.TotalResults = total
+	list.StartIndex = start
+	list.ItemsPerPage = len(list.Resources)
+	scim.Write(w, http.StatusOK, list)
+}
+
+// User handles GET /scim/v2/Users/{id}
+func (sc *SCIMController) User(w http.ResponseWriter, r *http.Request) {
+	user, ok := sc.user(w, r)
+	if !ok {
+		return
+	}
+	scim.Write(w, http.StatusOK, sc.resource(user))
+}
+
+// user looks up the user of a request's id route variable
+func (sc *SCIMController) user(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := idParam(r)
+	if err != nil {
+		sc.writeError(w, r, err)
+		return nil, false
+	}
+	user, err := sc.us.ByID(id)
+	if err != nil {
+		sc.writeError(w, r, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// CreateUser handles POST /scim/v2/Users. Accounts are created with a
+// verified address and a random password, so users sign in with single
+// sign-on.
+func (sc *SCIMController) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var res scim.User
+	if !sc.decode(w, r, &res) {
+		return
+	}
+	user, err := sc.us.Provision(res.EmailAddress(), res.FullName())
+	if err != nil {
+		sc.writeError(w, r, err)
+		return
+	}
+	if !res.IsActive() {
+		if err := sc.us.Deactivate(user); err != nil {
+			sc.writeError(w, r, err)
+			return
+		}
+	}
+	broadcastUserCreated(r, sc.hooks, user)
+	created := sc.resource(user)
+	w.Header().Set("Location", created.Meta.Location)
+	scim.Write(w, http.StatusCreated, created)
+}
+
+// ReplaceUser handles PUT /scim/v2/Users/{id}
+func (sc *SCIMController) ReplaceUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := sc.user(w, r)
+	if !ok {
+		return
+	}
+	var res scim.User
+	if !sc.decode(w, r, &res) {
+		return
+	}
+	sc.update(w, r, user, &res)
+}
+
+// PatchUser handles PATCH /scim/v2/Users/{id}, which is how most
+// providers deactivate users: replacing active with false
+func (sc *SCIMController) PatchUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := sc.user(w, r)
+	if !ok {
+		return
+	}
+	var patch scim.PatchOp
+	if !sc.decode(w, r, &patch) {
+		return
+	}
+	res := sc.resource(user)
+	if err := patch.Apply(&res); err != nil {
+		scim.WriteError(w, http.StatusBadRequest, scim.InvalidSyntax, err.Error())
+		return
+	}
+	sc.update(w, r, user, &res)
+}
+
+// update makes a user match a resource and responds with the result
+func (sc *SCIMController) update(w http.ResponseWriter, r *http.Request,
+	user *models.User, res *scim.User) {
+	err := sc.us.UpdateProvisioned(user, res.EmailAddress(), res.FullName())
+	if err == nil {
+		if res.IsActive() {
+			err = sc.us.Reactivate(user)
+		} else {
+			err = sc.us.Deactivate(user)
+		}
+	}
+	if err != nil {
+		sc.writeError(w, r, err)
+		return
+	}
+	scim.Write(w, http.StatusOK, sc.resource(user))
+}
+
+// DeleteUser handles DELETE /scim/v2/Users/{id}. The account is
+// deactivated rather than deleted, so its data survives a provider
+// mistake; the provider can still see and reactivate it. Webhooks are
+// told the user was deleted all the same.
+func (sc *SCIMController) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := sc.user(w, r)
+	if !ok {
+		return
+	}
+	if err := sc.us.Deactivate(user); err != nil {
+		sc.writeError(w, r, err)
+		return
+	}
+	err := sc.hooks.UserDeleted(user, webhooks.DeletedByProvider, 0)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "broadcasting user.deleted", "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
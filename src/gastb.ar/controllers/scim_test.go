@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSCIMAuthorize(t *testing.T) {
+	sc := NewSCIMController(nil, nil, "s3cret-token", "https://gastb.ar")
+	cases := []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{"valid", []string{"Bearer s3cret-token"}, http.StatusOK},
+		{"lowercase scheme", []string{"bearer s3cret-token"}, http.StatusOK},
+		{"extra spaces", []string{"Bearer   s3cret-token "}, http.StatusOK},
+
+		{"no header", nil, http.StatusUnauthorized},
+		{"empty token", []string{"Bearer "}, http.StatusUnauthorized},
+		{"scheme only", []string{"Bearer"}, http.StatusUnauthorized},
+		{"wrong token", []string{"Bearer s3cret-tokeN"}, http.StatusUnauthorized},
+		{"prefix of the token", []string{"Bearer s3cret"}, http.StatusUnauthorized},
+		{"token with a suffix", []string{"Bearer s3cret-token2"}, http.StatusUnauthorized},
+		{"other scheme", []string{"Basic s3cret-token"}, http.StatusUnauthorized},
+		{"token without a scheme", []string{"s3cret-token"}, http.StatusUnauthorized},
+		// Only the first header is read
+		{"wrong token first", []string{"Bearer nope", "Bearer s3cret-token"}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			called := false
+			h := sc.Authorize(func(w http.ResponseWriter, r *http.Request) { called = true })
+			r := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+			for _, v := range c.header {
+				r.Header.Add("Authorization", v)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != c.want || called != (c.want == http.StatusOK) {
+				t.Fatalf("status %d, handler called %v, want %d", rec.Code, called, c.want)
+			}
+			if c.want == http.StatusUnauthorized && !strings.Contains(rec.Body.String(), "bearer token") {
+				t.Errorf("body = %s, want a SCIM error", rec.Body)
+			}
+		})
+	}
+
+	// Without a configured token, an empty one still doesn't pass
+	empty := NewSCIMController(nil, nil, "", "https://gastb.ar")
+	r := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	empty.Authorize(func(w http.ResponseWriter, r *http.Request) {})(rec, r)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("empty token on a controller without one: status %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"net/http"
+
+	"gastb.ar/models"
+)
+
+// SearchController serves full text search over what users can see
+type SearchController struct {
+	ss *models.SearchService
+}
+
+// NewSearchController creates a controller on top of an initialized
+// search service
+func NewSearchController(ss *models.SearchService) *SearchController {
+	return &SearchController{
+		ss: ss,
+	}
+}
+
+type searchResultJSON struct {
+	// Type is the kind of document, such as "stocklist"
+	Type  string `json:"type"`
+	ID    uint   `json:"id"`
+	Title string `json:"title"`
+	// Snippet is HTML, with the matching words in <mark> tags
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+// Search handles GET /api/v1/search, searching the stocklists the user
+// can see for the q query parameter and responding with the best
+// matches first.
+func (sc *SearchController) Search(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	results, err := sc.ss.Search(user.ID, r.URL.Query().Get("q"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]searchResultJSON, len(results))
+	for i, res := range results {
+		data[i] = searchResultJSON{
+			Type:    res.Type,
+			ID:      res.ID,
+			Title:   res.Title,
+			Snippet: res.Snippet,
+			Rank:    res.Rank,
+		}
+	}
+	writeJSON(w, http.StatusOK, data)
+}
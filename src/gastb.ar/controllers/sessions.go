@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"gastb.ar/context"
+	"gastb.ar/cookies"
+	"gastb.ar/flash"
+	"gastb.ar/geoip"
+	"gastb.ar/models"
+	"gastb.ar/useragent"
+	"gastb.ar/views"
+)
+
+// SessionsController lists the browsers users are logged in from, on a
+// page and to API clients, and lets them log any of them out.
+type SessionsController struct {
+	IndexView *views.View
+	us        *models.UserService
+	geo       *geoip.DB
+	remember  *cookies.Remember
+}
+
+// NewSessionsController creates a controller on top of an initialized
+// user service, the database sessions are located with and the remember
+// token cookie manager
+func NewSessionsController(us *models.UserService, geo *geoip.DB,
+	rc *cookies.Remember) *SessionsController {
+	return &SessionsController{
+		IndexView: views.NewView("bootstrap", "sessions/index"),
+		us:        us,
+		geo:       geo,
+		remember:  rc,
+	}
+}
+
+// SessionInfo describes one of the user's sessions, on the sessions page
+// and in API responses
+type SessionInfo struct {
+	ID uint `json:"id"`
+	// Current is set for the session the request was made with
+	Current bool `json:"current"`
+	// Browser and OS are empty when the user agent is not recognized
+	Browser   string `json:"browser"`
+	OS        string `json:"os"`
+	Mobile    bool   `json:"mobile"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	// Country is the ISO 3166 code of the country of the IP address,
+	// empty if it is not known
+	Country    string    `json:"country"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// sessions describes the sessions of the user of a request
+func (sC *SessionsController) sessions(r *http.Request, user *models.User) ([]SessionInfo, error) {
+	sessions, err := sC.us.Sessions(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	current := context.Session(r.Context())
+	infos := make([]SessionInfo, len(sessions))
+	for i, s := range sessions {
+		agent := useragent.Parse(s.UserAgent)
+		infos[i] = SessionInfo{
+			ID:         s.ID,
+			Current:    current != nil && current.ID == s.ID,
+			Browser:    agent.Browser,
+			OS:         agent.OS,
+			Mobile:     agent.Mobile,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			Country:    sC.geo.Country(s.IP),
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+		}
+	}
+	return infos, nil
+}
+
+// currentID returns the ID of the session of a request, or 0 for
+// requests made without one
+func currentID(r *http.Request) uint {
+	if s := context.Session(r.Context()); s != nil {
+		return s.ID
+	}
+	return 0
+}
+
+// Index renders the sessions page on GET /profile/sessions
+func (sC *SessionsController) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	sessions, err := sC.sessions(r, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sC.IndexView.Render(w, r, sessions)
+}
+
+// End handles POST /profile/sessions/{id}/end, logging the user out of
+// one of their sessions. Ending the current one logs them out here.
+func (sC *SessionsController) End(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := idParam(r)
+	if err == nil {
+		err = sC.us.EndSession(user.ID, id)
+	}
+	switch err {
+	case nil:
+	case models.ErrInvalidID, models.ErrNotFound:
+		flash.Error(w, tr(r, "That session has already ended."))
+		http.Redirect(w, r, "/profile/sessions", http.StatusFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if id == currentID(r) {
+		sC.remember.Delete(w)
+		flash.Info(w, tr(r, "You have been logged out."))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	flash.Success(w, tr(r, "The session has been logged out."))
+	http.Redirect(w, r, "/profile/sessions", http.StatusFound)
+}
+
+// EndOthers handles POST /profile/sessions/end-others, logging the user
+// out of every browser but this one
+func (sC *SessionsController) EndOthers(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if _, err := sC.us.EndOtherSessions(user.ID, currentID(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flash.Success(w, tr(r, "You have been logged out everywhere else."))
+	http.Redirect(w, r, "/profile/sessions", http.StatusFound)
+}
+
+//
+// API
+//
+
+// List handles GET /api/v1/users/me/sessions
+func (sC *SessionsController) List(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	sessions, err := sC.sessions(r, user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// Delete handles DELETE /api/v1/users/me/sessions/{id}
+func (sC *SessionsController) Delete(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	id, err := idParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := sC.us.EndSession(user.ID, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+type endSessionsJSON struct {
+	// Ended is how many sessions were logged out
+	Ended int64 `json:"ended"`
+}
+
+// DeleteOthers handles DELETE /api/v1/users/me/sessions, logging the user
+// out of all their sessions but the one of the request. Requests made
+// with an API key have none, so all of them end.
+func (sC *SessionsController) DeleteOthers(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	n, err := sC.us.EndOtherSessions(user.ID, currentID(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, endSessionsJSON{Ended: n})
+}
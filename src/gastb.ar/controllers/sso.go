@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gastb.ar/cookies"
+	"gastb.ar/flash"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+	"gastb.ar/oidc"
+	"gastb.ar/rand"
+)
+
+// SSOController signs users in through an OpenID Connect provider.
+// Users are matched to accounts by their verified email address, and
+// accounts are created on their first sign-in.
+type SSOController struct {
+	users    *UsersController
+	provider *oidc.Provider
+	cookie   *cookies.SSO
+	// domain restricts single sign-on to email addresses of a domain;
+	// empty allows any address the provider verified
+	domain string
+}
+
+// NewSSOController creates a controller that signs users in with the
+// users controller once the provider vouches for them
+func NewSSOController(uC *UsersController, p *oidc.Provider, sc *cookies.SSO,
+	domain string) *SSOController {
+	return &SSOController{
+		users:    uC,
+		provider: p,
+		cookie:   sc,
+		domain:   strings.ToLower(strings.TrimPrefix(domain, "@")),
+	}
+}
+
+// Login handles GET /login/sso. It sends the user to the provider,
+// keeping what the callback needs to check its answer in a cookie.
+func (sC *SSOController) Login(w http.ResponseWriter, r *http.Request) {
+	var values [3]string
+	for i := range values {
+		v, err := rand.String(32)
+		if err != nil {
+			httperror.Render(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	url, err := sC.provider.AuthURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "starting single sign-on failed", "error", err)
+		flash.Error(w, tr(r, "Single sign-on failed. Please try again."))
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	sC.cookie.Set(w, state, nonce, verifier)
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Callback handles GET /login/sso/callback, where the provider sends
+// users back with a code to exchange for their identity
+func (sC *SSOController) Callback(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier, err := sC.cookie.Get(r)
+	sC.cookie.Delete(w)
+	q := r.URL.Query()
+	if err != nil || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		httperror.Render(w, r, http.StatusBadRequest, "")
+		return
+	}
+	if e := q.Get("error"); e != "" || q.Get("code") == "" {
+		slog.WarnContext(r.Context(), "single sign-on refused by provider",
+			"error", e, "description", q.Get("error_description"))
+		sC.fail(w, r, "Single sign-on failed. Please try again.")
+		return
+	}
+	claims, err := sC.provider.Exchange(r.Context(), q.Get("code"), verifier, nonce)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "single sign-on failed", "error", err)
+		sC.fail(w, r, "Single sign-on failed. Please try again.")
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if email == "" || !claims.EmailVerified ||
+		(sC.domain != "" && !strings.HasSuffix(email, "@"+sC.domain)) {
+		sC.fail(w, r, "Your email address is not allowed to sign in with single sign-on.")
+		return
+	}
+
+	user, err := sC.users.ByEmail(email)
+	switch err {
+	case nil:
+		if user.IsLocked() || user.ResetRequired || user.IsDeactivated() {
+			sC.fail(w, r, "Your account is locked. Please try again later.")
+			return
+		}
+	case models.ErrNotFound:
+		// Without a domain, anyone the provider knows could sign up
+		// here, which an invite-only site must not allow
+		if sC.domain == "" && sC.users.inviteOnly {
+			sC.fail(w, r, "Your email address is not allowed to sign in with single sign-on.")
+			return
+		}
+		if user, err = sC.users.Provision(email, claims.Name); err != nil {
+			httperror.Render(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		broadcastUserCreated(r, sC.users.hooks, user)
+	default:
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if err := sC.users.signIn(w, r, user); err != nil {
+		httperror.Render(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	sC.users.recordLogin(w, r, user)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// fail sends users back to the login form with a message
+func (sC *SSOController) fail(w http.ResponseWriter, r *http.Request, msg string) {
+	flash.Error(w, tr(r, msg))
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
@@ -6,12 +6,13 @@ func NewStatic() *Static {
 	return &Static{
 		Home:     views.NewView(
 			  "bootstrap", "static/home"),
-		Profile:  views.NewView(
-			  "bootstrap", "static/profile"),
+		Error:    views.NewView(
+			  "bootstrap", "errors/error"),
 		}
 	}
 
 type Static struct {
 	Home    *views.View
-	Profile *views.View
+	// Error renders every HTML error page, see the httperror package
+	Error   *views.View
 }
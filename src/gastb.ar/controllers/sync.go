@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"gastb.ar/models"
+)
+
+// syncPageSize is how many changes a sync response covers at most
+const syncPageSize = 500
+
+// SyncController lets offline clients catch up on the stocklists they
+// can see with the changes made since they last synced, instead of
+// fetching everything again.
+type SyncController struct {
+	cs   *models.ChangeService
+	ss   *models.StocklistService
+	orgs *models.OrganizationService
+}
+
+// NewSyncController creates a controller on top of initialized change,
+// stocklist and organization services
+func NewSyncController(cs *models.ChangeService, ss *models.StocklistService,
+	orgs *models.OrganizationService) *SyncController {
+	return &SyncController{
+		cs:   cs,
+		ss:   ss,
+		orgs: orgs,
+	}
+}
+
+type syncStocklistsJSON struct {
+	// Updated are stocklists created or changed, as they are now
+	Updated []stocklistJSON `json:"updated"`
+	// Deleted are the IDs of stocklists deleted
+	Deleted []uint `json:"deleted"`
+}
+
+type syncJSON struct {
+	// Cursor is the since parameter of the next sync
+	Cursor string `json:"cursor"`
+	// HasMore is set when there are more changes to sync right away
+	HasMore    bool               `json:"has_more"`
+	Stocklists syncStocklistsJSON `json:"stocklists"`
+}
+
+// Sync handles GET /api/v1/sync. With the cursor of a previous response
+// in the since query parameter, it responds with the stocklists the user
+// can see that changed since then; without it, with all of them. Once
+// changes past the cursor are purged, it responds 410 Gone, and clients
+// should sync without since.
+func (sc *SyncController) Sync(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	data := syncJSON{Stocklists: syncStocklistsJSON{
+		Updated: []stocklistJSON{},
+		Deleted: []uint{},
+	}}
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		// Changes made while reading show up in the next sync
+		cursor, err := sc.cs.Latest()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		stocklists, err := sc.visible(user.ID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for i := range stocklists {
+			data.Stocklists.Updated = append(data.Stocklists.Updated, newStocklistJSON(&stocklists[i]))
+		}
+		data.Cursor = strconv.FormatUint(cursor, 10)
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+	from, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		writeError(w, requestError("since must be the cursor of a previous sync"))
+		return
+	}
+	changes, cursor, err := sc.cs.Since(user.ID, from, syncPageSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Only the last change to each stocklist matters
+	last := make(map[uint]string)
+	var ids []uint
+	for _, c := range changes {
+		if _, ok := last[c.EntityID]; !ok {
+			ids = append(ids, c.EntityID)
+		}
+		last[c.EntityID] = c.Op
+	}
+	var upserted []uint
+	for _, id := range ids {
+		if last[id] != models.ChangeDelete {
+			upserted = append(upserted, id)
+		}
+	}
+	stocklists, err := sc.ss.AsTenant(user.ID).ByIDs(upserted)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	found := make(map[uint]bool, len(stocklists))
+	for i := range stocklists {
+		found[stocklists[i].ID] = true
+		data.Stocklists.Updated = append(data.Stocklists.Updated, newStocklistJSON(&stocklists[i]))
+	}
+	for _, id := range ids {
+		// Stocklists deleted by a change past this page are deleted too
+		if !found[id] {
+			data.Stocklists.Deleted = append(data.Stocklists.Deleted, id)
+		}
+	}
+	data.Cursor = strconv.FormatUint(cursor, 10)
+	data.HasMore = len(changes) == syncPageSize
+	writeJSON(w, http.StatusOK, data)
+}
+
+// visible returns a user's personal stocklists and those of their
+// organizations
+func (sc *SyncController) visible(userID uint) ([]models.Stocklist, error) {
+	ss := sc.ss.AsTenant(userID)
+	stocklists, err := ss.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	orgs, err := sc.orgs.ForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, org := range orgs {
+		shared, err := ss.ByOrganizationID(org.ID)
+		if err != nil {
+			return nil, err
+		}
+		stocklists = append(stocklists, shared...)
+	}
+	return stocklists, nil
+}
@@ -0,0 +1,356 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"gastb.ar/images"
+	"gastb.ar/models"
+	"gastb.ar/rand"
+	"gastb.ar/storage"
+)
+
+// Upload limits
+const (
+	maxAvatarBytes     = 5 << 20
+	maxAttachmentBytes = 10 << 20
+	// avatarSize is the side in pixels of the square avatars are scaled to
+	avatarSize = 256
+)
+
+// Content types accepted as stocklist attachments, as sniffed by
+// http.DetectContentType
+var attachmentTypes = map[string]bool{
+	"image/jpeg":                true,
+	"image/png":                 true,
+	"image/gif":                 true,
+	"application/pdf":           true,
+	"text/plain; charset=utf-8": true,
+}
+
+// errFileType is returned for attachments of a type that is not accepted
+var errFileType = errors.New("images: only images, PDF and text files can be attached")
+
+// UploadsController handles user avatars and stocklist attachments,
+// whose content is kept in a storage.Storage.
+type UploadsController struct {
+	us    *models.UserService
+	ss    *models.StocklistService
+	as    *models.AttachmentService
+	store storage.Storage
+}
+
+// NewUploadsController creates a controller on top of initialized
+// services and a storage backend.
+func NewUploadsController(us *models.UserService, ss *models.StocklistService,
+	as *models.AttachmentService, store storage.Storage) *UploadsController {
+	return &UploadsController {
+		us:    us,
+		ss:    ss,
+		as:    as,
+		store: store,
+	}
+}
+
+// formFile reads the "file" field of a multipart request, up to max
+// bytes. It returns the content and the file name.
+func formFile(w http.ResponseWriter, r *http.Request, max int64) ([]byte, string, error) {
+	// Leave room for the rest of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, max+64<<10)
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, "", images.ErrTooLarge
+		}
+		return nil, "", requestError("a multipart form with a file field is required")
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, max+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(b)) > max {
+		return nil, "", images.ErrTooLarge
+	}
+	return b, path.Base(header.Filename), nil
+}
+
+// serveFile streams a stored file
+func (uc *UploadsController) serveFile(w http.ResponseWriter, r *http.Request,
+	key, contentType, disposition string) {
+	body, err := uc.store.Get(r.Context(), key)
+	if err == storage.ErrNotFound {
+		writeError(w, models.ErrNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Keys change whenever the content does
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	io.Copy(w, body)
+}
+
+//
+// 1. Avatars
+//
+
+// avatarExts maps avatar content types to file extensions
+var avatarExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// avatarType returns the content type of an avatar from its key
+func avatarType(key string) string {
+	return mime.TypeByExtension(path.Ext(key))
+}
+
+// SetAvatar handles PUT /api/v1/users/me/avatar. The image in the file
+// field is cropped to a square and scaled down to 256 pixels.
+func (uc *UploadsController) SetAvatar(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	b, _, err := formFile(w, r, maxAvatarBytes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, _, err = images.Read(bytes.NewReader(b), maxAvatarBytes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	thumb, contentType, err := images.Thumbnail(b, avatarSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	suffix, err := rand.String(6)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	key := fmt.Sprintf("avatars/%d-%s%s", user.ID, strings.TrimRight(suffix, "="),
+		avatarExts[contentType])
+	err = uc.store.Put(r.Context(), key, bytes.NewReader(thumb), int64(len(thumb)), contentType)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	old := user.AvatarKey
+	user.AvatarKey = key
+	if err := uc.us.Update(user); err != nil {
+		writeError(w, err)
+		return
+	}
+	if old != "" {
+		uc.store.Delete(r.Context(), old)
+	}
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+// Avatar handles GET /api/v1/users/me/avatar
+func (uc *UploadsController) Avatar(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.AvatarKey == "" {
+		writeError(w, models.ErrNotFound)
+		return
+	}
+	uc.serveFile(w, r, user.AvatarKey, avatarType(user.AvatarKey), "")
+}
+
+// DeleteAvatar handles DELETE /api/v1/users/me/avatar
+func (uc *UploadsController) DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.AvatarKey == "" {
+		writeJSON(w, http.StatusOK, nil)
+		return
+	}
+	old := user.AvatarKey
+	user.AvatarKey = ""
+	if err := uc.us.Update(user); err != nil {
+		writeError(w, err)
+		return
+	}
+	uc.store.Delete(r.Context(), old)
+	writeJSON(w, http.StatusOK, nil)
+}
+
+//
+// 2. Stocklist attachments
+//
+
+type attachmentJSON struct {
+	ID          uint      `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newAttachmentJSON(a *models.Attachment) attachmentJSON {
+	return attachmentJSON{
+		ID:          a.ID,
+		Name:        a.Name,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		CreatedAt:   a.CreatedAt,
+	}
+}
+
+// ownedAttachment looks up the attachment in the {aid} route variable,
+// returning ErrNotFound unless it belongs to the stocklist in {id}, which
+// the user must reach with role, see ownedStocklist
+func (uc *UploadsController) ownedAttachment(r *http.Request, user *models.User, role string) (*models.Attachment, error) {
+	stocklist, err := ownedStocklist(uc.ss, r, user, role)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uintParam(r, "aid")
+	if err != nil {
+		return nil, err
+	}
+	a, err := uc.as.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if a.StocklistID != stocklist.ID {
+		return nil, models.ErrNotFound
+	}
+	return a, nil
+}
+
+// Attachments handles GET /api/v1/stocklists/{id}/attachments
+func (uc *UploadsController) Attachments(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	stocklist, err := ownedStocklist(uc.ss, r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	attachments, err := uc.as.ByStocklistID(stocklist.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]attachmentJSON, 0, len(attachments))
+	for i := range attachments {
+		data = append(data, newAttachmentJSON(&attachments[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// CreateAttachment handles POST /api/v1/stocklists/{id}/attachments,
+// storing the image, PDF or text file in the file field
+func (uc *UploadsController) CreateAttachment(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	stocklist, err := ownedStocklist(uc.ss, r, user, models.OrgRoleMember)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, name, err := formFile(w, r, maxAttachmentBytes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	contentType := http.DetectContentType(b)
+	if !attachmentTypes[contentType] {
+		writeError(w, errFileType)
+		return
+	}
+	if strings.HasPrefix(contentType, "image/") {
+		if _, _, err := images.Read(bytes.NewReader(b), maxAttachmentBytes); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	suffix, err := rand.String(12)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	a := &models.Attachment{
+		StocklistID: stocklist.ID,
+		Key:         fmt.Sprintf("attachments/%d/%s", stocklist.ID, strings.TrimRight(suffix, "=")),
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(b)),
+	}
+	if err := uc.store.Put(r.Context(), a.Key, bytes.NewReader(b), a.Size, contentType); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := uc.as.Create(a); err != nil {
+		uc.store.Delete(r.Context(), a.Key)
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAttachmentJSON(a))
+}
+
+// Attachment handles GET /api/v1/stocklists/{id}/attachments/{aid},
+// downloading the file
+func (uc *UploadsController) Attachment(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	a, err := uc.ownedAttachment(r, user, models.OrgRoleViewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})
+	uc.serveFile(w, r, a.Key, a.ContentType, disposition)
+}
+
+// DeleteAttachment handles DELETE /api/v1/stocklists/{id}/attachments/{aid}
+func (uc *UploadsController) DeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	a, err := uc.ownedAttachment(r, user, models.OrgRoleMember)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := uc.as.Delete(a.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	uc.store.Delete(r.Context(), a.Key)
+	writeJSON(w, http.StatusOK, nil)
+}
+
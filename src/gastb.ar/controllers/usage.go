@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// Days of API usage returned by default, and at most
+const (
+	defaultUsageDays = 30
+	maxUsageDays     = 90
+)
+
+// UsageController shows users how much they used their API keys.
+type UsageController struct {
+	aus *models.APIUsageService
+	as  *models.APIKeyService
+}
+
+// NewUsageController creates a controller on top of initialized API
+// usage and API key services
+func NewUsageController(aus *models.APIUsageService, as *models.APIKeyService) *UsageController {
+	return &UsageController{
+		aus: aus,
+		as:  as,
+	}
+}
+
+type usageJSON struct {
+	APIKeyID uint `json:"api_key_id"`
+	// Name is empty for keys that were deleted since
+	Name string `json:"name"`
+	// Day is a date in UTC, as YYYY-MM-DD
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	// Bytes counts the bytes of request and response bodies
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage handles GET /api/v1/users/me/usage, listing the requests and
+// bytes of each of the user's API keys per day, over the number of days
+// in the days query parameter
+func (uc *UsageController) Usage(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	days := defaultUsageDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxUsageDays {
+			writeError(w, requestError("days must be between 1 and "+strconv.Itoa(maxUsageDays)))
+			return
+		}
+		days = n
+	}
+	// Requests counted since the last flush show up in the next one
+	since := time.Now().AddDate(0, 0, 1-days)
+	usage, err := uc.aus.ByUserID(user.ID, since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	keys, err := uc.as.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	names := make(map[uint]string, len(keys))
+	for _, key := range keys {
+		names[key.ID] = key.Name
+	}
+	data := make([]usageJSON, 0, len(usage))
+	for _, u := range usage {
+		data = append(data, usageJSON{
+			APIKeyID: u.APIKeyID,
+			Name:     names[u.APIKeyID],
+			Day:      u.Day.Format("2006-01-02"),
+			Requests: u.Requests,
+			Bytes:    u.Bytes,
+		})
+	}
+	writeJSON(w, http.StatusOK, data)
+}
@@ -2,63 +2,219 @@ package controllers
 
 import (
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 
-	"github.com/gorilla/schema"
-
+	"gastb.ar/captcha"
+	"gastb.ar/context"
+	"gastb.ar/cookies"
+	"gastb.ar/flash"
+	"gastb.ar/forms"
+	"gastb.ar/i18n"
 	"gastb.ar/views"
 	"gastb.ar/models"
-	"gastb.ar/rand"
+	"gastb.ar/webhooks"
 )
 
 // UsersController:
 // 1. calls the view layer when receiving GET requests on /signup and /login,
 // 2. calls the model layer when information is POSTed to /signup and /login. 
 type UsersController struct {
-	SignupView *views.View
-	LoginView  *views.View
+	SignupView  *views.View
+	LoginView   *views.View
+	ProfileView *views.View
+	ForgotView  *views.View
+	ResetView   *views.View
+	LockView    *views.View
+	SudoView    *views.View
 	*models.UserService
+	invites       *models.InviteService
+	notifications *models.NotificationSettingService
+	profiles      *models.ProfileService
+	remember      *cookies.Remember
+	device        *cookies.Device
+	hooks         *webhooks.Dispatcher
+	// inviteOnly requires a valid invite code to sign up
+	inviteOnly bool
+	// captcha, if set, checks signups and password reset requests
+	captcha captcha.Verifier
+	// referrals, if set, attributes signups to referral codes
+	referrals *models.ReferralService
+	// profileCache, if set, caches public profile pages
+	profileCache *ProfileCache
 }
 
-// NewUserController creates a controller on top of an initialized UserService.
-func NewUserController(us *models.UserService) *UsersController {
+// NewUserController creates a controller on top of initialized user,
+// invite, notification setting and profile services, the remember token and
+// device cookie managers and the webhook dispatcher signups are
+// broadcast with.
+func NewUserController(us *models.UserService, is *models.InviteService,
+	nss *models.NotificationSettingService, ps *models.ProfileService, rc *cookies.Remember,
+	dc *cookies.Device, hooks *webhooks.Dispatcher, inviteOnly bool) *UsersController {
 	return &UsersController {
-		SignupView:  views.NewView("bootstrap", "users/new"),
-		LoginView:   views.NewView("bootstrap", "users/login"),
-		UserService: us,
+		SignupView:    views.NewView("bootstrap", "users/new"),
+		LoginView:     views.NewView("bootstrap", "users/login"),
+		ProfileView:   views.NewView("bootstrap", "users/profile"),
+		ForgotView:    views.NewView("bootstrap", "users/forgot"),
+		ResetView:     views.NewView("bootstrap", "users/reset"),
+		LockView:      views.NewView("bootstrap", "users/lock"),
+		SudoView:      views.NewView("bootstrap", "users/sudo"),
+		UserService:   us,
+		invites:       is,
+		notifications: nss,
+		profiles:      ps,
+		remember:      rc,
+		device:        dc,
+		hooks:         hooks,
+		inviteOnly:    inviteOnly,
 	}
 }
 
+// SetCaptcha makes signups and password reset requests pass a captcha
+// checked by v
+func (uC *UsersController) SetCaptcha(v captcha.Verifier) {
+	uC.captcha = v
+}
+
+// SetReferrals makes signups with a referral code count towards its
+// owner's rewards
+func (uC *UsersController) SetReferrals(rs *models.ReferralService) {
+	uC.referrals = rs
+}
+
+// SetProfileCache drops the cached profile pages of users who change
+// their username or public profile settings
+func (uC *UsersController) SetProfileCache(pc *ProfileCache) {
+	uC.profileCache = pc
+}
+
 // Form objects and funcitons:
 
 type SignupForm struct {
-	Name string `schema:"name"`
-	Email string `schema:"email"`
-	Password string `schema:"password"`
+	Name            string `schema:"name"`
+	Email           string `schema:"email" validate:"required,email"`
+	Password        string `schema:"password" validate:"required,min=8"`
+	PasswordConfirm string `schema:"password_confirm" validate:"required,matches=Password"`
+	Invite          string `schema:"invite"`
+	// Referral is the referral code of the signup link, if any
+	Referral string `schema:"ref"`
 }
 
+type LocaleForm struct {
+	Locale string `schema:"locale" validate:"required"`
+}
+
+// LoginForm is posted to log in; Email may be a username too
 type LoginForm struct {
-	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	Email    string `schema:"email" validate:"required"`
+	Password string `schema:"password" validate:"required"`
 }
 
-func parseForm(r *http.Request, dst interface{}) error {
-	if err := r.ParseForm(); err != nil {
-		return err
-	}
-	dec := schema.NewDecoder()
-	if err := dec.Decode(dst, r.PostForm); err != nil {
-		return err
+type ForgotForm struct {
+	Email string `schema:"email" validate:"required,email"`
+}
+
+type ResetForm struct {
+	Token           string `schema:"token" validate:"required"`
+	Password        string `schema:"password" validate:"required,min=8"`
+	PasswordConfirm string `schema:"password_confirm" validate:"required,matches=Password"`
+}
+
+type NotificationsForm struct {
+	EmailAlerts     bool `schema:"email_alerts"`
+	Digest          bool `schema:"digest"`
+	SecurityNotices bool `schema:"security_notices"`
+	Webhooks        bool `schema:"webhooks"`
+}
+
+type ProfileForm struct {
+	Public         bool `schema:"public"`
+	ShowName       bool `schema:"show_name"`
+	ShowAvatar     bool `schema:"show_avatar"`
+	ShowStocklists bool `schema:"show_stocklists"`
+}
+
+type PasswordForm struct {
+	Current         string `schema:"current" validate:"required"`
+	Password        string `schema:"password" validate:"required,min=8"`
+	PasswordConfirm string `schema:"password_confirm" validate:"required,matches=Password"`
+}
+
+type LockForm struct {
+	Token string `schema:"token" validate:"required"`
+}
+
+type CodeForm struct {
+	Code string `schema:"code" validate:"required"`
+}
+
+type UsernameForm struct {
+	Username string `schema:"username"`
+}
+
+type EmailForm struct {
+	Email string `schema:"email" validate:"required,email"`
+}
+
+// SudoForm is posted to confirm the password before sensitive actions;
+// Next is where users go once it is confirmed
+type SudoForm struct {
+	Password string `schema:"password" validate:"required"`
+	Next     string `schema:"next"`
+}
+
+// profilePage is what the profile view is rendered with
+type profilePage struct {
+	User          *models.User
+	Notifications *models.NotificationSettings
+	Profile       *models.ProfileSettings
+	UsernameForm  forms.Form
+	EmailForm     forms.Form
+	PasswordForm  forms.Form
+}
+
+// New is used to render the signup form on GET /signup, carrying over the
+// invite and referral codes of signup links
+func (uC *UsersController) New(w http.ResponseWriter, r *http.Request) {
+	form := SignupForm{
+		Invite:   r.URL.Query().Get("invite"),
+		Referral: r.URL.Query().Get("ref"),
 	}
-	return nil
+	uC.renderForm(w, r, uC.SignupView, form, nil)
 }
 
 // Signup is a handlefunc used to process POST requests on the signup form 
 // when a user enters their name, email and password
 func (uC *UsersController) Signup(w http.ResponseWriter,r *http.Request) {
 	var form SignupForm
-	if err := parseForm(r, &form); err != nil {
-		panic(err)
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs != nil {
+		uC.renderForm(w, r, uC.SignupView, form, errs)
+		return
+	}
+	if msg := captchaError(r, uC.captcha); msg != "" {
+		errs.Add("captcha", msg)
+		uC.renderForm(w, r, uC.SignupView, form, errs)
+		return
+	}
+	var invite *models.Invite
+	if uC.inviteOnly || form.Invite != "" {
+		invite, err = uC.invites.ByCode(form.Invite)
+		switch err {
+		case nil:
+		case models.ErrInvalidInvite:
+			errs.Add("invite", "is invalid or has expired")
+			uC.renderForm(w, r, uC.SignupView, form, errs)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 	user := &models.User{
 		Name:     form.Name,
@@ -67,72 +223,600 @@ func (uC *UsersController) Signup(w http.ResponseWriter,r *http.Request) {
 	}
 
 	if err := uC.UserService.Create(user); err != nil{
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch err {
+		case models.ErrEmailRequired:
+			errs.Add("email", "is required")
+		case models.ErrEmailInvalid:
+			errs.Add("email", "must be a valid email address")
+		case models.ErrEmailTaken:
+			errs.Add("email", "is already taken")
+		case models.ErrEmailNotAllowed:
+			errs.Add("email", "is not allowed, please use another address")
+		case models.ErrPasswordTooShort:
+			errs.Add("password", fmt.Sprintf("must be at least %d characters long",
+				models.MinPasswordLength))
+		case models.ErrPasswordReused:
+			errs.Add("password", "must not be one of your recent passwords")
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		uC.renderForm(w, r, uC.SignupView, form, errs)
 		return
 	}
+	if invite != nil {
+		if err := uC.invites.Redeem(invite, user.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	broadcastUserCreated(r, uC.hooks, user)
+	attributeReferral(r, uC.referrals, form.Referral, user)
 	
+	flash.Success(w, tr(r, "Account created. Welcome!"))
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 // Login is is a handler used to process POST requests on the login form when
 // user sends their email and password
 func (uC *UsersController) Login(w http.ResponseWriter, r *http.Request) {
-	var form SignupForm
-	if err := parseForm(r, &form); err != nil {
-		panic(err)
+	var form LoginForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs != nil {
+		uC.renderForm(w, r, uC.LoginView, form, errs)
+		return
 	}
 	user, err := uC.UserService.Authenticate(form.Email, form.Password)
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
-			fmt.Fprintln(w, "Invalid email address.")
+			errs.Add("email", "does not belong to any account")
 		case models.ErrInvalidPassword:
-			fmt.Fprintln(w, "Invalid password provided.")
+			errs.Add("password", "is not correct")
+		case models.ErrAccountLocked:
+			errs.Add("email", "belongs to an account locked after too many failed logins; try again later")
+		case models.ErrPasswordResetRequired:
+			errs.Add("email", "belongs to a locked account; follow the link we emailed you to choose a new password")
+		case models.ErrSSORequired:
+			errs.Add("email", "must sign in with single sign-on")
+		case models.ErrAccountDeactivated:
+			errs.Add("email", "belongs to a deactivated account")
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-	return
+		uC.renderForm(w, r, uC.LoginView, form, errs)
+		return
+	}
+	if err := uC.signIn(w, r, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	uC.signIn(w, user)
+	uC.recordLogin(w, r, user)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// signIn is a method that creates a token, sets it to the user, and
-// sets a Cookie header on the ResponseWriter. It returns an error if 
-// setting the user was not successful, or generating the token failed
-func (uC *UsersController) signIn(w http.ResponseWriter, user *models.User) error {
-	token, err := rand.RememberToken()
+// recordLogin records the device a user logged in from, so logins from
+// new devices are notified. Failing to do so does not fail the login.
+func (uC *UsersController) recordLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	id, err := uC.device.ID(w, r)
+	if err == nil {
+		err = uC.UserService.RecordLogin(user, id, clientOf(r))
+	}
 	if err != nil {
-		return err
+		slog.ErrorContext(r.Context(), "recording login device failed", "error", err)
 	}
-	user.Token = token
-	err = uC.UserService.Update(user)
+}
+
+// clientOf describes the client that sent a request, for security notices
+func clientOf(r *http.Request) models.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return err
+		ip = r.RemoteAddr
+	}
+	return models.Client{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// renderForm re-renders a form view with the values submitted by the user
+// and a message next to each invalid field
+func (uC *UsersController) renderForm(w http.ResponseWriter, r *http.Request,
+	v *views.View, values interface{}, errs forms.Errors) {
+	form := forms.Form{Values: values, Errors: errs}
+	if err := v.Render(w, r, form); err != nil {
+		panic(err)
+	}
+}
+
+// captchaError checks the captcha response posted with a form, if there
+// is a captcha, returning the message to show with the form when the
+// check doesn't pass
+func captchaError(r *http.Request, v captcha.Verifier) string {
+	if v == nil {
+		return ""
 	}
+	switch err := v.Verify(r.Context(), r.PostForm.Get(v.Widget().Field), clientOf(r).IP); err {
+	case nil:
+		return ""
+	case captcha.ErrMissing, captcha.ErrFailed:
+		return "Please confirm you are not a robot."
+	default:
+		slog.ErrorContext(r.Context(), "verifying captcha failed", "error", err)
+		return "We could not check that you are not a robot, please try again."
+	}
+}
 
-	cookie := http.Cookie {
-		Name:     "remember_token",
-		Value:    token,
-		HttpOnly: true,
+// signIn starts a session for the user and sets its token in the
+// remember cookie. It returns an error if the session could not be
+// started.
+func (uC *UsersController) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	token, err := uC.UserService.StartSession(user, clientOf(r))
+	if err != nil {
+		return err
 	}
-	http.SetCookie(w, &cookie)
+	uC.remember.Set(w, token)
 	return nil
 }
 
-// CookieTest is used to display cookies set on the current user
-func (uC *UsersController) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// Logout is a handler used to process POST requests on /logout. It deletes
+// the remember token cookie and ends its session, so that copies of the
+// cookie stop working too.
+func (uC *UsersController) Logout(w http.ResponseWriter, r *http.Request) {
+	uC.remember.Delete(w)
+	user, session := context.User(r.Context()), context.Session(r.Context())
+	if user != nil && session != nil {
+		err := uC.UserService.EndSession(user.ID, session.ID)
+		if err != nil && err != models.ErrNotFound {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	flash.Info(w, tr(r, "You have been logged out."))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// SetLocale handles POST /profile/locale, saving the language the user
+// picked for the interface
+func (uC *UsersController) SetLocale(w http.ResponseWriter, r *http.Request) {
+	var form LocaleForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil || errs != nil || !i18n.Supported(form.Locale) {
+		http.Error(w, "invalid locale", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	user.Locale = form.Locale
+	if err := uC.UserService.Update(user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flash.Success(w, i18n.T(user.Locale, "Language updated."))
+	http.Redirect(w, r, "/profile", http.StatusFound)
+}
+
+// Profile renders the profile page on GET /profile
+func (uC *UsersController) Profile(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	uC.renderProfile(w, r, profilePage{User: user})
+}
+
+// renderProfile renders the profile page of the user of page. Forms
+// page leaves empty start from the user's current values.
+func (uC *UsersController) renderProfile(w http.ResponseWriter, r *http.Request,
+	page profilePage) {
+	user := page.User
+	ns, err := uC.notifications.ForUser(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Notifications = ns
+	profile, err := uC.profiles.ForUser(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Profile = profile
+	if page.UsernameForm.Values == nil {
+		page.UsernameForm.Values = UsernameForm{Username: user.GetUsername()}
+	}
+	if page.EmailForm.Values == nil {
+		page.EmailForm.Values = EmailForm{Email: user.Email}
+	}
+	if page.PasswordForm.Values == nil {
+		page.PasswordForm.Values = PasswordForm{}
+	}
+	if err := uC.ProfileView.Render(w, r, page); err != nil {
+		panic(err)
+	}
+}
+
+// ChangeUsername handles POST /profile/username; an empty username
+// removes it
+func (uC *UsersController) ChangeUsername(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form UsernameForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs == nil {
+		oldName := user.GetUsername()
+		switch err := uC.UserService.ChangeUsername(user, form.Username); err {
+		case nil:
+			uC.profileCache.Invalidate(oldName)
+			flash.Success(w, tr(r, "Your username has been saved."))
+			http.Redirect(w, r, "/profile", http.StatusFound)
+			return
+		case models.ErrUsernameInvalid:
+			errs.Add("username", "must be 3 to 30 letters, digits or underscores, starting with a letter")
+		case models.ErrUsernameReserved:
+			errs.Add("username", "is reserved")
+		case models.ErrUsernameTaken:
+			errs.Add("username", "is already taken")
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	uC.renderProfile(w, r, profilePage{User: user,
+		UsernameForm: forms.Form{Values: form, Errors: errs}})
+}
+
+// ChangeEmail handles POST /profile/email. It needs a recent password
+// confirmation (see RequireSudo), since whoever controls the address can
+// reset the password.
+func (uC *UsersController) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form EmailForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs == nil {
+		switch err := uC.UserService.ChangeEmail(user, form.Email, clientOf(r)); err {
+		case nil:
+			flash.Success(w, tr(r, "Email address updated. Check your inbox to confirm it."))
+			http.Redirect(w, r, "/profile", http.StatusFound)
+			return
+		case models.ErrEmailInvalid:
+			errs.Add("email", "must be a valid email address")
+		case models.ErrEmailTaken:
+			errs.Add("email", "is already taken")
+		case models.ErrEmailNotAllowed:
+			errs.Add("email", "is not allowed, please use another address")
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	uC.renderProfile(w, r, profilePage{User: user,
+		EmailForm: forms.Form{Values: form, Errors: errs}})
+}
+
+// ChangePassword handles POST /profile/password. Other sessions are
+// logged out; this browser stays logged in with a new one.
+func (uC *UsersController) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form PasswordForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs == nil {
+		switch err := uC.UserService.ChangePassword(user, form.Current, form.Password,
+			clientOf(r)); err {
+		case nil:
+			if err := uC.signIn(w, r, user); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			flash.Success(w, tr(r, "Your password has been changed."))
+			http.Redirect(w, r, "/profile", http.StatusFound)
+			return
+		case models.ErrInvalidPassword:
+			errs.Add("current", "is not correct")
+		case models.ErrPasswordTooShort:
+			errs.Add("password", fmt.Sprintf("must be at least %d characters long",
+				models.MinPasswordLength))
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	uC.renderProfile(w, r, profilePage{User: user,
+		PasswordForm: forms.Form{Values: PasswordForm{}, Errors: errs}})
+}
+
+// NewSudo renders the page where users confirm their password before a
+// sensitive action, on GET /sudo
+func (uC *UsersController) NewSudo(w http.ResponseWriter, r *http.Request) {
+	form := SudoForm{Next: localPath(r.URL.Query().Get("next"))}
+	uC.renderForm(w, r, uC.SudoView, form, nil)
+}
+
+// Sudo handles POST /sudo, confirming the user's password for their
+// session and sending them where they were going
+func (uC *UsersController) Sudo(w http.ResponseWriter, r *http.Request) {
+	var form SudoForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	form.Next = localPath(form.Next)
+	if errs == nil {
+		user, session := context.User(r.Context()), context.Session(r.Context())
+		if session == nil {
+			http.Error(w, "no session to confirm", http.StatusBadRequest)
+			return
+		}
+		switch err := uC.UserService.Reauthenticate(user, session, form.Password); err {
+		case nil:
+			http.Redirect(w, r, form.Next, http.StatusFound)
+			return
+		case models.ErrInvalidPassword:
+			errs.Add("password", "is not correct")
+		case models.ErrSSORequired:
+			flash.Info(w, tr(r, "Log in again with single sign-on to continue."))
+			http.Redirect(w, r, "/login/sso", http.StatusFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	form.Password = ""
+	uC.renderForm(w, r, uC.SudoView, form, errs)
+}
+
+// NewLock renders the page confirming that the user wants to lock their
+// account on GET /lock, the "this wasn't me" link of security notices
+func (uC *UsersController) NewLock(w http.ResponseWriter, r *http.Request) {
+	form := LockForm{Token: r.URL.Query().Get("token")}
+	uC.renderForm(w, r, uC.LockView, form, nil)
+}
+
+// Lock handles POST /lock, locking the account a security notice was
+// about until its password is reset
+func (uC *UsersController) Lock(w http.ResponseWriter, r *http.Request) {
+	var form LockForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil || errs != nil {
+		http.Error(w, "invalid lock request", http.StatusBadRequest)
+		return
+	}
+	switch _, err := uC.UserService.LockAccount(form.Token); err {
+	case nil:
+		uC.remember.Delete(w)
+		flash.Info(w, tr(r, "Your account is locked. We emailed you a link to choose a new password."))
+	case models.ErrInvalidToken:
+		flash.Error(w, tr(r, "This link is invalid or has expired."))
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// SetNotifications handles POST /profile/notifications, saving the
+// user's notification settings
+func (uC *UsersController) SetNotifications(w http.ResponseWriter, r *http.Request) {
+	var form NotificationsForm
+	if _, err := forms.Parse(r, &form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	ns, err := uC.notifications.ForUser(user.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	user, err := uC.UserService.ByToken(cookie.Value)
+	ns.EmailAlerts = form.EmailAlerts
+	ns.Digest = form.Digest
+	ns.SecurityNotices = form.SecurityNotices
+	ns.Webhooks = form.Webhooks
+	if err := uC.notifications.Update(ns); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flash.Success(w, tr(r, "Email preferences updated."))
+	http.Redirect(w, r, "/profile", http.StatusFound)
+}
+
+// SetProfile handles POST /profile/public, saving the settings of the
+// user's public profile
+func (uC *UsersController) SetProfile(w http.ResponseWriter, r *http.Request) {
+	var form ProfileForm
+	if _, err := forms.Parse(r, &form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	ps, err := uC.profiles.ForUser(user.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-	return
+		return
 	}
-	fmt.Fprintln(w, user)
+	ps.Public = form.Public
+	ps.ShowName = form.ShowName
+	ps.ShowAvatar = form.ShowAvatar
+	ps.ShowStocklists = form.ShowStocklists
+	switch err := uC.profiles.Update(user, ps); err {
+	case nil:
+		uC.profileCache.Invalidate(user.GetUsername())
+		flash.Success(w, tr(r, "Public profile updated."))
+	case models.ErrUsernameRequired:
+		flash.Error(w, tr(r, "Pick a username before making your profile public."))
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/profile", http.StatusFound)
 }
 
+// Unsubscribe handles GET /digest/unsubscribe, the link at the bottom of
+// digest emails, which works without logging in
+func (uC *UsersController) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	switch err := uC.notifications.UnsubscribeDigest(r.URL.Query().Get("token")); err {
+	case nil:
+		flash.Success(w, tr(r, "You won't get the digest email anymore."))
+	case models.ErrInvalidToken:
+		flash.Info(w, tr(r, "You are not subscribed to the digest email."))
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Verify handles GET /verify, the link in verification emails
+func (uC *UsersController) Verify(w http.ResponseWriter, r *http.Request) {
+	user, verified, err := uC.UserService.VerifyEmail(r.URL.Query().Get("token"))
+	switch err {
+	case nil:
+		if verified {
+			broadcastUserVerified(r, uC.hooks, user)
+		}
+		flash.Success(w, tr(r, "Your email address is confirmed. Thanks!"))
+	case models.ErrInvalidToken:
+		flash.Error(w, tr(r, "This confirmation link is invalid or has expired."))
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// ResendVerification handles POST /profile/verify, emailing the user a
+// new confirmation link
+func (uC *UsersController) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	if err := uC.UserService.RequestVerification(context.User(r.Context())); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flash.Info(w, tr(r, "We sent you a new confirmation link."))
+	http.Redirect(w, r, "/profile", http.StatusFound)
+}
+
+// VerifyCode handles POST /profile/verify/code, confirming the user's
+// email address with the code emailed along with the link
+func (uC *UsersController) VerifyCode(w http.ResponseWriter, r *http.Request) {
+	var form CodeForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs != nil {
+		flash.Error(w, tr(r, "Please type the code we emailed you."))
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+	user := context.User(r.Context())
+	verified := user.EmailVerifiedAt != nil
+	switch err := uC.UserService.VerifyCode(user, form.Code); err {
+	case nil:
+		if !verified {
+			broadcastUserVerified(r, uC.hooks, user)
+		}
+		flash.Success(w, tr(r, "Your email address is confirmed. Thanks!"))
+	case models.ErrInvalidCode:
+		flash.Error(w, tr(r, "That code is incorrect."))
+	case models.ErrCodeExpired:
+		flash.Error(w, tr(r, "That code has expired. Send yourself a new one."))
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/profile", http.StatusFound)
+}
+
+// Forgot handles POST /forgot, emailing a password reset link. The same
+// message is shown whether or not the address has an account.
+func (uC *UsersController) Forgot(w http.ResponseWriter, r *http.Request) {
+	var form ForgotForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs != nil {
+		uC.renderForm(w, r, uC.ForgotView, form, errs)
+		return
+	}
+	if msg := captchaError(r, uC.captcha); msg != "" {
+		errs.Add("captcha", msg)
+		uC.renderForm(w, r, uC.ForgotView, form, errs)
+		return
+	}
+	if err := uC.UserService.RequestPasswordReset(form.Email, clientOf(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flash.Info(w, tr(r, "If that address has an account, we sent it a link to reset the password."))
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// NewReset renders the form choosing a new password on GET /reset, the
+// link in password reset emails
+func (uC *UsersController) NewReset(w http.ResponseWriter, r *http.Request) {
+	form := ResetForm{Token: r.URL.Query().Get("token")}
+	uC.renderForm(w, r, uC.ResetView, form, nil)
+}
+
+// Reset handles POST /reset, setting the new password and logging the
+// user in
+func (uC *UsersController) Reset(w http.ResponseWriter, r *http.Request) {
+	var form ResetForm
+	errs, err := forms.Parse(r, &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs != nil {
+		uC.renderForm(w, r, uC.ResetView, form, errs)
+		return
+	}
+	user, err := uC.UserService.ResetPassword(form.Token, form.Password, clientOf(r))
+	switch err {
+	case nil:
+	case models.ErrInvalidToken:
+		flash.Error(w, tr(r, "This password reset link is invalid or has expired."))
+		http.Redirect(w, r, "/forgot", http.StatusFound)
+		return
+	case models.ErrPasswordTooShort:
+		errs.Add("password", fmt.Sprintf("must be at least %d characters long",
+			models.MinPasswordLength))
+		uC.renderForm(w, r, uC.ResetView, form, errs)
+		return
+	case models.ErrPasswordReused:
+		errs.Add("password", "must not be one of your recent passwords")
+		uC.renderForm(w, r, uC.ResetView, form, errs)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := uC.signIn(w, r, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flash.Success(w, tr(r, "Your password has been changed."))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// tr translates a message into the language of a request
+func tr(r *http.Request, msg string, args ...interface{}) string {
+	return i18n.T(context.Locale(r.Context()), msg, args...)
+}
+
+
 
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// WebhooksController serves the webhook management API under
+// /api/v1/webhooks, with the same JSON envelope as APIController.
+type WebhooksController struct {
+	ws *models.WebhookService
+}
+
+// NewWebhooksController creates a controller on top of an initialized
+// webhook service.
+func NewWebhooksController(ws *models.WebhookService) *WebhooksController {
+	return &WebhooksController {
+		ws: ws,
+	}
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type webhookJSON struct {
+	ID     uint     `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is only included when the webhook is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookJSON(wh *models.Webhook) webhookJSON {
+	return webhookJSON{
+		ID:        wh.ID,
+		URL:       wh.URL,
+		Events:    strings.Split(wh.Events, ","),
+		CreatedAt: wh.CreatedAt,
+	}
+}
+
+type deliveryJSON struct {
+	ID            uint       `json:"id"`
+	EventID       string     `json:"event_id"`
+	Event         string     `json:"event"`
+	Attempt       int        `json:"attempt"`
+	StatusCode    int        `json:"status_code,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Succeeded     bool       `json:"succeeded"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Number of delivery attempts listed per webhook
+const deliveriesLimit = 50
+
+// ownedWebhook looks up the webhook in the {id} route variable,
+// returning ErrNotFound if it belongs to somebody else
+func (wc *WebhooksController) ownedWebhook(r *http.Request, user *models.User) (*models.Webhook, error) {
+	id, err := idParam(r)
+	if err != nil {
+		return nil, err
+	}
+	wh, err := wc.ws.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if wh.UserID != user.ID {
+		return nil, models.ErrNotFound
+	}
+	return wh, nil
+}
+
+// Webhooks handles GET /api/v1/webhooks
+func (wc *WebhooksController) Webhooks(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	whs, err := wc.ws.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]webhookJSON, 0, len(whs))
+	for i := range whs {
+		data = append(data, newWebhookJSON(&whs[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// CreateWebhook handles POST /api/v1/webhooks. The response holds the
+// secret payloads are signed with, which is not shown again.
+func (wc *WebhooksController) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req webhookRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, event := range req.Events {
+		if models.AdminEvent(event) && !user.IsAdmin() {
+			writeError(w, models.ErrEventAdminOnly)
+			return
+		}
+	}
+	wh := &models.Webhook{
+		UserID: user.ID,
+		URL:    req.URL,
+		Events: strings.Join(req.Events, ","),
+	}
+	if err := wc.ws.Create(wh); err != nil {
+		writeError(w, err)
+		return
+	}
+	data := newWebhookJSON(wh)
+	data.Secret = wh.Secret
+	writeJSON(w, http.StatusCreated, data)
+}
+
+// DeleteWebhook handles DELETE /api/v1/webhooks/{id}
+func (wc *WebhooksController) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	wh, err := wc.ownedWebhook(r, user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := wc.ws.Delete(wh.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// Deliveries handles GET /api/v1/webhooks/{id}/deliveries, listing the
+// latest delivery attempts, newest first
+func (wc *WebhooksController) Deliveries(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	wh, err := wc.ownedWebhook(r, user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ds, err := wc.ws.Deliveries(wh.ID, deliveriesLimit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := make([]deliveryJSON, 0, len(ds))
+	for _, d := range ds {
+		data = append(data, deliveryJSON{
+			ID:            d.ID,
+			EventID:       d.EventID,
+			Event:         d.Event,
+			Attempt:       d.Attempt,
+			StatusCode:    d.StatusCode,
+			Error:         d.Error,
+			Succeeded:     d.Succeeded,
+			NextAttemptAt: d.NextAttemptAt,
+			CreatedAt:     d.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,110 @@
+package cookies
+
+// The cookies package sets, reads and deletes the remember token cookie
+// that keeps users logged in, and the device cookie that recognizes
+// browsers they logged in from before. Cookies are signed so that
+// tampered values are rejected before they reach the database, and their
+// attributes (Secure, SameSite, expiry) come from the configuration.
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gastb.ar/hash"
+)
+
+// RememberName is the name of the remember token cookie
+const RememberName = "remember_token"
+
+// ErrInvalidCookie is returned when a cookie is missing or its signature
+// does not match its value.
+var ErrInvalidCookie = errors.New("cookies: missing or invalid cookie")
+
+// Config holds the attributes of the cookies.
+type Config struct {
+	// Secure restricts cookies to HTTPS; it should be on in production
+	Secure bool
+	// SameSite is one of "lax", "strict" or "none"; it defaults to lax
+	SameSite string
+	// Domain makes cookies valid for subdomains; empty means the host
+	Domain string
+	// MaxAge is how long the remember cookie lasts; zero makes it a
+	// session cookie
+	MaxAge time.Duration
+}
+
+func (c Config) sameSite() http.SameSite {
+	switch strings.ToLower(c.SameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// Remember manages the remember token cookie.
+type Remember struct {
+	cfg Config
+	key string
+}
+
+// NewRemember creates a Remember that signs cookies with key
+func NewRemember(cfg Config, key []byte) *Remember {
+	return &Remember{cfg: cfg, key: string(key)}
+}
+
+func (rc *Remember) sign(value string) string {
+	return hash.NewHMAC(rc.key).Hash(value)
+}
+
+func (rc *Remember) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     RememberName,
+		Value:    value,
+		Path:     "/",
+		Domain:   rc.cfg.Domain,
+		MaxAge:   maxAge,
+		Secure:   rc.cfg.Secure,
+		HttpOnly: true,
+		SameSite: rc.cfg.sameSite(),
+	}
+}
+
+// Set stores a signed remember token in the cookie
+func (rc *Remember) Set(w http.ResponseWriter, token string) {
+	c := rc.cookie(token+"."+rc.sign(token), int(rc.cfg.MaxAge.Seconds()))
+	if rc.cfg.MaxAge > 0 {
+		c.Expires = time.Now().Add(rc.cfg.MaxAge)
+	}
+	http.SetCookie(w, c)
+}
+
+// Get returns the remember token of a request, or ErrInvalidCookie if
+// there is none or its signature is wrong
+func (rc *Remember) Get(r *http.Request) (string, error) {
+	c, err := r.Cookie(RememberName)
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 {
+		return "", ErrInvalidCookie
+	}
+	token, sig := c.Value[:i], c.Value[i+1:]
+	if !hmac.Equal([]byte(rc.sign(token)), []byte(sig)) {
+		return "", ErrInvalidCookie
+	}
+	return token, nil
+}
+
+// Delete tells the browser to drop the cookie
+func (rc *Remember) Delete(w http.ResponseWriter) {
+	c := rc.cookie("", -1)
+	c.Expires = time.Unix(0, 0)
+	http.SetCookie(w, c)
+}
@@ -0,0 +1,160 @@
+package cookies
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// set returns the cookie fn sets
+func set(t *testing.T, fn func(w http.ResponseWriter)) *http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	fn(rec)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("set %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+// withCookie returns a request carrying a cookie
+func withCookie(name, value string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	if value != "" {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	return r
+}
+
+func TestRemember(t *testing.T) {
+	rc := NewRemember(Config{Secure: true, SameSite: "strict", MaxAge: time.Hour}, testKey)
+	c := set(t, func(w http.ResponseWriter) { rc.Set(w, "tok.en") })
+	if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteStrictMode || c.MaxAge != 3600 || c.Path != "/" {
+		t.Errorf("cookie attributes: %+v", c)
+	}
+	i := strings.LastIndex(c.Value, ".")
+	sig := c.Value[i+1:]
+	other := set(t, func(w http.ResponseWriter) {
+		NewRemember(Config{}, []byte("another key of thirty two bytes!")).Set(w, "tok.en")
+	})
+
+	cases := []struct {
+		name  string
+		value string
+		want  string
+		err   error
+	}{
+		{"signed", c.Value, "tok.en", nil},
+		{"no cookie", "", "", ErrInvalidCookie},
+		{"no signature", "tok.en", "", ErrInvalidCookie},
+		{"unsigned token", "tok.en.", "", ErrInvalidCookie},
+		{"other token", "other." + sig, "", ErrInvalidCookie},
+		{"token with a suffix", "tok.en2." + sig, "", ErrInvalidCookie},
+		{"tampered signature", c.Value[:len(c.Value)-2] + "AA", "", ErrInvalidCookie},
+		{"signed with another key", other.Value, "", ErrInvalidCookie},
+		{"signature only", "." + sig, "", ErrInvalidCookie},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := rc.Get(withCookie(RememberName, c.value))
+			if got != c.want || err != c.err {
+				t.Errorf("Get = %q, %v, want %q, %v", got, err, c.want, c.err)
+			}
+		})
+	}
+
+	d := set(t, rc.Delete)
+	if d.Name != RememberName || d.Value != "" || d.MaxAge >= 0 {
+		t.Errorf("Delete set %+v, want an expired cookie", d)
+	}
+}
+
+func TestSameSite(t *testing.T) {
+	for in, want := range map[string]http.SameSite{
+		"": http.SameSiteLaxMode, "lax": http.SameSiteLaxMode, "Strict": http.SameSiteStrictMode,
+		"none": http.SameSiteNoneMode, "bogus": http.SameSiteLaxMode,
+	} {
+		if got := (Config{SameSite: in}).sameSite(); got != want {
+			t.Errorf("sameSite(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestDevice(t *testing.T) {
+	dc := NewDevice(Config{Secure: true}, testKey)
+	var id string
+	c := set(t, func(w http.ResponseWriter) {
+		var err error
+		if id, err = dc.ID(w, withCookie(DeviceName, "")); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !c.HttpOnly || !c.Secure || c.MaxAge <= 0 || !strings.HasPrefix(c.Value, id+".") {
+		t.Errorf("device cookie: %+v", c)
+	}
+
+	cases := []struct {
+		name  string
+		value string
+		kept  bool
+	}{
+		{"signed", c.Value, true},
+		{"unsigned", id, false},
+		{"tampered ID", "x" + c.Value[1:], false},
+		{"tampered signature", c.Value[:len(c.Value)-2] + "AA", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			got, err := dc.ID(rec, withCookie(DeviceName, c.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reset := len(rec.Result().Cookies()) > 0
+			if (got == id) != c.kept || reset == c.kept {
+				t.Errorf("ID = %q, new cookie %v, want the same ID %v", got, reset, c.kept)
+			}
+		})
+	}
+}
+
+func TestSSO(t *testing.T) {
+	sc := NewSSO(Config{}, testKey)
+	c := set(t, func(w http.ResponseWriter) { sc.Set(w, "state", "nonce", "verifier") })
+	if c.Path != "/login/sso" || c.SameSite != http.SameSiteLaxMode || !c.HttpOnly {
+		t.Errorf("cookie attributes: %+v", c)
+	}
+	i := strings.LastIndex(c.Value, ".")
+	value, sig := c.Value[:i], c.Value[i+1:]
+	// Values whose signature is right but that don't have three parts
+	two := set(t, func(w http.ResponseWriter) { sc.Set(w, "state", "nonce.verifier", "x") })
+
+	cases := []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"signed", c.Value, nil},
+		{"no cookie", "", ErrInvalidCookie},
+		{"no signature", value, ErrInvalidCookie},
+		{"other state", strings.Replace(value, "state", "other", 1) + "." + sig, ErrInvalidCookie},
+		{"tampered signature", value + "." + sig[:len(sig)-2] + "AA", ErrInvalidCookie},
+		{"four parts", two.Value, ErrInvalidCookie},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			state, nonce, verifier, err := sc.Get(withCookie(SSOName, c.value))
+			if err != c.err {
+				t.Fatalf("Get: %v, want %v", err, c.err)
+			}
+			if err == nil && (state != "state" || nonce != "nonce" || verifier != "verifier") {
+				t.Errorf("Get = %q, %q, %q", state, nonce, verifier)
+			}
+		})
+	}
+}
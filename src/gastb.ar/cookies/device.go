@@ -0,0 +1,62 @@
+package cookies
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strings"
+	"time"
+
+	"gastb.ar/hash"
+	"gastb.ar/rand"
+)
+
+// DeviceName is the name of the device cookie
+const DeviceName = "device_id"
+
+// deviceMaxAge is how long a browser keeps its device ID
+const deviceMaxAge = 2 * 365 * 24 * time.Hour
+
+// Device manages the device cookie, a random ID that tells browsers a
+// user logged in from before apart from new ones. It outlives logouts.
+type Device struct {
+	cfg Config
+	key string
+}
+
+// NewDevice creates a Device that signs cookies with key
+func NewDevice(cfg Config, key []byte) *Device {
+	return &Device{cfg: cfg, key: string(key)}
+}
+
+func (dc *Device) sign(value string) string {
+	return hash.NewHMAC(dc.key).Hash(value)
+}
+
+// ID returns the device ID of a request, setting a new one in a cookie
+// if the request has none or its signature is wrong
+func (dc *Device) ID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(DeviceName); err == nil {
+		if i := strings.LastIndex(c.Value, "."); i >= 0 {
+			id, sig := c.Value[:i], c.Value[i+1:]
+			if hmac.Equal([]byte(dc.sign(id)), []byte(sig)) {
+				return id, nil
+			}
+		}
+	}
+	id, err := rand.String(24)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     DeviceName,
+		Value:    id + "." + dc.sign(id),
+		Path:     "/",
+		Domain:   dc.cfg.Domain,
+		MaxAge:   int(deviceMaxAge.Seconds()),
+		Expires:  time.Now().Add(deviceMaxAge),
+		Secure:   dc.cfg.Secure,
+		HttpOnly: true,
+		SameSite: dc.cfg.sameSite(),
+	})
+	return id, nil
+}
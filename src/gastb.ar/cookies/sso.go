@@ -0,0 +1,85 @@
+package cookies
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strings"
+	"time"
+
+	"gastb.ar/hash"
+)
+
+// SSOName is the name of the single sign-on cookie
+const SSOName = "sso_state"
+
+// ssoMaxAge is how long users have to sign in at the provider
+const ssoMaxAge = 10 * time.Minute
+
+// SSO manages the single sign-on cookie, which keeps the state, nonce
+// and PKCE verifier of a sign-in until the provider redirects back
+type SSO struct {
+	cfg Config
+	key string
+}
+
+// NewSSO creates an SSO that signs cookies with key
+func NewSSO(cfg Config, key []byte) *SSO {
+	return &SSO{cfg: cfg, key: string(key)}
+}
+
+func (sc *SSO) sign(value string) string {
+	return hash.NewHMAC(sc.key).Hash(value)
+}
+
+func (sc *SSO) cookie(value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     SSOName,
+		Value:    value,
+		Path:     "/login/sso",
+		Domain:   sc.cfg.Domain,
+		MaxAge:   int(maxAge.Seconds()),
+		Expires:  time.Now().Add(maxAge),
+		Secure:   sc.cfg.Secure,
+		HttpOnly: true,
+		// The provider redirects back with a top-level GET from its own
+		// site, which strict would leave the cookie out of
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Set stores the values of a sign-in in the cookie. They must not
+// contain dots.
+func (sc *SSO) Set(w http.ResponseWriter, state, nonce, verifier string) {
+	value := state + "." + nonce + "." + verifier
+	http.SetCookie(w, sc.cookie(value+"."+sc.sign(value), ssoMaxAge))
+}
+
+// Get returns the values of the sign-in in progress, or ErrInvalidCookie
+// if there is none or its signature is wrong
+func (sc *SSO) Get(r *http.Request) (state, nonce, verifier string, err error) {
+	c, err := r.Cookie(SSOName)
+	if err != nil {
+		return "", "", "", ErrInvalidCookie
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 {
+		return "", "", "", ErrInvalidCookie
+	}
+	value, sig := c.Value[:i], c.Value[i+1:]
+	if !hmac.Equal([]byte(sc.sign(value)), []byte(sig)) {
+		return "", "", "", ErrInvalidCookie
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return "", "", "", ErrInvalidCookie
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// Delete tells the browser to drop the cookie, so a sign-in can't be
+// completed twice
+func (sc *SSO) Delete(w http.ResponseWriter) {
+	c := sc.cookie("", -1)
+	c.Expires = time.Unix(0, 0)
+	http.SetCookie(w, c)
+}
@@ -0,0 +1,163 @@
+package email
+
+// The email package sends transactional mail through a Mailer chosen by
+// Config: an SMTP server, the Mailgun API, or a no-op mailer that only
+// logs messages, for development.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"text/template"
+)
+
+var (
+	// ErrNoRecipients is returned for messages without a To address
+	ErrNoRecipients = errors.New("email: message has no recipients")
+)
+
+// Message is an email with a plain text body and, optionally, an HTML
+// alternative
+type Message struct {
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+	// ReplyTo overrides the mailer's default Reply-To address
+	ReplyTo string
+}
+
+// Mailer sends messages. From and Reply-To come from the mailer's
+// configuration unless the message sets them.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Config selects and configures a Mailer
+type Config struct {
+	// Backend is "smtp", "mailgun", or "" to only log messages
+	Backend string
+	// From is the sender of every message, e.g. "Gastb <no-reply@gastb.ar>"
+	From string
+	// ReplyTo is the default Reply-To address, if any
+	ReplyTo string
+	SMTP    SMTPConfig
+	Mailgun MailgunConfig
+}
+
+// New creates the Mailer selected by cfg
+func New(cfg Config) (Mailer, error) {
+	if cfg.Backend == "" {
+		return Nop{}, nil
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return nil, errors.New("email: invalid From address " + cfg.From)
+	}
+	if cfg.ReplyTo != "" {
+		if _, err := mail.ParseAddress(cfg.ReplyTo); err != nil {
+			return nil, errors.New("email: invalid Reply-To address " + cfg.ReplyTo)
+		}
+	}
+	switch cfg.Backend {
+	case "smtp":
+		return NewSMTP(cfg.SMTP, cfg.From, cfg.ReplyTo)
+	case "mailgun":
+		return NewMailgun(cfg.Mailgun, cfg.From, cfg.ReplyTo)
+	}
+	return nil, errors.New("email: unknown backend " + cfg.Backend)
+}
+
+// Nop is a Mailer that logs messages instead of sending them
+type Nop struct{}
+
+// Send implements Mailer
+func (Nop) Send(ctx context.Context, msg Message) error {
+	if len(msg.To) == 0 {
+		return ErrNoRecipients
+	}
+	slog.InfoContext(ctx, "email not sent",
+		"to", strings.Join(msg.To, ", "),
+		"subject", msg.Subject,
+		"text", msg.Text)
+	return nil
+}
+
+// Template renders the subject and bodies of a message. The subject and
+// text body are text templates; the HTML body is an html/template, so
+// values are escaped.
+type Template struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// NewTemplate parses the subject, text and HTML templates of a message.
+// html may be empty for text only messages.
+func NewTemplate(name, subject, text, html string) (*Template, error) {
+	t := &Template{}
+	var err error
+	if t.subject, err = template.New(name + ".subject").Parse(subject); err != nil {
+		return nil, err
+	}
+	if t.text, err = template.New(name + ".text").Parse(text); err != nil {
+		return nil, err
+	}
+	if html != "" {
+		if t.html, err = htmltemplate.New(name + ".html").Parse(html); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// ParseTemplate parses a single source defining the "subject", "text"
+// and, optionally, "html" templates of a message
+func ParseTemplate(name, src string) (*Template, error) {
+	text, err := template.New(name).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if text.Lookup("subject") == nil || text.Lookup("text") == nil {
+		return nil, errors.New("email: template " + name + " must define subject and text")
+	}
+	t := &Template{
+		subject: text.Lookup("subject"),
+		text:    text.Lookup("text"),
+	}
+	if text.Lookup("html") != nil {
+		html, err := htmltemplate.New(name).Parse(src)
+		if err != nil {
+			return nil, err
+		}
+		t.html = html.Lookup("html")
+	}
+	return t, nil
+}
+
+// Message renders the template with data into a message for to
+func (t *Template) Message(data interface{}, to ...string) (Message, error) {
+	msg := Message{To: to}
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	// Headers can't span lines
+	msg.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.Text = buf.String()
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, data); err != nil {
+			return msg, err
+		}
+		msg.HTML = buf.String()
+	}
+	return msg, nil
+}
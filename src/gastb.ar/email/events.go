@@ -0,0 +1,112 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Event types reported by mail providers that make an address
+// undeliverable
+const (
+	// EventBounce is a permanent delivery failure, such as a mailbox
+	// that does not exist
+	EventBounce = "bounce"
+	// EventComplaint is the recipient marking a message as spam
+	EventComplaint = "complaint"
+)
+
+// Event is a delivery event reported by the mail provider
+type Event struct {
+	// Type is EventBounce or EventComplaint, or empty for events that
+	// don't affect deliverability, such as temporary failures
+	Type      string
+	Recipient string
+	// Reason is the provider's description of the event, if any
+	Reason string
+}
+
+var (
+	// ErrBadSignature is returned for event callbacks that were not
+	// signed by the provider, or were signed too long ago
+	ErrBadSignature = errors.New("email: invalid event signature")
+)
+
+// maxEventAge is how old a signed event may be; older ones are rejected
+// so captured callbacks can't be replayed
+const maxEventAge = 15 * time.Minute
+
+// mailgunEvent is the body of a Mailgun webhook callback
+type mailgunEvent struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event          string `json:"event"`
+		Severity       string `json:"severity"`
+		Recipient      string `json:"recipient"`
+		Reason         string `json:"reason"`
+		DeliveryStatus struct {
+			Description string `json:"description"`
+			Message     string `json:"message"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// ParseMailgunEvent reads a Mailgun webhook callback from r and checks
+// it was signed with signingKey.
+func ParseMailgunEvent(signingKey string, r io.Reader) (*Event, error) {
+	var body mailgunEvent
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return nil, errors.New("email: invalid event: " + err.Error())
+	}
+	sig := body.Signature
+	if !validMailgunSignature(signingKey, sig.Timestamp, sig.Token, sig.Signature) {
+		return nil, ErrBadSignature
+	}
+
+	data := body.EventData
+	event := &Event{Recipient: data.Recipient, Reason: data.Reason}
+	if d := data.DeliveryStatus.Description; d != "" {
+		event.Reason = d
+	} else if m := data.DeliveryStatus.Message; m != "" {
+		event.Reason = m
+	}
+	switch {
+	case data.Event == "failed" && data.Severity == "permanent":
+		event.Type = EventBounce
+	case data.Event == "complained":
+		event.Type = EventComplaint
+	}
+	return event, nil
+}
+
+// validMailgunSignature checks signature is the HMAC-SHA256 of the
+// timestamp and token, and the timestamp is recent
+func validMailgunSignature(key, timestamp, token, signature string) bool {
+	if key == "" {
+		return false
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(sec, 0))
+	if age > maxEventAge || age < -maxEventAge {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -0,0 +1,91 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gastb.ar/tracing"
+)
+
+// MailgunConfig configures the Mailgun API
+type MailgunConfig struct {
+	Domain string
+	APIKey string
+	// BaseURL defaults to the US region, "https://api.mailgun.net/v3";
+	// EU domains use "https://api.eu.mailgun.net/v3"
+	BaseURL string
+	// WebhookSigningKey verifies the event callbacks Mailgun posts to
+	// the app; without it they are rejected
+	WebhookSigningKey string
+}
+
+// Mailgun sends messages through the Mailgun HTTP API
+type Mailgun struct {
+	cfg     MailgunConfig
+	from    string
+	replyTo string
+	client  *http.Client
+}
+
+// NewMailgun creates a Mailgun mailer
+func NewMailgun(cfg MailgunConfig, from, replyTo string) (*Mailgun, error) {
+	if cfg.Domain == "" || cfg.APIKey == "" {
+		return nil, errors.New("email: Mailgun domain and API key are required")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "https://api.mailgun.net/v3"
+	}
+	return &Mailgun{
+		cfg:     cfg,
+		from:    from,
+		replyTo: replyTo,
+		client:  &http.Client{Timeout: 30 * time.Second, Transport: &tracing.Transport{}},
+	}, nil
+}
+
+// Send implements Mailer
+func (m *Mailgun) Send(ctx context.Context, msg Message) error {
+	if len(msg.To) == 0 {
+		return ErrNoRecipients
+	}
+	form := url.Values{
+		"from":    {m.from},
+		"to":      msg.To,
+		"subject": {msg.Subject},
+		"text":    {msg.Text},
+	}
+	if msg.HTML != "" {
+		form.Set("html", msg.HTML)
+	}
+	replyTo := m.replyTo
+	if msg.ReplyTo != "" {
+		replyTo = msg.ReplyTo
+	}
+	if replyTo != "" {
+		form.Set("h:Reply-To", replyTo)
+	}
+
+	endpoint := strings.TrimSuffix(m.cfg.BaseURL, "/") + "/" + url.PathEscape(m.cfg.Domain) + "/messages"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", m.cfg.APIKey)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("email: mailgun responded %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
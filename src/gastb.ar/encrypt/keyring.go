@@ -0,0 +1,172 @@
+package encrypt
+
+// The encrypt package encrypts sensitive values kept in the database,
+// such as webhook signing secrets, with AES-GCM. Every user's values are
+// encrypted with their own key, derived from a master key, and master
+// keys are named so they can be rotated: new values use the current key,
+// while older keys are kept to read what they encrypted until it is
+// encrypted again.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the size of master keys in bytes
+const KeySize = 32
+
+// prefix starts every encrypted value, which looks like
+// "enc:KEY_ID:USER_ID:CIPHERTEXT". Values without it are plaintext
+// stored before encryption was turned on.
+const prefix = "enc:"
+
+var (
+	// ErrKeySize is returned for master keys that aren't KeySize bytes
+	ErrKeySize = errors.New("encrypt: keys must be 32 bytes")
+	// ErrKeyID is returned for key IDs that are empty or contain a colon
+	ErrKeyID = errors.New("encrypt: key IDs must be non-empty and have no colons")
+	// ErrUnknownKey is returned for values encrypted with a key that is
+	// not in the keyring
+	ErrUnknownKey = errors.New("encrypt: value was encrypted with an unknown key")
+	// ErrMalformed is returned for values that can't be decrypted, for
+	// they were tampered with or belong to another column
+	ErrMalformed = errors.New("encrypt: malformed or tampered value")
+)
+
+// Key is a master key and the ID values encrypted with it are tagged with
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring encrypts values with its current key and decrypts them with
+// any of its keys. It is safe for concurrent use.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring creates a Keyring encrypting with current and decrypting
+// with it and the old keys
+func NewKeyring(current Key, old ...Key) (*Keyring, error) {
+	kr := &Keyring{
+		current: current.ID,
+		keys:    make(map[string][]byte),
+	}
+	for _, k := range append([]Key{current}, old...) {
+		if k.ID == "" || strings.Contains(k.ID, ":") {
+			return nil, ErrKeyID
+		}
+		if len(k.Secret) != KeySize {
+			return nil, ErrKeySize
+		}
+		kr.keys[k.ID] = k.Secret
+	}
+	return kr, nil
+}
+
+// aead returns the cipher of a user under a master key
+func (kr *Keyring) aead(keyID string, userID uint) (cipher.AEAD, error) {
+	master, ok := kr.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	mac := hmac.New(sha256.New, master)
+	fmt.Fprintf(mac, "user:%d", userID)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts the value of a column, such as "webhooks.secret",
+// belonging to a user. The empty string stays empty.
+func (kr *Keyring) Encrypt(userID uint, column, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	aead, err := kr.aead(kr.current, userID)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(column))
+	return fmt.Sprintf("%s%s:%d:%s", prefix, kr.current, userID,
+		base64.RawURLEncoding.EncodeToString(sealed)), nil
+}
+
+// Decrypt returns the plaintext of a value Encrypt returned for column.
+// Plaintext values, stored before encryption was turned on, are returned
+// as they are.
+//
+// The value is decrypted with the key of the user it was encrypted for,
+// which it records, so that records moved to another account when
+// merging users can still be read.
+func (kr *Keyring) Decrypt(column, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, prefix), ":", 3)
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	userID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	aead, err := kr.aead(parts[0], uint(userID))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", ErrMalformed
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(column))
+	if err != nil {
+		return "", ErrMalformed
+	}
+	return string(plaintext), nil
+}
+
+// Stale reports whether a value should be encrypted again: it is
+// plaintext, or encrypted with a key other than the current one
+func (kr *Keyring) Stale(value string) bool {
+	if value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, prefix+kr.current+":")
+}
+
+// IsEncrypted reports whether a value was returned by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// ParseKey decodes a base64 encoded master key, as kept in the config
+func ParseKey(id, encoded string) (Key, error) {
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Key{}, fmt.Errorf("encrypt: key %q: %w", id, err)
+	}
+	if len(secret) != KeySize {
+		return Key{}, ErrKeySize
+	}
+	return Key{ID: id, Secret: secret}, nil
+}
@@ -0,0 +1,138 @@
+package encrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(id string, b byte) Key {
+	return Key{ID: id, Secret: bytes.Repeat([]byte{b}, KeySize)}
+}
+
+func TestNewKeyring(t *testing.T) {
+	cases := []struct {
+		name string
+		keys []Key
+		want error
+	}{
+		{"valid", []Key{testKey("k1", 1), testKey("k0", 0)}, nil},
+		{"empty ID", []Key{testKey("", 1)}, ErrKeyID},
+		{"ID with a colon", []Key{testKey("k:1", 1)}, ErrKeyID},
+		{"short key", []Key{{ID: "k1", Secret: make([]byte, 16)}}, ErrKeySize},
+		{"short old key", []Key{testKey("k1", 1), {ID: "k0", Secret: make([]byte, 31)}}, ErrKeySize},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewKeyring(c.keys[0], c.keys[1:]...); err != c.want {
+				t.Errorf("NewKeyring: %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	old, err := NewKeyring(testKey("k0", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKeyring(testKey("k1", 1), testKey("k0", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := kr.Encrypt(7, "webhooks.secret", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldValue, err := old.Encrypt(7, "webhooks.secret", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(value, "enc:k1:7:") || strings.Contains(value, "s3cret") {
+		t.Fatalf("Encrypt = %q", value)
+	}
+	parts := strings.SplitN(value, ":", 4)
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with returns value with its sealed bytes changed by fn
+	with := func(fn func([]byte) []byte) string {
+		b := fn(append([]byte(nil), sealed...))
+		return strings.Join(parts[:3], ":") + ":" + base64.RawURLEncoding.EncodeToString(b)
+	}
+	// sameID is a keyring whose current key has k1's ID but not its secret
+	sameID, err := NewKeyring(testKey("k1", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		kr     *Keyring
+		column string
+		value  string
+		want   error
+	}{
+		{"current key", kr, "webhooks.secret", value, nil},
+		{"old key", kr, "webhooks.secret", oldValue, nil},
+		{"plaintext", kr, "webhooks.secret", "s3cret", nil},
+
+		{"unknown key ID", old, "webhooks.secret", value, ErrUnknownKey},
+		{"key ID renamed", kr, "webhooks.secret", strings.Replace(value, "enc:k1:", "enc:k9:", 1), ErrUnknownKey},
+		{"same key ID, other secret", sameID, "webhooks.secret", value, ErrMalformed},
+		{"key ID swapped", kr, "webhooks.secret", strings.Replace(value, "enc:k1:", "enc:k0:", 1), ErrMalformed},
+		{"other column", kr, "users.totp_secret", value, ErrMalformed},
+		{"other user", kr, "webhooks.secret", strings.Replace(value, ":7:", ":8:", 1), ErrMalformed},
+		{"flipped ciphertext bit", kr, "webhooks.secret", with(func(b []byte) []byte {
+			b[len(b)-20] ^= 1
+			return b
+		}), ErrMalformed},
+		{"flipped tag bit", kr, "webhooks.secret", with(func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}), ErrMalformed},
+		{"flipped nonce bit", kr, "webhooks.secret", with(func(b []byte) []byte {
+			b[0] ^= 1
+			return b
+		}), ErrMalformed},
+		{"truncated", kr, "webhooks.secret", with(func(b []byte) []byte { return b[:len(b)-1] }), ErrMalformed},
+		{"shorter than a nonce", kr, "webhooks.secret", with(func(b []byte) []byte { return b[:4] }), ErrMalformed},
+		{"not base64", kr, "webhooks.secret", value + "!", ErrMalformed},
+		{"user ID not a number", kr, "webhooks.secret", strings.Replace(value, ":7:", ":x:", 1), ErrMalformed},
+		{"missing parts", kr, "webhooks.secret", "enc:k1:" + parts[3], ErrMalformed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.kr.Decrypt(c.column, c.value)
+			if err != c.want {
+				t.Fatalf("Decrypt = %q, %v, want %v", got, err, c.want)
+			}
+			if err == nil && got != "s3cret" {
+				t.Errorf("Decrypt = %q, want s3cret", got)
+			}
+		})
+	}
+}
+
+func TestStale(t *testing.T) {
+	kr, err := NewKeyring(testKey("k1", 1), testKey("k0", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := NewKeyring(testKey("k0", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := kr.Encrypt(1, "c", "v")
+	stale, _ := old.Encrypt(1, "c", "v")
+	for value, want := range map[string]bool{current: false, stale: true, "plain": true, "": false} {
+		if got := kr.Stale(value); got != want {
+			t.Errorf("Stale(%q) = %v, want %v", value, got, want)
+		}
+	}
+	if got, err := kr.Encrypt(1, "c", ""); got != "" || err != nil {
+		t.Errorf("Encrypt of an empty value = %q, %v, want it empty", got, err)
+	}
+}
@@ -0,0 +1,229 @@
+package errreport
+
+// The errreport package sends panics and the errors behind 5xx responses
+// and failed jobs to Sentry, or any service accepting Sentry's envelope
+// API such as GlitchTip. Events carry the request ID, the user ID and the
+// method and URL of the request they happened in, with secrets in the
+// query string redacted; bodies, cookies and headers other than the user
+// agent are never sent.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+
+	ctxpkg "gastb.ar/context"
+)
+
+// Config configures error reporting
+type Config struct {
+	// DSN is the client key URL of the project, e.g.
+	// https://<key>@o1.ingest.sentry.io/<project>. Empty disables
+	// reporting.
+	DSN string
+	// Environment and Release tag every event
+	Environment string
+	Release     string
+}
+
+var (
+	mu     sync.RWMutex
+	global *reporter
+)
+
+func current() *reporter {
+	mu.RLock()
+	defer mu.RUnlock()
+	return global
+}
+
+// Init turns reporting on. It returns a function that sends pending
+// events and stops the sender, to be called on shutdown.
+func Init(cfg Config) (func(ctx context.Context) error, error) {
+	if cfg.DSN == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	r, err := newReporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	global = r
+	mu.Unlock()
+	return func(ctx context.Context) error {
+		mu.Lock()
+		global = nil
+		mu.Unlock()
+		return r.shutdown(ctx)
+	}, nil
+}
+
+//
+// 1. Request scope
+//
+
+// scope is what is known about the request an error happens in
+type scope struct {
+	method    string
+	url       string
+	query     string
+	userAgent string
+	requestID string
+
+	mu     sync.Mutex
+	userID uint
+}
+
+type scopeKey struct{}
+
+// WithRequest returns a context whose events describe r. The request ID
+// must be in r's context already.
+func WithRequest(ctx context.Context, r *http.Request) context.Context {
+	u := *r.URL
+	u.RawQuery, u.Fragment = "", ""
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	return context.WithValue(ctx, scopeKey{}, &scope{
+		method:    r.Method,
+		url:       u.String(),
+		query:     redact(r.URL.Query()),
+		userAgent: r.UserAgent(),
+		requestID: ctxpkg.RequestID(ctx),
+	})
+}
+
+// SetUser records the ID of the user making the request of ctx, once it
+// is known
+func SetUser(ctx context.Context, id uint) {
+	if s, ok := ctx.Value(scopeKey{}).(*scope); ok {
+		s.mu.Lock()
+		s.userID = id
+		s.mu.Unlock()
+	}
+}
+
+// sensitive matches query parameters whose values are not sent
+var sensitive = regexp.MustCompile(`(?i)pass|token|secret|key|code|state|sig|auth|session|email`)
+
+// redact encodes a query string with the values of sensitive parameters
+// replaced
+func redact(q url.Values) string {
+	for name, values := range q {
+		if sensitive.MatchString(name) {
+			for i := range values {
+				values[i] = "[Filtered]"
+			}
+		}
+	}
+	return q.Encode()
+}
+
+//
+// 2. Reporting
+//
+
+// causeSetter is implemented by response writers that report 5xx
+// responses, to learn the error behind them
+type causeSetter interface {
+	SetCause(err error)
+}
+
+// SetCause records err as the cause of the 5xx response being written to
+// w, so that it is what gets reported rather than the status alone. It
+// looks through writers wrapping w with an Unwrap method.
+func SetCause(w http.ResponseWriter, err error) {
+	for {
+		if cs, ok := w.(causeSetter); ok {
+			cs.SetCause(err)
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Error reports err, with the stack of the caller. tags are key/value
+// pairs, such as the kind of a failed job.
+func Error(ctx context.Context, err error, tags ...string) {
+	r := current()
+	if r == nil || err == nil {
+		return
+	}
+	r.report(ctx, fmt.Sprintf("%T", err), err.Error(), callers(), tags)
+}
+
+// Panic reports a recovered panic. It must be called from the deferred
+// function that recovered, so the stack still shows where it happened.
+func Panic(ctx context.Context, rec interface{}, tags ...string) {
+	r := current()
+	if r == nil {
+		return
+	}
+	r.report(ctx, "panic", fmt.Sprint(rec), callers(), tags)
+}
+
+// Enabled reports whether reporting is on
+func Enabled() bool {
+	return current() != nil
+}
+
+// callers returns the stack of the caller of the function calling it
+func callers() []uintptr {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	return pcs[:n]
+}
+
+// event is what is reported, before encoding
+type event struct {
+	time      time.Time
+	errType   string
+	message   string
+	stack     []uintptr
+	tags      map[string]string
+	scope     *scope
+	userID    uint
+	requestID string
+}
+
+func (r *reporter) report(ctx context.Context, errType, message string, stack []uintptr, tags []string) {
+	ev := &event{
+		time:      time.Now(),
+		errType:   errType,
+		message:   message,
+		stack:     stack,
+		tags:      make(map[string]string),
+		requestID: ctxpkg.RequestID(ctx),
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		ev.tags[tags[i]] = tags[i+1]
+	}
+	if s, ok := ctx.Value(scopeKey{}).(*scope); ok {
+		ev.scope = s
+		s.mu.Lock()
+		ev.userID = s.userID
+		s.mu.Unlock()
+		if ev.requestID == "" {
+			ev.requestID = s.requestID
+		}
+	}
+	if u := ctxpkg.User(ctx); u != nil {
+		ev.userID = u.ID
+	}
+	r.send(ev)
+}
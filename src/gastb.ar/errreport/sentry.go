@@ -0,0 +1,277 @@
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gastb.ar/rand"
+)
+
+// queueSize is how many events wait to be sent; more are dropped rather
+// than slowing down requests
+const queueSize = 100
+
+// inAppPrefix marks the frames of this module, which Sentry highlights
+const inAppPrefix = "gastb.ar/"
+
+// reporter posts events to a Sentry envelope endpoint, one at a time
+// from a single goroutine
+type reporter struct {
+	cfg      Config
+	endpoint string
+	auth     string
+	server   string
+	client   *http.Client
+
+	queue chan *event
+	flush chan chan struct{}
+
+	// rate limits sent by the server; events are dropped until then
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+// newReporter parses the DSN and starts the sender
+func newReporter(cfg Config) (*reporter, error) {
+	u, err := url.Parse(cfg.DSN)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, errors.New("errreport: invalid DSN")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	project := path[i+1:]
+	if project == "" {
+		return nil, errors.New("errreport: DSN has no project ID")
+	}
+	server, _ := os.Hostname()
+	r := &reporter{
+		cfg:      cfg,
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path[:i], project),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=gastb-errreport/1",
+			u.User.Username()),
+		server: server,
+		// Like the tracing exporter's, these requests aren't traced
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *event, queueSize),
+		flush:  make(chan chan struct{}),
+	}
+	go r.loop()
+	return r, nil
+}
+
+func (r *reporter) send(ev *event) {
+	r.mu.Lock()
+	paused := time.Now().Before(r.pausedUntil)
+	r.mu.Unlock()
+	if paused {
+		return
+	}
+	select {
+	case r.queue <- ev:
+	default:
+	}
+}
+
+func (r *reporter) loop() {
+	for {
+		select {
+		case ev := <-r.queue:
+			r.post(ev)
+		case ack := <-r.flush:
+			for len(r.queue) > 0 {
+				r.post(<-r.queue)
+			}
+			close(ack)
+			return
+		}
+	}
+}
+
+// shutdown sends pending events and stops the sender
+func (r *reporter) shutdown(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case r.flush <- ack:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//
+// Sentry event encoding
+//
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryRequest struct {
+	Method      string            `json:"method,omitempty"`
+	URL         string            `json:"url,omitempty"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type sentryEvent struct {
+	EventID     string `json:"event_id"`
+	Timestamp   string `json:"timestamp"`
+	Platform    string `json:"platform"`
+	Level       string `json:"level"`
+	ServerName  string `json:"server_name,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	Release     string `json:"release,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Request *sentryRequest    `json:"request,omitempty"`
+	User    map[string]string `json:"user,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// frames converts a stack to Sentry frames, outermost call first
+func frames(stack []uintptr) []sentryFrame {
+	var out []sentryFrame
+	fs := runtime.CallersFrames(stack)
+	for {
+		f, more := fs.Next()
+		module, function := splitFunction(f.Function)
+		out = append(out, sentryFrame{
+			Function: function,
+			Module:   module,
+			AbsPath:  f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, inAppPrefix),
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// splitFunction splits a qualified function name such as
+// gastb.ar/jobs.(*Queue).run into its package path and name
+func splitFunction(name string) (module, function string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	dot += slash + 1
+	return name[:dot], name[dot+1:]
+}
+
+// encode builds the Sentry event of ev
+func (r *reporter) encode(ev *event) (*sentryEvent, error) {
+	id, err := rand.Bytes(16)
+	if err != nil {
+		return nil, err
+	}
+	se := &sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   ev.time.UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       "error",
+		ServerName:  r.server,
+		Environment: r.cfg.Environment,
+		Release:     r.cfg.Release,
+		Tags:        ev.tags,
+	}
+	exc := sentryException{Type: ev.errType, Value: ev.message}
+	exc.Stacktrace.Frames = frames(ev.stack)
+	se.Exception.Values = []sentryException{exc}
+	if ev.requestID != "" {
+		se.Tags["request_id"] = ev.requestID
+	}
+	if ev.userID != 0 {
+		se.User = map[string]string{"id": strconv.FormatUint(uint64(ev.userID), 10)}
+	}
+	if s := ev.scope; s != nil {
+		se.Request = &sentryRequest{
+			Method:      s.method,
+			URL:         s.url,
+			QueryString: s.query,
+		}
+		if s.userAgent != "" {
+			se.Request.Headers = map[string]string{"User-Agent": s.userAgent}
+		}
+	}
+	return se, nil
+}
+
+// post sends an event in an envelope
+func (r *reporter) post(ev *event) {
+	se, err := r.encode(ev)
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(se)
+	if err != nil {
+		return
+	}
+	var body bytes.Buffer
+	header, _ := json.Marshal(map[string]string{
+		"event_id": se.EventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	body.Write(header)
+	fmt.Fprintf(&body, "\n{\"type\":\"event\",\"length\":%d}\n", len(payload))
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest("POST", r.endpoint, &body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		slog.Warn("reporting error failed", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := time.Minute
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(s) * time.Second
+		}
+		r.mu.Lock()
+		r.pausedUntil = time.Now().Add(wait)
+		r.mu.Unlock()
+	}
+}
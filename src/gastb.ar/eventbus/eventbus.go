@@ -0,0 +1,125 @@
+package eventbus
+
+// The eventbus package publishes the changes of the outbox to an event
+// bus, for downstream consumers such as analytics. Events are JSON
+// documents with a stable schema, Event; the publisher is NATS JetStream
+// or Kafka, selected by the configuration. Publishing runs as a consumer
+// of the outbox relay, which hands a batch of changes again until it
+// was published, so every change is published at least once; each event
+// has an ID derived from the change to drop repeats by. Like the cache
+// package's Redis, the publishers speak their protocols over plain
+// connections rather than through client libraries.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// SchemaVersion is the version of the Event schema, bumped on changes
+// that would break consumers
+const SchemaVersion = 1
+
+// Event is the JSON document published for a change
+type Event struct {
+	// ID is the same every time a change is published, such as
+	// "chg_42"
+	ID string `json:"id"`
+	// SchemaVersion is SchemaVersion
+	SchemaVersion int `json:"schema_version"`
+	// Type is the entity and operation, such as "stocklist.created"
+	Type string `json:"type"`
+	// Seq orders events: a later change has a higher Seq
+	Seq            uint64    `json:"seq"`
+	Entity         string    `json:"entity"`
+	EntityID       uint      `json:"entity_id"`
+	UserID         uint      `json:"user_id"`
+	OrganizationID *uint     `json:"organization_id"`
+	OccurredAt     time.Time `json:"occurred_at"`
+	// Data is the entity after the change, or before a deletion; for
+	// stocklists, a models.StocklistPayload
+	Data json.RawMessage `json:"data"`
+}
+
+// Key is the partition key of an event: events of the same entity share
+// it, so that brokers keep them in order
+func (e *Event) Key() string {
+	return e.Entity + ":" + strconv.FormatUint(uint64(e.EntityID), 10)
+}
+
+// opTypes names the operations of changes in event types
+var opTypes = map[string]string{
+	models.ChangeCreate: "created",
+	models.ChangeUpdate: "updated",
+	models.ChangeDelete: "deleted",
+}
+
+// NewEvent describes a change of the outbox as an event
+func NewEvent(c *models.Change) Event {
+	return Event{
+		ID:             "chg_" + strconv.FormatUint(c.Seq, 10),
+		SchemaVersion:  SchemaVersion,
+		Type:           c.Entity + "." + opTypes[c.Op],
+		Seq:            c.Seq,
+		Entity:         c.Entity,
+		EntityID:       c.EntityID,
+		UserID:         c.UserID,
+		OrganizationID: c.OrganizationID,
+		OccurredAt:     c.CreatedAt.UTC(),
+		Data:           json.RawMessage(c.Payload),
+	}
+}
+
+// Publisher sends events to an event bus. Publish returns once the bus
+// acknowledged every event, in order; if it returns an error, some may
+// have been published anyway.
+type Publisher interface {
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// Config selects and configures a Publisher
+type Config struct {
+	// Backend is "nats", "kafka", or empty for no publishing
+	Backend string
+	NATS    NATSConfig
+	Kafka   KafkaConfig
+	// Timeout bounds connecting and each acknowledgement; it defaults
+	// to 5 seconds
+	Timeout time.Duration
+}
+
+// DefaultTimeout is the Timeout of publishers that don't set one
+const DefaultTimeout = 5 * time.Second
+
+// New creates the Publisher selected by cfg, or returns nil if there is
+// no backend
+func New(cfg Config) (Publisher, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "nats":
+		return NewNATS(cfg.NATS, cfg.Timeout)
+	case "kafka":
+		return NewKafka(cfg.Kafka, cfg.Timeout)
+	}
+	return nil, errors.New("eventbus: unknown backend " + cfg.Backend)
+}
+
+// Consumer returns an outbox consumer publishing changes with p
+func Consumer(p Publisher) func(ctx context.Context, changes []models.Change) error {
+	return func(ctx context.Context, changes []models.Change) error {
+		events := make([]Event, len(changes))
+		for i := range changes {
+			events[i] = NewEvent(&changes[i])
+		}
+		return p.Publish(ctx, events)
+	}
+}
@@ -0,0 +1,118 @@
+package eventbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gastb.ar/tracing"
+)
+
+// KafkaConfig configures publishing to Kafka through a Confluent REST
+// Proxy
+type KafkaConfig struct {
+	// URL is the REST Proxy, such as http://localhost:8082
+	URL string
+	// Username and Password authenticate to it, if set
+	Username string
+	Password string
+	// Topic is what events are published to, keyed by Event.Key
+	Topic string
+}
+
+// Kafka publishes events to a topic through the v2 API of a Confluent
+// REST Proxy, which responds once the brokers acknowledged them.
+// Consumers drop the events published again by their ID.
+type Kafka struct {
+	cfg      KafkaConfig
+	endpoint string
+	client   *http.Client
+}
+
+var _ Publisher = &Kafka{}
+
+// NewKafka creates a Kafka publisher
+func NewKafka(cfg KafkaConfig, timeout time.Duration) (*Kafka, error) {
+	if cfg.Topic == "" {
+		return nil, errors.New("eventbus: a Kafka topic is required")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("eventbus: the Kafka REST Proxy URL must be http(s)://host:port")
+	}
+	return &Kafka{
+		cfg:      cfg,
+		endpoint: strings.TrimSuffix(cfg.URL, "/") + "/topics/" + url.PathEscape(cfg.Topic),
+		client:   &http.Client{Timeout: timeout, Transport: &tracing.Transport{}},
+	}, nil
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value *Event `json:"value"`
+}
+
+// Publish implements Publisher
+func (k *Kafka) Publish(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	records := make([]kafkaRecord, len(events))
+	for i := range events {
+		records[i] = kafkaRecord{Key: events[i].Key(), Value: &events[i]}
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if k.cfg.Username != "" {
+		req.SetBasicAuth(k.cfg.Username, k.cfg.Password)
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("eventbus: kafka: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("eventbus: kafka: the REST Proxy responded %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	// Records fail one by one, with the others published
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("eventbus: kafka: decoding REST Proxy response: %w", err)
+	}
+	if len(result.Offsets) != len(events) {
+		return errors.New("eventbus: kafka: the REST Proxy didn't acknowledge every event")
+	}
+	for i, o := range result.Offsets {
+		if o.ErrorCode != nil || o.Error != "" {
+			return fmt.Errorf("eventbus: kafka: publishing %s: %s", events[i].ID, o.Error)
+		}
+	}
+	return nil
+}
+
+// Close implements Publisher
+func (k *Kafka) Close() error {
+	k.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,275 @@
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gastb.ar/rand"
+)
+
+// NATSConfig configures publishing to NATS JetStream
+type NATSConfig struct {
+	// URL is the server, nats://[user:password@]host:port
+	URL string
+	// Token authenticates instead of a user and password
+	Token string
+	// Subject is what events are published on, followed by a dot and
+	// their type, e.g. "gastb.events" publishes on
+	// "gastb.events.stocklist.created". A JetStream stream must capture
+	// it, e.g. with the subject "gastb.events.>".
+	Subject string
+}
+
+// NATS publishes events to a JetStream stream. Each event waits for the
+// stream's acknowledgement, and carries its ID in the Nats-Msg-Id header
+// so that the stream drops the ones published again within its
+// duplicate window.
+type NATS struct {
+	cfg     NATSConfig
+	addr    string
+	user    string
+	pass    string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn *natsConn
+}
+
+var _ Publisher = &NATS{}
+
+// NewNATS creates a NATS publisher. It connects on the first Publish.
+func NewNATS(cfg NATSConfig, timeout time.Duration) (*NATS, error) {
+	if cfg.Subject == "" {
+		return nil, errors.New("eventbus: a NATS subject is required")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		return nil, errors.New("eventbus: the NATS URL must be nats://host:port")
+	}
+	n := &NATS{cfg: cfg, addr: u.Host, timeout: timeout}
+	if u.Port() == "" {
+		n.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		n.user = u.User.Username()
+		n.pass, _ = u.User.Password()
+	}
+	return n, nil
+}
+
+// Publish implements Publisher. A connection that fails is closed, and
+// the next Publish opens a new one.
+func (n *NATS) Publish(ctx context.Context, events []Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		c, err := n.dial()
+		if err != nil {
+			return err
+		}
+		n.conn = c
+	}
+	for i := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		body, err := json.Marshal(&events[i])
+		if err != nil {
+			return err
+		}
+		if err := n.conn.publish(n.cfg.Subject+"."+events[i].Type, events[i].ID, body, n.timeout); err != nil {
+			var perr natsPubError
+			if !errors.As(err, &perr) {
+				n.conn.conn.Close()
+				n.conn = nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements Publisher
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// natsPubError is a negative acknowledgement of JetStream, which leaves
+// the connection usable
+type natsPubError string
+
+func (e natsPubError) Error() string {
+	return "eventbus: nats: " + string(e)
+}
+
+// natsConn is a connection speaking the NATS client protocol, subscribed
+// to an inbox that acknowledgements are sent to
+type natsConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	inbox string
+}
+
+// dial connects, authenticates and subscribes to a new inbox
+func (n *NATS) dial() (*natsConn, error) {
+	conn, err := net.DialTimeout("tcp", n.addr, n.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("eventbus: nats: %v", err)
+	}
+	id, err := rand.String(12)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &natsConn{
+		conn:  conn,
+		r:     bufio.NewReader(conn),
+		w:     bufio.NewWriter(conn),
+		inbox: "_INBOX.gastb." + strings.NewReplacer("-", "", "_", "").Replace(id),
+	}
+	conn.SetDeadline(time.Now().Add(n.timeout))
+	// The server greets with INFO
+	line, err := c.readLine()
+	if err == nil && !strings.HasPrefix(line, "INFO ") {
+		err = errors.New("eventbus: nats: unexpected greeting")
+	}
+	if err == nil {
+		options, _ := json.Marshal(map[string]interface{}{
+			"verbose":    false,
+			"pedantic":   false,
+			"headers":    true,
+			"name":       "gastb",
+			"lang":       "go",
+			"version":    "1",
+			"user":       n.user,
+			"pass":       n.pass,
+			"auth_token": n.cfg.Token,
+		})
+		fmt.Fprintf(c.w, "CONNECT %s\r\nSUB %s 1\r\nPING\r\n", options, c.inbox)
+		err = c.w.Flush()
+	}
+	for err == nil {
+		line, err = c.readLine()
+		if err != nil || line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			err = errors.New("eventbus: nats: " + line)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// publish sends a message with its ID in the Nats-Msg-Id header, asking
+// for the acknowledgement on the inbox, and waits for it
+func (c *natsConn) publish(subject, id string, body []byte, timeout time.Duration) error {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	header := "NATS/1.0\r\nNats-Msg-Id: " + id + "\r\n\r\n"
+	fmt.Fprintf(c.w, "HPUB %s %s %d %d\r\n%s", subject, c.inbox, len(header), len(header)+len(body), header)
+	c.w.Write(body)
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("eventbus: nats: %v", err)
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			c.w.WriteString("PONG\r\n")
+			if err := c.w.Flush(); err != nil {
+				return fmt.Errorf("eventbus: nats: %v", err)
+			}
+		case "+OK", "PONG", "INFO":
+		case "-ERR":
+			return errors.New("eventbus: nats: " + line)
+		case "MSG", "HMSG":
+			headers, payload, err := c.readMsg(fields)
+			if err != nil {
+				return err
+			}
+			return jetStreamAck(headers, payload)
+		default:
+			return fmt.Errorf("eventbus: nats: unexpected %q", fields[0])
+		}
+	}
+}
+
+// readMsg reads the headers and payload of a MSG or HMSG whose control
+// line had fields
+func (c *natsConn) readMsg(fields []string) (string, []byte, error) {
+	hdrLen := 0
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err == nil && fields[0] == "HMSG" {
+		hdrLen, err = strconv.Atoi(fields[len(fields)-2])
+	}
+	if err != nil || hdrLen > total {
+		return "", nil, errors.New("eventbus: nats: malformed message")
+	}
+	b := make([]byte, total+2)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return "", nil, fmt.Errorf("eventbus: nats: %v", err)
+	}
+	return string(b[:hdrLen]), b[hdrLen:total], nil
+}
+
+// jetStreamAck checks the reply to a publish: an acknowledgement with
+// the stream sequence, or an error, such as 503 when no stream captures
+// the subject
+func jetStreamAck(headers string, payload []byte) error {
+	if status := strings.Fields(strings.SplitN(headers, "\r\n", 2)[0]); len(status) > 1 {
+		return natsPubError("no JetStream stream acknowledged the event (status " + status[1] + ")")
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return natsPubError("malformed acknowledgement")
+	}
+	if ack.Error != nil {
+		return natsPubError(ack.Error.Description)
+	}
+	if ack.Stream == "" {
+		return natsPubError("the event was not stored in a stream")
+	}
+	return nil
+}
+
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("eventbus: nats: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,124 @@
+package flash
+
+// The flash package stores one-off messages in signed cookies, so that a
+// handler can leave a message for the page a client is redirected to.
+// Messages are deleted as soon as they are read.
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gastb.ar/hash"
+)
+
+// Levels of a flash message. They match the Bootstrap alert classes.
+const (
+	LevelSuccess = "success"
+	LevelInfo    = "info"
+	LevelError   = "danger"
+)
+
+// Name of the cookie holding the flash message
+const cookieName = "flash"
+
+// Message is a flash message shown to the user once.
+type Message struct {
+	Level   string `json:"l"`
+	Message string `json:"m"`
+}
+
+var (
+	mu  sync.RWMutex
+	key string
+)
+
+// SetKey sets the key used to sign flash cookies. It must be called at
+// startup, before any message is set or read.
+func SetKey(k []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	key = string(k)
+}
+
+func sign(payload string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return hash.NewHMAC(key).Hash(payload)
+}
+
+// Set stores a message with the given level in a flash cookie, replacing
+// any message that has not been read yet
+func Set(w http.ResponseWriter, level, msg string) {
+	b, err := json.Marshal(Message{Level: level, Message: msg})
+	if err != nil {
+		return
+	}
+	payload := base64.URLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    payload + "." + sign(payload),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Success sets a success flash message
+func Success(w http.ResponseWriter, msg string) {
+	Set(w, LevelSuccess, msg)
+}
+
+// Info sets an informational flash message
+func Info(w http.ResponseWriter, msg string) {
+	Set(w, LevelInfo, msg)
+}
+
+// Error sets an error flash message
+func Error(w http.ResponseWriter, msg string) {
+	Set(w, LevelError, msg)
+}
+
+// Pending reports whether a request carries a flash message, which the
+// page it gets shows
+func Pending(r *http.Request) bool {
+	_, err := r.Cookie(cookieName)
+	return err == nil
+}
+
+// Pop returns the flash message of a request and deletes the cookie that
+// holds it. It returns nil if there is no message or if its signature
+// is not valid.
+func Pop(w http.ResponseWriter, r *http.Request) *Message {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	if !hmac.Equal([]byte(sign(parts[0])), []byte(parts[1])) {
+		return nil
+	}
+	b, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	var msg Message
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil
+	}
+	return &msg
+}
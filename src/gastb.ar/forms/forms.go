@@ -0,0 +1,162 @@
+package forms
+
+// The forms package decodes POST bodies into typed structs and validates
+// them with rules given in struct tags, so that handlers can re-render a
+// form with a message next to each invalid field and the values the user
+// already typed in.
+//
+// Fields are named by their schema tag and validated by their validate
+// tag, a comma separated list of rules:
+//
+//	required      the field must not be empty
+//	email         the field must be an email address
+//	min=N         the field must have at least N characters
+//	max=N         the field must have at most N characters
+//	matches=Field the field must equal the struct field named Field
+//
+// e.g.
+//
+//	Password string `schema:"password" validate:"required,min=8"`
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/schema"
+)
+
+// Errors maps form field names to a message explaining what is wrong
+// with the submitted value. It is nil when the form is valid.
+type Errors map[string]string
+
+// Add records a message for a field, keeping the first one if there
+// already is one
+func (e *Errors) Add(field, msg string) {
+	if *e == nil {
+		*e = make(Errors)
+	}
+	if _, ok := (*e)[field]; !ok {
+		(*e)[field] = msg
+	}
+}
+
+// Form is what templates get to render a form: Values holds the submitted
+// values (a struct decoded by Parse) and Errors the message of each
+// invalid field.
+type Form struct {
+	Values interface{}
+	Errors Errors
+}
+
+// Error returns the message for a field, or an empty string
+func (f Form) Error(field string) string {
+	return f.Errors[field]
+}
+
+var decoder = schema.NewDecoder()
+
+func init() {
+	// Forms carry fields that are not part of the struct, such as the
+	// CSRF token.
+	decoder.IgnoreUnknownKeys(true)
+}
+
+// Parse decodes the POST body of r into dst, a pointer to a struct, and
+// validates it. A non-nil error means the body could not be decoded;
+// invalid values are reported in the returned Errors instead.
+func Parse(r *http.Request, dst interface{}) (Errors, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(dst, r.PostForm); err != nil {
+		return nil, err
+	}
+	return Validate(dst), nil
+}
+
+var emailRegex = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// Validate checks the fields of the struct dst points to against their
+// validate tags
+func Validate(dst interface{}) Errors {
+	v := reflect.Indirect(reflect.ValueOf(dst))
+	t := v.Type()
+	var errs Errors
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name := fieldName(sf)
+		value := fmt.Sprint(v.Field(i).Interface())
+		for _, rule := range strings.Split(tag, ",") {
+			if msg := check(v, rule, value); msg != "" {
+				errs.Add(name, msg)
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// fieldName returns the form name of a struct field
+func fieldName(sf reflect.StructField) string {
+	name := strings.Split(sf.Tag.Get("schema"), ",")[0]
+	if name == "" || name == "-" {
+		return sf.Name
+	}
+	return name
+}
+
+// check applies a single rule to a value, returning a message if the
+// value breaks it. Rules other than required pass on empty values.
+func check(v reflect.Value, rule, value string) string {
+	rule = strings.TrimSpace(rule)
+	arg := ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		rule, arg = rule[:i], rule[i+1:]
+	}
+	if rule == "required" {
+		if strings.TrimSpace(value) == "" {
+			return "is required"
+		}
+		return ""
+	}
+	if value == "" {
+		return ""
+	}
+	switch rule {
+	case "email":
+		if !emailRegex.MatchString(value) {
+			return "must be a valid email address"
+		}
+	case "min":
+		n, _ := strconv.Atoi(arg)
+		if utf8.RuneCountInString(value) < n {
+			return fmt.Sprintf("must be at least %d characters long", n)
+		}
+	case "max":
+		n, _ := strconv.Atoi(arg)
+		if utf8.RuneCountInString(value) > n {
+			return fmt.Sprintf("must be at most %d characters long", n)
+		}
+	case "matches":
+		other := v.FieldByName(arg)
+		if !other.IsValid() {
+			panic("forms: matches refers to unknown field " + arg)
+		}
+		if fmt.Sprint(other.Interface()) != value {
+			sf, _ := v.Type().FieldByName(arg)
+			return "must match " + fieldName(sf)
+		}
+	default:
+		panic("forms: unknown validation rule " + rule)
+	}
+	return ""
+}
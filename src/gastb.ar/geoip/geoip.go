@@ -0,0 +1,100 @@
+package geoip
+
+// The geoip package tells roughly where IP addresses are, down to the
+// country, so users can spot sessions that aren't theirs. Locations come
+// from a CSV file of address ranges, one per line as
+// "first,last,country", the format of the free DB-IP "IP to Country
+// Lite" database. Without a file, no address has a location.
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidFile is returned when loading a file that isn't a list of
+// address ranges
+var ErrInvalidFile = errors.New("geoip: file is not a list of address ranges")
+
+// DB holds the address ranges of countries. The zero value and nil
+// locate nothing.
+type DB struct {
+	// ranges are sorted by their first address and don't overlap
+	ranges []ipRange
+}
+
+type ipRange struct {
+	first, last netip.Addr
+	country     string
+}
+
+// Load reads the CSV file at path; an empty path gives an empty DB
+func Load(path string) (*DB, error) {
+	if path == "" {
+		return &DB{}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read reads address ranges in the format of Load from r
+func Read(r io.Reader) (*DB, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	var db DB
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("%w: line %d has %d fields", ErrInvalidFile, line, len(rec))
+		}
+		first, err1 := netip.ParseAddr(rec[0])
+		last, err2 := netip.ParseAddr(rec[1])
+		first, last = first.Unmap(), last.Unmap()
+		if err1 != nil || err2 != nil || first.Is4() != last.Is4() || last.Less(first) {
+			return nil, fmt.Errorf("%w: line %d has no valid range", ErrInvalidFile, line)
+		}
+		db.ranges = append(db.ranges, ipRange{first, last, strings.ToUpper(rec[2])})
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].first.Less(db.ranges[j].first)
+	})
+	return &db, nil
+}
+
+// Country returns the ISO 3166 code of the country ip is in, or "" if it
+// is not known, as for private addresses
+func (db *DB) Country(ip string) string {
+	if db == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	// The last range starting at or before addr is the only one that
+	// may hold it
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].first)
+	}) - 1
+	if i < 0 || db.ranges[i].last.Less(addr) || db.ranges[i].first.Is4() != addr.Is4() {
+		return ""
+	}
+	return db.ranges[i].country
+}
@@ -0,0 +1,635 @@
+package graphql
+
+// The graphql package executes GraphQL queries and mutations against a
+// schema of Go resolvers. It implements the parts of the language API
+// clients use: operations with variables, aliases, fragments and the
+// @include and @skip directives. Introspection, subscriptions and
+// non-null result types are not supported.
+//
+// Fields are resolved breadth first: a field is resolved for every
+// object of its type at the same depth before going deeper, so a field
+// with a BatchFunc loads, say, the attachments of all the stocklists in
+// a response with one query instead of one per stocklist.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxDepth is how deeply selections may nest when a schema has no
+// MaxDepth of its own
+const DefaultMaxDepth = 10
+
+// Schema is the root of a GraphQL API
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+	// MaxDepth bounds how deeply selections may nest, so that a single
+	// request can't make the server do unbounded work
+	MaxDepth int
+}
+
+// Object is an object type: its fields, by name
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// ResolveFunc returns the value of a field of source
+type ResolveFunc func(ctx context.Context, source interface{}, args Args) (interface{}, error)
+
+// BatchFunc returns the values of a field of several sources at once, in
+// the order of the sources
+type BatchFunc func(ctx context.Context, sources []interface{}, args Args) ([]interface{}, error)
+
+// Field is a field of an object. Fields of scalar type have no Type; their
+// values are encoded as JSON. Fields of object type return, for each
+// source, nil, a value of the type or a slice of them. Exactly one of
+// Resolve and Batch must be set.
+type Field struct {
+	Type *Object
+	// Args maps the names of the arguments to their types: ID, String,
+	// Int, Float or Boolean, followed by ! if the argument is required
+	Args    map[string]string
+	Resolve ResolveFunc
+	Batch   BatchFunc
+}
+
+// Args holds the arguments of a field, coerced to their declared types:
+// IDs and Strings are strings, Ints are ints, Floats are float64s and
+// Booleans are bools. Arguments that were left out or null are missing.
+type Args map[string]interface{}
+
+// String returns a String or ID argument, or "" if it is missing
+func (a Args) String(name string) string {
+	s, _ := a[name].(string)
+	return s
+}
+
+// Int returns an Int argument, or 0 if it is missing
+func (a Args) Int(name string) int {
+	n, _ := a[name].(int)
+	return n
+}
+
+// Has reports whether an argument was given
+func (a Args) Has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+// Request is a GraphQL request, as sent in the body of a POST
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Response is the result of a request. Data is null if the request could
+// not be executed at all; otherwise, fields whose resolvers failed are
+// null and Errors says why.
+type Response struct {
+	Data   interface{} `json:"data"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// Error is an error in a request or in resolving one of its fields
+type Error struct {
+	Message string `json:"message"`
+	// Line is where the error is in the query, when it is about the
+	// query itself; it is sent as part of the message
+	Line int `json:"-"`
+	// Path leads to the field that failed, through field names and list
+	// indices
+	Path []interface{} `json:"path,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("graphql: line %d: %s", e.Line, e.Message)
+	}
+	return "graphql: " + e.Message
+}
+
+// ErrorMessage lets a schema decide what clients see of resolver errors,
+// such as hiding internal ones. By default, the error text is shown.
+type ErrorMessage func(ctx context.Context, err error) string
+
+// Execute runs a request. Mutations are only run if allowMutations is
+// set, so that requests with side effects can be limited to POST.
+func (s *Schema) Execute(ctx context.Context, req Request, allowMutations bool, msg ErrorMessage) *Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return failed(err)
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return failed(err)
+	}
+	root := s.Query
+	switch op.kind {
+	case "mutation":
+		if s.Mutation == nil {
+			return failed(&Error{Message: "mutations are not supported"})
+		}
+		if !allowMutations {
+			return failed(&Error{Message: "mutations must be sent with POST"})
+		}
+		root = s.Mutation
+	case "subscription":
+		return failed(&Error{Message: "subscriptions are not supported"})
+	}
+	vars, err := coerceVariables(op.variables, req.Variables)
+	if err != nil {
+		return failed(err)
+	}
+	if msg == nil {
+		msg = func(ctx context.Context, err error) string { return err.Error() }
+	}
+	e := &execution{doc: doc, vars: vars, msg: msg, maxDepth: s.MaxDepth}
+	if e.maxDepth <= 0 {
+		e.maxDepth = DefaultMaxDepth
+	}
+	results, err := e.execute(ctx, root, []interface{}{nil}, op.selection, [][]interface{}{nil}, 1)
+	if err != nil {
+		return failed(err)
+	}
+	return &Response{Data: results[0], Errors: e.errors}
+}
+
+func failed(err error) *Response {
+	gerr, ok := err.(*Error)
+	if !ok {
+		gerr = &Error{Message: err.Error()}
+	}
+	if gerr.Line > 0 {
+		gerr = &Error{Message: fmt.Sprintf("line %d: %s", gerr.Line, gerr.Message)}
+	}
+	return &Response{Errors: []*Error{gerr}}
+}
+
+// operation picks the operation to run: the one named, or the only one
+func (doc *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, &Error{Message: "operationName is required when the request has several operations"}
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{Message: fmt.Sprintf("unknown operation %q", name)}
+}
+
+// coerceVariables checks the variables sent with a request against the
+// definitions of the operation, filling in defaults
+func coerceVariables(defs []*variableDef, values map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{}, len(defs))
+	for _, d := range defs {
+		v, ok := values[d.name]
+		if !ok && d.hasValue {
+			v, ok = d.fallback, true
+		}
+		if !ok || v == nil {
+			if strings.HasSuffix(d.typ, "!") {
+				return nil, &Error{Message: fmt.Sprintf("variable $%s of type %s is required", d.name, d.typ)}
+			}
+			continue
+		}
+		c, err := coerce(d.typ, v)
+		if err != nil {
+			return nil, &Error{Message: fmt.Sprintf("variable $%s: %v", d.name, err)}
+		}
+		vars[d.name] = c
+	}
+	return vars, nil
+}
+
+// coerce converts a value to a scalar or list type, accepting what JSON
+// decoding and the parser produce
+func coerce(typ string, v interface{}) (interface{}, error) {
+	typ = strings.TrimSuffix(typ, "!")
+	if v == nil {
+		return nil, nil
+	}
+	if strings.HasPrefix(typ, "[") {
+		elem := typ[1 : len(typ)-1]
+		list, ok := v.([]interface{})
+		if !ok {
+			// A single value is accepted as a list of one
+			list = []interface{}{v}
+		}
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			if item == nil && strings.HasSuffix(elem, "!") {
+				return nil, fmt.Errorf("expected %s, found null", elem)
+			}
+			c, err := coerce(elem, item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	switch typ {
+	case "ID":
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				return v.String(), nil
+			}
+		case int:
+			return strconv.Itoa(v), nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			if v == float64(int64(v)) {
+				return strconv.FormatInt(int64(v), 10), nil
+			}
+		}
+	case "String":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "Int":
+		switch v := v.(type) {
+		case int:
+			return v, nil
+		case int64:
+			if int64(int32(v)) == v {
+				return int(v), nil
+			}
+		case json.Number:
+			if n, err := v.Int64(); err == nil && int64(int32(n)) == n {
+				return int(n), nil
+			}
+		case float64:
+			if v == float64(int32(v)) {
+				return int(v), nil
+			}
+		}
+	case "Float":
+		switch v := v.(type) {
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case json.Number:
+			if f, err := v.Float64(); err == nil {
+				return f, nil
+			}
+		}
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+	return nil, fmt.Errorf("expected %s, found %v", typ, v)
+}
+
+// execution is the state of running one operation
+type execution struct {
+	doc      *document
+	vars     map[string]interface{}
+	msg      ErrorMessage
+	maxDepth int
+	errors   []*Error
+}
+
+// execute resolves a selection on sources of type obj, at paths, and
+// returns one result per source. Errors in the query are returned;
+// resolver errors null their field and are collected.
+func (e *execution) execute(ctx context.Context, obj *Object, sources []interface{},
+	sel []selection, paths [][]interface{}, depth int) ([]*result, error) {
+	if depth > e.maxDepth {
+		return nil, &Error{Message: fmt.Sprintf("selections are nested deeper than %d", e.maxDepth)}
+	}
+	fields, err := e.collect(obj, sel, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*result, len(sources))
+	for i := range results {
+		results[i] = &result{}
+	}
+
+	for _, f := range fields {
+		key := f.key()
+		if f.name == "__typename" {
+			for _, r := range results {
+				r.set(key, obj.Name)
+			}
+			continue
+		}
+		def := obj.Fields[f.name]
+		if def == nil {
+			return nil, &Error{Message: fmt.Sprintf("%s has no field %q", obj.Name, f.name), Line: f.line}
+		}
+		args, err := e.args(def, f)
+		if err != nil {
+			return nil, err
+		}
+		if def.Type == nil && f.selection != nil {
+			return nil, &Error{Message: fmt.Sprintf("%s.%s is a scalar and can't have a selection", obj.Name, f.name), Line: f.line}
+		}
+		if def.Type != nil && f.selection == nil {
+			return nil, &Error{Message: fmt.Sprintf("%s.%s needs a selection of %s fields", obj.Name, f.name, def.Type.Name), Line: f.line}
+		}
+
+		values, failed := e.resolve(ctx, def, sources, args, paths, key)
+		if def.Type == nil {
+			for i, r := range results {
+				r.set(key, values[i])
+			}
+			continue
+		}
+
+		// Gather the objects of every source, to resolve their fields
+		// together
+		var children []interface{}
+		var childPaths [][]interface{}
+		type slot struct{ list, start, n int }
+		slots := make([]slot, len(sources))
+		for i, v := range values {
+			slots[i] = slot{list: -1}
+			if failed[i] || isNil(v) {
+				continue
+			}
+			path := appendPath(paths[i], key)
+			rv := reflect.ValueOf(v)
+			if rv.Kind() == reflect.Slice {
+				slots[i] = slot{list: 1, start: len(children), n: rv.Len()}
+				for j := 0; j < rv.Len(); j++ {
+					children = append(children, rv.Index(j).Interface())
+					childPaths = append(childPaths, appendPath(path, j))
+				}
+				continue
+			}
+			slots[i] = slot{list: 0, start: len(children), n: 1}
+			children = append(children, v)
+			childPaths = append(childPaths, path)
+		}
+		childResults, err := e.execute(ctx, def.Type, children, f.selection, childPaths, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		for i, r := range results {
+			s := slots[i]
+			switch s.list {
+			case -1:
+				r.set(key, nil)
+			case 0:
+				r.set(key, childResults[s.start])
+			case 1:
+				r.set(key, childResults[s.start:s.start+s.n])
+			}
+		}
+	}
+	return results, nil
+}
+
+// resolve runs the resolver of a field for every source. Sources whose
+// resolver failed are marked in failed.
+func (e *execution) resolve(ctx context.Context, def *Field, sources []interface{}, args Args,
+	paths [][]interface{}, key string) (values []interface{}, failed []bool) {
+	failed = make([]bool, len(sources))
+	if len(sources) == 0 {
+		return nil, failed
+	}
+	if def.Batch != nil {
+		values, err := def.Batch(ctx, sources, args)
+		if err == nil && len(values) != len(sources) {
+			err = fmt.Errorf("graphql: batch returned %d values for %d sources", len(values), len(sources))
+		}
+		if err != nil {
+			e.errors = append(e.errors, &Error{Message: e.msg(ctx, err), Path: appendPath(paths[0], key)})
+			for i := range failed {
+				failed[i] = true
+			}
+			return make([]interface{}, len(sources)), failed
+		}
+		return values, failed
+	}
+	values = make([]interface{}, len(sources))
+	for i, src := range sources {
+		v, err := def.Resolve(ctx, src, args)
+		if err != nil {
+			e.errors = append(e.errors, &Error{Message: e.msg(ctx, err), Path: appendPath(paths[i], key)})
+			failed[i] = true
+			continue
+		}
+		values[i] = v
+	}
+	return values, failed
+}
+
+// collect flattens a selection into the fields to resolve, expanding
+// fragments and applying @include and @skip. Fields selected more than
+// once under the same key are merged.
+func (e *execution) collect(obj *Object, sel []selection, fields []*field, visited map[string]bool) ([]*field, error) {
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *field:
+			ok, err := e.included(s.directives)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			merged := false
+			for i, f := range fields {
+				if f.key() != s.key() {
+					continue
+				}
+				if f.name != s.name {
+					return nil, &Error{Message: fmt.Sprintf("%q selects both %s and %s", s.key(), f.name, s.name), Line: s.line}
+				}
+				copied := *f
+				copied.selection = append(append([]selection(nil), f.selection...), s.selection...)
+				fields[i], merged = &copied, true
+			}
+			if !merged {
+				fields = append(fields, s)
+			}
+		case *fragmentSpread:
+			ok, err := e.included(s.directives)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			frag := e.doc.fragments[s.name]
+			if frag == nil {
+				return nil, &Error{Message: fmt.Sprintf("unknown fragment %q", s.name)}
+			}
+			if visited[s.name] {
+				return nil, &Error{Message: fmt.Sprintf("fragment %q spreads itself", s.name)}
+			}
+			if frag.on != obj.Name {
+				return nil, &Error{Message: fmt.Sprintf("fragment %q on %s can't be spread on %s", s.name, frag.on, obj.Name)}
+			}
+			visited[s.name] = true
+			fields, err = e.collect(obj, frag.selection, fields, visited)
+			delete(visited, s.name)
+			if err != nil {
+				return nil, err
+			}
+		case *inlineFragment:
+			ok, err := e.included(s.directives)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if s.on != "" && s.on != obj.Name {
+				return nil, &Error{Message: fmt.Sprintf("fragment on %s can't be spread on %s", s.on, obj.Name)}
+			}
+			if fields, err = e.collect(obj, s.selection, fields, visited); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fields, nil
+}
+
+// included applies @include(if:) and @skip(if:)
+func (e *execution) included(directives []*directive) (bool, error) {
+	for _, d := range directives {
+		if d.name != "include" && d.name != "skip" {
+			return false, &Error{Message: fmt.Sprintf("unknown directive @%s", d.name)}
+		}
+		if len(d.args) != 1 || d.args[0].name != "if" {
+			return false, &Error{Message: fmt.Sprintf("@%s takes an if argument", d.name)}
+		}
+		v, err := e.value(d.args[0].value)
+		if err != nil {
+			return false, err
+		}
+		cond, ok := v.(bool)
+		if !ok {
+			return false, &Error{Message: fmt.Sprintf("@%s(if:) must be a Boolean", d.name)}
+		}
+		if cond == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// args coerces the arguments of a field to the declared types
+func (e *execution) args(def *Field, f *field) (Args, error) {
+	args := make(Args, len(f.args))
+	for _, a := range f.args {
+		typ, ok := def.Args[a.name]
+		if !ok {
+			return nil, &Error{Message: fmt.Sprintf("%s has no argument %q", f.name, a.name), Line: f.line}
+		}
+		v, err := e.value(a.value)
+		if err != nil {
+			return nil, err
+		}
+		c, err := coerce(typ, v)
+		if err != nil {
+			return nil, &Error{Message: fmt.Sprintf("argument %q of %s: %v", a.name, f.name, err), Line: f.line}
+		}
+		if c != nil {
+			args[a.name] = c
+		}
+	}
+	for name, typ := range def.Args {
+		if strings.HasSuffix(typ, "!") && !args.Has(name) {
+			return nil, &Error{Message: fmt.Sprintf("argument %q of %s is required", name, f.name), Line: f.line}
+		}
+	}
+	return args, nil
+}
+
+// value replaces the variables in a parsed value with their values
+func (e *execution) value(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case variable:
+		return e.vars[string(v)], nil
+	case enumValue:
+		return string(v), nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			c, err := e.value(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	case objectValue:
+		return nil, &Error{Message: "input objects are not supported"}
+	}
+	return v, nil
+}
+
+func appendPath(path []interface{}, elem interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(path)+1), path...), elem)
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// result is an object in the response; it keeps its fields in the
+// order they were selected, as GraphQL requires
+type result struct {
+	keys   []string
+	values []interface{}
+}
+
+func (r *result) set(key string, v interface{}) {
+	r.keys = append(r.keys, key)
+	r.values = append(r.values, v)
+}
+
+// MarshalJSON implements json.Marshaler
+func (r *result) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,267 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	ID      string
+	Name    string
+	Friend  *testUser
+	Tickers []string
+}
+
+// testSchema is a schema of users with friends and a batched field,
+// counting the calls to the batch
+func testSchema(batches *int) *Schema {
+	ana := &testUser{ID: "1", Name: "Ana", Tickers: []string{"AAPL"}}
+	bob := &testUser{ID: "2", Name: "Bob", Friend: ana, Tickers: []string{"KO", "MSFT"}}
+	ana.Friend = bob
+	users := []*testUser{ana, bob}
+	byID := func(id string) *testUser {
+		for _, u := range users {
+			if u.ID == id {
+				return u
+			}
+		}
+		return nil
+	}
+
+	user := &Object{Name: "User"}
+	user.Fields = map[string]*Field{
+		"id": {Resolve: func(ctx context.Context, src interface{}, args Args) (interface{}, error) {
+			return src.(*testUser).ID, nil
+		}},
+		"name": {Resolve: func(ctx context.Context, src interface{}, args Args) (interface{}, error) {
+			return src.(*testUser).Name, nil
+		}},
+		"friend": {Type: user, Resolve: func(ctx context.Context, src interface{}, args Args) (interface{}, error) {
+			return src.(*testUser).Friend, nil
+		}},
+		"tickers": {
+			Args: map[string]string{"limit": "Int"},
+			Batch: func(ctx context.Context, srcs []interface{}, args Args) ([]interface{}, error) {
+				*batches++
+				out := make([]interface{}, len(srcs))
+				for i, src := range srcs {
+					t := src.(*testUser).Tickers
+					if args.Has("limit") && args.Int("limit") < len(t) {
+						t = t[:args.Int("limit")]
+					}
+					out[i] = t
+				}
+				return out, nil
+			},
+		},
+		"secret": {Resolve: func(ctx context.Context, src interface{}, args Args) (interface{}, error) {
+			return nil, errors.New("forbidden")
+		}},
+	}
+	query := &Object{Name: "Query", Fields: map[string]*Field{
+		"user": {Type: user, Args: map[string]string{"id": "ID!"},
+			Resolve: func(ctx context.Context, src interface{}, args Args) (interface{}, error) {
+				return byID(args.String("id")), nil
+			}},
+		"users": {Type: user, Resolve: func(ctx context.Context, src interface{}, args Args) (interface{}, error) {
+			return users, nil
+		}},
+	}}
+	mutation := &Object{Name: "Mutation", Fields: map[string]*Field{
+		"rename": {Type: user, Args: map[string]string{"id": "ID!", "name": "String!"},
+			Resolve: func(ctx context.Context, src interface{}, args Args) (interface{}, error) {
+				u := byID(args.String("id"))
+				u.Name = args.String("name")
+				return u, nil
+			}},
+	}}
+	return &Schema{Query: query, Mutation: mutation, MaxDepth: 4}
+}
+
+// run executes a request on a fresh test schema and returns the response
+// as JSON
+func run(t *testing.T, req Request, allowMutations bool) string {
+	t.Helper()
+	var batches int
+	resp := testSchema(&batches).Execute(context.Background(), req, allowMutations, nil)
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("encoding the response: %v", err)
+	}
+	return string(b)
+}
+
+func TestExecute(t *testing.T) {
+	cases := []struct {
+		name string
+		req  Request
+		want string
+	}{{
+		name: "fields in selection order",
+		req:  Request{Query: `{ user(id: 1) { name id } }`},
+		want: `{"data":{"user":{"name":"Ana","id":"1"}}}`,
+	}, {
+		name: "aliases and typename",
+		req:  Request{Query: `{ a: user(id: "1") { n: name __typename } b: user(id: 2) { n: name } }`},
+		want: `{"data":{"a":{"n":"Ana","__typename":"User"},"b":{"n":"Bob"}}}`,
+	}, {
+		name: "nested objects and lists",
+		req:  Request{Query: `{ users { name friend { name tickers(limit: 1) } } }`},
+		want: `{"data":{"users":[{"name":"Ana","friend":{"name":"Bob","tickers":["KO"]}},` +
+			`{"name":"Bob","friend":{"name":"Ana","tickers":["AAPL"]}}]}}`,
+	}, {
+		name: "missing object",
+		req:  Request{Query: `{ user(id: 9) { name } }`},
+		want: `{"data":{"user":null}}`,
+	}, {
+		name: "variables and defaults",
+		req: Request{
+			Query:     `query Q($id: ID!, $limit: Int = 1) { user(id: $id) { tickers(limit: $limit) } }`,
+			Variables: map[string]interface{}{"id": json.Number("2")},
+		},
+		want: `{"data":{"user":{"tickers":["KO"]}}}`,
+	}, {
+		name: "fragments and directives",
+		req: Request{
+			Query: `query($full: Boolean!) { user(id: 1) { ...F ... on User { id @skip(if: $full) } } }
+				fragment F on User { name friend @include(if: $full) { name } }`,
+			Variables: map[string]interface{}{"full": true},
+		},
+		want: `{"data":{"user":{"name":"Ana","friend":{"name":"Bob"}}}}`,
+	}, {
+		name: "merged fields",
+		req:  Request{Query: `{ user(id: 1) { friend { name } friend { id } } }`},
+		want: `{"data":{"user":{"friend":{"name":"Bob","id":"2"}}}}`,
+	}, {
+		name: "named operation",
+		req:  Request{Query: `query A { users { id } } query B { user(id: 2) { id } }`, OperationName: "B"},
+		want: `{"data":{"user":{"id":"2"}}}`,
+	}, {
+		name: "resolver error",
+		req:  Request{Query: `{ users { name secret } }`},
+		want: `{"data":{"users":[{"name":"Ana","secret":null},{"name":"Bob","secret":null}]},` +
+			`"errors":[{"message":"forbidden","path":["users",0,"secret"]},` +
+			`{"message":"forbidden","path":["users",1,"secret"]}]}`,
+	}, {
+		name: "mutation",
+		req:  Request{Query: `mutation { rename(id: 1, name: "Ana B.") { name } }`},
+		want: `{"data":{"rename":{"name":"Ana B."}}}`,
+	}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := run(t, c.req, true); got != c.want {
+				t.Errorf("got  %s\nwant %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		vars  map[string]interface{}
+		want  string
+	}{
+		{"syntax", `{ user(id: 1) { name }`, nil, "line 1"},
+		{"unknown field", "{\n  user(id: 1) { email } }", nil, `line 2: User has no field \"email\"`},
+		{"missing argument", `{ user { name } }`, nil, `argument \"id\" of user is required`},
+		{"unknown argument", `{ user(id: 1, x: 2) { name } }`, nil, `user has no argument \"x\"`},
+		{"wrong argument type", `{ user(id: 1) { tickers(limit: "x") } }`, nil, `argument \"limit\" of tickers`},
+		{"missing variable", `query($id: ID!) { user(id: $id) { name } }`, nil, `variable $id of type ID! is required`},
+		{"scalar with selection", `{ user(id: 1) { name { x } } }`, nil, "is a scalar"},
+		{"object without selection", `{ user(id: 1) }`, nil, "needs a selection"},
+		{"too deep", `{ user(id: 1) { friend { friend { friend { name } } } } }`, nil, "nested deeper than 4"},
+		{"fragment cycle", `{ user(id: 1) { ...A } } fragment A on User { name ...A }`, nil, "spreads itself"},
+		{"nested fragment cycle", `{ user(id: 1) { ...A } } fragment A on User { friend { ...A } }`, nil, "nested deeper than 4"},
+		{"several operations", `query A { users { id } } query B { users { id } }`, nil, "operationName is required"},
+		{"unknown directive", `{ users @defer { id } }`, nil, "unknown directive @defer"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := run(t, Request{Query: c.query, Variables: c.vars}, true)
+			if !strings.HasPrefix(got, `{"data":null,"errors":[`) || !strings.Contains(got, c.want) {
+				t.Errorf("got %s, want an error containing %s", got, c.want)
+			}
+		})
+	}
+
+	// Mutations need allowMutations
+	got := run(t, Request{Query: `mutation { rename(id: 1, name: "x") { name } }`}, false)
+	if !strings.Contains(got, "mutations must be sent with POST") {
+		t.Errorf("mutation without allowMutations: %s", got)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	var batches int
+	s := testSchema(&batches)
+	resp := s.Execute(context.Background(), Request{Query: `{ users { tickers friend { tickers } } }`}, false, nil)
+	if len(resp.Errors) > 0 {
+		t.Fatalf("errors: %v", resp.Errors)
+	}
+	// One call for the users, one for their friends
+	if batches != 2 {
+		t.Errorf("the batch ran %d times, want once per depth", batches)
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	var batches int
+	hide := func(ctx context.Context, err error) string { return "internal error" }
+	resp := testSchema(&batches).Execute(context.Background(),
+		Request{Query: `{ user(id: 1) { secret } }`}, false, hide)
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != "internal error" {
+		t.Errorf("errors = %v, want the message of the schema", resp.Errors)
+	}
+}
+
+func TestCoerce(t *testing.T) {
+	cases := []struct {
+		typ  string
+		in   interface{}
+		want interface{}
+	}{
+		{"ID", "a1", "a1"},
+		{"ID", float64(7), "7"},
+		{"ID", json.Number("7"), "7"},
+		{"Int", float64(3), 3},
+		{"Int", json.Number("-3"), -3},
+		{"Float", 2, float64(2)},
+		{"Boolean", true, true},
+		{"[Int]", float64(1), []interface{}{1}},
+		{"[String!]!", []interface{}{"a", "b"}, []interface{}{"a", "b"}},
+	}
+	for _, c := range cases {
+		got, err := coerce(c.typ, c.in)
+		if err != nil {
+			t.Errorf("coerce(%s, %v): %v", c.typ, c.in, err)
+			continue
+		}
+		g, _ := json.Marshal(got)
+		w, _ := json.Marshal(c.want)
+		if string(g) != string(w) {
+			t.Errorf("coerce(%s, %v) = %s, want %s", c.typ, c.in, g, w)
+		}
+	}
+
+	for _, c := range []struct {
+		typ string
+		in  interface{}
+	}{
+		{"ID", 1.5},
+		{"Int", float64(1 << 40)},
+		{"Int", "3"},
+		{"String", 3},
+		{"Boolean", "true"},
+		{"[String!]", []interface{}{nil}},
+		{"Date", "2024-01-01"},
+	} {
+		if got, err := coerce(c.typ, c.in); err == nil {
+			t.Errorf("coerce(%s, %v) = %v, want an error", c.typ, c.in, got)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// document is a parsed request: its operations and fragments
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind      string // "query" or "mutation"
+	name      string
+	variables []*variableDef
+	selection []selection
+}
+
+type variableDef struct {
+	name     string
+	typ      string // as written, e.g. "ID!" or "[String]"
+	fallback interface{}
+	hasValue bool
+}
+
+type fragment struct {
+	name      string
+	on        string
+	selection []selection
+}
+
+// selection is a *field, a *fragmentSpread or an *inlineFragment
+type selection interface{}
+
+type field struct {
+	alias      string
+	name       string
+	args       []*argument
+	directives []*directive
+	selection  []selection
+	line       int
+}
+
+// key is the name of the field in the response
+func (f *field) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type argument struct {
+	name  string
+	value interface{}
+}
+
+type directive struct {
+	name string
+	args []*argument
+}
+
+type fragmentSpread struct {
+	name       string
+	directives []*directive
+}
+
+type inlineFragment struct {
+	on         string
+	directives []*directive
+	selection  []selection
+}
+
+// variable is a $name reference in a value
+type variable string
+
+// enumValue is an unquoted name in a value, other than true, false and
+// null
+type enumValue string
+
+// objectValue is an input object in a value; fields keep their order
+type objectValue []*argument
+
+// Token kinds
+const (
+	tokEOF = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind  int
+	value string
+	line  int
+}
+
+// lexer splits a request into tokens, skipping whitespace, commas and
+// comments
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return l.token()
+		}
+	}
+	return token{kind: tokEOF, line: l.line}, nil
+}
+
+func (l *lexer) token() (token, error) {
+	start, c := l.pos, l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$()=:@[]{}|&", c) >= 0:
+		l.pos++
+		return token{kind: tokPunct, value: string(c), line: l.line}, nil
+	case c == '.':
+		if !strings.HasPrefix(l.src[l.pos:], "...") {
+			return token{}, l.errorf("unexpected %q", ".")
+		}
+		l.pos += 3
+		return token{kind: tokPunct, value: "...", line: l.line}, nil
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokName, value: l.src[start:l.pos], line: l.line}, nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			return l.blockString()
+		}
+		return l.string()
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return token{}, l.errorf("unexpected character %q", r)
+}
+
+func (l *lexer) number() (token, error) {
+	start, kind := l.pos, tokInt
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	digits := func() int {
+		n := 0
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+			n++
+		}
+		return n
+	}
+	if digits() == 0 {
+		return token{}, l.errorf("invalid number")
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = tokFloat
+		l.pos++
+		if digits() == 0 {
+			return token{}, l.errorf("invalid number")
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = tokFloat
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if digits() == 0 {
+			return token{}, l.errorf("invalid number")
+		}
+	}
+	return token{kind: kind, value: l.src[start:l.pos], line: l.line}, nil
+}
+
+func (l *lexer) string() (token, error) {
+	var sb strings.Builder
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return token{kind: tokString, value: sb.String(), line: l.line}, nil
+		case c == '\n':
+			return token{}, l.errorf("unterminated string")
+		case c == '\\':
+			if l.pos+1 >= len(l.src) {
+				return token{}, l.errorf("unterminated string")
+			}
+			l.pos++
+			switch e := l.src[l.pos]; e {
+			case '"', '\\', '/':
+				sb.WriteByte(e)
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'u':
+				if l.pos+4 >= len(l.src) {
+					return token{}, l.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(l.src[l.pos+1:l.pos+5], 16, 32)
+				if err != nil {
+					return token{}, l.errorf("invalid unicode escape")
+				}
+				sb.WriteRune(rune(r))
+				l.pos += 4
+			default:
+				return token{}, l.errorf("invalid escape \\%c", e)
+			}
+			l.pos++
+		default:
+			sb.WriteByte(c)
+			l.pos++
+		}
+	}
+	return token{}, l.errorf("unterminated string")
+}
+
+// blockString reads a """block string""". Its common indentation and
+// leading and trailing blank lines are removed.
+func (l *lexer) blockString() (token, error) {
+	l.pos += 3
+	end := strings.Index(l.src[l.pos:], `"""`)
+	for end > 0 && l.src[l.pos+end-1] == '\\' {
+		next := strings.Index(l.src[l.pos+end+3:], `"""`)
+		if next < 0 {
+			end = -1
+			break
+		}
+		end += 3 + next
+	}
+	if end < 0 {
+		return token{}, l.errorf("unterminated block string")
+	}
+	raw := strings.ReplaceAll(l.src[l.pos:l.pos+end], `\"""`, `"""`)
+	l.line += strings.Count(raw, "\n")
+	l.pos += end + 3
+
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return token{kind: tokString, value: strings.Join(lines, "\n"), line: l.line}, nil
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &Error{Message: "syntax error: " + fmt.Sprintf(format, args...), Line: l.line}
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parser builds a document from the tokens of a request
+type parser struct {
+	lex lexer
+	tok token
+	err error
+}
+
+// parse parses a request into a document
+func parse(src string) (*document, error) {
+	p := &parser{lex: lexer{src: strings.TrimPrefix(src, "\ufeff"), line: 1}}
+	p.advance()
+	doc := &document{fragments: make(map[string]*fragment)}
+	for p.err == nil && p.tok.kind != tokEOF {
+		switch {
+		case p.is(tokPunct, "{"):
+			doc.operations = append(doc.operations, &operation{kind: "query", selection: p.selectionSet()})
+		case p.is(tokName, "query"), p.is(tokName, "mutation"), p.is(tokName, "subscription"):
+			doc.operations = append(doc.operations, p.operation())
+		case p.is(tokName, "fragment"):
+			f := p.fragment()
+			if p.err == nil && doc.fragments[f.name] != nil {
+				return nil, &Error{Message: fmt.Sprintf("fragment %q is defined twice", f.name)}
+			}
+			doc.fragments[f.name] = f
+		default:
+			p.unexpected()
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if len(doc.operations) == 0 {
+		return nil, &Error{Message: "the request has no operation"}
+	}
+	return doc, nil
+}
+
+func (p *parser) advance() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *parser) is(kind int, value string) bool {
+	return p.err == nil && p.tok.kind == kind && p.tok.value == value
+}
+
+// skip advances past a punctuator if it is next, and reports whether it
+// was
+func (p *parser) skip(value string) bool {
+	if p.is(tokPunct, value) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(value string) {
+	if !p.skip(value) {
+		p.unexpected()
+	}
+}
+
+func (p *parser) name() string {
+	if p.err != nil {
+		return ""
+	}
+	if p.tok.kind != tokName {
+		p.unexpected()
+		return ""
+	}
+	name := p.tok.value
+	p.advance()
+	return name
+}
+
+func (p *parser) unexpected() {
+	if p.err != nil {
+		return
+	}
+	what := fmt.Sprintf("%q", p.tok.value)
+	if p.tok.kind == tokEOF {
+		what = "end of request"
+	}
+	p.err = &Error{Message: "syntax error: unexpected " + what, Line: p.tok.line}
+}
+
+func (p *parser) operation() *operation {
+	op := &operation{kind: p.name()}
+	if p.tok.kind == tokName {
+		op.name = p.name()
+	}
+	if p.skip("(") {
+		for p.err == nil && !p.skip(")") {
+			op.variables = append(op.variables, p.variableDef())
+		}
+	}
+	if len(p.directives()) > 0 && p.err == nil {
+		p.err = &Error{Message: "directives on operations are not supported", Line: p.tok.line}
+	}
+	op.selection = p.selectionSet()
+	return op
+}
+
+func (p *parser) variableDef() *variableDef {
+	p.expect("$")
+	v := &variableDef{name: p.name()}
+	p.expect(":")
+	v.typ = p.typeRef()
+	if p.skip("=") {
+		v.fallback, v.hasValue = p.value(true), true
+	}
+	return v
+}
+
+// typeRef reads a type such as ID!, [String] or [Int!]!
+func (p *parser) typeRef() string {
+	var t string
+	if p.skip("[") {
+		t = "[" + p.typeRef() + "]"
+		p.expect("]")
+	} else {
+		t = p.name()
+	}
+	if p.skip("!") {
+		t += "!"
+	}
+	return t
+}
+
+func (p *parser) fragment() *fragment {
+	p.name() // fragment
+	f := &fragment{name: p.name()}
+	if p.name() != "on" && p.err == nil {
+		p.err = &Error{Message: "syntax error: expected \"on\"", Line: p.tok.line}
+	}
+	f.on = p.name()
+	if len(p.directives()) > 0 && p.err == nil {
+		p.err = &Error{Message: "directives on fragments are not supported", Line: p.tok.line}
+	}
+	f.selection = p.selectionSet()
+	return f
+}
+
+func (p *parser) selectionSet() []selection {
+	p.expect("{")
+	var sel []selection
+	for p.err == nil && !p.skip("}") {
+		if p.skip("...") {
+			if p.tok.kind == tokName && p.tok.value != "on" {
+				sel = append(sel, &fragmentSpread{name: p.name(), directives: p.directives()})
+				continue
+			}
+			in := &inlineFragment{}
+			if p.is(tokName, "on") {
+				p.advance()
+				in.on = p.name()
+			}
+			in.directives = p.directives()
+			in.selection = p.selectionSet()
+			sel = append(sel, in)
+			continue
+		}
+		sel = append(sel, p.field())
+	}
+	if len(sel) == 0 && p.err == nil {
+		p.err = &Error{Message: "syntax error: empty selection", Line: p.tok.line}
+	}
+	return sel
+}
+
+func (p *parser) field() *field {
+	f := &field{line: p.tok.line, name: p.name()}
+	if p.skip(":") {
+		f.alias, f.name = f.name, p.name()
+	}
+	f.args = p.arguments(false)
+	f.directives = p.directives()
+	if p.is(tokPunct, "{") {
+		f.selection = p.selectionSet()
+	}
+	return f
+}
+
+func (p *parser) arguments(constant bool) []*argument {
+	var args []*argument
+	if !p.skip("(") {
+		return nil
+	}
+	for p.err == nil && !p.skip(")") {
+		a := &argument{name: p.name()}
+		p.expect(":")
+		a.value = p.value(constant)
+		args = append(args, a)
+	}
+	return args
+}
+
+func (p *parser) directives() []*directive {
+	var ds []*directive
+	for p.skip("@") {
+		ds = append(ds, &directive{name: p.name(), args: p.arguments(false)})
+	}
+	return ds
+}
+
+// value reads an argument value. Constant values, such as variable
+// defaults, can't refer to variables.
+func (p *parser) value(constant bool) interface{} {
+	if p.err != nil {
+		return nil
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokPunct:
+		switch tok.value {
+		case "$":
+			if constant {
+				p.unexpected()
+				return nil
+			}
+			p.advance()
+			return variable(p.name())
+		case "[":
+			p.advance()
+			list := []interface{}{}
+			for p.err == nil && !p.skip("]") {
+				list = append(list, p.value(constant))
+			}
+			return list
+		case "{":
+			p.advance()
+			obj := objectValue{}
+			for p.err == nil && !p.skip("}") {
+				a := &argument{name: p.name()}
+				p.expect(":")
+				a.value = p.value(constant)
+				obj = append(obj, a)
+			}
+			return obj
+		}
+	case tokInt:
+		p.advance()
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			p.err = &Error{Message: "integer out of range: " + tok.value, Line: tok.line}
+		}
+		return n
+	case tokFloat:
+		p.advance()
+		f, _ := strconv.ParseFloat(tok.value, 64)
+		return f
+	case tokString:
+		p.advance()
+		return tok.value
+	case tokName:
+		p.advance()
+		switch tok.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return enumValue(tok.value)
+	}
+	p.unexpected()
+	return nil
+}
@@ -7,25 +7,33 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
-// HMAC is a wrapper around the hash.Hash interface
+// HMAC hashes strings with HMAC-SHA256 under a secret key. It is safe
+// for concurrent use: every call hashes with its own hash.Hash, so
+// requests hashing remember tokens in parallel don't share state.
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 // NewHMAC creates and returns an HMAC object from a secret key 
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC {
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+// DeriveKey returns a 32 byte key for a given purpose (e.g. "csrf"), derived
+// from a secret key, so that subsystems never share the same key material
+func DeriveKey(secret, purpose string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
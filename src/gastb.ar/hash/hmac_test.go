@@ -0,0 +1,39 @@
+package hash
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestHMACConcurrent(t *testing.T) {
+	h := NewHMAC("secret")
+	inputs := make([]string, 64)
+	want := make([]string, len(inputs))
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("remember-token-%d", i)
+		want[i] = NewHMAC("secret").Hash(inputs[i])
+	}
+
+	// Run with -race: the requests of a site hash in parallel
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				for i, in := range inputs {
+					if got := h.Hash(in); got != want[i] {
+						t.Errorf("Hash(%q) = %s, want %s", in, got, want[i])
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if NewHMAC("other").Hash(inputs[0]) == want[0] {
+		t.Error("hashes under different keys are equal")
+	}
+}
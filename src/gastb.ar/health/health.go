@@ -0,0 +1,140 @@
+package health
+
+// The health package serves liveness and readiness probes for load
+// balancers and Kubernetes. Subsystems register readiness checks for the
+// dependencies they need, such as the database.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency is usable, returning nil if it is.
+type Check func(ctx context.Context) error
+
+// Default time a single readiness check may take
+const DefaultTimeout = 2 * time.Second
+
+// Checker holds the registered readiness checks.
+type Checker struct {
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	names  []string
+	checks map[string]Check
+}
+
+// NewChecker creates a Checker with no checks registered
+func NewChecker() *Checker {
+	return &Checker{
+		Timeout: DefaultTimeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Register adds a named readiness check, replacing any check with
+// the same name
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Result is the outcome of a single check
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the body of the readiness response
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Statuses used in results and reports
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Run executes every registered check concurrently and returns a report
+// with the result of each one
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	names := append([]string(nil), c.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.Unlock()
+
+	results := make([]Result, len(names))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.run(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result)}
+	for i, name := range names {
+		report.Checks[name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	res := Result{Status: StatusOK, Duration: time.Since(start).String()}
+	if err != nil {
+		res.Status = StatusUnavailable
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Healthz handles GET /healthz. It only reports that the process is alive
+// and serving requests.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+// Readyz handles GET /readyz. It responds 200 OK if every check passes
+// and 503 Service Unavailable otherwise, with the result of each check.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
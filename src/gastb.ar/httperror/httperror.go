@@ -0,0 +1,119 @@
+package httperror
+
+// The httperror package renders error responses in the format each client
+// expects: RFC 7807 problem details for API clients, and an HTML error
+// page for browsers, so that API clients never have to parse HTML.
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gastb.ar/context"
+	"gastb.ar/views"
+)
+
+// ContentType is the media type of problem details
+const ContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail explains this occurrence of the problem to the client, so
+	// it must not leak internals
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Data and Error keep errors readable by clients written against
+	// the {"data", "error"} envelope of the v1 API
+	Data  *struct{}     `json:"data"`
+	Error envelopeError `json:"error"`
+}
+
+type envelopeError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// New creates the problem for a status code, with an optional detail
+func New(status int, detail string) *Problem {
+	msg := detail
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Error:  envelopeError{Status: status, Message: msg},
+	}
+}
+
+// page is the view HTML errors are rendered with
+var page *views.View
+
+// SetPage sets the view HTML errors are rendered with. It is executed
+// with the *Problem as data. Until it is set, browsers get plain text.
+func SetPage(v *views.View) {
+	page = v
+}
+
+// WantsJSON reports whether a request was made by an API client rather
+// than a browser
+func WantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/graphql" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return !strings.Contains(accept, "text/html") &&
+		(strings.Contains(accept, "application/json") ||
+			strings.Contains(accept, ContentType))
+}
+
+// Render writes an error response in the format the client of r expects.
+// detail is shown to the client and may be empty.
+func Render(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	p := New(status, detail)
+	p.Instance = r.URL.Path
+	p.RequestID = context.RequestID(r.Context())
+	if WantsJSON(r) {
+		Write(w, p)
+		return
+	}
+	if page == nil {
+		msg := detail
+		if msg == "" {
+			msg = p.Title
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := page.Render(w, r, p); err != nil {
+		slog.ErrorContext(r.Context(), "rendering error page", "error", err)
+	}
+}
+
+// Write writes a problem as JSON
+func Write(w http.ResponseWriter, p *Problem) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// NotFound is an http.HandlerFunc answering 404 Not Found
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Render(w, r, http.StatusNotFound, "")
+}
+
+// MethodNotAllowed is an http.HandlerFunc answering 405 Method Not Allowed
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Render(w, r, http.StatusMethodNotAllowed, "")
+}
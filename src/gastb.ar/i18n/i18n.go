@@ -0,0 +1,131 @@
+package i18n
+
+// The i18n package translates the user interface. Messages are looked up
+// by their English text in the JSON catalogs embedded from locales/, one
+// per language (e.g. locales/es.json), so English needs no catalog and a
+// message missing from a catalog is shown in English.
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default is the language used when no other one is supported
+const Default = "en"
+
+// nameKey is the catalog entry holding the name of the language, in that
+// language
+const nameKey = "_language"
+
+//go:embed locales/*.json
+var files embed.FS
+
+// catalogs maps language codes to translations of English messages
+var catalogs = map[string]map[string]string{
+	Default: {nameKey: "English"},
+}
+
+func init() {
+	entries, err := files.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range entries {
+		b, err := files.ReadFile("locales/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(b, &catalog); err != nil {
+			panic(fmt.Sprintf("i18n: %s: %v", e.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(e.Name(), path.Ext(e.Name()))] = catalog
+	}
+}
+
+// T translates a message into a language. With args, the translation is
+// used as a fmt format string, e.g. T("es", "Hello, %s!", name).
+func T(lang, msg string, args ...interface{}) string {
+	if tr, ok := catalogs[lang][msg]; ok {
+		msg = tr
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Supported reports whether there is a catalog for a language
+func Supported(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// Languages returns the codes of the supported languages, sorted
+func Languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Name returns the name of a language in that language, e.g. "Español"
+func Name(lang string) string {
+	if name, ok := catalogs[lang][nameKey]; ok {
+		return name
+	}
+	return lang
+}
+
+// Negotiate picks the language of a response: the one in the user's
+// profile if supported, else the best supported one of an Accept-Language
+// header, else Default. Regional variants match their base language, so
+// "es-AR" is served in "es".
+func Negotiate(preferred, acceptLanguage string) string {
+	if Supported(preferred) {
+		return preferred
+	}
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].q > choices[j].q
+	})
+	for _, c := range choices {
+		if Supported(c.lang) {
+			return c.lang
+		}
+		if base, _, ok := strings.Cut(c.lang, "-"); ok && Supported(base) {
+			return base
+		}
+	}
+	return Default
+}
@@ -0,0 +1,93 @@
+package images
+
+// The images package validates uploaded images and scales them down,
+// e.g. to turn any photo into a small avatar.
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"golang.org/x/image/draw"
+)
+
+// Errors returned for images that can not be accepted
+var (
+	ErrTooLarge    = errors.New("images: file is too large")
+	ErrUnsupported = errors.New("images: only JPEG, PNG and GIF images are supported")
+	// ErrDimensions is returned for images with so many pixels that
+	// decoding them would use too much memory
+	ErrDimensions = errors.New("images: image dimensions are too large")
+)
+
+// Maximum number of pixels of an image that is decoded
+const maxPixels = 40 << 20
+
+// Supported content types, by the format names of the image package
+var contentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+// Read reads at most maxSize bytes of an image and checks that it is a
+// JPEG, PNG or GIF of reasonable dimensions. It returns the bytes and
+// the content type.
+func Read(r io.Reader, maxSize int64) ([]byte, string, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(b)) > maxSize {
+		return nil, "", ErrTooLarge
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", ErrUnsupported
+	}
+	contentType, ok := contentTypes[format]
+	if !ok || http.DetectContentType(b) != contentType {
+		return nil, "", ErrUnsupported
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, "", ErrDimensions
+	}
+	return b, contentType, nil
+}
+
+// Thumbnail scales an image read with Read to fit in a size x size square,
+// cropping it to a square first, and encodes it as JPEG, or as PNG if
+// it may have transparency. It returns the encoded image and its content
+// type.
+func Thumbnail(b []byte, size int) ([]byte, string, error) {
+	src, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", ErrUnsupported
+	}
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(
+		bounds.Min.X+(bounds.Dx()-side)/2,
+		bounds.Min.Y+(bounds.Dy()-side)/2))
+	if side < size {
+		size = side
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), "image/png", err
+}
@@ -0,0 +1,8 @@
+package integration
+
+// The integration package checks the gorm layer and the user pages
+// against throwaway Postgres containers started with dockertest. Its
+// tests only build with the integration tag, since they need a Docker
+// daemon:
+//
+//	go test -tags integration ./integration
@@ -0,0 +1,137 @@
+//go:build integration
+
+package integration
+
+import (
+	"testing"
+
+	"gastb.ar/models"
+	"gastb.ar/models/modelstest"
+)
+
+// TestGorm checks the gorm layer against a fresh Postgres container: the
+// modelstest contracts, plus what only a real database does, such as
+// unique indexes, soft deletes and transactions.
+func TestGorm(t *testing.T) {
+	db := NewDB(t)
+
+	t.Run("UserDB", func(t *testing.T) {
+		modelstest.TestUserDB(t, func() models.UserDB {
+			db.Reset(t)
+			return models.NewUserDB(db.Gorm)
+		})
+	})
+
+	t.Run("StocklistDB", func(t *testing.T) {
+		modelstest.TestStocklistDB(t, func() models.StocklistDB {
+			db.Reset(t)
+			return models.NewStocklistDB(db.Gorm)
+		})
+	})
+
+	t.Run("SessionDB", func(t *testing.T) {
+		modelstest.TestSessionDB(t, func() models.SessionDB {
+			db.Reset(t)
+			return models.NewSessionDB(db.Gorm)
+		})
+	})
+
+	t.Run("UniqueEmail", func(t *testing.T) {
+		db.Reset(t)
+		if err := db.UserService.Create(newUser("ana@example.com")); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		err := db.UserService.Create(newUser("ANA@example.com"))
+		if err != models.ErrEmailTaken {
+			t.Errorf("Create with a taken email returned %v, want ErrEmailTaken", err)
+		}
+		// Skipping validation, the unique index must still refuse it
+		dup := newUser("ana@example.com")
+		dup.PasswordHash = "hash"
+		dup.TokenHash = "other-token-hash"
+		if err := models.NewUserDB(db.Gorm).Create(dup); err == nil {
+			t.Error("the database accepted a duplicate email")
+		}
+	})
+
+	t.Run("SoftDelete", func(t *testing.T) {
+		db.Reset(t)
+		user := newUser("ana@example.com")
+		if err := db.UserService.Create(user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := models.NewUserDB(db.Gorm).Delete(user.ID); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := db.UserService.ByID(user.ID); err != models.ErrNotFound {
+			t.Errorf("ByID after Delete returned %v, want ErrNotFound", err)
+		}
+		var deleted models.User
+		if err := db.Gorm.Unscoped().First(&deleted, user.ID).Error; err != nil {
+			t.Fatalf("the deleted row is gone: %v", err)
+		}
+		if deleted.DeletedAt == nil {
+			t.Error("the deleted row has no DeletedAt")
+		}
+	})
+
+	t.Run("DeletedEmail", func(t *testing.T) {
+		db.Reset(t)
+		user := newUser("ana@example.com")
+		if err := db.UserService.Create(user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := models.NewUserDB(db.Gorm).Delete(user.ID); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		// A deleted account's address can sign up again
+		if err := db.UserService.Create(newUser("ana@example.com")); err != nil {
+			t.Errorf("Create with a deleted user's email: %v", err)
+		}
+	})
+
+	t.Run("Transactions", func(t *testing.T) {
+		db.Reset(t)
+		users := models.NewUserDB(db.Gorm)
+
+		tx := db.Gorm.Begin()
+		rolledBack := newUser("rolled@example.com")
+		rolledBack.PasswordHash = "hash"
+		rolledBack.TokenHash = "rolled-back"
+		if err := models.NewUserDB(tx).Create(rolledBack); err != nil {
+			t.Fatalf("Create in transaction: %v", err)
+		}
+		if err := tx.Rollback().Error; err != nil {
+			t.Fatalf("Rollback: %v", err)
+		}
+		if _, err := users.ByEmail(rolledBack.Email); err != models.ErrNotFound {
+			t.Errorf("ByEmail after Rollback returned %v, want ErrNotFound", err)
+		}
+
+		tx = db.Gorm.Begin()
+		committed := newUser("committed@example.com")
+		committed.PasswordHash = "hash"
+		committed.TokenHash = "committed"
+		if err := models.NewUserDB(tx).Create(committed); err != nil {
+			t.Fatalf("Create in transaction: %v", err)
+		}
+		if _, err := users.ByEmail(committed.Email); err != models.ErrNotFound {
+			t.Errorf("uncommitted user visible outside the transaction: %v", err)
+		}
+		if err := tx.Commit().Error; err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		if _, err := users.ByEmail(committed.Email); err != nil {
+			t.Errorf("ByEmail after Commit: %v", err)
+		}
+	})
+}
+
+// newUser returns a user that passes validation
+func newUser(email string) *models.User {
+	return &models.User{
+		Name:     "Ana",
+		Email:    email,
+		Password: "correct horse battery",
+	}
+}
@@ -0,0 +1,101 @@
+//go:build integration
+
+package integration
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/controllers"
+	"gastb.ar/cookies"
+	"gastb.ar/hash"
+	"gastb.ar/jobs"
+	"gastb.ar/middleware"
+	"gastb.ar/testutil"
+	"gastb.ar/webhooks"
+)
+
+// testHMACKey derives the cookie and CSRF keys of the test server
+const testHMACKey = "integration-hmac-key"
+
+// TestUserHandlers signs up, logs in and out through the HTML forms of a
+// server wired like the web server, with CSRF protection and the user
+// middleware, against a fresh Postgres container.
+func TestUserHandlers(t *testing.T) {
+	// Templates are parsed from views/, so the server runs from the module
+	// root, like the web server
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	db := NewDB(t)
+	c := testutil.NewClient(t, newUserServer(db))
+
+	c.Signup("Ana", "ana@example.com", "correct horse")
+	c.Login("ana@example.com", "correct horse")
+	c.Get("/profile").Status(http.StatusOK).Contains("ana@example.com")
+
+	// A form posted with the token of the latest page passes the CSRF
+	// check, and one without it doesn't
+	c.PostForm("/profile/locale", url.Values{"locale": {"es"}}).Redirects("/profile")
+	user, err := db.UserService.ByEmail("ana@example.com")
+	if err != nil {
+		t.Fatalf("ByEmail: %v", err)
+	}
+	if user.Locale != "es" {
+		t.Errorf("locale is %q after the form, want %q", user.Locale, "es")
+	}
+	req, err := http.NewRequest(http.MethodPost, "/profile/locale",
+		strings.NewReader(url.Values{"locale": {"en"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.Do(req).Status(http.StatusForbidden)
+
+	c.PostForm("/logout", nil).Redirects("/")
+	c.Get("/profile").Redirects("/login")
+}
+
+// newUserServer routes the signup, login and profile pages of the web
+// server, wrapped in the same CSRF and user middleware
+func newUserServer(db *DB) http.Handler {
+	rememberCookie := cookies.NewRemember(cookies.Config{}, hash.DeriveKey(testHMACKey, "remember"))
+	deviceCookie := cookies.NewDevice(cookies.Config{}, hash.DeriveKey(testHMACKey, "device"))
+	queue := jobs.New(db.JobService, slog.Default())
+	hooks := webhooks.NewDispatcher(db.WebhookService, db.NotificationSettingService, queue)
+	userC := controllers.NewUserController(db.UserService, db.InviteService,
+		db.NotificationSettingService, db.ProfileService, rememberCookie, deviceCookie,
+		hooks, false)
+	userMw := middleware.User{
+		UserService: db.UserService,
+		Remember:    rememberCookie,
+	}
+	requireUserMw := middleware.RequireUser{
+		User: userMw,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/signup", userC.New).Methods("GET")
+	router.HandleFunc("/signup", userC.Signup).Methods("POST")
+	router.Handle("/login", userC.LoginView).Methods("GET")
+	router.HandleFunc("/login", userC.Login).Methods("POST")
+	router.HandleFunc("/logout", userC.Logout).Methods("POST")
+	router.HandleFunc("/profile", requireUserMw.ApplyFn(userC.Profile)).Methods("GET")
+	router.HandleFunc("/profile/locale",
+		requireUserMw.ApplyFn(userC.SetLocale)).Methods("POST")
+
+	csrfMw := middleware.CSRF{Key: hash.DeriveKey(testHMACKey, "csrf")}
+	return csrfMw.Apply(userMw.Apply(router))
+}
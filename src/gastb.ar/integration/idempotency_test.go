@@ -0,0 +1,80 @@
+//go:build integration
+
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gastb.ar/context"
+	"gastb.ar/middleware"
+	"gastb.ar/models"
+)
+
+// TestIdempotency retries requests with the same Idempotency-Key through
+// the middleware, against the keys stored in Postgres
+func TestIdempotency(t *testing.T) {
+	db := NewDB(t)
+	ana, bob := newUser("ana@example.com"), newUser("bob@example.com")
+	for _, u := range []*models.User{ana, bob} {
+		if err := db.UserService.Create(u); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	calls, status := 0, http.StatusCreated
+	h := (&middleware.Idempotency{IdempotencyKeyService: db.IdempotencyKeyService}).ApplyFn(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"call":%d}`, calls)
+		})
+	// do posts body with key as user
+	do := func(user *models.User, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/stocklists", strings.NewReader(body))
+		r.Header.Set(middleware.IdempotencyKeyHeader, key)
+		r = r.WithContext(context.WithUser(r.Context(), user))
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		return rec
+	}
+
+	cases := []struct {
+		name     string
+		user     *models.User
+		key      string
+		body     string
+		status   int
+		replayed bool
+		calls    int
+	}{
+		{"first attempt", ana, "k1", `{"name":"Tech"}`, http.StatusCreated, false, 1},
+		{"retry", ana, "k1", `{"name":"Tech"}`, http.StatusCreated, true, 1},
+		{"retry with a different body", ana, "k1", `{"name":"Energy"}`, http.StatusUnprocessableEntity, false, 1},
+		{"retry with a longer body", ana, "k1", `{"name":"Tech"} `, http.StatusUnprocessableEntity, false, 1},
+		{"same key of another user", bob, "k1", `{"name":"Energy"}`, http.StatusCreated, false, 2},
+		{"another key", ana, "k2", `{"name":"Energy"}`, http.StatusCreated, false, 3},
+	}
+	for _, c := range cases {
+		rec := do(c.user, c.key, c.body)
+		replayed := rec.Header().Get(middleware.IdempotentReplayedHeader) == "true"
+		if rec.Code != c.status || replayed != c.replayed || calls != c.calls {
+			t.Errorf("%s: status %d, replayed %v, %d calls, want %d, %v, %d",
+				c.name, rec.Code, replayed, calls, c.status, c.replayed, c.calls)
+		}
+	}
+	if got := do(ana, "k1", `{"name":"Tech"}`).Body.String(); got != `{"call":1}` {
+		t.Errorf("replayed body = %s, want the first response", got)
+	}
+
+	// Server errors aren't stored, so the request can be retried
+	status = http.StatusInternalServerError
+	do(ana, "k3", `{}`)
+	status = http.StatusCreated
+	if rec := do(ana, "k3", `{}`); rec.Code != http.StatusCreated || calls != 5 {
+		t.Errorf("retry after a server error: status %d, %d calls, want 201 and 5", rec.Code, calls)
+	}
+}
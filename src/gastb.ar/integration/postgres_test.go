@@ -0,0 +1,115 @@
+//go:build integration
+
+package integration
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"gastb.ar/models"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// Image and tag of the Postgres containers
+const (
+	PostgresImage = "postgres"
+	PostgresTag   = "16-alpine"
+)
+
+// Seconds after which Docker removes a container even if the test
+// process died without purging it
+const containerTTL = 600
+
+// Postgres starts a Postgres container for the test and returns its
+// connection info, in the format of PostgresConfig.ConnectionInfo. The
+// container is removed when the test finishes.
+func Postgres(t testing.TB) string {
+	t.Helper()
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Fatalf("integration: connecting to Docker: %v", err)
+	}
+	pool.MaxWait = 2 * time.Minute
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: PostgresImage,
+		Tag:        PostgresTag,
+		Env: []string{
+			"POSTGRES_USER=gastb",
+			"POSTGRES_PASSWORD=gastb",
+			"POSTGRES_DB=gastb_test",
+		},
+	}, func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		t.Fatalf("integration: starting Postgres: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := pool.Purge(resource); err != nil {
+			t.Logf("integration: removing Postgres container: %v", err)
+		}
+	})
+	resource.Expire(containerTTL)
+
+	host, port, err := net.SplitHostPort(resource.GetHostPort("5432/tcp"))
+	if err != nil {
+		t.Fatalf("integration: Postgres address: %v", err)
+	}
+	conn := fmt.Sprintf("host=%s port=%s user=gastb password=gastb dbname=gastb_test sslmode=disable",
+		host, port)
+	err = pool.Retry(func() error {
+		db, err := gorm.Open("postgres", conn)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.DB().Ping()
+	})
+	if err != nil {
+		t.Fatalf("integration: waiting for Postgres: %v", err)
+	}
+	return conn
+}
+
+// DB is a migrated database in its own container, with both the services
+// and a raw gorm connection to it
+type DB struct {
+	*models.Services
+	Gorm *gorm.DB
+}
+
+// NewDB starts a Postgres container for the test and migrates it
+func NewDB(t testing.TB) *DB {
+	t.Helper()
+	conn := Postgres(t)
+	services, err := models.NewServices(conn, "integration-hmac-key")
+	if err != nil {
+		t.Fatalf("integration: %v", err)
+	}
+	t.Cleanup(func() { services.Close() })
+	if err := services.AutoMigrate(); err != nil {
+		t.Fatalf("integration: migrating: %v", err)
+	}
+	db, err := gorm.Open("postgres", conn)
+	if err != nil {
+		t.Fatalf("integration: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &DB{Services: services, Gorm: db}
+}
+
+// Reset drops and recreates every table
+func (db *DB) Reset(t testing.TB) {
+	t.Helper()
+	if err := db.DestructiveReset(); err != nil {
+		t.Fatalf("integration: resetting: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+//go:build integration
+
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+
+	"gastb.ar/context"
+	"gastb.ar/controllers"
+	"gastb.ar/models"
+)
+
+// TestRowLevelSecurity checks that with row level security on, the
+// controllers only reach the stocklists of the user they serve, on a
+// connection the policies apply to: as a role that isn't a superuser,
+// without the bypass.
+func TestRowLevelSecurity(t *testing.T) {
+	admin := Postgres(t)
+	raw, err := gorm.Open("postgres", admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+	if err := raw.Exec("CREATE ROLE gastb_app LOGIN PASSWORD 'gastb_app'").Error; err != nil {
+		t.Fatal(err)
+	}
+	site := strings.Replace(admin, "user=gastb password=gastb", "user=gastb_app password=gastb_app", 1)
+	services, err := models.NewServices(site, "integration-hmac-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { services.Close() })
+	services.SetRowLevelSecurity(true)
+	if err := services.SetAdminConnection(admin + " app.bypass_rls=on"); err != nil {
+		t.Fatal(err)
+	}
+	if err := services.AutoMigrate(); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	for _, grant := range []string{
+		"GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO gastb_app",
+		"GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO gastb_app",
+	} {
+		if err := raw.Exec(grant).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ana, bob := newUser("ana@example.com"), newUser("bob@example.com")
+	for _, u := range []*models.User{ana, bob} {
+		if err := services.UserService.Create(u); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	org := &models.Organization{Name: "Bob Inc"}
+	if err := services.OrganizationService.Create(org, bob.ID); err != nil {
+		t.Fatalf("creating the organization: %v", err)
+	}
+	anas := &models.Stocklist{UserID: ana.ID, Name: "Ana secret"}
+	bobs := &models.Stocklist{UserID: bob.ID, Name: "Bob secret"}
+	team := &models.Stocklist{UserID: bob.ID, OrganizationID: &org.ID, Name: "Bob team secret"}
+	public := &models.Stocklist{UserID: bob.ID, Name: "Bob public", Public: true}
+	for _, s := range []*models.Stocklist{anas, bobs, team, public} {
+		if err := services.StocklistService.AsTenant(s.UserID).Create(s); err != nil {
+			t.Fatalf("creating %s: %v", s.Name, err)
+		}
+	}
+	attachment := &models.Attachment{StocklistID: bobs.ID, Key: "attachments/bob",
+		Name: "bob.pdf", ContentType: "application/pdf"}
+	if err := services.AttachmentService.Create(attachment); err != nil {
+		t.Fatalf("creating the attachment: %v", err)
+	}
+	guest, err := services.GuestService.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.GuestService.AddStocklist(&models.GuestStocklist{GuestID: guest.ID, Name: "Ana guest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Services", func(t *testing.T) {
+		// Without a tenant, only public stocklists are visible
+		lists, err := services.StocklistService.ByUserID(bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lists) != 1 || lists[0].ID != public.ID {
+			t.Errorf("ByUserID without a tenant returned %v, want only the public stocklist", lists)
+		}
+		asAna := services.StocklistService.AsTenant(ana.ID)
+		for _, s := range []*models.Stocklist{bobs, team} {
+			if _, err := asAna.ByID(s.ID); err != models.ErrNotFound {
+				t.Errorf("ByID(%s) as Ana returned %v, want ErrNotFound", s.Name, err)
+			}
+		}
+		if lists, err := asAna.ByOrganizationID(org.ID); err != nil || len(lists) != 0 {
+			t.Errorf("ByOrganizationID as Ana returned %v, %v, want none", lists, err)
+		}
+		// Writes outside a tenant reach nothing
+		services.StocklistService.Delete(bobs.ID)
+		if _, err := services.StocklistService.AsTenant(bob.ID).ByID(bobs.ID); err != nil {
+			t.Errorf("Bob's stocklist after a Delete without a tenant: %v", err)
+		}
+		// The admin connection sees every stocklist
+		st, err := services.Stats()
+		if err != nil || st.Stocklists != 4 {
+			t.Errorf("Stats counted %d stocklists, %v, want 4", st.Stocklists, err)
+		}
+	})
+
+	apiC := controllers.NewAPIController(services.UserService, services.StocklistService,
+		services.APIKeyService, nil)
+	orgsC := controllers.NewOrganizationsController(services.OrganizationService,
+		services.StocklistService)
+	uploadsC := controllers.NewUploadsController(services.UserService, services.StocklistService,
+		services.AttachmentService, nil)
+	searchC := controllers.NewSearchController(services.SearchService)
+	router := mux.NewRouter()
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/search", searchC.Search).Methods("GET")
+	api.HandleFunc("/users/me/guest", apiC.ClaimGuest).Methods("POST")
+	api.HandleFunc("/stocklists", apiC.Stocklists).Methods("GET")
+	api.HandleFunc("/stocklists/export.csv", apiC.ExportStocklists).Methods("GET")
+	api.HandleFunc("/stocklists/{id:[0-9]+}", apiC.Stocklist).Methods("GET")
+	api.HandleFunc("/stocklists/{id:[0-9]+}/attachments", uploadsC.Attachments).Methods("GET")
+	api.HandleFunc("/orgs/{id:[0-9]+}/stocklists", orgsC.Stocklists).Methods("GET")
+
+	// do runs a request through the router as Ana
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r = r.WithContext(context.WithUser(r.Context(), ana))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		return rec
+	}
+	// names returns the names in a JSON list of stocklists
+	names := func(t *testing.T, rec *httptest.ResponseRecorder) []string {
+		t.Helper()
+		var resp struct {
+			Data []struct {
+				Name  string `json:"name"`
+				Title string `json:"title"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding %s: %v", rec.Body, err)
+		}
+		var names []string
+		for _, d := range resp.Data {
+			names = append(names, d.Name+d.Title)
+		}
+		return names
+	}
+
+	t.Run("Controllers", func(t *testing.T) {
+		if got := names(t, do("GET", "/api/v1/stocklists", "")); len(got) != 1 || got[0] != "Ana secret" {
+			t.Errorf("stocklists = %v, want Ana's", got)
+		}
+		if got := names(t, do("GET", "/api/v1/search?q=secret", "")); len(got) != 1 || got[0] != "Ana secret" {
+			t.Errorf("search = %v, want Ana's stocklist", got)
+		}
+		csv := do("GET", "/api/v1/stocklists/export.csv", "").Body.String()
+		if !strings.Contains(csv, "Ana secret") || strings.Contains(csv, "Bob") {
+			t.Errorf("export = %q, want Ana's stocklist only", csv)
+		}
+		for _, path := range []string{
+			"/api/v1/stocklists/" + strconv.Itoa(int(bobs.ID)),
+			"/api/v1/stocklists/" + strconv.Itoa(int(bobs.ID)) + "/attachments",
+		} {
+			if rec := do("GET", path, ""); rec.Code != http.StatusNotFound {
+				t.Errorf("GET %s: status %d, want 404", path, rec.Code)
+			}
+		}
+		path := "/api/v1/orgs/" + strconv.Itoa(int(org.ID)) + "/stocklists"
+		if rec := do("GET", path, ""); rec.Code < 400 || strings.Contains(rec.Body.String(), "Bob team") {
+			t.Errorf("GET %s: status %d, %s, want an error", path, rec.Code, rec.Body)
+		}
+		// Claiming a guest creates stocklists as the user
+		rec := do("POST", "/api/v1/users/me/guest", `{"guest_token":"`+guest.Token+`"}`)
+		if got := names(t, rec); len(got) != 2 || got[0] != "Ana secret" || got[1] != "Ana guest" {
+			t.Errorf("claiming the guest: status %d, stocklists %v, want Ana's two", rec.Code, got)
+		}
+	})
+}
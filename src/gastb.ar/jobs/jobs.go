@@ -0,0 +1,247 @@
+package jobs
+
+// The jobs package runs background work from a queue stored in the
+// database: a pool of workers claims due jobs, runs the handler
+// registered for their kind and retries failures with exponential
+// backoff. Jobs survive restarts, and several processes can share the
+// queue.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gastb.ar/errreport"
+	"gastb.ar/metrics"
+	"gastb.ar/models"
+	"gastb.ar/tracing"
+)
+
+// Queue defaults
+const (
+	DefaultWorkers      = 4
+	DefaultMaxAttempts  = 5
+	DefaultBackoff      = 30 * time.Second
+	DefaultPollInterval = time.Second
+	// DefaultLease is how long a job may run before another worker
+	// assumes its worker died and runs it again
+	DefaultLease = 5 * time.Minute
+	maxBackoff   = 6 * time.Hour
+)
+
+var (
+	processed = metrics.NewCounter("jobs_processed_total",
+		"Job attempts by kind and result.", "kind", "result")
+	duration = metrics.NewHistogram("job_duration_seconds",
+		"Time spent running jobs by kind.", metrics.DefaultBuckets, "kind")
+)
+
+// Handler runs a job. Returning an error schedules a retry, until the
+// job runs out of attempts.
+type Handler func(ctx context.Context, job *models.Job) error
+
+// Queue enqueues jobs and runs them with a pool of workers
+type Queue struct {
+	js       *models.JobService
+	logger   *slog.Logger
+	handlers map[string]Handler
+
+	// Workers is the number of jobs run concurrently
+	Workers int
+	// Backoff is the delay before the first retry; it doubles after each
+	// failed attempt
+	Backoff      time.Duration
+	PollInterval time.Duration
+	Lease        time.Duration
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a queue with the default settings. Handlers must be
+// registered before calling Start.
+func New(js *models.JobService, logger *slog.Logger) *Queue {
+	return &Queue {
+		js:           js,
+		logger:       logger,
+		handlers:     make(map[string]Handler),
+		Workers:      DefaultWorkers,
+		Backoff:      DefaultBackoff,
+		PollInterval: DefaultPollInterval,
+		Lease:        DefaultLease,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Register sets the handler of a kind of job
+func (q *Queue) Register(kind string, h Handler) {
+	q.handlers[kind] = h
+}
+
+// Options tune an enqueued job
+type Options struct {
+	// RunAt delays the job; zero means now
+	RunAt time.Time
+	// MaxAttempts defaults to DefaultMaxAttempts
+	MaxAttempts int
+	// Key, if set, skips enqueueing while a job with the same key is
+	// pending
+	Key string
+}
+
+// Enqueue adds a job of a kind with JSON encoded args to the queue
+func (q *Queue) Enqueue(kind string, args interface{}, opts Options) error {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	job := &models.Job{
+		Kind:        kind,
+		Args:        string(b),
+		Key:         opts.Key,
+		RunAt:       opts.RunAt,
+		MaxAttempts: opts.MaxAttempts,
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = DefaultMaxAttempts
+	}
+	if err := q.js.Enqueue(job); err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Args decodes the args of a job into dst
+func Args(job *models.Job, dst interface{}) error {
+	return json.Unmarshal([]byte(job.Args), dst)
+}
+
+// Backoff returns the delay before retrying a job that failed its
+// given attempt, starting at base and doubling up to six hours
+func Backoff(base time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt-1)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Start launches the workers. They stop claiming jobs once Shutdown is
+// called.
+func (q *Queue) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+}
+
+// Shutdown stops the workers and waits for running jobs to finish or for
+// ctx to be done, whichever happens first. Jobs cut short are run again
+// once their lease expires.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	if q.cancel == nil {
+		return nil
+	}
+	q.cancel()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work claims and runs jobs until ctx is canceled, sleeping for the poll
+// interval whenever the queue is empty
+func (q *Queue) work(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		job, err := q.js.Claim(time.Now(), q.Lease)
+		switch err {
+		case nil:
+			q.run(job)
+			continue
+		case models.ErrNotFound:
+		default:
+			q.logger.Error("claiming job", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+// run runs a claimed job and records its outcome. Jobs are not
+// canceled on shutdown, only bounded by their lease.
+func (q *Queue) run(job *models.Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.Lease)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "job "+job.Kind, tracing.KindInternal)
+	defer span.End()
+	span.SetAttr("job.id", fmt.Sprint(job.ID))
+	span.SetAttr("job.attempt", fmt.Sprint(job.Attempts))
+
+	start := time.Now()
+	err := q.handle(ctx, job)
+	duration.Observe(time.Since(start).Seconds(), job.Kind)
+
+	var saveErr error
+	switch {
+	case err == nil:
+		processed.Inc(job.Kind, "success")
+		saveErr = q.js.Complete(job)
+	case job.Attempts >= job.MaxAttempts:
+		processed.Inc(job.Kind, "failure")
+		span.SetError(err)
+		q.logger.Error("job failed", "job_id", job.ID, "kind", job.Kind,
+			"attempt", job.Attempts, "error", err)
+		errreport.Error(ctx, err, "job_kind", job.Kind, "job_id", fmt.Sprint(job.ID))
+		saveErr = q.js.Fail(job, err)
+	default:
+		processed.Inc(job.Kind, "retry")
+		span.SetError(err)
+		q.logger.Warn("job failed, retrying", "job_id", job.ID, "kind", job.Kind,
+			"attempt", job.Attempts, "error", err)
+		saveErr = q.js.Retry(job, err, time.Now().Add(Backoff(q.Backoff, job.Attempts)))
+	}
+	if saveErr != nil {
+		q.logger.Error("saving job", "job_id", job.ID, "error", saveErr)
+	}
+}
+
+// handle calls the handler of a job, turning panics into errors. Panics
+// are reported on every attempt, other errors only once retries run out.
+func (q *Queue) handle(ctx context.Context, job *models.Job) (err error) {
+	h, ok := q.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("jobs: no handler for kind %q", job.Kind)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			errreport.Panic(ctx, p, "job_kind", job.Kind, "job_id", fmt.Sprint(job.ID))
+			err = fmt.Errorf("jobs: panic: %v", p)
+		}
+	}()
+	return h(ctx, job)
+}
@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// PurgeKind is the kind of the job deleting expired tokens and old jobs
+const PurgeKind = "tokens.purge"
+
+// FinishedJobRetention is how long finished jobs are kept for inspection
+const FinishedJobRetention = 7 * 24 * time.Hour
+
+// PurgeHandler returns a handler deleting unused invites, user tokens,
+// guests and idempotency keys that have expired, changes older than
+// models.ChangeRetention, and jobs finished longer than
+// FinishedJobRetention ago
+func PurgeHandler(is *models.InviteService, us *models.UserService,
+	gs *models.GuestService, ks *models.IdempotencyKeyService, cs *models.ChangeService,
+	js *models.JobService) Handler {
+	return func(ctx context.Context, job *models.Job) error {
+		now := time.Now()
+		invites, err := is.PurgeExpired(now)
+		if err != nil {
+			return err
+		}
+		tokens, err := us.PurgeTokens(now)
+		if err != nil {
+			return err
+		}
+		guests, err := gs.PurgeExpired(now)
+		if err != nil {
+			return err
+		}
+		keys, err := ks.PurgeExpired(now)
+		if err != nil {
+			return err
+		}
+		changes, err := cs.PurgeExpired(now.Add(-models.ChangeRetention))
+		if err != nil {
+			return err
+		}
+		finished, err := js.PurgeFinished(now.Add(-FinishedJobRetention))
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "purged expired records", "invites", invites,
+			"tokens", tokens, "guests", guests, "idempotency_keys", keys,
+			"changes", changes, "jobs", finished)
+		return nil
+	}
+}
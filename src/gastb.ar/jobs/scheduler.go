@@ -0,0 +1,142 @@
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// Scheduler enqueues recurring jobs on cron schedules. Each run uses the
+// job kind as its key, so a run is skipped while the previous one is
+// still pending or running.
+type Scheduler struct {
+	queue   *Queue
+	entries []*entry
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+type entry struct {
+	kind     string
+	spec     string
+	schedule *Schedule
+	next     time.Time
+}
+
+// NewScheduler creates a scheduler enqueueing jobs on a queue
+func NewScheduler(queue *Queue) *Scheduler {
+	return &Scheduler {
+		queue: queue,
+		stop:  make(chan struct{}),
+	}
+}
+
+// Add schedules a kind of job, whose handler must be registered on the
+// queue, on a cron expression. It must be called before Start.
+func (s *Scheduler) Add(kind, spec string) error {
+	if _, ok := s.queue.handlers[kind]; !ok {
+		return fmt.Errorf("jobs: can not schedule %q: no handler", kind)
+	}
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	s.entries = append(s.entries, &entry{kind: kind, spec: spec, schedule: schedule})
+	return nil
+}
+
+// Start runs the scheduler in the background until Stop is called
+func (s *Scheduler) Start() {
+	now := time.Now()
+	for _, e := range s.entries {
+		e.next = e.schedule.Next(now)
+	}
+	go s.loop()
+}
+
+// Stop stops the scheduler
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *Scheduler) loop() {
+	for {
+		s.mu.Lock()
+		var wake time.Time
+		for _, e := range s.entries {
+			if !e.next.IsZero() && (wake.IsZero() || e.next.Before(wake)) {
+				wake = e.next
+			}
+		}
+		s.mu.Unlock()
+		if wake.IsZero() {
+			return
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(time.Until(wake)):
+		}
+		s.runDue(time.Now())
+	}
+}
+
+// runDue enqueues the jobs whose time has come and computes their next
+// run
+func (s *Scheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.next.IsZero() || e.next.After(now) {
+			continue
+		}
+		err := s.queue.Enqueue(e.kind, nil, Options{Key: e.kind})
+		switch err {
+		case nil:
+		case models.ErrJobPending:
+			s.queue.logger.Info("skipping scheduled job, previous run pending",
+				"kind", e.kind)
+		default:
+			s.queue.logger.Error("enqueueing scheduled job", "kind", e.kind,
+				"error", err)
+		}
+		e.next = e.schedule.Next(now)
+	}
+}
+
+// Status describes a scheduled job for the admin dashboard
+type Status struct {
+	Kind string
+	Spec string
+	Next time.Time
+	// Last is the latest run, or nil if it never ran
+	Last *models.Job
+}
+
+// Status returns the status of every scheduled job, sorted by kind
+func (s *Scheduler) Status() ([]Status, error) {
+	s.mu.Lock()
+	statuses := make([]Status, 0, len(s.entries))
+	for _, e := range s.entries {
+		statuses = append(statuses, Status{Kind: e.kind, Spec: e.spec, Next: e.next})
+	}
+	s.mu.Unlock()
+	for i := range statuses {
+		last, err := s.queue.js.LastByKind(statuses[i].Kind)
+		switch err {
+		case nil:
+			statuses[i].Last = last
+		case models.ErrNotFound:
+		default:
+			return nil, err
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Kind < statuses[j].Kind
+	})
+	return statuses, nil
+}
@@ -0,0 +1,116 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"gastb.ar/models"
+	"gastb.ar/storage"
+)
+
+// UserPurgeKind is the kind of the jobs deleting the data of deleted
+// users
+const UserPurgeKind = "users.purge"
+
+// UserPurgeBatch is how many records a purge deletes at a time
+const UserPurgeBatch = 100
+
+// userPurgeAttempts is how many times a purge job is tried; each attempt
+// goes on from where the previous one stopped
+const userPurgeAttempts = 10
+
+// UserPurges deletes the data of deleted users through the job queue,
+// in batches, so that users with a lot of it don't hold up a worker or
+// the database. It is a models.UserPurger.
+type UserPurges struct {
+	ups   *models.UserPurgeService
+	store storage.Storage
+	queue *Queue
+}
+
+var _ models.UserPurger = &UserPurges{}
+
+// NewUserPurges creates a UserPurges deleting uploads from store and
+// registers its job handler on the queue
+func NewUserPurges(ups *models.UserPurgeService, store storage.Storage,
+	queue *Queue) *UserPurges {
+	p := &UserPurges{
+		ups:   ups,
+		store: store,
+		queue: queue,
+	}
+	queue.Register(UserPurgeKind, p.run)
+	return p
+}
+
+type userPurgeArgs struct {
+	UserID uint `json:"user_id"`
+}
+
+// Purge enqueues the purge of a deleted user's data, unless it is
+// pending already
+func (p *UserPurges) Purge(userID uint) error {
+	err := p.queue.Enqueue(UserPurgeKind, userPurgeArgs{UserID: userID}, Options{
+		Key:         fmt.Sprintf("%s:%d", UserPurgeKind, userID),
+		MaxAttempts: userPurgeAttempts,
+	})
+	if err == models.ErrJobPending {
+		return nil
+	}
+	return err
+}
+
+// Resume enqueues the purges that are not finished, such as those whose
+// job failed for good or was never enqueued. It is meant to be called at
+// startup.
+func (p *UserPurges) Resume() error {
+	purges, err := p.ups.UnfinishedPurges()
+	if err != nil {
+		return err
+	}
+	for _, up := range purges {
+		if err := p.Purge(up.UserID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run is the job handler purging a user's data batch by batch until it
+// is all gone. Progress is saved after each batch, so a job cut short by
+// its lease or a failure goes on from there on the next attempt.
+func (p *UserPurges) run(ctx context.Context, job *models.Job) error {
+	var args userPurgeArgs
+	if err := Args(job, &args); err != nil {
+		return err
+	}
+	up, err := p.ups.PurgeByUserID(args.UserID)
+	if err == models.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deleteFile := func(key string) error {
+		return p.store.Delete(ctx, key)
+	}
+	for done := false; !done; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		done, err = p.ups.PurgeBatch(up, UserPurgeBatch, deleteFile)
+		if err == models.ErrUserNotDeleted {
+			slog.WarnContext(ctx, "dropped purge of a user who is not deleted",
+				"user_id", up.UserID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	slog.InfoContext(ctx, "purged deleted user", "user_id", up.UserID,
+		"stocklists", up.Stocklists, "attachments", up.Attachments,
+		"webhooks", up.Webhooks, "api_keys", up.APIKeys, "sessions", up.Sessions)
+	return nil
+}
@@ -0,0 +1,168 @@
+package log
+
+// The log package configures structured logging on top of log/slog: JSON
+// lines in production, human readable text in development, with a level
+// that can be changed while the server runs. Attributes stored in a
+// context (request ID, user ID) and the trace ID are added to every record
+// logged with that context.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"gastb.ar/tracing"
+)
+
+// level is shared by every logger created by this package, so that
+// SetLevel takes effect immediately
+var level = new(slog.LevelVar)
+
+// New creates a logger writing JSON in production and text otherwise
+func New(w io.Writer, prod bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if prod {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{h})
+}
+
+// Init creates a logger on stdout, makes it the default slog logger and
+// sets the level, e.g. "info"
+func Init(prod bool, lvl string) (*slog.Logger, error) {
+	if err := SetLevel(lvl); err != nil {
+		return nil, err
+	}
+	logger := New(os.Stdout, prod)
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// ParseLevel parses one of "debug", "info", "warn" or "error"
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("log: invalid level %q", s)
+	}
+	return l, nil
+}
+
+// SetLevel changes the minimum level of every logger created by New
+func SetLevel(s string) error {
+	l, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// Level returns the current minimum level
+func Level() slog.Level {
+	return level.Level()
+}
+
+// LevelHandler handles GET and PUT requests on the log level, so it can be
+// raised to debug on a running server. PUT takes {"level": "debug"}.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := SetLevel(body.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("log level changed", "level", Level().String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": Level().String()})
+}
+
+//
+// Contextual attributes
+//
+
+type attrsKey struct{}
+
+// WithAttrs returns a context whose log records carry the given key/value
+// pairs, in addition to those already in ctx
+func WithAttrs(ctx context.Context, args ...any) context.Context {
+	prev, _ := ctx.Value(attrsKey{}).([]any)
+	attrs := make([]any, 0, len(prev)+len(args))
+	attrs = append(attrs, prev...)
+	attrs = append(attrs, args...)
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// contextHandler adds the attributes of the record's context and its
+// trace ID to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if attrs, ok := ctx.Value(attrsKey{}).([]any); ok {
+			r.Add(attrs...)
+		}
+		if id := tracing.TraceID(ctx); id != "" {
+			r.AddAttrs(slog.String("trace_id", id))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+//
+// gorm adapter
+//
+
+// GormLogger routes gorm's logs through slog. What gorm sends depends on
+// its log mode, set by models.Services.SetLogLevel: queries are logged
+// at info level, failed operations at error level, and gorm's own
+// notices, such as callbacks being registered, at debug level.
+type GormLogger struct {
+	Logger *slog.Logger
+}
+
+// Print implements gorm's logger interface
+func (gl GormLogger) Print(v ...interface{}) {
+	logger := gl.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if len(v) >= 5 && v[0] == "sql" {
+		logger.Info("sql query",
+			"source", v[1], "duration", v[2], "sql", v[3], "rows", v[len(v)-1])
+		return
+	}
+	if len(v) >= 3 && (v[0] == "log" || v[0] == "error") {
+		logger.Error("database error", "source", v[1], "error", fmt.Sprint(v[2:]...))
+		return
+	}
+	if len(v) >= 1 && v[0] == "info" {
+		logger.Debug("gorm", "detail", fmt.Sprint(v[1:]...))
+		return
+	}
+	logger.Error("gorm", "detail", fmt.Sprint(v...))
+}
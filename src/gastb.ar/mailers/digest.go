@@ -0,0 +1,155 @@
+package mailers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gastb.ar/email"
+	"gastb.ar/models"
+	"gastb.ar/views"
+)
+
+// DigestKind is the kind of the job sending digests, scheduled through
+// the Schedules setting
+const DigestKind = "digest.send"
+
+// Subscriptions sent a digest less than digestGap ago are skipped, so a
+// retried job doesn't send twice
+const digestGap = 20 * time.Hour
+
+// firstDigestPeriod is the period the first digest of a subscription
+// covers
+const firstDigestPeriod = 7 * 24 * time.Hour
+
+// Digests sends the periodic digest to subscribed users
+type Digests struct {
+	ds      *models.DigestService
+	nss     *models.NotificationSettingService
+	us      *models.UserService
+	ss      *models.StocklistService
+	mailer  email.Mailer
+	baseURL string
+	digest  *email.Template
+
+	// Chat, if set, also posts a summary of each digest to the user's
+	// chat channels
+	Chat ChatPoster
+}
+
+// ChatPoster posts messages to the chat channels of a user; a
+// webhooks.Dispatcher is a ChatPoster
+type ChatPoster interface {
+	Chat(userID uint, text string) error
+}
+
+// NewDigests creates a digest sender on top of initialized services,
+// sending through m. Links in the emails point to baseURL.
+func NewDigests(ds *models.DigestService, nss *models.NotificationSettingService,
+	us *models.UserService, ss *models.StocklistService, m email.Mailer,
+	baseURL string) *Digests {
+	return &Digests{
+		ds:      ds,
+		nss:     nss,
+		us:      us,
+		ss:      ss,
+		mailer:  m,
+		baseURL: baseURL,
+		digest:  views.NewEmail("digest"),
+	}
+}
+
+// Send is the job handler sending a digest to every user with
+// stocklists who opted in to it in their notification settings
+func (d *Digests) Send(ctx context.Context, job *models.Job) error {
+	ids, err := d.nss.DigestRecipients()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sent := 0
+	for _, id := range ids {
+		ok, err := d.send(ctx, id, now)
+		if err != nil {
+			return err
+		}
+		if ok {
+			sent++
+		}
+	}
+	slog.InfoContext(ctx, "sent digests", "recipients", len(ids), "sent", sent)
+	return nil
+}
+
+// send emails the digest of one user, reporting whether it was sent.
+// Deleted users, users sent one recently and users with nothing to
+// report are skipped.
+func (d *Digests) send(ctx context.Context, userID uint, now time.Time) (bool, error) {
+	user, err := d.us.ByID(userID)
+	if err == models.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sub, err := d.ds.ByUserID(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if sub.LastSentAt != nil && sub.LastSentAt.After(now.Add(-digestGap)) {
+		return false, nil
+	}
+	stocklists, err := d.ss.AsTenant(user.ID).ByUserID(user.ID)
+	if err != nil {
+		return false, err
+	}
+	since := now.Add(-firstDigestPeriod)
+	if sub.LastSentAt != nil {
+		since = *sub.LastSentAt
+	}
+	data := views.DigestEmail{
+		Name:           user.Name,
+		Since:          since,
+		StocklistsURL:  d.baseURL + "/profile",
+		UnsubscribeURL: link(d.baseURL, "/digest/unsubscribe", sub.Token),
+	}
+	for _, sl := range stocklists {
+		data.Stocklists = append(data.Stocklists, views.DigestStocklist{
+			Name:    sl.Name,
+			New:     sl.CreatedAt.After(since),
+			Changed: sl.UpdatedAt.After(since),
+		})
+	}
+	if len(data.Stocklists) > 0 {
+		msg, err := d.digest.Message(data, user.Email)
+		if err != nil {
+			return false, err
+		}
+		if err := d.mailer.Send(ctx, msg); err != nil {
+			return false, err
+		}
+		// The email is out, so failing here would send it again
+		if d.Chat != nil {
+			if err := d.Chat.Chat(user.ID, digestText(data)); err != nil {
+				slog.WarnContext(ctx, "posting digest to chat failed", "user_id", user.ID, "error", err)
+			}
+		}
+	}
+	return len(data.Stocklists) > 0, d.ds.MarkSent(sub)
+}
+
+// digestText summarizes a digest in one line for chat channels
+func digestText(data views.DigestEmail) string {
+	var added, changed int
+	for _, sl := range data.Stocklists {
+		switch {
+		case sl.New:
+			added++
+		case sl.Changed:
+			changed++
+		}
+	}
+	return fmt.Sprintf("Your gastb.ar digest since %s: %d stocklists, %d new and %d changed. %s",
+		data.Since.Format("Jan 2"), len(data.Stocklists), added, changed, data.StocklistsURL)
+}
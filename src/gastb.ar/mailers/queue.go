@@ -0,0 +1,116 @@
+package mailers
+
+import (
+	"context"
+	"strings"
+
+	"gastb.ar/email"
+	"gastb.ar/jobs"
+	"gastb.ar/metrics"
+	"gastb.ar/models"
+)
+
+// JobKind is the kind of the jobs sending emails
+const JobKind = "email.send"
+
+// DefaultMaxAttempts is how many times an email is tried before its
+// delivery is marked dead. With the queue's default backoff, the last
+// attempt happens about an hour after the first.
+const DefaultMaxAttempts = 8
+
+var sent = metrics.NewCounter("email_deliveries_total",
+	"Email delivery attempts by result.", "result")
+
+// Queue is an email.Mailer that sends messages from background jobs
+// through another mailer, so an outage of the mail provider delays emails
+// instead of failing the requests that send them. Every message is
+// tracked as a models.EmailDelivery. Addresses the mail provider reported
+// as undeliverable are left out.
+type Queue struct {
+	mailer     email.Mailer
+	queue      *jobs.Queue
+	deliveries *models.EmailDeliveryService
+	users      *models.UserService
+
+	// MaxAttempts is how many times an email is tried
+	MaxAttempts int
+}
+
+var _ email.Mailer = &Queue{}
+
+// NewQueue creates a Queue sending through m and registers its job
+// handler on the job queue. us tells which addresses are undeliverable.
+func NewQueue(m email.Mailer, queue *jobs.Queue, ds *models.EmailDeliveryService,
+	us *models.UserService) *Queue {
+	q := &Queue{
+		mailer:      m,
+		queue:       queue,
+		deliveries:  ds,
+		users:       us,
+		MaxAttempts: DefaultMaxAttempts,
+	}
+	queue.Register(JobKind, q.deliver)
+	return q
+}
+
+// sendArgs are the args of a sending job
+type sendArgs struct {
+	DeliveryID uint          `json:"delivery_id"`
+	Message    email.Message `json:"message"`
+}
+
+// Send implements email.Mailer by queueing msg. Only errors recording
+// or enqueueing it are returned; a message whose recipients are all
+// undeliverable is recorded as suppressed and not sent.
+func (q *Queue) Send(ctx context.Context, msg email.Message) error {
+	if len(msg.To) == 0 {
+		return email.ErrNoRecipients
+	}
+	d := &models.EmailDelivery{
+		To:      strings.Join(msg.To, ", "),
+		Subject: msg.Subject,
+	}
+	to, err := q.users.Deliverable(msg.To)
+	if err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		sent.Inc("suppressed")
+		return q.deliveries.Suppress(d)
+	}
+	msg.To = to
+	d.To = strings.Join(to, ", ")
+	if err := q.deliveries.Create(d); err != nil {
+		return err
+	}
+	args := sendArgs{DeliveryID: d.ID, Message: msg}
+	return q.queue.Enqueue(JobKind, args, jobs.Options{MaxAttempts: q.MaxAttempts})
+}
+
+// deliver is the job handler sending an email once and recording the
+// outcome
+func (q *Queue) deliver(ctx context.Context, job *models.Job) error {
+	var args sendArgs
+	if err := jobs.Args(job, &args); err != nil {
+		return err
+	}
+	d, err := q.deliveries.ByID(args.DeliveryID)
+	if err != nil {
+		return err
+	}
+	sendErr := q.mailer.Send(ctx, args.Message)
+	if sendErr == nil {
+		sent.Inc("success")
+		return q.deliveries.MarkSent(d, job.Attempts)
+	}
+	last := job.Attempts >= job.MaxAttempts
+	if last {
+		sent.Inc("dead")
+	} else {
+		sent.Inc("failure")
+	}
+	if err := q.deliveries.MarkFailed(d, job.Attempts, sendErr, last); err != nil {
+		return err
+	}
+	return sendErr
+}
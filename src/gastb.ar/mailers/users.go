@@ -0,0 +1,142 @@
+package mailers
+
+// The mailers package renders the views package's email templates and
+// sends them, implementing the mailer interfaces of the models package.
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"gastb.ar/email"
+	"gastb.ar/models"
+	"gastb.ar/views"
+)
+
+// sendTimeout bounds how long sending one email may take
+const sendTimeout = 30 * time.Second
+
+// Users sends the emails of user account flows
+type Users struct {
+	mailer  email.Mailer
+	nss     *models.NotificationSettingService
+	baseURL string
+
+	welcome       *email.Template
+	verifyEmail   *email.Template
+	passwordReset *email.Template
+	emailChanged  *email.Template
+	security      *email.Template
+}
+
+var _ models.UserMailer = &Users{}
+
+// NewUsers creates a user mailer sending through m. Security notices
+// are only sent to users whose notification settings allow it. Links in
+// the emails point to baseURL, the public address of the site.
+func NewUsers(m email.Mailer, nss *models.NotificationSettingService, baseURL string) *Users {
+	return &Users{
+		mailer:        m,
+		nss:           nss,
+		baseURL:       baseURL,
+		welcome:       views.NewEmail("welcome"),
+		verifyEmail:   views.NewEmail("verify_email"),
+		passwordReset: views.NewEmail("password_reset"),
+		emailChanged:  views.NewEmail("email_changed"),
+		security:      views.NewEmail("security_notice"),
+	}
+}
+
+// link builds an absolute URL to a path of the site at baseURL, with an
+// optional token query parameter
+func link(baseURL, path, token string) string {
+	link := baseURL + path
+	if token != "" {
+		link += "?" + url.Values{"token": {token}}.Encode()
+	}
+	return link
+}
+
+// hours describes how long a link lasts, e.g. "48 hours"
+func hours(d time.Duration) string {
+	h := int(d.Hours())
+	if h == 1 {
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d hours", h)
+}
+
+// minutes describes how long a code lasts, e.g. "30 minutes"
+func minutes(d time.Duration) string {
+	m := int(d.Minutes())
+	if m == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", m)
+}
+
+// send renders t with data and sends it to to
+func (u *Users) send(t *email.Template, data interface{}, to string) error {
+	msg, err := t.Message(data, to)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	return u.mailer.Send(ctx, msg)
+}
+
+// Welcome implements models.UserMailer
+func (u *Users) Welcome(user *models.User) error {
+	return u.send(u.welcome, views.WelcomeEmail{
+		Name:     user.Name,
+		LoginURL: link(u.baseURL, "/login", ""),
+	}, user.Email)
+}
+
+// VerifyEmail implements models.UserMailer
+func (u *Users) VerifyEmail(user *models.User, token, code string) error {
+	return u.send(u.verifyEmail, views.VerifyEmail{
+		Name:          user.Name,
+		URL:           link(u.baseURL, "/verify", token),
+		ExpiresIn:     hours(models.VerifyEmailTTL),
+		Code:          code,
+		CodeExpiresIn: minutes(models.VerificationCodeTTL),
+	}, user.Email)
+}
+
+// PasswordReset implements models.UserMailer
+func (u *Users) PasswordReset(user *models.User, token string) error {
+	return u.send(u.passwordReset, views.PasswordResetEmail{
+		Name:      user.Name,
+		URL:       link(u.baseURL, "/reset", token),
+		ExpiresIn: hours(models.PasswordResetTTL),
+	}, user.Email)
+}
+
+// SecurityNotice implements models.UserMailer
+func (u *Users) SecurityNotice(user *models.User, notice models.SecurityNotice) error {
+	if enabled, err := u.nss.Enabled(user.ID, models.NotifySecurityNotices); err != nil || !enabled {
+		return err
+	}
+	details := views.SecurityDetails{
+		Time:      notice.Time,
+		IP:        notice.Client.IP,
+		UserAgent: notice.Client.UserAgent,
+		LockURL:   link(u.baseURL, "/lock", notice.LockToken),
+	}
+	if notice.Kind == models.SecurityEmailChanged {
+		return u.send(u.emailChanged, views.EmailChangedEmail{
+			Name:            user.Name,
+			OldEmail:        notice.OldEmail,
+			NewEmail:        user.Email,
+			SecurityDetails: details,
+		}, notice.To)
+	}
+	return u.send(u.security, views.SecurityNoticeEmail{
+		Name:            user.Name,
+		Kind:            notice.Kind,
+		SecurityDetails: details,
+	}, notice.To)
+}
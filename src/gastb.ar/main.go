@@ -1,52 +1,706 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"gastb.ar/assets"
+	"gastb.ar/billing"
+	"gastb.ar/cache"
+	"gastb.ar/calendar"
+	"gastb.ar/captcha"
+	"gastb.ar/config"
 	"gastb.ar/controllers"
+	"gastb.ar/email"
+	"gastb.ar/errreport"
+	"gastb.ar/eventbus"
+	"gastb.ar/geoip"
+	"gastb.ar/cookies"
+	"gastb.ar/flash"
+	"gastb.ar/hash"
+	"gastb.ar/health"
+	"gastb.ar/httperror"
+	"gastb.ar/jobs"
+	"gastb.ar/log"
+	"gastb.ar/mailers"
+	"gastb.ar/metrics"
 	"gastb.ar/models"
+	"gastb.ar/notify"
+	"gastb.ar/outbox"
+	"gastb.ar/oidc"
+	"gastb.ar/policies"
 	"gastb.ar/middleware"
+	"gastb.ar/ratelimit"
+	"gastb.ar/storage"
+	"gastb.ar/tracing"
+	"gastb.ar/views"
+	"gastb.ar/rpc"
+	"gastb.ar/webhooks"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
 	// Config information
-	cfg := DefaultConfig()
-	psqlInfo := DefaultPostgresConfig().ConnectionInfo()
+	cfg := config.DefaultConfig()
+	pgCfg := config.DefaultPostgresConfig()
+	psqlInfo := pgCfg.ConnectionInfo()
 	hmacSecretKey := cfg.HMAC
 
+	logger, err := log.Init(cfg.IsProd(), cfg.LogLevel)
+	if err != nil {
+		panic(err)
+	}
+	flash.SetKey(hash.DeriveKey(cfg.HMAC, "flash"))
+
+	shutdownTracing := tracing.Init(tracing.Config{
+		Endpoint:    cfg.OTLPEndpoint,
+		ServiceName: "gastb",
+		SampleRatio: cfg.TraceSampleRatio,
+	})
+	defer shutdownTracing(context.Background())
+
+	if cfg.ErrorReporting.Environment == "" {
+		cfg.ErrorReporting.Environment = cfg.Env
+	}
+	shutdownErrReport, err := errreport.Init(cfg.ErrorReporting)
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownErrReport(context.Background())
+
 	// Connect to database
 	services, err := models.NewServices(psqlInfo,hmacSecretKey)
 	if err != nil {
 		panic(err)
 	}
 	defer services.Close()
-	services.AutoMigrate()
+	// Postgres may still be starting, as under docker-compose
+	if err := services.WaitForDB(context.Background(), pgCfg.WaitTimeout); err != nil {
+		panic(err)
+	}
+	services.SetPreparedStatements(pgCfg.PreparedStatements)
+	services.SetRowLevelSecurity(pgCfg.RowLevelSecurity)
+	if pgCfg.RowLevelSecurity {
+		// Migrations and the admin dashboard's counts span users
+		if err := services.SetAdminConnection(pgCfg.AdminConnectionInfo()); err != nil {
+			panic(err)
+		}
+	}
+	keyring, err := cfg.Keyring()
+	if err != nil {
+		panic(err)
+	}
+	services.SetKeyring(keyring)
+	if cfg.BlockDisposableEmail {
+		services.UserService.SetDomainBlocklist(services.BlockedDomainService)
+	}
+	services.UserService.SetPasswordHistory(cfg.PasswordHistory)
+	appCache, err := cache.New(cfg.Cache)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.SessionCacheTTL > 0 {
+		services.UserService.SetSessionCache(appCache, cfg.SessionCacheTTL)
+	}
+	services.SubscriptionService.SetPlans(cfg.Billing)
+	if err := services.SetLogLevel(cfg.DBLogLevel); err != nil {
+		panic(err)
+	}
+	services.LogSlowQueries(cfg.SlowQueryThreshold, cfg.ExplainSlowQueries)
+	if err := services.AutoMigrate(); err != nil {
+		panic(err)
+	}
+
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
+
+	rememberCookie := cookies.NewRemember(cookies.Config{
+		Secure:   cfg.IsProd(),
+		SameSite: cfg.CookieSameSite,
+		MaxAge:   cfg.RememberTTL,
+	}, hash.DeriveKey(cfg.HMAC, "remember"))
+	deviceCookie := cookies.NewDevice(cookies.Config{
+		Secure:   cfg.IsProd(),
+		SameSite: cfg.CookieSameSite,
+	}, hash.DeriveKey(cfg.HMAC, "device"))
+
+	// Background jobs
+	queue := jobs.New(services.JobService, logger)
+	queue.Register(jobs.PurgeKind,
+		jobs.PurgeHandler(services.InviteService, services.UserService,
+			services.GuestService, services.IdempotencyKeyService, services.ChangeService,
+			services.JobService))
+	hooks := webhooks.NewDispatcher(services.WebhookService,
+		services.NotificationSettingService, queue)
+	userPurges := jobs.NewUserPurges(services.UserPurgeService, store, queue)
+	services.UserService.SetPurger(userPurges)
+	mailer, err := email.New(cfg.Mail)
+	if err != nil {
+		panic(err)
+	}
+	mailQueue := mailers.NewQueue(mailer, queue, services.EmailDeliveryService,
+		services.UserService)
+	services.UserService.SetMailer(mailers.NewUsers(mailQueue,
+		services.NotificationSettingService, cfg.BaseURL))
+	digests := mailers.NewDigests(services.DigestService,
+		services.NotificationSettingService, services.UserService,
+		services.StocklistService, mailQueue, cfg.BaseURL)
+	digests.Chat = hooks
+	queue.Register(mailers.DigestKind, digests.Send)
+	queue.Start()
+	if err := userPurges.Resume(); err != nil {
+		logger.Error("resuming user purges", "error", err)
+	}
+	scheduler := jobs.NewScheduler(queue)
+	for kind, spec := range cfg.Schedules {
+		if err := scheduler.Add(kind, spec); err != nil {
+			panic(err)
+		}
+	}
+	scheduler.Start()
+	// Changes logged in the outbox go out to webhooks, and to the event
+	// bus if one is configured
+	relay := outbox.New(services.ChangeService, logger)
+	relay.Add("webhooks", hooks.StocklistChanges)
+	publisher, err := eventbus.New(cfg.EventBus)
+	if err != nil {
+		panic(err)
+	}
+	if publisher != nil {
+		relay.Add("eventbus", eventbus.Consumer(publisher))
+	}
+	stopRelay := relay.Run(outbox.DefaultInterval)
 
 	// Create controllers
 	staticC := controllers.NewStatic()
-	userC := controllers.NewUserController(services.UserService)
-	requireUserMw := middleware.RequireUser {
+	httperror.SetPage(staticC.Error)
+	userC := controllers.NewUserController(services.UserService,
+		services.InviteService, services.NotificationSettingService,
+		services.ProfileService, rememberCookie, deviceCookie, hooks, cfg.InviteOnly)
+	// Single sign-on is only offered when a provider is configured, and
+	// SCIM only along with it
+	var ssoC *controllers.SSOController
+	var scimC *controllers.SCIMController
+	if cfg.OIDC.Issuer != "" {
+		provider := oidc.New(oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.BaseURL + "/login/sso/callback",
+		})
+		ssoCookie := cookies.NewSSO(cookies.Config{
+			Secure: cfg.IsProd(),
+		}, hash.DeriveKey(cfg.HMAC, "sso"))
+		ssoC = controllers.NewSSOController(userC, provider, ssoCookie,
+			cfg.OIDC.Domain)
+		if cfg.OIDC.Enforce && cfg.OIDC.Domain != "" {
+			services.UserService.RequireSSO(cfg.OIDC.Domain)
+		}
+		views.SSO = true
+		if cfg.OIDC.SCIMToken != "" {
+			scimC = controllers.NewSCIMController(services.UserService, hooks,
+				cfg.OIDC.SCIMToken, cfg.BaseURL)
+		}
+	}
+	maintenanceMw := &middleware.Maintenance {
+		Settings: services.SettingService,
+		Default:  cfg.Maintenance,
+	}
+	adminC := controllers.NewAdminController(services, scheduler, maintenanceMw)
+	apiC := controllers.NewAPIController(services.UserService,
+		services.StocklistService, services.APIKeyService, hooks)
+	if cfg.Exports.Storage.Backend != "" {
+		exportStore, err := storage.New(cfg.Exports.Storage)
+		if err != nil {
+			panic(err)
+		}
+		if err := apiC.SetExportStorage(exportStore, cfg.Exports.LinkTTL); err != nil {
+			panic(err)
+		}
+	}
+	userC.SetReferrals(services.ReferralService)
+	apiC.SetReferrals(services.ReferralService)
+	// Signups and password reset requests pass a captcha when a provider
+	// is configured; its widget must be allowed by the CSP
+	csp := middleware.DefaultCSP
+	verifier, err := captcha.New(cfg.Captcha)
+	if err != nil {
+		panic(err)
+	}
+	if verifier != nil {
+		userC.SetCaptcha(verifier)
+		apiC.SetCaptcha(verifier)
+		widget := verifier.Widget()
+		views.Captcha = &widget
+		csp = widget.AllowIn(csp)
+	}
+	uploadsC := controllers.NewUploadsController(services.UserService,
+		services.StocklistService, services.AttachmentService, store)
+	webhooksC := controllers.NewWebhooksController(services.WebhookService)
+	graphqlC := controllers.NewGraphQLController(services.StocklistService,
+		services.AttachmentService)
+	openapiC := controllers.NewOpenAPIController()
+	mailC := controllers.NewMailController(services.UserService,
+		cfg.Mail.Mailgun.WebhookSigningKey)
+	hub := notify.NewHub()
+	notificationsC := controllers.NewNotificationsController(hub,
+		services.NotificationSettingService)
+	// There is no source of dividend and earnings dates yet, so feeds are
+	// empty until one is plugged in here
+	calendarC := controllers.NewCalendarController(services.CalendarFeedService,
+		calendar.None, cfg.BaseURL)
+	documents, err := policies.Load(cfg.PoliciesDir)
+	if err != nil {
+		panic(err)
+	}
+	policiesC := controllers.NewPoliciesController(documents, services.PolicyService)
+	preferencesC := controllers.NewPreferencesController(services.PreferenceService)
+	guestsC := controllers.NewGuestsController(services.GuestService)
+	referralsC := controllers.NewReferralsController(services.ReferralService, cfg.BaseURL)
+	orgsC := controllers.NewOrganizationsController(services.OrganizationService,
+		services.StocklistService)
+	stripe, err := billing.New(cfg.Billing)
+	if err != nil {
+		panic(err)
+	}
+	billingC := controllers.NewBillingController(services.SubscriptionService,
+		services.StocklistService, services.APIUsageService, cfg.Billing, stripe, cfg.BaseURL)
+	usageC := controllers.NewUsageController(services.APIUsageService, services.APIKeyService)
+	syncC := controllers.NewSyncController(services.ChangeService, services.StocklistService,
+		services.OrganizationService)
+	searchC := controllers.NewSearchController(services.SearchService)
+	geo, err := geoip.Load(cfg.GeoIPFile)
+	if err != nil {
+		panic(err)
+	}
+	sessionsC := controllers.NewSessionsController(services.UserService, geo, rememberCookie)
+	profilesC := controllers.NewProfilesController(services.UserService,
+		services.ProfileService, services.StocklistService, services.ChangeService, store,
+		cfg.BaseURL)
+	var profileCache *controllers.ProfileCache
+	if cfg.ProfileCacheTTL > 0 {
+		profileCache = controllers.NewProfileCache(appCache, cfg.ProfileCacheTTL,
+			services.UserService)
+		profilesC.SetProfileCache(profileCache)
+		userC.SetProfileCache(profileCache)
+		apiC.SetProfileCache(profileCache)
+		orgsC.SetProfileCache(profileCache)
+		graphqlC.SetProfileCache(profileCache)
+	}
+	userMw := middleware.User {
 		UserService: services.UserService,
+		Remember:    rememberCookie,
+	}
+	localeMw := middleware.Locale{}
+	requireUserMw := middleware.RequireUser {
+		User: userMw,
+	}
+	requireAdminMw := middleware.RequireAdmin {
+		RequireUser: requireUserMw,
+	}
+	requireSudoMw := middleware.RequireSudo{Window: cfg.SudoWindow}
+	policiesMw := middleware.Policies {
+		Service:   services.PolicyService,
+		Documents: documents,
+	}
+	apiKeyMw := middleware.APIKey {
+		APIKeyService: services.APIKeyService,
+		UserService:   services.UserService,
 	}
 	
-	// Create intermediate handlers
-	profileAuthd := requireUserMw.Apply(staticC.Profile)
+	logMw := middleware.Logger {
+		Logger: logger,
+	}
+
+	recoverMw := middleware.Recover {
+		Logger: logMw.Logger,
+		Prod:   cfg.IsProd(),
+	}
+
+	tracingMw := middleware.Tracing{}
+	metricsMw := middleware.Metrics{}
+	instrument := func(next http.Handler) http.Handler {
+		return metricsMw.Apply(next)
+	}
+
+	// Rate limits per route group, sharing one in-memory store
+	limitStore := ratelimit.NewMemoryStore()
+	loginLimitMw := middleware.RateLimit {
+		Store: limitStore,
+		Group: "login",
+		PerIP: ratelimit.PerMinute(10),
+	}
+	services.UserService.SetResetLimit(limitStore, ratelimit.PerHour(cfg.PasswordResetLimit))
+	apiLimitMw := middleware.RateLimit {
+		Store:   limitStore,
+		Group:   "api",
+		PerIP:   ratelimit.PerMinute(300),
+		PerUser: ratelimit.PerMinute(120),
+	}
+	// API key requests are metered, and held to the daily quota of
+	// their user's plan
+	usageMw := middleware.Usage{
+		APIUsageService: services.APIUsageService,
+		DailyLimit: func(user *models.User) int {
+			plan, err := services.SubscriptionService.PlanFor(user.ID)
+			if err != nil {
+				return 0
+			}
+			return plan.APIRequestsPerDay
+		},
+	}
+	stopUsage := services.APIUsageService.Run(usageFlushInterval)
+	// Retried POST requests with an Idempotency-Key get the first
+	// response again
+	services.IdempotencyKeyService.SetRetention(cfg.IdempotencyRetention)
+	idempotencyMw := middleware.Idempotency{
+		IdempotencyKeyService: services.IdempotencyKeyService,
+	}
+	// Plans may raise or lower the API limit of their users
+	apiLimitMw.UserLimit = func(user *models.User) ratelimit.Limit {
+		plan, err := services.SubscriptionService.PlanFor(user.ID)
+		if err != nil || plan.APIRequestsPerMinute == 0 {
+			return apiLimitMw.PerUser
+		}
+		return ratelimit.PerMinute(plan.APIRequestsPerMinute)
+	}
+
+	corsMw := middleware.CORS {
+		AllowedOrigins:   cfg.CORSOrigins,
+		AllowedMethods:   cfg.CORSMethods,
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "If-Match", "If-None-Match",
+			controllers.GuestTokenHeader, middleware.IdempotencyKeyHeader},
+		AllowCredentials: cfg.CORSAllowCredentials,
+		MaxAge:           10 * time.Minute,
+	}
+
+	secureMw := middleware.SecureHeaders {
+		Prod: cfg.IsProd(),
+		CSP:  csp,
+	}
+
+	compressMw := middleware.Compress {
+		MinSize: middleware.DefaultCompressMinSize,
+	}
+
+	// CSRF protection for every state-changing request
+	csrfMw := middleware.CSRF{
+		Key:  hash.DeriveKey(cfg.HMAC, "csrf"),
+		Prod: cfg.IsProd(),
+	}
 
 	// Routing code
 	router := mux.NewRouter()
+	router.Use(instrument)
+	router.NotFoundHandler = http.HandlerFunc(httperror.NotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(httperror.MethodNotAllowed)
 
 	router.Handle("/", staticC.Home).Methods("GET")
-	router.Handle("/profile", profileAuthd).Methods("GET")
-	router.Handle("/signup", userC.SignupView).Methods("GET")
+	router.HandleFunc("/profile", requireUserMw.ApplyFn(userC.Profile)).Methods("GET")
+	router.HandleFunc("/signup", userC.New).Methods("GET")
 	router.Handle("/login", userC.LoginView).Methods("GET")
 
-	router.HandleFunc("/cookietest",userC.CookieTest).Methods("GET")
-	
-	router.HandleFunc("/signup", userC.Signup).Methods("POST")
-	router.HandleFunc("/login",userC.Login).Methods("POST")
+	router.HandleFunc("/signup", loginLimitMw.ApplyFn(userC.Signup)).Methods("POST")
+	router.HandleFunc("/login", loginLimitMw.ApplyFn(userC.Login)).Methods("POST")
+	if ssoC != nil {
+		router.HandleFunc("/login/sso", loginLimitMw.ApplyFn(ssoC.Login)).Methods("GET")
+		router.HandleFunc("/login/sso/callback",
+			loginLimitMw.ApplyFn(ssoC.Callback)).Methods("GET")
+	}
+	router.HandleFunc("/logout", userC.Logout).Methods("POST")
+	router.HandleFunc("/profile/locale",
+		requireUserMw.ApplyFn(userC.SetLocale)).Methods("POST")
+	router.HandleFunc("/profile/username",
+		requireUserMw.ApplyFn(userC.ChangeUsername)).Methods("POST")
+	router.HandleFunc("/profile/email",
+		requireUserMw.ApplyFn(requireSudoMw.ApplyFn(userC.ChangeEmail))).Methods("POST")
+	router.HandleFunc("/sudo", requireUserMw.ApplyFn(userC.NewSudo)).Methods("GET")
+	router.HandleFunc("/sudo",
+		requireUserMw.ApplyFn(loginLimitMw.ApplyFn(userC.Sudo))).Methods("POST")
+	router.HandleFunc("/profile/notifications",
+		requireUserMw.ApplyFn(userC.SetNotifications)).Methods("POST")
+	router.HandleFunc("/profile/sessions",
+		requireUserMw.ApplyFn(sessionsC.Index)).Methods("GET")
+	router.HandleFunc("/profile/sessions/{id:[0-9]+}/end",
+		requireUserMw.ApplyFn(sessionsC.End)).Methods("POST")
+	router.HandleFunc("/profile/sessions/end-others",
+		requireUserMw.ApplyFn(sessionsC.EndOthers)).Methods("POST")
+	router.HandleFunc("/profile/public",
+		requireUserMw.ApplyFn(userC.SetProfile)).Methods("POST")
+	router.HandleFunc("/u/{username}", profileCache.ApplyFn(profilesC.Show)).Methods("GET")
+	router.HandleFunc("/u/{username}/avatar", profilesC.Avatar).Methods("GET")
+	router.HandleFunc("/u/{username}/stocklists/{id:[0-9]+}/feed",
+		profilesC.StocklistFeed).Methods("GET")
+	router.HandleFunc("/digest/unsubscribe", userC.Unsubscribe).Methods("GET")
+	router.HandleFunc("/calendar.ics", calendarC.Feed).Methods("GET")
+	router.HandleFunc("/profile/verify",
+		requireUserMw.ApplyFn(userC.ResendVerification)).Methods("POST")
+	router.HandleFunc("/profile/verify/code",
+		requireUserMw.ApplyFn(userC.VerifyCode)).Methods("POST")
+	router.HandleFunc("/profile/password",
+		requireUserMw.ApplyFn(userC.ChangePassword)).Methods("POST")
+	router.HandleFunc("/verify", userC.Verify).Methods("GET")
+	router.HandleFunc("/lock", userC.NewLock).Methods("GET")
+	router.HandleFunc("/lock", userC.Lock).Methods("POST")
+	router.Handle("/forgot", userC.ForgotView).Methods("GET")
+	router.HandleFunc("/forgot", loginLimitMw.ApplyFn(userC.Forgot)).Methods("POST")
+	router.HandleFunc("/reset", userC.NewReset).Methods("GET")
+	router.HandleFunc("/reset", loginLimitMw.ApplyFn(userC.Reset)).Methods("POST")
+	router.HandleFunc("/notifications/stream",
+		requireUserMw.ApplyFn(notificationsC.Stream)).Methods("GET")
+	router.HandleFunc(middleware.ConsentPath,
+		requireUserMw.ApplyFn(policiesC.Consent)).Methods("GET")
+	router.HandleFunc(middleware.ConsentPath,
+		requireUserMw.ApplyFn(policiesC.Accept)).Methods("POST")
+	router.HandleFunc("/policies/{kind:[a-z]+}", policiesC.Show).Methods("GET")
+	router.HandleFunc("/policies/{kind:[a-z]+}/{version}", policiesC.Show).Methods("GET")
+
+	// Admin dashboard
+	router.HandleFunc("/admin", requireAdminMw.ApplyFn(adminC.Index)).Methods("GET")
+	router.HandleFunc("/admin/users", requireAdminMw.ApplyFn(adminC.Users)).Methods("GET")
+	router.HandleFunc("/admin/emails", requireAdminMw.ApplyFn(adminC.Emails)).Methods("GET")
+	router.HandleFunc("/admin/suppressed",
+		requireAdminMw.ApplyFn(adminC.Suppressed)).Methods("GET")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/unlock",
+		requireAdminMw.ApplyFn(adminC.Unlock)).Methods("POST")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/allow-email",
+		requireAdminMw.ApplyFn(adminC.AllowEmail)).Methods("POST")
+	router.HandleFunc("/admin/invites", requireAdminMw.ApplyFn(adminC.CreateInvite)).Methods("POST")
+
+	// JSON API routes, authenticated by API key instead of cookies
+	// and therefore not subject to CSRF checks
+	apiRouter := mux.NewRouter()
+	apiRouter.Use(instrument)
+	apiRouter.NotFoundHandler = http.HandlerFunc(httperror.NotFound)
+	apiRouter.MethodNotAllowedHandler = http.HandlerFunc(httperror.MethodNotAllowed)
+	api := apiRouter.PathPrefix("/api/v1").Subrouter()
+	// Batched operations go through the router again, past the
+	// authentication their batch went through, each one taken from the
+	// rate limit like a request of its own
+	batchC := controllers.NewBatchController(apiLimitMw.Apply(idempotencyMw.Apply(apiRouter)))
+
+	api.HandleFunc("/openapi.json", openapiC.Document).Methods("GET")
+	api.HandleFunc("/batch", batchC.Batch).Methods("POST")
+	api.HandleFunc("/sync", syncC.Sync).Methods("GET")
+	api.HandleFunc("/search", searchC.Search).Methods("GET")
+	api.HandleFunc("/keys", loginLimitMw.ApplyFn(apiC.CreateKey)).Methods("POST")
+	api.HandleFunc("/users", loginLimitMw.ApplyFn(apiC.CreateUser)).Methods("POST")
+	api.HandleFunc("/users/me", apiC.Me).Methods("GET")
+	api.HandleFunc("/users/me/guest", apiC.ClaimGuest).Methods("POST")
+	api.HandleFunc("/users/me/referrals", referralsC.Referrals).Methods("GET")
+	api.HandleFunc("/users/me/usage", usageC.Usage).Methods("GET")
+	api.HandleFunc("/users/me/username", apiC.SetUsername).Methods("PUT")
+	api.HandleFunc("/users/me/verify", apiC.VerifyEmail).Methods("POST")
+	api.HandleFunc("/users/me/verify/resend", apiC.ResendVerification).Methods("POST")
+	api.HandleFunc("/users/me/notifications", notificationsC.Settings).Methods("GET")
+	api.HandleFunc("/users/me/notifications", notificationsC.UpdateSettings).Methods("PUT")
+	api.HandleFunc("/users/me/policies", policiesC.Policies).Methods("GET")
+	api.HandleFunc("/users/me/policies", policiesC.AcceptPolicies).Methods("POST")
+	api.HandleFunc("/users/me/preferences", preferencesC.Preferences).Methods("GET")
+	api.HandleFunc("/users/me/preferences", preferencesC.UpdatePreferences).Methods("PUT")
+	api.HandleFunc("/users/me/sessions", sessionsC.List).Methods("GET")
+	api.HandleFunc("/users/me/sessions", sessionsC.DeleteOthers).Methods("DELETE")
+	api.HandleFunc("/users/me/sessions/{id:[0-9]+}", sessionsC.Delete).Methods("DELETE")
+	api.HandleFunc("/users/me/profile", profilesC.Settings).Methods("GET")
+	api.HandleFunc("/users/me/profile", profilesC.UpdateSettings).Methods("PUT")
+	api.HandleFunc("/users/me/calendar", calendarC.CalendarFeed).Methods("GET")
+	api.HandleFunc("/users/me/calendar/reset", calendarC.ResetCalendarFeed).Methods("POST")
+	api.HandleFunc("/users/me/avatar", uploadsC.Avatar).Methods("GET")
+	api.HandleFunc("/users/me/avatar", uploadsC.SetAvatar).Methods("PUT")
+	api.HandleFunc("/users/me/avatar", uploadsC.DeleteAvatar).Methods("DELETE")
+	api.HandleFunc("/stocklists", apiC.Stocklists).Methods("GET")
+	api.HandleFunc("/stocklists", apiC.CreateStocklist).Methods("POST")
+	api.HandleFunc("/stocklists/export.csv", apiC.ExportStocklists).Methods("GET")
+	api.HandleFunc("/stocklists/{id:[0-9]+}", apiC.Stocklist).Methods("GET")
+	api.HandleFunc("/stocklists/{id:[0-9]+}", apiC.UpdateStocklist).Methods("PUT")
+	api.HandleFunc("/stocklists/{id:[0-9]+}", apiC.DeleteStocklist).Methods("DELETE")
+	api.HandleFunc("/stocklists/{id:[0-9]+}/attachments",
+		uploadsC.Attachments).Methods("GET")
+	api.HandleFunc("/stocklists/{id:[0-9]+}/attachments",
+		uploadsC.CreateAttachment).Methods("POST")
+	api.HandleFunc("/stocklists/{id:[0-9]+}/attachments/{aid:[0-9]+}",
+		uploadsC.Attachment).Methods("GET")
+	api.HandleFunc("/stocklists/{id:[0-9]+}/attachments/{aid:[0-9]+}",
+		uploadsC.DeleteAttachment).Methods("DELETE")
+	api.HandleFunc("/orgs", orgsC.Organizations).Methods("GET")
+	api.HandleFunc("/orgs", orgsC.Create).Methods("POST")
+	api.HandleFunc("/orgs/invites/accept", orgsC.AcceptInvite).Methods("POST")
+	api.HandleFunc("/orgs/{id:[0-9]+}", orgsC.Organization).Methods("GET")
+	api.HandleFunc("/orgs/{id:[0-9]+}", orgsC.Update).Methods("PUT")
+	api.HandleFunc("/orgs/{id:[0-9]+}/members", orgsC.Members).Methods("GET")
+	api.HandleFunc("/orgs/{id:[0-9]+}/members/{uid:[0-9]+}", orgsC.SetRole).Methods("PUT")
+	api.HandleFunc("/orgs/{id:[0-9]+}/members/{uid:[0-9]+}",
+		orgsC.RemoveMember).Methods("DELETE")
+	api.HandleFunc("/orgs/{id:[0-9]+}/invites", orgsC.Invites).Methods("GET")
+	api.HandleFunc("/orgs/{id:[0-9]+}/invites", orgsC.Invite).Methods("POST")
+	api.HandleFunc("/orgs/{id:[0-9]+}/invites/{iid:[0-9]+}",
+		orgsC.RevokeInvite).Methods("DELETE")
+	api.HandleFunc("/orgs/{id:[0-9]+}/stocklists", orgsC.Stocklists).Methods("GET")
+	api.HandleFunc("/orgs/{id:[0-9]+}/stocklists", orgsC.CreateStocklist).Methods("POST")
+	api.HandleFunc("/guests", loginLimitMw.ApplyFn(guestsC.Create)).Methods("POST")
+	api.HandleFunc("/guest/stocklists", guestsC.Stocklists).Methods("GET")
+	api.HandleFunc("/guest/stocklists", guestsC.CreateStocklist).Methods("POST")
+	api.HandleFunc("/guest/stocklists/{id:[0-9]+}", guestsC.DeleteStocklist).Methods("DELETE")
+	api.HandleFunc("/notifications/stream", notificationsC.Stream).Methods("GET")
+	api.HandleFunc("/admin/maintenance",
+		requireAdminMw.ApplyFn(adminC.Maintenance)).Methods("GET")
+	api.HandleFunc("/admin/maintenance",
+		requireAdminMw.ApplyFn(adminC.SetMaintenance)).Methods("PUT")
+	api.HandleFunc("/admin/blocked-domains",
+		requireAdminMw.ApplyFn(adminC.BlockedDomains)).Methods("GET")
+	api.HandleFunc("/admin/blocked-domains",
+		requireAdminMw.ApplyFn(adminC.BlockDomains)).Methods("POST")
+	api.HandleFunc("/admin/blocked-domains/{domain}",
+		requireAdminMw.ApplyFn(adminC.UnblockDomain)).Methods("DELETE")
+	api.HandleFunc("/mail/events", mailC.Events).Methods("POST")
+	api.HandleFunc("/billing", billingC.Billing).Methods("GET")
+	api.HandleFunc("/billing/checkout", billingC.Checkout).Methods("POST")
+	api.HandleFunc("/billing/stripe", billingC.StripeEvents).Methods("POST")
+	api.HandleFunc("/webhooks", webhooksC.Webhooks).Methods("GET")
+	api.HandleFunc("/webhooks", webhooksC.CreateWebhook).Methods("POST")
+	api.HandleFunc("/webhooks/{id:[0-9]+}", webhooksC.DeleteWebhook).Methods("DELETE")
+	api.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", webhooksC.Deliveries).Methods("GET")
+	// GraphQL lives outside /api/v1 but is authenticated like the API
+	apiRouter.HandleFunc("/graphql", graphqlC.Serve).Methods("GET", "POST")
+
+	root := mux.NewRouter()
+	root.PathPrefix(assets.Prefix).Handler(assets.Handler()).Methods("GET", "HEAD")
+	apiChain := corsMw.Apply(apiKeyMw.Apply(maintenanceMw.Apply(apiLimitMw.Apply(usageMw.Apply(idempotencyMw.Apply(apiRouter))))))
+	root.PathPrefix("/api/").Handler(apiChain)
+	root.Handle("/graphql", apiChain)
+	if scimC != nil {
+		// SCIM is authenticated by the provider's token, not cookies
+		scimRouter := mux.NewRouter()
+		scimRouter.Use(instrument)
+		scimRouter.NotFoundHandler = http.HandlerFunc(scimC.NotFound)
+		scimRouter.MethodNotAllowedHandler = http.HandlerFunc(httperror.MethodNotAllowed)
+		s := scimRouter.PathPrefix("/scim/v2").Subrouter()
+		s.HandleFunc("/Users", scimC.Authorize(scimC.Users)).Methods("GET")
+		s.HandleFunc("/Users", scimC.Authorize(scimC.CreateUser)).Methods("POST")
+		s.HandleFunc("/Users/{id:[0-9]+}", scimC.Authorize(scimC.User)).Methods("GET")
+		s.HandleFunc("/Users/{id:[0-9]+}", scimC.Authorize(scimC.ReplaceUser)).Methods("PUT")
+		s.HandleFunc("/Users/{id:[0-9]+}", scimC.Authorize(scimC.PatchUser)).Methods("PATCH")
+		s.HandleFunc("/Users/{id:[0-9]+}", scimC.Authorize(scimC.DeleteUser)).Methods("DELETE")
+		root.PathPrefix("/scim/").Handler(apiLimitMw.Apply(scimRouter))
+	}
+	root.PathPrefix("/").Handler(
+		csrfMw.Apply(userMw.Apply(localeMw.Apply(maintenanceMw.Apply(policiesMw.Apply(router))))))
+
+	// Internal listener for operational endpoints
+	checker := health.NewChecker()
+	checker.Register("database", services.Ping)
+	checker.Register("migrations", services.CheckMigrations)
+	// Fail readiness while shutting down, so load balancers send new
+	// requests elsewhere
+	var shuttingDown atomic.Bool
+	checker.Register("shutdown", func(ctx context.Context) error {
+		if shuttingDown.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	})
+
+	internal := mux.NewRouter()
+	internal.HandleFunc("/healthz", checker.Healthz).Methods("GET")
+	internal.HandleFunc("/readyz", checker.Readyz).Methods("GET")
+	internal.Handle("/metrics", metrics.Handler()).Methods("GET")
+	internal.HandleFunc("/loglevel", log.LevelHandler).Methods("GET", "PUT")
+	// Profiles, e.g. go tool pprof http://localhost:8502/debug/pprof/heap
+	// or gastbctl profile heap
+	internal.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	internal.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	internal.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	internal.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	internal.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	metrics.CollectRuntime(runtimeMetricsInterval)
+	stopStatsD := func() {}
+	if cfg.StatsD.Addr != "" {
+		stopStatsD, err = metrics.Default.PushStatsD(cfg.StatsD)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// Other backend services create users and read stocklists over gRPC
+	var internalHandler http.Handler = internal
+	if cfg.RPCToken != "" {
+		rpcSrv := rpc.NewServer(services.UserService, services.StocklistService, cfg.RPCToken)
+		rpcSrv.SetHooks(hooks)
+		internalHandler = rpcSrv.Handler(internal)
+	}
+	internalSrv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.InternalPort),
+		Handler: internalHandler,
+	}
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: tracingMw.Apply(logMw.Apply(recoverMw.Apply(secureMw.Apply(compressMw.Apply(root))))),
+	}
+	// End any notification streams left after draining, or they would
+	// hold up shutdown
+	srv.RegisterOnShutdown(hub.Close)
+	for _, s := range []*http.Server{internalSrv, srv} {
+		go func(s *http.Server) {
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("server stopped", "addr", s.Addr, "error", err)
+				os.Exit(1)
+			}
+		}(s)
+	}
 
-	http.ListenAndServe(fmt.Sprintf(":%d",cfg.Port), router)
+	// Shut down gracefully on SIGINT or SIGTERM: stop accepting requests
+	// and jobs, then wait for those in flight
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	logger.Info("shutting down")
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Lame duck: while still serving requests, end notification streams
+	// over part of the deadline, asking clients to reconnect, so they
+	// move to other instances gradually
+	drainCtx, cancelDrain := context.WithTimeout(ctx, streamDrainTimeout)
+	hub.Drain(drainCtx)
+	cancelDrain()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("shutting down server", "error", err)
+	}
+	scheduler.Stop()
+	stopRelay()
+	if publisher != nil {
+		publisher.Close()
+	}
+	if err := queue.Shutdown(ctx); err != nil {
+		logger.Error("shutting down job queue", "error", err)
+	}
+	internalSrv.Shutdown(ctx)
+	if err := stopUsage(); err != nil {
+		logger.Error("flushing API usage", "error", err)
+	}
+	// Push the counts of the last requests and jobs
+	stopStatsD()
 }
+
+// How long in-flight requests and jobs get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// How long notification streams are drained for on shutdown, out of
+// shutdownTimeout
+const streamDrainTimeout = 10 * time.Second
+
+// How often API usage counted in memory is written to the database
+const usageFlushInterval = 10 * time.Second
+
+// How often heap, GC and goroutine metrics are updated
+const runtimeMetricsInterval = 15 * time.Second
@@ -0,0 +1,395 @@
+package metrics
+
+// The metrics package keeps counters, gauges and histograms that other
+// subsystems register into, and exposes them in the Prometheus text format
+// or pushes them to a StatsD agent.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets, in seconds, suited to request and
+// query latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is implemented by every metric type
+type collector interface {
+	name() string
+	write(w io.Writer)
+	samples() []sample
+}
+
+// sample is one value of a metric, named as in the text format, for
+// exporters other than Prometheus. labels are name, value pairs.
+type sample struct {
+	name   string
+	labels []string
+	value  float64
+	// cumulative values only go up, like counters and histogram buckets
+	cumulative bool
+}
+
+// Registry holds metrics by name
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default is the registry used by the package level constructors
+var Default = NewRegistry()
+
+// register adds c to the registry, or returns the collector already
+// registered under the same name
+func (reg *Registry) register(c collector) collector {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if existing, ok := reg.collectors[c.name()]; ok {
+		return existing
+	}
+	reg.collectors[c.name()] = c
+	return c
+}
+
+// sorted returns the registered collectors by name
+func (reg *Registry) sorted() []collector {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	names := make([]string, 0, len(reg.collectors))
+	for name := range reg.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = reg.collectors[name]
+	}
+	return collectors
+}
+
+// WriteText writes every metric in the Prometheus text exposition format
+func (reg *Registry) WriteText(w io.Writer) {
+	for _, c := range reg.sorted() {
+		c.write(w)
+	}
+}
+
+// Handler serves the metrics of reg for Prometheus to scrape
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		reg.WriteText(w)
+	})
+}
+
+// Handler serves the metrics of the Default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+//
+// 1. Label handling shared by every metric type
+//
+
+type vec struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+// key joins label values into a map key, checking their number
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			v.metricName, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// labelString formats label pairs as {a="x",b="y"}, adding extra pairs
+// at the end
+func (v *vec) labelString(key string, extra ...string) string {
+	var values []string
+	if len(v.labels) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	var pairs []string
+	for i, label := range v.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", label, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelPairs returns label name, value pairs, adding extra pairs at the
+// end
+func (v *vec) labelPairs(key string, extra ...string) []string {
+	var pairs []string
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, v.labels[i], value)
+		}
+	}
+	return append(pairs, extra...)
+}
+
+func (v *vec) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, v.help, v.metricName, kind)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//
+// 2. Counters and gauges
+//
+
+// Counter is a value that only goes up, partitioned by labels
+type Counter struct {
+	vec
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates a counter and registers it in the Default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter creates a counter and registers it in reg. If a counter with
+// the same name exists, it is returned instead.
+func (reg *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		vec:    vec{metricName: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+	return reg.register(c).(*Counter)
+}
+
+// Inc adds one to the counter for the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the counter for the given
+// label values
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+func (c *Counter) samples() []sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var s []sample
+	for _, key := range sortedKeys(c.values) {
+		s = append(s, sample{c.metricName, c.labelPairs(key), c.values[key], true})
+	}
+	return s
+}
+
+// Gauge is a value that can go up and down, partitioned by labels
+type Gauge struct {
+	vec
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge creates a gauge and registers it in the Default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewGauge creates a gauge and registers it in reg. If a gauge with the
+// same name exists, it is returned instead.
+func (reg *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		vec:    vec{metricName: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+	return reg.register(g).(*Gauge)
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.mu.Lock()
+	g.values[key] = value
+	g.mu.Unlock()
+}
+
+// Add adds delta to the gauge for the given label values
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.mu.Lock()
+	g.values[key] += delta
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelString(key), formatFloat(g.values[key]))
+	}
+}
+
+func (g *Gauge) samples() []sample {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var s []sample
+	for _, key := range sortedKeys(g.values) {
+		s = append(s, sample{g.metricName, g.labelPairs(key), g.values[key], false})
+	}
+	return s
+}
+
+//
+// 3. Histograms
+//
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations, such as latencies, in buckets,
+// partitioned by labels
+type Histogram struct {
+	vec
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// NewHistogram creates a histogram and registers it in the Default
+// registry. Nil buckets means DefaultBuckets.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram creates a histogram and registers it in reg. If a histogram
+// with the same name exists, it is returned instead.
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		vec:     vec{metricName: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	return reg.register(h).(*Histogram)
+}
+
+// Observe adds an observation for the given label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += value
+	hv.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName,
+				h.labelString(key, "le", formatFloat(upper)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName,
+			h.labelString(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(key), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(key), hv.count)
+	}
+}
+
+func (h *Histogram) samples() []sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var s []sample
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, upper := range h.buckets {
+			s = append(s, sample{h.metricName + "_bucket",
+				h.labelPairs(key, "le", formatFloat(upper)), float64(hv.counts[i]), true})
+		}
+		s = append(s,
+			sample{h.metricName + "_bucket", h.labelPairs(key, "le", "+Inf"), float64(hv.count), true},
+			sample{h.metricName + "_sum", h.labelPairs(key), hv.sum, true},
+			sample{h.metricName + "_count", h.labelPairs(key), float64(hv.count), true})
+	}
+	return s
+}
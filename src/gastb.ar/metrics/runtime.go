@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+// gcPauseBuckets are histogram buckets, in seconds, suited to GC pauses
+var gcPauseBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1}
+
+var (
+	goroutines = NewGauge("go_goroutines", "Number of goroutines.")
+	heapAlloc  = NewGauge("go_heap_alloc_bytes", "Bytes of allocated heap objects.")
+	heapInuse  = NewGauge("go_heap_inuse_bytes", "Bytes in in-use heap spans.")
+	heapObjs   = NewGauge("go_heap_objects", "Number of allocated heap objects.")
+	sysBytes   = NewGauge("go_sys_bytes", "Bytes of memory obtained from the OS.")
+	gcCycles   = NewCounter("go_gc_cycles_total", "Completed GC cycles.")
+	gcPauses   = NewHistogram("go_gc_pause_seconds", "Stop-the-world GC pauses.", gcPauseBuckets)
+)
+
+// CollectRuntime updates the go_* metrics of the Default registry every
+// interval until the returned function is called. GC pauses are observed
+// as they are found, so those of more than 256 cycles between two
+// updates are lost; the cycles are still counted.
+func CollectRuntime(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		var lastGC uint32
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			lastGC = collectRuntime(lastGC)
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// collectRuntime reads the runtime statistics and returns the number of
+// GC cycles they covered
+func collectRuntime(lastGC uint32) uint32 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	goroutines.Set(float64(runtime.NumGoroutine()))
+	heapAlloc.Set(float64(ms.HeapAlloc))
+	heapInuse.Set(float64(ms.HeapInuse))
+	heapObjs.Set(float64(ms.HeapObjects))
+	sysBytes.Set(float64(ms.Sys))
+
+	gcCycles.Add(float64(ms.NumGC - lastGC))
+	// PauseNs is a ring of the latest 256 pauses, the latest at
+	// (NumGC+255)%256
+	first := lastGC
+	if ms.NumGC-first > uint32(len(ms.PauseNs)) {
+		first = ms.NumGC - uint32(len(ms.PauseNs))
+	}
+	for i := first; i < ms.NumGC; i++ {
+		gcPauses.Observe(time.Duration(ms.PauseNs[i%uint32(len(ms.PauseNs))]).Seconds())
+	}
+	return ms.NumGC
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// value returns the sample of c named name, or 0 if it wasn't set yet
+func value(c collector, name string) float64 {
+	for _, s := range c.samples() {
+		if s.name == name {
+			return s.value
+		}
+	}
+	return 0
+}
+
+func TestCollectRuntime(t *testing.T) {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	cycles := value(gcCycles, "go_gc_cycles_total")
+	pauses := value(gcPauses, "go_gc_pause_seconds_count")
+
+	// Only the cycles after the one it was last run at are new
+	last := collectRuntime(ms.NumGC - 1)
+	if last < ms.NumGC {
+		t.Errorf("collectRuntime returned %d, want at least %d", last, ms.NumGC)
+	}
+	newCycles := float64(last - (ms.NumGC - 1))
+	if got := value(gcCycles, "go_gc_cycles_total") - cycles; got != newCycles {
+		t.Errorf("go_gc_cycles_total went up by %v, want %v", got, newCycles)
+	}
+	if got := value(gcPauses, "go_gc_pause_seconds_count") - pauses; got != newCycles {
+		t.Errorf("%v pauses observed, want %v", got, newCycles)
+	}
+	if got := value(goroutines, "go_goroutines"); got < 1 {
+		t.Errorf("go_goroutines = %v", got)
+	}
+	for _, g := range []*Gauge{heapAlloc, heapInuse, heapObjs, sysBytes} {
+		if got := value(g, g.metricName); got <= 0 {
+			t.Errorf("%s = %v", g.metricName, got)
+		}
+	}
+}
+
+func TestCollectRuntimeLostPauses(t *testing.T) {
+	// Of more than 256 cycles, only the pauses still in the ring are
+	// observed, but every cycle is counted
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for i := ms.NumGC; i < 300; i++ {
+		runtime.GC()
+	}
+	cycles := value(gcCycles, "go_gc_cycles_total")
+	pauses := value(gcPauses, "go_gc_pause_seconds_count")
+	last := collectRuntime(0)
+	if got := value(gcCycles, "go_gc_cycles_total") - cycles; got != float64(last) {
+		t.Errorf("go_gc_cycles_total went up by %v, want %d", got, last)
+	}
+	if got := value(gcPauses, "go_gc_pause_seconds_count") - pauses; got != 256 {
+		t.Errorf("%v pauses observed, want the 256 of the ring", got)
+	}
+}
+
+func TestCollectRuntimeStops(t *testing.T) {
+	before := runtime.NumGoroutine()
+	stop := CollectRuntime(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	stop()
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatal("the collecting goroutine kept running after stop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// StatsDConfig configures pushing metrics to a StatsD or DogStatsD agent,
+// for infrastructure that doesn't scrape Prometheus
+type StatsDConfig struct {
+	// Addr is the agent's UDP host:port, e.g. localhost:8125; empty
+	// turns pushing off
+	Addr string
+	// DogStatsD sends labels as DogStatsD tags. Plain StatsD has no
+	// labels, so their values are appended to the metric name instead,
+	// e.g. http_requests_total.GET.200.
+	DogStatsD bool
+	// Interval is how often metrics are pushed; it defaults to 10s
+	Interval time.Duration
+}
+
+// statsdPacketSize keeps packets under the MTU of most networks, as
+// StatsD agents expect
+const statsdPacketSize = 1432
+
+// statsdReplacer replaces the characters that are part of the StatsD
+// line syntax in names, tags and label values
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_",
+	",", "_", "\n", "_", " ", "_")
+
+// statsd pushes the metrics of a registry. Counters and histograms are
+// sent as StatsD counters of how much they went up since the last push,
+// and gauges as gauges, under the names of the text format.
+type statsd struct {
+	reg  *Registry
+	conn net.Conn
+	dog  bool
+	// last holds the values of cumulative samples at the last push
+	last map[string]float64
+}
+
+// PushStatsD sends the metrics of reg to a StatsD agent every
+// cfg.Interval, until the returned function is called, which pushes them
+// a last time. Metrics that fail to send are logged and sent in the next
+// push.
+func (reg *Registry) PushStatsD(cfg StatsDConfig) (stop func(), err error) {
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	s := &statsd{reg: reg, conn: conn, dog: cfg.DogStatsD, last: make(map[string]float64)}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				s.push()
+				conn.Close()
+				return
+			}
+			s.push()
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}, nil
+}
+
+// push sends every sample, batching lines into packets
+func (s *statsd) push() {
+	var packet bytes.Buffer
+	var sent map[string]float64
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			slog.Warn("pushing metrics to StatsD failed", "error", err)
+		} else {
+			for id, v := range sent {
+				s.last[id] = v
+			}
+		}
+		packet.Reset()
+		sent = make(map[string]float64)
+	}
+	sent = make(map[string]float64)
+	for _, c := range s.reg.sorted() {
+		for _, smp := range c.samples() {
+			name, tags := s.format(smp)
+			var lines []string
+			if smp.cumulative {
+				id := name + tags
+				delta := smp.value - s.last[id]
+				if delta <= 0 {
+					continue
+				}
+				sent[id] = smp.value
+				lines = []string{name + ":" + formatFloat(delta) + "|c" + tags}
+			} else {
+				if smp.value < 0 && !s.dog {
+					// A signed value would change a plain StatsD gauge
+					// by that much rather than set it
+					lines = append(lines, name+":0|g")
+				}
+				lines = append(lines, name+":"+formatFloat(smp.value)+"|g"+tags)
+			}
+			for _, line := range lines {
+				if packet.Len()+len(line)+1 > statsdPacketSize {
+					send()
+				}
+				packet.WriteString(line)
+				packet.WriteByte('\n')
+			}
+		}
+	}
+	send()
+}
+
+// format returns the StatsD name of a sample and its DogStatsD tags, if
+// any
+func (s *statsd) format(smp sample) (name, tags string) {
+	name = statsdReplacer.Replace(smp.name)
+	if len(smp.labels) == 0 {
+		return name, ""
+	}
+	var pairs []string
+	for i := 0; i+1 < len(smp.labels); i += 2 {
+		value := statsdReplacer.Replace(smp.labels[i+1])
+		if s.dog {
+			pairs = append(pairs, smp.labels[i]+":"+value)
+		} else {
+			name += "." + strings.ReplaceAll(value, ".", "_")
+		}
+	}
+	if !s.dog {
+		return name, ""
+	}
+	return name, "|#" + strings.Join(pairs, ",")
+}
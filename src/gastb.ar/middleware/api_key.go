@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"gastb.ar/context"
+	"gastb.ar/models"
+)
+
+// APIKey authenticates JSON API requests. It looks up the user owning the
+// key sent in an "Authorization: Bearer <key>" header and adds them to the
+// request context. API requests are never authenticated by cookies.
+type APIKey struct {
+	*models.APIKeyService
+	*models.UserService
+}
+
+// ApplyFn takes in a handler function and returns a handler function that
+// adds the key's owner to the request context before calling it.
+// Requests without a valid API key are passed on unchanged.
+func (mw *APIKey) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := bearerToken(r)
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		apiKey, err := mw.APIKeyService.ByKey(key)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		user, err := mw.UserService.ByID(apiKey.UserID)
+		if err != nil || user.ResetRequired || user.IsDeactivated() {
+			next(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		ctx = context.WithUser(ctx, user)
+		ctx = context.WithAPIKey(ctx, apiKey)
+		ctx = withLoggedUser(ctx, user.ID)
+		r = r.WithContext(ctx)
+
+		next(w, r)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *APIKey) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// bearerToken returns the token in the Authorization header of a request,
+// or an empty string if there is none
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
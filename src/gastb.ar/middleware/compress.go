@@ -0,0 +1,259 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Default settings of the Compress middleware
+const (
+	DefaultCompressMinSize = 1024
+)
+
+// DefaultCompressTypes are the content types compressed when Compress has
+// no ContentTypes of its own
+var DefaultCompressTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/csv",
+	"application/javascript",
+	"application/json",
+	"image/svg+xml",
+}
+
+// Compress compresses responses with brotli or gzip, whichever the client
+// prefers, if they are at least MinSize bytes long and of one of the
+// ContentTypes.
+type Compress struct {
+	MinSize      int
+	ContentTypes []string
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in response
+// compression
+func (mw *Compress) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			mw:             mw,
+			encoding:       encoding,
+			status:         http.StatusOK,
+		}
+		defer cw.close()
+		next(cw, r)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Compress) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Compress) minSize() int {
+	if mw.MinSize <= 0 {
+		return DefaultCompressMinSize
+	}
+	return mw.MinSize
+}
+
+func (mw *Compress) compressible(contentType string) bool {
+	types := mw.ContentTypes
+	if types == nil {
+		types = DefaultCompressTypes
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks "br" or "gzip" from an Accept-Encoding header,
+// preferring brotli on ties, or returns an empty string for neither
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name != "br" && name != "gzip" || q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && name == "br" {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+var (
+	gzipPool = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	}}
+	brotliPool = sync.Pool{New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+	}}
+)
+
+// encoder is implemented by both gzip and brotli writers
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressWriter buffers the start of a response until it knows whether
+// it is worth compressing, then either streams it through an encoder or
+// passes it on untouched
+type compressWriter struct {
+	http.ResponseWriter
+	mw       *Compress
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	enc      encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		return
+	}
+	cw.status = status
+	// Responses without a body are sent right away.
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.mw.minSize() {
+			return len(b), nil
+		}
+		cw.decide(true)
+		if err := cw.writeBuffered(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressed or not, and sets up the encoder
+func (cw *compressWriter) decide(bigEnough bool) {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if bigEnough && h.Get("Content-Encoding") == "" &&
+		cw.mw.compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if cw.encoding == "br" {
+			cw.enc = brotliPool.Get().(*brotli.Writer)
+		} else {
+			cw.enc = gzipPool.Get().(*gzip.Writer)
+		}
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) writeBuffered() error {
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends whatever has been written so far, compressing it if the
+// response is compressible, since streaming handlers can not wait for
+// MinSize bytes
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+		cw.writeBuffered()
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket upgrades through the middleware
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		cw.decided = true
+		return hj.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// close finishes the response once the handler has returned
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if len(cw.buf) == 0 && cw.status == http.StatusOK {
+			// Nothing was written: let the server send its defaults.
+			cw.decided = true
+			return
+		}
+		cw.decide(false)
+		cw.writeBuffered()
+	}
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+	cw.enc.Reset(io.Discard)
+	if cw.encoding == "br" {
+		brotliPool.Put(cw.enc)
+	} else {
+		gzipPool.Put(cw.enc)
+	}
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets browser applications served from other origins call the
+// routes it wraps. Preflight requests are answered directly.
+type CORS struct {
+	// AllowedOrigins lists origins such as "https://app.example.com";
+	// "*" allows any origin
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials lets browsers send cookies and read responses
+	// to credentialed requests
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache preflight responses
+	MaxAge time.Duration
+}
+
+// allowed returns the value of the Access-Control-Allow-Origin header for
+// a request from origin, or an empty string if the origin is not allowed
+func (mw *CORS) allowed(origin string) string {
+	for _, o := range mw.AllowedOrigins {
+		if o == "*" {
+			// Browsers reject a wildcard on credentialed responses.
+			if mw.AllowCredentials {
+				return origin
+			}
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in CORS
+// handling
+func (mw *CORS) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		allowOrigin := mw.allowed(origin)
+
+		preflight := r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if allowOrigin == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.Set("Access-Control-Allow-Origin", allowOrigin)
+			h.Set("Access-Control-Allow-Methods", strings.Join(mw.AllowedMethods, ", "))
+			if len(mw.AllowedHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(mw.AllowedHeaders, ", "))
+			}
+			if mw.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if mw.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(mw.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowOrigin != "" {
+			h.Set("Access-Control-Allow-Origin", allowOrigin)
+			h.Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed, Retry-After, X-Request-ID")
+			if mw.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		next(w, r)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *CORS) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/csrf"
+)
+
+// CSRF rejects state-changing requests that don't carry the token of the
+// browser's CSRF cookie, which views put in forms with csrfField, or that
+// come from another origin.
+type CSRF struct {
+	// Key signs the CSRF cookie
+	Key []byte
+	// Prod means the site is served over HTTPS: the cookie is Secure,
+	// and requests without an Origin header need a Referer on the same
+	// HTTPS origin. Otherwise requests are checked as plain HTTP, as
+	// development servers take them.
+	Prod bool
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in the
+// CSRF checks
+func (mw *CSRF) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.Apply(next)
+}
+
+// Apply takes in a handler and returns it wrapped in the CSRF checks
+func (mw *CSRF) Apply(next http.Handler) http.HandlerFunc {
+	protected := csrf.Protect(mw.Key, csrf.Secure(mw.Prod))(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The csrf package takes every request as HTTPS unless told
+		// otherwise, since the server can't tell behind a proxy
+		if !mw.Prod {
+			r = csrf.PlaintextHTTPRequest(r)
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/csrf"
+)
+
+// csrfInput matches the value of the hidden input csrfField renders
+var csrfInput = regexp.MustCompile(`value="([^"]+)"`)
+
+// csrfSession gets a form from h as a new browser would, and returns
+// its cookies and the token of the form
+func csrfSession(t *testing.T, h http.Handler) ([]*http.Cookie, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/form", nil))
+	m := csrfInput.FindStringSubmatch(rec.Body.String())
+	if rec.Code != http.StatusOK || m == nil {
+		t.Fatalf("GET /form: status %d, body %s", rec.Code, rec.Body)
+	}
+	return rec.Result().Cookies(), m[1]
+}
+
+func TestCSRF(t *testing.T) {
+	form := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			io.WriteString(w, string(csrf.TemplateField(r)))
+		}
+	})
+	type request struct {
+		token   string // "own", "other", "tampered" or none
+		cookies bool
+		origin  string
+		referer string
+	}
+	cases := []struct {
+		name string
+		prod bool
+		req  request
+		want int
+	}{
+		{"dev: token", false, request{"own", true, "", ""}, http.StatusOK},
+		{"dev: same origin", false, request{"own", true, "http://gastb.ar", ""}, http.StatusOK},
+		{"dev: no token", false, request{"", true, "", ""}, http.StatusForbidden},
+		{"dev: no cookie", false, request{"own", false, "", ""}, http.StatusForbidden},
+		{"dev: token of another session", false, request{"other", true, "", ""}, http.StatusForbidden},
+		{"dev: tampered token", false, request{"tampered", true, "", ""}, http.StatusForbidden},
+		{"dev: other origin", false, request{"own", true, "http://evil.example.com", ""}, http.StatusForbidden},
+
+		{"prod: same origin", true, request{"own", true, "https://gastb.ar", ""}, http.StatusOK},
+		{"prod: same origin referer", true, request{"own", true, "", "https://gastb.ar/form"}, http.StatusOK},
+		{"prod: no token", true, request{"", true, "https://gastb.ar", ""}, http.StatusForbidden},
+		{"prod: token of another session", true, request{"other", true, "https://gastb.ar", ""}, http.StatusForbidden},
+		{"prod: other origin", true, request{"own", true, "https://evil.example.com", ""}, http.StatusForbidden},
+		{"prod: plain HTTP origin", true, request{"own", true, "http://gastb.ar", ""}, http.StatusForbidden},
+		{"prod: other referer", true, request{"own", true, "", "https://evil.example.com/"}, http.StatusForbidden},
+		{"prod: plain HTTP referer", true, request{"own", true, "", "http://gastb.ar/form"}, http.StatusForbidden},
+		{"prod: no origin or referer", true, request{"own", true, "", ""}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mw := &CSRF{Key: []byte("0123456789abcdef0123456789abcdef"), Prod: c.prod}
+			h := mw.Apply(form)
+			cookies, token := csrfSession(t, h)
+			_, other := csrfSession(t, h)
+			switch c.req.token {
+			case "other":
+				token = other
+			case "tampered":
+				token = token[:len(token)-4] + "AAA="
+			case "":
+				token = ""
+			}
+			body := url.Values{}
+			if token != "" {
+				body.Set("gorilla.csrf.Token", token)
+			}
+			// The server only sees paths and the Host header, whatever
+			// the scheme clients used
+			r := httptest.NewRequest("POST", "/form", strings.NewReader(body.Encode()))
+			r.Host = "gastb.ar"
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if c.req.cookies {
+				for _, cookie := range cookies {
+					r.AddCookie(cookie)
+				}
+			}
+			if c.req.origin != "" {
+				r.Header.Set("Origin", c.req.origin)
+			}
+			if c.req.referer != "" {
+				r.Header.Set("Referer", c.req.referer)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != c.want {
+				t.Errorf("POST: status %d, want %d", rec.Code, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"gastb.ar/context"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+)
+
+const (
+	// IdempotencyKeyHeader is the header clients send a key of their
+	// choosing in, the same on every attempt of a request
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed from a
+	// previous attempt
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKey is how long a key can be
+const maxIdempotencyKey = 255
+
+// maxFingerprintBody is how much of a request's body its fingerprint
+// covers; larger bodies, such as uploads, are told apart by their length
+const maxFingerprintBody = 1 << 20
+
+// Idempotency makes POST requests of authenticated users safe to retry:
+// the response to the first request with an Idempotency-Key is stored,
+// and later requests with the same key get it again instead of being
+// handled. Keys are per user, and kept for the service's retention.
+// Server errors aren't stored, so those requests can be retried.
+type Idempotency struct {
+	*models.IdempotencyKeyService
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in the
+// idempotency check
+func (mw *Idempotency) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		user := context.User(r.Context())
+		if key == "" || user == nil || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			httperror.Render(w, r, http.StatusBadRequest,
+				"Idempotency-Key must be at most "+strconv.Itoa(maxIdempotencyKey)+" characters")
+			return
+		}
+		fingerprint, err := fingerprintRequest(r)
+		if err != nil {
+			httperror.Render(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		stored, err := mw.Begin(user.ID, key, fingerprint)
+		switch err {
+		case nil:
+		case models.ErrIdempotencyKeyReused:
+			httperror.Render(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was used for a different request")
+			return
+		case models.ErrIdempotencyInProgress:
+			httperror.Render(w, r, http.StatusConflict, "a request with this Idempotency-Key is in progress")
+			return
+		default:
+			slog.ErrorContext(r.Context(), "claiming idempotency key failed", "error", err)
+			httperror.Render(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if stored.Done() {
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		cw := &cacheWriter{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		// A panicking handler must not leave the key claimed
+		defer func() {
+			if !completed {
+				if err := mw.Release(stored); err != nil {
+					slog.ErrorContext(r.Context(), "releasing idempotency key failed", "error", err)
+				}
+			}
+		}()
+		next(cw, r)
+		if cw.status >= http.StatusInternalServerError {
+			return
+		}
+		err = mw.Complete(stored, cw.status, w.Header().Get("Content-Type"), cw.buf.Bytes())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "storing idempotent response failed", "error", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Idempotency) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// fingerprintRequest hashes the method, URL and body of a request, and
+// puts back the part of the body it read
+func fingerprintRequest(r *http.Request) (string, error) {
+	head, err := io.ReadAll(io.LimitReader(r.Body, maxFingerprintBody))
+	if err != nil {
+		return "", err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	io.WriteString(h, strconv.FormatInt(r.ContentLength, 10)+"\n")
+	h.Write(head)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
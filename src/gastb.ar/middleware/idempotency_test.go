@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFingerprintRequest(t *testing.T) {
+	fingerprint := func(t *testing.T, method, target, body string) string {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		f, err := fingerprintRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The handler still gets the whole body
+		if got, _ := io.ReadAll(r.Body); string(got) != body {
+			t.Fatalf("body after fingerprinting = %q, want %q", got, body)
+		}
+		return f
+	}
+	first := fingerprint(t, "POST", "/api/v1/stocklists", `{"name":"Tech"}`)
+	long := strings.Repeat("x", maxFingerprintBody)
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		same   bool
+	}{
+		{"same request", "POST", "/api/v1/stocklists", `{"name":"Tech"}`, true},
+		{"different body", "POST", "/api/v1/stocklists", `{"name":"Energy"}`, false},
+		{"body with one more byte", "POST", "/api/v1/stocklists", `{"name":"Tech"} `, false},
+		{"empty body", "POST", "/api/v1/stocklists", "", false},
+		{"different path", "POST", "/api/v1/stocklists/1", `{"name":"Tech"}`, false},
+		{"different query", "POST", "/api/v1/stocklists?dry_run=1", `{"name":"Tech"}`, false},
+		{"different method", "PUT", "/api/v1/stocklists", `{"name":"Tech"}`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := fingerprint(t, c.method, c.target, c.body)
+			if (got == first) != c.same {
+				t.Errorf("fingerprint equal to the first request's: %v, want %v", got == first, c.same)
+			}
+		})
+	}
+	// Past the fingerprinted part, bodies are told apart by length
+	if fingerprint(t, "POST", "/", long+"a") == fingerprint(t, "POST", "/", long+"ab") {
+		t.Errorf("long bodies of different lengths share a fingerprint")
+	}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+
+	"gastb.ar/context"
+	"gastb.ar/i18n"
+)
+
+// Locale picks the language each request is answered in, from the
+// logged in user's profile or the Accept-Language header, and adds it to
+// the request context. It must run after the User middleware.
+type Locale struct{}
+
+// ApplyFn takes in a handler function and returns a handler function that
+// adds the negotiated language to the request context before calling it
+func (mw *Locale) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var preferred string
+		if user := context.User(r.Context()); user != nil {
+			preferred = user.Locale
+		}
+		locale := i18n.Negotiate(preferred, r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", locale)
+		w.Header().Add("Vary", "Accept-Language")
+		next(w, r.WithContext(context.WithLocale(r.Context(), locale)))
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Locale) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
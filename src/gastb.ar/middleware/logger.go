@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	ctxpkg "context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"gastb.ar/context"
+	"gastb.ar/errreport"
+	"gastb.ar/log"
+	"gastb.ar/rand"
+)
+
+// Header carrying the request ID, both ways
+const requestIDHeader = "X-Request-ID"
+
+// Number of random bytes in a generated request ID
+const requestIDBytes = 9
+
+// validRequestID matches request IDs we accept from upstream proxies
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9_\-=.]{1,64}$`)
+
+// Logger assigns every request an ID, stores it in the request context and
+// the X-Request-ID response header, and writes one access log record per
+// request once it has been served. Records logged with the request context
+// further down the chain carry the request ID as well.
+type Logger struct {
+	*slog.Logger
+}
+
+// logEntry collects what the access log line needs while the request is
+// handled further down the chain
+type logEntry struct {
+	userID uint
+}
+
+type logEntryKey struct{}
+
+// withLoggedUser records the ID of the user making a request, so that the
+// Logger middleware can include it even though it runs before the user is
+// known, and returns a context whose log records include it. Errors
+// reported for the request carry it too.
+func withLoggedUser(ctx ctxpkg.Context, id uint) ctxpkg.Context {
+	if entry, ok := ctx.Value(logEntryKey{}).(*logEntry); ok {
+		entry.userID = id
+	}
+	errreport.SetUser(ctx, id)
+	return log.WithAttrs(ctx, "user_id", id)
+}
+
+// statusRecorder is a ResponseWriter that remembers the status code and
+// number of bytes written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController
+// and errreport.SetCause
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in request ID
+// assignment and access logging
+func (mw *Logger) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id, _ = rand.String(requestIDBytes)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		entry := &logEntry{}
+		ctx := context.WithRequestID(r.Context(), id)
+		ctx = ctxpkg.WithValue(ctx, logEntryKey{}, entry)
+		ctx = log.WithAttrs(ctx, "request_id", id)
+		r = r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		mw.LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int("bytes", rec.bytes),
+			slog.Uint64("user_id", uint64(entry.userID)),
+		)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Logger) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
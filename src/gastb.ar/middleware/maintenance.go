@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gastb.ar/context"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+)
+
+// How long the maintenance setting is cached, so that it is not read
+// from the database on every request. Toggling it takes up to this long
+// to reach every instance.
+const maintenanceCacheTTL = 5 * time.Second
+
+// Seconds clients are told to wait in the Retry-After header
+const maintenanceRetryAfter = 300
+
+// Maintenance answers 503 Service Unavailable, with the maintenance
+// message as detail, to everyone but admins
+// while maintenance mode is on. The switch is the "maintenance" setting,
+// falling back to Default when it was never set. It must run after the
+// middleware authenticating users, and leaves the login routes alone so
+// that admins can still log in.
+type Maintenance struct {
+	Settings *models.SettingService
+	Default  bool
+
+	mu        sync.Mutex
+	on        bool
+	message   string
+	fetchedAt time.Time
+}
+
+// State returns whether maintenance mode is on and its message
+func (mw *Maintenance) State() (bool, string) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if time.Since(mw.fetchedAt) < maintenanceCacheTTL {
+		return mw.on, mw.message
+	}
+	on := mw.Default
+	value, err := mw.Settings.Get(models.SettingMaintenance)
+	switch err {
+	case nil:
+		on = value == "on"
+	case models.ErrNotFound:
+	default:
+		// Keep the previous state rather than failing every request
+		slog.Error("reading maintenance setting", "error", err)
+		return mw.on, mw.message
+	}
+	message, _ := mw.Settings.Get(models.SettingMaintenanceMessage)
+	mw.on, mw.message, mw.fetchedAt = on, message, time.Now()
+	return mw.on, mw.message
+}
+
+// Forget drops the cached state, so that a change made by this instance
+// applies immediately
+func (mw *Maintenance) Forget() {
+	mw.mu.Lock()
+	mw.fetchedAt = time.Time{}
+	mw.mu.Unlock()
+}
+
+// ApplyFn takes in a handler function and returns a handler function that
+// serves the maintenance page instead of calling it while maintenance
+// mode is on, unless the user is an admin
+func (mw *Maintenance) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		on, message := mw.State()
+		user := context.User(r.Context())
+		if !on || maintenanceExempt(r) || (user != nil && user.IsAdmin()) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", fmt.Sprint(maintenanceRetryAfter))
+		httperror.Render(w, r, http.StatusServiceUnavailable, message)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Maintenance) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// maintenanceExempt reports whether a request is let through during
+// maintenance for anyone, so that admins can log in
+func maintenanceExempt(r *http.Request) bool {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/login", "/logout", "/api/v1/keys":
+		return true
+	}
+	return false
+}
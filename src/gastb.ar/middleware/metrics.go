@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gastb.ar/metrics"
+	"gastb.ar/tracing"
+)
+
+var (
+	httpRequests = metrics.NewCounter("http_requests_total",
+		"Number of HTTP requests served.", "route", "method", "status")
+	httpDuration = metrics.NewHistogram("http_request_duration_seconds",
+		"Latency of HTTP requests.", nil, "route", "method", "status")
+)
+
+// Metrics counts and times requests by route and status. It must run after
+// routing (e.g. with mux.Router.Use) so that the route template is known,
+// which keeps the number of label values bounded.
+type Metrics struct{}
+
+// ApplyFn takes in a handler function and returns it wrapped in
+// instrumentation
+func (mw *Metrics) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := "unmatched"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		// The Tracing middleware runs before routing, so name its span here
+		span := tracing.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttr("http.route", route)
+
+		status := strconv.Itoa(rec.status)
+		httpRequests.Inc(route, r.Method, status)
+		httpDuration.Observe(time.Since(start).Seconds(), route, r.Method, status)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Metrics) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
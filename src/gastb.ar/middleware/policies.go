@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gastb.ar/context"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+	"gastb.ar/policies"
+)
+
+// ConsentPath is the page where users accept the current policies
+const ConsentPath = "/policies/accept"
+
+// Policies sends logged in users who haven't accepted the current
+// version of every policy document to the consent page, where they
+// come back from. Page views are redirected; other requests get 403
+// Forbidden. It must run after the User middleware, and leaves logging
+// out and the policy pages alone.
+type Policies struct {
+	Service   *models.PolicyService
+	Documents *policies.Set
+}
+
+// ApplyFn takes in a handler function and returns a handler function that
+// only calls it for users who accepted the current policies
+func (mw *Policies) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil || policiesExempt(r) {
+			next(w, r)
+			return
+		}
+		pending, err := mw.Service.Pending(user.ID, mw.Documents.Policies())
+		if err != nil {
+			// Don't lock everyone out while the database is struggling
+			slog.ErrorContext(r.Context(), "checking policy acceptance failed", "error", err)
+			next(w, r)
+			return
+		}
+		if len(pending) == 0 {
+			next(w, r)
+			return
+		}
+		if r.Method != http.MethodGet || httperror.WantsJSON(r) {
+			httperror.Render(w, r, http.StatusForbidden,
+				"Accept the updated policies at "+ConsentPath+" to continue.")
+			return
+		}
+		http.Redirect(w, r, ConsentPath+"?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(),
+			http.StatusFound)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Policies) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// policiesExempt reports whether a request is let through for users
+// with policies to accept
+func policiesExempt(r *http.Request) bool {
+	return r.URL.Path == "/logout" || strings.HasPrefix(r.URL.Path, "/policies/")
+}
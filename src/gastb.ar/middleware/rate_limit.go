@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"gastb.ar/context"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+	"gastb.ar/ratelimit"
+)
+
+// RateLimit throttles a group of routes with token buckets kept in Store.
+// Requests are limited per client IP address and, when the request context
+// holds a logged in user, per user as well. Rejected requests get a
+// 429 Too Many Requests response with a Retry-After header.
+type RateLimit struct {
+	Store ratelimit.Store
+	// Group namespaces the buckets, so that route groups sharing a Store
+	// are limited independently
+	Group   string
+	PerIP   ratelimit.Limit
+	PerUser ratelimit.Limit
+	// UserLimit, if set, returns the limit of a user instead of PerUser,
+	// for limits that depend on the user's plan
+	UserLimit func(user *models.User) ratelimit.Limit
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in the
+// rate limit checks
+func (mw *RateLimit) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := fmt.Sprintf("%s:ip:%s", mw.Group, clientIP(r))
+		ok, retryAfter, err := mw.Store.Take(key, mw.PerIP)
+		if err == nil && ok {
+			if user := context.User(r.Context()); user != nil {
+				key = fmt.Sprintf("%s:user:%d", mw.Group, user.ID)
+				limit := mw.PerUser
+				if mw.UserLimit != nil {
+					limit = mw.UserLimit(user)
+				}
+				ok, retryAfter, err = mw.Store.Take(key, limit)
+			}
+		}
+		if err != nil {
+			// Fail open: an unavailable store should not take the
+			// whole site down with it.
+			next(w, r)
+			return
+		}
+		if !ok {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			httperror.Render(w, r, http.StatusTooManyRequests, "")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *RateLimit) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// clientIP returns the IP address of the client that sent a request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
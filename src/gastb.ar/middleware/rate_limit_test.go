@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gastb.ar/context"
+	"gastb.ar/models"
+	"gastb.ar/ratelimit"
+)
+
+// failingStore is a ratelimit.Store that is down
+type failingStore struct{}
+
+func (failingStore) Take(key string, limit ratelimit.Limit) (bool, time.Duration, error) {
+	return false, 0, errors.New("store down")
+}
+
+func TestRateLimit(t *testing.T) {
+	ana, bob := &models.User{}, &models.User{}
+	ana.ID, bob.ID = 1, 2
+	type request struct {
+		remoteAddr string
+		forwarded  string
+		user       *models.User
+		status     int
+	}
+	cases := []struct {
+		name     string
+		mw       *RateLimit
+		requests []request
+	}{{
+		name: "per IP",
+		mw:   &RateLimit{PerIP: ratelimit.PerMinute(2)},
+		requests: []request{
+			{"192.0.2.1:1000", "", nil, http.StatusOK},
+			{"192.0.2.1:1001", "", nil, http.StatusOK},
+			{"192.0.2.1:1002", "", nil, http.StatusTooManyRequests},
+			{"192.0.2.2:1000", "", nil, http.StatusOK},
+		},
+	}, {
+		name: "forwarded headers don't change the IP",
+		mw:   &RateLimit{PerIP: ratelimit.PerMinute(1)},
+		requests: []request{
+			{"192.0.2.1:1000", "203.0.113.1", nil, http.StatusOK},
+			{"192.0.2.1:1000", "203.0.113.2", nil, http.StatusTooManyRequests},
+		},
+	}, {
+		name: "per user across IPs",
+		mw:   &RateLimit{PerIP: ratelimit.PerMinute(10), PerUser: ratelimit.PerMinute(1)},
+		requests: []request{
+			{"192.0.2.1:1000", "", ana, http.StatusOK},
+			{"192.0.2.2:1000", "", ana, http.StatusTooManyRequests},
+			{"192.0.2.3:1000", "", bob, http.StatusOK},
+		},
+	}, {
+		name: "limited IP stops users too",
+		mw:   &RateLimit{PerIP: ratelimit.PerMinute(1), PerUser: ratelimit.PerMinute(10)},
+		requests: []request{
+			{"192.0.2.1:1000", "", ana, http.StatusOK},
+			{"192.0.2.1:1000", "", bob, http.StatusTooManyRequests},
+		},
+	}, {
+		name: "user limit of the plan",
+		mw: &RateLimit{PerUser: ratelimit.PerMinute(1), UserLimit: func(u *models.User) ratelimit.Limit {
+			if u.ID == bob.ID {
+				return ratelimit.PerMinute(2)
+			}
+			return ratelimit.PerMinute(1)
+		}},
+		requests: []request{
+			{"192.0.2.1:1000", "", ana, http.StatusOK},
+			{"192.0.2.1:1000", "", ana, http.StatusTooManyRequests},
+			{"192.0.2.1:1000", "", bob, http.StatusOK},
+			{"192.0.2.1:1000", "", bob, http.StatusOK},
+			{"192.0.2.1:1000", "", bob, http.StatusTooManyRequests},
+		},
+	}, {
+		name: "fails open",
+		mw:   &RateLimit{Store: failingStore{}, PerIP: ratelimit.PerMinute(1)},
+		requests: []request{
+			{"192.0.2.1:1000", "", nil, http.StatusOK},
+			{"192.0.2.1:1000", "", nil, http.StatusOK},
+		},
+	}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.mw.Store == nil {
+				c.mw.Store = ratelimit.NewMemoryStore()
+			}
+			h := c.mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {})
+			for i, req := range c.requests {
+				r := httptest.NewRequest("GET", "/api/v1/stocklists", nil)
+				r.RemoteAddr = req.remoteAddr
+				if req.forwarded != "" {
+					r.Header.Set("X-Forwarded-For", req.forwarded)
+					r.Header.Set("X-Real-IP", req.forwarded)
+				}
+				if req.user != nil {
+					r = r.WithContext(context.WithUser(r.Context(), req.user))
+				}
+				rec := httptest.NewRecorder()
+				h(rec, r)
+				if rec.Code != req.status {
+					t.Fatalf("request %d: status %d, want %d", i, rec.Code, req.status)
+				}
+				if req.status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: no Retry-After header", i)
+				}
+			}
+		})
+	}
+
+	// Groups sharing a store are limited independently
+	store := ratelimit.NewMemoryStore()
+	login := (&RateLimit{Store: store, Group: "login", PerIP: ratelimit.PerMinute(1)}).ApplyFn(
+		func(w http.ResponseWriter, r *http.Request) {})
+	api := (&RateLimit{Store: store, Group: "api", PerIP: ratelimit.PerMinute(1)}).ApplyFn(
+		func(w http.ResponseWriter, r *http.Request) {})
+	for _, h := range []http.HandlerFunc{login, api} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("first request of a group: status %d, want 200", rec.Code)
+		}
+	}
+}
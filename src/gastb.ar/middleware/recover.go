@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"gastb.ar/errreport"
+	"gastb.ar/httperror"
+)
+
+// Recover turns panics in handlers into 500 Internal Server Error responses
+// instead of dropping the connection. The stack trace is logged with the
+// request ID; in production clients get the error page or problem details
+// of the httperror package, while in development they get the stack trace.
+// Panics and other 5xx responses are sent to the error reporter, if
+// configured.
+type Recover struct {
+	*slog.Logger
+	Prod bool
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in panic
+// recovery
+func (mw *Recover) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !errreport.Enabled() {
+			mw.serve(w, r, next)
+			return
+		}
+		r = r.WithContext(errreport.WithRequest(r.Context(), r))
+		rw := &reportWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		if mw.serve(rw, r, next) {
+			return
+		}
+		if rw.status >= 500 {
+			cause := rw.cause
+			if cause == nil {
+				cause = fmt.Errorf("%d %s", rw.status, http.StatusText(rw.status))
+			}
+			errreport.Error(r.Context(), cause, "status", fmt.Sprint(rw.status))
+		}
+	})
+}
+
+// serve calls next, recovering from panics, and reports whether it
+// panicked
+func (mw *Recover) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) (panicked bool) {
+	defer func() {
+		rec := recover()
+		if rec == nil {
+			return
+		}
+		// The server handles this one by aborting the response.
+		if rec == http.ErrAbortHandler {
+			panic(rec)
+		}
+		panicked = true
+		errreport.Panic(r.Context(), rec)
+		stack := debug.Stack()
+		mw.ErrorContext(r.Context(), "panic",
+			"error", fmt.Sprint(rec), "stack", string(stack))
+		mw.renderError(w, r, fmt.Sprintf("panic: %v\n\n%s", rec, stack))
+	}()
+	next(w, r)
+	return false
+}
+
+// reportWriter records the status of a response and the error behind it,
+// set with errreport.SetCause
+type reportWriter struct {
+	statusRecorder
+	cause error
+}
+
+// SetCause implements errreport's cause setter
+func (rw *reportWriter) SetCause(err error) {
+	rw.cause = err
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Recover) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// renderError writes the 500 response for a recovered panic
+func (mw *Recover) renderError(w http.ResponseWriter, r *http.Request, detail string) {
+	status := http.StatusInternalServerError
+	if mw.Prod {
+		httperror.Render(w, r, status, "")
+		return
+	}
+	if httperror.WantsJSON(r) {
+		httperror.Render(w, r, status, detail)
+		return
+	}
+	http.Error(w, detail, status)
+}
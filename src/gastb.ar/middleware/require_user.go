@@ -7,32 +7,40 @@ import (
 
 	"gastb.ar/models"
 	"gastb.ar/context"
+	"gastb.ar/cookies"
+	"gastb.ar/httperror"
 )
 
-// RequireUser wraps the UserService and adds verification methods
-type RequireUser struct {
+// User wraps the UserService and looks up the session of the remember
+// token cookie, if any, adding it and its user to the request context
+type User struct {
 	*models.UserService
+	Remember *cookies.Remember
 }
 
-// ApplyFn takes in a handler function and returns it again only if user
-// is logged in; otherwise, it redirects to login page
-func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+// ApplyFn takes in a handler function and returns a handler function that
+// adds the logged in user to the request context before calling it.
+// Requests without a valid remember token are passed on unchanged.
+func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		cookie, err := r.Cookie("remember_token")
+		token, err := mw.Remember.Get(r)
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusFound)
+			next(w, r)
 			return
 		}
-		
-		user, err := mw.UserService.ByToken(cookie.Value)
+
+		client := models.Client{IP: clientIP(r), UserAgent: r.UserAgent()}
+		user, session, err := mw.UserService.BySession(token, client)
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusFound)
+			next(w, r)
 			return
 		}
 
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
+		ctx = withLoggedUser(ctx, user.ID)
 		r = r.WithContext(ctx)
 
 		next(w, r)
@@ -40,7 +48,62 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 }
 
 // Apply takes in a handler and passes its ServeHTTP handler function
-// over to RequireFn
+// over to ApplyFn
+func (mw *User) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// RequireUser protects routes that need a logged in user. It assumes the
+// User middleware has already been run on the request.
+type RequireUser struct {
+	User
+}
+
+// ApplyFn takes in a handler function and returns it again only if user
+// is logged in; otherwise, it redirects to login page, or responds with
+// 401 Unauthorized if the client is not a browser
+func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			if httperror.WantsJSON(r) {
+				httperror.Render(w, r, http.StatusUnauthorized, "")
+				return
+			}
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
 func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
+
+// RequireAdmin protects routes that only admins may use. Users that are
+// not logged in are handled as by RequireUser; other users get a 404 so
+// the admin section is not advertised.
+type RequireAdmin struct {
+	RequireUser
+}
+
+// ApplyFn takes in a handler function and returns it again only if the
+// user is an admin
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		if user := context.User(r.Context()); !user.IsAdmin() {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
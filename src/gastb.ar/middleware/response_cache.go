@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gastb.ar/cache"
+	"gastb.ar/metrics"
+)
+
+// DefaultResponseCacheTTL is how long responses are cached when
+// ResponseCache has no TTL of its own
+const DefaultResponseCacheTTL = 30 * time.Second
+
+var cachedResponses = metrics.NewCounter("response_cache_total",
+	"Requests to cached routes by result.", "result")
+
+// ResponseCache serves GET and HEAD requests from Cache, so pages that
+// everybody sees the same, such as shared stocklists, survive traffic
+// spikes. Only 200 responses without cookies are cached, with the
+// headers the handler set; those set by outer middleware, such as a
+// Content-Security-Policy with a nonce, are set anew on every request.
+// Handlers that change what a page shows should Invalidate its keys.
+type ResponseCache struct {
+	Cache cache.Cache
+	TTL   time.Duration
+	// Key returns the cache key of a request, or "" if its response must
+	// not be cached, e.g. because it depends on who is asking. Responses
+	// in different formats of the same URL need different keys.
+	Key func(r *http.Request) string
+}
+
+// cachedResponse is how a response is stored
+type cachedResponse struct {
+	Status int         `json:"s"`
+	Header http.Header `json:"h"`
+	Body   []byte      `json:"b"`
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in response
+// caching
+func (mw *ResponseCache) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next(w, r)
+			return
+		}
+		key := mw.Key(r)
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		b, ok, err := mw.Cache.Get(key)
+		if err != nil {
+			slog.Warn("reading response cache failed", "key", key, "error", err)
+		}
+		var cached cachedResponse
+		if ok && json.Unmarshal(b, &cached) == nil {
+			cachedResponses.Inc("hit")
+			for k, v := range cached.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(cached.Status)
+			if r.Method != http.MethodHead {
+				w.Write(cached.Body)
+			}
+			return
+		}
+
+		cachedResponses.Inc("miss")
+		w.Header().Set("X-Cache", "MISS")
+		outer := w.Header().Clone()
+		cw := &cacheWriter{ResponseWriter: w, status: http.StatusOK}
+		next(cw, r)
+		if cw.status != http.StatusOK || r.Method == http.MethodHead ||
+			w.Header().Get("Set-Cookie") != "" {
+			return
+		}
+		header := w.Header().Clone()
+		for k := range outer {
+			header.Del(k)
+		}
+		b, err = json.Marshal(cachedResponse{Status: cw.status, Header: header, Body: cw.buf.Bytes()})
+		if err == nil {
+			err = mw.Cache.Set(key, b, mw.ttl())
+		}
+		if err != nil {
+			slog.Warn("writing response cache failed", "key", key, "error", err)
+		}
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *ResponseCache) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// Invalidate drops cached responses, such as those of a stocklist that
+// changed. Failures are logged; the responses expire with their TTL.
+func (mw *ResponseCache) Invalidate(keys ...string) {
+	if err := mw.Cache.Delete(keys...); err != nil {
+		slog.Warn("invalidating response cache failed", "keys", keys, "error", err)
+	}
+}
+
+func (mw *ResponseCache) ttl() time.Duration {
+	if mw.TTL <= 0 {
+		return DefaultResponseCacheTTL
+	}
+	return mw.TTL
+}
+
+// cacheWriter passes a response through while keeping a copy
+type cacheWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+}
+
+// Unwrap returns the wrapped ResponseWriter
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status, cw.wroteHeader = status, true
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	cw.buf.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gastb.ar/cache"
+)
+
+// countingHandler answers with the number of requests it has served,
+// with the status and cookie of the test case
+type countingHandler struct {
+	calls  int
+	status int
+	cookie bool
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.calls++
+	w.Header().Set("Content-Type", "text/plain")
+	if h.cookie {
+		http.SetCookie(w, &http.Cookie{Name: "flash", Value: "x"})
+	}
+	if h.status != 0 {
+		w.WriteHeader(h.status)
+	}
+	fmt.Fprintf(w, "call %d", h.calls)
+}
+
+func newResponseCache() *ResponseCache {
+	return &ResponseCache{
+		Cache: cache.NewMemoryCache(),
+		Key: func(r *http.Request) string {
+			if r.URL.Query().Get("private") != "" {
+				return ""
+			}
+			return "page:" + r.URL.Path
+		},
+	}
+}
+
+// serve sends a request through h and returns the response
+func serve(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func TestResponseCache(t *testing.T) {
+	mw := newResponseCache()
+	h := &countingHandler{}
+	cached := mw.Apply(h)
+
+	miss := serve(cached, "GET", "/u/ana")
+	if got := miss.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("first request: X-Cache %q, want MISS", got)
+	}
+	hit := serve(cached, "GET", "/u/ana")
+	if got := hit.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("second request: X-Cache %q, want HIT", got)
+	}
+	if hit.Body.String() != "call 1" || hit.Code != http.StatusOK {
+		t.Errorf("cached response = %d %q, want 200 %q", hit.Code, hit.Body, "call 1")
+	}
+	if got := hit.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("cached response has Content-Type %q, want the handler's", got)
+	}
+	if head := serve(cached, "HEAD", "/u/ana"); head.Body.Len() != 0 || head.Code != http.StatusOK {
+		t.Errorf("HEAD from the cache = %d with %d bytes, want 200 and no body",
+			head.Code, head.Body.Len())
+	}
+
+	serve(cached, "POST", "/u/ana")
+	serve(cached, "GET", "/u/ana?private=1")
+	if h.calls != 3 {
+		t.Errorf("the handler ran %d times, want POST and uncached keys to reach it", h.calls)
+	}
+
+	mw.Invalidate("page:/u/ana")
+	if rec := serve(cached, "GET", "/u/ana"); rec.Body.String() != "call 4" {
+		t.Errorf("after Invalidate the response is %q, want a fresh one", rec.Body)
+	}
+}
+
+func TestResponseCacheSkips(t *testing.T) {
+	cases := map[string]*countingHandler{
+		"not found":  {status: http.StatusNotFound},
+		"redirect":   {status: http.StatusFound},
+		"set cookie": {cookie: true},
+	}
+	for name, h := range cases {
+		t.Run(name, func(t *testing.T) {
+			cached := newResponseCache().Apply(h)
+			serve(cached, "GET", "/u/ana")
+			if rec := serve(cached, "GET", "/u/ana"); rec.Header().Get("X-Cache") != "MISS" {
+				t.Errorf("the response was cached: %d %q", rec.Code, rec.Body)
+			}
+			if h.calls != 2 {
+				t.Errorf("the handler ran %d times, want 2", h.calls)
+			}
+		})
+	}
+}
+
+func TestResponseCacheOuterHeaders(t *testing.T) {
+	cached := newResponseCache().Apply(&countingHandler{})
+	nonce := 0
+	// Like SecureHeaders, set a header that differs on every request
+	outer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce++
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf("script-src 'nonce-%d'", nonce))
+		cached(w, r)
+	})
+
+	serve(outer, "GET", "/u/ana")
+	hit := serve(outer, "GET", "/u/ana")
+	if hit.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("the second request missed the cache")
+	}
+	if got, want := hit.Header().Get("Content-Security-Policy"), "script-src 'nonce-2'"; got != want {
+		t.Errorf("cached response has Content-Security-Policy %q, want %q", got, want)
+	}
+}
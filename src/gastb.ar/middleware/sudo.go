@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"gastb.ar/context"
+	"gastb.ar/httperror"
+)
+
+// SudoPath is the page where users confirm their password again
+const SudoPath = "/sudo"
+
+// RequireSudo protects sensitive actions, such as changing the email
+// address, which need the user to have confirmed their password in
+// their session recently ("sudo mode"); logging in counts. It must run
+// after RequireUser. Page views and form posts are sent to SudoPath,
+// which sends users back; other requests get 403 Forbidden.
+type RequireSudo struct {
+	// Window is how long a confirmation lasts
+	Window time.Duration
+}
+
+// ApplyFn takes in a handler function and returns it again only if the
+// user's session is elevated
+func (mw *RequireSudo) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := context.Session(r.Context()); s != nil && s.Elevated(time.Now(), mw.Window) {
+			next(w, r)
+			return
+		}
+		if httperror.WantsJSON(r) {
+			httperror.Render(w, r, http.StatusForbidden,
+				"Confirm your password at "+SudoPath+" to continue.")
+			return
+		}
+		// Form posts can't be replayed, so users come back to the page
+		// the form was on
+		back := r.URL.RequestURI()
+		if r.Method != http.MethodGet {
+			back = refererPath(r)
+		}
+		http.Redirect(w, r, SudoPath+"?"+url.Values{"next": {back}}.Encode(),
+			http.StatusSeeOther)
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *RequireSudo) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// refererPath returns the path of the page a request came from, if it is
+// on this site, and / otherwise
+func refererPath(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil || u.Host != r.Host || u.Path == "" {
+		return "/"
+	}
+	return u.RequestURI()
+}
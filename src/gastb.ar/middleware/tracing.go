@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"gastb.ar/tracing"
+)
+
+// Tracing starts a server span for every request, continuing the trace of
+// the caller if it sent a traceparent header. It should run outermost so
+// that the rest of the chain, including the access log, sees the span.
+type Tracing struct{}
+
+// ApplyFn takes in a handler function and returns it wrapped in a span
+func (mw *Tracing) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing.Enabled() {
+			next(w, r)
+			return
+		}
+		ctx := tracing.Extract(r.Context(), r)
+		ctx, span := tracing.Start(ctx, "HTTP "+r.Method, tracing.KindServer)
+		if span == nil {
+			next(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.target", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttr("http.status_code", fmt.Sprint(rec.status))
+		if rec.status >= 500 {
+			span.SetError(fmt.Errorf("HTTP %d", rec.status))
+		}
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Tracing) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"gastb.ar/context"
+	"gastb.ar/httperror"
+	"gastb.ar/models"
+)
+
+// Usage meters the requests made with API keys, counting each request
+// and the bytes it sent and received against its key. Requests over a
+// user's daily quota get a 429 Too Many Requests response, retried the
+// next day.
+type Usage struct {
+	*models.APIUsageService
+	// DailyLimit, if set, returns how many API requests a user can make
+	// per day; 0 means no limit
+	DailyLimit func(user *models.User) int
+}
+
+// ApplyFn takes in a handler function and returns it wrapped in the
+// metering
+func (mw *Usage) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := context.APIKey(r.Context())
+		if apiKey == nil {
+			next(w, r)
+			return
+		}
+		if mw.DailyLimit != nil {
+			if limit := mw.DailyLimit(context.User(r.Context())); limit > 0 {
+				// Fail open, like RateLimit, if the count can't be read
+				made, err := mw.RequestsToday(apiKey.UserID)
+				if err == nil && made >= int64(limit) {
+					w.Header().Set("Retry-After", strconv.Itoa(secondsToMidnight(time.Now())))
+					httperror.Render(w, r, http.StatusTooManyRequests, "daily API quota exceeded")
+					return
+				}
+			}
+		}
+		sr := &statusRecorder{ResponseWriter: w}
+		next(sr, r)
+		received := r.ContentLength
+		if received < 0 {
+			received = 0
+		}
+		mw.Record(apiKey.ID, apiKey.UserID, received+int64(sr.bytes))
+	})
+}
+
+// Apply takes in a handler and passes its ServeHTTP handler function
+// over to ApplyFn
+func (mw *Usage) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// secondsToMidnight returns how many seconds are left until the next day
+// starts, in UTC, when daily quotas are reset
+func secondsToMidnight(now time.Time) int {
+	midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	return int(midnight.Sub(now).Seconds()) + 1
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+
+	"gastb.ar/hash"
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// APIKey lets scripts and other programs act on behalf of a user through
+// the JSON API. Only the hash of the key is stored.
+type APIKey struct {
+	gorm.Model
+	UserID  uint   `gorm:"not null;index"`
+	Name    string
+	Key     string `gorm:"-"`
+	KeyHash string `gorm:"not null;unique_index"`
+}
+
+// ErrInvalidAPIKey is returned when an API key does not match any key
+// in the database.
+var ErrInvalidAPIKey = errors.New("models: invalid API key")
+
+// APIKeyService creates and looks up API keys.
+type APIKeyService struct {
+	db   *gorm.DB
+	hmac hash.HMAC
+}
+
+// NewAPIKeyService instantiates an APIKeyService on a database connection
+// and a hasher for the keys.
+func NewAPIKeyService(db *gorm.DB, hmacSecretKey string) *APIKeyService {
+	return &APIKeyService {
+		db:   db,
+		hmac: hash.NewHMAC(hmacSecretKey),
+	}
+}
+
+// Create generates a new key for a user, stores its hash and returns the
+// APIKey with the Key field set. The key can not be recovered later on.
+func (as *APIKeyService) Create(userID uint, name string) (*APIKey, error) {
+	if userID == 0 {
+		return nil, ErrUserIDRequired
+	}
+	key, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	apiKey := &APIKey{
+		UserID:  userID,
+		Name:    name,
+		Key:     key,
+		KeyHash: as.hmac.Hash(key),
+	}
+	if err := as.db.Create(apiKey).Error; err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// ByKey hashes a key and looks up the corresponding APIKey.
+// It returns ErrInvalidAPIKey if there is none.
+func (as *APIKeyService) ByKey(key string) (*APIKey, error) {
+	var apiKey APIKey
+	db := as.db.Where("key_hash = ?", as.hmac.Hash(key))
+	err := first(db, &apiKey)
+	if err == ErrNotFound {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+// ByUserID returns all the API keys of a user.
+func (as *APIKeyService) ByUserID(userID uint) ([]APIKey, error) {
+	var apiKeys []APIKey
+	err := as.db.Where("user_id = ?", userID).Find(&apiKeys).Error
+	if err != nil {
+		return nil, err
+	}
+	return apiKeys, nil
+}
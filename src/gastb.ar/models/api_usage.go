@@ -0,0 +1,202 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"gastb.ar/clock"
+
+	"github.com/jinzhu/gorm"
+)
+
+// APIUsage counts the requests made with an API key on a day, in UTC,
+// and the bytes they sent and received.
+type APIUsage struct {
+	ID       uint      `gorm:"primary_key"`
+	APIKeyID uint      `gorm:"not null;unique_index:uix_api_usages_key_day"`
+	Day      time.Time `gorm:"type:date;not null;unique_index:uix_api_usages_key_day"`
+	UserID   uint      `gorm:"not null;index"`
+	Requests int64     `gorm:"not null"`
+	Bytes    int64     `gorm:"not null"`
+}
+
+// usageKey identifies the row of APIUsage a request counts in
+type usageKey struct {
+	apiKeyID uint
+	day      time.Time
+}
+
+// userUsage is how many requests a user made today, as last read from
+// the database
+type userUsage struct {
+	day      time.Time
+	requests int64
+	readAt   time.Time
+}
+
+// usageReadEvery is how long a user's count of today's requests is
+// cached. Other instances' requests show up in it after up to that long.
+const usageReadEvery = time.Minute
+
+// APIUsageService meters the use of API keys. Requests are counted in
+// memory and added to the daily rollups in APIUsage by Flush, which
+// should run every few seconds; see Run.
+type APIUsageService struct {
+	db    *gorm.DB
+	clock clock.Clock
+
+	mu sync.Mutex
+	// pending counts requests not flushed yet, by key and day, with
+	// the user of the key
+	pending map[usageKey]*APIUsage
+	// today caches the flushed counts of today's requests by user
+	today map[uint]*userUsage
+}
+
+// NewAPIUsageService instantiates an APIUsageService on a database
+// connection.
+func NewAPIUsageService(db *gorm.DB) *APIUsageService {
+	return &APIUsageService{
+		db:      db,
+		clock:   clock.Real,
+		pending: make(map[usageKey]*APIUsage),
+		today:   make(map[uint]*userUsage),
+	}
+}
+
+// SetClock sets the clock that days are based on
+func (us *APIUsageService) SetClock(c clock.Clock) {
+	us.clock = c
+}
+
+// usageDay returns the UTC day of t
+func usageDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Record counts a request made with an API key of a user, which sent and
+// received a number of bytes.
+func (us *APIUsageService) Record(apiKeyID, userID uint, bytes int64) {
+	key := usageKey{apiKeyID: apiKeyID, day: usageDay(us.clock.Now())}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, ok := us.pending[key]
+	if !ok {
+		u = &APIUsage{APIKeyID: apiKeyID, Day: key.day, UserID: userID}
+		us.pending[key] = u
+	}
+	u.Requests++
+	u.Bytes += bytes
+}
+
+// Flush adds the requests counted since the last flush to the daily
+// rollups. Counts that can't be written are kept for the next flush.
+func (us *APIUsageService) Flush() error {
+	us.mu.Lock()
+	pending := us.pending
+	us.pending = make(map[usageKey]*APIUsage)
+	us.mu.Unlock()
+	var err error
+	for key, u := range pending {
+		err = us.db.Exec("INSERT INTO api_usages (api_key_id, day, user_id, requests, bytes) "+
+			"VALUES (?, ?, ?, ?, ?) ON CONFLICT (api_key_id, day) DO UPDATE SET "+
+			"requests = api_usages.requests + EXCLUDED.requests, "+
+			"bytes = api_usages.bytes + EXCLUDED.bytes",
+			u.APIKeyID, u.Day, u.UserID, u.Requests, u.Bytes).Error
+		if err != nil {
+			us.restore(key, u)
+			continue
+		}
+		us.forget(u.UserID)
+	}
+	return err
+}
+
+// restore adds counts that failed to flush back to the pending ones
+func (us *APIUsageService) restore(key usageKey, u *APIUsage) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if p, ok := us.pending[key]; ok {
+		p.Requests += u.Requests
+		p.Bytes += u.Bytes
+		return
+	}
+	us.pending[key] = u
+}
+
+// forget drops the cached count of a user whose requests were just
+// flushed, so that they are not counted twice
+func (us *APIUsageService) forget(userID uint) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.today, userID)
+}
+
+// Run flushes counts every interval until the returned function is
+// called, which flushes one last time.
+func (us *APIUsageService) Run(interval time.Duration) (stop func() error) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				us.Flush()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		<-stopped
+		return us.Flush()
+	}
+}
+
+// RequestsToday returns how many API requests a user made today, across
+// their keys. Requests made through other instances may take up to
+// usageReadEvery to be counted.
+func (us *APIUsageService) RequestsToday(userID uint) (int64, error) {
+	now := us.clock.Now()
+	today := usageDay(now)
+	us.mu.Lock()
+	cached, ok := us.today[userID]
+	us.mu.Unlock()
+	if !ok || !cached.day.Equal(today) || now.Sub(cached.readAt) > usageReadEvery {
+		var row struct{ Requests int64 }
+		err := us.db.Model(&APIUsage{}).Select("COALESCE(SUM(requests), 0) AS requests").
+			Where("user_id = ? AND day = ?", userID, today).Scan(&row).Error
+		if err != nil {
+			return 0, err
+		}
+		cached = &userUsage{day: today, requests: row.Requests, readAt: now}
+		us.mu.Lock()
+		us.today[userID] = cached
+		us.mu.Unlock()
+	}
+	requests := cached.requests
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for key, u := range us.pending {
+		if u.UserID == userID && key.day.Equal(today) {
+			requests += u.Requests
+		}
+	}
+	return requests, nil
+}
+
+// ByUserID returns the daily usage of a user's API keys since a day,
+// oldest first.
+func (us *APIUsageService) ByUserID(userID uint, since time.Time) ([]APIUsage, error) {
+	var usage []APIUsage
+	err := us.db.Where("user_id = ? AND day >= ?", userID, usageDay(since)).
+		Order("day, api_key_id").Find(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Attachment is a file attached to a stocklist. The content lives in
+// the storage package under Key; this is its metadata.
+type Attachment struct {
+	gorm.Model
+	StocklistID uint   `gorm:"not null;index"`
+	Key         string `gorm:"not null;unique_index"`
+	Name        string `gorm:"not null"`
+	ContentType string `gorm:"not null"`
+	Size        int64
+}
+
+// AttachmentService stores attachment metadata.
+type AttachmentService struct {
+	db *gorm.DB
+}
+
+// NewAttachmentService instantiates an AttachmentService on a database
+// connection.
+func NewAttachmentService(db *gorm.DB) *AttachmentService {
+	return &AttachmentService {
+		db: db,
+	}
+}
+
+// Create stores the metadata of an attachment.
+func (as *AttachmentService) Create(a *Attachment) error {
+	if a.StocklistID == 0 {
+		return ErrInvalidID
+	}
+	if a.Name == "" {
+		return ErrNameRequired
+	}
+	return as.db.Create(a).Error
+}
+
+// ByID looks up an attachment by ID.
+func (as *AttachmentService) ByID(id uint) (*Attachment, error) {
+	var a Attachment
+	if err := first(as.db.Where("id = ?", id), &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// ByStocklistID returns the attachments of a stocklist.
+func (as *AttachmentService) ByStocklistID(stocklistID uint) ([]Attachment, error) {
+	var attachments []Attachment
+	err := as.db.Where("stocklist_id = ?", stocklistID).Order("id").
+		Find(&attachments).Error
+	if err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// ByStocklistIDs returns the attachments of several stocklists with one
+// query, keyed by stocklist ID.
+func (as *AttachmentService) ByStocklistIDs(stocklistIDs []uint) (map[uint][]Attachment, error) {
+	byStocklist := make(map[uint][]Attachment, len(stocklistIDs))
+	if len(stocklistIDs) == 0 {
+		return byStocklist, nil
+	}
+	var attachments []Attachment
+	err := as.db.Where("stocklist_id IN (?)", stocklistIDs).Order("id").
+		Find(&attachments).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		byStocklist[a.StocklistID] = append(byStocklist[a.StocklistID], a)
+	}
+	return byStocklist, nil
+}
+
+// Delete deletes the metadata of an attachment.
+func (as *AttachmentService) Delete(id uint) error {
+	if id == 0 {
+		return ErrInvalidID
+	}
+	return as.db.Unscoped().Delete(&Attachment{Model: gorm.Model{ID: id}}).Error
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// AuditEntry records a sensitive change for support and security
+// reviews. Entries are only ever added.
+type AuditEntry struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	// ActorID is the user who made the change; 0 for gastbctl and the
+	// system itself
+	ActorID uint
+	// UserID is the user the change is about
+	UserID uint   `gorm:"not null;index"`
+	Action string `gorm:"not null;index"`
+	// Detail describes the change for people; it must not hold secrets
+	Detail string `gorm:"type:text"`
+}
+
+// Audited actions
+const (
+	AuditUserMerge              = "user.merge"
+	AuditPasswordResetThrottled = "password_reset.throttled"
+)
+
+// AuditService reads and writes the audit log.
+type AuditService struct {
+	db *gorm.DB
+}
+
+// NewAuditService instantiates an AuditService on a database connection.
+func NewAuditService(db *gorm.DB) *AuditService {
+	return &AuditService{
+		db: db,
+	}
+}
+
+// Record adds an entry to the audit log.
+func (as *AuditService) Record(entry *AuditEntry) error {
+	return as.db.Create(entry).Error
+}
+
+// ByUserID returns up to limit entries about a user, newest first.
+func (as *AuditService) ByUserID(userID uint, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := as.db.Where("user_id = ?", userID).Order("id DESC").Limit(limit).
+		Find(&entries).Error
+	return entries, err
+}
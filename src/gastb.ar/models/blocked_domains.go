@@ -0,0 +1,120 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// BlockedDomain is an email domain, such as one of a disposable email
+// service, that new addresses can't use. Its subdomains are blocked too.
+type BlockedDomain struct {
+	Domain    string `gorm:"primary_key"`
+	CreatedAt time.Time
+}
+
+// DomainBlocklist tells whether an email domain is blocked
+type DomainBlocklist interface {
+	DomainBlocked(domain string) (bool, error)
+}
+
+var (
+	// ErrEmailNotAllowed is returned when an email address belongs to a
+	// blocked domain.
+	ErrEmailNotAllowed = errors.New("models: email addresses of this domain are not allowed")
+
+	// ErrDomainInvalid is returned when blocking something that isn't a
+	// domain name.
+	ErrDomainInvalid = errors.New("models: domain is not valid")
+)
+
+// domainRegex is a loose check that a domain name is well formed, like
+// emailRegex
+var domainRegex = regexp.MustCompile(`^[a-z0-9\-]+(\.[a-z0-9\-]+)*\.[a-z]{2,}$`)
+
+// BlockedDomainService keeps the blocklist of email domains, which the
+// user service consults once given to SetDomainBlocklist.
+type BlockedDomainService struct {
+	db *gorm.DB
+}
+
+// NewBlockedDomainService instantiates a BlockedDomainService on a
+// database connection.
+func NewBlockedDomainService(db *gorm.DB) *BlockedDomainService {
+	return &BlockedDomainService{
+		db: db,
+	}
+}
+
+// normalizeDomain lower-cases a domain and strips the @ it may be given
+// with
+func normalizeDomain(domain string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "@")
+}
+
+// BlockedDomains returns the blocked domains in alphabetical order.
+func (bds *BlockedDomainService) BlockedDomains() ([]BlockedDomain, error) {
+	var domains []BlockedDomain
+	err := bds.db.Order("domain").Find(&domains).Error
+	return domains, err
+}
+
+// BlockDomains adds domains to the blocklist, returning ErrDomainInvalid
+// and blocking none if any isn't a domain name. Blocking a domain again
+// does nothing. Accounts that already use them are left alone.
+func (bds *BlockedDomainService) BlockDomains(domains []string) error {
+	for i, d := range domains {
+		domains[i] = normalizeDomain(d)
+		if !domainRegex.MatchString(domains[i]) {
+			return ErrDomainInvalid
+		}
+	}
+	tx := bds.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, d := range domains {
+		err := tx.Exec("INSERT INTO blocked_domains (domain, created_at) VALUES (?, ?) "+
+			"ON CONFLICT DO NOTHING", d, time.Now()).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// UnblockDomain removes a domain from the blocklist, returning
+// ErrNotFound if it isn't on it.
+func (bds *BlockedDomainService) UnblockDomain(domain string) error {
+	res := bds.db.Where("domain = ?", normalizeDomain(domain)).Delete(&BlockedDomain{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DomainBlocked reports whether a domain, or a domain it is a subdomain
+// of, is blocked.
+func (bds *BlockedDomainService) DomainBlocked(domain string) (bool, error) {
+	domain = normalizeDomain(domain)
+	var candidates []string
+	for {
+		candidates = append(candidates, domain)
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	var count int
+	err := bds.db.Model(&BlockedDomain{}).Where("domain IN (?)", candidates).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// CalendarFeed holds the token in the URL of a user's calendar feed,
+// which calendar apps fetch without logging in. Like digest tokens, it is
+// stored as is, because the URL is shown again whenever it is asked for.
+type CalendarFeed struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;unique_index"`
+	Token  string `gorm:"not null;unique_index"`
+}
+
+// CalendarFeedService keeps track of calendar feed tokens.
+type CalendarFeedService struct {
+	db *gorm.DB
+}
+
+// NewCalendarFeedService instantiates a CalendarFeedService on a database
+// connection.
+func NewCalendarFeedService(db *gorm.DB) *CalendarFeedService {
+	return &CalendarFeedService {
+		db: db,
+	}
+}
+
+// ByUserID returns the calendar feed of a user, creating it with a new
+// token the first time.
+func (cs *CalendarFeedService) ByUserID(userID uint) (*CalendarFeed, error) {
+	var feed CalendarFeed
+	err := first(cs.db.Where("user_id = ?", userID), &feed)
+	if err != ErrNotFound {
+		if err != nil {
+			return nil, err
+		}
+		return &feed, nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	feed = CalendarFeed{UserID: userID, Token: token}
+	if err := cs.db.Create(&feed).Error; err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+// ByToken returns the calendar feed with a token, or ErrInvalidToken if
+// there is none.
+func (cs *CalendarFeedService) ByToken(token string) (*CalendarFeed, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	var feed CalendarFeed
+	err := first(cs.db.Where("token = ?", token), &feed)
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+// Reset gives a user's calendar feed a new token, so that the old URL
+// stops working, e.g. after it was shared by mistake.
+func (cs *CalendarFeedService) Reset(userID uint) (*CalendarFeed, error) {
+	feed, err := cs.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	feed.Token = token
+	if err := cs.db.Model(feed).Update("token", token).Error; err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
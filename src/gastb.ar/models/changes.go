@@ -0,0 +1,272 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Change records that a stocklist was created, updated or deleted. The
+// changes table is an outbox: it is written in the transaction of the
+// change itself, so none are missed, and read in order by clients
+// syncing the stocklists they can see and by the consumers of the
+// outbox relay, which each keep an OutboxCursor.
+type Change struct {
+	// Seq increases with every change, in the order changes commit
+	Seq      uint64 `gorm:"primary_key"`
+	Entity   string `gorm:"not null"`
+	EntityID uint   `gorm:"not null"`
+	Op       string `gorm:"not null"`
+	// UserID and OrganizationID are those of the stocklist, telling
+	// who sees the change
+	UserID         uint  `gorm:"not null;index"`
+	OrganizationID *uint `gorm:"index"`
+	// Payload is the entity after the change, or before a deletion, as
+	// JSON; for stocklists, a StocklistPayload
+	Payload   string    `gorm:"type:jsonb;not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Entities and operations of changes
+const (
+	ChangeStocklist = "stocklist"
+
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// StocklistPayload is the payload of stocklist changes
+type StocklistPayload struct {
+	ID             uint      `json:"id"`
+	UserID         uint      `json:"user_id"`
+	OrganizationID *uint     `json:"organization_id"`
+	Name           string    `json:"name"`
+	Version        uint      `json:"version"`
+	Public         bool      `json:"public"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// OutboxCursor is the sequence number of the last change a consumer of
+// the outbox handled. Changes are only purged once every consumer
+// handled them.
+type OutboxCursor struct {
+	Consumer  string `gorm:"primary_key"`
+	Seq       uint64 `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+// ChangeRetention is how long changes are kept. Clients that last synced
+// longer ago than that have to sync everything again.
+const ChangeRetention = 30 * 24 * time.Hour
+
+// ErrCursorExpired is returned when syncing from a change that was
+// deleted after ChangeRetention
+var ErrCursorExpired = errors.New("models: the sync cursor expired, sync everything again")
+
+// changeLock is the key of the advisory lock serializing the
+// transactions writing changes, so that their sequence numbers are
+// assigned in commit order and readers can't skip one that commits late
+const changeLock = 0x6368616e6765
+
+// relayLock is the key of the advisory lock held while relaying changes
+// to the outbox consumers
+const relayLock = 0x72656c6179
+
+// recordChange logs a change to a stocklist in the transaction tx, which
+// holds the change lock until it ends
+func recordChange(tx *gorm.DB, stocklist *Stocklist, op string) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", changeLock).Error; err != nil {
+		return err
+	}
+	payload, err := json.Marshal(StocklistPayload{
+		ID:             stocklist.ID,
+		UserID:         stocklist.UserID,
+		OrganizationID: stocklist.OrganizationID,
+		Name:           stocklist.Name,
+		Version:        stocklist.Version,
+		Public:         stocklist.Public,
+		CreatedAt:      stocklist.CreatedAt,
+		UpdatedAt:      stocklist.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Create(&Change{
+		Entity:         ChangeStocklist,
+		EntityID:       stocklist.ID,
+		Op:             op,
+		UserID:         stocklist.UserID,
+		OrganizationID: stocklist.OrganizationID,
+		Payload:        string(payload),
+	}).Error
+}
+
+// recordMoves logs, in the transaction tx, that the personal stocklists
+// of a user are about to move to another, with payloads like
+// StocklistPayload
+func recordMoves(tx *gorm.DB, from, to uint) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", changeLock).Error; err != nil {
+		return err
+	}
+	return tx.Exec("INSERT INTO changes (entity, entity_id, op, user_id, payload, created_at) "+
+		"SELECT ?, id, ?, ?, json_build_object('id', id, 'user_id', ?::bigint, "+
+		"'organization_id', organization_id, 'name', name, 'version', version, "+
+		"'public', public, 'created_at', created_at, 'updated_at', updated_at), NOW() "+
+		"FROM stocklists WHERE user_id = ? AND organization_id IS NULL AND deleted_at IS NULL",
+		ChangeStocklist, ChangeUpdate, to, to, from).Error
+}
+
+// inTransaction runs fn in a transaction, committed if fn returns nil
+func inTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	// Calls made in a transaction already, as by asTenant, join it
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return fn(db)
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// ChangeService reads the outbox of changes.
+type ChangeService struct {
+	db *gorm.DB
+}
+
+// NewChangeService instantiates a ChangeService on a database
+// connection.
+func NewChangeService(db *gorm.DB) *ChangeService {
+	return &ChangeService{
+		db: db,
+	}
+}
+
+// visibleTo scopes changes to those of a user's personal stocklists and
+// of the stocklists of their organizations
+func visibleTo(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Where("(user_id = ? AND organization_id IS NULL) OR organization_id IN "+
+		"(SELECT organization_id FROM memberships WHERE user_id = ?)", userID, userID)
+}
+
+// Latest returns the sequence number of the latest change, 0 if there
+// is none. Every change up to it has committed.
+func (cs *ChangeService) Latest() (uint64, error) {
+	var row struct{ Seq uint64 }
+	err := cs.db.Model(&Change{}).Select("COALESCE(MAX(seq), 0) AS seq").Scan(&row).Error
+	return row.Seq, err
+}
+
+// Since returns up to limit changes a user can see after the one with
+// sequence number since, oldest first, and the sequence number to pass
+// next time: that of the last change returned if there may be more, the
+// latest one otherwise. It returns ErrCursorExpired if changes after
+// since were deleted.
+func (cs *ChangeService) Since(userID uint, since uint64, limit int) ([]Change, uint64, error) {
+	var row struct{ Min, Max uint64 }
+	err := cs.db.Model(&Change{}).
+		Select("COALESCE(MIN(seq), 0) AS min, COALESCE(MAX(seq), 0) AS max").Scan(&row).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	// Cursors from before changes were purged, or the database reset
+	if row.Min > since+1 || row.Max < since {
+		return nil, 0, ErrCursorExpired
+	}
+	var changes []Change
+	err = visibleTo(cs.db.Where("seq > ? AND seq <= ?", since, row.Max), userID).
+		Order("seq").Limit(limit).Find(&changes).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(changes) == limit {
+		return changes, changes[len(changes)-1].Seq, nil
+	}
+	return changes, row.Max, nil
+}
+
+// After returns up to limit changes after the one with sequence number
+// seq, oldest first, whoever they belong to.
+func (cs *ChangeService) After(seq uint64, limit int) ([]Change, error) {
+	var changes []Change
+	err := cs.db.Where("seq > ?", seq).Order("seq").Limit(limit).Find(&changes).Error
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// ByStocklist returns up to limit changes of a stocklist, latest first.
+// Changes older than ChangeRetention were purged.
+func (cs *ChangeService) ByStocklist(id uint, limit int) ([]Change, error) {
+	var changes []Change
+	err := cs.db.Where("entity = ? AND entity_id = ?", ChangeStocklist, id).
+		Order("seq DESC").Limit(limit).Find(&changes).Error
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Cursor returns the sequence number of the last change a consumer
+// handled. Consumers seen for the first time start after the latest
+// change, rather than with the whole history.
+func (cs *ChangeService) Cursor(consumer string) (uint64, error) {
+	var cursor OutboxCursor
+	err := first(cs.db.Where("consumer = ?", consumer), &cursor)
+	if err != ErrNotFound {
+		return cursor.Seq, err
+	}
+	latest, err := cs.Latest()
+	if err != nil {
+		return 0, err
+	}
+	err = cs.db.Exec("INSERT INTO outbox_cursors (consumer, seq, updated_at) "+
+		"VALUES (?, ?, NOW()) ON CONFLICT DO NOTHING", consumer, latest).Error
+	if err != nil {
+		return 0, err
+	}
+	return cs.Cursor(consumer)
+}
+
+// Advance records that a consumer handled the changes up to the one with
+// sequence number seq
+func (cs *ChangeService) Advance(consumer string, seq uint64) error {
+	return cs.db.Model(&OutboxCursor{}).Where("consumer = ? AND seq < ?", consumer, seq).
+		Updates(map[string]interface{}{"seq": seq, "updated_at": time.Now()}).Error
+}
+
+// Relay runs fn while holding the relay lock, so that one instance at a
+// time relays changes, and reports whether it got the lock.
+func (cs *ChangeService) Relay(fn func() error) (bool, error) {
+	var locked bool
+	err := inTransaction(cs.db, func(tx *gorm.DB) error {
+		var row struct{ Locked bool }
+		err := tx.Raw("SELECT pg_try_advisory_xact_lock(?) AS locked", relayLock).Scan(&row).Error
+		if err != nil || !row.Locked {
+			return err
+		}
+		locked = true
+		return fn()
+	})
+	return locked, err
+}
+
+// PurgeExpired deletes the changes made before a given time that every
+// outbox consumer handled, but the latest one, so that expired cursors
+// can be told from recent ones, and returns how many were deleted.
+func (cs *ChangeService) PurgeExpired(before time.Time) (int64, error) {
+	db := cs.db.Where("created_at < ? AND seq < (SELECT MAX(seq) FROM changes) AND "+
+		"NOT EXISTS (SELECT 1 FROM outbox_cursors WHERE outbox_cursors.seq < changes.seq)", before).
+		Delete(&Change{})
+	return db.RowsAffected, db.Error
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DigestSubscription keeps track of the digest emails of a user who
+// opted in to them (see NotificationSettings). Token identifies the user
+// in unsubscribe links; it is stored as is, unlike other tokens, because
+// every digest has to include it.
+type DigestSubscription struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;unique_index"`
+	Token      string `gorm:"not null;unique_index"`
+	LastSentAt *time.Time
+}
+
+// DigestService keeps track of digest emails.
+type DigestService struct {
+	db *gorm.DB
+}
+
+// NewDigestService instantiates a DigestService on a database connection.
+func NewDigestService(db *gorm.DB) *DigestService {
+	return &DigestService {
+		db: db,
+	}
+}
+
+// ByUserID returns the digest subscription of a user, creating it with a
+// new token the first time.
+func (ds *DigestService) ByUserID(userID uint) (*DigestSubscription, error) {
+	var sub DigestSubscription
+	err := first(ds.db.Where("user_id = ?", userID), &sub)
+	if err != ErrNotFound {
+		if err != nil {
+			return nil, err
+		}
+		return &sub, nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	sub = DigestSubscription{UserID: userID, Token: token}
+	if err := ds.db.Create(&sub).Error; err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// MarkSent records that a digest was sent for a subscription.
+func (ds *DigestService) MarkSent(sub *DigestSubscription) error {
+	now := time.Now()
+	sub.LastSentAt = &now
+	return ds.db.Model(sub).Update("last_sent_at", now).Error
+}
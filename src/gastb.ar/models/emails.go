@@ -0,0 +1,105 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// EmailDelivery tracks an outgoing email from the moment it is queued
+// until it is sent or given up on.
+type EmailDelivery struct {
+	gorm.Model
+	To       string `gorm:"not null"`
+	Subject  string
+	Status   string `gorm:"not null;index"`
+	Attempts int    `gorm:"not null;default:0"`
+	// LastError is the error of the latest failed attempt
+	LastError string `gorm:"type:text"`
+	SentAt    *time.Time
+}
+
+// Email delivery statuses. Dead deliveries failed every attempt and
+// won't be retried; suppressed ones were never tried because every
+// recipient is undeliverable.
+const (
+	EmailQueued     = "queued"
+	EmailRetrying   = "retrying"
+	EmailSent       = "sent"
+	EmailDead       = "dead"
+	EmailSuppressed = "suppressed"
+)
+
+// EmailStatuses lists every email delivery status
+var EmailStatuses = []string{EmailQueued, EmailRetrying, EmailSent, EmailDead,
+	EmailSuppressed}
+
+// EmailDeliveryService records outgoing emails.
+type EmailDeliveryService struct {
+	db *gorm.DB
+}
+
+// NewEmailDeliveryService instantiates an EmailDeliveryService on a
+// database connection.
+func NewEmailDeliveryService(db *gorm.DB) *EmailDeliveryService {
+	return &EmailDeliveryService {
+		db: db,
+	}
+}
+
+// Create records an email as queued.
+func (es *EmailDeliveryService) Create(d *EmailDelivery) error {
+	d.Status = EmailQueued
+	return es.db.Create(d).Error
+}
+
+// Suppress records an email that won't be sent because every recipient
+// is undeliverable.
+func (es *EmailDeliveryService) Suppress(d *EmailDelivery) error {
+	d.Status = EmailSuppressed
+	return es.db.Create(d).Error
+}
+
+// ByID looks up an email delivery by ID.
+func (es *EmailDeliveryService) ByID(id uint) (*EmailDelivery, error) {
+	var d EmailDelivery
+	if err := first(es.db.Where("id = ?", id), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// MarkSent records the attempt that sent an email.
+func (es *EmailDeliveryService) MarkSent(d *EmailDelivery, attempt int) error {
+	now := time.Now()
+	d.Status = EmailSent
+	d.Attempts = attempt
+	d.SentAt = &now
+	return es.db.Save(d).Error
+}
+
+// MarkFailed records a failed attempt at sending an email. If it was the
+// last one, the delivery is dead.
+func (es *EmailDeliveryService) MarkFailed(d *EmailDelivery, attempt int, err error, last bool) error {
+	d.Status = EmailRetrying
+	if last {
+		d.Status = EmailDead
+	}
+	d.Attempts = attempt
+	d.LastError = err.Error()
+	return es.db.Save(d).Error
+}
+
+// Recent returns the latest email deliveries, newest first, optionally
+// only those with a given status.
+func (es *EmailDeliveryService) Recent(status string, limit int) ([]EmailDelivery, error) {
+	var ds []EmailDelivery
+	db := es.db.Order("created_at desc").Limit(limit)
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+	if err := db.Find(&ds).Error; err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
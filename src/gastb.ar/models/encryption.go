@@ -0,0 +1,158 @@
+package models
+
+import (
+	"gastb.ar/encrypt"
+)
+
+// Columns holding encrypted values. The name of the column is bound to
+// its values, so that one can't be copied into another.
+const (
+	columnWebhookSecret     = "webhooks.secret"
+	columnSlackWebhookURL   = "notification_settings.slack_webhook_url"
+	columnDiscordWebhookURL = "notification_settings.discord_webhook_url"
+)
+
+// reencryptBatch is how many records Reencrypt loads at a time
+const reencryptBatch = 100
+
+// SetKeyring makes the services encrypt sensitive columns, such as
+// webhook secrets and chat webhook URLs, with the keys of kr. Values
+// stored before are read as they are, until Reencrypt encrypts them.
+// Without a keyring, values are stored in plaintext. It is meant to be
+// called at startup.
+func (s *Services) SetKeyring(kr *encrypt.Keyring) {
+	s.WebhookService.keys = kr
+	s.NotificationSettingService.keys = kr
+}
+
+// Reencrypt encrypts the sensitive values that are plaintext or were
+// encrypted with an old key with the current key, so that old keys can
+// be dropped from the keyring, and returns how many records it changed.
+// It can be stopped and run again at any time.
+func (s *Services) Reencrypt() (int, error) {
+	n, err := s.WebhookService.reencrypt()
+	if err != nil {
+		return n, err
+	}
+	m, err := s.NotificationSettingService.reencrypt()
+	return n + m, err
+}
+
+func (ws *WebhookService) encrypt(userID uint, secret string) (string, error) {
+	if ws.keys == nil {
+		return secret, nil
+	}
+	return ws.keys.Encrypt(userID, columnWebhookSecret, secret)
+}
+
+func (ws *WebhookService) decrypt(wh *Webhook) error {
+	if ws.keys == nil {
+		return nil
+	}
+	secret, err := ws.keys.Decrypt(columnWebhookSecret, wh.Secret)
+	if err != nil {
+		return err
+	}
+	wh.Secret = secret
+	return nil
+}
+
+// reencrypt encrypts the secrets of webhooks, deleted ones included,
+// that aren't encrypted with the current key
+func (ws *WebhookService) reencrypt() (int, error) {
+	if ws.keys == nil {
+		return 0, nil
+	}
+	changed := 0
+	for lastID := uint(0); ; {
+		var whs []Webhook
+		err := ws.db.Unscoped().Where("id > ?", lastID).Order("id").
+			Limit(reencryptBatch).Find(&whs).Error
+		if err != nil || len(whs) == 0 {
+			return changed, err
+		}
+		lastID = whs[len(whs)-1].ID
+		for i := range whs {
+			wh := &whs[i]
+			if !ws.keys.Stale(wh.Secret) {
+				continue
+			}
+			if err := ws.decrypt(wh); err != nil {
+				return changed, err
+			}
+			secret, err := ws.encrypt(wh.UserID, wh.Secret)
+			if err != nil {
+				return changed, err
+			}
+			err = ws.db.Unscoped().Model(wh).UpdateColumn("secret", secret).Error
+			if err != nil {
+				return changed, err
+			}
+			changed++
+		}
+	}
+}
+
+// encrypt encrypts the chat webhook URLs of settings in place
+func (nss *NotificationSettingService) encrypt(ns *NotificationSettings) error {
+	if nss.keys == nil {
+		return nil
+	}
+	var err error
+	if ns.SlackWebhookURL, err = nss.keys.Encrypt(ns.UserID, columnSlackWebhookURL, ns.SlackWebhookURL); err != nil {
+		return err
+	}
+	ns.DiscordWebhookURL, err = nss.keys.Encrypt(ns.UserID, columnDiscordWebhookURL, ns.DiscordWebhookURL)
+	return err
+}
+
+// decrypt decrypts the chat webhook URLs of settings in place
+func (nss *NotificationSettingService) decrypt(ns *NotificationSettings) error {
+	if nss.keys == nil {
+		return nil
+	}
+	var err error
+	if ns.SlackWebhookURL, err = nss.keys.Decrypt(columnSlackWebhookURL, ns.SlackWebhookURL); err != nil {
+		return err
+	}
+	ns.DiscordWebhookURL, err = nss.keys.Decrypt(columnDiscordWebhookURL, ns.DiscordWebhookURL)
+	return err
+}
+
+// reencrypt encrypts the chat webhook URLs that aren't encrypted with
+// the current key
+func (nss *NotificationSettingService) reencrypt() (int, error) {
+	if nss.keys == nil {
+		return 0, nil
+	}
+	changed := 0
+	for lastID := uint(0); ; {
+		var settings []NotificationSettings
+		err := nss.db.Where("id > ?", lastID).Order("id").
+			Limit(reencryptBatch).Find(&settings).Error
+		if err != nil || len(settings) == 0 {
+			return changed, err
+		}
+		lastID = settings[len(settings)-1].ID
+		for i := range settings {
+			ns := &settings[i]
+			if !nss.keys.Stale(ns.SlackWebhookURL) && !nss.keys.Stale(ns.DiscordWebhookURL) {
+				continue
+			}
+			if err := nss.decrypt(ns); err != nil {
+				return changed, err
+			}
+			if err := nss.encrypt(ns); err != nil {
+				return changed, err
+			}
+			err := nss.db.Model(ns).UpdateColumns(map[string]interface{}{
+				"slack_webhook_url":   ns.SlackWebhookURL,
+				"discord_webhook_url": ns.DiscordWebhookURL,
+			}).Error
+			if err != nil {
+				return changed, err
+			}
+			changed++
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+)
+
+// failoverConnector opens connections to the first usable host of a
+// connection string listing several, as libpq does with host=a,b,c and
+// target_session_attrs; lib/pq only takes one host. database/sql opens
+// connections through it whenever the pool needs one, so once a primary
+// fails over, new connections find the new one without a restart.
+type failoverConnector struct {
+	// dsns are the connection strings of each host, in the order given
+	dsns  []string
+	hosts []string
+	// readWrite skips hosts whose sessions are read-only, such as
+	// standbys
+	readWrite bool
+	// last is the index of the host that last worked, tried first
+	last atomic.Int64
+}
+
+// newFailoverConnector parses a connection string in the key=value
+// format, whose host and port may be comma separated lists: a port for
+// each host, or one for all of them
+func newFailoverConnector(connectionInfo string) (*failoverConnector, error) {
+	opts, err := parseConnectionInfo(connectionInfo)
+	if err != nil {
+		return nil, err
+	}
+	c := &failoverConnector{}
+	switch attrs := opts["target_session_attrs"]; attrs {
+	case "", "any":
+	case "read-write":
+		c.readWrite = true
+	default:
+		return nil, fmt.Errorf("models: unsupported target_session_attrs %q", attrs)
+	}
+	delete(opts, "target_session_attrs")
+	hosts := strings.Split(opts["host"], ",")
+	ports := strings.Split(opts["port"], ",")
+	if len(ports) != 1 && len(ports) != len(hosts) {
+		return nil, errors.New("models: give one port, or one for each host")
+	}
+	for i, host := range hosts {
+		opts["host"] = strings.TrimSpace(host)
+		opts["port"] = strings.TrimSpace(ports[0])
+		if len(ports) > 1 {
+			opts["port"] = strings.TrimSpace(ports[i])
+		}
+		c.dsns = append(c.dsns, formatConnectionInfo(opts))
+		c.hosts = append(c.hosts, opts["host"]+":"+opts["port"])
+	}
+	return c, nil
+}
+
+// Connect implements driver.Connector, trying each host in turn from the
+// one that last worked
+func (c *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := int(c.last.Load())
+	var errs []string
+	for i := range c.dsns {
+		n := (start + i) % len(c.dsns)
+		conn, err := c.connect(ctx, n)
+		if err == nil {
+			c.last.Store(int64(n))
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, c.hosts[n]+": "+err.Error())
+	}
+	if len(errs) == 1 {
+		return nil, errors.New(errs[0])
+	}
+	return nil, errors.New("models: no usable database host: " + strings.Join(errs, "; "))
+}
+
+// connect opens a connection to the nth host, checking that it takes
+// writes if it must
+func (c *failoverConnector) connect(ctx context.Context, n int) (driver.Conn, error) {
+	pc, err := pq.NewConnector(c.dsns[n])
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pc.Connect(ctx)
+	if err != nil || !c.readWrite {
+		return conn, err
+	}
+	readOnly, err := transactionReadOnly(ctx, conn)
+	if err == nil && readOnly {
+		err = errors.New("read-only session")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Driver implements driver.Connector
+func (c *failoverConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// transactionReadOnly tells whether a connection's sessions are read-only
+func transactionReadOnly(ctx context.Context, conn driver.Conn) (bool, error) {
+	q, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return false, errors.New("models: the driver can't query")
+	}
+	rows, err := q.QueryContext(ctx, "SHOW transaction_read_only", nil)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		if err == io.EOF {
+			err = errors.New("models: SHOW transaction_read_only returned nothing")
+		}
+		return false, err
+	}
+	var value string
+	switch v := dest[0].(type) {
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	}
+	return value == "on", nil
+}
+
+// parseConnectionInfo parses a connection string in the key=value
+// format, whose values may be single-quoted with backslash escapes
+func parseConnectionInfo(s string) (map[string]string, error) {
+	opts := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("models: malformed connection info near %q", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var value strings.Builder
+		if strings.HasPrefix(s, "'") {
+			i, closed := 1, false
+			for ; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				} else if s[i] == '\'' {
+					closed = true
+					break
+				}
+				value.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, errors.New("models: unterminated quote in connection info")
+			}
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(s[:end])
+			s = s[end:]
+		}
+		opts[key] = value.String()
+	}
+	return opts, nil
+}
+
+// formatConnectionInfo formats options as a connection string, quoting
+// every value
+func formatConnectionInfo(opts map[string]string) string {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "='" + escape.Replace(opts[k]) + "'"
+	}
+	return strings.Join(parts, " ")
+}
+
+// openDB opens a pool of connections through a failoverConnector. It
+// doesn't connect yet; see Services.WaitForDB.
+func openDB(connectionInfo string) (*sql.DB, error) {
+	connector, err := newFailoverConnector(connectionInfo)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewFailoverConnector(t *testing.T) {
+	// As PostgresConfig.ConnectionInfo formats it
+	c, err := newFailoverConnector(`host='db1, db2' port=5432,6432 user='gastb' ` +
+		`password='it\'s a \\secret' dbname='gastb' sslmode=disable target_session_attrs=read-write`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.readWrite {
+		t.Error("target_session_attrs=read-write was ignored")
+	}
+	if got := strings.Join(c.hosts, " "); got != "db1:5432 db2:6432" {
+		t.Errorf("hosts = %s", got)
+	}
+	want := `dbname='gastb' host='db2' password='it\'s a \\secret' port='6432' sslmode='disable' user='gastb'`
+	if c.dsns[1] != want {
+		t.Errorf("dsn = %s, want %s", c.dsns[1], want)
+	}
+
+	// One port for every host
+	c, _ = newFailoverConnector("host=db1,db2 port=5432")
+	if got := strings.Join(c.hosts, " "); got != "db1:5432 db2:5432" {
+		t.Errorf("hosts = %s", got)
+	}
+
+	for _, info := range []string{
+		"host=db1,db2,db3 port=1,2",
+		"host=db1 target_session_attrs=read-only",
+		"host='db1",
+		"=db1",
+	} {
+		if _, err := newFailoverConnector(info); err == nil {
+			t.Errorf("newFailoverConnector(%q) succeeded", info)
+		}
+	}
+}
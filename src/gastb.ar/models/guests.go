@@ -0,0 +1,235 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gastb.ar/clock"
+	"gastb.ar/hash"
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Guest is someone trying the site without an account. They build
+// stocklists against a guest token, which move to their account when
+// they sign up, see UserService.ClaimGuest. Only the hash of the token
+// is stored.
+type Guest struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+}
+
+// GuestStocklist is a stocklist of a guest
+type GuestStocklist struct {
+	ID        uint `gorm:"primary_key"`
+	GuestID   uint `gorm:"not null;index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Name      string `gorm:"not null"`
+}
+
+// GuestTTL is how long guests keep their stocklists without signing up
+const GuestTTL = 7 * 24 * time.Hour
+
+// MaxGuestStocklists is how many stocklists a guest can have
+const MaxGuestStocklists = 10
+
+var (
+	// ErrInvalidGuest is returned when a guest token is unknown, expired
+	// or already claimed.
+	ErrInvalidGuest = errors.New("models: guest token is invalid or expired")
+	// ErrGuestLimit is returned when a guest adds a stocklist over
+	// MaxGuestStocklists.
+	ErrGuestLimit = errors.New("models: guests can't have more stocklists, sign up to add more")
+)
+
+// GuestService creates guests and keeps their stocklists.
+type GuestService struct {
+	db    *gorm.DB
+	hmac  hash.HMAC
+	clock clock.Clock
+}
+
+// NewGuestService instantiates a GuestService on a database connection
+// and a hasher for the tokens.
+func NewGuestService(db *gorm.DB, hmacSecretKey string) *GuestService {
+	return &GuestService{
+		db:    db,
+		hmac:  hash.NewHMAC(hmacSecretKey),
+		clock: clock.Real,
+	}
+}
+
+// SetClock sets the clock that guest expiry is based on
+func (gs *GuestService) SetClock(c clock.Clock) {
+	gs.clock = c
+}
+
+// Create starts a guest session and returns it with the Token field set.
+func (gs *GuestService) Create() (*Guest, error) {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	guest := &Guest{
+		Token:     token,
+		TokenHash: gs.hmac.Hash(token),
+		ExpiresAt: gs.clock.Now().Add(GuestTTL),
+	}
+	if err := gs.db.Create(guest).Error; err != nil {
+		return nil, err
+	}
+	return guest, nil
+}
+
+// ByToken looks up an unexpired guest by token, returning
+// ErrInvalidGuest if there is none.
+func (gs *GuestService) ByToken(token string) (*Guest, error) {
+	var guest Guest
+	err := first(gs.db.Where("token_hash = ? AND expires_at > ?",
+		gs.hmac.Hash(token), gs.clock.Now()), &guest)
+	if err == ErrNotFound {
+		return nil, ErrInvalidGuest
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &guest, nil
+}
+
+// Stocklists returns the stocklists of a guest, oldest first.
+func (gs *GuestService) Stocklists(guestID uint) ([]GuestStocklist, error) {
+	var stocklists []GuestStocklist
+	err := gs.db.Where("guest_id = ?", guestID).Order("id").Find(&stocklists).Error
+	if err != nil {
+		return nil, err
+	}
+	return stocklists, nil
+}
+
+// AddStocklist validates a guest's stocklist and stores it, up to
+// MaxGuestStocklists per guest.
+func (gs *GuestService) AddStocklist(stocklist *GuestStocklist) error {
+	stocklist.Name = strings.TrimSpace(stocklist.Name)
+	if stocklist.Name == "" {
+		return ErrNameRequired
+	}
+	var count int
+	err := gs.db.Model(&GuestStocklist{}).Where("guest_id = ?", stocklist.GuestID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count >= MaxGuestStocklists {
+		return ErrGuestLimit
+	}
+	return gs.db.Create(stocklist).Error
+}
+
+// DeleteStocklist deletes a stocklist of a guest, returning ErrNotFound
+// if the guest has no such stocklist.
+func (gs *GuestService) DeleteStocklist(guestID, id uint) error {
+	res := gs.db.Where("id = ? AND guest_id = ?", id, guestID).Delete(&GuestStocklist{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PurgeExpired deletes guests that expired before a given time, with
+// their stocklists, and returns how many guests were deleted.
+func (gs *GuestService) PurgeExpired(before time.Time) (int64, error) {
+	err := gs.db.Exec("DELETE FROM guest_stocklists WHERE guest_id IN "+
+		"(SELECT id FROM guests WHERE expires_at < ?)", before).Error
+	if err != nil {
+		return 0, err
+	}
+	db := gs.db.Where("expires_at < ?", before).Delete(&Guest{})
+	return db.RowsAffected, db.Error
+}
+
+// ClaimGuest moves the stocklists of a guest to the account of user,
+// who just signed up or logged in, and ends the guest session, returning
+// ErrInvalidGuest if the token is unknown, expired or already claimed.
+// The stocklists are private, like new ones.
+func (us *UserService) ClaimGuest(guestToken string, user *User) error {
+	if user.ID == 0 {
+		return ErrInvalidID
+	}
+	return us.guests.claim(us.hmac.Hash(guestToken), user.ID, us.clock.Now())
+}
+
+// guestGorm moves the records of guests to accounts
+type guestGorm struct {
+	db *gorm.DB
+	// rls runs claims as the user's tenant, see
+	// Services.SetRowLevelSecurity
+	rls bool
+}
+
+// claim moves the stocklists of the unexpired guest whose token has a
+// hash to a user, and deletes the guest, in a transaction. Deleting the
+// guest first makes concurrent claims of the same token wait for each
+// other, and all but the first fail.
+func (gg *guestGorm) claim(tokenHash string, userID uint, now time.Time) error {
+	var guest Guest
+	err := first(gg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, now), &guest)
+	if err == ErrNotFound {
+		return ErrInvalidGuest
+	}
+	if err != nil {
+		return err
+	}
+	tx := gg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	// The stocklists are created as the user's
+	if gg.rls {
+		err = setTenant(tx, userID)
+	}
+	if err == nil {
+		err = gg.move(tx, &guest, userID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (gg *guestGorm) move(tx *gorm.DB, guest *Guest, userID uint) error {
+	res := tx.Delete(guest)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidGuest
+	}
+	var stocklists []GuestStocklist
+	if err := tx.Where("guest_id = ?", guest.ID).Order("id").Find(&stocklists).Error; err != nil {
+		return err
+	}
+	for _, gsl := range stocklists {
+		stocklist := Stocklist{
+			UserID:  userID,
+			Name:    gsl.Name,
+			Version: 1,
+		}
+		if err := tx.Create(&stocklist).Error; err != nil {
+			return err
+		}
+		if err := recordChange(tx, &stocklist, ChangeCreate); err != nil {
+			return err
+		}
+	}
+	return tx.Where("guest_id = ?", guest.ID).Delete(&GuestStocklist{}).Error
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"gastb.ar/metrics"
+	"gastb.ar/tracing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// QueryEvent describes a database operation once it has finished.
+type QueryEvent struct {
+	// Op is one of "create", "query", "update", "delete" or "row_query"
+	Op       string
+	Table    string
+	SQL      string
+	Vars     []interface{}
+	Duration time.Duration
+	Err      error
+}
+
+// QueryHook is called after every database operation.
+type QueryHook func(e QueryEvent)
+
+// queryHooks is the list of hooks called by the gorm callbacks
+type queryHooks struct {
+	mu    sync.RWMutex
+	hooks []QueryHook
+}
+
+func (qh *queryHooks) add(h QueryHook) {
+	qh.mu.Lock()
+	defer qh.mu.Unlock()
+	qh.hooks = append(qh.hooks, h)
+}
+
+func (qh *queryHooks) call(e QueryEvent) {
+	qh.mu.RLock()
+	defer qh.mu.RUnlock()
+	for _, h := range qh.hooks {
+		h(e)
+	}
+}
+
+// AddQueryHook registers a hook called after every database operation
+func (s *Services) AddQueryHook(h QueryHook) {
+	s.hooks.add(h)
+}
+
+// Key under which the start time of an operation is stored in its scope
+const startKey = "hooks:start"
+
+// registerCallbacks installs gorm callbacks around every kind of operation
+// that time it and pass a QueryEvent to the hooks
+func registerCallbacks(db *gorm.DB, qh *queryHooks) {
+	before := func(scope *gorm.Scope) {
+		scope.Set(startKey, time.Now())
+	}
+	after := func(op string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			var d time.Duration
+			if start, ok := scope.Get(startKey); ok {
+				d = time.Since(start.(time.Time))
+			}
+			qh.call(QueryEvent{
+				Op:       op,
+				Table:    scope.TableName(),
+				SQL:      scope.SQL,
+				Vars:     scope.SQLVars,
+				Duration: d,
+				Err:      scope.DB().Error,
+			})
+		}
+	}
+
+	cb := db.Callback()
+	cb.Create().Before("gorm:begin_transaction").Register("hooks:before_create", before)
+	cb.Create().After("gorm:commit_or_rollback_transaction").Register("hooks:after_create", after("create"))
+	cb.Query().Before("gorm:query").Register("hooks:before_query", before)
+	cb.Query().After("gorm:after_query").Register("hooks:after_query", after("query"))
+	cb.Update().Before("gorm:begin_transaction").Register("hooks:before_update", before)
+	cb.Update().After("gorm:commit_or_rollback_transaction").Register("hooks:after_update", after("update"))
+	cb.Delete().Before("gorm:begin_transaction").Register("hooks:before_delete", before)
+	cb.Delete().After("gorm:commit_or_rollback_transaction").Register("hooks:after_delete", after("delete"))
+	cb.RowQuery().Before("gorm:row_query").Register("hooks:before_row_query", before)
+	cb.RowQuery().After("gorm:row_query").Register("hooks:after_row_query", after("row_query"))
+}
+
+// queryDuration is the latency of database operations by kind and table
+var queryDuration = metrics.NewHistogram("db_query_duration_seconds",
+	"Latency of database operations.", nil, "op", "table")
+
+// observeQuery records a QueryEvent in the db_query_duration_seconds metric
+func observeQuery(e QueryEvent) {
+	queryDuration.Observe(e.Duration.Seconds(), e.Op, e.Table)
+}
+
+// traceQuery records a QueryEvent as a database client span. gorm does not
+// carry the request context down to its callbacks, so query spans are not
+// linked to the span of the request that caused them.
+func traceQuery(e QueryEvent) {
+	if !tracing.Enabled() {
+		return
+	}
+	end := time.Now()
+	tracing.Record("db."+e.Op+" "+e.Table, tracing.KindClient, end.Add(-e.Duration), end,
+		map[string]string{
+			"db.system":    "postgresql",
+			"db.operation": e.Op,
+			"db.sql.table": e.Table,
+			"db.statement": e.SQL,
+		}, e.Err)
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gastb.ar/clock"
+
+	"github.com/jinzhu/gorm"
+)
+
+// IdempotencyKey is a key a client sent with a request so that retrying
+// it doesn't repeat its effects, with the response it got. Status is 0
+// while the first request is still being handled.
+type IdempotencyKey struct {
+	ID     uint   `gorm:"primary_key"`
+	UserID uint   `gorm:"not null;unique_index:uix_idempotency_keys_user_key"`
+	Key    string `gorm:"not null;unique_index:uix_idempotency_keys_user_key"`
+	// Fingerprint identifies the request the key was first used for,
+	// from its method, path and body
+	Fingerprint string `gorm:"not null"`
+	Status      int    `gorm:"not null"`
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+// Done reports whether the response of the first request is stored
+func (k *IdempotencyKey) Done() bool {
+	return k.Status != 0
+}
+
+// DefaultIdempotencyRetention is how long responses are kept for
+// retries, unless set otherwise with SetRetention
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+var (
+	// ErrIdempotencyKeyReused is returned when a key is sent again with
+	// a different request than the one it was first used for.
+	ErrIdempotencyKeyReused = errors.New("models: the idempotency key was used for a different request")
+
+	// ErrIdempotencyInProgress is returned when a key is sent again
+	// while the first request with it is still being handled.
+	ErrIdempotencyInProgress = errors.New("models: a request with this idempotency key is in progress")
+)
+
+// IdempotencyKeyService stores the responses of requests made with an
+// idempotency key, to replay them when the requests are retried.
+type IdempotencyKeyService struct {
+	db        *gorm.DB
+	clock     clock.Clock
+	retention time.Duration
+}
+
+// NewIdempotencyKeyService instantiates an IdempotencyKeyService on a
+// database connection.
+func NewIdempotencyKeyService(db *gorm.DB) *IdempotencyKeyService {
+	return &IdempotencyKeyService{
+		db:        db,
+		clock:     clock.Real,
+		retention: DefaultIdempotencyRetention,
+	}
+}
+
+// SetClock sets the clock keys expire by
+func (is *IdempotencyKeyService) SetClock(c clock.Clock) {
+	is.clock = c
+}
+
+// SetRetention sets how long responses are kept for retries
+func (is *IdempotencyKeyService) SetRetention(d time.Duration) {
+	if d > 0 {
+		is.retention = d
+	}
+}
+
+// Begin claims a user's key for a request with a fingerprint. It returns
+// the new, pending key if it wasn't used yet, or the one stored for it:
+// done, to replay its response, or else ErrIdempotencyInProgress. A key
+// used for another request returns ErrIdempotencyKeyReused. Expired keys
+// can be used again.
+func (is *IdempotencyKeyService) Begin(userID uint, key, fingerprint string) (*IdempotencyKey, error) {
+	now := is.clock.Now()
+	err := is.db.Where("user_id = ? AND key = ? AND expires_at < ?", userID, key, now).
+		Delete(&IdempotencyKey{}).Error
+	if err != nil {
+		return nil, err
+	}
+	res := is.db.Exec("INSERT INTO idempotency_keys (user_id, key, fingerprint, status, "+
+		"created_at, expires_at) VALUES (?, ?, ?, 0, ?, ?) ON CONFLICT DO NOTHING",
+		userID, key, fingerprint, now, now.Add(is.retention))
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	var k IdempotencyKey
+	if err := first(is.db.Where("user_id = ? AND key = ?", userID, key), &k); err != nil {
+		return nil, err
+	}
+	if res.RowsAffected == 1 {
+		return &k, nil
+	}
+	if k.Fingerprint != fingerprint {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if !k.Done() {
+		return nil, ErrIdempotencyInProgress
+	}
+	return &k, nil
+}
+
+// Complete stores the response to the request a pending key was claimed
+// for.
+func (is *IdempotencyKeyService) Complete(k *IdempotencyKey, status int, contentType string, body []byte) error {
+	k.Status = status
+	k.ContentType = contentType
+	k.Body = body
+	return is.db.Model(k).Updates(map[string]interface{}{
+		"status":       status,
+		"content_type": contentType,
+		"body":         body,
+	}).Error
+}
+
+// Release deletes a pending key whose request failed, so that it can be
+// retried.
+func (is *IdempotencyKeyService) Release(k *IdempotencyKey) error {
+	return is.db.Delete(k).Error
+}
+
+// PurgeExpired deletes keys that expired before a given time, and
+// returns how many were deleted.
+func (is *IdempotencyKeyService) PurgeExpired(before time.Time) (int64, error) {
+	db := is.db.Where("expires_at < ?", before).Delete(&IdempotencyKey{})
+	return db.RowsAffected, db.Error
+}
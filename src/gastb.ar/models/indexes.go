@@ -0,0 +1,161 @@
+package models
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Index is an index created by the migration rather than from gorm tags.
+// AutoMigrate builds tag indexes with a plain CREATE INDEX, which blocks
+// writes to the table until it is done; these are built concurrently, so
+// adding one to a large table doesn't take the site down.
+type Index struct {
+	Name  string
+	Table string
+	// Columns may be expressions, with an operator class
+	Columns []string
+	Unique  bool
+	// Using is the index method, such as gin; empty means btree
+	Using string
+	// Extension is a Postgres extension the index needs. If it can't be
+	// created, as without the privilege to, the index is skipped.
+	Extension string
+	// Where makes a partial index of the rows matching a condition
+	Where string
+}
+
+// indexes lists the explicit indexes. Names match those gorm gave them
+// when they were tags, so existing databases already have them.
+var indexes = []Index{
+	// Remember cookies set before sessions were kept are looked up by it
+	{Name: "uix_users_token_hash", Table: "users", Columns: []string{"token_hash"}, Unique: true},
+	// Emails and usernames are unique among users that weren't deleted,
+	// whose lookups ignore deleted rows, so that a deleted account's
+	// address can sign up again. Logins and profile pages are by either;
+	// users without a username have NULL.
+	{Name: "uix_users_email_live", Table: "users", Columns: []string{"email"}, Unique: true,
+		Where: "deleted_at IS NULL"},
+	{Name: "uix_users_username_live", Table: "users", Columns: []string{"username"}, Unique: true,
+		Where: "deleted_at IS NULL"},
+	// Listing a user's stocklists
+	{Name: "idx_stocklists_user_id", Table: "stocklists", Columns: []string{"user_id"}},
+	// Listing a team's stocklists; most stocklists are personal, with
+	// NULL, and left out
+	{Name: "idx_stocklists_organization_id", Table: "stocklists",
+		Columns: []string{"organization_id"}, Where: "organization_id IS NOT NULL"},
+	// Full text search, see SearchService
+	{Name: "idx_stocklists_search_vector", Table: "stocklists", Using: "gin",
+		Columns: []string{"search_vector"}},
+	// The feeds of public stocklists
+	{Name: "idx_changes_entity_id", Table: "changes", Columns: []string{"entity", "entity_id", "seq"}},
+	// The admin user search: trigram indexes serve the substring matches
+	// on email and name, and btree ones the date ranges and the order.
+	// Role, verification and lockout match too many users for an index
+	// to help, so they are filtered among the rows the others find.
+	{Name: "idx_users_email_trgm", Table: "users", Using: "gin", Extension: "pg_trgm",
+		Columns: []string{"lower(email) gin_trgm_ops"}},
+	{Name: "idx_users_name_trgm", Table: "users", Using: "gin", Extension: "pg_trgm",
+		Columns: []string{"lower(name) gin_trgm_ops"}},
+	{Name: "idx_users_created_at", Table: "users", Columns: []string{"created_at"}},
+	{Name: "idx_users_last_login_at", Table: "users", Columns: []string{"last_login_at"}},
+}
+
+// droppedIndexes are indexes that were replaced, dropped once those of
+// indexes are built
+var droppedIndexes = []string{
+	// Covered deleted users too; see uix_users_email_live
+	"uix_users_email",
+	"uix_users_username",
+}
+
+// createIndexes creates missing indexes concurrently, then drops the
+// replaced ones of droppedIndexes. A concurrent build
+// that fails leaves an invalid index behind, which IF NOT EXISTS would
+// skip, so invalid indexes are dropped and built again.
+func (s *Services) createIndexes() error {
+	for _, idx := range indexes {
+		exists, valid, err := s.indexState(idx.Name)
+		if err != nil {
+			return err
+		}
+		if exists && valid {
+			continue
+		}
+		if idx.Extension != "" {
+			err := s.admin.Exec("CREATE EXTENSION IF NOT EXISTS " + idx.Extension).Error
+			if err != nil {
+				slog.Warn("skipping index whose extension can't be created",
+					"index", idx.Name, "extension", idx.Extension, "error", err)
+				continue
+			}
+		}
+		if exists {
+			if err := s.admin.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + idx.Name).Error; err != nil {
+				return err
+			}
+		}
+		unique := ""
+		if idx.Unique {
+			unique = "UNIQUE "
+		}
+		using := ""
+		if idx.Using != "" {
+			using = " USING " + idx.Using
+		}
+		where := ""
+		if idx.Where != "" {
+			where = " WHERE " + idx.Where
+		}
+		// CONCURRENTLY can't run in a transaction, and Exec doesn't open one
+		err = s.admin.Exec(fmt.Sprintf("CREATE %sINDEX CONCURRENTLY IF NOT EXISTS %s ON %s%s (%s)%s",
+			unique, idx.Name, idx.Table, using, strings.Join(idx.Columns, ", "), where)).Error
+		if err != nil {
+			return fmt.Errorf("models: creating index %s: %v", idx.Name, err)
+		}
+	}
+	for _, name := range droppedIndexes {
+		if err := s.admin.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexState tells whether an index exists and, if so, whether its build
+// finished
+func (s *Services) indexState(name string) (exists, valid bool, err error) {
+	rows, err := s.admin.Raw(`SELECT i.indisvalid FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relname = ? AND pg_table_is_visible(c.oid)`, name).Rows()
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, false, rows.Err()
+	}
+	err = rows.Scan(&valid)
+	return true, valid, err
+}
+
+// IndexStatus tells whether an explicit index exists and is usable
+type IndexStatus struct {
+	Index
+	Exists bool
+	// Valid is false for an index whose concurrent build failed
+	Valid bool
+}
+
+// IndexStatus lists the explicit indexes and their state
+func (s *Services) IndexStatus() ([]IndexStatus, error) {
+	var status []IndexStatus
+	for _, idx := range indexes {
+		exists, valid, err := s.indexState(idx.Name)
+		if err != nil {
+			return nil, err
+		}
+		status = append(status, IndexStatus{Index: idx, Exists: exists, Valid: valid})
+	}
+	return status, nil
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gastb.ar/clock"
+	"gastb.ar/hash"
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Invite lets someone sign up when signups are invite only. Only the hash
+// of the code is stored.
+type Invite struct {
+	gorm.Model
+	CreatedBy uint   `gorm:"not null"`
+	Email     string
+	Code      string `gorm:"-"`
+	CodeHash  string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	UsedBy    uint
+}
+
+// How long an invite can be used
+const InviteTTL = 7 * 24 * time.Hour
+
+// ErrInvalidInvite is returned when an invite code is unknown, expired or
+// already used.
+var ErrInvalidInvite = errors.New("models: invite is invalid or expired")
+
+// InviteService creates and redeems invites.
+type InviteService struct {
+	db    *gorm.DB
+	hmac  hash.HMAC
+	clock clock.Clock
+}
+
+// NewInviteService instantiates an InviteService on a database connection
+// and a hasher for the codes.
+func NewInviteService(db *gorm.DB, hmacSecretKey string) *InviteService {
+	return &InviteService {
+		db:    db,
+		hmac:  hash.NewHMAC(hmacSecretKey),
+		clock: clock.Real,
+	}
+}
+
+// SetClock sets the clock that invite expiry is based on
+func (is *InviteService) SetClock(c clock.Clock) {
+	is.clock = c
+}
+
+// Create generates an invite on behalf of a user, optionally meant for a
+// given email address, and returns it with the Code field set.
+func (is *InviteService) Create(createdBy uint, email string) (*Invite, error) {
+	code, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	invite := &Invite{
+		CreatedBy: createdBy,
+		Email:     email,
+		Code:      code,
+		CodeHash:  is.hmac.Hash(code),
+		ExpiresAt: is.clock.Now().Add(InviteTTL),
+	}
+	if err := is.db.Create(invite).Error; err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// ByCode looks up a usable invite by code, returning ErrInvalidInvite if
+// there is none.
+func (is *InviteService) ByCode(code string) (*Invite, error) {
+	var invite Invite
+	db := is.db.Where("code_hash = ?", is.hmac.Hash(code))
+	err := first(db, &invite)
+	if err == ErrNotFound {
+		return nil, ErrInvalidInvite
+	}
+	if err != nil {
+		return nil, err
+	}
+	if invite.UsedAt != nil || is.clock.Now().After(invite.ExpiresAt) {
+		return nil, ErrInvalidInvite
+	}
+	return &invite, nil
+}
+
+// Redeem marks an invite as used by a user.
+func (is *InviteService) Redeem(invite *Invite, userID uint) error {
+	now := is.clock.Now()
+	invite.UsedAt = &now
+	invite.UsedBy = userID
+	return is.db.Save(invite).Error
+}
+
+// Recent returns the latest invites, newest first.
+func (is *InviteService) Recent(limit int) ([]Invite, error) {
+	var invites []Invite
+	err := is.db.Order("created_at desc").Limit(limit).Find(&invites).Error
+	if err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// PurgeExpired deletes invites that expired before a given time without
+// being used, and returns how many were deleted.
+func (is *InviteService) PurgeExpired(before time.Time) (int64, error) {
+	db := is.db.Where("used_at IS NULL AND expires_at < ?", before).Delete(&Invite{})
+	return db.RowsAffected, db.Error
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Job is a unit of background work in the jobs table, run by the jobs
+// package. Finished jobs are kept until purged, as a record of what ran.
+type Job struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Kind names the handler that runs the job, e.g. "webhooks.deliver"
+	Kind string `gorm:"not null"`
+	// Args is the JSON encoded input of the handler
+	Args string `gorm:"type:text"`
+	// Key optionally identifies a job so that it is not enqueued twice
+	// while pending
+	Key         string `gorm:"index"`
+	RunAt       time.Time `gorm:"not null;index"`
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	// LockedUntil is set while a worker runs the job; jobs whose worker
+	// died are picked up again once it passes
+	LockedUntil *time.Time
+	FinishedAt  *time.Time `gorm:"index"`
+	Failed      bool
+}
+
+// ErrJobPending is returned when enqueueing a job whose key is already
+// used by a pending job.
+var ErrJobPending = errors.New("models: a job with this key is pending")
+
+// JobService stores jobs and hands them out to workers.
+type JobService struct {
+	db *gorm.DB
+}
+
+// NewJobService instantiates a JobService on a database connection.
+func NewJobService(db *gorm.DB) *JobService {
+	return &JobService {
+		db: db,
+	}
+}
+
+// Enqueue stores a new job. If the job has a Key and a pending job with
+// the same key exists, it returns ErrJobPending.
+func (js *JobService) Enqueue(job *Job) error {
+	if job.Key != "" {
+		var count int
+		err := js.db.Model(&Job{}).
+			Where("key = ? AND finished_at IS NULL", job.Key).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrJobPending
+		}
+	}
+	return js.db.Create(job).Error
+}
+
+// Claim locks the next job due at now for lease and increments its
+// attempts. It returns ErrNotFound when there is nothing to run.
+// Concurrent workers never get the same job, thanks to SKIP LOCKED.
+func (js *JobService) Claim(now time.Time, lease time.Duration) (*Job, error) {
+	var job Job
+	err := js.db.Raw(`UPDATE jobs SET locked_until = ?, attempts = attempts + 1,
+		updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE finished_at IS NULL AND run_at <= ?
+				AND (locked_until IS NULL OR locked_until < ?)
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`, now.Add(lease), now, now, now).Scan(&job).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Complete marks a job as done.
+func (js *JobService) Complete(job *Job) error {
+	now := time.Now()
+	return js.db.Model(job).Updates(map[string]interface{}{
+		"finished_at":  &now,
+		"locked_until": nil,
+		"last_error":   "",
+	}).Error
+}
+
+// Retry records a failed attempt and schedules the next one at runAt.
+func (js *JobService) Retry(job *Job, jobErr error, runAt time.Time) error {
+	return js.db.Model(job).Updates(map[string]interface{}{
+		"run_at":       runAt,
+		"locked_until": nil,
+		"last_error":   jobErr.Error(),
+	}).Error
+}
+
+// Fail records a failed attempt and gives up on the job.
+func (js *JobService) Fail(job *Job, jobErr error) error {
+	now := time.Now()
+	return js.db.Model(job).Updates(map[string]interface{}{
+		"finished_at":  &now,
+		"locked_until": nil,
+		"last_error":   jobErr.Error(),
+		"failed":       true,
+	}).Error
+}
+
+// LastByKind returns the most recently enqueued job of a kind.
+func (js *JobService) LastByKind(kind string) (*Job, error) {
+	var job Job
+	db := js.db.Where("kind = ?", kind).Order("id desc")
+	if err := first(db, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// PurgeFinished deletes jobs finished before a given time and returns
+// how many were deleted.
+func (js *JobService) PurgeFinished(before time.Time) (int64, error) {
+	db := js.db.Where("finished_at < ?", before).Delete(&Job{})
+	return db.RowsAffected, db.Error
+}
@@ -0,0 +1,584 @@
+package modelstest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// TestUserDB checks that a models.UserDB behaves as the services expect.
+// newDB must return an empty database each time it is called. It is meant
+// to be called from the tests of every implementation, e.g.
+//
+//	func TestUsers(t *testing.T) {
+//		modelstest.TestUserDB(t, func() models.UserDB { return modelstest.NewUsers() })
+//	}
+func TestUserDB(t *testing.T, newDB func() models.UserDB) {
+	t.Run("CreateAndLookUp", func(t *testing.T) {
+		db := newDB()
+		user := newUser("ana@example.com", "Ana")
+		username := "ana"
+		user.Username = &username
+		if err := db.Create(user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if user.ID == 0 {
+			t.Fatal("Create did not assign an ID")
+		}
+		lookups := map[string]func() (*models.User, error){
+			"ByID":        func() (*models.User, error) { return db.ByID(user.ID) },
+			"ByEmail":     func() (*models.User, error) { return db.ByEmail(user.Email) },
+			"ByTokenHash": func() (*models.User, error) { return db.ByTokenHash(user.TokenHash) },
+			"ByUsername":  func() (*models.User, error) { return db.ByUsername(username) },
+		}
+		for name, lookup := range lookups {
+			got, err := lookup()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got.ID != user.ID || got.Email != user.Email {
+				t.Errorf("%s returned user %d %q, want %d %q", name,
+					got.ID, got.Email, user.ID, user.Email)
+			}
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		db := newDB()
+		if _, err := db.ByID(42); err != models.ErrNotFound {
+			t.Errorf("ByID of a missing user returned %v, want ErrNotFound", err)
+		}
+		if _, err := db.ByEmail("nobody@example.com"); err != models.ErrNotFound {
+			t.Errorf("ByEmail of a missing user returned %v, want ErrNotFound", err)
+		}
+		if _, err := db.ByTokenHash("nope"); err != models.ErrNotFound {
+			t.Errorf("ByTokenHash of a missing user returned %v, want ErrNotFound", err)
+		}
+		if _, err := db.ByUsername("nobody"); err != models.ErrNotFound {
+			t.Errorf("ByUsername of a missing user returned %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("UniqueEmail", func(t *testing.T) {
+		db := newDB()
+		if err := db.Create(newUser("ana@example.com", "Ana")); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := db.Create(newUser("ana@example.com", "Other Ana")); err == nil {
+			t.Error("Create with a taken email succeeded")
+		}
+	})
+
+	t.Run("UniqueUsername", func(t *testing.T) {
+		db := newDB()
+		ana, other := newUser("ana@example.com", "Ana"), newUser("ana@example.org", "Other Ana")
+		username := "ana"
+		ana.Username, other.Username = &username, &username
+		if err := db.Create(ana); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := db.Create(other); err == nil {
+			t.Error("Create with a taken username succeeded")
+		}
+		// Users without a username don't clash
+		for _, email := range []string{"bruno@example.com", "carla@example.com"} {
+			if err := db.Create(newUser(email, "")); err != nil {
+				t.Errorf("Create without a username: %v", err)
+			}
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		db := newDB()
+		user := newUser("ana@example.com", "Ana")
+		if err := db.Create(user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		user.Name = "Ana María"
+		if err := db.Update(user); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		got, err := db.ByID(user.ID)
+		if err != nil {
+			t.Fatalf("ByID: %v", err)
+		}
+		if got.Name != "Ana María" {
+			t.Errorf("name after Update is %q, want %q", got.Name, "Ana María")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		db := newDB()
+		user := newUser("ana@example.com", "Ana")
+		if err := db.Create(user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := db.Delete(user.ID); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := db.ByID(user.ID); err != models.ErrNotFound {
+			t.Errorf("ByID after Delete returned %v, want ErrNotFound", err)
+		}
+		if err := db.Delete(0); err != models.ErrInvalidID {
+			t.Errorf("Delete(0) returned %v, want ErrInvalidID", err)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		db := newDB()
+		for _, u := range []*models.User{
+			newUser("ana@example.com", "Ana"),
+			newUser("bruno@example.com", "Bruno"),
+			newUser("carla@example.org", "Carla Anaya"),
+		} {
+			if err := db.Create(u); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		users, err := db.Search(models.SearchQuery{Text: "ANA", Limit: 10})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(users) != 2 {
+			t.Errorf("Search matched %d users, want 2", len(users))
+		}
+		// Wildcards in the text match literally
+		for _, text := range []string{"%", "_", `\`, "a_a"} {
+			users, err = db.Search(models.SearchQuery{Text: text, Limit: 10})
+			if err != nil {
+				t.Fatalf("Search %q: %v", text, err)
+			}
+			if len(users) != 0 {
+				t.Errorf("Search %q matched %d users, want none", text, len(users))
+			}
+		}
+		users, err = db.Search(models.SearchQuery{Limit: 2})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(users) != 2 {
+			t.Errorf("Search with limit 2 returned %d users", len(users))
+		}
+	})
+
+	t.Run("SearchFilters", func(t *testing.T) {
+		db := newDB()
+		now := time.Now().Truncate(time.Second)
+		earlier := now.Add(-48 * time.Hour)
+		later := now.Add(time.Hour)
+		ana := newUser("ana@example.com", "Ana")
+		ana.Role = models.RoleAdmin
+		ana.EmailVerifiedAt = &earlier
+		ana.LastLoginAt = &now
+		bruno := newUser("bruno@example.com", "Bruno")
+		bruno.Role = models.RoleUser
+		bruno.LockedUntil = &later
+		for _, u := range []*models.User{ana, bruno} {
+			if err := db.Create(u); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		yes, no := true, false
+		for name, c := range map[string]struct {
+			query models.SearchQuery
+			want  string
+		}{
+			"verified":      {models.SearchQuery{Verified: &yes}, "ana@example.com"},
+			"unverified":    {models.SearchQuery{Verified: &no}, "bruno@example.com"},
+			"role":          {models.SearchQuery{Role: models.RoleUser}, "bruno@example.com"},
+			"locked":        {models.SearchQuery{Locked: &yes, Now: now}, "bruno@example.com"},
+			"not locked":    {models.SearchQuery{Locked: &no, Now: now}, "ana@example.com"},
+			"logged in":     {models.SearchQuery{LastLoginAfter: earlier}, "ana@example.com"},
+			"text and role": {models.SearchQuery{Text: "example", Role: models.RoleAdmin}, "ana@example.com"},
+		} {
+			users, err := db.Search(c.query)
+			if err != nil {
+				t.Fatalf("Search %s: %v", name, err)
+			}
+			if len(users) != 1 || users[0].Email != c.want {
+				t.Errorf("Search %s returned %d users starting at %q, want only %s",
+					name, len(users), firstEmail(users), c.want)
+			}
+		}
+		users, err := db.Search(models.SearchQuery{CreatedBefore: earlier})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(users) != 0 {
+			t.Errorf("Search created before two days ago returned %d users, want 0", len(users))
+		}
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		db := newDB()
+		for _, u := range []*models.User{
+			newUser("ana@example.com", "Ana"),
+			newUser("bruno@example.com", "Bruno"),
+			newUser("carla@example.org", "Carla"),
+		} {
+			if err := db.Create(u); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		users, total, err := db.Page(1, 10)
+		if err != nil {
+			t.Fatalf("Page: %v", err)
+		}
+		if total != 3 {
+			t.Errorf("Page counted %d users, want 3", total)
+		}
+		if len(users) != 2 || users[0].Email != "bruno@example.com" {
+			t.Errorf("Page(1, 10) returned %d users starting at %q, want 2 from bruno",
+				len(users), firstEmail(users))
+		}
+		if users, _, _ := db.Page(5, 10); len(users) != 0 {
+			t.Errorf("Page past the end returned %d users", len(users))
+		}
+	})
+
+	t.Run("Undeliverable", func(t *testing.T) {
+		db := newDB()
+		ana := newUser("ana@example.com", "Ana")
+		bruno := newUser("bruno@example.com", "Bruno")
+		for _, u := range []*models.User{ana, bruno} {
+			if err := db.Create(u); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		now := time.Now()
+		bruno.Undeliverable = models.UndeliverableBounce
+		bruno.UndeliverableAt = &now
+		if err := db.Update(bruno); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		users, err := db.Undeliverable(10)
+		if err != nil {
+			t.Fatalf("Undeliverable: %v", err)
+		}
+		if len(users) != 1 || users[0].ID != bruno.ID {
+			t.Errorf("Undeliverable returned %v, want only %s", users, bruno.Email)
+		}
+		emails, err := db.UndeliverableAmong([]string{ana.Email, bruno.Email, "x@example.com"})
+		if err != nil {
+			t.Fatalf("UndeliverableAmong: %v", err)
+		}
+		if len(emails) != 1 || emails[0] != bruno.Email {
+			t.Errorf("UndeliverableAmong returned %v, want [%s]", emails, bruno.Email)
+		}
+	})
+}
+
+// TestStocklistDB checks that a models.StocklistDB behaves as the
+// services expect. newDB must return an empty database each time it is
+// called.
+func TestStocklistDB(t *testing.T, newDB func() models.StocklistDB) {
+	t.Run("CreateAndLookUp", func(t *testing.T) {
+		db := newDB()
+		s := &models.Stocklist{UserID: 1, Name: "Tech", Version: 1}
+		if err := db.Create(s); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if s.ID == 0 {
+			t.Fatal("Create did not assign an ID")
+		}
+		got, err := db.ByID(s.ID)
+		if err != nil {
+			t.Fatalf("ByID: %v", err)
+		}
+		if got.Name != "Tech" || got.UserID != 1 {
+			t.Errorf("ByID returned %q of user %d, want %q of user 1",
+				got.Name, got.UserID, "Tech")
+		}
+		if _, err := db.ByID(s.ID + 100); err != models.ErrNotFound {
+			t.Errorf("ByID of a missing stocklist returned %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("ByUserID", func(t *testing.T) {
+		db := newDB()
+		org := uint(1)
+		for _, s := range []*models.Stocklist{
+			{UserID: 1, Name: "Tech", Version: 1},
+			{UserID: 1, Name: "Energy", Version: 1},
+			{UserID: 2, Name: "Banks", Version: 1},
+			{UserID: 1, OrganizationID: &org, Name: "Team", Version: 1},
+		} {
+			if err := db.Create(s); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		stocklists, err := db.ByUserID(1)
+		if err != nil {
+			t.Fatalf("ByUserID: %v", err)
+		}
+		if len(stocklists) != 2 {
+			t.Errorf("ByUserID returned %d stocklists, want the 2 personal ones",
+				len(stocklists))
+		}
+	})
+
+	t.Run("ByOrganizationID", func(t *testing.T) {
+		db := newDB()
+		org, other := uint(1), uint(2)
+		for _, s := range []*models.Stocklist{
+			{UserID: 1, OrganizationID: &org, Name: "Tech", Version: 1},
+			{UserID: 1, Name: "Energy", Version: 1},
+			{UserID: 2, OrganizationID: &org, Name: "Banks", Version: 1},
+			{UserID: 2, OrganizationID: &other, Name: "Retail", Version: 1},
+		} {
+			if err := db.Create(s); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		stocklists, err := db.ByOrganizationID(org)
+		if err != nil {
+			t.Fatalf("ByOrganizationID: %v", err)
+		}
+		if len(stocklists) != 2 || stocklists[0].Name != "Tech" || stocklists[1].Name != "Banks" {
+			t.Errorf("ByOrganizationID returned %v, want Tech and Banks in ID order", stocklists)
+		}
+	})
+
+	t.Run("EachByUserID", func(t *testing.T) {
+		db := newDB()
+		for _, s := range []*models.Stocklist{
+			{UserID: 1, Name: "Tech", Version: 1},
+			{UserID: 2, Name: "Banks", Version: 1},
+			{UserID: 1, Name: "Energy", Version: 1},
+		} {
+			if err := db.Create(s); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		var names []string
+		err := db.EachByUserID(1, func(s *models.Stocklist) error {
+			names = append(names, s.Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("EachByUserID: %v", err)
+		}
+		if len(names) != 2 || names[0] != "Tech" || names[1] != "Energy" {
+			t.Errorf("EachByUserID visited %q, want [Tech Energy] in ID order", names)
+		}
+		stop := errors.New("stop")
+		calls := 0
+		err = db.EachByUserID(1, func(*models.Stocklist) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf("EachByUserID returned %v after %d calls, want fn's error after 1",
+				err, calls)
+		}
+	})
+
+	t.Run("UpdateChecksVersion", func(t *testing.T) {
+		db := newDB()
+		s := &models.Stocklist{UserID: 1, Name: "Tech", Version: 1}
+		if err := db.Create(s); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		stale := *s
+		s.Name = "Technology"
+		if err := db.Update(s); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		got, err := db.ByID(s.ID)
+		if err != nil {
+			t.Fatalf("ByID: %v", err)
+		}
+		if got.Name != "Technology" || got.Version != 2 {
+			t.Errorf("after Update got %q version %d, want %q version 2",
+				got.Name, got.Version, "Technology")
+		}
+		stale.Name = "Tech stocks"
+		if err := db.Update(&stale); err != models.ErrConflict {
+			t.Errorf("Update of a stale stocklist returned %v, want ErrConflict", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		db := newDB()
+		s := &models.Stocklist{UserID: 1, Name: "Tech", Version: 1}
+		if err := db.Create(s); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := db.Delete(s.ID); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := db.ByID(s.ID); err != models.ErrNotFound {
+			t.Errorf("ByID after Delete returned %v, want ErrNotFound", err)
+		}
+	})
+}
+
+// TestSessionDB checks that a models.SessionDB behaves as the services
+// expect. newDB must return an empty database each time it is called.
+func TestSessionDB(t *testing.T, newDB func() models.SessionDB) {
+	t.Run("CreateAndLookUp", func(t *testing.T) {
+		db := newDB()
+		s := newSession(1, "hash-1", time.Now())
+		if err := db.Create(s); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if s.ID == 0 {
+			t.Fatal("Create did not assign an ID")
+		}
+		got, err := db.ByHash("hash-1")
+		if err != nil {
+			t.Fatalf("ByHash: %v", err)
+		}
+		if got.ID != s.ID || got.UserID != 1 {
+			t.Errorf("ByHash returned session %d of user %d, want %d of user 1",
+				got.ID, got.UserID, s.ID)
+		}
+		if _, err := db.ByHash("nope"); err != models.ErrNotFound {
+			t.Errorf("ByHash of a missing session returned %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("ByUser", func(t *testing.T) {
+		db := newDB()
+		now := time.Now().Truncate(time.Second)
+		older := newSession(1, "hash-1", now.Add(-time.Hour))
+		newer := newSession(1, "hash-2", now)
+		other := newSession(2, "hash-3", now)
+		for _, s := range []*models.Session{older, newer, other} {
+			if err := db.Create(s); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		got, err := db.ByUser(1)
+		if err != nil {
+			t.Fatalf("ByUser: %v", err)
+		}
+		if len(got) != 2 || got[0].ID != newer.ID || got[1].ID != older.ID {
+			t.Errorf("ByUser returned %v, want sessions %d and %d",
+				sessionIDs(got), newer.ID, older.ID)
+		}
+	})
+
+	t.Run("Updates", func(t *testing.T) {
+		db := newDB()
+		now := time.Now().Truncate(time.Second)
+		s := newSession(1, "hash-1", now.Add(-time.Hour))
+		if err := db.Create(s); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		s.IP, s.UserAgent, s.LastSeenAt = "192.0.2.2", "curl/8.0", now
+		if err := db.Touch(s); err != nil {
+			t.Fatalf("Touch: %v", err)
+		}
+		s.ReauthenticatedAt = &now
+		if err := db.Reauthenticated(s); err != nil {
+			t.Fatalf("Reauthenticated: %v", err)
+		}
+		got, err := db.ByHash("hash-1")
+		if err != nil {
+			t.Fatalf("ByHash: %v", err)
+		}
+		if got.IP != s.IP || got.UserAgent != s.UserAgent || !got.LastSeenAt.Equal(now) {
+			t.Errorf("after Touch got %q %q %v, want %q %q %v", got.IP,
+				got.UserAgent, got.LastSeenAt, s.IP, s.UserAgent, now)
+		}
+		if got.ReauthenticatedAt == nil || !got.ReauthenticatedAt.Equal(now) {
+			t.Errorf("after Reauthenticated got %v, want %v", got.ReauthenticatedAt, now)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		db := newDB()
+		s := newSession(1, "hash-1", time.Now())
+		if err := db.Create(s); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := db.Delete(2, s.ID); err != models.ErrNotFound {
+			t.Errorf("Delete of another user's session returned %v, want ErrNotFound", err)
+		}
+		if err := db.Delete(1, s.ID); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := db.ByHash("hash-1"); err != models.ErrNotFound {
+			t.Errorf("ByHash after Delete returned %v, want ErrNotFound", err)
+		}
+		if err := db.Delete(1, s.ID); err != models.ErrNotFound {
+			t.Errorf("second Delete returned %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("DeleteAll", func(t *testing.T) {
+		db := newDB()
+		now := time.Now()
+		var kept *models.Session
+		for i, hash := range []string{"hash-1", "hash-2", "hash-3"} {
+			s := newSession(1, hash, now)
+			if err := db.Create(s); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			if i == 0 {
+				kept = s
+			}
+		}
+		other := newSession(2, "hash-4", now)
+		if err := db.Create(other); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		n, err := db.DeleteAll(1, kept.ID)
+		if err != nil {
+			t.Fatalf("DeleteAll: %v", err)
+		}
+		if n != 2 {
+			t.Errorf("DeleteAll deleted %d sessions, want 2", n)
+		}
+		for hash, want := range map[string]error{
+			"hash-1": nil, "hash-2": models.ErrNotFound,
+			"hash-3": models.ErrNotFound, "hash-4": nil,
+		} {
+			if _, err := db.ByHash(hash); err != want {
+				t.Errorf("ByHash(%q) after DeleteAll returned %v, want %v", hash, err, want)
+			}
+		}
+	})
+}
+
+// newSession returns a session of a user ready to be stored
+func newSession(userID uint, tokenHash string, lastSeen time.Time) *models.Session {
+	return &models.Session{
+		UserID:     userID,
+		TokenHash:  tokenHash,
+		IP:         "192.0.2.1",
+		UserAgent:  "Mozilla/5.0",
+		CreatedAt:  lastSeen,
+		LastSeenAt: lastSeen,
+	}
+}
+
+// sessionIDs returns the IDs of sessions
+func sessionIDs(sessions []models.Session) []uint {
+	ids := make([]uint, len(sessions))
+	for i, s := range sessions {
+		ids[i] = s.ID
+	}
+	return ids
+}
+
+// firstEmail returns the email of the first of users, if any
+func firstEmail(users []models.User) string {
+	if len(users) == 0 {
+		return ""
+	}
+	return users[0].Email
+}
+
+// newUser returns a user ready to be stored, with a unique token hash
+func newUser(email, name string) *models.User {
+	return &models.User{
+		Name:         name,
+		Email:        email,
+		PasswordHash: "hash",
+		TokenHash:    "token-" + email,
+	}
+}
@@ -0,0 +1,20 @@
+package modelstest_test
+
+import (
+	"testing"
+
+	"gastb.ar/models"
+	"gastb.ar/models/modelstest"
+)
+
+func TestUsers(t *testing.T) {
+	modelstest.TestUserDB(t, func() models.UserDB { return modelstest.NewUsers() })
+}
+
+func TestStocklists(t *testing.T) {
+	modelstest.TestStocklistDB(t, func() models.StocklistDB { return modelstest.NewStocklists() })
+}
+
+func TestSessions(t *testing.T) {
+	modelstest.TestSessionDB(t, func() models.SessionDB { return modelstest.NewSessions() })
+}
@@ -0,0 +1,134 @@
+package modelstest
+
+import (
+	"sort"
+	"sync"
+
+	"gastb.ar/models"
+)
+
+// Sessions is a map-backed models.SessionDB. Like Users, it is safe for
+// concurrent use and keeps copies.
+type Sessions struct {
+	mu       sync.Mutex
+	sessions map[uint]models.Session
+	nextID   uint
+}
+
+var _ models.SessionDB = &Sessions{}
+
+// NewSessions creates an empty Sessions
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions: make(map[uint]models.Session),
+		nextID:   1,
+	}
+}
+
+// Create implements models.SessionDB, assigning the session an ID
+func (s *Sessions) Create(session *models.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.sessions {
+		if stored.TokenHash == session.TokenHash {
+			return ErrDuplicate
+		}
+	}
+	session.ID = s.nextID
+	s.nextID++
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+// ByHash implements models.SessionDB
+func (s *Sessions) ByHash(tokenHash string) (*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if session.TokenHash == tokenHash {
+			return &session, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+// ByUser implements models.SessionDB
+func (s *Sessions) ByUser(userID uint) ([]models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []models.Session
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastSeenAt.Equal(sessions[j].LastSeenAt) {
+			return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// Touch implements models.SessionDB
+func (s *Sessions) Touch(session *models.Session) error {
+	return s.update(session.ID, func(stored *models.Session) {
+		stored.IP = session.IP
+		stored.UserAgent = session.UserAgent
+		stored.LastSeenAt = session.LastSeenAt
+	})
+}
+
+// Reauthenticated implements models.SessionDB
+func (s *Sessions) Reauthenticated(session *models.Session) error {
+	return s.update(session.ID, func(stored *models.Session) {
+		stored.ReauthenticatedAt = session.ReauthenticatedAt
+	})
+}
+
+// LoggedIn implements models.SessionDB. It does nothing, since users
+// are kept by Users.
+func (s *Sessions) LoggedIn(user *models.User) error {
+	return nil
+}
+
+// Delete implements models.SessionDB
+func (s *Sessions) Delete(userID, id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID {
+		return models.ErrNotFound
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+// DeleteAll implements models.SessionDB
+func (s *Sessions) DeleteAll(userID, except uint) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, session := range s.sessions {
+		if session.UserID == userID && id != except {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// update changes the stored session with an ID, like an UPDATE that
+// matches no row if there is none
+func (s *Sessions) update(id uint, fn func(*models.Session)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	fn(&stored)
+	s.sessions[id] = stored
+	return nil
+}
@@ -0,0 +1,144 @@
+package modelstest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// Stocklists is a map-backed models.StocklistDB. Like Users, it is safe
+// for concurrent use and keeps copies.
+type Stocklists struct {
+	mu         sync.Mutex
+	stocklists map[uint]models.Stocklist
+	nextID     uint
+}
+
+var _ models.StocklistDB = &Stocklists{}
+
+// NewStocklists creates an empty Stocklists
+func NewStocklists() *Stocklists {
+	return &Stocklists {
+		stocklists: make(map[uint]models.Stocklist),
+		nextID:     1,
+	}
+}
+
+// ByID implements models.StocklistDB
+func (s *Stocklists) ByID(id uint) (*models.Stocklist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stocklist, ok := s.stocklists[id]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	return &stocklist, nil
+}
+
+// ByUserID implements models.StocklistDB
+func (s *Stocklists) ByUserID(userID uint) ([]models.Stocklist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stocklists []models.Stocklist
+	for _, stocklist := range s.stocklists {
+		if stocklist.UserID == userID && stocklist.OrganizationID == nil {
+			stocklists = append(stocklists, stocklist)
+		}
+	}
+	sort.Slice(stocklists, func(i, j int) bool {
+		return stocklists[i].ID < stocklists[j].ID
+	})
+	return stocklists, nil
+}
+
+// ByOrganizationID implements models.StocklistDB
+func (s *Stocklists) ByOrganizationID(orgID uint) ([]models.Stocklist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stocklists []models.Stocklist
+	for _, stocklist := range s.stocklists {
+		if stocklist.OrganizationID != nil && *stocklist.OrganizationID == orgID {
+			stocklists = append(stocklists, stocklist)
+		}
+	}
+	sort.Slice(stocklists, func(i, j int) bool {
+		return stocklists[i].ID < stocklists[j].ID
+	})
+	return stocklists, nil
+}
+
+// ByIDs implements models.StocklistDB
+func (s *Stocklists) ByIDs(ids []uint) ([]models.Stocklist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stocklists []models.Stocklist
+	for _, id := range ids {
+		if stocklist, ok := s.stocklists[id]; ok {
+			stocklists = append(stocklists, stocklist)
+		}
+	}
+	sort.Slice(stocklists, func(i, j int) bool {
+		return stocklists[i].ID < stocklists[j].ID
+	})
+	return stocklists, nil
+}
+
+// EachByUserID implements models.StocklistDB. fn is called without the
+// lock held, so it may use s.
+func (s *Stocklists) EachByUserID(userID uint, fn func(*models.Stocklist) error) error {
+	stocklists, _ := s.ByUserID(userID)
+	for i := range stocklists {
+		if err := fn(&stocklists[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create implements models.StocklistDB, assigning the stocklist an ID
+func (s *Stocklists) Create(stocklist *models.Stocklist) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	stocklist.ID = s.nextID
+	stocklist.CreatedAt = now
+	stocklist.UpdatedAt = now
+	if stocklist.Version == 0 {
+		stocklist.Version = 1
+	}
+	s.nextID++
+	s.stocklists[stocklist.ID] = *stocklist
+	return nil
+}
+
+// Update implements models.StocklistDB, returning models.ErrConflict if
+// the stored version is not the one in stocklist
+func (s *Stocklists) Update(stocklist *models.Stocklist) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.stocklists[stocklist.ID]
+	if !ok || stored.Version != stocklist.Version {
+		return models.ErrConflict
+	}
+	stored.Name = stocklist.Name
+	stored.Public = stocklist.Public
+	stored.Version++
+	stored.UpdatedAt = time.Now()
+	s.stocklists[stored.ID] = stored
+	stocklist.Version = stored.Version
+	stocklist.UpdatedAt = stored.UpdatedAt
+	return nil
+}
+
+// Delete implements models.StocklistDB
+func (s *Stocklists) Delete(id uint) error {
+	if id == 0 {
+		return models.ErrInvalidID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.stocklists, id)
+	return nil
+}
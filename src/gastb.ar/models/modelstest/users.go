@@ -0,0 +1,226 @@
+package modelstest
+
+// The modelstest package has in-memory implementations of the models DB
+// interfaces, so code using them can be exercised without a database, and
+// contract checks that every implementation must pass.
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gastb.ar/models"
+)
+
+// ErrDuplicate is returned when creating or updating a record would
+// break a unique index, where a database would return its own error
+var ErrDuplicate = errors.New("modelstest: duplicate key")
+
+// Users is a map-backed models.UserDB. It is safe for concurrent use and
+// keeps copies, so callers changing a user don't change the stored one.
+type Users struct {
+	mu     sync.Mutex
+	users  map[uint]models.User
+	nextID uint
+}
+
+var _ models.UserDB = &Users{}
+
+// NewUsers creates an empty Users
+func NewUsers() *Users {
+	return &Users {
+		users:  make(map[uint]models.User),
+		nextID: 1,
+	}
+}
+
+// ByID implements models.UserDB
+func (u *Users) ByID(id uint) (*models.User, error) {
+	if id == 0 {
+		return nil, models.ErrInvalidID
+	}
+	return u.find(func(user *models.User) bool { return user.ID == id })
+}
+
+// ByEmail implements models.UserDB
+func (u *Users) ByEmail(email string) (*models.User, error) {
+	return u.find(func(user *models.User) bool { return user.Email == email })
+}
+
+// ByUsername implements models.UserDB
+func (u *Users) ByUsername(username string) (*models.User, error) {
+	return u.find(func(user *models.User) bool {
+		return user.Username != nil && *user.Username == username
+	})
+}
+
+// ByTokenHash implements models.UserDB
+func (u *Users) ByTokenHash(tokenHash string) (*models.User, error) {
+	return u.find(func(user *models.User) bool { return user.TokenHash == tokenHash })
+}
+
+// Search implements models.UserDB
+func (u *Users) Search(query models.SearchQuery) ([]models.User, error) {
+	text := strings.ToLower(query.Text)
+	inRange := func(t time.Time, after, before time.Time) bool {
+		return (after.IsZero() || !t.Before(after)) && (before.IsZero() || t.Before(before))
+	}
+	users := u.filter(func(user *models.User) bool {
+		switch {
+		case text != "" && !strings.Contains(strings.ToLower(user.Email), text) &&
+			!strings.Contains(strings.ToLower(user.Name), text):
+			return false
+		case query.Verified != nil && *query.Verified != (user.EmailVerifiedAt != nil):
+			return false
+		case query.Role != "" && user.Role != query.Role:
+			return false
+		case query.Locked != nil && *query.Locked != user.IsLockedAt(query.Now):
+			return false
+		case !inRange(user.CreatedAt, query.CreatedAfter, query.CreatedBefore):
+			return false
+		}
+		if query.LastLoginAfter.IsZero() && query.LastLoginBefore.IsZero() {
+			return true
+		}
+		return user.LastLoginAt != nil &&
+			inRange(*user.LastLoginAt, query.LastLoginAfter, query.LastLoginBefore)
+	})
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].CreatedAt.After(users[j].CreatedAt)
+	})
+	if query.Limit <= 0 {
+		return users, nil
+	}
+	return truncate(users, query.Limit), nil
+}
+
+// Page implements models.UserDB
+func (u *Users) Page(offset, limit int) ([]models.User, int, error) {
+	users := u.filter(func(user *models.User) bool { return true })
+	total := len(users)
+	if offset > total {
+		offset = total
+	}
+	return truncate(users[offset:], limit), total, nil
+}
+
+// Undeliverable implements models.UserDB
+func (u *Users) Undeliverable(limit int) ([]models.User, error) {
+	users := u.filter(func(user *models.User) bool { return user.Undeliverable != "" })
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].UndeliverableAt.After(*users[j].UndeliverableAt)
+	})
+	return truncate(users, limit), nil
+}
+
+// UndeliverableAmong implements models.UserDB
+func (u *Users) UndeliverableAmong(emails []string) ([]string, error) {
+	wanted := make(map[string]bool, len(emails))
+	for _, e := range emails {
+		wanted[e] = true
+	}
+	var suppressed []string
+	for _, user := range u.filter(func(user *models.User) bool {
+		return user.Undeliverable != "" && wanted[user.Email]
+	}) {
+		suppressed = append(suppressed, user.Email)
+	}
+	return suppressed, nil
+}
+
+// Create implements models.UserDB, assigning the user an ID
+func (u *Users) Create(user *models.User) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.checkUnique(user); err != nil {
+		return err
+	}
+	now := time.Now()
+	user.ID = u.nextID
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	u.nextID++
+	u.users[user.ID] = *user
+	return nil
+}
+
+// Update implements models.UserDB. Like gorm's Save, it creates users
+// that have no ID yet.
+func (u *Users) Update(user *models.User) error {
+	if user.ID == 0 {
+		return u.Create(user)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.checkUnique(user); err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now()
+	u.users[user.ID] = *user
+	return nil
+}
+
+// Delete implements models.UserDB
+func (u *Users) Delete(id uint) error {
+	if id == 0 {
+		return models.ErrInvalidID
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.users, id)
+	return nil
+}
+
+// find returns a copy of the first user matching, or ErrNotFound
+func (u *Users) find(match func(*models.User) bool) (*models.User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, user := range u.users {
+		if match(&user) {
+			return &user, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+// filter returns copies of the users matching, by ID
+func (u *Users) filter(match func(*models.User) bool) []models.User {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var users []models.User
+	for _, user := range u.users {
+		if match(&user) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// checkUnique fails if another user has the email, token hash or
+// username of user, as the unique indexes of the users table would. u.mu
+// must be held.
+func (u *Users) checkUnique(user *models.User) error {
+	for id, other := range u.users {
+		if id == user.ID {
+			continue
+		}
+		if other.Email == user.Email || other.TokenHash == user.TokenHash {
+			return ErrDuplicate
+		}
+		if other.Username != nil && user.Username != nil && *other.Username == *user.Username {
+			return ErrDuplicate
+		}
+	}
+	return nil
+}
+
+// truncate returns at most limit elements of s
+func truncate(s []models.User, limit int) []models.User {
+	if len(s) > limit {
+		return s[:limit]
+	}
+	return s
+}
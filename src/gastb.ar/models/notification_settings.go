@@ -0,0 +1,185 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gastb.ar/encrypt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// NotificationSettings are a user's choices of which notifications they
+// get. Users that never saved them get DefaultNotificationSettings.
+type NotificationSettings struct {
+	ID        uint `gorm:"primary_key"`
+	UserID    uint `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// EmailAlerts emails price alerts as they trigger
+	EmailAlerts bool `gorm:"not null"`
+	// Digest sends the periodic digest email
+	Digest bool `gorm:"not null"`
+	// SecurityNotices emails changes to the account, such as a new
+	// email address
+	SecurityNotices bool `gorm:"not null"`
+	// Webhooks delivers events to the user's webhooks
+	Webhooks bool `gorm:"not null"`
+	// SlackWebhookURL and DiscordWebhookURL are incoming webhooks of chat
+	// channels that alerts and digests are posted to as well, if set.
+	// Anyone with them can post to the channels, so they are encrypted
+	// like webhook secrets.
+	SlackWebhookURL   string
+	DiscordWebhookURL string
+}
+
+// Kinds of notification, as passed to NotificationSettings.Enabled
+const (
+	NotifyEmailAlerts     = "email_alerts"
+	NotifyDigest          = "digest"
+	NotifySecurityNotices = "security_notices"
+	NotifyWebhooks        = "webhooks"
+)
+
+// ErrNotificationKind is returned for an unknown kind of notification
+var ErrNotificationKind = errors.New("models: unknown kind of notification")
+
+// Errors returned for chat webhook URLs that don't belong to the service
+var (
+	ErrSlackURL   = errors.New("models: Slack webhook URL must start with " + SlackWebhookPrefix)
+	ErrDiscordURL = errors.New("models: Discord webhook URL must start with " + DiscordWebhookPrefix)
+)
+
+// Prefixes of the incoming webhook URLs of Slack and Discord. Only these
+// are accepted, so the settings can't be used to make the server post to
+// arbitrary addresses.
+const (
+	SlackWebhookPrefix   = "https://hooks.slack.com/"
+	DiscordWebhookPrefix = "https://discord.com/api/webhooks/"
+)
+
+// DefaultNotificationSettings returns the settings of a user that never
+// changed them: everything but the digest, which is opt-in.
+func DefaultNotificationSettings(userID uint) *NotificationSettings {
+	return &NotificationSettings{
+		UserID:          userID,
+		EmailAlerts:     true,
+		SecurityNotices: true,
+		Webhooks:        true,
+	}
+}
+
+// Enabled reports whether the user wants a kind of notification
+func (ns *NotificationSettings) Enabled(kind string) (bool, error) {
+	switch kind {
+	case NotifyEmailAlerts:
+		return ns.EmailAlerts, nil
+	case NotifyDigest:
+		return ns.Digest, nil
+	case NotifySecurityNotices:
+		return ns.SecurityNotices, nil
+	case NotifyWebhooks:
+		return ns.Webhooks, nil
+	}
+	return false, ErrNotificationKind
+}
+
+// NotificationSettingService reads and writes notification settings.
+// Every subsystem sending notifications to a user asks it first.
+type NotificationSettingService struct {
+	db   *gorm.DB
+	keys *encrypt.Keyring
+}
+
+// NewNotificationSettingService instantiates a NotificationSettingService
+// on a database connection.
+func NewNotificationSettingService(db *gorm.DB) *NotificationSettingService {
+	return &NotificationSettingService {
+		db: db,
+	}
+}
+
+// ForUser returns the notification settings of a user, or the defaults
+// if they never saved any.
+func (nss *NotificationSettingService) ForUser(userID uint) (*NotificationSettings, error) {
+	var ns NotificationSettings
+	err := first(nss.db.Where("user_id = ?", userID), &ns)
+	if err == ErrNotFound {
+		return DefaultNotificationSettings(userID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := nss.decrypt(&ns); err != nil {
+		return nil, err
+	}
+	return &ns, nil
+}
+
+// Update saves the notification settings of a user.
+func (nss *NotificationSettingService) Update(ns *NotificationSettings) error {
+	if ns.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	ns.SlackWebhookURL = strings.TrimSpace(ns.SlackWebhookURL)
+	if ns.SlackWebhookURL != "" && !strings.HasPrefix(ns.SlackWebhookURL, SlackWebhookPrefix) {
+		return ErrSlackURL
+	}
+	// Discord still serves webhooks from its old domain
+	ns.DiscordWebhookURL = strings.Replace(strings.TrimSpace(ns.DiscordWebhookURL),
+		"https://discordapp.com/", "https://discord.com/", 1)
+	if ns.DiscordWebhookURL != "" && !strings.HasPrefix(ns.DiscordWebhookURL, DiscordWebhookPrefix) {
+		return ErrDiscordURL
+	}
+	// The settings are saved encrypted, and handed back as they came
+	stored := *ns
+	if err := nss.encrypt(&stored); err != nil {
+		return err
+	}
+	if err := nss.db.Save(&stored).Error; err != nil {
+		return err
+	}
+	ns.ID, ns.CreatedAt, ns.UpdatedAt = stored.ID, stored.CreatedAt, stored.UpdatedAt
+	return nil
+}
+
+// Enabled reports whether a user wants a kind of notification.
+func (nss *NotificationSettingService) Enabled(userID uint, kind string) (bool, error) {
+	ns, err := nss.ForUser(userID)
+	if err != nil {
+		return false, err
+	}
+	return ns.Enabled(kind)
+}
+
+// DigestRecipients returns the IDs of the users that opted in to the
+// digest.
+func (nss *NotificationSettingService) DigestRecipients() ([]uint, error) {
+	var ids []uint
+	err := nss.db.Model(&NotificationSettings{}).Where("digest = ?", true).
+		Order("user_id").Pluck("user_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// UnsubscribeDigest turns the digest off for the user an unsubscribe
+// link was sent to, returning ErrInvalidToken if the token is unknown.
+func (nss *NotificationSettingService) UnsubscribeDigest(token string) error {
+	var sub DigestSubscription
+	err := first(nss.db.Where("token = ?", token), &sub)
+	if err == ErrNotFound {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	ns, err := nss.ForUser(sub.UserID)
+	if err != nil {
+		return err
+	}
+	ns.Digest = false
+	return nss.Update(ns)
+}
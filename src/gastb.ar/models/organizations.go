@@ -0,0 +1,527 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gastb.ar/clock"
+	"gastb.ar/hash"
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Organization is a team owning stocklists its members share. What each
+// member can do depends on the role of their Membership.
+type Organization struct {
+	gorm.Model
+	Name string `gorm:"not null"`
+	// SeatLimit is how many members and pending invitations the
+	// organization pays for; 0 means no limit
+	SeatLimit int `gorm:"not null;default:0"`
+}
+
+// Membership makes a user a member of an organization with a role.
+type Membership struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	OrganizationID uint   `gorm:"not null;unique_index:uix_memberships_org_user"`
+	UserID         uint   `gorm:"not null;unique_index:uix_memberships_org_user;index"`
+	Role           string `gorm:"not null"`
+}
+
+// OrgInvite invites the owner of an email address to join an
+// organization with a role. Only the hash of the token is stored.
+type OrgInvite struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	OrganizationID uint   `gorm:"not null;index"`
+	InvitedBy      uint   `gorm:"not null"`
+	Email          string `gorm:"not null"`
+	Role           string `gorm:"not null"`
+	Token          string `gorm:"-"`
+	TokenHash      string `gorm:"not null;unique_index"`
+	ExpiresAt      time.Time
+	AcceptedAt     *time.Time
+	AcceptedBy     uint
+}
+
+// Roles in an organization, from the least to the most powerful. Each
+// role can do what the ones before it can.
+const (
+	// OrgRoleViewer can see the organization's stocklists
+	OrgRoleViewer = "viewer"
+	// OrgRoleMember can also create, change and delete them
+	OrgRoleMember = "member"
+	// OrgRoleAdmin can also rename the organization, and invite and
+	// remove members other than owners
+	OrgRoleAdmin = "admin"
+	// OrgRoleOwner can also manage owners
+	OrgRoleOwner = "owner"
+)
+
+// OrgRoles lists the roles in an organization, least powerful first
+var OrgRoles = []string{OrgRoleViewer, OrgRoleMember, OrgRoleAdmin, OrgRoleOwner}
+
+// OrgInviteTTL is how long an invitation to an organization can be
+// accepted
+const OrgInviteTTL = 7 * 24 * time.Hour
+
+// Errors returned by OrganizationService
+var (
+	ErrOrgRoleInvalid = errors.New("models: role must be viewer, member, admin or owner")
+	// ErrNotMember is returned when a user is not a member of an
+	// organization, which they shouldn't be able to tell from one that
+	// doesn't exist
+	ErrNotMember = errors.New("models: not a member of the organization")
+	// ErrOrgForbidden is returned when a member's role doesn't allow an
+	// action
+	ErrOrgForbidden = errors.New("models: your role in the organization doesn't allow this")
+	// ErrLastOwner is returned when the only owner of an organization
+	// would leave it or lose the role
+	ErrLastOwner = errors.New("models: the organization must keep an owner")
+	// ErrNoSeats is returned when inviting more people than the
+	// organization has seats for
+	ErrNoSeats = errors.New("models: the organization has no seats left")
+	// ErrAlreadyMember is returned when inviting or adding a member again
+	ErrAlreadyMember = errors.New("models: already a member of the organization")
+	// ErrInvalidOrgInvite is returned when an invitation token is
+	// unknown, expired, revoked or already accepted
+	ErrInvalidOrgInvite = errors.New("models: invitation is invalid or expired")
+	// ErrOrgInviteEmail is returned when accepting an invitation sent to
+	// another address than the user's
+	ErrOrgInviteEmail = errors.New("models: invitation was sent to another email address")
+)
+
+// orgRoleRank orders roles by power; unknown roles rank 0
+func orgRoleRank(role string) int {
+	for i, r := range OrgRoles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// OrgRoleAllows reports whether role have is role want or a more
+// powerful one
+func OrgRoleAllows(have, want string) bool {
+	return orgRoleRank(want) > 0 && orgRoleRank(have) >= orgRoleRank(want)
+}
+
+// Allows reports whether a member's role is role or a more powerful one
+func (m *Membership) Allows(role string) bool {
+	return OrgRoleAllows(m.Role, role)
+}
+
+// UserOrganization is an organization with the role of the user it was
+// listed for
+type UserOrganization struct {
+	Organization
+	Role string
+}
+
+// SeatCount tells how many seats of an organization are taken, for
+// billing
+type SeatCount struct {
+	// Used counts the members
+	Used int
+	// Pending counts the invitations that can still be accepted, whose
+	// seats are kept for them
+	Pending int
+	// Limit is Organization.SeatLimit, 0 for no limit
+	Limit int
+}
+
+// Available reports whether another member can be invited
+func (sc SeatCount) Available() bool {
+	return sc.Limit == 0 || sc.Used+sc.Pending < sc.Limit
+}
+
+// OrganizationService manages organizations, their members and
+// invitations.
+type OrganizationService struct {
+	db    *gorm.DB
+	hmac  hash.HMAC
+	clock clock.Clock
+}
+
+// NewOrganizationService instantiates an OrganizationService on a
+// database connection and a hasher for invitation tokens.
+func NewOrganizationService(db *gorm.DB, hmacSecretKey string) *OrganizationService {
+	return &OrganizationService{
+		db:    db,
+		hmac:  hash.NewHMAC(hmacSecretKey),
+		clock: clock.Real,
+	}
+}
+
+// SetClock sets the clock that invitation expiry is based on
+func (os *OrganizationService) SetClock(c clock.Clock) {
+	os.clock = c
+}
+
+// Create stores an organization with ownerID as its first owner.
+func (os *OrganizationService) Create(org *Organization, ownerID uint) error {
+	org.Name = strings.TrimSpace(org.Name)
+	if org.Name == "" {
+		return ErrNameRequired
+	}
+	if ownerID == 0 {
+		return ErrUserIDRequired
+	}
+	tx := os.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	err := tx.Create(org).Error
+	if err == nil {
+		err = tx.Create(&Membership{
+			OrganizationID: org.ID,
+			UserID:         ownerID,
+			Role:           OrgRoleOwner,
+		}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// ByID looks up an organization by ID.
+func (os *OrganizationService) ByID(id uint) (*Organization, error) {
+	var org Organization
+	if err := first(os.db.Where("id = ?", id), &org); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// Rename changes the name of an organization.
+func (os *OrganizationService) Rename(org *Organization, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrNameRequired
+	}
+	org.Name = name
+	return os.db.Model(org).Update("name", name).Error
+}
+
+// SetSeatLimit sets how many seats an organization pays for; 0 removes
+// the limit. Members over a lowered limit stay, but no one can be
+// invited until seats free up.
+func (os *OrganizationService) SetSeatLimit(orgID uint, limit int) error {
+	if limit < 0 {
+		limit = 0
+	}
+	res := os.db.Model(&Organization{}).Where("id = ?", orgID).Update("seat_limit", limit)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ForUser returns the organizations a user is a member of, with their
+// role in each, oldest first.
+func (os *OrganizationService) ForUser(userID uint) ([]UserOrganization, error) {
+	var orgs []UserOrganization
+	err := os.db.Table("organizations").
+		Select("organizations.*, memberships.role").
+		Joins("JOIN memberships ON memberships.organization_id = organizations.id").
+		Where("memberships.user_id = ? AND organizations.deleted_at IS NULL", userID).
+		Order("organizations.id").Scan(&orgs).Error
+	if err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// Membership returns the membership of a user in an organization, or
+// ErrNotMember.
+func (os *OrganizationService) Membership(orgID, userID uint) (*Membership, error) {
+	var m Membership
+	err := first(os.db.Where("organization_id = ? AND user_id = ?", orgID, userID), &m)
+	if err == ErrNotFound {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Authorize returns the membership of a user in an organization if
+// their role is role or a more powerful one, and ErrNotMember or
+// ErrOrgForbidden otherwise.
+func (os *OrganizationService) Authorize(orgID, userID uint, role string) (*Membership, error) {
+	m, err := os.Membership(orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Allows(role) {
+		return nil, ErrOrgForbidden
+	}
+	return m, nil
+}
+
+// Members returns the memberships of an organization, oldest first.
+func (os *OrganizationService) Members(orgID uint) ([]Membership, error) {
+	var members []Membership
+	err := os.db.Where("organization_id = ?", orgID).Order("id").Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Seats counts the seats an organization uses.
+func (os *OrganizationService) Seats(orgID uint) (*SeatCount, error) {
+	org, err := os.ByID(orgID)
+	if err != nil {
+		return nil, err
+	}
+	sc := &SeatCount{Limit: org.SeatLimit}
+	err = os.db.Model(&Membership{}).Where("organization_id = ?", orgID).Count(&sc.Used).Error
+	if err != nil {
+		return nil, err
+	}
+	err = os.db.Model(&OrgInvite{}).
+		Where("organization_id = ? AND accepted_at IS NULL AND expires_at > ?", orgID, os.clock.Now()).
+		Count(&sc.Pending).Error
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Invite invites an email address to the organization of actor, who
+// must be an admin, with a role; only owners invite owners. It returns
+// the invitation with the Token field set, for the link sent to the
+// address. Every pending invitation takes a seat.
+func (os *OrganizationService) Invite(actor *Membership, email, role string) (*OrgInvite, error) {
+	if orgRoleRank(role) == 0 {
+		return nil, ErrOrgRoleInvalid
+	}
+	if !actor.Allows(OrgRoleAdmin) || !actor.Allows(role) {
+		return nil, ErrOrgForbidden
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return nil, ErrEmailRequired
+	}
+	if !emailRegex.MatchString(email) {
+		return nil, ErrEmailInvalid
+	}
+	var count int
+	err := os.db.Model(&Membership{}).
+		Joins("JOIN users ON users.id = memberships.user_id").
+		Where("memberships.organization_id = ? AND users.email = ?", actor.OrganizationID, email).
+		Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrAlreadyMember
+	}
+	seats, err := os.Seats(actor.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	if !seats.Available() {
+		return nil, ErrNoSeats
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	invite := &OrgInvite{
+		OrganizationID: actor.OrganizationID,
+		InvitedBy:      actor.UserID,
+		Email:          email,
+		Role:           role,
+		Token:          token,
+		TokenHash:      os.hmac.Hash(token),
+		ExpiresAt:      os.clock.Now().Add(OrgInviteTTL),
+	}
+	if err := os.db.Create(invite).Error; err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// PendingInvites returns the invitations to an organization that can
+// still be accepted, oldest first.
+func (os *OrganizationService) PendingInvites(orgID uint) ([]OrgInvite, error) {
+	var invites []OrgInvite
+	err := os.db.Where("organization_id = ? AND accepted_at IS NULL AND expires_at > ?",
+		orgID, os.clock.Now()).Order("id").Find(&invites).Error
+	if err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// RevokeInvite deletes a pending invitation to the organization of
+// actor, who must be an admin, freeing its seat.
+func (os *OrganizationService) RevokeInvite(actor *Membership, inviteID uint) error {
+	if !actor.Allows(OrgRoleAdmin) {
+		return ErrOrgForbidden
+	}
+	res := os.db.Where("id = ? AND organization_id = ? AND accepted_at IS NULL",
+		inviteID, actor.OrganizationID).Delete(&OrgInvite{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AcceptInvite makes user a member of the organization an invitation
+// token is for, with its role. The invitation must have been sent to
+// the user's email address.
+func (os *OrganizationService) AcceptInvite(token string, user *User) (*Membership, error) {
+	var invite OrgInvite
+	err := first(os.db.Where("token_hash = ? AND accepted_at IS NULL AND expires_at > ?",
+		os.hmac.Hash(token), os.clock.Now()), &invite)
+	if err == ErrNotFound {
+		return nil, ErrInvalidOrgInvite
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(invite.Email, user.Email) {
+		return nil, ErrOrgInviteEmail
+	}
+	if _, err := os.Membership(invite.OrganizationID, user.ID); err != ErrNotMember {
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrAlreadyMember
+	}
+	m := &Membership{
+		OrganizationID: invite.OrganizationID,
+		UserID:         user.ID,
+		Role:           invite.Role,
+	}
+	tx := os.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	// Marking the invitation first makes concurrent acceptances wait for
+	// each other, and all but the first fail
+	res := tx.Model(&OrgInvite{}).Where("id = ? AND accepted_at IS NULL", invite.ID).
+		Updates(map[string]interface{}{"accepted_at": os.clock.Now(), "accepted_by": user.ID})
+	err = res.Error
+	if err == nil && res.RowsAffected == 0 {
+		err = ErrInvalidOrgInvite
+	}
+	if err == nil {
+		err = tx.Create(m).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetRole changes the role of a member of the organization of actor,
+// who must be an admin. Only owners make or unmake owners, and the last
+// owner keeps the role.
+func (os *OrganizationService) SetRole(actor *Membership, userID uint, role string) (*Membership, error) {
+	if orgRoleRank(role) == 0 {
+		return nil, ErrOrgRoleInvalid
+	}
+	m, err := os.Membership(actor.OrganizationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.Allows(OrgRoleAdmin) || !actor.Allows(role) || !actor.Allows(m.Role) {
+		return nil, ErrOrgForbidden
+	}
+	if m.Role == OrgRoleOwner && role != OrgRoleOwner {
+		if err := os.keepOwner(actor.OrganizationID); err != nil {
+			return nil, err
+		}
+	}
+	m.Role = role
+	if err := os.db.Model(m).Update("role", role).Error; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RemoveMember removes a member from the organization of actor. Members
+// can leave on their own; removing others takes an admin, or an owner
+// for owners. The last owner can't leave. Stocklists the member created
+// stay with the organization.
+func (os *OrganizationService) RemoveMember(actor *Membership, userID uint) error {
+	m, err := os.Membership(actor.OrganizationID, userID)
+	if err != nil {
+		return err
+	}
+	if m.ID != actor.ID && (!actor.Allows(OrgRoleAdmin) || !actor.Allows(m.Role)) {
+		return ErrOrgForbidden
+	}
+	if m.Role == OrgRoleOwner {
+		if err := os.keepOwner(actor.OrganizationID); err != nil {
+			return err
+		}
+	}
+	return os.db.Delete(m).Error
+}
+
+// keepOwner returns ErrLastOwner unless an organization has more than
+// one owner
+func (os *OrganizationService) keepOwner(orgID uint) error {
+	var owners int
+	err := os.db.Model(&Membership{}).
+		Where("organization_id = ? AND role = ?", orgID, OrgRoleOwner).Count(&owners).Error
+	if err != nil {
+		return err
+	}
+	if owners <= 1 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// SetOrganizations lets members reach the stocklists of their
+// organizations. Without it, users only reach their personal stocklists.
+func (ss *StocklistService) SetOrganizations(orgs *OrganizationService) {
+	ss.orgs = orgs
+}
+
+// RoleOf returns the role a user has on a stocklist: OrgRoleOwner on
+// their personal stocklists, their role in the organization on its
+// stocklists, and "" on stocklists they can't see.
+func (ss *StocklistService) RoleOf(stocklist *Stocklist, userID uint) (string, error) {
+	if stocklist.OrganizationID == nil {
+		if stocklist.UserID == userID {
+			return OrgRoleOwner, nil
+		}
+		return "", nil
+	}
+	if ss.orgs == nil {
+		return "", nil
+	}
+	m, err := ss.orgs.Membership(*stocklist.OrganizationID, userID)
+	if err == ErrNotMember {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return m.Role, nil
+}
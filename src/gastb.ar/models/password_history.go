@@ -0,0 +1,103 @@
+package models
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PasswordHistory is the hash of a password a user had, kept so they
+// can't go back to it. Only the latest ones, as many as the user service
+// checks, are kept.
+type PasswordHistory struct {
+	ID           uint   `gorm:"primary_key"`
+	UserID       uint   `gorm:"not null;index"`
+	PasswordHash string `gorm:"not null"`
+	CreatedAt    time.Time
+}
+
+// ErrPasswordReused is returned when changing or resetting a password to
+// one of the user's recent passwords.
+var ErrPasswordReused = errors.New("models: password was used recently")
+
+// passwordHistoryGorm stores the previous passwords of users
+type passwordHistoryGorm struct {
+	db *gorm.DB
+}
+
+// latest returns the hashes of the n latest passwords of a user
+func (hg *passwordHistoryGorm) latest(userID uint, n int) ([]string, error) {
+	var hashes []string
+	err := hg.db.Model(&PasswordHistory{}).Where("user_id = ?", userID).
+		Order("created_at DESC, id DESC").Limit(n).Pluck("password_hash", &hashes).Error
+	return hashes, err
+}
+
+// record adds a password hash to the history of a user and deletes all
+// but the keep latest ones
+func (hg *passwordHistoryGorm) record(userID uint, passwordHash string, keep int, now time.Time) error {
+	err := hg.db.Create(&PasswordHistory{
+		UserID:       userID,
+		PasswordHash: passwordHash,
+		CreatedAt:    now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return hg.db.Exec("DELETE FROM password_histories WHERE user_id = ? AND id NOT IN "+
+		"(SELECT id FROM password_histories WHERE user_id = ? "+
+		"ORDER BY created_at DESC, id DESC LIMIT ?)", userID, userID, keep).Error
+}
+
+// SetPasswordHistory makes password changes and resets refuse the n
+// latest passwords of the user, their current one included, with
+// ErrPasswordReused. 0 allows any password.
+func (us *UserService) SetPasswordHistory(n int) {
+	us.passwordHistory = n
+}
+
+// checkReuse returns ErrPasswordReused if password is the current
+// password of user or one of the latest ones they had
+func (us *UserService) checkReuse(user *User, password string) error {
+	if us.passwordHistory <= 0 {
+		return nil
+	}
+	hashes, err := us.history.latest(user.ID, us.passwordHistory)
+	if err != nil {
+		return err
+	}
+	// The current password counts even for accounts older than the
+	// history
+	if len(hashes) == 0 || hashes[0] != user.PasswordHash {
+		hashes = append(hashes, user.PasswordHash)
+	}
+	for _, h := range hashes {
+		if h == "" {
+			continue
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(h), []byte(password))
+		if err == nil {
+			return ErrPasswordReused
+		}
+		if err != bcrypt.ErrMismatchedHashAndPassword {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordPassword adds the current password of user to their history.
+// The password is set by then, so failures are only logged.
+func (us *UserService) recordPassword(user *User) {
+	if us.passwordHistory <= 0 || user.PasswordHash == "" {
+		return
+	}
+	err := us.history.record(user.ID, user.PasswordHash, us.passwordHistory, us.clock.Now())
+	if err != nil {
+		slog.Error("recording password history failed", "user_id", user.ID, "error", err)
+	}
+}
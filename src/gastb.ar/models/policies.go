@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Policy identifies a version of a policy document, such as the terms of
+// service, that users must accept
+type Policy struct {
+	Kind    string `json:"kind"`
+	Version string `json:"version"`
+}
+
+// PolicyAcceptance records that a user accepted a version of a policy
+// document, when and from where.
+type PolicyAcceptance struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null;unique_index:idx_policy_acceptances_user_policy"`
+	Kind       string `gorm:"not null;unique_index:idx_policy_acceptances_user_policy"`
+	Version    string `gorm:"not null;unique_index:idx_policy_acceptances_user_policy"`
+	AcceptedAt time.Time
+	IP         string
+}
+
+// PolicyService records which policy versions users accepted.
+type PolicyService struct {
+	db *gorm.DB
+}
+
+// NewPolicyService instantiates a PolicyService on a database connection.
+func NewPolicyService(db *gorm.DB) *PolicyService {
+	return &PolicyService{
+		db: db,
+	}
+}
+
+// Accept records that a user accepted policies at a time, from an IP
+// address. Accepting a version again keeps the first record.
+func (ps *PolicyService) Accept(userID uint, policies []Policy, ip string, at time.Time) error {
+	if userID == 0 {
+		return ErrInvalidID
+	}
+	for _, p := range policies {
+		err := ps.db.Exec("INSERT INTO policy_acceptances "+
+			"(user_id, kind, version, accepted_at, ip) VALUES (?, ?, ?, ?, ?) "+
+			"ON CONFLICT DO NOTHING", userID, p.Kind, p.Version, at, ip).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByUserID returns the acceptances of a user, newest first.
+func (ps *PolicyService) ByUserID(userID uint) ([]PolicyAcceptance, error) {
+	var acceptances []PolicyAcceptance
+	err := ps.db.Where("user_id = ?", userID).Order("accepted_at DESC").
+		Find(&acceptances).Error
+	return acceptances, err
+}
+
+// Pending returns the policies among current that a user hasn't accepted.
+func (ps *PolicyService) Pending(userID uint, current []Policy) ([]Policy, error) {
+	if len(current) == 0 {
+		return nil, nil
+	}
+	var accepted []Policy
+	err := ps.db.Model(&PolicyAcceptance{}).Select("kind, version").
+		Where("user_id = ?", userID).Scan(&accepted).Error
+	if err != nil {
+		return nil, err
+	}
+	var pending []Policy
+	for _, p := range current {
+		found := false
+		for _, a := range accepted {
+			if a == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			pending = append(pending, p)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// UserPreference is one of a user's interface preferences, stored as a
+// key and a string value. Preferences are read and written as a whole,
+// typed, through Preferences; keys nobody knows about any more are
+// ignored.
+type UserPreference struct {
+	UserID    uint   `gorm:"primary_key;auto_increment:false"`
+	Key       string `gorm:"primary_key"`
+	Value     string `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+// Keys of the preferences
+const (
+	PrefTheme            = "theme"
+	PrefCurrency         = "currency"
+	PrefRowsPerPage      = "rows_per_page"
+	PrefDefaultStocklist = "default_stocklist"
+)
+
+// Themes of the interface
+const (
+	// ThemeSystem follows the light or dark setting of the device
+	ThemeSystem = "system"
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+)
+
+// RowsPerPage are the page sizes users can pick
+var RowsPerPage = []int{10, 25, 50, 100}
+
+// Preferences are a user's interface settings, kept on the server so they
+// follow them across devices. Users that never saved them get
+// DefaultPreferences.
+type Preferences struct {
+	Theme string
+	// Currency is the ISO 4217 code values are shown in
+	Currency    string
+	RowsPerPage int
+	// DefaultStocklistID is the stocklist opened first; 0 for none. It
+	// is checked when saved, so it may name a stocklist deleted since.
+	DefaultStocklistID uint
+}
+
+// DefaultPreferences returns the preferences of a user that never
+// changed them.
+func DefaultPreferences() *Preferences {
+	return &Preferences{
+		Theme:       ThemeSystem,
+		Currency:    "USD",
+		RowsPerPage: 25,
+	}
+}
+
+var (
+	// ErrThemeInvalid is returned for themes other than system, light
+	// and dark
+	ErrThemeInvalid = errors.New("models: theme must be system, light or dark")
+
+	// ErrCurrencyInvalid is returned for currencies that aren't three
+	// letter codes
+	ErrCurrencyInvalid = errors.New("models: currency must be a three letter ISO 4217 code")
+
+	// ErrRowsPerPageInvalid is returned for page sizes not in RowsPerPage
+	ErrRowsPerPageInvalid = errors.New("models: rows per page must be 10, 25, 50 or 100")
+
+	// ErrDefaultStocklist is returned for a default stocklist the user
+	// doesn't own
+	ErrDefaultStocklist = errors.New("models: default stocklist must be one of the user's stocklists")
+)
+
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// PreferenceService reads and writes the preferences of users.
+type PreferenceService struct {
+	db *gorm.DB
+	// rls runs the default stocklist check as the user's tenant, see
+	// Services.SetRowLevelSecurity
+	rls bool
+}
+
+// NewPreferenceService instantiates a PreferenceService on a database
+// connection.
+func NewPreferenceService(db *gorm.DB) *PreferenceService {
+	return &PreferenceService{
+		db: db,
+	}
+}
+
+// ForUser returns the preferences of a user; the ones they never saved
+// have their default value.
+func (ps *PreferenceService) ForUser(userID uint) (*Preferences, error) {
+	var rows []UserPreference
+	if err := ps.db.Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	p := DefaultPreferences()
+	for _, row := range rows {
+		switch row.Key {
+		case PrefTheme:
+			p.Theme = row.Value
+		case PrefCurrency:
+			p.Currency = row.Value
+		case PrefRowsPerPage:
+			if n, err := strconv.Atoi(row.Value); err == nil {
+				p.RowsPerPage = n
+			}
+		case PrefDefaultStocklist:
+			if id, err := strconv.ParseUint(row.Value, 10, 64); err == nil {
+				p.DefaultStocklistID = uint(id)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Update validates and saves the preferences of a user. The currency is
+// upper-cased first.
+func (ps *PreferenceService) Update(userID uint, p *Preferences) error {
+	if userID == 0 {
+		return ErrUserIDRequired
+	}
+	if err := ps.validate(userID, p); err != nil {
+		return err
+	}
+	values := map[string]string{
+		PrefTheme:            p.Theme,
+		PrefCurrency:         p.Currency,
+		PrefRowsPerPage:      strconv.Itoa(p.RowsPerPage),
+		PrefDefaultStocklist: strconv.FormatUint(uint64(p.DefaultStocklistID), 10),
+	}
+	tx := ps.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for key, value := range values {
+		err := tx.Save(&UserPreference{UserID: userID, Key: key, Value: value}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// validate checks preferences before they are saved
+func (ps *PreferenceService) validate(userID uint, p *Preferences) error {
+	switch p.Theme {
+	case ThemeSystem, ThemeLight, ThemeDark:
+	default:
+		return ErrThemeInvalid
+	}
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	if !currencyRegex.MatchString(p.Currency) {
+		return ErrCurrencyInvalid
+	}
+	valid := false
+	for _, n := range RowsPerPage {
+		if p.RowsPerPage == n {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrRowsPerPageInvalid
+	}
+	if p.DefaultStocklistID != 0 {
+		var count int
+		err := scoped(ps.db, ps.rls, userID, func(db *gorm.DB) error {
+			return db.Model(&Stocklist{}).
+				Where("id = ? AND user_id = ?", p.DefaultStocklistID, userID).
+				Count(&count).Error
+		})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrDefaultStocklist
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ProfileSettings are a user's choices about their public profile page at
+// /u/{username}. Profiles are private until the user makes them public;
+// users that never saved settings get DefaultProfileSettings.
+type ProfileSettings struct {
+	ID        uint `gorm:"primary_key"`
+	UserID    uint `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Public shows the profile page at all; it needs a username
+	Public bool `gorm:"not null"`
+	// ShowName, ShowAvatar and ShowStocklists show the user's name,
+	// avatar and public stocklists on the page
+	ShowName       bool `gorm:"not null"`
+	ShowAvatar     bool `gorm:"not null"`
+	ShowStocklists bool `gorm:"not null"`
+}
+
+// ErrUsernameRequired is returned when making the profile of a user
+// without a username public, since it would have no address.
+var ErrUsernameRequired = errors.New("models: pick a username before making the profile public")
+
+// DefaultProfileSettings returns the settings of a user that never
+// changed them: a private profile, which shows everything once public.
+func DefaultProfileSettings(userID uint) *ProfileSettings {
+	return &ProfileSettings{
+		UserID:         userID,
+		ShowName:       true,
+		ShowAvatar:     true,
+		ShowStocklists: true,
+	}
+}
+
+// ProfileService reads and writes the public profile settings of users.
+type ProfileService struct {
+	db *gorm.DB
+}
+
+// NewProfileService instantiates a ProfileService on a database
+// connection.
+func NewProfileService(db *gorm.DB) *ProfileService {
+	return &ProfileService{
+		db: db,
+	}
+}
+
+// ForUser returns the profile settings of a user, or the defaults if they
+// never saved any.
+func (ps *ProfileService) ForUser(userID uint) (*ProfileSettings, error) {
+	var settings ProfileSettings
+	err := first(ps.db.Where("user_id = ?", userID), &settings)
+	if err == ErrNotFound {
+		return DefaultProfileSettings(userID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// Update saves the profile settings of user.
+func (ps *ProfileService) Update(user *User, settings *ProfileSettings) error {
+	if user.ID == 0 {
+		return ErrUserIDRequired
+	}
+	if settings.Public && user.Username == nil {
+		return ErrUsernameRequired
+	}
+	settings.UserID = user.ID
+	return ps.db.Save(settings).Error
+}
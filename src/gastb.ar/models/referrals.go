@@ -0,0 +1,196 @@
+package models
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ReferralCode is the code a user shares for others to sign up with, so
+// that their signups are attributed to the user. Like calendar feed
+// tokens, it is stored as is, because it is shown again whenever it is
+// asked for.
+type ReferralCode struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;unique_index"`
+	Code   string `gorm:"not null;unique_index"`
+}
+
+// Referral is a signup attributed to a referral code. Signups failing
+// the abuse checks are kept, with the reason, but earn no reward.
+type Referral struct {
+	gorm.Model
+	ReferrerID uint `gorm:"not null;index"`
+	// UserID is the user who signed up
+	UserID uint `gorm:"not null;unique_index"`
+	// IP is the address the user signed up from
+	IP string
+	// Rejected is why the signup earns no reward, one of the
+	// ReferralSelf or ReferralSameIP, or empty if it does
+	Rejected string
+}
+
+// Reasons referrals are rejected for
+const (
+	// ReferralSelf is a user referring themselves, with their own code
+	// or with an address of their own
+	ReferralSelf = "self_referral"
+	// ReferralSameIP is a signup from an address the referrer used, or
+	// that another of their referrals signed up from
+	ReferralSameIP = "same_ip"
+)
+
+// ReferralStats is what a user's referral code brought in
+type ReferralStats struct {
+	Code string
+	// Signups counts the signups attributed to the code
+	Signups int
+	// Rewards counts those that passed the abuse checks
+	Rewards int
+}
+
+// ErrInvalidReferral is returned for unknown referral codes, and codes
+// of deleted users
+var ErrInvalidReferral = errors.New("models: referral code is invalid")
+
+// Number of random bytes in a referral code, which makes 8 characters
+const referralCodeBytes = 5
+
+// referralEncoding writes codes in letters and digits that are easy to
+// read out and type
+var referralEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ReferralService hands out referral codes and attributes signups to
+// them.
+type ReferralService struct {
+	db *gorm.DB
+}
+
+// NewReferralService instantiates a ReferralService on a database
+// connection.
+func NewReferralService(db *gorm.DB) *ReferralService {
+	return &ReferralService{
+		db: db,
+	}
+}
+
+// CodeFor returns the referral code of a user, creating it the first
+// time.
+func (rs *ReferralService) CodeFor(userID uint) (*ReferralCode, error) {
+	var rc ReferralCode
+	err := first(rs.db.Where("user_id = ?", userID), &rc)
+	if err != ErrNotFound {
+		if err != nil {
+			return nil, err
+		}
+		return &rc, nil
+	}
+	b, err := rand.Bytes(referralCodeBytes)
+	if err != nil {
+		return nil, err
+	}
+	rc = ReferralCode{UserID: userID, Code: referralEncoding.EncodeToString(b)}
+	if err := rs.db.Create(&rc).Error; err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// StatsFor returns the referral code of a user, with how many signups it
+// brought in and how many of them earned a reward.
+func (rs *ReferralService) StatsFor(userID uint) (*ReferralStats, error) {
+	rc, err := rs.CodeFor(userID)
+	if err != nil {
+		return nil, err
+	}
+	stats := &ReferralStats{Code: rc.Code}
+	err = rs.db.Model(&Referral{}).Where("referrer_id = ?", userID).
+		Count(&stats.Signups).Error
+	if err != nil {
+		return nil, err
+	}
+	err = rs.db.Model(&Referral{}).Where("referrer_id = ? AND rejected = ''", userID).
+		Count(&stats.Rewards).Error
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Attribute records that user signed up with a referral code, from
+// client. The signup is rejected, and earns no reward, if the code is
+// the user's own or its owner's address is the user's up to case and
+// "+tag" suffixes, or if the owner or another of their referrals used
+// the same IP address. Unknown codes return ErrInvalidReferral.
+func (rs *ReferralService) Attribute(code string, user *User, client Client) (*Referral, error) {
+	if user.ID == 0 {
+		return nil, ErrInvalidID
+	}
+	var referrer User
+	err := first(rs.db.Joins("JOIN referral_codes ON referral_codes.user_id = users.id").
+		Where("referral_codes.code = ? AND referral_codes.deleted_at IS NULL",
+			strings.ToUpper(strings.TrimSpace(code))), &referrer)
+	if err == ErrNotFound {
+		return nil, ErrInvalidReferral
+	}
+	if err != nil {
+		return nil, err
+	}
+	referral := &Referral{
+		ReferrerID: referrer.ID,
+		UserID:     user.ID,
+		IP:         client.IP,
+	}
+	switch {
+	case referrer.ID == user.ID || sameMailbox(referrer.Email, user.Email):
+		referral.Rejected = ReferralSelf
+	case client.IP != "":
+		sameIP, err := rs.usedIP(referrer.ID, client.IP)
+		if err != nil {
+			return nil, err
+		}
+		if sameIP {
+			referral.Rejected = ReferralSameIP
+		}
+	}
+	if err := rs.db.Create(referral).Error; err != nil {
+		return nil, err
+	}
+	return referral, nil
+}
+
+// usedIP reports whether a referrer had a session from an IP address,
+// or already has a referral that signed up from it
+func (rs *ReferralService) usedIP(referrerID uint, ip string) (bool, error) {
+	var count int
+	err := rs.db.Model(&Session{}).Where("user_id = ? AND ip = ?", referrerID, ip).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = rs.db.Model(&Referral{}).Where("referrer_id = ? AND ip = ?", referrerID, ip).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// sameMailbox reports whether two email addresses reach the same
+// mailbox, ignoring case and "+tag" suffixes
+func sameMailbox(a, b string) bool {
+	mailbox := func(email string) string {
+		email = strings.ToLower(email)
+		at := strings.LastIndex(email, "@")
+		if at < 0 {
+			return email
+		}
+		local, domain := email[:at], email[at:]
+		if plus := strings.Index(local, "+"); plus >= 0 {
+			local = local[:plus]
+		}
+		return local + domain
+	}
+	return mailbox(a) == mailbox(b)
+}
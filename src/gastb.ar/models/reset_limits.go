@@ -0,0 +1,66 @@
+package models
+
+import (
+	"fmt"
+	"log/slog"
+
+	"gastb.ar/ratelimit"
+)
+
+// SetResetLimit makes RequestPasswordReset email at most limit links to
+// one address, and at most limit links for one client IP, keeping count
+// in store. Requests over the limit succeed without sending anything, so
+// they can't tell whether an address has an account either, and are
+// recorded in the audit log. A zero limit sends every link.
+func (us *UserService) SetResetLimit(store ratelimit.Store, limit ratelimit.Limit) {
+	us.resetLimits = store
+	us.resetLimit = limit
+}
+
+// resetAllowed takes a password reset request for email, whose user is
+// nil if it has no account, from the limits of the address and the
+// client, and reports whether a link may be sent. Refusals are audited.
+// A failing store lets requests through, so users can still reset their
+// passwords.
+func (us *UserService) resetAllowed(email string, user *User, client Client) bool {
+	if us.resetLimits == nil || us.resetLimit.Unlimited() {
+		return true
+	}
+	// The IP address goes first, so that a client over its limit doesn't
+	// use up the limits of the addresses it tries
+	type limitKey struct{ key, by string }
+	var keys []limitKey
+	if client.IP != "" {
+		keys = append(keys, limitKey{"reset:ip:" + client.IP, "the IP address"})
+	}
+	keys = append(keys, limitKey{"reset:email:" + us.hmac.Hash(email), "the email address"})
+	for _, k := range keys {
+		ok, _, err := us.resetLimits.Take(k.key, us.resetLimit)
+		if err != nil {
+			slog.Error("checking password reset limit failed", "error", err)
+			continue
+		}
+		if !ok {
+			us.auditResetThrottled(email, user, client, k.by)
+			return false
+		}
+	}
+	return true
+}
+
+// auditResetThrottled records a password reset request refused for
+// going over the limit of by. Requests for unknown addresses are
+// recorded about user 0.
+func (us *UserService) auditResetThrottled(email string, user *User, client Client, by string) {
+	entry := &AuditEntry{
+		Action: AuditPasswordResetThrottled,
+		Detail: fmt.Sprintf("Password reset for %s from %s not sent: too many requests for %s",
+			email, client.IP, by),
+	}
+	if user != nil {
+		entry.UserID = user.ID
+	}
+	if err := us.audit.Record(entry); err != nil {
+		slog.Error("recording throttled password reset failed", "error", err)
+	}
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"errors"
+	"html"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// searchConfig is the text search configuration documents are parsed
+// with. Stocklist names are short and in any language, so words are
+// only lowercased, not stemmed.
+const searchConfig = "simple"
+
+// searchLimit is how many results Search returns at most
+const searchLimit = 50
+
+// Markers of the matches in snippets, escaped along with the rest of the
+// text before they are replaced with <mark> tags
+const (
+	startSel = "\x02"
+	stopSel  = "\x03"
+)
+
+// ErrQueryRequired is returned when searching for nothing
+var ErrQueryRequired = errors.New("models: a search query is required")
+
+// SearchResult is a document matching a search
+type SearchResult struct {
+	// Type is the kind of document, such as "stocklist"
+	Type string
+	ID   uint
+	// Title is the document's name
+	Title string
+	// Snippet is the matching text as HTML, with the matches in <mark>
+	// tags and the rest escaped
+	Snippet string
+	// Rank is higher for documents matching better
+	Rank float64
+}
+
+// SearchService searches the documents a user can see with Postgres full
+// text search. Documents are indexed in a search_vector column, kept up
+// to date by triggers that createSearch sets up when migrating.
+type SearchService struct {
+	db *gorm.DB
+	// rls runs searches as the user's tenant, see
+	// Services.SetRowLevelSecurity
+	rls bool
+}
+
+// NewSearchService instantiates a SearchService on a database connection.
+func NewSearchService(db *gorm.DB) *SearchService {
+	return &SearchService{db: db}
+}
+
+// Search returns the documents a user can see matching query, best
+// first. The query is in the syntax of web search engines: words must
+// all match, "quoted phrases" in order, or separates alternatives and a
+// leading - excludes a word.
+func (ss *SearchService) Search(userID uint, query string) ([]SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, ErrQueryRequired
+	}
+	options := "StartSel=" + startSel + ", StopSel=" + stopSel + ", HighlightAll=true"
+	results := []SearchResult{}
+	err := scoped(ss.db, ss.rls, userID, func(db *gorm.DB) error {
+		rows, err := db.Raw(`SELECT s.id, s.name,
+				ts_headline(?, s.name, q, ?) AS snippet,
+				ts_rank(s.search_vector, q) AS rank
+			FROM stocklists s, websearch_to_tsquery(?, ?) q
+			WHERE s.deleted_at IS NULL AND s.search_vector @@ q
+				AND ((s.user_id = ? AND s.organization_id IS NULL) OR s.organization_id IN
+					(SELECT organization_id FROM memberships WHERE user_id = ?))
+			ORDER BY rank DESC, s.id
+			LIMIT ?`, searchConfig, options, searchConfig, query, userID, userID, searchLimit).Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			r := SearchResult{Type: ChangeStocklist}
+			if err := rows.Scan(&r.ID, &r.Title, &r.Snippet, &r.Rank); err != nil {
+				return err
+			}
+			r.Snippet = highlight(r.Snippet)
+			results = append(results, r)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// highlight escapes a snippet and turns its match markers into tags
+func highlight(snippet string) string {
+	return strings.NewReplacer(startSel, "<mark>", stopSel, "</mark>").
+		Replace(html.EscapeString(snippet))
+}
+
+// createSearch adds the search_vector column of stocklists, the trigger
+// filling it in and the vectors of existing rows. The column is left out
+// of the Stocklist model, so gorm never reads or writes it. It runs
+// before createIndexes, which indexes the column.
+func (s *Services) createSearch() error {
+	statements := []string{
+		`ALTER TABLE stocklists ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE OR REPLACE FUNCTION stocklists_search_vector() RETURNS trigger AS $$
+		BEGIN
+			NEW.search_vector := to_tsvector('` + searchConfig + `', coalesce(NEW.name, ''));
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS stocklists_search_vector ON stocklists`,
+		`CREATE TRIGGER stocklists_search_vector BEFORE INSERT OR UPDATE OF name
+		ON stocklists FOR EACH ROW EXECUTE PROCEDURE stocklists_search_vector()`,
+		`UPDATE stocklists SET search_vector = to_tsvector('` + searchConfig + `', name)
+		WHERE search_vector IS NULL`,
+	}
+	for _, stmt := range statements {
+		if err := s.admin.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+
+	"gastb.ar/rand"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Client describes where a request came from, for security notices
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+// Kinds of security notice
+const (
+	SecurityNewLogin        = "new_login"
+	SecurityPasswordChanged = "password_changed"
+	SecurityEmailChanged    = "email_changed"
+)
+
+// SecurityNotice tells a user about a sensitive change to their account.
+// LockToken is the token of the "this wasn't me" link, which locks the
+// account until the password is reset.
+type SecurityNotice struct {
+	Kind   string
+	Client Client
+	Time   time.Time
+	// To is the address the notice is sent to; the old address when the
+	// email address changed
+	To        string
+	OldEmail  string
+	LockToken string
+}
+
+// ErrPasswordResetRequired is returned when authenticating a user who
+// locked their account from a security notice, until they reset their
+// password.
+var ErrPasswordResetRequired = errors.New("models: account is locked until the password is reset")
+
+// Device is a browser a user logged in from, identified by a random ID
+// kept in a long lived cookie. Only a hash of the ID is stored.
+type Device struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;unique_index:idx_devices_user_hash"`
+	IDHash     string `gorm:"not null;unique_index:idx_devices_user_hash"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+}
+
+// userDeviceGorm stores the devices of users
+type userDeviceGorm struct {
+	db *gorm.DB
+}
+
+// seen records a login from a device, reporting whether the user had
+// logged in from other devices but not this one
+func (dg *userDeviceGorm) seen(userID uint, deviceID string, client Client, now time.Time) (bool, error) {
+	sum := sha256.Sum256([]byte(deviceID))
+	idHash := hex.EncodeToString(sum[:])
+	var device Device
+	err := first(dg.db.Where("user_id = ? AND id_hash = ?", userID, idHash), &device)
+	switch err {
+	case nil:
+		device.UserAgent = client.UserAgent
+		device.IP = client.IP
+		device.LastSeenAt = now
+		return false, dg.db.Save(&device).Error
+	case ErrNotFound:
+	default:
+		return false, err
+	}
+	var known int
+	if err := dg.db.Model(&Device{}).Where("user_id = ?", userID).Count(&known).Error; err != nil {
+		return false, err
+	}
+	device = Device{
+		UserID:     userID,
+		IDHash:     idHash,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		LastSeenAt: now,
+	}
+	if err := dg.db.Create(&device).Error; err != nil {
+		return false, err
+	}
+	return known > 0, nil
+}
+
+// notifySecurity emails a user a security notice with a link to lock
+// their account, sent to the address to. Failures are logged, as for
+// other emails.
+func (us *UserService) notifySecurity(user *User, kind string, client Client, to, oldEmail string) {
+	if us.mailer == nil {
+		return
+	}
+	now := us.clock.Now()
+	token, err := us.tokens.create(user.ID, to, TokenLockAccount, LockAccountTTL, us.hmac.Hash, now)
+	if err != nil {
+		slog.Error("creating account lock token failed", "user_id", user.ID,
+			"error", err)
+		return
+	}
+	notice := SecurityNotice{
+		Kind:      kind,
+		Client:    client,
+		Time:      now,
+		To:        to,
+		OldEmail:  oldEmail,
+		LockToken: token,
+	}
+	us.mail(kind, user, func(m UserMailer) error {
+		return m.SecurityNotice(user, notice)
+	})
+}
+
+// RecordLogin records that a user logged in from a device, identified by
+// the ID in its device cookie. Logins from a device the user never used
+// before are notified, except for the very first one.
+func (us *UserService) RecordLogin(user *User, deviceID string, client Client) error {
+	isNew, err := us.devices.seen(user.ID, deviceID, client, us.clock.Now())
+	if err != nil {
+		return err
+	}
+	if isNew {
+		us.notifySecurity(user, SecurityNewLogin, client, user.Email, "")
+	}
+	return nil
+}
+
+// ChangePassword sets a new password for a user after checking their
+// current one. Recent passwords are refused with ErrPasswordReused. All
+// the user's sessions end, so the caller has to start a new one for the
+// client that changed it.
+func (us *UserService) ChangePassword(user *User, current, password string, client Client) error {
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(current))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrInvalidPassword
+	}
+	if err != nil {
+		return err
+	}
+	if len(password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	if err := us.checkReuse(user, password); err != nil {
+		return err
+	}
+	user.Password = password
+	if err := user.hashPassword(); err != nil {
+		return err
+	}
+	if user.Token, err = rand.RememberToken(); err != nil {
+		return err
+	}
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	us.recordPassword(user)
+	us.notifySecurity(user, SecurityPasswordChanged, client, user.Email, "")
+	return nil
+}
+
+// LockAccount handles the "this wasn't me" link of a security notice. It
+// logs the user out everywhere and requires a password reset before they
+// can log in again, emailing them a reset link. If the notice was about
+// a change of address, the old address is restored first, since whoever
+// changed it may control the new one.
+func (us *UserService) LockAccount(token string) (*User, error) {
+	ut, err := us.tokens.use(us.hmac.Hash(token), TokenLockAccount, us.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	user, err := us.db.ByID(ut.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != ut.Email {
+		current := user.Email
+		user.Email = ut.Email
+		if err := us.validateEmail(user); err != nil {
+			// The old address was taken meanwhile; keep the current one
+			user.Email = current
+		}
+	}
+	user.ResetRequired = true
+	if user.Token, err = rand.RememberToken(); err != nil {
+		return nil, err
+	}
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	if err := us.sendPasswordReset(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
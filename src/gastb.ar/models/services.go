@@ -1,37 +1,311 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gastb.ar/clock"
+	"gastb.ar/log"
+
+	"github.com/jinzhu/gorm"
+)
 
 type Services struct {
 	*UserService
+	*StocklistService
+	*APIKeyService
+	*InviteService
+	*WebhookService
+	*JobService
+	*SettingService
+	*AttachmentService
+	*EmailDeliveryService
+	*DigestService
+	*NotificationSettingService
+	*CalendarFeedService
+	*AuditService
+	*PolicyService
+	*PreferenceService
+	*BlockedDomainService
+	*ProfileService
+	*UserPurgeService
+	*GuestService
+	*ReferralService
+	*OrganizationService
+	*SubscriptionService
+	*APIUsageService
+	*IdempotencyKeyService
+	*ChangeService
+	*SearchService
 	db        *gorm.DB
+	// admin is the connection of SetAdminConnection, db without one
+	admin     *gorm.DB
+	hooks     *queryHooks
+	stmts     *stmtCache
+	slow      *slowQueryLog
+	prepared  *gorm.DB
+	// logLevel is set by SetLogLevel; empty is warn
+	logLevel string
+	// rls enforces tenant isolation with row level security, see
+	// SetRowLevelSecurity
+	rls bool
 }
 
 func NewServices(connectionInfo string, hmacSecretKey string) (*Services, error) {
-	db, err := gorm.Open("postgres", connectionInfo)
-	if err != nil { 
+	sqlDB, err := openDB(connectionInfo)
+	if err != nil {
+		return nil, err
+	}
+	// gorm pings the database when opening, its only error with a pool
+	// given; the database may not be up yet, which WaitForDB waits for
+	db, _ := gorm.Open("postgres", sqlDB)
+	// Errors are logged; SetLogLevel changes what else is
+	db.SetLogger(log.GormLogger{})
+
+	hooks := &queryHooks{}
+	hooks.add(observeQuery)
+	hooks.add(traceQuery)
+	registerCallbacks(db, hooks)
+
+	// The hot user lookups go through a second gorm handle on the same
+	// pool, whose queries are prepared once and reused
+	stmts := newStmtCache(db.DB())
+	prepared, err := gorm.Open("postgres", stmts)
+	if err != nil {
 		return nil, err
 	}
-	db.LogMode(true)
+	prepared.SetLogger(log.GormLogger{})
+	registerCallbacks(prepared, hooks)
+	us := NewUserService(db, hmacSecretKey)
+	us.db = &userGorm{db: db, prepared: prepared}
+	ss := NewStocklistService(db)
+	orgs := NewOrganizationService(db, hmacSecretKey)
+	ss.SetOrganizations(orgs)
+	subs := NewSubscriptionService(db)
+	ss.SetSubscriptions(subs)
 
 	return &Services {
-		UserService:      NewUserService(db, hmacSecretKey),
-		db:               db,
+		UserService:                us,
+		StocklistService:           ss,
+		APIKeyService:              NewAPIKeyService(db, hmacSecretKey),
+		InviteService:              NewInviteService(db, hmacSecretKey),
+		WebhookService:             NewWebhookService(db),
+		JobService:                 NewJobService(db),
+		SettingService:             NewSettingService(db),
+		AttachmentService:          NewAttachmentService(db),
+		EmailDeliveryService:       NewEmailDeliveryService(db),
+		DigestService:              NewDigestService(db),
+		NotificationSettingService: NewNotificationSettingService(db),
+		CalendarFeedService:        NewCalendarFeedService(db),
+		AuditService:               NewAuditService(db),
+		PolicyService:              NewPolicyService(db),
+		PreferenceService:          NewPreferenceService(db),
+		BlockedDomainService:       NewBlockedDomainService(db),
+		ProfileService:             NewProfileService(db),
+		UserPurgeService:           NewUserPurgeService(db),
+		GuestService:               NewGuestService(db, hmacSecretKey),
+		ReferralService:            NewReferralService(db),
+		OrganizationService:        orgs,
+		SubscriptionService:        subs,
+		APIUsageService:            NewAPIUsageService(db),
+		IdempotencyKeyService:      NewIdempotencyKeyService(db),
+		ChangeService:              NewChangeService(db),
+		SearchService:              NewSearchService(db),
+		db:                         db,
+		admin:                      db,
+		hooks:                      hooks,
+		stmts:                      stmts,
+		prepared:                   prepared,
 	}, nil
 }
 
+// SetClock sets the clock of the services that deal with expiry: user
+// tokens, verification codes and lockouts, invites, guests,
+// organization invitations, API usage days and idempotency keys
+func (s *Services) SetClock(c clock.Clock) {
+	s.UserService.SetClock(c)
+	s.InviteService.SetClock(c)
+	s.GuestService.SetClock(c)
+	s.OrganizationService.SetClock(c)
+	s.APIUsageService.SetClock(c)
+	s.IdempotencyKeyService.SetClock(c)
+}
+
+// SetPreparedStatements turns the prepared statements of the hot user
+// lookups on or off; they are on by default. Turn them off behind
+// poolers in transaction mode. It is meant to be called at startup.
+func (s *Services) SetPreparedStatements(on bool) {
+	s.stmts.setEnabled(on)
+}
+
+// PreparedStatements returns how many statements are prepared
+func (s *Services) PreparedStatements() int {
+	return s.stmts.Len()
+}
+
 func (s *Services) Close() error {
+	s.stmts.Close()
+	if s.admin != s.db {
+		s.admin.Close()
+	}
 	return s.db.Close()
 }
 
+// allModels lists every model managed by AutoMigrate
+func allModels() []interface{} {
+	return []interface{}{&User{}, &Stocklist{}, &APIKey{}, &Invite{},
+		&Webhook{}, &WebhookDelivery{}, &Job{},
+		&Setting{}, &Attachment{}, &UserToken{},
+		&EmailDelivery{}, &DigestSubscription{},
+		&NotificationSettings{}, &Device{}, &VerificationCode{}, &Session{},
+		&CalendarFeed{}, &AuditEntry{},
+		&PolicyAcceptance{}, &UserPreference{},
+		&BlockedDomain{}, &ProfileSettings{}, &PasswordHistory{},
+		&UserPurge{}, &Guest{}, &GuestStocklist{},
+		&ReferralCode{}, &Referral{},
+		&Organization{}, &Membership{}, &OrgInvite{}, &Subscription{},
+		&APIUsage{}, &IdempotencyKey{}, &Change{},
+		&OutboxCursor{}}
+}
+
+// AutoMigrate creates missing tables and columns, then the search
+// triggers, the row level security policies and the explicit indexes
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Stocklist{}).Error
+	if err := s.admin.AutoMigrate(allModels()...).Error; err != nil {
+		return err
+	}
+	if err := s.createSearch(); err != nil {
+		return err
+	}
+	if err := s.createPolicies(); err != nil {
+		return err
+	}
+	return s.createIndexes()
+}
+
+// Ping checks that the database connection is alive
+func (s *Services) Ping(ctx context.Context) error {
+	return s.db.DB().PingContext(ctx)
+}
+
+// Backoff of WaitForDB
+const (
+	waitBackoff    = 250 * time.Millisecond
+	maxWaitBackoff = 8 * time.Second
+)
+
+// WaitForDB waits for the database to take connections, retrying with
+// exponential backoff, so that the site can start along with Postgres,
+// as under docker-compose, or during a failover. It returns the last
+// error once timeout passes or ctx is done. It is meant to be called
+// after NewServices, before anything else uses the database.
+func (s *Services) WaitForDB(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	for attempt, wait := 1, waitBackoff; ; attempt, wait = attempt+1, min(2*wait, maxWaitBackoff) {
+		err := s.Ping(ctx)
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("database is up", "attempts", attempt,
+					"waited", time.Since(start).Round(time.Millisecond))
+			}
+			return nil
+		}
+		if deadline, _ := ctx.Deadline(); time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("models: database unavailable after %v: %w",
+				time.Since(start).Round(time.Millisecond), err)
+		}
+		slog.Warn("waiting for the database", "attempt", attempt, "retry_in", wait,
+			"error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("models: database unavailable: %w", err)
+		}
+	}
+}
+
+// CheckMigrations returns an error if the table of any model is missing
+func (s *Services) CheckMigrations(ctx context.Context) error {
+	for _, m := range allModels() {
+		if !s.db.HasTable(m) {
+			return fmt.Errorf("models: table for %T is missing", m)
+		}
+	}
+	return nil
 }
 
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Stocklist{}).Error
-	if err != nil {
+	if err := s.DropTables(); err != nil {
 		return err
 	}
 	return s.AutoMigrate() 
 }
+
+// DropTables drops the table of every model, deleting all data
+func (s *Services) DropTables() error {
+	return s.db.DropTableIfExists(allModels()...).Error
+}
+
+// TableStatus tells whether the table of a model exists
+type TableStatus struct {
+	Table  string
+	Exists bool
+}
+
+// MigrationStatus lists the table of every model and whether it exists
+func (s *Services) MigrationStatus() []TableStatus {
+	var status []TableStatus
+	for _, m := range allModels() {
+		status = append(status, TableStatus{
+			Table:  s.db.NewScope(m).TableName(),
+			Exists: s.db.HasTable(m),
+		})
+	}
+	return status
+}
+
+// Stats are counts shown on the admin dashboard
+type Stats struct {
+	Users          int
+	LockedUsers    int
+	NewUsers       int // signed up in the last 7 days
+	Stocklists     int
+	APIKeys        int
+	PendingInvites int
+	DeadEmails     int // given up on in the last 7 days
+}
+
+// Stats counts records across tables for the admin dashboard
+func (s *Services) Stats() (Stats, error) {
+	var st Stats
+	now := time.Now()
+	counts := []struct {
+		dst   *int
+		model interface{}
+		where string
+		args  []interface{}
+	}{
+		{&st.Users, &User{}, "", nil},
+		{&st.LockedUsers, &User{}, "locked_until > ?", []interface{}{now}},
+		{&st.NewUsers, &User{}, "created_at > ?", []interface{}{now.AddDate(0, 0, -7)}},
+		{&st.Stocklists, &Stocklist{}, "", nil},
+		{&st.APIKeys, &APIKey{}, "", nil},
+		{&st.PendingInvites, &Invite{}, "used_at IS NULL AND expires_at > ?", []interface{}{now}},
+		{&st.DeadEmails, &EmailDelivery{}, "status = ? AND created_at > ?",
+			[]interface{}{EmailDead, now.AddDate(0, 0, -7)}},
+	}
+	for _, c := range counts {
+		db := s.admin.Model(c.model)
+		if c.where != "" {
+			db = db.Where(c.where, c.args...)
+		}
+		if err := db.Count(c.dst).Error; err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"log/slog"
+	"time"
+
+	"gastb.ar/cache"
+)
+
+// cachedSessions is a SessionDB keeping the sessions looked up by remember
+// token in a cache.Cache, so that most requests of logged in users skip
+// that query. Sessions ended through it are dropped from the cache at
+// once; those deleted outside it, by user merges and purges, live on
+// until their TTL, but their users are looked up on every request anyway.
+// Cache failures are logged, and the database is used instead.
+type cachedSessions struct {
+	SessionDB
+	cache cache.Cache
+	ttl   time.Duration
+}
+
+var _ SessionDB = &cachedSessions{}
+
+// NewCachedSessionDB returns a SessionDB keeping the sessions db looks up
+// by remember token in c for up to ttl
+func NewCachedSessionDB(db SessionDB, c cache.Cache, ttl time.Duration) SessionDB {
+	return &cachedSessions{SessionDB: db, cache: c, ttl: ttl}
+}
+
+func sessionKey(tokenHash string) string {
+	return "session:" + tokenHash
+}
+
+func (cs *cachedSessions) ByHash(tokenHash string) (*Session, error) {
+	var s Session
+	ok, err := cache.GetJSON(cs.cache, sessionKey(tokenHash), &s)
+	if err != nil {
+		slog.Warn("reading session cache failed", "error", err)
+	}
+	if ok {
+		return &s, nil
+	}
+	found, err := cs.SessionDB.ByHash(tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	cs.store(found)
+	return found, nil
+}
+
+func (cs *cachedSessions) Touch(s *Session) error {
+	if err := cs.SessionDB.Touch(s); err != nil {
+		return err
+	}
+	cs.store(s)
+	return nil
+}
+
+func (cs *cachedSessions) Reauthenticated(s *Session) error {
+	if err := cs.SessionDB.Reauthenticated(s); err != nil {
+		return err
+	}
+	cs.store(s)
+	return nil
+}
+
+func (cs *cachedSessions) Delete(userID, id uint) error {
+	sessions, err := cs.SessionDB.ByUser(userID)
+	if err != nil {
+		return err
+	}
+	if err := cs.SessionDB.Delete(userID, id); err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.ID == id {
+			cs.drop(s.TokenHash)
+		}
+	}
+	return nil
+}
+
+func (cs *cachedSessions) DeleteAll(userID, except uint) (int64, error) {
+	sessions, err := cs.SessionDB.ByUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := cs.SessionDB.DeleteAll(userID, except)
+	if err != nil {
+		return n, err
+	}
+	var hashes []string
+	for _, s := range sessions {
+		if s.ID != except {
+			hashes = append(hashes, s.TokenHash)
+		}
+	}
+	cs.drop(hashes...)
+	return n, nil
+}
+
+func (cs *cachedSessions) store(s *Session) {
+	if err := cache.SetJSON(cs.cache, sessionKey(s.TokenHash), s, cs.ttl); err != nil {
+		slog.Warn("writing session cache failed", "error", err)
+	}
+}
+
+func (cs *cachedSessions) drop(tokenHashes ...string) {
+	if len(tokenHashes) == 0 {
+		return
+	}
+	keys := make([]string, len(tokenHashes))
+	for i, h := range tokenHashes {
+		keys[i] = sessionKey(h)
+	}
+	if err := cs.cache.Delete(keys...); err != nil {
+		slog.Warn("invalidating session cache failed", "error", err)
+	}
+}
+
+// SetSessionCache keeps the sessions looked up by remember token in c for
+// up to ttl. With several instances, c must be shared between them, or
+// logging out on one leaves the session usable on the others until the
+// TTL runs out. It is meant to be called at startup.
+func (us *UserService) SetSessionCache(c cache.Cache, ttl time.Duration) {
+	us.sessions = NewCachedSessionDB(us.sessions, c, ttl)
+}
@@ -0,0 +1,71 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"gastb.ar/cache"
+	"gastb.ar/models"
+	"gastb.ar/models/modelstest"
+)
+
+func TestCachedSessionDB(t *testing.T) {
+	modelstest.TestSessionDB(t, func() models.SessionDB {
+		return models.NewCachedSessionDB(modelstest.NewSessions(), cache.NewMemoryCache(), time.Minute)
+	})
+}
+
+func TestSessionCache(t *testing.T) {
+	users, sessions := modelstest.NewUsers(), modelstest.NewSessions()
+	us := models.NewUserServiceWith(users, sessions, "test-hmac-key")
+	us.SetSessionCache(cache.NewMemoryCache(), time.Minute)
+	user := &models.User{Name: "Ana", Email: "ana@example.com", TokenHash: "token"}
+	if err := users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	start := func() string {
+		token, err := us.StartSession(user, models.Client{})
+		if err != nil {
+			t.Fatalf("StartSession: %v", err)
+		}
+		if _, err := us.ByRemember(token); err != nil {
+			t.Fatalf("ByRemember: %v", err)
+		}
+		return token
+	}
+
+	// Once looked up, a session is served from the cache
+	token := start()
+	_, s, err := us.BySession(token, models.Client{})
+	if err != nil {
+		t.Fatalf("BySession: %v", err)
+	}
+	if err := sessions.Delete(user.ID, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.ByRemember(token); err != nil {
+		t.Errorf("ByRemember of a cached session returned %v", err)
+	}
+
+	// Sessions ended through the service are dropped at once
+	token = start()
+	_, s, _ = us.BySession(token, models.Client{})
+	if err := us.EndSession(user.ID, s.ID); err != nil {
+		t.Fatalf("EndSession: %v", err)
+	}
+	if _, err := us.ByRemember(token); err != models.ErrNotFound {
+		t.Errorf("ByRemember after EndSession returned %v, want ErrNotFound", err)
+	}
+
+	current, other := start(), start()
+	_, s, _ = us.BySession(current, models.Client{})
+	if _, err := us.EndOtherSessions(user.ID, s.ID); err != nil {
+		t.Fatalf("EndOtherSessions: %v", err)
+	}
+	if _, err := us.ByRemember(other); err != models.ErrNotFound {
+		t.Errorf("ByRemember of another session returned %v, want ErrNotFound", err)
+	}
+	if _, err := us.ByRemember(current); err != nil {
+		t.Errorf("ByRemember of the current session returned %v", err)
+	}
+}
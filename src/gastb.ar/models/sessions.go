@@ -0,0 +1,268 @@
+package models
+
+import (
+	"time"
+
+	"gastb.ar/rand"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Session is a login of a user in a browser, which the remember token
+// cookie points at. Users can be logged in from several browsers at once
+// and end any of their sessions. Only the hash of the token is stored.
+type Session struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// UserAgent and IP are those of the latest request in the session
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// ReauthenticatedAt is when the user last confirmed their password in
+	// the session, logging in included; sensitive actions need it to be
+	// recent
+	ReauthenticatedAt *time.Time
+}
+
+// Elevated reports whether the user confirmed their password in the
+// session within window of now, which lets them take sensitive actions
+// ("sudo mode")
+func (s *Session) Elevated(now time.Time, window time.Duration) bool {
+	return s.ReauthenticatedAt != nil && now.Sub(*s.ReauthenticatedAt) < window
+}
+
+// sessionTouchInterval is how stale the latest request of a session may
+// get before it is recorded again, so that not every request writes
+const sessionTouchInterval = 5 * time.Minute
+
+// SessionDB stores the sessions of users. The services decide when a
+// session changes; Touch and Reauthenticated store what they changed.
+type SessionDB interface {
+	Create(s *Session) error
+	// ByHash returns the session with a remember token hash, or
+	// ErrNotFound
+	ByHash(tokenHash string) (*Session, error)
+	// ByUser lists the sessions of a user, the most recently used first
+	ByUser(userID uint) ([]Session, error)
+	// Touch stores the client and LastSeenAt of a session
+	Touch(s *Session) error
+	// Reauthenticated stores the ReauthenticatedAt of a session
+	Reauthenticated(s *Session) error
+	// LoggedIn stores the LastLoginAt of a user starting a session
+	LoggedIn(user *User) error
+	// Delete deletes a session of a user, returning ErrNotFound if they
+	// have none with the ID
+	Delete(userID, id uint) error
+	// DeleteAll deletes the sessions of a user but the one with ID
+	// except, returning how many there were
+	DeleteAll(userID, except uint) (int64, error)
+}
+
+// sessionGorm stores the sessions of users
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+var _ SessionDB = &sessionGorm{}
+
+// NewSessionDB returns the gorm implementation of SessionDB.
+func NewSessionDB(db *gorm.DB) SessionDB {
+	return &sessionGorm{db}
+}
+
+func (sg *sessionGorm) Create(s *Session) error {
+	return sg.db.Create(s).Error
+}
+
+func (sg *sessionGorm) ByHash(tokenHash string) (*Session, error) {
+	var s Session
+	if err := first(sg.db.Where("token_hash = ?", tokenHash), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sg *sessionGorm) ByUser(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ?", userID).Order("last_seen_at DESC, id DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+func (sg *sessionGorm) Touch(s *Session) error {
+	return sg.db.Model(s).UpdateColumns(map[string]interface{}{
+		"ip":           s.IP,
+		"user_agent":   s.UserAgent,
+		"last_seen_at": s.LastSeenAt,
+	}).Error
+}
+
+func (sg *sessionGorm) Reauthenticated(s *Session) error {
+	return sg.db.Model(s).UpdateColumn("reauthenticated_at", s.ReauthenticatedAt).Error
+}
+
+func (sg *sessionGorm) LoggedIn(user *User) error {
+	return sg.db.Model(&User{}).Where("id = ?", user.ID).
+		UpdateColumn("last_login_at", user.LastLoginAt).Error
+}
+
+func (sg *sessionGorm) Delete(userID, id uint) error {
+	db := sg.db.Where("id = ? AND user_id = ?", id, userID).Delete(&Session{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (sg *sessionGorm) DeleteAll(userID, except uint) (int64, error) {
+	db := sg.db.Where("user_id = ? AND id <> ?", userID, except).Delete(&Session{})
+	return db.RowsAffected, db.Error
+}
+
+// touch records a request in the session at now, unless one from the
+// same client was recorded recently
+func touch(sessions SessionDB, s *Session, client Client, now time.Time) error {
+	if client.IP == "" {
+		client.IP = s.IP
+	}
+	if client.UserAgent == "" {
+		client.UserAgent = s.UserAgent
+	}
+	if client.IP == s.IP && client.UserAgent == s.UserAgent &&
+		now.Sub(s.LastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+	s.IP, s.UserAgent, s.LastSeenAt = client.IP, client.UserAgent, now
+	return sessions.Touch(s)
+}
+
+// StartSession logs a user in from a client, returning the token of the
+// new session to keep in the remember cookie, and records the login on
+// the user. Users have just authenticated, so the session starts
+// elevated.
+func (us *UserService) StartSession(user *User, client Client) (string, error) {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return "", err
+	}
+	now := us.clock.Now()
+	err = us.sessions.Create(&Session{
+		UserID:            user.ID,
+		TokenHash:         us.hmac.Hash(token),
+		UserAgent:         client.UserAgent,
+		IP:                client.IP,
+		CreatedAt:         now,
+		LastSeenAt:        now,
+		ReauthenticatedAt: &now,
+	})
+	if err != nil {
+		return "", err
+	}
+	user.LastLoginAt = &now
+	if err := us.sessions.LoggedIn(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// BySession looks up the session with a remember token and its user,
+// recording a request from client in it. Deactivated users have no
+// sessions.
+func (us *UserService) BySession(token string, client Client) (*User, *Session, error) {
+	tokenHash := us.hmac.Hash(token)
+	s, err := us.sessions.ByHash(tokenHash)
+	if err == ErrNotFound {
+		s, err = us.adoptRemember(tokenHash, client)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := us.db.ByID(s.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Deactivation ends sessions, but not those whose lookup was in
+	// flight
+	if user.IsDeactivated() {
+		return nil, nil, ErrNotFound
+	}
+	if err := touch(us.sessions, s, client, us.clock.Now()); err != nil {
+		return nil, nil, err
+	}
+	return user, s, nil
+}
+
+// adoptRemember turns a remember cookie set before sessions were kept,
+// which holds the user's own token, into a session, so users stay logged
+// in. The user's token is replaced, so the cookie only works through the
+// session from then on.
+func (us *UserService) adoptRemember(tokenHash string, client Client) (*Session, error) {
+	user, err := us.db.ByTokenHash(tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+	// Not through Update, which would end the user's other sessions
+	user.TokenHash = us.hmac.Hash(token)
+	if err := us.db.Update(user); err != nil {
+		return nil, err
+	}
+	now := us.clock.Now()
+	s := &Session{
+		UserID:     user.ID,
+		TokenHash:  tokenHash,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	return s, us.sessions.Create(s)
+}
+
+// Sessions lists the sessions of a user, the most recently used first
+func (us *UserService) Sessions(userID uint) ([]Session, error) {
+	return us.sessions.ByUser(userID)
+}
+
+// EndSession logs a user out of one of their sessions, returning
+// ErrNotFound if they have none with the ID
+func (us *UserService) EndSession(userID, id uint) error {
+	return us.sessions.Delete(userID, id)
+}
+
+// EndOtherSessions logs a user out of all their sessions but current,
+// the ID of the one they are using, or of all of them if current is 0.
+// It returns how many sessions ended.
+func (us *UserService) EndOtherSessions(userID, current uint) (int64, error) {
+	return us.sessions.DeleteAll(userID, current)
+}
+
+// Reauthenticate checks the password of the user of a session again and
+// records it, elevating the session for sensitive actions. Users who must
+// sign in with single sign-on get ErrSSORequired, since logging in again
+// is how they confirm who they are.
+func (us *UserService) Reauthenticate(user *User, session *Session, password string) error {
+	if us.RequiresSSO(user.Email) {
+		return ErrSSORequired
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrInvalidPassword
+	}
+	if err != nil {
+		return err
+	}
+	now := us.clock.Now()
+	session.ReauthenticatedAt = &now
+	return us.sessions.Reauthenticated(session)
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Setting is a site-wide setting that admins can change while the server
+// runs, such as the maintenance mode switch.
+type Setting struct {
+	Key       string `gorm:"primary_key"`
+	Value     string `gorm:"type:text"`
+	UpdatedAt time.Time
+}
+
+// Keys of the settings
+const (
+	SettingMaintenance        = "maintenance"
+	SettingMaintenanceMessage = "maintenance_message"
+)
+
+// SettingService reads and writes site-wide settings.
+type SettingService struct {
+	db *gorm.DB
+}
+
+// NewSettingService instantiates a SettingService on a database
+// connection.
+func NewSettingService(db *gorm.DB) *SettingService {
+	return &SettingService {
+		db: db,
+	}
+}
+
+// Get returns the value of a setting, or ErrNotFound if it was never set.
+func (ss *SettingService) Get(key string) (string, error) {
+	var setting Setting
+	if err := first(ss.db.Where("key = ?", key), &setting); err != nil {
+		return "", err
+	}
+	return setting.Value, nil
+}
+
+// Set stores the value of a setting.
+func (ss *SettingService) Set(key, value string) error {
+	return ss.db.Save(&Setting{Key: key, Value: value}).Error
+}
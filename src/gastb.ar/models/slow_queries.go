@@ -0,0 +1,263 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slowQueriesKept is how many slow queries SlowQueries returns
+const slowQueriesKept = 20
+
+// Limits of plan capture: at most explainConcurrency plans are captured
+// at once, each statement at most once every explainInterval, and a plan
+// taking longer than explainTimeout is given up on. Slow queries past
+// these limits are kept without a plan.
+const (
+	explainConcurrency = 2
+	explainInterval    = 10 * time.Minute
+	explainTimeout     = 30 * time.Second
+)
+
+// SlowQuery is a database operation that took longer than the slow query
+// threshold. Its parameters are not kept, only how many there were, so
+// emails or tokens in them don't end up in logs or on the dashboard.
+type SlowQuery struct {
+	Time     time.Time
+	Op       string
+	Table    string
+	SQL      string
+	Params   int
+	Duration time.Duration
+	Err      string
+	// Plan is the output of EXPLAIN, with ANALYZE for reads, when plans
+	// are captured; it is filled in shortly after the query is recorded
+	Plan string
+}
+
+// slowQueryLog logs operations slower than a threshold and keeps the
+// latest ones for the admin dashboard
+type slowQueryLog struct {
+	db        *sql.DB
+	threshold time.Duration
+	explain   bool
+	// quiet keeps slow queries for the dashboard without logging them
+	quiet bool
+
+	// explaining holds a slot for each plan being captured
+	explaining chan struct{}
+
+	mu      sync.Mutex
+	queries []*SlowQuery // oldest first
+	// explained is when each statement was last explained, by
+	// fingerprint
+	explained map[string]time.Time
+}
+
+// hook is the QueryHook of the log
+func (l *slowQueryLog) hook(e QueryEvent) {
+	if e.Duration < l.threshold {
+		return
+	}
+	q := &SlowQuery{
+		Time:     time.Now(),
+		Op:       e.Op,
+		Table:    e.Table,
+		SQL:      e.SQL,
+		Params:   len(e.Vars),
+		Duration: e.Duration,
+	}
+	if e.Err != nil {
+		q.Err = e.Err.Error()
+	}
+	if !l.quiet {
+		slog.Warn("slow query", "op", q.Op, "table", q.Table, "duration", q.Duration,
+			"sql", q.SQL, "params", q.Params)
+	}
+
+	l.mu.Lock()
+	l.queries = append(l.queries, q)
+	if len(l.queries) > slowQueriesKept {
+		l.queries = l.queries[len(l.queries)-slowQueriesKept:]
+	}
+	l.mu.Unlock()
+
+	if !l.explain || e.Err != nil {
+		return
+	}
+	explain, analyze := explainable(e.SQL)
+	if explain && l.startExplain(e.SQL, q.Time) {
+		go l.capturePlan(q, e.Vars, analyze)
+	}
+}
+
+// startExplain reports whether the plan of a statement is to be
+// captured, taking a slot of explaining if so. It isn't if the statement
+// was explained in the last explainInterval, or if every slot is taken.
+func (l *slowQueryLog) startExplain(sql string, now time.Time) bool {
+	key := fingerprint(sql)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.explained[key]; ok && now.Sub(last) < explainInterval {
+		return false
+	}
+	select {
+	case l.explaining <- struct{}{}:
+	default:
+		return false
+	}
+	for k, last := range l.explained {
+		if now.Sub(last) >= explainInterval {
+			delete(l.explained, k)
+		}
+	}
+	l.explained[key] = now
+	return true
+}
+
+// capturePlan explains a slow query, with ANALYZE if analyze, and frees
+// its slot of explaining. It goes through database/sql rather than gorm
+// so its own duration doesn't come back to the hook.
+func (l *slowQueryLog) capturePlan(q *SlowQuery, vars []interface{}, analyze bool) {
+	defer func() { <-l.explaining }()
+	ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+	defer cancel()
+	// EXPLAIN ANALYZE runs the statement again, in a read-only
+	// transaction that is rolled back
+	tx, err := l.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		slog.Warn("explaining slow query failed", "error", err)
+		return
+	}
+	defer tx.Rollback()
+	stmt := "EXPLAIN "
+	if analyze {
+		stmt = "EXPLAIN ANALYZE "
+	}
+	rows, err := tx.QueryContext(ctx, stmt+q.SQL, vars...)
+	if err != nil {
+		slog.Warn("explaining slow query failed", "error", err)
+		return
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			slog.Warn("explaining slow query failed", "error", err)
+			return
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Warn("explaining slow query failed", "error", err)
+		return
+	}
+	l.mu.Lock()
+	q.Plan = strings.Join(lines, "\n")
+	l.mu.Unlock()
+}
+
+// latest returns copies of the kept queries, newest first
+func (l *slowQueryLog) latest() []SlowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queries := make([]SlowQuery, 0, len(l.queries))
+	for i := len(l.queries) - 1; i >= 0; i-- {
+		queries = append(queries, *l.queries[i])
+	}
+	return queries
+}
+
+// sideEffects matches reads that lock rows or call functions with
+// effects, which EXPLAIN ANALYZE would run again
+var sideEffects = regexp.MustCompile(`(?i)\bFOR\s+(NO\s+KEY\s+)?(UPDATE|SHARE|KEY\s+SHARE)\b|` +
+	`\b(pg_advisory\w*|pg_try_advisory\w*|nextval|setval|set_config|pg_notify)\s*\(`)
+
+// explainable tells whether a statement can be explained, and whether
+// with ANALYZE: only plain reads are run again, writes and the reads
+// of sideEffects only get their estimated plan.
+func explainable(sql string) (explain, analyze bool) {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return false, false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT":
+		return true, !sideEffects.MatchString(sql)
+	case "INSERT", "UPDATE", "DELETE", "WITH":
+		return true, false
+	}
+	return false, false
+}
+
+// fingerprint identifies a statement whatever its spacing; parameters
+// are placeholders, so it is the same for every call
+func fingerprint(sql string) string {
+	return strings.Join(strings.Fields(sql), " ")
+}
+
+// LogSlowQueries logs database operations that take threshold or longer,
+// without their parameters, and keeps the latest for SlowQueries. With
+// explain, their plans are captured too, within the limits of
+// explainConcurrency and explainInterval: reads with EXPLAIN ANALYZE,
+// which runs them a second time, and writes with EXPLAIN. It should be
+// called once, at startup, after SetLogLevel; a zero threshold logs
+// nothing. Below the warn log level, slow queries are only kept.
+func (s *Services) LogSlowQueries(threshold time.Duration, explain bool) {
+	if threshold <= 0 {
+		return
+	}
+	quiet := s.logLevel == DBLogSilent || s.logLevel == DBLogError
+	s.slow = &slowQueryLog{
+		db:         s.db.DB(),
+		threshold:  threshold,
+		explain:    explain,
+		quiet:      quiet,
+		explaining: make(chan struct{}, explainConcurrency),
+		explained:  make(map[string]time.Time),
+	}
+	s.hooks.add(s.slow.hook)
+}
+
+// SlowQueries returns the latest slow queries, newest first, or none if
+// slow queries are not logged
+func (s *Services) SlowQueries() []SlowQuery {
+	if s.slow == nil {
+		return nil
+	}
+	return s.slow.latest()
+}
+
+// Levels of SetLogLevel, from the quietest
+const (
+	DBLogSilent = "silent"
+	DBLogError  = "error"
+	DBLogWarn   = "warn"
+	DBLogInfo   = "info"
+)
+
+// SetLogLevel sets what the database layer logs, through slog: nothing
+// with DBLogSilent, failed operations with DBLogError, also slow queries
+// with DBLogWarn, the default, and every query with DBLogInfo. It is
+// meant to be called at startup, before LogSlowQueries.
+func (s *Services) SetLogLevel(level string) error {
+	switch level {
+	case DBLogSilent:
+		s.db.LogMode(false)
+		s.prepared.LogMode(false)
+	case DBLogError, DBLogWarn:
+	case DBLogInfo:
+		s.db.LogMode(true)
+		s.prepared.LogMode(true)
+	default:
+		return fmt.Errorf("models: unknown database log level %q", level)
+	}
+	s.logLevel = level
+	return nil
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExplainable(t *testing.T) {
+	for _, c := range []struct {
+		sql              string
+		explain, analyze bool
+	}{
+		{`SELECT * FROM "users" WHERE (email = $1)`, true, true},
+		{"  select count(*) from stocklists", true, true},
+		{`SELECT * FROM "stocklists" WHERE id = $1 FOR UPDATE`, true, false},
+		{`SELECT * FROM jobs FOR NO KEY UPDATE SKIP LOCKED`, true, false},
+		{`SELECT * FROM users FOR SHARE`, true, false},
+		{"SELECT pg_advisory_xact_lock($1)", true, false},
+		{"SELECT pg_try_advisory_lock($1)", true, false},
+		{"SELECT nextval('users_id_seq')", true, false},
+		{"SELECT set_config($1, $2, true)", true, false},
+		{`INSERT INTO "users" ("email") VALUES ($1)`, true, false},
+		{`UPDATE "users" SET "name" = $1`, true, false},
+		{`DELETE FROM "sessions" WHERE expires_at < $1`, true, false},
+		{"WITH moved AS (DELETE FROM a RETURNING *) INSERT INTO b SELECT * FROM moved", true, false},
+		{"CREATE INDEX CONCURRENTLY idx ON users (email)", false, false},
+		{"BEGIN", false, false},
+		{"", false, false},
+	} {
+		explain, analyze := explainable(c.sql)
+		if explain != c.explain || analyze != c.analyze {
+			t.Errorf("explainable(%q) = %t, %t, want %t, %t",
+				c.sql, explain, analyze, c.explain, c.analyze)
+		}
+	}
+}
+
+func TestStartExplain(t *testing.T) {
+	l := &slowQueryLog{
+		explaining: make(chan struct{}, explainConcurrency),
+		explained:  make(map[string]time.Time),
+	}
+	now := time.Now()
+
+	// A statement is explained once per explainInterval, whatever its
+	// spacing
+	if !l.startExplain("SELECT * FROM users", now) {
+		t.Fatal("the first slow query wasn't explained")
+	}
+	<-l.explaining
+	if l.startExplain("SELECT *\n\tFROM users", now.Add(time.Minute)) {
+		t.Error("the same statement was explained again within the interval")
+	}
+	if !l.startExplain("SELECT * FROM users", now.Add(explainInterval)) {
+		t.Error("the statement wasn't explained again after the interval")
+	}
+	<-l.explaining
+
+	// At most explainConcurrency plans are captured at once
+	for i := 0; i < explainConcurrency; i++ {
+		if !l.startExplain("SELECT "+string(rune('a'+i)), now) {
+			t.Fatalf("plan %d wasn't started", i)
+		}
+	}
+	if l.startExplain("SELECT z", now) {
+		t.Error("a plan was started with every slot taken")
+	}
+	<-l.explaining
+	if !l.startExplain("SELECT z", now) {
+		t.Error("a plan wasn't started once a slot was free")
+	}
+
+	// Fingerprints older than the interval are forgotten
+	<-l.explaining
+	if !l.startExplain("SELECT late", now.Add(2*explainInterval)) {
+		t.Fatal("a later plan wasn't started")
+	}
+	if len(l.explained) != 1 {
+		t.Errorf("%d fingerprints kept, want only the recent one", len(l.explained))
+	}
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPreparedStatements caps the statements a stmtCache keeps. Only the
+// hot lookups go through it, so this is only reached if their SQL stops
+// being constant, e.g. by listing values inline.
+const maxPreparedStatements = 64
+
+// stmtCache is a gorm.SQLCommon that prepares each query the first time
+// it runs and reuses the statement afterwards, sparing Postgres parsing
+// and planning it again. database/sql prepares a statement on each
+// connection as it is first used there, and again after reconnecting.
+//
+// Prepared statements break behind poolers in transaction mode, such as
+// PgBouncer, so the cache can be disabled, passing queries through.
+type stmtCache struct {
+	db       *sql.DB
+	disabled atomic.Bool
+	mu       sync.RWMutex
+	stmts    map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// stmt returns the prepared statement of query, or nil if the cache is
+// disabled, full, or the statement can't be prepared; callers then run
+// the query unprepared, which also reports any error in it
+func (c *stmtCache) stmt(query string) *sql.Stmt {
+	if c.disabled.Load() {
+		return nil
+	}
+	c.mu.RLock()
+	st, ok := c.stmts[query]
+	c.mu.RUnlock()
+	if ok {
+		return st
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, ok := c.stmts[query]; ok {
+		return st
+	}
+	if len(c.stmts) >= maxPreparedStatements {
+		return nil
+	}
+	st, err := c.db.Prepare(query)
+	if err != nil {
+		return nil
+	}
+	c.stmts[query] = st
+	return st
+}
+
+// setEnabled turns the cache on or off. Turning it off closes the
+// statements, releasing them on the server.
+func (c *stmtCache) setEnabled(on bool) {
+	c.disabled.Store(!on)
+	if !on {
+		c.Close()
+	}
+}
+
+// Len returns how many statements are prepared
+func (c *stmtCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.stmts)
+}
+
+// Close closes every statement, keeping the cache usable
+func (c *stmtCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var first error
+	for q, st := range c.stmts {
+		if err := st.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(c.stmts, q)
+	}
+	return first
+}
+
+func (c *stmtCache) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if st := c.stmt(query); st != nil {
+		return st.Exec(args...)
+	}
+	return c.db.Exec(query, args...)
+}
+
+func (c *stmtCache) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.Prepare(query)
+}
+
+func (c *stmtCache) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if st := c.stmt(query); st != nil {
+		return st.Query(args...)
+	}
+	return c.db.Query(query, args...)
+}
+
+func (c *stmtCache) QueryRow(query string, args ...interface{}) *sql.Row {
+	if st := c.stmt(query); st != nil {
+		return st.QueryRow(args...)
+	}
+	return c.db.QueryRow(query, args...)
+}
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Stocklist is a named list of stocks owned by a user, or by the
+// organization in OrganizationID, stored in the stocklists database.
+type Stocklist struct {
+	gorm.Model
+	// UserID is the owner of a personal stocklist, and whoever created
+	// the stocklist of an organization
+	UserID uint `gorm:"not null"` // idx_stocklists_user_id, see indexes
+	// OrganizationID is set on stocklists owned by a team, which its
+	// members share according to their roles
+	OrganizationID *uint  // idx_stocklists_organization_id, see indexes
+	Name           string `gorm:"not null"`
+	// Version is incremented by every update, which fails with
+	// ErrConflict if the stocklist changed since it was read
+	Version uint `gorm:"not null;default:1"`
+	// Public lists the stocklist on its owner's public profile
+	Public bool `gorm:"not null;default:false"`
+}
+
+// StocklistDB is an interface that can interact with the stocklists database.
+//
+// For single stocklist queries:
+// stocklist found returns nil error;
+// stocklist not found returns ErrNotFound;
+// other errors may also be returned if they arise.
+type StocklistDB interface {
+	//Query methods
+	ByID(id uint)         (*Stocklist, error)
+	// ByUserID and EachByUserID return a user's personal stocklists,
+	// not those they created for an organization
+	ByUserID(userID uint) ([]Stocklist, error)
+	// EachByUserID calls fn with each of a user's stocklists in ID order,
+	// reading them one at a time instead of loading them all. It stops
+	// at the first error fn returns and returns it.
+	EachByUserID(userID uint, fn func(*Stocklist) error) error
+	ByOrganizationID(orgID uint) ([]Stocklist, error)
+	// ByIDs returns the stocklists with the given IDs that weren't
+	// deleted, in ID order
+	ByIDs(ids []uint) ([]Stocklist, error)
+
+	//Edit methods
+	Create(stocklist *Stocklist) error
+	Update(stocklist *Stocklist) error
+	Delete(id uint)              error
+}
+
+// stocklistGorm is the database interaction layer
+// implementing the StocklistDB interface.
+type stocklistGorm struct {
+	db *gorm.DB
+}
+
+var _ StocklistDB = &stocklistGorm{}
+
+// NewStocklistDB returns the gorm implementation of StocklistDB.
+func NewStocklistDB(db *gorm.DB) StocklistDB {
+	return &stocklistGorm{db}
+}
+
+// StocklistService wraps the StocklistDB implementation and validates
+// stocklists before they are written to the database.
+type StocklistService struct {
+	StocklistDB
+	orgs *OrganizationService
+	subs *SubscriptionService
+	// rls scopes the services AsTenant returns, see
+	// Services.SetRowLevelSecurity
+	rls bool
+}
+
+//
+// 1. StocklistService methods and related functions
+//
+
+// NewStocklistService instantiates a StocklistService on a database
+// connection.
+func NewStocklistService(db *gorm.DB) *StocklistService {
+	return &StocklistService {
+		StocklistDB: &stocklistGorm{db},
+	}
+}
+
+// Errors returned when a stocklist fails validation
+var (
+	// ErrUserIDRequired is returned when a stocklist has no owner.
+	ErrUserIDRequired = errors.New("models: user ID is required")
+
+	// ErrNameRequired is returned when a stocklist has an empty name.
+	ErrNameRequired = errors.New("models: name is required")
+
+	// ErrConflict is returned when updating a record that was changed by
+	// someone else since it was read.
+	ErrConflict = errors.New("models: the record was changed by someone else")
+)
+
+// validate checks that a stocklist has an owner and a name
+func (ss *StocklistService) validate(stocklist *Stocklist) error {
+	if stocklist.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	if stocklist.Name == "" {
+		return ErrNameRequired
+	}
+	return nil
+}
+
+// Create validates a stocklist and passes it on to the database layer,
+// unless its owner's plan doesn't allow more stocklists.
+func (ss *StocklistService) Create(stocklist *Stocklist) error {
+	if err := ss.validate(stocklist); err != nil {
+		return err
+	}
+	if err := ss.checkQuota(stocklist); err != nil {
+		return err
+	}
+	stocklist.Version = 1
+	return ss.StocklistDB.Create(stocklist)
+}
+
+// Update validates a stocklist and passes it on to the database layer.
+func (ss *StocklistService) Update(stocklist *Stocklist) error {
+	if err := ss.validate(stocklist); err != nil {
+		return err
+	}
+	return ss.StocklistDB.Update(stocklist)
+}
+
+// exportFlushRows is how many CSV rows ExportCSV buffers before writing
+// them out
+const exportFlushRows = 100
+
+// ExportCSV writes a user's stocklists to w as CSV, with a header row.
+// Rows are streamed from the database and written out every
+// exportFlushRows, so memory use doesn't grow with the number of
+// stocklists.
+func (ss *StocklistService) ExportCSV(w io.Writer, userID uint) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "name", "version", "created_at", "updated_at"}); err != nil {
+		return err
+	}
+	n := 0
+	err := ss.EachByUserID(userID, func(s *Stocklist) error {
+		err := cw.Write([]string{
+			strconv.FormatUint(uint64(s.ID), 10),
+			s.Name,
+			strconv.FormatUint(uint64(s.Version), 10),
+			s.CreatedAt.UTC().Format(time.RFC3339),
+			s.UpdatedAt.UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+		if n++; n%exportFlushRows == 0 {
+			cw.Flush()
+			return cw.Error()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//
+// 2. StocklistDB methods
+//
+
+// Create writes a stocklist to the database, and the change to the
+// changelog.
+func (sg *stocklistGorm) Create(stocklist *Stocklist) error {
+	return inTransaction(sg.db, func(tx *gorm.DB) error {
+		if err := tx.Create(stocklist).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, stocklist, ChangeCreate)
+	})
+}
+
+// Update saves the provided stocklist and increments its version, as long
+// as the version in the database is still the one that was read;
+// otherwise it returns ErrConflict.
+func (sg *stocklistGorm) Update(stocklist *Stocklist) error {
+	return inTransaction(sg.db, func(tx *gorm.DB) error {
+		db := tx.Model(stocklist).Where("version = ?", stocklist.Version).
+			Updates(map[string]interface{}{
+				"name":    stocklist.Name,
+				"public":  stocklist.Public,
+				"version": stocklist.Version + 1,
+			})
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected == 0 {
+			return ErrConflict
+		}
+		return recordChange(tx, stocklist, ChangeUpdate)
+	})
+}
+
+// Delete deletes the stocklist with the provided ID
+func (sg *stocklistGorm) Delete(id uint) error {
+	if id == 0 {
+		return ErrInvalidID
+	}
+	return inTransaction(sg.db, func(tx *gorm.DB) error {
+		var stocklist Stocklist
+		err := first(tx.Where("id = ?", id), &stocklist)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&stocklist).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, &stocklist, ChangeDelete)
+	})
+}
+
+// ByID looks up a stocklist with the provided ID and returns it.
+// Error returns are the same as userGorm.ByID.
+func (sg *stocklistGorm) ByID(id uint) (*Stocklist, error) {
+	var stocklist Stocklist
+	db := sg.db.Where("id = ?", id)
+	err := first(db, &stocklist)
+	if err != nil {
+		return nil, err
+	}
+	return &stocklist, nil
+}
+
+// ByUserID returns all the personal stocklists of a user.
+func (sg *stocklistGorm) ByUserID(userID uint) ([]Stocklist, error) {
+	var stocklists []Stocklist
+	err := sg.db.Where("user_id = ? AND organization_id IS NULL", userID).
+		Find(&stocklists).Error
+	if err != nil {
+		return nil, err
+	}
+	return stocklists, nil
+}
+
+// ByOrganizationID returns all the stocklists of an organization, in ID
+// order.
+func (sg *stocklistGorm) ByOrganizationID(orgID uint) ([]Stocklist, error) {
+	var stocklists []Stocklist
+	err := sg.db.Where("organization_id = ?", orgID).Order("id").Find(&stocklists).Error
+	if err != nil {
+		return nil, err
+	}
+	return stocklists, nil
+}
+
+// ByIDs looks up several stocklists with one query
+func (sg *stocklistGorm) ByIDs(ids []uint) ([]Stocklist, error) {
+	var stocklists []Stocklist
+	if len(ids) == 0 {
+		return stocklists, nil
+	}
+	err := sg.db.Where("id IN (?)", ids).Order("id").Find(&stocklists).Error
+	if err != nil {
+		return nil, err
+	}
+	return stocklists, nil
+}
+
+// EachByUserID iterates over a user's stocklists with a database cursor
+func (sg *stocklistGorm) EachByUserID(userID uint, fn func(*Stocklist) error) error {
+	rows, err := sg.db.Model(&Stocklist{}).Where("user_id = ? AND organization_id IS NULL", userID).
+		Order("id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Stocklist
+		if err := sg.db.ScanRows(rows, &s); err != nil {
+			return err
+		}
+		if err := fn(&s); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
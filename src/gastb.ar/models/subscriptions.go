@@ -0,0 +1,162 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gastb.ar/billing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Subscription is the Stripe subscription of a user, as last reported by
+// Stripe's webhook. Users without one, or whose subscription isn't
+// active, are on the default plan.
+type Subscription struct {
+	gorm.Model
+	UserID               uint   `gorm:"not null;unique_index"`
+	Plan                 string `gorm:"not null"`
+	Status               string `gorm:"not null"`
+	StripeCustomerID     string
+	StripeSubscriptionID string `gorm:"index"`
+	CurrentPeriodEnd     time.Time
+	// EventAt is when the latest Stripe event applied was created.
+	// Stripe doesn't deliver events in order, so older ones are ignored.
+	EventAt time.Time
+}
+
+// Active reports whether a subscription is paid for, or still in the
+// grace period of a failed payment
+func (s *Subscription) Active() bool {
+	return activeStatus(s.Status)
+}
+
+func activeStatus(status string) bool {
+	switch status {
+	case "active", "trialing", "past_due":
+		return true
+	}
+	return false
+}
+
+// ErrQuotaExceeded is returned when creating a stocklist over the limit
+// of the user's plan
+var ErrQuotaExceeded = errors.New("models: your plan doesn't allow more stocklists, upgrade to add more")
+
+// SubscriptionService keeps the subscriptions of users and tells which
+// plan they are on.
+type SubscriptionService struct {
+	db    *gorm.DB
+	plans billing.Config
+}
+
+// NewSubscriptionService instantiates a SubscriptionService on a
+// database connection. Until plans are set, everyone is on an unlimited
+// plan.
+func NewSubscriptionService(db *gorm.DB) *SubscriptionService {
+	return &SubscriptionService{
+		db: db,
+	}
+}
+
+// SetPlans sets the plans users can be on
+func (ss *SubscriptionService) SetPlans(plans billing.Config) {
+	ss.plans = plans
+}
+
+// ByUserID returns the subscription of a user, or ErrNotFound if they
+// never had one.
+func (ss *SubscriptionService) ByUserID(userID uint) (*Subscription, error) {
+	var sub Subscription
+	if err := first(ss.db.Where("user_id = ?", userID), &sub); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// PlanFor returns the plan of a user: that of their subscription while
+// it is active, the default plan otherwise.
+func (ss *SubscriptionService) PlanFor(userID uint) (billing.Plan, error) {
+	sub, err := ss.ByUserID(userID)
+	if err == ErrNotFound {
+		return ss.plans.Plan(""), nil
+	}
+	if err != nil {
+		return billing.Plan{}, err
+	}
+	if !sub.Active() {
+		return ss.plans.Plan(""), nil
+	}
+	return ss.plans.Plan(sub.Plan), nil
+}
+
+// Apply records the state of a Stripe subscription reported by an event
+// created at a given time. The plan is the one sold at the
+// subscription's price, which changes when users switch plans in Stripe,
+// or else the one it was bought as. Events older than the last one
+// applied, and events ending a subscription the user has since
+// replaced, are ignored.
+func (ss *SubscriptionService) Apply(sub *billing.Subscription, at time.Time) error {
+	userID := sub.UserID
+	var existing Subscription
+	var err error
+	if userID != 0 {
+		err = first(ss.db.Where("user_id = ?", userID), &existing)
+	} else {
+		err = first(ss.db.Where("stripe_subscription_id = ?", sub.ID), &existing)
+		userID = existing.UserID
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err == ErrNotFound && userID == 0 {
+		// A subscription not bought through the site
+		return nil
+	}
+	if err == nil {
+		if existing.EventAt.After(at) {
+			return nil
+		}
+		if existing.StripeSubscriptionID != sub.ID && existing.Active() && !activeStatus(sub.Status) {
+			return nil
+		}
+	}
+	plan := sub.Plan
+	if p, ok := ss.plans.PlanForPrice(sub.Price); ok {
+		plan = p.Name
+	}
+	existing.UserID = userID
+	existing.Plan = plan
+	existing.Status = sub.Status
+	existing.StripeCustomerID = sub.Customer
+	existing.StripeSubscriptionID = sub.ID
+	existing.CurrentPeriodEnd = sub.CurrentPeriodEnd
+	existing.EventAt = at
+	return ss.db.Save(&existing).Error
+}
+
+// SetSubscriptions limits the stocklists users can have to what their
+// plan allows. Stocklists of organizations don't count.
+func (ss *StocklistService) SetSubscriptions(subs *SubscriptionService) {
+	ss.subs = subs
+}
+
+// checkQuota returns ErrQuotaExceeded if a new personal stocklist would
+// be over the limit of its owner's plan
+func (ss *StocklistService) checkQuota(stocklist *Stocklist) error {
+	if ss.subs == nil || stocklist.OrganizationID != nil {
+		return nil
+	}
+	plan, err := ss.subs.PlanFor(stocklist.UserID)
+	if err != nil || plan.MaxStocklists == 0 {
+		return err
+	}
+	stocklists, err := ss.ByUserID(stocklist.UserID)
+	if err != nil {
+		return err
+	}
+	if len(stocklists) >= plan.MaxStocklists {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package models
+
+import (
+	"gastb.ar/log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// tenantSetting is the Postgres setting holding the ID of the user whose
+// request a transaction runs for, which row level security policies
+// compare rows to
+const tenantSetting = "app.tenant_id"
+
+// bypassSetting is the Postgres setting letting a session through the
+// policies when it is on. Only admin connections set it, see
+// Services.SetAdminConnection and gastbctl; the site's own connections
+// don't, so that a query run outside asTenant only reaches public rows.
+const bypassSetting = "app.bypass_rls"
+
+// tenantPolicies are the row level security policies of the tables
+// holding tenant data, keyed by table. A row passes if it is one the
+// tenant can see, the same as visibleTo, or if the bypass is on. They
+// fail closed: a session with neither sees no rows.
+var tenantPolicies = map[string]string{
+	"stocklists": `current_setting('` + bypassSetting + `', true) = 'on'
+		OR (user_id = NULLIF(current_setting('` + tenantSetting + `', true), '')::integer
+			AND organization_id IS NULL)
+		OR organization_id IN (SELECT organization_id FROM memberships
+			WHERE user_id = NULLIF(current_setting('` + tenantSetting + `', true), '')::integer)`,
+}
+
+// publicPolicies let any session read the rows of a table matching a
+// condition, such as public stocklists for profiles, without writing
+// them
+var publicPolicies = map[string]string{
+	"stocklists": "public",
+}
+
+// SetRowLevelSecurity turns tenant isolation by row level security on or
+// off; it is off by default. AutoMigrate then creates or drops the
+// policies, and the services run the queries of a user as their tenant,
+// so that a missing ownership check finds nothing instead of another
+// user's stocklist. Work spanning tenants needs an admin connection, see
+// SetAdminConnection. It is meant to be called at startup, before
+// AutoMigrate.
+func (s *Services) SetRowLevelSecurity(on bool) {
+	s.rls = on
+	s.StocklistService.rls = on
+	s.SearchService.rls = on
+	s.PreferenceService.rls = on
+	s.UserPurgeService.rls = on
+	s.UserService.guests.rls = on
+}
+
+// SetAdminConnection connects the migrations and the counts of Stats,
+// which span tenants, with their own pool, whose connection info should
+// turn the bypass on, as config.PostgresConfig.AdminConnectionInfo
+// does. Without it, they use the site's connections. It is meant to be
+// called at startup, before AutoMigrate.
+func (s *Services) SetAdminConnection(connectionInfo string) error {
+	sqlDB, err := openDB(connectionInfo)
+	if err != nil {
+		return err
+	}
+	admin, _ := gorm.Open("postgres", sqlDB)
+	admin.SetLogger(log.GormLogger{})
+	registerCallbacks(admin, s.hooks)
+	// Only startup and the admin dashboard use it
+	admin.DB().SetMaxOpenConns(2)
+	if s.admin != s.db {
+		s.admin.Close()
+	}
+	s.admin = admin
+	return nil
+}
+
+// createPolicies enables row level security on the tables of
+// tenantPolicies with their policies, or disables it. FORCE applies the
+// policies to the role owning the tables, which the site connects as.
+func (s *Services) createPolicies() error {
+	for table, using := range tenantPolicies {
+		statements := []string{
+			"DROP POLICY IF EXISTS tenant_isolation ON " + table,
+			"DROP POLICY IF EXISTS public_read ON " + table,
+			"ALTER TABLE " + table + " NO FORCE ROW LEVEL SECURITY",
+			"ALTER TABLE " + table + " DISABLE ROW LEVEL SECURITY",
+		}
+		if s.rls {
+			statements = []string{
+				"DROP POLICY IF EXISTS tenant_isolation ON " + table,
+				"CREATE POLICY tenant_isolation ON " + table + " USING (" + using + ")",
+				"DROP POLICY IF EXISTS public_read ON " + table,
+				"ALTER TABLE " + table + " ENABLE ROW LEVEL SECURITY",
+				"ALTER TABLE " + table + " FORCE ROW LEVEL SECURITY",
+			}
+			if cond, ok := publicPolicies[table]; ok {
+				statements = append(statements, "CREATE POLICY public_read ON "+table+
+					" FOR SELECT USING ("+cond+")")
+			}
+		}
+		for _, stmt := range statements {
+			if err := s.admin.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// asTenant runs fn in a transaction whose connection has the tenant set
+// to userID and the bypass off. The settings are local to the
+// transaction, so the connection goes back to the pool without them, and
+// it works behind poolers in transaction mode too.
+func asTenant(db *gorm.DB, userID uint, fn func(tx *gorm.DB) error) error {
+	return inTransaction(db, func(tx *gorm.DB) error {
+		if err := setTenant(tx, userID); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// setTenant sets the tenant of the transaction tx to userID and turns
+// the bypass off, until it ends
+func setTenant(tx *gorm.DB, userID uint) error {
+	return tx.Exec("SELECT set_config(?, ?, true), set_config(?, 'off', true)",
+		tenantSetting, userID, bypassSetting).Error
+}
+
+// scoped calls fn with db as userID's tenant if rls is on, in a
+// transaction, and with db itself otherwise. It is for the services
+// whose queries reach tenant data outside of a StocklistDB.
+func scoped(db *gorm.DB, rls bool, userID uint, fn func(db *gorm.DB) error) error {
+	if !rls {
+		return fn(db)
+	}
+	return asTenant(db, userID, fn)
+}
+
+// tenantStocklists is a StocklistDB running every call as a tenant
+type tenantStocklists struct {
+	db     *gorm.DB
+	userID uint
+}
+
+var _ StocklistDB = &tenantStocklists{}
+
+// run calls fn with a StocklistDB in a transaction as the tenant
+func (ts *tenantStocklists) run(fn func(sg *stocklistGorm) error) error {
+	return asTenant(ts.db, ts.userID, func(tx *gorm.DB) error {
+		return fn(&stocklistGorm{tx})
+	})
+}
+
+func (ts *tenantStocklists) ByID(id uint) (stocklist *Stocklist, err error) {
+	err = ts.run(func(sg *stocklistGorm) error {
+		stocklist, err = sg.ByID(id)
+		return err
+	})
+	return stocklist, err
+}
+
+func (ts *tenantStocklists) ByUserID(userID uint) (stocklists []Stocklist, err error) {
+	err = ts.run(func(sg *stocklistGorm) error {
+		stocklists, err = sg.ByUserID(userID)
+		return err
+	})
+	return stocklists, err
+}
+
+func (ts *tenantStocklists) EachByUserID(userID uint, fn func(*Stocklist) error) error {
+	return ts.run(func(sg *stocklistGorm) error {
+		return sg.EachByUserID(userID, fn)
+	})
+}
+
+func (ts *tenantStocklists) ByOrganizationID(orgID uint) (stocklists []Stocklist, err error) {
+	err = ts.run(func(sg *stocklistGorm) error {
+		stocklists, err = sg.ByOrganizationID(orgID)
+		return err
+	})
+	return stocklists, err
+}
+
+func (ts *tenantStocklists) ByIDs(ids []uint) (stocklists []Stocklist, err error) {
+	err = ts.run(func(sg *stocklistGorm) error {
+		stocklists, err = sg.ByIDs(ids)
+		return err
+	})
+	return stocklists, err
+}
+
+func (ts *tenantStocklists) Create(stocklist *Stocklist) error {
+	return ts.run(func(sg *stocklistGorm) error { return sg.Create(stocklist) })
+}
+
+func (ts *tenantStocklists) Update(stocklist *Stocklist) error {
+	return ts.run(func(sg *stocklistGorm) error { return sg.Update(stocklist) })
+}
+
+func (ts *tenantStocklists) Delete(id uint) error {
+	return ts.run(func(sg *stocklistGorm) error { return sg.Delete(id) })
+}
+
+// AsTenant returns the service as seen by a user: with row level
+// security on, its queries only reach the stocklists the user can see.
+// Otherwise, or on top of another StocklistDB than the database's, it
+// returns ss itself.
+func (ss *StocklistService) AsTenant(userID uint) *StocklistService {
+	sg, ok := ss.StocklistDB.(*stocklistGorm)
+	if !ss.rls || !ok {
+		return ss
+	}
+	scoped := *ss
+	scoped.StocklistDB = &tenantStocklists{db: sg.db, userID: userID}
+	return &scoped
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ImportRow is a user to create or invite, read from an import file
+type ImportRow struct {
+	// Line is where the row is in the file, for reports
+	Line  int
+	Email string
+	Name  string
+	// Role is RoleUser or RoleAdmin; empty means RoleUser
+	Role string
+}
+
+// What an import does with a row
+const (
+	ImportCreate = "create"
+	ImportInvite = "invite"
+	// ImportSkip is for addresses that already have an account
+	ImportSkip = "skip"
+	// ImportInvalid is for rows that can't be imported; their Err says
+	// why
+	ImportInvalid = "invalid"
+)
+
+// ImportResult is what an import does, or would do, with a row. After a
+// real import, User or Invite is set for created and invited rows.
+type ImportResult struct {
+	Row    ImportRow
+	Action string
+	Err    error
+	User   *User
+	Invite *Invite
+}
+
+var (
+	// ErrRoleInvalid is returned for roles other than user and admin
+	ErrRoleInvalid = errors.New("models: role must be user or admin")
+
+	// ErrInviteRole is returned when inviting with the admin role, which
+	// invites can't carry
+	ErrInviteRole = errors.New("models: invites can't grant the admin role")
+)
+
+// CheckImport validates import rows and tells what importing them would
+// do: the email address must be well formed and not repeated in the
+// file, and the role known. Rows whose address has an account already
+// are skipped. With invite, rows are invited rather than created.
+func (s *Services) CheckImport(rows []ImportRow, invite bool) ([]ImportResult, error) {
+	results := make([]ImportResult, 0, len(rows))
+	seen := make(map[string]int)
+	for _, row := range rows {
+		row.Email = strings.ToLower(strings.TrimSpace(row.Email))
+		row.Role = strings.ToLower(strings.TrimSpace(row.Role))
+		res := ImportResult{Row: row, Action: ImportCreate}
+		if invite {
+			res.Action = ImportInvite
+		}
+		first, dup := seen[row.Email]
+		switch {
+		case row.Email == "":
+			res.Err = ErrEmailRequired
+		case !emailRegex.MatchString(row.Email):
+			res.Err = ErrEmailInvalid
+		case dup:
+			res.Err = fmt.Errorf("models: email address is repeated from line %d", first)
+		case row.Role != "" && row.Role != RoleUser && row.Role != RoleAdmin:
+			res.Err = ErrRoleInvalid
+		case invite && row.Role == RoleAdmin:
+			res.Err = ErrInviteRole
+		}
+		if row.Email != "" && !dup {
+			seen[row.Email] = row.Line
+		}
+		if res.Err != nil {
+			res.Action = ImportInvalid
+			results = append(results, res)
+			continue
+		}
+		_, err := s.UserService.db.ByEmail(row.Email)
+		switch err {
+		case nil:
+			res.Action = ImportSkip
+		case ErrNotFound:
+		default:
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Import creates or invites the rows of results checked by CheckImport,
+// batchSize rows per transaction. Created users get a random password,
+// so they sign in by resetting it or with single sign-on, and no emails.
+// A failed batch is rolled back and stops the import; the error says how
+// many rows were imported before it.
+func (s *Services) Import(results []ImportResult, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = len(results)
+	}
+	done := 0
+	for start := 0; start < len(results); start += batchSize {
+		end := start + batchSize
+		if end > len(results) {
+			end = len(results)
+		}
+		batch := results[start:end]
+		tx := s.db.Begin()
+		if tx.Error != nil {
+			return tx.Error
+		}
+		n, err := s.importBatch(tx, batch)
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			for i := range batch {
+				batch[i].User, batch[i].Invite = nil, nil
+			}
+			return fmt.Errorf("models: import stopped after %d rows: %w", done, err)
+		}
+		done += n
+	}
+	return nil
+}
+
+// importBatch imports rows through services on the transaction tx and
+// returns how many it created or invited
+func (s *Services) importBatch(tx *gorm.DB, batch []ImportResult) (int, error) {
+	us := s.UserService.withDB(tx)
+	is := s.InviteService.withDB(tx)
+	n := 0
+	for i := range batch {
+		res := &batch[i]
+		switch res.Action {
+		case ImportCreate:
+			password, err := rand.String(24)
+			if err != nil {
+				return n, err
+			}
+			user := &User{Email: res.Row.Email, Name: res.Row.Name,
+				Role: res.Row.Role, Password: password}
+			if err := us.Create(user); err != nil {
+				return n, fmt.Errorf("line %d: %w", res.Row.Line, err)
+			}
+			res.User = user
+		case ImportInvite:
+			invite, err := is.Create(0, res.Row.Email)
+			if err != nil {
+				return n, fmt.Errorf("line %d: %w", res.Row.Line, err)
+			}
+			res.Invite = invite
+		default:
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// withDB returns a copy of the service running on db, such as a
+// transaction. The copy sends no emails, since the transaction may be
+// rolled back.
+func (us *UserService) withDB(db *gorm.DB) *UserService {
+	c := *us
+	c.db = &userGorm{db: db}
+	c.tokens = &userTokenGorm{db}
+	c.codes = &verificationCodeGorm{db}
+	c.devices = &userDeviceGorm{db}
+	c.sessions = &sessionGorm{db}
+	c.history = &passwordHistoryGorm{db}
+	c.merges = &userMergeGorm{db}
+	c.audit = NewAuditService(db)
+	c.purges = &userPurgeGorm{db}
+	c.guests = &guestGorm{db: db, rls: us.guests.rls}
+	c.mailer = nil
+	return &c
+}
+
+// withDB returns a copy of the service running on db, such as a
+// transaction
+func (is *InviteService) withDB(db *gorm.DB) *InviteService {
+	c := *is
+	c.db = db
+	return &c
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrMergeSame is returned when merging a user into themselves
+var ErrMergeSame = errors.New("models: can't merge a user into themselves")
+
+// Merge moves what a duplicate account owns to the primary one and
+// deletes the duplicate, for people who signed up twice. Stocklists, API
+// keys, webhooks and invites move over; the duplicate's sessions end and
+// its pending email tokens, codes and known devices are dropped. Settings
+// kept once per user move only if the primary account has none.
+//
+// The primary account keeps its email address. The duplicate's is
+// released, so it can be added back to the primary account later, and
+// kept in the audit entry recording the merge. Everything happens in one
+// transaction.
+func (us *UserService) Merge(primaryID, duplicateID uint) error {
+	if primaryID == duplicateID {
+		return ErrMergeSame
+	}
+	primary, err := us.db.ByID(primaryID)
+	if err != nil {
+		return err
+	}
+	duplicate, err := us.db.ByID(duplicateID)
+	if err != nil {
+		return err
+	}
+	return us.merges.merge(primary, duplicate)
+}
+
+// userMergeGorm moves records between users
+type userMergeGorm struct {
+	db *gorm.DB
+}
+
+// merge moves the records of duplicate to primary and deletes duplicate
+// in a transaction, recording it in the audit log
+func (mg *userMergeGorm) merge(primary, duplicate *User) error {
+	tx := mg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	moved, err := mg.move(tx, primary.ID, duplicate.ID)
+	if err == nil {
+		// Deleting releases the email address and username, which are
+		// only unique among users that weren't deleted
+		err = tx.Delete(&User{Model: gorm.Model{ID: duplicate.ID}}).Error
+	}
+	if err == nil {
+		err = tx.Create(&AuditEntry{
+			UserID: primary.ID,
+			Action: AuditUserMerge,
+			Detail: fmt.Sprintf("merged user %d (%s) into %d (%s): %s",
+				duplicate.ID, duplicate.Email, primary.ID, primary.Email,
+				strings.Join(moved, ", ")),
+		}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// move reassigns the records of a user to another, returning how many
+// of each kind moved
+func (mg *userMergeGorm) move(tx *gorm.DB, to, from uint) ([]string, error) {
+	var moved []string
+	// The primary's clients sync the stocklists they get
+	if err := recordMoves(tx, from, to); err != nil {
+		return nil, err
+	}
+	// Records a user can have any number of
+	owned := []struct {
+		name   string
+		model  interface{}
+		column string
+	}{
+		{"stocklists", &Stocklist{}, "user_id"},
+		{"API keys", &APIKey{}, "user_id"},
+		{"API usage days", &APIUsage{}, "user_id"},
+		{"webhooks", &Webhook{}, "user_id"},
+		{"invites created", &Invite{}, "created_by"},
+		{"invites used", &Invite{}, "used_by"},
+		{"referrals", &Referral{}, "referrer_id"},
+		{"organization invites sent", &OrgInvite{}, "invited_by"},
+	}
+	for _, o := range owned {
+		res := tx.Unscoped().Model(o.model).Where(o.column+" = ?", from).
+			UpdateColumn(o.column, to)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		moved = append(moved, fmt.Sprintf("%d %s", res.RowsAffected, o.name))
+	}
+	// Records kept once per user, moved unless the primary has its own
+	for _, m := range []interface{}{&DigestSubscription{}, &CalendarFeed{},
+		&NotificationSettings{}, &UserPreference{}, &ProfileSettings{},
+		&ReferralCode{}, &Referral{}, &Subscription{}} {
+		table := tx.NewScope(m).TableName()
+		err := tx.Exec(fmt.Sprintf("UPDATE %s SET user_id = ? WHERE user_id = ? "+
+			"AND NOT EXISTS (SELECT 1 FROM %s WHERE user_id = ?)", table, table),
+			to, from, to).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Memberships, moved to organizations the primary isn't a member of;
+	// in the others, the primary keeps its role, or becomes an owner if
+	// the duplicate was one
+	err := tx.Exec("UPDATE memberships SET user_id = ? WHERE user_id = ? "+
+		"AND organization_id NOT IN (SELECT organization_id FROM memberships WHERE user_id = ?)",
+		to, from, to).Error
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Exec("UPDATE memberships SET role = ? WHERE user_id = ? AND organization_id IN "+
+		"(SELECT organization_id FROM memberships WHERE user_id = ? AND role = ?)",
+		OrgRoleOwner, to, from, OrgRoleOwner).Error
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Where("user_id = ?", from).Delete(&Membership{}).Error; err != nil {
+		return nil, err
+	}
+	// Records only meaningful to the duplicate account
+	for _, m := range []interface{}{&DigestSubscription{}, &CalendarFeed{},
+		&NotificationSettings{}, &UserPreference{}, &ProfileSettings{},
+		&ReferralCode{}, &Referral{}, &Subscription{},
+		&UserToken{}, &VerificationCode{}, &Device{}, &Session{},
+		&PasswordHistory{}, &IdempotencyKey{}} {
+		if err := tx.Unscoped().Where("user_id = ?", from).Delete(m).Error; err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Where("user_id = ? AND organization_id IS NULL", from).Delete(&Change{}).Error
+	if err != nil {
+		return nil, err
+	}
+	return moved, nil
+}
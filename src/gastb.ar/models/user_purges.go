@@ -0,0 +1,290 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// UserPurge tracks the deletion of the data of a deleted user, which
+// runs in the background in batches after the account is deleted. The
+// counts say how many records each step deleted so far.
+type UserPurge struct {
+	ID        uint `gorm:"primary_key"`
+	UserID    uint `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Step names the step running, such as "stocklists"; it is empty
+	// before the first batch
+	Step        string
+	Attachments int64 `gorm:"not null;default:0"`
+	Stocklists  int64 `gorm:"not null;default:0"`
+	Webhooks    int64 `gorm:"not null;default:0"`
+	APIKeys     int64 `gorm:"not null;default:0"`
+	Sessions    int64 `gorm:"not null;default:0"`
+	FinishedAt  *time.Time
+}
+
+// ErrUserNotDeleted is returned when purging the data of a user whose
+// account is not deleted.
+var ErrUserNotDeleted = errors.New("models: user is not deleted")
+
+// UserPurger purges the data of deleted users in the background, such
+// as a jobs.UserPurges
+type UserPurger interface {
+	Purge(userID uint) error
+}
+
+// SetPurger makes Delete hand the data of deleted users to p. Without
+// one, their data is kept.
+func (us *UserService) SetPurger(p UserPurger) {
+	us.purger = p
+}
+
+// userPurgeGorm records user purges
+type userPurgeGorm struct {
+	db *gorm.DB
+}
+
+// start records that the data of a user is to be purged, unless it
+// already is
+func (pg *userPurgeGorm) start(userID uint) error {
+	return pg.db.Where(UserPurge{UserID: userID}).FirstOrCreate(&UserPurge{}).Error
+}
+
+// purgeStep is a step of a purge. Batch deletes up to n records of a
+// kind owned by a user, calling deleteFile with the storage key of each
+// file going with them, and returns how many it deleted; 0 means the
+// step is done. Counter names the column of UserPurge counting them, if
+// any.
+type purgeStep struct {
+	name    string
+	counter string
+	batch   func(db *gorm.DB, userID uint, n int, deleteFile func(key string) error) (int64, error)
+}
+
+// Attachments go before their stocklists, and deliveries before their
+// webhooks, so that no record is left pointing at a deleted one.
+// Stocklists of organizations, and their attachments, stay with the
+// organization.
+var userPurgeSteps = []purgeStep{
+	{"attachments", "attachments", purgeAttachments},
+	{"avatar", "", purgeAvatar},
+	{"stocklists", "stocklists", purgeOwnedWhere(&Stocklist{}, "organization_id IS NULL")},
+	{"webhook_deliveries", "", purgeDeliveries},
+	{"webhooks", "webhooks", purgeOwned(&Webhook{})},
+	{"api_usages", "", purgeOwned(&APIUsage{})},
+	{"api_keys", "api_keys", purgeOwned(&APIKey{})},
+	{"sessions", "sessions", purgeOwned(&Session{})},
+	{"memberships", "", purgeMemberships},
+	{"records", "", purgeRecords},
+}
+
+// purgeOwned returns a step deleting the records of a model with a
+// user_id column
+func purgeOwned(model interface{}) func(*gorm.DB, uint, int, func(string) error) (int64, error) {
+	return purgeOwnedWhere(model, "TRUE")
+}
+
+// purgeOwnedWhere is purgeOwned for the records also matching an SQL
+// condition
+func purgeOwnedWhere(model interface{}, cond string) func(*gorm.DB, uint, int, func(string) error) (int64, error) {
+	return func(db *gorm.DB, userID uint, n int, _ func(string) error) (int64, error) {
+		table := db.NewScope(model).TableName()
+		res := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN "+
+			"(SELECT id FROM %s WHERE user_id = ? AND %s LIMIT ?)", table, table, cond), userID, n)
+		return res.RowsAffected, res.Error
+	}
+}
+
+// purgeMemberships removes a user from their organizations, all at once.
+// Where they were the only owner, the longest-standing other member
+// becomes one, so that the organization keeps an owner if it keeps
+// anyone.
+func purgeMemberships(db *gorm.DB, userID uint, _ int, _ func(string) error) (int64, error) {
+	err := db.Exec("UPDATE memberships SET role = ? WHERE id IN "+
+		"(SELECT DISTINCT ON (m.organization_id) m.id FROM memberships m "+
+		"JOIN memberships o ON o.organization_id = m.organization_id "+
+		"AND o.user_id = ? AND o.role = ? "+
+		"WHERE m.user_id <> ? AND NOT EXISTS (SELECT 1 FROM memberships x "+
+		"WHERE x.organization_id = m.organization_id AND x.role = ? AND x.user_id <> ?) "+
+		"ORDER BY m.organization_id, m.id)",
+		OrgRoleOwner, userID, OrgRoleOwner, userID, OrgRoleOwner, userID).Error
+	if err != nil {
+		return 0, err
+	}
+	res := db.Where("user_id = ?", userID).Delete(&Membership{})
+	return res.RowsAffected, res.Error
+}
+
+func purgeAttachments(db *gorm.DB, userID uint, n int, deleteFile func(string) error) (int64, error) {
+	var attachments []Attachment
+	err := db.Unscoped().Joins("JOIN stocklists ON stocklists.id = attachments.stocklist_id").
+		Where("stocklists.user_id = ? AND stocklists.organization_id IS NULL", userID).
+		Limit(n).Find(&attachments).Error
+	if err != nil || len(attachments) == 0 {
+		return 0, err
+	}
+	ids := make([]uint, len(attachments))
+	for i, a := range attachments {
+		if err := deleteFile(a.Key); err != nil {
+			return 0, err
+		}
+		ids[i] = a.ID
+	}
+	res := db.Unscoped().Where("id IN (?)", ids).Delete(&Attachment{})
+	return res.RowsAffected, res.Error
+}
+
+func purgeAvatar(db *gorm.DB, userID uint, _ int, deleteFile func(string) error) (int64, error) {
+	var user User
+	if err := first(db.Unscoped().Where("id = ?", userID), &user); err != nil {
+		return 0, err
+	}
+	if user.AvatarKey == "" {
+		return 0, nil
+	}
+	if err := deleteFile(user.AvatarKey); err != nil {
+		return 0, err
+	}
+	res := db.Unscoped().Model(&User{}).Where("id = ?", userID).UpdateColumn("avatar_key", "")
+	return res.RowsAffected, res.Error
+}
+
+func purgeDeliveries(db *gorm.DB, userID uint, n int, _ func(string) error) (int64, error) {
+	res := db.Exec("DELETE FROM webhook_deliveries WHERE id IN "+
+		"(SELECT webhook_deliveries.id FROM webhook_deliveries "+
+		"JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id "+
+		"WHERE webhooks.user_id = ? LIMIT ?)", userID, n)
+	return res.RowsAffected, res.Error
+}
+
+// purgeRecords deletes the settings and security records of a user, of
+// which there are only a few, all at once. The audit log is kept.
+func purgeRecords(db *gorm.DB, userID uint, _ int, _ func(string) error) (int64, error) {
+	var deleted int64
+	for _, m := range []interface{}{&DigestSubscription{}, &CalendarFeed{},
+		&NotificationSettings{}, &UserPreference{}, &ProfileSettings{},
+		&PolicyAcceptance{}, &UserToken{}, &VerificationCode{}, &Device{},
+		&PasswordHistory{}, &ReferralCode{}, &Referral{}, &Subscription{},
+		&IdempotencyKey{}} {
+		res := db.Unscoped().Where("user_id = ?", userID).Delete(m)
+		if res.Error != nil {
+			return 0, res.Error
+		}
+		deleted += res.RowsAffected
+	}
+	// Changes to stocklists of organizations are their members' to sync
+	res := db.Where("user_id = ? AND organization_id IS NULL", userID).Delete(&Change{})
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	return deleted + res.RowsAffected, nil
+}
+
+// UserPurgeService runs and reports on the purges of deleted users.
+type UserPurgeService struct {
+	db *gorm.DB
+	// rls runs the batches as the user's tenant, see
+	// Services.SetRowLevelSecurity
+	rls bool
+}
+
+// NewUserPurgeService instantiates a UserPurgeService on a database
+// connection.
+func NewUserPurgeService(db *gorm.DB) *UserPurgeService {
+	return &UserPurgeService{
+		db: db,
+	}
+}
+
+// PurgeByUserID looks up the purge of a user's data
+func (ps *UserPurgeService) PurgeByUserID(userID uint) (*UserPurge, error) {
+	var p UserPurge
+	if err := first(ps.db.Where("user_id = ?", userID), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UnfinishedPurges returns the purges still running, oldest first
+func (ps *UserPurgeService) UnfinishedPurges() ([]UserPurge, error) {
+	var purges []UserPurge
+	err := ps.db.Where("finished_at IS NULL").Order("id").Find(&purges).Error
+	return purges, err
+}
+
+// LatestPurges returns up to limit purges, newest first
+func (ps *UserPurgeService) LatestPurges(limit int) ([]UserPurge, error) {
+	var purges []UserPurge
+	err := ps.db.Order("id DESC").Limit(limit).Find(&purges).Error
+	return purges, err
+}
+
+// PurgeBatch runs one batch of up to n records of the current step of
+// a purge, recording its progress, and reports whether the purge is
+// finished. Files going with the records are deleted with deleteFile
+// first, so a failure leaves the records to try again. Batches can be
+// run again after any failure.
+//
+// A purge whose user isn't deleted, as when deleting the account failed
+// after the purge was recorded, is dropped with ErrUserNotDeleted.
+func (ps *UserPurgeService) PurgeBatch(p *UserPurge, n int, deleteFile func(key string) error) (bool, error) {
+	if p.FinishedAt != nil {
+		return true, nil
+	}
+	if p.Step == "" {
+		var count int
+		err := ps.db.Unscoped().Model(&User{}).
+			Where("id = ? AND deleted_at IS NOT NULL", p.UserID).Count(&count).Error
+		if err != nil {
+			return false, err
+		}
+		if count == 0 {
+			if err := ps.db.Delete(p).Error; err != nil {
+				return false, err
+			}
+			return true, ErrUserNotDeleted
+		}
+		p.Step = userPurgeSteps[0].name
+	}
+	i := 0
+	for i < len(userPurgeSteps) && userPurgeSteps[i].name != p.Step {
+		i++
+	}
+	if i == len(userPurgeSteps) {
+		return false, fmt.Errorf("models: unknown purge step %q", p.Step)
+	}
+	step := userPurgeSteps[i]
+	var deleted int64
+	err := scoped(ps.db, ps.rls, p.UserID, func(db *gorm.DB) (err error) {
+		deleted, err = step.batch(db, p.UserID, n, deleteFile)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	updates := map[string]interface{}{"step": p.Step}
+	switch {
+	case deleted > 0 && step.counter != "":
+		updates[step.counter] = gorm.Expr(step.counter+" + ?", deleted)
+	case deleted == 0 && i+1 < len(userPurgeSteps):
+		p.Step = userPurgeSteps[i+1].name
+		updates["step"] = p.Step
+	case deleted == 0:
+		now := time.Now()
+		p.FinishedAt = &now
+		updates["finished_at"] = now
+	}
+	if err := ps.db.Model(p).Updates(updates).Error; err != nil {
+		return false, err
+	}
+	// Read the counts back rather than adding them up here, in case
+	// another worker ran the same batch
+	if err := ps.db.First(p, p.ID).Error; err != nil {
+		return false, err
+	}
+	return p.FinishedAt != nil, nil
+}
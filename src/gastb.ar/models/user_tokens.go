@@ -0,0 +1,109 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// UserToken is a single use token emailed to a user, to confirm their
+// address or reset their password. Only the hash of the token is stored.
+type UserToken struct {
+	gorm.Model
+	UserID  uint   `gorm:"not null;index"`
+	Purpose string `gorm:"not null"`
+	// Email is the address the token was sent to; verification tokens
+	// stop working if the user changes their address meanwhile
+	Email     string `gorm:"not null"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// Token purposes, and how long tokens for each can be used
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenPasswordReset = "password_reset"
+	// TokenLockAccount tokens are sent with security notices, so the
+	// user can lock their account if they did not cause the event
+	TokenLockAccount = "lock_account"
+
+	VerifyEmailTTL   = 48 * time.Hour
+	PasswordResetTTL = time.Hour
+	LockAccountTTL   = 7 * 24 * time.Hour
+)
+
+// ErrInvalidToken is returned when a token is unknown, expired, already
+// used or meant for something else.
+var ErrInvalidToken = errors.New("models: token is invalid or expired")
+
+// userTokenGorm stores user tokens
+type userTokenGorm struct {
+	db *gorm.DB
+}
+
+// create stores a token for a user, sent to email, and returns it, since
+// only its hash is kept
+func (tg *userTokenGorm) create(userID uint, email, purpose string, ttl time.Duration,
+	hash func(string) string, now time.Time) (string, error) {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return "", err
+	}
+	ut := &UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		TokenHash: hash(token),
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := tg.db.Create(ut).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// find returns the token with the given hash and purpose, or
+// ErrInvalidToken if it can't be used, without using it
+func (tg *userTokenGorm) find(tokenHash, purpose string, now time.Time) (*UserToken, error) {
+	var ut UserToken
+	err := first(tg.db.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		tokenHash, purpose, now), &ut)
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ut, nil
+}
+
+// use marks the token with the given hash and purpose as used at now,
+// returning it, or ErrInvalidToken if it can't be used. Marking and checking happen
+// in one statement, so a token can't be used twice concurrently.
+func (tg *userTokenGorm) use(tokenHash, purpose string, now time.Time) (*UserToken, error) {
+	db := tg.db.Model(&UserToken{}).
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+			tokenHash, purpose, now).
+		Update("used_at", now)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if db.RowsAffected == 0 {
+		return nil, ErrInvalidToken
+	}
+	var ut UserToken
+	if err := first(tg.db.Where("token_hash = ?", tokenHash), &ut); err != nil {
+		return nil, err
+	}
+	return &ut, nil
+}
+
+// purge deletes tokens that expired before a given time
+func (tg *userTokenGorm) purge(before time.Time) (int64, error) {
+	db := tg.db.Unscoped().Where("expires_at < ?", before).Delete(&UserToken{})
+	return db.RowsAffected, db.Error
+}
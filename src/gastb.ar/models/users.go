@@ -2,9 +2,15 @@ package models
 
 import (
 	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
 
-//	"gastb.ar/rand"
+	"gastb.ar/clock"
+	"gastb.ar/rand"
 	"gastb.ar/hash"
+	"gastb.ar/ratelimit"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -16,11 +22,106 @@ import (
 type User struct {
 	gorm.Model
 	Name         string
-	Email        string `gorm:"not null;unique_index"`
+	Email        string `gorm:"not null"` // uix_users_email_live, see indexes
+	// Username is an optional public name, so pages about the user don't
+	// show their email address; nil if they didn't pick one
+	Username     *string // uix_users_username_live, see indexes
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
 	Token        string `gorm:"-"`
-	TokenHash    string `gorm:"not null;unique_index"`
+	TokenHash    string `gorm:"not null"` // uix_users_token_hash, see indexes
+	Role         string `gorm:"not null;default:'user'"`
+	// FailedLogins counts consecutive wrong passwords; the account is
+	// locked until LockedUntil once it reaches MaxFailedLogins
+	FailedLogins int        `gorm:"not null;default:0"`
+	LockedUntil  *time.Time
+	// Locale is the language the user picked for the interface; empty
+	// means the one negotiated with their browser
+	Locale string
+	// AvatarKey is the storage key of the user's avatar, if any
+	AvatarKey string
+	// EmailVerifiedAt is when the user confirmed they own Email; nil
+	// until they follow the link in the verification email
+	EmailVerifiedAt *time.Time
+	// ResetRequired locks the account until the password is reset, after
+	// the user said a security notice was not about them
+	ResetRequired bool `gorm:"not null;default:false"`
+	// Undeliverable is why email to Email is suppressed, UndeliverableBounce
+	// or UndeliverableComplaint, as reported by the mail provider; empty
+	// while the address accepts mail
+	Undeliverable   string `gorm:"index"`
+	UndeliverableAt *time.Time
+	// DeactivatedAt is when the account was deactivated, by the identity
+	// provider through SCIM; deactivated users can't log in
+	DeactivatedAt *time.Time
+	// LastLoginAt is when the user last started a session; nil if they
+	// never did
+	LastLoginAt *time.Time // idx_users_last_login_at, see indexes
+}
+
+// SearchQuery filters the users returned by Search. Zero fields don't
+// filter.
+type SearchQuery struct {
+	// Text matches users whose email address or name contains it,
+	// ignoring case
+	Text string
+	// Verified matches users who confirmed their email address, or who
+	// didn't if false
+	Verified *bool
+	Role     string
+	// Locked matches users locked out at Now, or not locked out if false
+	Locked *bool
+	// Ranges include their After bound and exclude their Before bound.
+	// Users who never logged in are outside every LastLogin range.
+	CreatedAfter    time.Time
+	CreatedBefore   time.Time
+	LastLoginAfter  time.Time
+	LastLoginBefore time.Time
+	// Now is when Locked is checked; UserService.Search sets it
+	Now time.Time
+	// Limit caps the number of users returned; 0 returns them all
+	Limit int
+}
+
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Reasons an email address is undeliverable
+const (
+	UndeliverableBounce    = "bounce"
+	UndeliverableComplaint = "complaint"
+)
+
+// GetUsername returns the user's username, or "" if they have none
+func (u *User) GetUsername() string {
+	if u.Username == nil {
+		return ""
+	}
+	return *u.Username
+}
+
+// IsAdmin reports whether the user can access the admin dashboard
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// IsLocked reports whether the account is locked after too many
+// failed logins
+func (u *User) IsLocked() bool {
+	return u.IsLockedAt(time.Now())
+}
+
+// IsLockedAt reports whether the account is locked at a given time
+func (u *User) IsLockedAt(t time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(t)
+}
+
+// IsDeactivated reports whether the account is deactivated
+func (u *User) IsDeactivated() bool {
+	return u.DeactivatedAt != nil
 }
 
 // UsersDB is an interface that can interact with the users database.
@@ -33,7 +134,20 @@ type UserDB interface {
 	//Query methods
 	ByID(id uint)                 (*User, error)
 	ByEmail(email string)         (*User, error)
+	ByUsername(username string)   (*User, error)
 	ByTokenHash(tokenHash string) (*User, error)
+	// Search returns up to query.Limit users matching every filter of
+	// query, newest first; an empty query matches every user
+	Search(query SearchQuery) ([]User, error)
+	// Page returns up to limit users oldest first, skipping the first
+	// offset, and how many users there are in total
+	Page(offset, limit int) ([]User, int, error)
+	// Undeliverable returns up to limit users whose email address is
+	// suppressed, most recently suppressed first
+	Undeliverable(limit int) ([]User, error)
+	// UndeliverableAmong returns which of emails belong to users whose
+	// address is suppressed
+	UndeliverableAmong(emails []string) ([]string, error)
 
 	//Edit methods
 	Create(user *User) error
@@ -47,17 +161,61 @@ type UserDB interface {
 // implementing the UserDB interface.
 type userGorm struct {
 	db *gorm.DB
+	// prepared, if set, runs the hot lookups (ByID, ByEmail and
+	// ByTokenHash) with cached prepared statements
+	prepared *gorm.DB
 }
 
 var _ UserDB = &userGorm{}
 // Checks to see if userGorm is correctly implemented; otherwise code
 // does not compile.
 
+// NewUserDB returns the gorm implementation of UserDB, for code that needs
+// the database layer alone, such as the modelstest contract checks.
+func NewUserDB(db *gorm.DB) UserDB {
+	return &userGorm{db: db}
+}
+
+// UserMailer sends the emails of user account flows. Tokens are the
+// single use tokens the emailed links must carry.
+type UserMailer interface {
+	Welcome(user *User) error
+	// VerifyEmail sends both a verification link carrying token and a
+	// code to type in instead
+	VerifyEmail(user *User, token, code string) error
+	PasswordReset(user *User, token string) error
+	// SecurityNotice tells the user about a sensitive change to their
+	// account, such as a login from a new device
+	SecurityNotice(user *User, notice SecurityNotice) error
+}
+
 // UserService wraps the UserDB implementation and implements non-database
 // related services.
 type UserService struct {
-	db   UserDB
-	hmac hash.HMAC
+	db       UserDB
+	tokens   *userTokenGorm
+	codes    *verificationCodeGorm
+	devices  *userDeviceGorm
+	sessions SessionDB
+	history  *passwordHistoryGorm
+	merges   *userMergeGorm
+	hmac     hash.HMAC
+	mailer   UserMailer
+	clock    clock.Clock
+	// ssoDomain is the email domain whose users must sign in with
+	// single sign-on
+	ssoDomain string
+	// blocklist, if set, holds the email domains new addresses can't use
+	blocklist DomainBlocklist
+	// passwordHistory is how many recent passwords can't be used again
+	passwordHistory int
+	// resetLimits and resetLimit throttle password reset requests
+	resetLimits ratelimit.Store
+	resetLimit  ratelimit.Limit
+	audit       *AuditService
+	purges      *userPurgeGorm
+	purger      UserPurger
+	guests      *guestGorm
 }
 
 //
@@ -67,70 +225,749 @@ type UserService struct {
 // NewUserService instatiates a UserService on a database connection and
 // a hasher for user tokens.
 func NewUserService(db *gorm.DB, hmacSecretKey string) *UserService {
-	ug := &userGorm{db}
+	ug := &userGorm{db: db}
 	
 	hmac := hash.NewHMAC(hmacSecretKey)
 
 	return &UserService {
-		db:     ug,
-		hmac:   hmac,
+		db:       ug,
+		tokens:   &userTokenGorm{db},
+		codes:    &verificationCodeGorm{db},
+		devices:  &userDeviceGorm{db},
+		sessions: &sessionGorm{db},
+		history:  &passwordHistoryGorm{db},
+		merges:   &userMergeGorm{db},
+		audit:    NewAuditService(db),
+		purges:   &userPurgeGorm{db},
+		guests:   &guestGorm{db: db},
+		hmac:     hmac,
+		clock:    clock.Real,
+	}
+}
+
+// NewUserServiceWith instantiates a UserService on other implementations
+// of the user and session stores, such as the modelstest fakes, and a
+// hasher for user tokens. Only logging in, sessions and the UserDB
+// lookups work on it; the other flows need the database.
+func NewUserServiceWith(users UserDB, sessions SessionDB, hmacSecretKey string) *UserService {
+	return &UserService{
+		db:       users,
+		sessions: sessions,
+		hmac:     hash.NewHMAC(hmacSecretKey),
+		clock:    clock.Real,
+	}
+}
+
+// SetMailer sets the mailer for account emails. Without one, no emails
+// are sent.
+func (us *UserService) SetMailer(m UserMailer) {
+	us.mailer = m
+}
+
+// SetClock sets the clock that token and code expiry, lockouts and
+// verification times are based on
+func (us *UserService) SetClock(c clock.Clock) {
+	us.clock = c
+}
+
+// RequireSSO disables password logins for the email addresses of a
+// domain, whose users must sign in with single sign-on instead
+func (us *UserService) RequireSSO(domain string) {
+	us.ssoDomain = strings.ToLower(strings.TrimPrefix(domain, "@"))
+}
+
+// SetDomainBlocklist makes new and changed email addresses be refused
+// with ErrEmailNotAllowed when bl blocks their domain
+func (us *UserService) SetDomainBlocklist(bl DomainBlocklist) {
+	us.blocklist = bl
+}
+
+// RequiresSSO reports whether an email address must sign in with single
+// sign-on
+func (us *UserService) RequiresSSO(email string) bool {
+	if us.ssoDomain == "" {
+		return false
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	return strings.HasSuffix(email, "@"+us.ssoDomain)
+}
+
+// mail calls send with the user service's mailer, if any. Failures are
+// logged rather than returned: they should not undo the change the email
+// is about.
+func (us *UserService) mail(kind string, user *User, send func(m UserMailer) error) {
+	if us.mailer == nil {
+		return
+	}
+	if err := send(us.mailer); err != nil {
+		slog.Error("sending email failed", "email", kind, "user_id", user.ID,
+			"error", err)
 	}
 }
 
-// Create takes a user object, hashes sensitive data and passes it on to
-// the database layer.
+// Create takes a user object, validates it, hashes sensitive data and 
+// passes it on to the database layer.
 func (us *UserService) Create(user *User) error {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	user.PasswordHash = string(hashedBytes)
+	if err := us.validate(user); err != nil {
+		return err
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	// Every user needs a token hash, since it is unique in the database.
+	if user.Token == "" {
+		token, err := rand.RememberToken()
+		if err != nil {
+			return err
+		}
+		user.Token = token
+	}
+	user.TokenHash = us.hmac.Hash(user.Token)
+	if err := user.hashPassword(); err != nil {
+		return err
+	}
+	if err := us.db.Create(user); err != nil {
+		return err
+	}
+	us.recordPassword(user)
+	us.mail("welcome", user, func(m UserMailer) error {
+		return m.Welcome(user)
+	})
+	// The account exists by now; users can ask for another link later
+	if err := us.RequestVerification(user); err != nil {
+		slog.Error("requesting email verification failed", "user_id", user.ID,
+			"error", err)
+	}
+	return nil
+}
 
+// hashPassword sets PasswordHash from Password
+func (u *User) hashPassword() error {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	return us.db.Create(user)
+	u.PasswordHash = string(hashedBytes)
+	return nil
 }
 
 // Update takes a user object, hashes sensitive data and passes it on to
-// the database layer
+// the database layer. The token hash is only replaced if a new Token is
+// set, which also logs the user out of all their sessions.
 func (us *UserService) Update(user *User) error {
-	user.TokenHash = us.hmac.Hash(user.Token)
+	logout := user.Token != ""
+	if logout {
+		user.TokenHash = us.hmac.Hash(user.Token)
+		// Updating the user again must not end sessions started since
+		user.Token = ""
+	}
+	if err := us.db.Update(user); err != nil {
+		return err
+	}
+	if logout {
+		_, err := us.sessions.DeleteAll(user.ID, 0)
+		return err
+	}
+	return nil
+}
+
+// Search looks up users for the admin dashboard
+func (us *UserService) Search(query SearchQuery) ([]User, error) {
+	query.Text = strings.TrimSpace(query.Text)
+	if query.Now.IsZero() {
+		query.Now = us.clock.Now()
+	}
+	return us.db.Search(query)
+}
+
+// Page lists users oldest first, for clients paging through all of them
+func (us *UserService) Page(offset, limit int) ([]User, int, error) {
+	return us.db.Page(offset, limit)
+}
+
+// Unlock releases an account locked after too many failed logins
+func (us *UserService) Unlock(id uint) error {
+	user, err := us.db.ByID(id)
+	if err != nil {
+		return err
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return us.db.Update(user)
+}
+
+// ByID looks up a user by ID. Error returns are the same as userGorm.ByID.
+func (us *UserService) ByID(id uint) (*User, error) {
+	return us.db.ByID(id)
+}
+
+// ByEmail looks up a user by email address, which is normalized first.
+func (us *UserService) ByEmail(email string) (*User, error) {
+	return us.db.ByEmail(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// Lock keeps a user from logging in until a given time and logs them out
+// everywhere. Unlock lifts it early.
+func (us *UserService) Lock(id uint, until time.Time) error {
+	user, err := us.db.ByID(id)
+	if err != nil {
+		return err
+	}
+	user.LockedUntil = &until
+	if user.Token, err = rand.RememberToken(); err != nil {
+		return err
+	}
+	return us.Update(user)
+}
+
+// Provision creates the account of a user whose identity provider
+// vouches for them, on their first single sign-on or when the provider
+// provisions it. The password is random, so only single sign-on or a
+// password reset get into it, and the address counts as verified.
+func (us *UserService) Provision(email, name string) (*User, error) {
+	password, err := rand.String(32)
+	if err != nil {
+		return nil, err
+	}
+	now := us.clock.Now()
+	user := &User{
+		Name:            name,
+		Email:           email,
+		Password:        password,
+		EmailVerifiedAt: &now,
+	}
+	if err := us.Create(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateProvisioned changes the email address and name of a user as
+// their identity provider says. Like in Provision, the address counts as
+// verified.
+func (us *UserService) UpdateProvisioned(user *User, email, name string) error {
+	oldEmail := user.Email
+	user.Email = email
+	if err := us.validateEmail(user); err != nil {
+		user.Email = oldEmail
+		return err
+	}
+	if user.Email != oldEmail {
+		now := us.clock.Now()
+		user.EmailVerifiedAt = &now
+		user.Undeliverable = ""
+		user.UndeliverableAt = nil
+	}
+	user.Name = name
 	return us.db.Update(user)
 }
 
-// Authenticate checks validity of email and passowrd
-// If the email provided is invalid, it returns 
+// Deactivate keeps a user from logging in, until Reactivate, and logs
+// them out everywhere
+func (us *UserService) Deactivate(user *User) error {
+	if user.DeactivatedAt != nil {
+		return nil
+	}
+	now := us.clock.Now()
+	user.DeactivatedAt = &now
+	var err error
+	if user.Token, err = rand.RememberToken(); err != nil {
+		return err
+	}
+	return us.Update(user)
+}
+
+// Reactivate lets a deactivated user log in again
+func (us *UserService) Reactivate(user *User) error {
+	if user.DeactivatedAt == nil {
+		return nil
+	}
+	user.DeactivatedAt = nil
+	return us.Update(user)
+}
+
+// ByUsername looks up a user by username; see UserDB.ByID for errors.
+func (us *UserService) ByUsername(username string) (*User, error) {
+	return us.db.ByUsername(strings.ToLower(strings.TrimSpace(username)))
+}
+
+// ChangeUsername validates and sets a user's username; an empty one
+// removes it.
+func (us *UserService) ChangeUsername(user *User, username string) error {
+	old, oldName := user.Username, user.GetUsername()
+	user.Username = &username
+	if err := us.validateUsername(user); err != nil {
+		user.Username = old
+		return err
+	}
+	if user.GetUsername() == oldName {
+		return nil
+	}
+	return us.db.Update(user)
+}
+
+// Delete soft deletes the user with the provided ID. With a purger, the
+// user's stocklists, uploads, webhooks, API keys, sessions and settings
+// are then deleted in the background; the purge is recorded first, so
+// that it can be resumed if handing it over fails.
+func (us *UserService) Delete(id uint) error {
+	if us.purger != nil && id != 0 {
+		if err := us.purges.start(id); err != nil {
+			return err
+		}
+	}
+	if err := us.db.Delete(id); err != nil {
+		return err
+	}
+	if us.purger == nil {
+		return nil
+	}
+	return us.purger.Purge(id)
+}
+
+// emailRegex is a loose check that an email address is well formed
+var emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}$`)
+
+// Minimum number of characters in a user password
+const MinPasswordLength = 8
+
+// validate normalizes a new user's email address and username and checks
+// that they and the password are acceptable and that neither is taken
+func (us *UserService) validate(user *User) error {
+	if err := us.validateEmail(user); err != nil {
+		return err
+	}
+	if err := us.validateUsername(user); err != nil {
+		return err
+	}
+	if len(user.Password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+// validateEmail normalizes a user's email address and checks that it is
+// well formed and not taken by another user. Unless the user keeps their
+// address, its domain must not be blocked.
+func (us *UserService) validateEmail(user *User) error {
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+	if user.Email == "" {
+		return ErrEmailRequired
+	}
+	if !emailRegex.MatchString(user.Email) {
+		return ErrEmailInvalid
+	}
+	existing, err := us.db.ByEmail(user.Email)
+	switch err {
+	case ErrNotFound:
+	case nil:
+		if existing.ID != user.ID {
+			return ErrEmailTaken
+		}
+		return nil
+	default:
+		return err
+	}
+	if us.blocklist != nil {
+		domain := user.Email[strings.LastIndexByte(user.Email, '@')+1:]
+		blocked, err := us.blocklist.DomainBlocked(domain)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return ErrEmailNotAllowed
+		}
+	}
+	return nil
+}
+
+// usernameRegex is what usernames look like: no @, so logins can tell
+// them from email addresses
+var usernameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{2,29}$`)
+
+// reservedUsernames can't be picked, since they would pass for the site
+// or one of its pages
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "api": true, "assets": true,
+	"gastb": true, "gastbar": true, "help": true, "login": true,
+	"logout": true, "mail": true, "me": true, "moderator": true,
+	"null": true, "policies": true, "profile": true, "root": true,
+	"security": true, "settings": true, "signup": true, "staff": true,
+	"static": true, "support": true, "system": true, "undefined": true,
+	"user": true, "users": true, "webmaster": true, "www": true,
+}
+
+// validateUsername normalizes a user's username, nil if empty, and checks
+// that it is well formed, not reserved and not taken by another user
+func (us *UserService) validateUsername(user *User) error {
+	username := strings.ToLower(strings.TrimSpace(user.GetUsername()))
+	if username == "" {
+		user.Username = nil
+		return nil
+	}
+	user.Username = &username
+	if !usernameRegex.MatchString(username) {
+		return ErrUsernameInvalid
+	}
+	if reservedUsernames[username] {
+		return ErrUsernameReserved
+	}
+	existing, err := us.db.ByUsername(username)
+	switch err {
+	case ErrNotFound:
+		return nil
+	case nil:
+		if existing.ID != user.ID {
+			return ErrUsernameTaken
+		}
+		return nil
+	default:
+		return err
+	}
+}
+
+// Number of consecutive failed logins after which an account is locked,
+// and for how long
+const (
+	MaxFailedLogins = 5
+	LockoutDuration = 15 * time.Minute
+)
+
+// Authenticate checks validity of a login, an email address or a
+// username, and passowrd
+// If the login provided is invalid, it returns 
 //   nil, ErrNotFound
+// If the email must sign in with single sign-on, it returns
+//   nil, ErrSSORequired
 // If the password provided is invalid, it returns
 //   nil, ErrInvalidPassword
+// If the password is valid but the account is deactivated, it returns
+//   nil, ErrAccountDeactivated
+// If the password is valid but the account is locked after too many
+// failed logins, it returns
+//   nil, ErrAccountLocked
+// If the password is valid but the account is locked until the password
+// is reset, it returns
+//   nil, ErrPasswordResetRequired
 // If all is valid, it returns
 //   user, nil
 // Otherwise, it returns whatever error arises
 //   nil, error
-func (us *UserService) Authenticate(email, password string) (*User, error) {
-	foundUser, err := us.db.ByEmail(email)
+func (us *UserService) Authenticate(login, password string) (*User, error) {
+	login = strings.ToLower(strings.TrimSpace(login))
+	if us.RequiresSSO(login) {
+		return nil, ErrSSORequired
+	}
+	var foundUser *User
+	var err error
+	if strings.Contains(login, "@") {
+		foundUser, err = us.db.ByEmail(login)
+	} else {
+		foundUser, err = us.db.ByUsername(login)
+	}
 	if err != nil {
 		return nil, err
 	}
-	
+	if us.RequiresSSO(foundUser.Email) {
+		return nil, ErrSSORequired
+	}
+	now := us.clock.Now()
+	// The state of the account is only told to whoever knows its
+	// password; anyone else can't tell it from a wrong password
+	var blocked error
+	switch {
+	case foundUser.IsDeactivated():
+		blocked = ErrAccountDeactivated
+	case foundUser.IsLockedAt(now):
+		blocked = ErrAccountLocked
+	case foundUser.ResetRequired:
+		blocked = ErrPasswordResetRequired
+	}
+
 	err = bcrypt.CompareHashAndPassword(
 		[]byte(foundUser.PasswordHash),
 		[]byte(password))
-	switch err {
-	case nil:
+	switch {
+	case err == nil && blocked != nil:
+		return nil, blocked
+	case err == nil:
+		if foundUser.FailedLogins > 0 || foundUser.LockedUntil != nil {
+			foundUser.FailedLogins = 0
+			foundUser.LockedUntil = nil
+			if err := us.db.Update(foundUser); err != nil {
+				return nil, err
+			}
+		}
 		return foundUser, nil
-	case bcrypt.ErrMismatchedHashAndPassword:
+	case err == bcrypt.ErrMismatchedHashAndPassword && blocked != nil:
+		return nil, ErrInvalidPassword
+	case err == bcrypt.ErrMismatchedHashAndPassword:
+		foundUser.FailedLogins++
+		if foundUser.FailedLogins >= MaxFailedLogins {
+			until := now.Add(LockoutDuration)
+			foundUser.LockedUntil = &until
+			foundUser.FailedLogins = 0
+		}
+		if err := us.db.Update(foundUser); err != nil {
+			return nil, err
+		}
 		return nil, ErrInvalidPassword
 	default:
 		return nil, err
 	}
 }
 
-// ByToken takes in a token, hashes it, and uses the hash to search 
-// for the corresponding user and returns them
-// It also returns whatever error is returned by UserDB when searching for 
-// that hash.
-func (us *UserService) ByToken(token string) (*User, error) {
+// RequestVerification emails the user a link to confirm their address.
+// Users that already did are not sent anything.
+func (us *UserService) RequestVerification(user *User) error {
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+	now := us.clock.Now()
+	token, err := us.tokens.create(user.ID, user.Email, TokenVerifyEmail, VerifyEmailTTL,
+		us.hmac.Hash, now)
+	if err != nil {
+		return err
+	}
+	code, err := us.codes.create(user.ID, user.Email, us.hmac.Hash, now)
+	if err != nil {
+		return err
+	}
+	us.mail("verify_email", user, func(m UserMailer) error {
+		return m.VerifyEmail(user, token, code)
+	})
+	return nil
+}
+
+// VerifyEmail confirms the address of the user a verification token was
+// sent to, reporting whether it was not confirmed before. It returns
+// ErrInvalidToken if the token can't be used, or the user has changed
+// their address since it was sent.
+func (us *UserService) VerifyEmail(token string) (*User, bool, error) {
+	now := us.clock.Now()
+	ut, err := us.tokens.use(us.hmac.Hash(token), TokenVerifyEmail, now)
+	if err != nil {
+		return nil, false, err
+	}
+	user, err := us.db.ByID(ut.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+	if user.Email != ut.Email {
+		return nil, false, ErrInvalidToken
+	}
+	if user.EmailVerifiedAt != nil {
+		return user, false, nil
+	}
+	user.EmailVerifiedAt = &now
+	if err := us.db.Update(user); err != nil {
+		return nil, false, err
+	}
+	return user, true, nil
+}
+
+// VerifyCode confirms the user's email address with the code emailed to
+// them. It returns ErrInvalidCode for a wrong code, and ErrCodeExpired
+// once the code expired or was tried MaxCodeAttempts times.
+func (us *UserService) VerifyCode(user *User, code string) error {
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+	now := us.clock.Now()
+	err := us.codes.check(user.ID, user.Email, us.hmac.Hash(strings.TrimSpace(code)), now)
+	if err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = &now
+	return us.db.Update(user)
+}
+
+// RequestPasswordReset emails a password reset link to the user with the
+// given address. Unknown addresses are not reported, so the form can't be
+// used to find out who has an account, and neither are requests over the
+// reset limit.
+func (us *UserService) RequestPasswordReset(email string, client Client) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	user, err := us.db.ByEmail(email)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if !us.resetAllowed(email, user, client) || user == nil {
+		return nil
+	}
+	return us.sendPasswordReset(user)
+}
+
+// sendPasswordReset emails a password reset link to a user
+func (us *UserService) sendPasswordReset(user *User) error {
+	token, err := us.tokens.create(user.ID, user.Email, TokenPasswordReset, PasswordResetTTL,
+		us.hmac.Hash, us.clock.Now())
+	if err != nil {
+		return err
+	}
+	us.mail("password_reset", user, func(m UserMailer) error {
+		return m.PasswordReset(user, token)
+	})
+	return nil
+}
+
+// ResetPassword sets a new password for the user a reset token was sent
+// to. Following the emailed link proves the user owns the address, so it
+// is marked as verified, and the account is unlocked. The remember token
+// is replaced, logging the user out everywhere. Recent passwords are
+// refused with ErrPasswordReused.
+func (us *UserService) ResetPassword(token, password string, client Client) (*User, error) {
+	if len(password) < MinPasswordLength {
+		return nil, ErrPasswordTooShort
+	}
+	now := us.clock.Now()
 	tokenHash := us.hmac.Hash(token)
-	return us.db.ByTokenHash(tokenHash)
+	// The token is only used up once the password is acceptable, so
+	// users can try another one
+	ut, err := us.tokens.find(tokenHash, TokenPasswordReset, now)
+	if err != nil {
+		return nil, err
+	}
+	user, err := us.db.ByID(ut.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := us.checkReuse(user, password); err != nil {
+		return nil, err
+	}
+	if _, err := us.tokens.use(tokenHash, TokenPasswordReset, now); err != nil {
+		return nil, err
+	}
+	user.Password = password
+	if err := user.hashPassword(); err != nil {
+		return nil, err
+	}
+	if user.EmailVerifiedAt == nil && user.Email == ut.Email {
+		user.EmailVerifiedAt = &now
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	user.ResetRequired = false
+	if user.Token, err = rand.RememberToken(); err != nil {
+		return nil, err
+	}
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	us.recordPassword(user)
+	us.notifySecurity(user, SecurityPasswordChanged, client, user.Email, "")
+	return user, nil
+}
+
+// ChangeEmail moves a user to a new email address. Whoever controls the
+// address can reset the password, so callers must have the user confirm
+// it first, see Reauthenticate. The old address is notified and the new
+// one has to be verified again.
+func (us *UserService) ChangeEmail(user *User, email string, client Client) error {
+	oldEmail := user.Email
+	user.Email = email
+	if err := us.validateEmail(user); err != nil {
+		user.Email = oldEmail
+		return err
+	}
+	if user.Email == oldEmail {
+		return nil
+	}
+	user.EmailVerifiedAt = nil
+	user.Undeliverable = ""
+	user.UndeliverableAt = nil
+	if err := us.db.Update(user); err != nil {
+		return err
+	}
+	us.notifySecurity(user, SecurityEmailChanged, client, oldEmail, oldEmail)
+	if err := us.RequestVerification(user); err != nil {
+		slog.Error("requesting email verification failed", "user_id", user.ID,
+			"error", err)
+	}
+	return nil
+}
+
+// MarkUndeliverable suppresses email to the user with a given address,
+// after the mail provider reported a bounce or complaint. Complaints are
+// not downgraded to bounces. It returns ErrNotFound if no user has the
+// address.
+func (us *UserService) MarkUndeliverable(email, reason string) error {
+	user, err := us.db.ByEmail(strings.ToLower(strings.TrimSpace(email)))
+	if err != nil {
+		return err
+	}
+	if user.Undeliverable == UndeliverableComplaint {
+		return nil
+	}
+	now := us.clock.Now()
+	user.Undeliverable = reason
+	user.UndeliverableAt = &now
+	return us.db.Update(user)
+}
+
+// AllowEmail lifts the suppression of a user's email address, once
+// they or an admin fixed the problem with it.
+func (us *UserService) AllowEmail(id uint) error {
+	user, err := us.db.ByID(id)
+	if err != nil {
+		return err
+	}
+	user.Undeliverable = ""
+	user.UndeliverableAt = nil
+	return us.db.Update(user)
+}
+
+// Undeliverable returns up to limit users whose email address is
+// suppressed, most recently suppressed first.
+func (us *UserService) Undeliverable(limit int) ([]User, error) {
+	return us.db.Undeliverable(limit)
+}
+
+// Deliverable returns the addresses among emails that mail may be sent
+// to, leaving out those of users whose address is suppressed.
+func (us *UserService) Deliverable(emails []string) ([]string, error) {
+	lower := make([]string, len(emails))
+	for i, e := range emails {
+		lower[i] = strings.ToLower(strings.TrimSpace(e))
+	}
+	suppressed, err := us.db.UndeliverableAmong(lower)
+	if err != nil {
+		return nil, err
+	}
+	if len(suppressed) == 0 {
+		return emails, nil
+	}
+	skip := make(map[string]bool, len(suppressed))
+	for _, e := range suppressed {
+		skip[e] = true
+	}
+	var ok []string
+	for i, e := range emails {
+		if !skip[lower[i]] {
+			ok = append(ok, e)
+		}
+	}
+	return ok, nil
+}
+
+// PurgeTokens deletes verification and password reset tokens, and
+// verification codes, that expired before a given time, and returns how
+// many were deleted.
+func (us *UserService) PurgeTokens(before time.Time) (int64, error) {
+	tokens, err := us.tokens.purge(before)
+	if err != nil {
+		return 0, err
+	}
+	codes, err := us.codes.purge(before)
+	return tokens + codes, err
+}
+
+// ByRemember takes in a remember token and returns the user whose
+// session it belongs to, as BySession does. It returns ErrNotFound if
+// there is no such session.
+func (us *UserService) ByRemember(token string) (*User, error) {
+	user, _, err := us.BySession(token, Client{})
+	return user, err
 }
 
 //
@@ -150,6 +987,45 @@ var (
 	// ErrInvalidPassword is returned when an invalid password 
 	// is used when attempting to authenticate a user
 	ErrInvalidPassword = errors.New("models: incorrect password provided")
+
+	// ErrEmailRequired is returned when a user is created without
+	// an email address.
+	ErrEmailRequired = errors.New("models: email address is required")
+
+	// ErrEmailInvalid is returned when an email address is not
+	// well formed.
+	ErrEmailInvalid = errors.New("models: email address is not valid")
+
+	// ErrEmailTaken is returned when a user is created with an email
+	// address that already belongs to another user.
+	ErrEmailTaken = errors.New("models: email address is already taken")
+
+	// ErrPasswordTooShort is returned when a password has fewer than
+	// MinPasswordLength characters.
+	ErrPasswordTooShort = errors.New("models: password is too short")
+
+	// ErrAccountLocked is returned when authenticating a user whose
+	// account is locked after too many failed logins.
+	ErrAccountLocked = errors.New("models: account is temporarily locked")
+
+	// ErrSSORequired is returned when authenticating with a password an
+	// email address that must sign in with single sign-on.
+	ErrSSORequired = errors.New("models: this account must sign in with single sign-on")
+
+	// ErrAccountDeactivated is returned when authenticating a user whose
+	// account is deactivated.
+	ErrAccountDeactivated = errors.New("models: account is deactivated")
+
+	// ErrUsernameInvalid is returned when a username is not well formed.
+	ErrUsernameInvalid = errors.New("models: username must be 3 to 30 letters, digits or underscores, starting with a letter")
+
+	// ErrUsernameReserved is returned when a username is one users can't
+	// pick.
+	ErrUsernameReserved = errors.New("models: username is reserved")
+
+	// ErrUsernameTaken is returned when a username already belongs to
+	// another user.
+	ErrUsernameTaken = errors.New("models: username is already taken")
 )
 
 // Auxiliary function that returns first result in database for a query
@@ -161,6 +1037,14 @@ func first(db *gorm.DB, dst interface{}) error {
 	return err
 }
 
+// lookup returns the connection the hot lookups run on
+func (ug *userGorm) lookup() *gorm.DB {
+	if ug.prepared != nil {
+		return ug.prepared
+	}
+	return ug.db
+}
+
 // Create takes a User object and writes it to the database.
 // If this results in an error, it returns it.
 func (ug *userGorm) Create(user *User) error {
@@ -193,7 +1077,7 @@ func (ug *userGorm) ByID(id uint) (*User, error) {
 	if id <= 0 {
 		return nil, errors.New("Invalid ID")
 	}
-	db := ug.db.Where("id = ?", id)
+	db := ug.lookup().Where("id = ?", id)
 	err := first(db, &user)
 	if err != nil {
 		return nil, err
@@ -205,7 +1089,19 @@ func (ug *userGorm) ByID(id uint) (*User, error) {
 // Error returns are the same as ByID.
 func (ug *userGorm) ByEmail(email string) (*User, error) {
 	var user User
-	db := ug.db.Where("email = ?", email)
+	db := ug.lookup().Where("email = ?", email)
+	err := first(db, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, err
+}
+
+// ByUsername looks up a user with the given username and returns them.
+// Error returns are the same as ByID.
+func (ug *userGorm) ByUsername(username string) (*User, error) {
+	var user User
+	db := ug.lookup().Where("username = ?", username)
 	err := first(db, &user)
 	if err != nil {
 		return nil, err
@@ -217,10 +1113,100 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 // Error returns are the same as ByID.
 func (ug *userGorm) ByTokenHash(tokenHash string) (*User, error) {
 	var user User
-	db := ug.db.Where("token_hash = ?", tokenHash)
+	db := ug.lookup().Where("token_hash = ?", tokenHash)
 	err := first(db, &user)
 	if err != nil {
 		return nil, err
 	}
 	return &user, err
 }
+
+// escapeLike escapes the wildcards of LIKE in s, with backslashes, so
+// that it matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Search returns up to query.Limit users matching query, newest first.
+func (ug *userGorm) Search(query SearchQuery) ([]User, error) {
+	var users []User
+	db := ug.db.Order("created_at desc")
+	if query.Limit > 0 {
+		db = db.Limit(query.Limit)
+	}
+	if query.Text != "" {
+		// Served by the trigram indexes on lower(email) and lower(name)
+		like := "%" + escapeLike(strings.ToLower(query.Text)) + "%"
+		db = db.Where(`lower(email) LIKE ? ESCAPE '\' OR lower(name) LIKE ? ESCAPE '\'`, like, like)
+	}
+	if query.Verified != nil {
+		if *query.Verified {
+			db = db.Where("email_verified_at IS NOT NULL")
+		} else {
+			db = db.Where("email_verified_at IS NULL")
+		}
+	}
+	if query.Role != "" {
+		db = db.Where("role = ?", query.Role)
+	}
+	if query.Locked != nil {
+		if *query.Locked {
+			db = db.Where("locked_until > ?", query.Now)
+		} else {
+			db = db.Where("locked_until IS NULL OR locked_until <= ?", query.Now)
+		}
+	}
+	if !query.CreatedAfter.IsZero() {
+		db = db.Where("created_at >= ?", query.CreatedAfter)
+	}
+	if !query.CreatedBefore.IsZero() {
+		db = db.Where("created_at < ?", query.CreatedBefore)
+	}
+	if !query.LastLoginAfter.IsZero() {
+		db = db.Where("last_login_at >= ?", query.LastLoginAfter)
+	}
+	if !query.LastLoginBefore.IsZero() {
+		db = db.Where("last_login_at < ?", query.LastLoginBefore)
+	}
+	if err := db.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Page returns up to limit users oldest first, skipping offset, and
+// the total number of users.
+func (ug *userGorm) Page(offset, limit int) ([]User, int, error) {
+	var users []User
+	var total int
+	if err := ug.db.Model(&User{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := ug.db.Order("id").Offset(offset).Limit(limit).Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// Undeliverable returns up to limit users whose email address is
+// suppressed.
+func (ug *userGorm) Undeliverable(limit int) ([]User, error) {
+	var users []User
+	db := ug.db.Where("undeliverable <> ''").Order("undeliverable_at desc").Limit(limit)
+	if err := db.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// UndeliverableAmong returns which of emails are suppressed.
+func (ug *userGorm) UndeliverableAmong(emails []string) ([]string, error) {
+	var suppressed []string
+	if len(emails) == 0 {
+		return nil, nil
+	}
+	err := ug.db.Model(&User{}).Where("email IN (?) AND undeliverable <> ''", emails).
+		Pluck("email", &suppressed).Error
+	return suppressed, err
+}
@@ -0,0 +1,17 @@
+package models
+
+import "testing"
+
+func TestEscapeLike(t *testing.T) {
+	for in, want := range map[string]string{
+		"ana":    "ana",
+		"100%":   `100\%`,
+		"a_b":    `a\_b`,
+		`c:\dir`: `c:\\dir`,
+		`%_\%`:   `\%\_\\\%`,
+	} {
+		if got := escapeLike(in); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gastb.ar/cache"
+	"gastb.ar/models"
+	"gastb.ar/models/modelstest"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const benchPassword = "correct horse battery"
+
+// newBenchUser returns a user service on the modelstest fakes and a
+// stored user whose password is hashed with a bcrypt cost
+func newBenchUser(b testing.TB, cost int) (*models.UserService, *models.User) {
+	b.Helper()
+	users := modelstest.NewUsers()
+	us := models.NewUserServiceWith(users, modelstest.NewSessions(), "bench-hmac-key")
+	hash, err := bcrypt.GenerateFromPassword([]byte(benchPassword), cost)
+	if err != nil {
+		b.Fatal(err)
+	}
+	user := &models.User{
+		Name:         "Ana",
+		Email:        "ana@example.com",
+		PasswordHash: string(hash),
+		TokenHash:    "token",
+	}
+	if err := users.Create(user); err != nil {
+		b.Fatal(err)
+	}
+	return us, user
+}
+
+func TestAuthenticateStates(t *testing.T) {
+	locked := time.Now().Add(time.Hour)
+	deactivated := time.Now()
+	for _, c := range []struct {
+		name  string
+		state func(u *models.User)
+		want  error
+	}{
+		{"active", func(u *models.User) {}, nil},
+		{"deactivated", func(u *models.User) { u.DeactivatedAt = &deactivated }, models.ErrAccountDeactivated},
+		{"locked", func(u *models.User) { u.LockedUntil = &locked }, models.ErrAccountLocked},
+		{"reset required", func(u *models.User) { u.ResetRequired = true }, models.ErrPasswordResetRequired},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			us, user := newBenchUser(t, bcrypt.MinCost)
+			c.state(user)
+			if err := us.Update(user); err != nil {
+				t.Fatal(err)
+			}
+			// Without the password, every account looks the same
+			if _, err := us.Authenticate(user.Email, "wrong"); err != models.ErrInvalidPassword {
+				t.Errorf("wrong password: %v, want ErrInvalidPassword", err)
+			}
+			if _, err := us.Authenticate(user.Email, benchPassword); err != c.want {
+				t.Errorf("right password: %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+// BenchmarkAuthenticate sweeps bcrypt costs around the default: the
+// comparison is nearly all of a login, so this is what each cost adds to
+// every one.
+func BenchmarkAuthenticate(b *testing.B) {
+	for cost := bcrypt.DefaultCost - 2; cost <= bcrypt.DefaultCost+4; cost++ {
+		b.Run(fmt.Sprintf("cost=%d", cost), func(b *testing.B) {
+			us, user := newBenchUser(b, cost)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := us.Authenticate(user.Email, benchPassword); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkByRemember looks up the user of a remember token, as every
+// request of a logged in user does, with and without the session cache.
+// On the fakes the cache only adds its encoding; against Postgres it
+// saves a round trip.
+func BenchmarkByRemember(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%t", cached), func(b *testing.B) {
+			us, user := newBenchUser(b, bcrypt.MinCost)
+			if cached {
+				us.SetSessionCache(cache.NewMemoryCache(), time.Minute)
+			}
+			token, err := us.StartSession(user, models.Client{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := us.ByRemember(token); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// VerificationCode is a short numeric code emailed along with the email
+// verification link, for users who would rather type it in, such as on
+// a phone. A user has at most one; requesting another replaces it. Only
+// the hash of the code is stored.
+type VerificationCode struct {
+	gorm.Model
+	UserID uint `gorm:"not null;unique_index"`
+	// Email is the address the code was sent to
+	Email     string `gorm:"not null"`
+	CodeHash  string `gorm:"not null"`
+	Attempts  int    `gorm:"not null;default:0"`
+	ExpiresAt time.Time
+}
+
+// Verification codes have VerificationCodeDigits digits and can be tried
+// MaxCodeAttempts times within VerificationCodeTTL.
+const (
+	VerificationCodeDigits = 6
+	VerificationCodeTTL    = 30 * time.Minute
+	MaxCodeAttempts        = 5
+)
+
+var (
+	// ErrInvalidCode is returned when a verification code is wrong
+	ErrInvalidCode = errors.New("models: verification code is incorrect")
+	// ErrCodeExpired is returned when there is no usable verification
+	// code: it expired, was tried too many times, or was never sent
+	ErrCodeExpired = errors.New("models: verification code has expired; request a new one")
+)
+
+// verificationCodeGorm stores verification codes
+type verificationCodeGorm struct {
+	db *gorm.DB
+}
+
+// create replaces the user's code with a new one sent to email, and
+// returns it
+func (cg *verificationCodeGorm) create(userID uint, email string,
+	hash func(string) string, now time.Time) (string, error) {
+	code, err := rand.Code(VerificationCodeDigits)
+	if err != nil {
+		return "", err
+	}
+	err = cg.db.Unscoped().Where("user_id = ?", userID).Delete(&VerificationCode{}).Error
+	if err != nil {
+		return "", err
+	}
+	vc := &VerificationCode{
+		UserID:    userID,
+		Email:     email,
+		CodeHash:  hash(code),
+		ExpiresAt: now.Add(VerificationCodeTTL),
+	}
+	if err := cg.db.Create(vc).Error; err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// check counts an attempt at the user's code and deletes the code if it
+// matches. Attempts are counted in one statement, so concurrent guesses
+// can't exceed MaxCodeAttempts.
+func (cg *verificationCodeGorm) check(userID uint, email, codeHash string, now time.Time) error {
+	db := cg.db.Model(&VerificationCode{}).
+		Where("user_id = ? AND attempts < ? AND expires_at > ?",
+			userID, MaxCodeAttempts, now).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrCodeExpired
+	}
+	var vc VerificationCode
+	if err := first(cg.db.Where("user_id = ?", userID), &vc); err != nil {
+		return err
+	}
+	if vc.Email != email {
+		return ErrCodeExpired
+	}
+	if subtle.ConstantTimeCompare([]byte(vc.CodeHash), []byte(codeHash)) != 1 {
+		return ErrInvalidCode
+	}
+	return cg.db.Unscoped().Delete(&vc).Error
+}
+
+// purge deletes codes that expired before a given time
+func (cg *verificationCodeGorm) purge(before time.Time) (int64, error) {
+	db := cg.db.Unscoped().Where("expires_at < ?", before).Delete(&VerificationCode{})
+	return db.RowsAffected, db.Error
+}
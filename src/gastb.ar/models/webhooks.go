@@ -0,0 +1,256 @@
+package models
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gastb.ar/encrypt"
+	"gastb.ar/netguard"
+	"gastb.ar/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Events webhooks can subscribe to
+const (
+	EventUserCreated     = "user.created"
+	EventUserVerified    = "user.verified"
+	EventUserDeleted     = "user.deleted"
+	EventAlertTriggered  = "alert.triggered"
+	EventStocklistShared = "stocklist.shared"
+	// Stocklist changes, relayed from the outbox
+	EventStocklistCreated = "stocklist.created"
+	EventStocklistUpdated = "stocklist.updated"
+	EventStocklistDeleted = "stocklist.deleted"
+)
+
+// WebhookEvents lists every event webhooks can subscribe to
+var WebhookEvents = []string{EventUserCreated, EventUserVerified, EventUserDeleted,
+	EventAlertTriggered, EventStocklistShared,
+	EventStocklistCreated, EventStocklistUpdated, EventStocklistDeleted}
+
+// AdminEvent reports whether an event is about the whole site rather than
+// a single user, so that only admins may subscribe to it
+func AdminEvent(event string) bool {
+	switch event {
+	case EventUserCreated, EventUserVerified, EventUserDeleted:
+		return true
+	}
+	return false
+}
+
+// Webhook is an endpoint a user registered to be notified of events.
+// Payloads are signed with Secret, which the user needs to verify them,
+// so it can't be hashed; it is encrypted instead once the services have
+// a keyring, and the service returns it decrypted.
+type Webhook struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	URL    string `gorm:"not null"`
+	// Events is a comma separated list of event names
+	Events string `gorm:"not null"`
+	Secret string `gorm:"not null"`
+}
+
+// Subscribed reports whether the webhook wants an event
+func (wh *Webhook) Subscribed(event string) bool {
+	for _, e := range strings.Split(wh.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery logs one attempt at delivering an event to a webhook.
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID  uint   `gorm:"not null;index"`
+	EventID    string `gorm:"not null;index"`
+	Event      string `gorm:"not null"`
+	Payload    string `gorm:"type:text"`
+	Attempt    int
+	StatusCode int
+	Error      string
+	Succeeded  bool
+	// NextAttemptAt is when the delivery is retried, if it failed and
+	// attempts are left
+	NextAttemptAt *time.Time
+}
+
+// Errors returned when a webhook fails validation
+var (
+	// ErrURLInvalid is returned when a webhook URL is not an absolute
+	// http(s) URL.
+	ErrURLInvalid = errors.New("models: URL must be an absolute http or https URL")
+
+	// ErrURLNotPublic is returned when a webhook URL points to a
+	// loopback, private or link-local address or to localhost. Names
+	// resolving to one are refused when deliveries connect.
+	ErrURLNotPublic = errors.New("models: URL must point to a public address")
+
+	// ErrEventsInvalid is returned when a webhook subscribes to no events
+	// or to unknown ones.
+	ErrEventsInvalid = errors.New("models: events must be a non-empty list of known events")
+
+	// ErrEventAdminOnly is returned when a user who is not an admin
+	// subscribes to a site-wide event.
+	ErrEventAdminOnly = errors.New("models: only admins may subscribe to user events")
+)
+
+// Number of random bytes in a webhook secret
+const webhookSecretBytes = 32
+
+// WebhookService manages webhooks and their delivery logs.
+type WebhookService struct {
+	db   *gorm.DB
+	keys *encrypt.Keyring
+}
+
+// NewWebhookService instantiates a WebhookService on a database connection.
+func NewWebhookService(db *gorm.DB) *WebhookService {
+	return &WebhookService {
+		db: db,
+	}
+}
+
+// validate normalizes and checks a webhook's URL and events
+func (ws *WebhookService) validate(wh *Webhook) error {
+	if wh.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	u, err := url.Parse(strings.TrimSpace(wh.URL))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrURLInvalid
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if ip := net.ParseIP(host); (ip != nil && !netguard.Public(ip)) ||
+		host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrURLNotPublic
+	}
+	wh.URL = u.String()
+
+	var events []string
+	for _, e := range strings.Split(wh.Events, ",") {
+		e = strings.TrimSpace(e)
+		known := false
+		for _, k := range WebhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return ErrEventsInvalid
+		}
+		events = append(events, e)
+	}
+	wh.Events = strings.Join(events, ",")
+	return nil
+}
+
+// Create validates a webhook, generates its secret and stores it.
+func (ws *WebhookService) Create(wh *Webhook) error {
+	if err := ws.validate(wh); err != nil {
+		return err
+	}
+	secret, err := rand.String(webhookSecretBytes)
+	if err != nil {
+		return err
+	}
+	if wh.Secret, err = ws.encrypt(wh.UserID, secret); err != nil {
+		return err
+	}
+	err = ws.db.Create(wh).Error
+	wh.Secret = secret
+	return err
+}
+
+// ByID looks up a webhook by ID.
+func (ws *WebhookService) ByID(id uint) (*Webhook, error) {
+	var wh Webhook
+	if err := first(ws.db.Where("id = ?", id), &wh); err != nil {
+		return nil, err
+	}
+	if err := ws.decrypt(&wh); err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+// ByUserID returns all the webhooks of a user.
+func (ws *WebhookService) ByUserID(userID uint) ([]Webhook, error) {
+	var whs []Webhook
+	if err := ws.db.Where("user_id = ?", userID).Find(&whs).Error; err != nil {
+		return nil, err
+	}
+	for i := range whs {
+		if err := ws.decrypt(&whs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return whs, nil
+}
+
+// Subscribers returns the webhooks of a user subscribed to an event.
+func (ws *WebhookService) Subscribers(userID uint, event string) ([]Webhook, error) {
+	whs, err := ws.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return subscribed(whs, event), nil
+}
+
+// AdminSubscribers returns the webhooks of admins subscribed to a
+// site-wide event.
+func (ws *WebhookService) AdminSubscribers(event string) ([]Webhook, error) {
+	var whs []Webhook
+	err := ws.db.Joins("JOIN users ON users.id = webhooks.user_id").
+		Where("users.role = ? AND users.deleted_at IS NULL", RoleAdmin).
+		Find(&whs).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range whs {
+		if err := ws.decrypt(&whs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return subscribed(whs, event), nil
+}
+
+// subscribed filters the webhooks subscribed to an event
+func subscribed(whs []Webhook, event string) []Webhook {
+	var subs []Webhook
+	for _, wh := range whs {
+		if wh.Subscribed(event) {
+			subs = append(subs, wh)
+		}
+	}
+	return subs
+}
+
+// Delete deletes a webhook.
+func (ws *WebhookService) Delete(id uint) error {
+	if id == 0 {
+		return ErrInvalidID
+	}
+	return ws.db.Delete(&Webhook{Model: gorm.Model{ID: id}}).Error
+}
+
+// LogDelivery stores the outcome of a delivery attempt.
+func (ws *WebhookService) LogDelivery(d *WebhookDelivery) error {
+	return ws.db.Create(d).Error
+}
+
+// Deliveries returns the latest delivery attempts of a webhook,
+// newest first.
+func (ws *WebhookService) Deliveries(webhookID uint, limit int) ([]WebhookDelivery, error) {
+	var ds []WebhookDelivery
+	err := ws.db.Where("webhook_id = ?", webhookID).
+		Order("created_at desc").Limit(limit).Find(&ds).Error
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
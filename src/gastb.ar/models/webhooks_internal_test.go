@@ -0,0 +1,34 @@
+package models
+
+import "testing"
+
+func TestWebhookValidateURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want error
+	}{
+		{"https://example.com/hook", nil},
+		{"http://93.184.216.34/hook", nil},
+		{"ftp://example.com/hook", ErrURLInvalid},
+		{"/hook", ErrURLInvalid},
+		{"http://127.0.0.1/hook", ErrURLNotPublic},
+		{"http://[::1]:8080/hook", ErrURLNotPublic},
+		{"http://localhost/hook", ErrURLNotPublic},
+		{"http://api.localhost./hook", ErrURLNotPublic},
+		{"http://10.0.0.5/hook", ErrURLNotPublic},
+		{"http://172.16.0.1/hook", ErrURLNotPublic},
+		{"http://192.168.1.1/hook", ErrURLNotPublic},
+		{"http://[fd00::1]/hook", ErrURLNotPublic},
+		{"http://169.254.169.254/latest/meta-data", ErrURLNotPublic},
+		{"http://[fe80::1]/hook", ErrURLNotPublic},
+		{"http://0.0.0.0/hook", ErrURLNotPublic},
+		{"http://[::]/hook", ErrURLNotPublic},
+	}
+	ws := &WebhookService{}
+	for _, c := range cases {
+		wh := &Webhook{UserID: 1, URL: c.url, Events: WebhookEvents[0]}
+		if err := ws.validate(wh); err != c.want {
+			t.Errorf("validate(%q) = %v, want %v", c.url, err, c.want)
+		}
+	}
+}
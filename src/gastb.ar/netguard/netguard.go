@@ -0,0 +1,62 @@
+package netguard
+
+// The netguard package keeps requests to URLs users give, such as
+// webhooks, off the server's own network: loopback, private and
+// link-local addresses, where the internal listener, other services and
+// cloud metadata endpoints are. Addresses are checked as connections are
+// dialed, after DNS resolution, so a name that resolves to a public
+// address when registered and to a private one later is still refused.
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrBlocked is returned when dialing an address that isn't public
+var ErrBlocked = errors.New("netguard: the address is not public")
+
+// Public reports whether ip is a public unicast address. Loopback,
+// private (RFC 1918 and fc00::/7), link-local (169.254.0.0/16, which
+// includes cloud metadata endpoints, and fe80::/10), unspecified and
+// multicast addresses are not. IPv4 addresses mapped to IPv6 are
+// checked as IPv4.
+func Public(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// Control is a net.Dialer Control function refusing connections to
+// addresses that aren't Public
+func Control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !Public(net.ParseIP(host)) {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// Transport returns an HTTP transport that only connects to public
+// addresses. It uses no proxy, which would be dialed instead of the
+// destination.
+func Transport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   Control,
+	}
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
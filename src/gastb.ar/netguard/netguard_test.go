@@ -0,0 +1,72 @@
+package netguard
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublic(t *testing.T) {
+	for _, c := range []struct {
+		class string
+		ip    string
+	}{
+		{"loopback", "127.0.0.1"},
+		{"loopback", "127.1.2.3"},
+		{"loopback", "::1"},
+		{"loopback mapped to IPv6", "::ffff:127.0.0.1"},
+		{"private", "10.0.0.1"},
+		{"private", "172.16.5.4"},
+		{"private", "192.168.1.1"},
+		{"private", "fd00::1"},
+		{"link-local", "169.254.169.254"},
+		{"link-local", "fe80::1"},
+		{"link-local multicast", "ff02::1"},
+		{"unspecified", "0.0.0.0"},
+		{"unspecified", "::"},
+		{"multicast", "224.0.0.1"},
+	} {
+		if Public(net.ParseIP(c.ip)) {
+			t.Errorf("%s address %s is public", c.class, c.ip)
+		}
+	}
+	for _, ip := range []string{"93.184.216.34", "8.8.8.8", "2606:4700:4700::1111"} {
+		if !Public(net.ParseIP(ip)) {
+			t.Errorf("%s isn't public", ip)
+		}
+	}
+	if Public(nil) {
+		t.Error("a nil IP is public")
+	}
+}
+
+func TestControl(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8502", "[::1]:80", "169.254.169.254:80", "10.1.2.3:5432"} {
+		if err := Control("tcp", addr, nil); err != ErrBlocked {
+			t.Errorf("Control(%s) = %v, want ErrBlocked", addr, err)
+		}
+	}
+	if err := Control("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("Control of a public address: %v", err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	client := &http.Client{Transport: Transport()}
+
+	// By address, and by a name resolving to loopback
+	for _, url := range []string{srv.URL, "http://localhost:" + port} {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("GET %s reached the server", url)
+		} else if !errors.Is(err, ErrBlocked) {
+			t.Errorf("GET %s failed with %v, want ErrBlocked", url, err)
+		}
+	}
+}
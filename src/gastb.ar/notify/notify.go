@@ -0,0 +1,170 @@
+package notify
+
+// The notify package streams notifications (price alerts fired,
+// collaboration invites) to the browsers and API clients of a user while
+// they are connected. Notifications are not stored: a user with no open
+// stream misses them.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Notification types
+const (
+	TypeAlertTriggered = "alert.triggered"
+	TypeInvite         = "collaboration.invite"
+)
+
+// Notification is a message for a user
+type Notification struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+	Time time.Time   `json:"time"`
+}
+
+// Broker delivers notifications to the subscribers of a user. Hub is the
+// in-memory implementation for single instance deployments; with several
+// instances, a Redis implementation would publish to a per-user channel
+// and relay what it receives to a local Hub, so that users get
+// notifications whichever instance they are connected to.
+type Broker interface {
+	// Publish sends a notification to every subscriber of a user
+	Publish(userID uint, n Notification) error
+	// Subscribe returns a channel receiving the notifications of a user
+	// and a function to call when done with it. The channel is closed
+	// when the broker is closed.
+	Subscribe(userID uint) (<-chan Notification, func())
+	// Drain stops new subscriptions and closes the existing ones spread
+	// over the time left until ctx's deadline, so that clients reconnect
+	// to other instances gradually rather than all at once. It returns
+	// once every subscription is closed; when ctx is done, the remaining
+	// ones are closed at once.
+	Drain(ctx context.Context)
+	// Close closes every subscription
+	Close()
+}
+
+// Number of notifications buffered per subscriber. Notifications for
+// subscribers that fall further behind are dropped.
+const subscriberBuffer = 16
+
+// Hub is an in-memory Broker
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[uint]map[chan Notification]struct{}
+	closed bool
+}
+
+// NewHub creates an empty Hub
+func NewHub() *Hub {
+	return &Hub {
+		subs: make(map[uint]map[chan Notification]struct{}),
+	}
+}
+
+// Publish implements Broker. It never blocks on slow subscribers.
+func (h *Hub) Publish(userID uint, n Notification) error {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- n:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe implements Broker
+func (h *Hub) Subscribe(userID uint) (<-chan Notification, func()) {
+	ch := make(chan Notification, subscriberBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan Notification]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[userID][ch]; !ok {
+			return
+		}
+		delete(h.subs[userID], ch)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+		close(ch)
+	}
+}
+
+// Drain implements Broker
+func (h *Hub) Drain(ctx context.Context) {
+	h.mu.Lock()
+	h.closed = true
+	n := 0
+	for _, chans := range h.subs {
+		n += len(chans)
+	}
+	h.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	var interval time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		interval = time.Until(deadline) / time.Duration(n)
+	}
+	for h.closeOne() {
+		if interval <= 0 {
+			continue
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			h.Close()
+			return
+		}
+	}
+}
+
+// closeOne closes a subscription, and reports whether there was one
+func (h *Hub) closeOne() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for userID, chans := range h.subs {
+		for ch := range chans {
+			delete(chans, ch)
+			if len(chans) == 0 {
+				delete(h.subs, userID)
+			}
+			close(ch)
+			return true
+		}
+	}
+	return false
+}
+
+// Close implements Broker
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for userID, chans := range h.subs {
+		for ch := range chans {
+			close(ch)
+		}
+		delete(h.subs, userID)
+	}
+}
@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// closed reports whether ch was closed, after reading what is buffered
+func closed(ch <-chan Notification) bool {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	a1, done1 := h.Subscribe(1)
+	a2, done2 := h.Subscribe(1)
+	b, doneB := h.Subscribe(2)
+	defer doneB()
+
+	h.Publish(1, Notification{Type: TypeInvite})
+	for i, ch := range []<-chan Notification{a1, a2} {
+		select {
+		case n := <-ch:
+			if n.Type != TypeInvite || n.Time.IsZero() {
+				t.Errorf("subscriber %d got %+v, want a timed invite", i, n)
+			}
+		default:
+			t.Errorf("subscriber %d got nothing", i)
+		}
+	}
+	select {
+	case n := <-b:
+		t.Errorf("another user's subscriber got %+v", n)
+	default:
+	}
+
+	done1()
+	done1()
+	if !closed(a1) {
+		t.Error("the channel is open after its done function")
+	}
+	h.Publish(1, Notification{Type: TypeAlertTriggered})
+	if n := <-a2; n.Type != TypeAlertTriggered {
+		t.Errorf("remaining subscriber got %+v", n)
+	}
+	done2()
+	if _, ok := h.subs[1]; ok {
+		t.Error("a user without subscribers is still in the hub")
+	}
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	h := NewHub()
+	ch, done := h.Subscribe(1)
+	defer done()
+	// Publish never blocks; what doesn't fit in the buffer is dropped
+	for i := 0; i < subscriberBuffer+5; i++ {
+		h.Publish(1, Notification{Type: TypeInvite})
+	}
+	if len(ch) != subscriberBuffer {
+		t.Errorf("%d notifications buffered, want %d", len(ch), subscriberBuffer)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	h := NewHub()
+	ch, done := h.Subscribe(1)
+	h.Close()
+	if !closed(ch) {
+		t.Error("Close left a subscription open")
+	}
+	done()
+	if late, _ := h.Subscribe(1); !closed(late) {
+		t.Error("a subscription after Close is open")
+	}
+}
+
+func TestHubDrain(t *testing.T) {
+	h := NewHub()
+	var chans []<-chan Notification
+	for i := uint(0); i < 4; i++ {
+		ch, _ := h.Subscribe(i % 2)
+		chans = append(chans, ch)
+	}
+
+	// The subscriptions are closed one at a time over the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	drained := make(chan struct{})
+	go func() {
+		h.Drain(ctx)
+		close(drained)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	open := 0
+	for _, ch := range chans {
+		if !closed(ch) {
+			open++
+		}
+	}
+	if open != 3 {
+		t.Errorf("%d subscriptions open early in the drain, want 3", open)
+	}
+	if late, _ := h.Subscribe(1); !closed(late) {
+		t.Error("a subscription during the drain is open")
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Drain didn't return by its deadline")
+	}
+	for i, ch := range chans {
+		if !closed(ch) {
+			t.Errorf("subscription %d is open after the drain", i)
+		}
+	}
+}
+
+func TestHubDrainCancelled(t *testing.T) {
+	h := NewHub()
+	a, _ := h.Subscribe(1)
+	b, _ := h.Subscribe(2)
+
+	// Without a deadline, every subscription is closed at once
+	h.Drain(context.Background())
+	if !closed(a) || !closed(b) {
+		t.Error("Drain without a deadline left subscriptions open")
+	}
+
+	// A drain cancelled before its deadline closes what is left at once
+	h = NewHub()
+	a, _ = h.Subscribe(1)
+	b, _ = h.Subscribe(2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	h.Drain(ctx)
+	if time.Since(start) > time.Second {
+		t.Errorf("the cancelled drain took %v", time.Since(start))
+	}
+	if !closed(a) || !closed(b) {
+		t.Error("the cancelled drain left subscriptions open")
+	}
+}
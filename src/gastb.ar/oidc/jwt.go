@@ -0,0 +1,211 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwk is a public key of the provider's JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// audience is the aud claim, a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// idToken are the claims of an ID token that are checked, besides
+// Claims
+type idToken struct {
+	Claims
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	Nonce     string   `json:"nonce"`
+	AuthParty string   `json:"azp"`
+}
+
+// verify checks the signature and claims of an ID token and returns its
+// claims. Only RS256 and ES256 signatures are accepted, which covers
+// the providers in use; the token's own alg can't weaken that.
+func (p *Provider) verify(ctx context.Context, raw, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, ErrInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, ErrInvalidToken
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, ErrInvalidToken
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	var tok idToken
+	if err := decodeSegment(parts[1], &tok); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if strings.TrimSuffix(tok.Issuer, "/") != strings.TrimSuffix(p.cfg.Issuer, "/") {
+		return nil, ErrInvalidToken
+	}
+	found := false
+	for _, aud := range tok.Audience {
+		found = found || aud == p.cfg.ClientID
+	}
+	if !found || (len(tok.Audience) > 1 && tok.AuthParty != p.cfg.ClientID) {
+		return nil, ErrInvalidToken
+	}
+	if p.clock.Now().Add(-clockSkew).After(time.Unix(tok.Expiry, 0)) {
+		return nil, ErrExpiredToken
+	}
+	if tok.Nonce != nonce {
+		return nil, ErrNonce
+	}
+	if tok.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	return &tok.Claims, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(seg string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// key returns the provider key with an ID, fetching the keys again if
+// it is unknown, since providers rotate them
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	doc, err := p.discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", doc.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	status, err := p.getJSON(req, &set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: keys endpoint responded %d", status)
+	}
+	p.keys = make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = pub
+		}
+	}
+	k, ok := p.keys[kid]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return k, nil
+}
+
+// publicKey decodes an RSA or P-256 key
+func (k jwk) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("oidc: invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("oidc: unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !pub.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("oidc: EC key is not on its curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("oidc: unsupported key type %s", k.Kty)
+}
@@ -0,0 +1,181 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gastb.ar/clock"
+)
+
+// testProvider serves a discovery document and a key set with an RSA
+// key "rsa" and a P-256 key "ec"
+func testProvider(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, now time.Time) *Provider {
+	t.Helper()
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discovery{Issuer: issuer, AuthorizationEndpoint: issuer + "/auth",
+			TokenEndpoint: issuer + "/token", JWKSURI: issuer + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {
+			{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(rsaKey.N.Bytes()),
+				E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))),
+				Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	issuer = srv.URL
+	p := New(Config{Issuer: issuer, ClientID: "gastb"})
+	p.SetClock(clock.NewFake(now))
+	return p
+}
+
+// sign builds a token of header and claims, signed according to alg:
+// RS256 and ES256 with the keys, HS256 with secret, none with nothing
+func sign(t *testing.T, header, claims map[string]interface{}, rsaKey *rsa.PrivateKey,
+	ecKey *ecdsa.PrivateKey, secret []byte) string {
+	t.Helper()
+	seg := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(header) + "." + seg(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch header["alg"] {
+	case "RS256":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	p := testProvider(t, rsaKey, ecKey, now)
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// claims returns valid claims changed by fn
+	claims := func(fn func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": p.cfg.Issuer, "aud": "gastb", "exp": now.Add(time.Hour).Unix(),
+			"nonce": "n0nce", "sub": "ana", "email": "ana@example.com",
+		}
+		if fn != nil {
+			fn(c)
+		}
+		return c
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+	es256 := map[string]interface{}{"alg": "ES256", "kid": "ec"}
+	valid := sign(t, rs256, claims(nil), rsaKey, ecKey, nil)
+	parts := strings.Split(valid, ".")
+	tampered := sign(t, rs256, claims(func(c map[string]interface{}) { c["sub"] = "bob" }), rsaKey, ecKey, nil)
+
+	cases := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"RS256", valid, nil},
+		{"ES256", sign(t, es256, claims(nil), rsaKey, ecKey, nil), nil},
+		{"aud among several with azp", sign(t, rs256, claims(func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{"other", "gastb"}, "gastb"
+		}), rsaKey, ecKey, nil), nil},
+		{"expired within the skew", sign(t, rs256, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-time.Minute).Unix()
+		}), rsaKey, ecKey, nil), nil},
+
+		{"alg none", sign(t, map[string]interface{}{"alg": "none", "kid": "rsa"}, claims(nil),
+			rsaKey, ecKey, nil), ErrInvalidToken},
+		{"HS256 keyed with the public key", sign(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"},
+			claims(nil), rsaKey, ecKey, pubDER), ErrInvalidToken},
+		{"ES256 on the RSA key", sign(t, map[string]interface{}{"alg": "ES256", "kid": "rsa"},
+			claims(nil), rsaKey, ecKey, nil), ErrInvalidToken},
+		{"RS256 on the EC key", sign(t, map[string]interface{}{"alg": "RS256", "kid": "ec"},
+			claims(nil), rsaKey, ecKey, nil), ErrInvalidToken},
+		{"signed by another key", sign(t, rs256, claims(nil), otherKey, ecKey, nil), ErrInvalidToken},
+		{"unknown kid", sign(t, map[string]interface{}{"alg": "RS256", "kid": "gone"},
+			claims(nil), rsaKey, ecKey, nil), ErrInvalidToken},
+		{"tampered payload", parts[0] + "." + strings.Split(tampered, ".")[1] + "." + parts[2], ErrInvalidToken},
+		{"two segments", parts[0] + "." + parts[1], ErrInvalidToken},
+		{"wrong issuer", sign(t, rs256, claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		}), rsaKey, ecKey, nil), ErrInvalidToken},
+		{"wrong audience", sign(t, rs256, claims(func(c map[string]interface{}) {
+			c["aud"] = "other"
+		}), rsaKey, ecKey, nil), ErrInvalidToken},
+		{"several audiences without azp", sign(t, rs256, claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"gastb", "other"}
+		}), rsaKey, ecKey, nil), ErrInvalidToken},
+		{"no subject", sign(t, rs256, claims(func(c map[string]interface{}) {
+			delete(c, "sub")
+		}), rsaKey, ecKey, nil), ErrInvalidToken},
+		{"expired", sign(t, rs256, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-clockSkew - time.Second).Unix()
+		}), rsaKey, ecKey, nil), ErrExpiredToken},
+		{"wrong nonce", sign(t, rs256, claims(func(c map[string]interface{}) {
+			c["nonce"] = "other"
+		}), rsaKey, ecKey, nil), ErrNonce},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := p.verify(context.Background(), c.token, "n0nce")
+			if err != c.want {
+				t.Fatalf("verify = %v, want %v", err, c.want)
+			}
+			if err == nil && got.Subject != "ana" {
+				t.Errorf("subject = %q, want ana", got.Subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package oidc
+
+// The oidc package signs users in through an OpenID Connect provider,
+// as a relying party using the authorization code flow with PKCE. The
+// provider's endpoints and keys are discovered from its issuer URL, and
+// ID tokens are verified against its published keys before their claims
+// are trusted.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gastb.ar/clock"
+	"gastb.ar/tracing"
+)
+
+// Config identifies the relying party to the provider
+type Config struct {
+	// Issuer is the provider's issuer URL, where its discovery document
+	// lives under /.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback the provider sends users back to; it
+	// must be registered with the provider
+	RedirectURL string
+}
+
+// Claims are the claims of a verified ID token that sign-in relies on
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// Errors returned when a sign-in can't be completed
+var (
+	ErrInvalidToken = errors.New("oidc: ID token is invalid")
+	ErrExpiredToken = errors.New("oidc: ID token has expired")
+	ErrNonce        = errors.New("oidc: ID token nonce does not match")
+)
+
+// clockSkew is how far the provider's clock may be off from ours
+const clockSkew = 2 * time.Minute
+
+// discoveryTTL is how long the discovery document and keys are cached
+const discoveryTTL = time.Hour
+
+// discovery is the part of the provider's discovery document in use
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect provider. It fetches the discovery
+// document and keys on first use rather than at startup, so the site
+// still starts when the provider is down.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+	clock  clock.Clock
+
+	mu        sync.Mutex
+	doc       *discovery
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+// New creates a Provider
+func New(cfg Config) *Provider {
+	return &Provider{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &tracing.Transport{},
+		},
+		clock: clock.Real,
+	}
+}
+
+// SetClock sets the clock ID tokens are checked against
+func (p *Provider) SetClock(c clock.Clock) {
+	p.clock = c
+}
+
+// AuthURL returns the provider URL to send users to for signing in.
+// state is echoed back to the callback, nonce ends up in the ID token
+// and verifier is the PKCE code verifier, to be passed to Exchange; all
+// three must be random and kept until the callback.
+func (p *Provider) AuthURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	doc, err := p.discovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the code the provider sent to the callback for an ID
+// token, and returns its claims once it is verified to come from the
+// provider, for this client, with nonce
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	doc, err := p.discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", doc.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	status, err := p.getJSON(req, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token endpoint responded %d %s", status, tokens.Error)
+	}
+	return p.verify(ctx, tokens.IDToken, nonce)
+}
+
+// discovery returns the provider's discovery document, fetching it if it
+// isn't cached
+func (p *Provider) discovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.doc != nil && p.clock.Now().Sub(p.fetchedAt) < discoveryTTL {
+		return p.doc, nil
+	}
+	issuer := strings.TrimSuffix(p.cfg.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var doc discovery
+	status, err := p.getJSON(req, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery responded %d", status)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: discovery document is for issuer %q", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	p.doc = &doc
+	p.keys = nil
+	p.fetchedAt = p.clock.Now()
+	return p.doc, nil
+}
+
+// getJSON sends a request and decodes a JSON response of any status
+func (p *Provider) getJSON(req *http.Request, dst interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst); err != nil {
+		return resp.StatusCode, fmt.Errorf("oidc: %s responded %d with invalid JSON", req.URL.Host, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
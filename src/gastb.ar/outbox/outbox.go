@@ -0,0 +1,124 @@
+package outbox
+
+// The outbox package relays the changes logged in the outbox table,
+// models.Change, to consumers such as webhooks and an event bus. Each
+// consumer keeps a cursor in the database, moved past a batch of changes
+// only once it handled all of them, so a change is delivered at least
+// once even across crashes and restarts; consumers must tolerate seeing
+// one again. One instance at a time relays, under a database lock.
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"gastb.ar/metrics"
+	"gastb.ar/models"
+)
+
+// DefaultInterval is how often the outbox is polled for new changes
+const DefaultInterval = time.Second
+
+// batchSize is how many changes a consumer is handed at once
+const batchSize = 100
+
+var relayed = metrics.NewCounter("outbox_changes_total",
+	"Outbox changes relayed by consumer and result.", "consumer", "result")
+
+// Consumer handles a batch of changes, oldest first. If it returns an
+// error, the whole batch is handed to it again on the next poll.
+type Consumer func(ctx context.Context, changes []models.Change) error
+
+// Relay polls the outbox and hands new changes to its consumers.
+type Relay struct {
+	cs        *models.ChangeService
+	consumers map[string]Consumer
+	logger    *slog.Logger
+}
+
+// New creates a Relay with no consumers
+func New(cs *models.ChangeService, logger *slog.Logger) *Relay {
+	return &Relay{
+		cs:        cs,
+		consumers: make(map[string]Consumer),
+		logger:    logger,
+	}
+}
+
+// Add registers a consumer under a name, which keys its cursor and so
+// must not change between deployments. A new consumer starts with the
+// changes made after it was first run. It is meant to be called before
+// Run.
+func (r *Relay) Add(name string, c Consumer) {
+	r.consumers[name] = c
+}
+
+// Run relays changes every interval until the returned function is
+// called.
+func (r *Relay) Run(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := r.cs.Relay(func() error { return r.Once(ctx) }); err != nil {
+					r.logger.Error("relaying outbox failed", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// Once hands every consumer the changes it hasn't handled yet, in
+// batches, until it is caught up or fails. Errors of consumers are
+// logged; only errors reading or moving cursors are returned.
+func (r *Relay) Once(ctx context.Context) error {
+	names := make([]string, 0, len(r.consumers))
+	for name := range r.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := r.drain(ctx, name, r.consumers[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain hands a consumer its pending changes
+func (r *Relay) drain(ctx context.Context, name string, c Consumer) error {
+	seq, err := r.cs.Cursor(name)
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		changes, err := r.cs.After(seq, batchSize)
+		if err != nil || len(changes) == 0 {
+			return err
+		}
+		if err := c(ctx, changes); err != nil {
+			relayed.Add(float64(len(changes)), name, "failure")
+			r.logger.Warn("outbox consumer failed, retrying", "consumer", name,
+				"from", changes[0].Seq, "error", err)
+			return nil
+		}
+		relayed.Add(float64(len(changes)), name, "success")
+		seq = changes[len(changes)-1].Seq
+		if err := r.cs.Advance(name, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
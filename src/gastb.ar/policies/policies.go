@@ -0,0 +1,129 @@
+package policies
+
+// The policies package loads the versions of the site's policy
+// documents, such as the terms of service, that users must accept. Each
+// kind of document is a directory holding one HTML fragment per version,
+// named after the version:
+//
+//	policies/terms/2026-01-01.html
+//	policies/terms/2026-10-15.html
+//	policies/privacy/2026-01-01.html
+//
+// Versions are compared as strings, so dates make good names; the
+// greatest is the current one. Old versions stay, so users can see what
+// they accepted.
+
+import (
+	"errors"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gastb.ar/models"
+)
+
+// Kinds of documents, in the order they are shown
+const (
+	Terms   = "terms"
+	Privacy = "privacy"
+)
+
+var kinds = []string{Terms, Privacy}
+
+// Document is a version of a policy document
+type Document struct {
+	models.Policy
+	// Body is HTML written by the site's operators
+	Body template.HTML
+}
+
+// Set is every version of the site's documents
+type Set struct {
+	// versions maps kinds to their versions, oldest first
+	versions map[string][]*Document
+}
+
+// ErrNotFound is returned for unknown kinds and versions
+var ErrNotFound = errors.New("policies: document not found")
+
+// Load reads the documents in dir. Kinds without a directory are left
+// out; a set without documents asks nothing of users.
+func Load(dir string) (*Set, error) {
+	s := &Set{versions: make(map[string][]*Document)}
+	for _, kind := range kinds {
+		files, err := filepath.Glob(filepath.Join(dir, kind, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		for _, f := range files {
+			body, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			s.versions[kind] = append(s.versions[kind], &Document{
+				Policy: models.Policy{
+					Kind:    kind,
+					Version: strings.TrimSuffix(filepath.Base(f), ".html"),
+				},
+				Body: template.HTML(body),
+			})
+		}
+	}
+	return s, nil
+}
+
+// Current returns the current version of every kind of document
+func (s *Set) Current() []*Document {
+	var docs []*Document
+	for _, kind := range kinds {
+		if versions := s.versions[kind]; len(versions) > 0 {
+			docs = append(docs, versions[len(versions)-1])
+		}
+	}
+	return docs
+}
+
+// Policies returns the current versions as models.Policy values
+func (s *Set) Policies() []models.Policy {
+	var ps []models.Policy
+	for _, d := range s.Current() {
+		ps = append(ps, d.Policy)
+	}
+	return ps
+}
+
+// Get returns a version of a kind of document; an empty version means
+// the current one
+func (s *Set) Get(kind, version string) (*Document, error) {
+	versions := s.versions[kind]
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	if version == "" {
+		return versions[len(versions)-1], nil
+	}
+	for _, d := range versions {
+		if d.Version == version {
+			return d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Filter returns the documents among the current ones whose Policy is
+// in ps
+func (s *Set) Filter(ps []models.Policy) []*Document {
+	var docs []*Document
+	for _, d := range s.Current() {
+		for _, p := range ps {
+			if d.Policy == p {
+				docs = append(docs, d)
+				break
+			}
+		}
+	}
+	return docs
+}
@@ -0,0 +1,189 @@
+package quotes
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"gastb.ar/metrics"
+)
+
+// Defaults of a Batcher
+const (
+	DefaultInterval = 100 * time.Millisecond
+	DefaultMaxBatch = 50
+	DefaultTimeout  = 10 * time.Second
+)
+
+var (
+	lookups = metrics.NewCounter("quote_lookups_total",
+		"Quote lookups by whether they joined a pending or running request.", "result")
+	requests = metrics.NewCounter("quote_provider_requests_total",
+		"Requests to the quote provider by result.", "result")
+)
+
+// Batcher coalesces quote lookups. Symbols asked for within Interval of
+// the first one are fetched with one provider request, of at most
+// MaxBatch symbols; a lookup of a symbol that is already pending or being
+// fetched waits for that request instead of starting another.
+type Batcher struct {
+	provider Provider
+
+	// Interval is how long symbols are collected before a request
+	Interval time.Duration
+	// MaxBatch is the most symbols sent in one request; a batch is sent
+	// as soon as it is full
+	MaxBatch int
+	// Timeout bounds provider requests. They are not cancelled with the
+	// lookups waiting on them, since other lookups may be waiting too.
+	Timeout time.Duration
+
+	mu sync.Mutex
+	// pending collects the symbols of the next request
+	pending *batch
+	// running maps the symbols being fetched to their request
+	running map[string]*batch
+}
+
+// batch is one provider request
+type batch struct {
+	symbols []string
+	done    chan struct{}
+	quotes  map[string]Quote
+	err     error
+}
+
+// NewBatcher returns a batcher with the default settings. Requests go
+// through a Breaker around p, so lookups fail fast with ErrUnavailable
+// while the provider is down.
+func NewBatcher(p Provider) *Batcher {
+	return &Batcher{
+		provider: NewBreaker(p),
+		Interval: DefaultInterval,
+		MaxBatch: DefaultMaxBatch,
+		Timeout:  DefaultTimeout,
+		running:  make(map[string]*batch),
+	}
+}
+
+// Quote returns the quote of a symbol, or ErrNotFound if the provider
+// doesn't know it
+func (b *Batcher) Quote(ctx context.Context, symbol string) (Quote, error) {
+	quotes, err := b.Quotes(ctx, []string{symbol})
+	if err != nil {
+		return Quote{}, err
+	}
+	q, ok := quotes[normalize(symbol)]
+	if !ok {
+		return Quote{}, ErrNotFound
+	}
+	return q, nil
+}
+
+// Quotes returns the quotes of symbols by upper case symbol. Symbols the
+// provider doesn't know are left out. It returns the error of any
+// request it waited on, or ctx's once it is done.
+func (b *Batcher) Quotes(ctx context.Context, symbols []string) (map[string]Quote, error) {
+	waits := make(map[*batch][]string)
+	b.mu.Lock()
+	for _, s := range symbols {
+		s = normalize(s)
+		if bt, ok := b.running[s]; ok {
+			lookups.Inc("joined_running")
+			waits[bt] = append(waits[bt], s)
+			continue
+		}
+		bt := b.add(s)
+		waits[bt] = append(waits[bt], s)
+	}
+	b.mu.Unlock()
+
+	quotes := make(map[string]Quote, len(symbols))
+	for bt, syms := range waits {
+		select {
+		case <-bt.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if bt.err != nil {
+			return nil, bt.err
+		}
+		for _, s := range syms {
+			if q, ok := bt.quotes[s]; ok {
+				quotes[s] = q
+			}
+		}
+	}
+	return quotes, nil
+}
+
+// add puts a symbol in the pending batch, starting one if there is none,
+// and returns the batch. b.mu must be held.
+func (b *Batcher) add(symbol string) *batch {
+	if bt := b.pending; bt != nil {
+		for _, s := range bt.symbols {
+			if s == symbol {
+				lookups.Inc("joined_pending")
+				return bt
+			}
+		}
+	}
+	lookups.Inc("new")
+	if b.pending == nil {
+		bt := &batch{done: make(chan struct{})}
+		b.pending = bt
+		time.AfterFunc(b.Interval, func() { b.flush(bt) })
+	}
+	bt := b.pending
+	bt.symbols = append(bt.symbols, symbol)
+	if len(bt.symbols) >= b.MaxBatch {
+		b.pending = nil
+		b.start(bt)
+	}
+	return bt
+}
+
+// flush sends a batch once its interval is over, unless it was sent when
+// it filled up
+func (b *Batcher) flush(bt *batch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending != bt {
+		return
+	}
+	b.pending = nil
+	b.start(bt)
+}
+
+// start marks the symbols of a batch as running and fetches them in the
+// background. b.mu must be held.
+func (b *Batcher) start(bt *batch) {
+	for _, s := range bt.symbols {
+		b.running[s] = bt
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), b.Timeout)
+		defer cancel()
+		bt.quotes, bt.err = b.provider.Quotes(ctx, bt.symbols)
+		if bt.err != nil {
+			requests.Inc("error")
+		} else {
+			requests.Inc("ok")
+		}
+
+		b.mu.Lock()
+		for _, s := range bt.symbols {
+			if b.running[s] == bt {
+				delete(b.running, s)
+			}
+		}
+		b.mu.Unlock()
+		close(bt.done)
+	}()
+}
+
+// normalize returns the form symbols are requested and returned in
+func normalize(symbol string) string {
+	return strings.ToUpper(strings.TrimSpace(symbol))
+}
@@ -0,0 +1,177 @@
+package quotes
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider quotes every symbol but UNKNOWN at 10 USD, recording the
+// symbols of each request. If release is set, requests wait for it.
+type fakeProvider struct {
+	release chan struct{}
+	err     error
+
+	mu       sync.Mutex
+	requests [][]string
+}
+
+func (fp *fakeProvider) Quotes(ctx context.Context, symbols []string) (map[string]Quote, error) {
+	fp.mu.Lock()
+	fp.requests = append(fp.requests, append([]string(nil), symbols...))
+	fp.mu.Unlock()
+	if fp.release != nil {
+		<-fp.release
+	}
+	if fp.err != nil {
+		return nil, fp.err
+	}
+	quotes := make(map[string]Quote)
+	for _, s := range symbols {
+		if s != "UNKNOWN" {
+			quotes[s] = Quote{Symbol: s, Price: 10, Currency: "USD"}
+		}
+	}
+	return quotes, nil
+}
+
+// sent returns the symbols of each request, sorted
+func (fp *fakeProvider) sent() [][]string {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	var reqs [][]string
+	for _, r := range fp.requests {
+		r = append([]string(nil), r...)
+		sort.Strings(r)
+		reqs = append(reqs, r)
+	}
+	return reqs
+}
+
+func TestBatcherCoalesces(t *testing.T) {
+	fp := &fakeProvider{}
+	b := NewBatcher(fp)
+	b.Interval = 20 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for _, s := range []string{"aapl", "AAPL", " msft ", "MSFT", "aapl"} {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			q, err := b.Quote(context.Background(), s)
+			if err != nil {
+				t.Errorf("Quote(%q): %v", s, err)
+				return
+			}
+			if q.Symbol != normalize(s) || q.Price != 10 {
+				t.Errorf("Quote(%q) = %+v", s, q)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	reqs := fp.sent()
+	if len(reqs) != 1 || len(reqs[0]) != 2 || reqs[0][0] != "AAPL" || reqs[0][1] != "MSFT" {
+		t.Errorf("provider requests = %v, want one for [AAPL MSFT]", reqs)
+	}
+}
+
+func TestBatcherMaxBatch(t *testing.T) {
+	fp := &fakeProvider{}
+	b := NewBatcher(fp)
+	// A full batch is sent right away, long before its interval is over
+	b.Interval = time.Hour
+	b.MaxBatch = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	quotes, err := b.Quotes(ctx, []string{"AAPL", "MSFT"})
+	if err != nil {
+		t.Fatalf("Quotes: %v", err)
+	}
+	if len(quotes) != 2 {
+		t.Errorf("Quotes returned %v, want AAPL and MSFT", quotes)
+	}
+	if reqs := fp.sent(); len(reqs) != 1 {
+		t.Errorf("provider requests = %v, want one", reqs)
+	}
+}
+
+func TestBatcherJoinsRunning(t *testing.T) {
+	fp := &fakeProvider{release: make(chan struct{})}
+	b := NewBatcher(fp)
+	b.Interval = time.Millisecond
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := b.Quote(context.Background(), "AAPL")
+		first <- err
+	}()
+	// Wait for the request to start, then look the symbol up again
+	for deadline := time.Now().Add(5 * time.Second); len(fp.sent()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the batch was never sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error, 1)
+	go func() {
+		_, err := b.Quote(context.Background(), "aapl")
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(fp.release)
+
+	for _, c := range []chan error{first, second} {
+		if err := <-c; err != nil {
+			t.Errorf("Quote: %v", err)
+		}
+	}
+	if reqs := fp.sent(); len(reqs) != 1 {
+		t.Errorf("provider requests = %v, want the second lookup to join the first", reqs)
+	}
+}
+
+func TestBatcherErrors(t *testing.T) {
+	b := NewBatcher(&fakeProvider{})
+	b.Interval = time.Millisecond
+	if _, err := b.Quote(context.Background(), "UNKNOWN"); err != ErrNotFound {
+		t.Errorf("Quote of an unknown symbol returned %v, want ErrNotFound", err)
+	}
+
+	errDown := errors.New("provider down")
+	b = NewBatcher(&fakeProvider{err: errDown})
+	b.Interval = time.Millisecond
+	if _, err := b.Quotes(context.Background(), []string{"AAPL"}); err != errDown {
+		t.Errorf("Quotes returned %v, want the provider's error", err)
+	}
+
+	fp := &fakeProvider{release: make(chan struct{})}
+	defer close(fp.release)
+	b = NewBatcher(fp)
+	b.Interval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.Quote(ctx, "AAPL"); err != context.DeadlineExceeded {
+		t.Errorf("Quote returned %v once its context was done, want DeadlineExceeded", err)
+	}
+}
+
+func TestBatcherBreaker(t *testing.T) {
+	errDown := errors.New("provider down")
+	fp := &fakeProvider{err: errDown}
+	b := NewBatcher(fp)
+	b.Interval = time.Millisecond
+	for i := 0; i < DefaultFailures; i++ {
+		b.Quote(context.Background(), "AAPL")
+	}
+	if _, err := b.Quote(context.Background(), "AAPL"); err != ErrUnavailable {
+		t.Errorf("after %d failures Quote returned %v, want ErrUnavailable", DefaultFailures, err)
+	}
+	if reqs := fp.sent(); len(reqs) != DefaultFailures {
+		t.Errorf("the provider got %d requests, want %d", len(reqs), DefaultFailures)
+	}
+}
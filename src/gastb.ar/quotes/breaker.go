@@ -0,0 +1,142 @@
+package quotes
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gastb.ar/clock"
+	"gastb.ar/metrics"
+)
+
+// Defaults of a Breaker
+const (
+	DefaultFailures = 5
+	DefaultCooldown = 30 * time.Second
+)
+
+// ErrUnavailable is returned while the provider is considered down, so
+// that callers can show prices as unavailable instead of waiting
+var ErrUnavailable = errors.New("quotes: provider unavailable")
+
+var (
+	breakerOpen = metrics.NewGauge("quote_breaker_open",
+		"Whether the quote provider circuit breaker is open (1) or closed (0).")
+	breakerRejected = metrics.NewCounter("quote_breaker_rejected_total",
+		"Quote requests failed fast by the circuit breaker.")
+)
+
+// circuit is the state of a Breaker
+type circuit int
+
+const (
+	closed circuit = iota
+	open
+	halfOpen
+)
+
+// Breaker is a Provider that stops calling the provider it wraps after
+// Failures consecutive failures. While open it fails every request with
+// ErrUnavailable; after Cooldown it lets a single probe request through,
+// which closes it again if it succeeds and reopens it if it fails.
+type Breaker struct {
+	provider Provider
+	clock    clock.Clock
+
+	// Failures is how many consecutive failures open the breaker
+	Failures int
+	// Cooldown is how long the breaker stays open before probing
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	state    circuit
+	failures int
+	openedAt time.Time
+}
+
+var _ Provider = &Breaker{}
+
+// NewBreaker returns a breaker around p with the default settings
+func NewBreaker(p Provider) *Breaker {
+	return &Breaker{
+		provider: p,
+		clock:    clock.Real,
+		Failures: DefaultFailures,
+		Cooldown: DefaultCooldown,
+	}
+}
+
+// SetClock replaces the clock used to time the cooldown, for tests
+func (b *Breaker) SetClock(c clock.Clock) {
+	b.clock = c
+}
+
+// Quotes implements Provider
+func (b *Breaker) Quotes(ctx context.Context, symbols []string) (map[string]Quote, error) {
+	if !b.allow() {
+		breakerRejected.Inc()
+		return nil, ErrUnavailable
+	}
+	quotes, err := b.provider.Quotes(ctx, symbols)
+	// A request cancelled by its caller says nothing about the provider
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		b.release()
+		return nil, err
+	}
+	b.record(err)
+	return quotes, err
+}
+
+// allow reports whether a request may go to the provider, turning an
+// open breaker half-open once its cooldown is over
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case open:
+		if b.clock.Now().Sub(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.state = halfOpen
+		return true
+	case halfOpen:
+		// The probe is still running
+		return false
+	}
+	return true
+}
+
+// release lets another request probe when a probe was cancelled
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == halfOpen {
+		b.state = open
+		b.openedAt = time.Time{}
+	}
+}
+
+// record updates the breaker with the result of a request
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != closed {
+			slog.Info("quote provider is back, closing circuit breaker")
+			breakerOpen.Set(0)
+		}
+		b.state, b.failures = closed, 0
+		return
+	}
+	b.failures++
+	if b.state == halfOpen || b.failures >= b.Failures {
+		if b.state == closed {
+			slog.Warn("quote provider is failing, opening circuit breaker",
+				"failures", b.failures, "error", err)
+			breakerOpen.Set(1)
+		}
+		b.state, b.openedAt = open, b.clock.Now()
+	}
+}
@@ -0,0 +1,162 @@
+package quotes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gastb.ar/clock"
+)
+
+// providerFunc is a Provider answering with a function
+type providerFunc func(ctx context.Context, symbols []string) (map[string]Quote, error)
+
+func (f providerFunc) Quotes(ctx context.Context, symbols []string) (map[string]Quote, error) {
+	return f(ctx, symbols)
+}
+
+// flakyProvider fails while err is set, counting requests
+type flakyProvider struct {
+	err   error
+	calls int
+}
+
+func (fp *flakyProvider) Quotes(ctx context.Context, symbols []string) (map[string]Quote, error) {
+	fp.calls++
+	return nil, fp.err
+}
+
+func newTestBreaker(p Provider) (*Breaker, *clock.Fake) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewBreaker(p)
+	b.SetClock(clk)
+	b.Failures = 3
+	b.Cooldown = time.Minute
+	return b, clk
+}
+
+func TestBreaker(t *testing.T) {
+	errDown := errors.New("provider down")
+	fp := &flakyProvider{err: errDown}
+	b, clk := newTestBreaker(fp)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.Quotes(ctx, []string{"AAPL"}); err != errDown {
+			t.Fatalf("request %d returned %v, want the provider's error", i, err)
+		}
+	}
+	if _, err := b.Quotes(ctx, []string{"AAPL"}); err != ErrUnavailable {
+		t.Fatalf("after 3 failures Quotes returned %v, want ErrUnavailable", err)
+	}
+	if fp.calls != 3 {
+		t.Errorf("the open breaker called the provider: %d calls, want 3", fp.calls)
+	}
+
+	// After the cooldown a failing probe reopens the breaker at once
+	clk.Advance(time.Minute)
+	if _, err := b.Quotes(ctx, []string{"AAPL"}); err != errDown {
+		t.Fatalf("probe returned %v, want the provider's error", err)
+	}
+	if _, err := b.Quotes(ctx, []string{"AAPL"}); err != ErrUnavailable {
+		t.Fatalf("after a failed probe Quotes returned %v, want ErrUnavailable", err)
+	}
+
+	// A successful probe closes it
+	clk.Advance(time.Minute)
+	fp.err = nil
+	if _, err := b.Quotes(ctx, []string{"AAPL"}); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	fp.err = errDown
+	for i := 0; i < 2; i++ {
+		b.Quotes(ctx, []string{"AAPL"})
+	}
+	if _, err := b.Quotes(ctx, []string{"AAPL"}); err != errDown {
+		t.Errorf("the closed breaker returned %v before 3 new failures, want the provider's error", err)
+	}
+}
+
+func TestBreakerSuccessResets(t *testing.T) {
+	errDown := errors.New("provider down")
+	fp := &flakyProvider{err: errDown}
+	b, _ := newTestBreaker(fp)
+	ctx := context.Background()
+
+	b.Quotes(ctx, nil)
+	b.Quotes(ctx, nil)
+	fp.err = nil
+	b.Quotes(ctx, nil)
+	fp.err = errDown
+	b.Quotes(ctx, nil)
+	b.Quotes(ctx, nil)
+	if _, err := b.Quotes(ctx, nil); err == ErrUnavailable {
+		t.Error("failures before a success counted towards opening the breaker")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	errDown := errors.New("provider down")
+	fp := &flakyProvider{err: errDown}
+	b, clk := newTestBreaker(fp)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		b.Quotes(ctx, nil)
+	}
+	clk.Advance(time.Minute)
+
+	// While a probe runs, other requests fail fast
+	started, finish := make(chan struct{}), make(chan struct{})
+	b.provider = providerFunc(func(ctx context.Context, symbols []string) (map[string]Quote, error) {
+		close(started)
+		<-finish
+		return nil, nil
+	})
+	done := make(chan error)
+	go func() {
+		_, err := b.Quotes(ctx, nil)
+		done <- err
+	}()
+	<-started
+	if _, err := b.Quotes(ctx, nil); err != ErrUnavailable {
+		t.Errorf("Quotes during the probe returned %v, want ErrUnavailable", err)
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	fp.err, b.provider = nil, fp
+	if _, err := b.Quotes(ctx, nil); err != nil {
+		t.Errorf("after a successful probe Quotes returned %v", err)
+	}
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	errDown := errors.New("provider down")
+	b, clk := newTestBreaker(&flakyProvider{err: errDown})
+	for i := 0; i < 3; i++ {
+		b.Quotes(context.Background(), nil)
+	}
+	clk.Advance(time.Minute)
+
+	// A probe its caller cancelled neither closes nor reopens the
+	// breaker; the next request probes again
+	ctx, cancel := context.WithCancel(context.Background())
+	b.provider = providerFunc(func(ctx context.Context, symbols []string) (map[string]Quote, error) {
+		cancel()
+		return nil, ctx.Err()
+	})
+	if _, err := b.Quotes(ctx, nil); err != context.Canceled {
+		t.Fatalf("cancelled probe returned %v, want Canceled", err)
+	}
+	probed := false
+	b.provider = providerFunc(func(ctx context.Context, symbols []string) (map[string]Quote, error) {
+		probed = true
+		return nil, nil
+	})
+	if _, err := b.Quotes(context.Background(), nil); err != nil || !probed {
+		t.Errorf("after a cancelled probe Quotes returned %v and probed %v, want a new probe",
+			err, probed)
+	}
+}
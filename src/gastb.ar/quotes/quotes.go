@@ -0,0 +1,32 @@
+package quotes
+
+// The quotes package gets stock prices from a third-party provider.
+// Providers rate limit their clients, so lookups go through a Batcher,
+// which sends one request for every symbol asked for in an interval, and
+// only one for a symbol however many users ask for it at once. A Breaker
+// between the two stops calling a provider that keeps failing.
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Quote is the latest price of a symbol
+type Quote struct {
+	Symbol   string
+	Price    float64
+	Currency string
+	// Time is when the provider last saw the price change
+	Time time.Time
+}
+
+// Provider fetches quotes from a third-party service. Quotes returns the
+// quotes it found, keyed by the symbols as given; symbols it doesn't know
+// are left out.
+type Provider interface {
+	Quotes(ctx context.Context, symbols []string) (map[string]Quote, error)
+}
+
+// ErrNotFound is returned for symbols the provider doesn't know
+var ErrNotFound = errors.New("quotes: symbol not found")
@@ -1,10 +1,13 @@
 package rand
 
 // The rand package wraps crypto/rand and generates user remember tokens
+// and numeric codes
 
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
+	"math/big"
 )
 
 // Number of bytes used to generate tokens
@@ -34,3 +37,14 @@ func String(n int) (string, error) {
 func RememberToken() (string, error) {
 	return String(RememberTokenBytes)
 }
+
+// Code returns a string of n random decimal digits, such as a one time
+// code for users to type in
+func Code(n int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", n, v), nil
+}
@@ -0,0 +1,116 @@
+package ratelimit
+
+// The ratelimit package implements token bucket rate limiting. Buckets are
+// kept in a Store, so that they can live in memory for a single instance or
+// in a shared backend such as Redis for several instances.
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket: up to Requests requests are allowed in a
+// burst, and the bucket refills at a rate of Requests per Per.
+// A zero Limit means no limit.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// PerMinute returns a Limit of n requests per minute
+func PerMinute(n int) Limit {
+	return Limit{Requests: n, Per: time.Minute}
+}
+
+// PerHour returns a Limit of n requests per hour
+func PerHour(n int) Limit {
+	return Limit{Requests: n, Per: time.Hour}
+}
+
+// Unlimited reports whether l imposes no limit
+func (l Limit) Unlimited() bool {
+	return l.Requests <= 0 || l.Per <= 0
+}
+
+// Store keeps token buckets by key.
+//
+// Take removes one token from the bucket for key, creating a full bucket
+// if there is none. If the bucket is empty it returns false and how long
+// the caller has to wait until a token is available.
+type Store interface {
+	Take(key string, limit Limit) (ok bool, retryAfter time.Duration, err error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// time it takes the bucket to refill completely
+	per time.Duration
+}
+
+// MemoryStore is a Store that keeps buckets in memory. It is safe for
+// concurrent use, but buckets are not shared between instances.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+	now     func() time.Time
+}
+
+var _ Store = &MemoryStore{}
+
+// Number of calls to Take between sweeps of idle buckets
+const sweepEvery = 1024
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take implements Store
+func (ms *MemoryStore) Take(key string, limit Limit) (bool, time.Duration, error) {
+	if limit.Unlimited() {
+		return true, 0, nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	ms.takes++
+	if ms.takes%sweepEvery == 0 {
+		ms.sweep(now)
+	}
+
+	// Tokens added per nanosecond
+	rate := float64(limit.Requests) / float64(limit.Per)
+	capacity := float64(limit.Requests)
+
+	b, ok := ms.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now, per: limit.Per}
+		ms.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration(math.Ceil((1 - b.tokens) / rate))
+		return false, wait, nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// sweep deletes buckets that have been idle long enough to be full again,
+// since they are equivalent to missing buckets
+func (ms *MemoryStore) sweep(now time.Time) {
+	for key, b := range ms.buckets {
+		if now.Sub(b.last) > b.per {
+			delete(ms.buckets, key)
+		}
+	}
+}
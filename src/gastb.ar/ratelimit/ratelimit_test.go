@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	type take struct {
+		key   string
+		after time.Duration // since start
+		ok    bool
+		retry time.Duration
+	}
+	cases := []struct {
+		name  string
+		limit Limit
+		takes []take
+	}{{
+		name:  "burst then wait",
+		limit: PerMinute(2),
+		takes: []take{
+			{"a", 0, true, 0},
+			{"a", 0, true, 0},
+			{"a", 0, false, 30 * time.Second},
+			{"a", 10 * time.Second, false, 20 * time.Second},
+			{"a", 30 * time.Second, true, 0},
+			{"a", 30 * time.Second, false, 30 * time.Second},
+		},
+	}, {
+		name:  "keys are independent",
+		limit: PerMinute(1),
+		takes: []take{
+			{"a", 0, true, 0},
+			{"a", 0, false, time.Minute},
+			{"b", 0, true, 0},
+			{"b", 0, false, time.Minute},
+		},
+	}, {
+		name:  "refills up to the limit only",
+		limit: PerHour(2),
+		takes: []take{
+			{"a", 0, true, 0},
+			{"a", 24 * time.Hour, true, 0},
+			{"a", 24 * time.Hour, true, 0},
+			{"a", 24 * time.Hour, false, 30 * time.Minute},
+		},
+	}, {
+		name:  "rejected requests take no token",
+		limit: PerMinute(1),
+		takes: []take{
+			{"a", 0, true, 0},
+			{"a", 0, false, time.Minute},
+			{"a", 0, false, time.Minute},
+			{"a", time.Minute, true, 0},
+		},
+	}, {
+		name:  "unlimited",
+		limit: Limit{},
+		takes: []take{
+			{"a", 0, true, 0},
+			{"a", 0, true, 0},
+			{"a", 0, true, 0},
+		},
+	}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := NewMemoryStore()
+			for i, tk := range c.takes {
+				ms.now = func() time.Time { return start.Add(tk.after) }
+				ok, retry, err := ms.Take(tk.key, c.limit)
+				if err != nil || ok != tk.ok || retry != tk.retry {
+					t.Errorf("take %d: %v, %v, %v, want %v, %v", i, ok, retry, err, tk.ok, tk.retry)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	ms := NewMemoryStore()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ms.now = func() time.Time { return now }
+	ms.Take("idle", PerMinute(1))
+	now = now.Add(2 * time.Minute)
+	for i := 1; i < sweepEvery; i++ {
+		ms.Take("busy", PerMinute(1))
+	}
+	if _, ok := ms.buckets["idle"]; ok {
+		t.Errorf("idle bucket was kept after a sweep")
+	}
+	if _, ok := ms.buckets["busy"]; !ok {
+		t.Errorf("busy bucket was swept")
+	}
+}
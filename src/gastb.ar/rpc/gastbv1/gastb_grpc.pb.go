@@ -0,0 +1,288 @@
+// The internal API of the site, for other backend services. It is served
+// on the internal listener, see the rpc package. After changing it,
+// regenerate the Go code with go generate ./rpc/..., which needs protoc,
+// protoc-gen-go and protoc-gen-go-grpc.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: gastb.proto
+
+package gastbv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	UserService_CreateUser_FullMethodName = "/gastb.v1.UserService/CreateUser"
+	UserService_GetUser_FullMethodName    = "/gastb.v1.UserService/GetUser"
+)
+
+// UserServiceClient is the client API for UserService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type UserServiceClient interface {
+	// CreateUser signs up a user with a password, notifying admin webhooks
+	// as signups do
+	CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*User, error)
+	// GetUser looks up a user by ID
+	GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error)
+}
+
+type userServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUserServiceClient(cc grpc.ClientConnInterface) UserServiceClient {
+	return &userServiceClient{cc}
+}
+
+func (c *userServiceClient) CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*User, error) {
+	out := new(User)
+	err := c.cc.Invoke(ctx, UserService_CreateUser_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userServiceClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error) {
+	out := new(User)
+	err := c.cc.Invoke(ctx, UserService_GetUser_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UserServiceServer is the server API for UserService service.
+// All implementations must embed UnimplementedUserServiceServer
+// for forward compatibility
+type UserServiceServer interface {
+	// CreateUser signs up a user with a password, notifying admin webhooks
+	// as signups do
+	CreateUser(context.Context, *CreateUserRequest) (*User, error)
+	// GetUser looks up a user by ID
+	GetUser(context.Context, *GetUserRequest) (*User, error)
+	mustEmbedUnimplementedUserServiceServer()
+}
+
+// UnimplementedUserServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedUserServiceServer struct {
+}
+
+func (UnimplementedUserServiceServer) CreateUser(context.Context, *CreateUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateUser not implemented")
+}
+func (UnimplementedUserServiceServer) GetUser(context.Context, *GetUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedUserServiceServer) mustEmbedUnimplementedUserServiceServer() {}
+
+// UnsafeUserServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UserServiceServer will
+// result in compilation errors.
+type UnsafeUserServiceServer interface {
+	mustEmbedUnimplementedUserServiceServer()
+}
+
+func RegisterUserServiceServer(s grpc.ServiceRegistrar, srv UserServiceServer) {
+	s.RegisterService(&UserService_ServiceDesc, srv)
+}
+
+func _UserService_CreateUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserServiceServer).CreateUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserService_CreateUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserServiceServer).CreateUser(ctx, req.(*CreateUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserService_GetUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserServiceServer).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UserService_GetUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserServiceServer).GetUser(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// UserService_ServiceDesc is the grpc.ServiceDesc for UserService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var UserService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gastb.v1.UserService",
+	HandlerType: (*UserServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateUser",
+			Handler:    _UserService_CreateUser_Handler,
+		},
+		{
+			MethodName: "GetUser",
+			Handler:    _UserService_GetUser_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "gastb.proto",
+}
+
+const (
+	StocklistService_ListStocklists_FullMethodName = "/gastb.v1.StocklistService/ListStocklists"
+	StocklistService_GetStocklist_FullMethodName   = "/gastb.v1.StocklistService/GetStocklist"
+)
+
+// StocklistServiceClient is the client API for StocklistService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StocklistServiceClient interface {
+	// ListStocklists returns the personal stocklists of a user
+	ListStocklists(ctx context.Context, in *ListStocklistsRequest, opts ...grpc.CallOption) (*ListStocklistsResponse, error)
+	// GetStocklist looks up a stocklist the user can see
+	GetStocklist(ctx context.Context, in *GetStocklistRequest, opts ...grpc.CallOption) (*Stocklist, error)
+}
+
+type stocklistServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStocklistServiceClient(cc grpc.ClientConnInterface) StocklistServiceClient {
+	return &stocklistServiceClient{cc}
+}
+
+func (c *stocklistServiceClient) ListStocklists(ctx context.Context, in *ListStocklistsRequest, opts ...grpc.CallOption) (*ListStocklistsResponse, error) {
+	out := new(ListStocklistsResponse)
+	err := c.cc.Invoke(ctx, StocklistService_ListStocklists_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *stocklistServiceClient) GetStocklist(ctx context.Context, in *GetStocklistRequest, opts ...grpc.CallOption) (*Stocklist, error) {
+	out := new(Stocklist)
+	err := c.cc.Invoke(ctx, StocklistService_GetStocklist_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StocklistServiceServer is the server API for StocklistService service.
+// All implementations must embed UnimplementedStocklistServiceServer
+// for forward compatibility
+type StocklistServiceServer interface {
+	// ListStocklists returns the personal stocklists of a user
+	ListStocklists(context.Context, *ListStocklistsRequest) (*ListStocklistsResponse, error)
+	// GetStocklist looks up a stocklist the user can see
+	GetStocklist(context.Context, *GetStocklistRequest) (*Stocklist, error)
+	mustEmbedUnimplementedStocklistServiceServer()
+}
+
+// UnimplementedStocklistServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedStocklistServiceServer struct {
+}
+
+func (UnimplementedStocklistServiceServer) ListStocklists(context.Context, *ListStocklistsRequest) (*ListStocklistsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListStocklists not implemented")
+}
+func (UnimplementedStocklistServiceServer) GetStocklist(context.Context, *GetStocklistRequest) (*Stocklist, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStocklist not implemented")
+}
+func (UnimplementedStocklistServiceServer) mustEmbedUnimplementedStocklistServiceServer() {}
+
+// UnsafeStocklistServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StocklistServiceServer will
+// result in compilation errors.
+type UnsafeStocklistServiceServer interface {
+	mustEmbedUnimplementedStocklistServiceServer()
+}
+
+func RegisterStocklistServiceServer(s grpc.ServiceRegistrar, srv StocklistServiceServer) {
+	s.RegisterService(&StocklistService_ServiceDesc, srv)
+}
+
+func _StocklistService_ListStocklists_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListStocklistsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StocklistServiceServer).ListStocklists(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StocklistService_ListStocklists_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StocklistServiceServer).ListStocklists(ctx, req.(*ListStocklistsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StocklistService_GetStocklist_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStocklistRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StocklistServiceServer).GetStocklist(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StocklistService_GetStocklist_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StocklistServiceServer).GetStocklist(ctx, req.(*GetStocklistRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// StocklistService_ServiceDesc is the grpc.ServiceDesc for StocklistService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var StocklistService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gastb.v1.StocklistService",
+	HandlerType: (*StocklistServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListStocklists",
+			Handler:    _StocklistService_ListStocklists_Handler,
+		},
+		{
+			MethodName: "GetStocklist",
+			Handler:    _StocklistService_GetStocklist_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "gastb.proto",
+}
@@ -0,0 +1,225 @@
+package rpc
+
+// The rpc package serves the gRPC API of rpc/gastbv1 to other backend
+// services, so they can create users and read stocklists without going
+// through the HTTP+JSON API. It shares the internal listener with the
+// operational endpoints, over HTTP/2 without TLS (h2c), and only takes
+// requests carrying the token of Config.RPCToken:
+//
+//	authorization: Bearer <token>
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"gastb.ar/models"
+	"gastb.ar/rpc/gastbv1"
+	"gastb.ar/webhooks"
+)
+
+// Users creates and looks up users, like models.UserService
+type Users interface {
+	Create(user *models.User) error
+	ByID(id uint) (*models.User, error)
+}
+
+// Server implements the services of gastbv1 on top of the models
+type Server struct {
+	gastbv1.UnimplementedUserServiceServer
+	gastbv1.UnimplementedStocklistServiceServer
+	users Users
+	ss    *models.StocklistService
+	hooks *webhooks.Dispatcher
+	token [sha256.Size]byte
+	grpc  *grpc.Server
+}
+
+// NewServer creates a server on top of initialized services, accepting
+// requests that carry token
+func NewServer(users Users, ss *models.StocklistService, token string) *Server {
+	s := &Server{
+		users: users,
+		ss:    ss,
+		token: sha256.Sum256([]byte(token)),
+	}
+	s.grpc = grpc.NewServer(grpc.UnaryInterceptor(s.authorize))
+	gastbv1.RegisterUserServiceServer(s.grpc, s)
+	gastbv1.RegisterStocklistServiceServer(s.grpc, s)
+	return s
+}
+
+// SetHooks makes CreateUser notify admin webhooks of the new user, like
+// signups do. Without hooks, no webhooks are sent.
+func (s *Server) SetHooks(hooks *webhooks.Dispatcher) {
+	s.hooks = hooks
+}
+
+// Handler returns a handler serving gRPC requests, and passing the other
+// requests on to next. It takes HTTP/2 without TLS, which gRPC clients
+// speak on plain-text connections.
+func (s *Server) Handler(next http.Handler) http.Handler {
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			s.grpc.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
+
+// authorize only calls handler for requests with the token. Both sides
+// are hashed first, so comparing takes the same time whatever the length
+// of the token sent. Empty tokens never pass.
+func (s *Server) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get("authorization")
+	const prefix = "Bearer "
+	if len(auth) != 1 || len(auth[0]) < len(prefix) || !strings.EqualFold(auth[0][:len(prefix)], prefix) ||
+		strings.TrimSpace(auth[0][len(prefix):]) == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	sent := sha256.Sum256([]byte(strings.TrimSpace(auth[0][len(prefix):])))
+	if subtle.ConstantTimeCompare(sent[:], s.token[:]) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return handler(ctx, req)
+}
+
+// CreateUser signs up a user
+func (s *Server) CreateUser(ctx context.Context, req *gastbv1.CreateUserRequest) (*gastbv1.User, error) {
+	user := &models.User{
+		Name:     strings.TrimSpace(req.Name),
+		Email:    req.Email,
+		Password: req.Password,
+	}
+	if err := s.users.Create(user); err != nil {
+		return nil, statusFor(err)
+	}
+	if s.hooks != nil {
+		if err := s.hooks.UserCreated(user); err != nil {
+			slog.ErrorContext(ctx, "broadcasting user.created", "error", err)
+		}
+	}
+	return newUser(user), nil
+}
+
+// GetUser looks up a user by ID
+func (s *Server) GetUser(ctx context.Context, req *gastbv1.GetUserRequest) (*gastbv1.User, error) {
+	id, err := uintID(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.users.ByID(id)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return newUser(user), nil
+}
+
+// ListStocklists returns the personal stocklists of a user, as
+// GET /api/v1/stocklists does
+func (s *Server) ListStocklists(ctx context.Context, req *gastbv1.ListStocklistsRequest) (*gastbv1.ListStocklistsResponse, error) {
+	userID, err := uintID(req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	stocklists, err := s.ss.AsTenant(userID).ByUserID(userID)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	resp := &gastbv1.ListStocklistsResponse{Stocklists: make([]*gastbv1.Stocklist, len(stocklists))}
+	for i := range stocklists {
+		resp.Stocklists[i] = newStocklist(&stocklists[i])
+	}
+	return resp, nil
+}
+
+// GetStocklist looks up a stocklist the user can see
+func (s *Server) GetStocklist(ctx context.Context, req *gastbv1.GetStocklistRequest) (*gastbv1.Stocklist, error) {
+	userID, err := uintID(req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uintID(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	stocklist, err := s.ss.AsTenant(userID).ByID(id)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	role, err := s.ss.RoleOf(stocklist, userID)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	if role == "" {
+		return nil, statusFor(models.ErrNotFound)
+	}
+	return newStocklist(stocklist), nil
+}
+
+// uintID checks an ID of a request fits the models' IDs
+func uintID(id uint64) (uint, error) {
+	if id == 0 || id > uint64(^uint32(0)) {
+		return 0, status.Error(codes.InvalidArgument, "invalid ID")
+	}
+	return uint(id), nil
+}
+
+// statusFor maps errors returned by the models package to gRPC statuses.
+// Unexpected errors are logged and not exposed to clients.
+func statusFor(err error) error {
+	msg := strings.TrimPrefix(err.Error(), "models: ")
+	switch err {
+	case models.ErrNotFound:
+		return status.Error(codes.NotFound, msg)
+	case models.ErrEmailTaken, models.ErrUsernameTaken:
+		return status.Error(codes.AlreadyExists, msg)
+	case models.ErrEmailRequired, models.ErrEmailInvalid, models.ErrEmailNotAllowed,
+		models.ErrPasswordTooShort:
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	slog.Error("rpc failed", "error", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+func newUser(user *models.User) *gastbv1.User {
+	return &gastbv1.User{
+		Id:            uint64(user.ID),
+		Name:          user.Name,
+		Email:         user.Email,
+		Username:      user.GetUsername(),
+		Role:          user.Role,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		CreatedAt:     user.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func newStocklist(stocklist *models.Stocklist) *gastbv1.Stocklist {
+	s := &gastbv1.Stocklist{
+		Id:        uint64(stocklist.ID),
+		UserId:    uint64(stocklist.UserID),
+		Name:      stocklist.Name,
+		Version:   uint64(stocklist.Version),
+		Public:    stocklist.Public,
+		CreatedAt: stocklist.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt: stocklist.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if stocklist.OrganizationID != nil {
+		s.OrganizationId = uint64(*stocklist.OrganizationID)
+	}
+	return s
+}
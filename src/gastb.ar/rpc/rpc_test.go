@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"gastb.ar/models"
+	"gastb.ar/models/modelstest"
+	"gastb.ar/rpc/gastbv1"
+)
+
+// users reports duplicate emails as UserService does
+type users struct {
+	*modelstest.Users
+}
+
+func (u users) Create(user *models.User) error {
+	if err := u.Users.Create(user); err != modelstest.ErrDuplicate {
+		return err
+	}
+	return models.ErrEmailTaken
+}
+
+// dial serves a test server over h2c behind a plain HTTP handler, and
+// returns clients of it and the stocklists it reads
+func dial(t *testing.T) (gastbv1.UserServiceClient, gastbv1.StocklistServiceClient, *modelstest.Stocklists) {
+	t.Helper()
+	stocklists := modelstest.NewStocklists()
+	s := NewServer(users{modelstest.NewUsers()}, &models.StocklistService{StocklistDB: stocklists}, "secret")
+	other := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	srv := httptest.NewServer(s.Handler(other))
+	t.Cleanup(srv.Close)
+
+	// Other requests still reach the internal endpoints
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /healthz: status %d", resp.StatusCode)
+	}
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(srv.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return gastbv1.NewUserServiceClient(conn), gastbv1.NewStocklistServiceClient(conn), stocklists
+}
+
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestAuthorize(t *testing.T) {
+	usersC, _, _ := dial(t)
+	cases := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"no token", context.Background()},
+		{"empty token", withToken("")},
+		{"wrong token", withToken("secreT")},
+		{"prefix of the token", withToken("secre")},
+		{"other scheme", metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic secret")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := usersC.GetUser(c.ctx, &gastbv1.GetUserRequest{Id: 1})
+			if status.Code(err) != codes.Unauthenticated {
+				t.Errorf("GetUser: %v, want Unauthenticated", err)
+			}
+		})
+	}
+}
+
+func TestUsers(t *testing.T) {
+	usersC, _, _ := dial(t)
+	ctx := withToken("secret")
+	created, err := usersC.CreateUser(ctx, &gastbv1.CreateUserRequest{
+		Name: " Ana ", Email: "ana@example.com", Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if created.Id == 0 || created.Name != "Ana" || created.Email != "ana@example.com" {
+		t.Errorf("CreateUser returned %v", created)
+	}
+	got, err := usersC.GetUser(ctx, &gastbv1.GetUserRequest{Id: created.Id})
+	if err != nil || got.Email != "ana@example.com" {
+		t.Errorf("GetUser = %v, %v, want Ana", got, err)
+	}
+
+	_, err = usersC.CreateUser(ctx, &gastbv1.CreateUserRequest{
+		Name: "Ana", Email: "ana@example.com", Password: "correct horse"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateUser with a taken email: %v, want AlreadyExists", err)
+	}
+	if _, err := usersC.GetUser(ctx, &gastbv1.GetUserRequest{Id: 99}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetUser of a missing user: %v, want NotFound", err)
+	}
+	if _, err := usersC.GetUser(ctx, &gastbv1.GetUserRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetUser without an ID: %v, want InvalidArgument", err)
+	}
+}
+
+func TestStocklists(t *testing.T) {
+	_, stocklistsC, stocklists := dial(t)
+	ctx := withToken("secret")
+	anas := &models.Stocklist{UserID: 1, Name: "Ana's"}
+	bobs := &models.Stocklist{UserID: 2, Name: "Bob's"}
+	for _, s := range []*models.Stocklist{anas, bobs} {
+		if err := stocklists.Create(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := stocklistsC.ListStocklists(ctx, &gastbv1.ListStocklistsRequest{UserId: 1})
+	if err != nil {
+		t.Fatalf("ListStocklists: %v", err)
+	}
+	if len(resp.Stocklists) != 1 || resp.Stocklists[0].Name != "Ana's" {
+		t.Errorf("ListStocklists = %v, want Ana's", resp.Stocklists)
+	}
+	got, err := stocklistsC.GetStocklist(ctx, &gastbv1.GetStocklistRequest{UserId: 1, Id: uint64(anas.ID)})
+	if err != nil || got.Name != "Ana's" || got.UserId != 1 {
+		t.Errorf("GetStocklist = %v, %v, want Ana's", got, err)
+	}
+	// Other users' stocklists look missing
+	_, err = stocklistsC.GetStocklist(ctx, &gastbv1.GetStocklistRequest{UserId: 1, Id: uint64(bobs.ID)})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetStocklist of Bob's as Ana: %v, want NotFound", err)
+	}
+}
@@ -0,0 +1,259 @@
+package scim
+
+// The scim package implements the parts of SCIM 2.0 (RFCs 7643 and 7644)
+// identity providers such as Okta and Azure AD use to provision users:
+// the User resource, list responses, errors, equality filters and PATCH
+// operations. Attributes the site has no use for are accepted and
+// dropped, since providers send many of them by default.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// Schema URIs
+const (
+	UserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	ListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// Error types, sent as scimType with 400 and 409 errors
+const (
+	InvalidFilter = "invalidFilter"
+	InvalidSyntax = "invalidSyntax"
+	InvalidValue  = "invalidValue"
+	Uniqueness    = "uniqueness"
+)
+
+// Name is the name of a user
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// Email is an email address of a user
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Meta describes a resource
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// User is a User resource
+type User struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	UserName    string   `json:"userName"`
+	Name        *Name    `json:"name,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Emails      []Email  `json:"emails,omitempty"`
+	// Active is nil in requests that leave it out, which means true
+	Active *bool `json:"active,omitempty"`
+	Meta   *Meta `json:"meta,omitempty"`
+}
+
+// IsActive reports whether the user should be able to log in
+func (u *User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+// FullName returns the display name of the user, or else one made from
+// their name
+func (u *User) FullName() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	if u.Name == nil {
+		return ""
+	}
+	if u.Name.Formatted != "" {
+		return u.Name.Formatted
+	}
+	return strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+}
+
+// EmailAddress returns the primary email address of the user. Providers
+// set userName to the email address, and some send no emails at all.
+func (u *User) EmailAddress() string {
+	for _, e := range u.Emails {
+		if e.Primary && e.Value != "" {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 && u.Emails[0].Value != "" {
+		return u.Emails[0].Value
+	}
+	return u.UserName
+}
+
+// ListResponse is a page of resources
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []User   `json:"Resources"`
+}
+
+// Error is an error response
+type Error struct {
+	Schemas []string `json:"schemas"`
+	// Status is the HTTP status code, as a string
+	Status   string `json:"status"`
+	ScimType string `json:"scimType,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// Write writes v as a SCIM response
+func Write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes a SCIM error. scimType may be empty.
+func WriteError(w http.ResponseWriter, status int, scimType, detail string) {
+	Write(w, status, Error{
+		Schemas:  []string{ErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+// ErrFilter is returned for filters other than a single equality
+var ErrFilter = errors.New("scim: only filters of the form attribute eq \"value\" are supported")
+
+// ParseFilter parses a filter comparing an attribute to a string, such
+// as userName eq "ana@example.com", which is how providers look up the
+// user they are about to create. Attribute names are case insensitive
+// and returned in lower case.
+func ParseFilter(filter string) (attr, value string, err error) {
+	fields := strings.SplitN(strings.TrimSpace(filter), " ", 3)
+	if len(fields) != 3 || !strings.EqualFold(fields[1], "eq") {
+		return "", "", ErrFilter
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(fields[2])), &value); err != nil {
+		return "", "", ErrFilter
+	}
+	return strings.ToLower(fields[0]), value, nil
+}
+
+// PatchOp is a PATCH request
+type PatchOp struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+// Operation is an operation of a PATCH request
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ErrPatch is returned for PATCH operations that can't be applied
+var ErrPatch = errors.New("scim: invalid PATCH operation")
+
+// Apply applies the operations of a PATCH request to u. Only add and
+// replace are supported, with a path or with an object of attributes;
+// operations on attributes the site doesn't keep are ignored.
+func (p *PatchOp) Apply(u *User) error {
+	for _, op := range p.Operations {
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+		case "remove":
+			// Nothing the site keeps can be removed
+			continue
+		default:
+			return ErrPatch
+		}
+		if op.Path != "" {
+			if err := set(u, op.Path, op.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return ErrPatch
+		}
+		for path, value := range attrs {
+			if err := set(u, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// set sets the attribute at path, one of the few kept
+func set(u *User, path string, value json.RawMessage) error {
+	var err error
+	switch strings.ToLower(path) {
+	case "active":
+		var active bool
+		active, err = parseBool(value)
+		u.Active = &active
+	case "username":
+		err = json.Unmarshal(value, &u.UserName)
+	case "displayname":
+		err = json.Unmarshal(value, &u.DisplayName)
+	case "name":
+		err = json.Unmarshal(value, &u.Name)
+	case "name.formatted", "name.givenname", "name.familyname":
+		if u.Name == nil {
+			u.Name = &Name{}
+		}
+		var s string
+		err = json.Unmarshal(value, &s)
+		switch strings.ToLower(path) {
+		case "name.formatted":
+			u.Name.Formatted = s
+		case "name.givenname":
+			u.Name.GivenName = s
+		default:
+			u.Name.FamilyName = s
+		}
+	case "emails":
+		err = json.Unmarshal(value, &u.Emails)
+	case `emails[type eq "work"].value`, `emails[primary eq true].value`:
+		var s string
+		err = json.Unmarshal(value, &s)
+		u.Emails = []Email{{Value: s, Type: "work", Primary: true}}
+	}
+	if err != nil {
+		return ErrPatch
+	}
+	return nil
+}
+
+// parseBool parses a boolean, which Azure AD sends as a string
+func parseBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.ToLower(s))
+}
@@ -0,0 +1,167 @@
+package storage
+
+// The storage package stores uploaded files (avatars, stocklist
+// attachments) behind the Storage interface, on local disk in development
+// and in an S3-compatible bucket in production.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when getting a key that does not exist
+var ErrNotFound = errors.New("storage: not found")
+
+// Storage stores files under keys such as "avatars/12.jpg". Keys are
+// chosen by the application, never by users.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns the content of a key, which the caller must close
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes a key; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns the objects whose keys start with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// Presigner is implemented by storages that can hand out links to
+// download a key directly from them, so large files don't go through the
+// application
+type Presigner interface {
+	// Presign returns a URL to GET key that works for ttl. A filename
+	// makes browsers save the download under that name.
+	Presign(key string, ttl time.Duration, filename string) (string, error)
+}
+
+// Object describes a stored file
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// Config selects and configures a Storage
+type Config struct {
+	// Backend is "local" or "s3"
+	Backend string
+	// Dir is the root directory of the local backend
+	Dir string
+	S3  S3Config
+}
+
+// New creates the Storage selected by cfg
+func New(cfg Config) (Storage, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return NewLocal(cfg.Dir)
+	case "s3":
+		return NewS3(cfg.S3)
+	}
+	return nil, errors.New("storage: unknown backend " + cfg.Backend)
+}
+
+// Local stores files in a directory
+type Local struct {
+	dir string
+}
+
+// NewLocal creates a Local storage in dir, creating it if needed
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir}, nil
+}
+
+// path maps a key to a file, refusing keys that would escape the
+// directory
+func (l *Local) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", errors.New("storage: invalid key " + key)
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(clean)), nil
+}
+
+// Put implements Storage. The file is written under a temporary name and
+// renamed, so readers never see a partial file.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Get implements Storage
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete implements Storage
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List implements Storage
+func (l *Local) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.Walk(l.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
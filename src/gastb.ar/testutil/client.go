@@ -0,0 +1,283 @@
+package testutil
+
+// The testutil package has helpers for end-to-end tests of the HTTP
+// handlers. Client talks to a handler through a real httptest server,
+// keeping cookies and CSRF tokens between requests like a browser does:
+//
+//	c := testutil.NewClient(t, handler)
+//	c.Signup("Ana", "ana@example.com", "correct horse")
+//	c.Login("ana@example.com", "correct horse")
+//	c.Get("/profile").Status(http.StatusOK)
+//
+// API requests are authenticated with a key the client creates:
+//
+//	c.LoginAPI("ana@example.com", "correct horse")
+//	var list struct{ ID uint `json:"id"` }
+//	c.PostJSON("/api/v1/stocklists", map[string]string{"name": "Tech"}, &list)
+//
+// Helpers fail the test on transport errors and on unexpected responses,
+// so tests only check what they are about.
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// CSRFField is the form field CSRF tokens are sent in, the default of
+// gorilla/csrf
+const CSRFField = "gorilla.csrf.Token"
+
+// csrfInput finds the token in the hidden input rendered by csrfField
+var csrfInput = regexp.MustCompile(`name="` + regexp.QuoteMeta(CSRFField) + `"\s+value="([^"]+)"`)
+
+// Client is an HTTP client for the server it starts. It doesn't follow
+// redirects, so tests can check where they lead.
+type Client struct {
+	t      testing.TB
+	Server *httptest.Server
+	HTTP   *http.Client
+	// Key is sent as a bearer token with API requests if set
+	Key string
+	// csrf is the token of the latest HTML page that had one
+	csrf string
+}
+
+// NewClient starts a server for handler, closed when the test ends, and
+// returns a client with an empty cookie jar for it
+func NewClient(t testing.TB, handler http.Handler) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{
+		t:      t,
+		Server: srv,
+		HTTP: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Response is a response with its body already read
+type Response struct {
+	*http.Response
+	Body []byte
+	t    testing.TB
+}
+
+// Status fails the test if the response doesn't have the status code
+// want, and returns r for chaining
+func (r *Response) Status(want int) *Response {
+	r.t.Helper()
+	if r.StatusCode != want {
+		r.t.Fatalf("%s %s: status %d, want %d\n%s", r.Request.Method, r.Request.URL.Path,
+			r.StatusCode, want, r.Body)
+	}
+	return r
+}
+
+// Redirects fails the test unless the response redirects to path
+func (r *Response) Redirects(path string) *Response {
+	r.t.Helper()
+	if loc := r.Header.Get("Location"); r.StatusCode/100 != 3 || loc != path {
+		r.t.Fatalf("%s %s: status %d to %q, want a redirect to %q", r.Request.Method,
+			r.Request.URL.Path, r.StatusCode, loc, path)
+	}
+	return r
+}
+
+// Contains fails the test unless the body contains s
+func (r *Response) Contains(s string) *Response {
+	r.t.Helper()
+	if !bytes.Contains(r.Body, []byte(s)) {
+		r.t.Fatalf("%s %s: body doesn't contain %q\n%s", r.Request.Method, r.Request.URL.Path,
+			s, r.Body)
+	}
+	return r
+}
+
+// Error returns the message of an API error response, or "" if the
+// response has none
+func (r *Response) Error() string {
+	var env struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(r.Body, &env) != nil || env.Error == nil {
+		return ""
+	}
+	return env.Error.Message
+}
+
+// Do sends req, resolving a relative URL against the server, and reads
+// the response. A CSRF token in an HTML response is kept for the next
+// form.
+func (c *Client) Do(req *http.Request) *Response {
+	c.t.Helper()
+	if req.URL.Host == "" {
+		u, err := url.Parse(c.Server.URL)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		if m := csrfInput.FindSubmatch(body); m != nil {
+			c.csrf = string(m[1])
+		}
+	}
+	return &Response{Response: resp, Body: body, t: c.t}
+}
+
+// Get requests path
+func (c *Client) Get(path string) *Response {
+	c.t.Helper()
+	return c.Do(c.request(http.MethodGet, path, nil))
+}
+
+// PostForm submits a form to path, with the CSRF token of the latest
+// page. If no page had one yet, the login page is fetched for it.
+func (c *Client) PostForm(path string, values url.Values) *Response {
+	c.t.Helper()
+	if c.csrf == "" {
+		c.Get("/login").Status(http.StatusOK)
+		if c.csrf == "" {
+			c.t.Fatal("testutil: the login page has no CSRF token")
+		}
+	}
+	form := url.Values{}
+	for k, v := range values {
+		form[k] = v
+	}
+	form.Set(CSRFField, c.csrf)
+	req := c.request(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.Do(req)
+}
+
+// Signup signs up a user through the signup form, failing the test if it
+// doesn't succeed. It doesn't log the user in.
+func (c *Client) Signup(name, email, password string) {
+	c.t.Helper()
+	c.PostForm("/signup", url.Values{
+		"name":             {name},
+		"email":            {email},
+		"password":         {password},
+		"password_confirm": {password},
+	}).Status(http.StatusFound)
+}
+
+// Login logs in through the login form, failing the test if it doesn't
+// succeed
+func (c *Client) Login(email, password string) {
+	c.t.Helper()
+	c.PostForm("/login", url.Values{
+		"email":    {email},
+		"password": {password},
+	}).Status(http.StatusFound)
+}
+
+// LoginAPI creates an API key for the user and sends it with every
+// following API request
+func (c *Client) LoginAPI(email, password string) {
+	c.t.Helper()
+	var key struct {
+		Key string `json:"key"`
+	}
+	c.PostJSON("/api/v1/keys", map[string]string{
+		"email":    email,
+		"password": password,
+		"name":     "testutil",
+	}, &key).Status(http.StatusCreated)
+	c.Key = key.Key
+}
+
+// JSON sends body, unless it is nil, as JSON to path. The data member of
+// a successful response is decoded into dst, unless it is nil; check the
+// status or Error of the response for failures.
+func (c *Client) JSON(method, path string, body, dst interface{}) *Response {
+	c.t.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		rd = bytes.NewReader(b)
+	}
+	req := c.request(method, path, rd)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+	resp := c.Do(req)
+	if dst != nil && resp.StatusCode/100 == 2 {
+		env := struct {
+			Data interface{} `json:"data"`
+		}{dst}
+		if err := json.Unmarshal(resp.Body, &env); err != nil {
+			c.t.Fatalf("%s %s: %v\n%s", method, path, err, resp.Body)
+		}
+	}
+	return resp
+}
+
+// GetJSON gets path from the API, decoding the data into dst
+func (c *Client) GetJSON(path string, dst interface{}) *Response {
+	c.t.Helper()
+	return c.JSON(http.MethodGet, path, nil, dst)
+}
+
+// PostJSON posts body to the API, decoding the data into dst
+func (c *Client) PostJSON(path string, body, dst interface{}) *Response {
+	c.t.Helper()
+	return c.JSON(http.MethodPost, path, body, dst)
+}
+
+// PutJSON puts body to the API, decoding the data into dst
+func (c *Client) PutJSON(path string, body, dst interface{}) *Response {
+	c.t.Helper()
+	return c.JSON(http.MethodPut, path, body, dst)
+}
+
+// Delete sends a DELETE request to the API
+func (c *Client) Delete(path string) *Response {
+	c.t.Helper()
+	return c.JSON(http.MethodDelete, path, nil, nil)
+}
+
+func (c *Client) request(method, path string, body io.Reader) *http.Request {
+	c.t.Helper()
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return req
+}
@@ -0,0 +1,181 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Exporter tuning
+const (
+	queueSize     = 2048
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+// exporter batches finished spans and posts them to the collector as
+// OTLP/HTTP JSON. Spans are dropped when the queue is full rather than
+// slowing down requests.
+type exporter struct {
+	cfg    Config
+	client *http.Client
+	queue  chan *Span
+	flush  chan chan struct{}
+	done   chan struct{}
+}
+
+func newExporter(cfg Config) *exporter {
+	e := &exporter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *Span, queueSize),
+		flush:  make(chan chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+func (e *exporter) export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *exporter) loop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	send := func() {
+		if len(batch) > 0 {
+			e.post(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case ack := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			send()
+			close(ack)
+			return
+		}
+	}
+}
+
+// shutdown sends pending spans and stops the export loop
+func (e *exporter) shutdown(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case e.flush <- ack:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//
+// OTLP JSON encoding
+//
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes"`
+	Status            otlpStatus `json:"status"`
+}
+
+func attrs(m map[string]string) []otlpAttr {
+	out := make([]otlpAttr, 0, len(m))
+	for k, v := range m {
+		out = append(out, otlpAttr{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	return out
+}
+
+func encodeSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	os := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        attrs(s.attrs),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.parentID != [8]byte{} {
+		os.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		os.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return os
+}
+
+func (e *exporter) post(batch []*Span) {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = encodeSpan(s)
+	}
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attrs(map[string]string{"service.name": e.cfg.ServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "gastb.ar/tracing"},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	resp, err := e.client.Post(e.cfg.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,300 @@
+package tracing
+
+// The tracing package records spans for HTTP requests, database queries and
+// outbound calls, propagates trace context with W3C traceparent headers and
+// exports finished spans to an OpenTelemetry collector over OTLP/HTTP.
+//
+// Tracing is off until Init is called with an endpoint; until then every
+// function in the package is a cheap no-op.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span is a timed operation within a trace. A nil *Span is valid and
+// ignores every call, which is what callers get when tracing is off or
+// the trace is not sampled.
+type Span struct {
+	mu       sync.Mutex
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+	ended    bool
+}
+
+// TraceID returns the hex encoded trace ID of the span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetName renames the span, e.g. once the route of a request is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttr sets an attribute of the span
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End finishes the span and hands it to the exporter. Calls after the
+// first one are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if t := current(); t != nil {
+		t.exporter.export(s)
+	}
+}
+
+//
+// 1. Global tracer
+//
+
+// Config configures tracing
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces URL of the collector, e.g.
+	// http://localhost:4318/v1/traces. Empty disables tracing.
+	Endpoint string
+	// ServiceName identifies this program in the tracing backend
+	ServiceName string
+	// SampleRatio is the fraction of new traces that are recorded,
+	// between 0 and 1
+	SampleRatio float64
+}
+
+type tracer struct {
+	cfg      Config
+	exporter *exporter
+}
+
+var (
+	mu     sync.RWMutex
+	global *tracer
+)
+
+func current() *tracer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return global
+}
+
+// Init turns tracing on. It returns a function that flushes pending spans
+// and stops the exporter, to be called on shutdown.
+func Init(cfg Config) func(ctx context.Context) error {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+	t := &tracer{cfg: cfg, exporter: newExporter(cfg)}
+	mu.Lock()
+	global = t
+	mu.Unlock()
+	return func(ctx context.Context) error {
+		mu.Lock()
+		global = nil
+		mu.Unlock()
+		return t.exporter.shutdown(ctx)
+	}
+}
+
+// Enabled reports whether tracing is on
+func Enabled() bool {
+	return current() != nil
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span stored in ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// TraceID returns the trace ID of the span in ctx, or an empty string,
+// for inclusion in log lines
+func TraceID(ctx context.Context) string {
+	return SpanFromContext(ctx).TraceID()
+}
+
+// remoteParent is a span context received from another process
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type remoteKey struct{}
+
+// Start begins a span as a child of the span in ctx, or of a remote parent
+// extracted with Extract, or as the root of a new trace. It returns a
+// context holding the new span.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	t := current()
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if rp, ok := ctx.Value(remoteKey{}).(remoteParent); ok {
+		if !rp.sampled {
+			return ctx, nil
+		}
+		s.traceID = rp.traceID
+		s.parentID = rp.spanID
+	} else {
+		if mathrand.Float64() >= t.cfg.SampleRatio {
+			return ctx, nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Record creates a span that has already finished, such as a database
+// query reported by a hook that has no access to a context
+func Record(name string, kind int, start, end time.Time, attrs map[string]string, err error) {
+	_, s := Start(context.Background(), name, kind)
+	if s == nil {
+		return
+	}
+	s.start = start
+	for k, v := range attrs {
+		s.attrs[k] = v
+	}
+	s.err = err
+	s.ended = true
+	s.end = end
+	if t := current(); t != nil {
+		t.exporter.export(s)
+	}
+}
+
+//
+// 2. W3C trace context propagation
+//
+
+const traceparentHeader = "traceparent"
+
+// Extract returns a context carrying the trace context of an incoming
+// request's traceparent header, if it has a valid one
+func Extract(ctx context.Context, r *http.Request) context.Context {
+	parts := strings.Split(r.Header.Get(traceparentHeader), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+	var rp remoteParent
+	tid, err1 := hex.DecodeString(parts[1])
+	sid, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil ||
+		len(tid) != 16 || len(sid) != 8 || len(flags) != 1 {
+		return ctx
+	}
+	copy(rp.traceID[:], tid)
+	copy(rp.spanID[:], sid)
+	rp.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, remoteKey{}, rp)
+}
+
+// Inject sets the traceparent header of an outgoing request to the span
+// in ctx
+func Inject(ctx context.Context, r *http.Request) {
+	s := SpanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	r.Header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-01",
+		hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:])))
+}
+
+// Transport is an http.RoundTripper for outbound calls (e.g. to a quote
+// provider) that records a client span per request and propagates the
+// trace context to the server
+type Transport struct {
+	// Base is the transport doing the actual work;
+	// nil means http.DefaultTransport
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx, span := Start(r.Context(), "HTTP "+r.Method+" "+r.URL.Host, KindClient)
+	if span == nil {
+		return base.RoundTrip(r)
+	}
+	defer span.End()
+	r = r.Clone(ctx)
+	Inject(ctx, r)
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.url", r.URL.Redacted())
+	resp, err := base.RoundTrip(r)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttr("http.status_code", fmt.Sprint(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetError(fmt.Errorf("HTTP %d", resp.StatusCode))
+	}
+	return resp, nil
+}
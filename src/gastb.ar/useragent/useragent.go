@@ -0,0 +1,87 @@
+package useragent
+
+// The useragent package tells which browser and operating system sent a
+// request from its User-Agent header, so users can recognize their
+// sessions. It knows the common browsers only and doesn't try to be
+// exact: headers are easy to fake, and the result is only shown to
+// people.
+
+import (
+	"strings"
+)
+
+// Agent is what a User-Agent header tells about a client
+type Agent struct {
+	// Browser is the name and major version of the browser, such as
+	// "Firefox 128", or "" if it is not known
+	Browser string
+	// OS is the name of the operating system, or "" if it is not known
+	OS string
+	// Mobile is set for phones and tablets
+	Mobile bool
+}
+
+// browsers are matched in order, since most browsers also claim to be
+// the ones they are based on
+var browsers = []struct {
+	token string
+	name  string
+}{
+	{"Edg/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"},
+	{"curl/", "curl"},
+}
+
+// systems are matched in order too; Android and iOS devices mention
+// Linux and Mac OS X
+var systems = []struct {
+	token string
+	name  string
+}{
+	{"Windows", "Windows"},
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// Parse reads a User-Agent header
+func Parse(ua string) Agent {
+	var a Agent
+	for _, b := range browsers {
+		if i := strings.Index(ua, b.token); i >= 0 {
+			a.Browser = b.name
+			if v := major(ua[i+len(b.token):]); v != "" {
+				a.Browser += " " + v
+			}
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(ua, s.token) {
+			a.OS = s.name
+			break
+		}
+	}
+	a.Mobile = strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPad") ||
+		a.OS == "Android"
+	return a
+}
+
+// major returns the leading digits of a version
+func major(version string) string {
+	end := 0
+	for end < len(version) && version[end] >= '0' && version[end] <= '9' {
+		end++
+	}
+	return version[:end]
+}
@@ -0,0 +1,16 @@
+package views
+
+import (
+	"gastb.ar/flash"
+	"gastb.ar/models"
+)
+
+// Data is the top level object every layout is executed with. Data passed
+// to Render that is not of this type is wrapped in it as the Yield field,
+// which is what the page templates ("yield") receive.
+type Data struct {
+	Alert  *flash.Message
+	User   *models.User
+	Locale string
+	Yield  interface{}
+}
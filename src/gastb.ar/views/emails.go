@@ -0,0 +1,101 @@
+package views
+
+import (
+	"embed"
+	"time"
+
+	"gastb.ar/email"
+)
+
+// Email templates are embedded, so mail can be rendered from background
+// jobs without depending on the working directory. Each file defines the
+// "subject", "text" and "html" templates of one message.
+//
+//go:embed emails/*.gohtml
+var emailFS embed.FS
+
+// NewEmail parses the email template with the given name, panicking if it
+// is missing or invalid, as NewView does
+func NewEmail(name string) *email.Template {
+	src, err := emailFS.ReadFile("emails/" + name + TemplateExt)
+	if err != nil {
+		panic(err)
+	}
+	t, err := email.ParseTemplate(name, string(src))
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// WelcomeEmail is the data of the "welcome" email
+type WelcomeEmail struct {
+	Name     string
+	LoginURL string
+}
+
+// VerifyEmail is the data of the "verify_email" email
+type VerifyEmail struct {
+	Name string
+	// URL confirms the address when followed
+	URL       string
+	ExpiresIn string
+	// Code confirms the address when typed in on the profile page
+	Code          string
+	CodeExpiresIn string
+}
+
+// PasswordResetEmail is the data of the "password_reset" email
+type PasswordResetEmail struct {
+	Name string
+	// URL leads to the form choosing a new password
+	URL       string
+	ExpiresIn string
+}
+
+// EmailChangedEmail is the data of the "email_changed" notice, sent to
+// the old address
+type EmailChangedEmail struct {
+	Name     string
+	OldEmail string
+	NewEmail string
+	SecurityDetails
+}
+
+// SecurityNoticeEmail is the data of the "security_notice" email, about
+// a login from a new device or a password change
+type SecurityNoticeEmail struct {
+	Name string
+	// Kind is models.SecurityNewLogin or models.SecurityPasswordChanged
+	Kind string
+	SecurityDetails
+}
+
+// SecurityDetails are shown in every security notice
+type SecurityDetails struct {
+	Time      time.Time
+	IP        string
+	UserAgent string
+	// LockURL is the "this wasn't me" link
+	LockURL string
+}
+
+// DigestEmail is the data of the "digest" email
+type DigestEmail struct {
+	Name string
+	// Since is when the previous digest was sent, or when the period the
+	// first digest covers started
+	Since          time.Time
+	Stocklists     []DigestStocklist
+	StocklistsURL  string
+	UnsubscribeURL string
+}
+
+// DigestStocklist is a stocklist in a digest
+type DigestStocklist struct {
+	Name string
+	// New is set for stocklists created since the previous digest, and
+	// Changed for older ones updated since
+	New     bool
+	Changed bool
+}
@@ -0,0 +1,313 @@
+package views_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gastb.ar/captcha"
+	"gastb.ar/context"
+	"gastb.ar/controllers"
+	"gastb.ar/flash"
+	"gastb.ar/forms"
+	"gastb.ar/httperror"
+	"gastb.ar/jobs"
+	"gastb.ar/models"
+	"gastb.ar/policies"
+	"gastb.ar/views"
+
+	"github.com/jinzhu/gorm"
+)
+
+// now is the time every case is rendered at, so output doesn't depend
+// on when the check runs
+var now = time.Date(2026, time.March, 14, 15, 9, 26, 0, time.UTC)
+
+// goldenCases returns the cases TestGolden renders. Names include
+// characters that must be escaped, so escaping changes show up too.
+func goldenCases() []goldenCase {
+	verified := now.Add(-48 * time.Hour)
+	user := &models.User{Model: gorm.Model{ID: 7}, Name: `Ana <b>"Ops"</b> & Co`,
+		Email: "ana@example.com", Role: models.RoleUser, EmailVerifiedAt: &verified}
+	unverified := &models.User{Model: gorm.Model{ID: 8}, Name: "Bruno", Email: "bruno@example.com",
+		Role: models.RoleUser}
+	username := "ana_ops"
+	user.Username = &username
+	admin := &models.User{Model: gorm.Model{ID: 1}, Name: "Admin", Email: "admin@example.com",
+		Role: models.RoleAdmin, EmailVerifiedAt: &verified}
+
+	locked := now.Add(time.Hour)
+	bounced := now.Add(-3 * time.Hour)
+	users := []models.User{*user, *unverified, *admin}
+	users[0].CreatedAt = now.Add(-30 * 24 * time.Hour)
+	lastLogin := now.Add(-2 * time.Hour)
+	users[0].LastLoginAt = &lastLogin
+	users[1].CreatedAt = now.Add(-24 * time.Hour)
+	users[1].LockedUntil = &locked
+	users[1].Undeliverable, users[1].UndeliverableAt = models.UndeliverableBounce, &bounced
+	users[2].CreatedAt = now.Add(-365 * 24 * time.Hour)
+
+	terms := &policies.Document{
+		Policy: models.Policy{Kind: policies.Terms, Version: "2026-03-01"},
+		Body:   "<h2>1. Use of the site</h2>\n<p>Be nice &amp; don't scrape.</p>",
+	}
+
+	security := views.SecurityDetails{Time: now, IP: "203.0.113.9",
+		UserAgent: "Mozilla/5.0 <script>", LockURL: "https://gastb.ar/lock?token=abc%2Bdef"}
+
+	return []goldenCase{
+		{"static/home", view("static/home", nil, nil)},
+		{"static/home:user", view("static/home", user, nil)},
+		{"errors/error", view("errors/error", nil, problem(http.StatusNotFound, ""))},
+		{"errors/error:500", view("errors/error", nil,
+			problem(http.StatusInternalServerError, "The <database> is down"))},
+		{"errors/error:503", view("errors/error", nil, problem(http.StatusServiceUnavailable, ""))},
+
+		{"users/new", view("users/new", nil, forms.Form{Values: controllers.SignupForm{}})},
+		{"users/new:errors", view("users/new", nil, forms.Form{
+			Values: controllers.SignupForm{Name: user.Name, Email: "ana@", Invite: "<invite>"},
+			Errors: forms.Errors{"email": "is not a valid email address",
+				"password": "must be at least 8 characters long",
+				"password_confirm": "must match Password", "invite": "is invalid or expired"},
+		})},
+		{"users/new:referral", view("users/new", nil, forms.Form{
+			Values: controllers.SignupForm{Referral: "MFRGGZDF"},
+		})},
+		{"users/login", view("users/login", nil, forms.Form{Values: controllers.LoginForm{}})},
+		{"users/login:errors", view("users/login", nil, views.Data{
+			Alert: &flash.Message{Level: flash.LevelError, Message: "Invalid email or password"},
+			Yield: forms.Form{Values: controllers.LoginForm{Email: `"ana"@example.com`},
+				Errors: forms.Errors{"password": "is required"}},
+		})},
+		{"users/login:es", view("users/login", nil, forms.Form{Values: controllers.LoginForm{}},
+			"es")},
+		{"users/forgot", view("users/forgot", nil, forms.Form{Values: controllers.ForgotForm{}})},
+		{"users/forgot:captcha", withCaptcha(view("users/forgot", nil, forms.Form{
+			Values: controllers.ForgotForm{Email: "ana@example.com"},
+			Errors: forms.Errors{"captcha": "Please confirm you are not a robot."},
+		}))},
+		{"users/reset", view("users/reset", nil, forms.Form{
+			Values: controllers.ResetForm{Token: "abc+def/="},
+			Errors: forms.Errors{"password_confirm": "must match Password"},
+		})},
+		{"users/reset:reused", view("users/reset", nil, forms.Form{
+			Values: controllers.ResetForm{Token: "abc+def/="},
+			Errors: forms.Errors{"password": "must not be one of your recent passwords"},
+		}, "es")},
+		{"users/sudo", view("users/sudo", user, forms.Form{
+			Values: controllers.SudoForm{Next: "/profile?tab=<email>"},
+			Errors: forms.Errors{"password": "is not correct"},
+		})},
+		{"users/lock", view("users/lock", nil, forms.Form{Values: controllers.LockForm{Token: "abc+def/="}})},
+		{"users/profile", view("users/profile", user, profile(user, nil))},
+		{"users/profile:unverified", view("users/profile", unverified, profile(unverified,
+			forms.Errors{"current": "is incorrect"}))},
+
+		{"profiles/show", view("profiles/show", nil, controllers.PublicProfile{
+			Username: username, Name: user.Name, AvatarURL: "/u/ana_ops/avatar",
+			Stocklists: []models.Stocklist{{Model: gorm.Model{ID: 3}, Name: "Dividends <& growth>", Public: true}},
+		})},
+		{"profiles/show:hidden", view("profiles/show", user,
+			controllers.PublicProfile{Username: username})},
+
+		{"sessions/index", view("sessions/index", user, []controllers.SessionInfo{
+			{ID: 3, Current: true, Browser: "Firefox 128", OS: "Linux",
+				UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+				IP: "203.0.113.9", Country: "AR", CreatedAt: now.Add(-72 * time.Hour), LastSeenAt: now},
+			{ID: 2, Mobile: true, UserAgent: `<script>"unknown"</script>`, IP: "10.0.0.2",
+				CreatedAt: now.Add(-400 * time.Hour), LastSeenAt: now.Add(-26 * time.Hour)},
+		})},
+
+		{"policies/show", view("policies/show", nil, controllers.PolicyDocument{
+			Title: "Terms of service", Document: terms})},
+		{"policies/consent", view("policies/consent", user, consent(terms, nil))},
+		{"policies/consent:errors", view("policies/consent", user, consent(terms,
+			forms.Errors{"accept": "must be checked to continue"}))},
+
+		{"admin/index", view("admin/index", admin, struct {
+			Stats       models.Stats
+			Invites     []models.Invite
+			Schedule    []jobs.Status
+			SlowQueries []models.SlowQuery
+			Now         time.Time
+		}{
+			models.Stats{Users: 3, LockedUsers: 1, NewUsers: 1, Stocklists: 12, APIKeys: 2,
+				PendingInvites: 1, DeadEmails: 4},
+			invites(),
+			schedule(),
+			slowQueries(),
+			now,
+		})},
+		{"admin/users", view("admin/users", admin, struct {
+			Filters controllers.UserFilters
+			Roles   []string
+			Error   string
+			Users   []models.User
+		}{controllers.UserFilters{Q: "<ana>", Role: models.RoleUser, Verified: "no",
+			CreatedFrom: "2024-01-01"}, []string{models.RoleUser, models.RoleAdmin}, "", users})},
+		{"admin/users:invalid-date", view("admin/users", admin, struct {
+			Filters controllers.UserFilters
+			Roles   []string
+			Error   string
+			Users   []models.User
+		}{controllers.UserFilters{LoginTo: "yesterday"}, []string{models.RoleUser, models.RoleAdmin},
+			"Dates must be written as YYYY-MM-DD.", nil})},
+		{"admin/emails", view("admin/emails", admin, struct {
+			Status   string
+			Statuses []string
+			Emails   []models.EmailDelivery
+		}{models.EmailDead, models.EmailStatuses, deliveries()})},
+		{"admin/suppressed", view("admin/suppressed", admin, struct {
+			Users []models.User
+		}{users[1:2]})},
+
+		{"emails/welcome", mail("welcome", views.WelcomeEmail{Name: user.Name,
+			LoginURL: "https://gastb.ar/login"})},
+		{"emails/verify_email", mail("verify_email", views.VerifyEmail{Name: user.Name,
+			URL: "https://gastb.ar/verify?token=abc%2Bdef", ExpiresIn: "24 hours",
+			Code: "042137", CodeExpiresIn: "30 minutes"})},
+		{"emails/password_reset", mail("password_reset", views.PasswordResetEmail{
+			Name: user.Name, URL: "https://gastb.ar/reset?token=abc%2Bdef", ExpiresIn: "1 hour"})},
+		{"emails/email_changed", mail("email_changed", views.EmailChangedEmail{Name: user.Name,
+			OldEmail: "ana@example.com", NewEmail: "ana+new@example.com",
+			SecurityDetails: security})},
+		{"emails/security_notice", mail("security_notice", views.SecurityNoticeEmail{
+			Name: user.Name, Kind: models.SecurityNewLogin, SecurityDetails: security})},
+		{"emails/security_notice:password", mail("security_notice", views.SecurityNoticeEmail{
+			Name: user.Name, Kind: models.SecurityPasswordChanged, SecurityDetails: security})},
+		{"emails/digest", mail("digest", views.DigestEmail{Name: user.Name,
+			Since: now.Add(-7 * 24 * time.Hour),
+			Stocklists: []views.DigestStocklist{
+				{Name: "Dividends & <growth>", New: true},
+				{Name: "Energy", Changed: true},
+			},
+			StocklistsURL:  "https://gastb.ar/stocklists",
+			UnsubscribeURL: "https://gastb.ar/unsubscribe?token=abc%2Bdef"})},
+	}
+}
+
+// view renders a page template for a request by user, who may be nil,
+// in locale, or the default one if none is given
+func view(name string, user *models.User, data interface{}, locale ...string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		v := views.NewView("bootstrap", name)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx := context.WithCSPNonce(r.Context(), "golden-nonce")
+		if user != nil {
+			ctx = context.WithUser(ctx, user)
+		}
+		if len(locale) > 0 {
+			ctx = context.WithLocale(ctx, locale[0])
+		}
+		w := httptest.NewRecorder()
+		if err := v.Render(w, r.WithContext(ctx), data); err != nil {
+			return nil, err
+		}
+		return w.Body.Bytes(), nil
+	}
+}
+
+// withCaptcha renders a case with the captcha widget on
+func withCaptcha(render func() ([]byte, error)) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		views.Captcha = &captcha.Widget{Script: "https://js.hcaptcha.com/1/api.js",
+			Class: "h-captcha", SiteKey: "site-key&1", Field: "h-captcha-response"}
+		defer func() { views.Captcha = nil }()
+		return render()
+	}
+}
+
+// mail renders an email template, with its subject, text and HTML parts
+// in one file
+func mail(name string, data interface{}) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		msg, err := views.NewEmail(name).Message(data, "ana@example.com")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("Subject: %s\n\n--- text\n%s\n--- html\n%s",
+			msg.Subject, msg.Text, msg.HTML)), nil
+	}
+}
+
+func problem(status int, detail string) *httperror.Problem {
+	p := httperror.New(status, detail)
+	p.RequestID = "req-0123456789"
+	return p
+}
+
+func profile(user *models.User, passwordErrors forms.Errors) interface{} {
+	return struct {
+		User          *models.User
+		Notifications *models.NotificationSettings
+		Profile       *models.ProfileSettings
+		UsernameForm  forms.Form
+		EmailForm     forms.Form
+		PasswordForm  forms.Form
+	}{
+		user,
+		&models.NotificationSettings{UserID: user.ID, EmailAlerts: true, SecurityNotices: true},
+		&models.ProfileSettings{UserID: user.ID, Public: user.Username != nil, ShowName: true},
+		forms.Form{Values: controllers.UsernameForm{Username: user.GetUsername()}},
+		forms.Form{Values: controllers.EmailForm{Email: user.Email}},
+		forms.Form{Values: controllers.PasswordForm{}, Errors: passwordErrors},
+	}
+}
+
+func consent(doc *policies.Document, errs forms.Errors) interface{} {
+	return struct {
+		Documents []controllers.PolicyDocument
+		Form      forms.Form
+	}{
+		[]controllers.PolicyDocument{{Title: "Terms of service", Document: doc}},
+		forms.Form{Values: controllers.ConsentForm{Next: "/profile?tab=<email>"}, Errors: errs},
+	}
+}
+
+func invites() []models.Invite {
+	used := now.Add(-time.Hour)
+	var inv [3]models.Invite
+	inv[0].CreatedAt, inv[0].Email, inv[0].ExpiresAt = now.Add(-time.Hour), "new@example.com",
+		now.Add(models.InviteTTL-time.Hour)
+	inv[1].CreatedAt, inv[1].ExpiresAt, inv[1].UsedAt = now.Add(-2*time.Hour),
+		now.Add(models.InviteTTL-2*time.Hour), &used
+	inv[2].CreatedAt, inv[2].ExpiresAt = now.Add(-10*24*time.Hour), now.Add(-3*24*time.Hour)
+	return inv[:]
+}
+
+func schedule() []jobs.Status {
+	finished := now.Add(-time.Hour)
+	return []jobs.Status{
+		{Kind: "digest", Spec: "0 8 * * 1", Next: now.Add(48 * time.Hour),
+			Last: &models.Job{CreatedAt: now.Add(-2 * time.Hour), FinishedAt: &finished}},
+		{Kind: "purge", Spec: "@hourly", Next: now.Add(time.Hour),
+			Last: &models.Job{CreatedAt: finished, FinishedAt: &finished, Failed: true,
+				LastError: "pq: <timeout>"}},
+		{Kind: "report", Spec: "@daily",
+			Last: &models.Job{CreatedAt: now}},
+		{Kind: "webhooks", Spec: "@every 1m"},
+	}
+}
+
+func slowQueries() []models.SlowQuery {
+	return []models.SlowQuery{
+		{Time: now.Add(-time.Minute), Op: "query", Table: "users",
+			SQL: `SELECT * FROM "users" WHERE (email ILIKE $1) LIMIT 50`, Params: 1,
+			Duration: 812 * time.Millisecond,
+			Plan: "Limit  (cost=0.00..4.12 rows=50 width=312)\n  ->  Seq Scan on users"},
+		{Time: now.Add(-time.Hour), Op: "update", Table: "jobs",
+			SQL: `UPDATE "jobs" SET "locked_until" = $1 WHERE id < 10`, Params: 1,
+			Duration: 1500 * time.Millisecond, Err: "pq: canceling statement due to <timeout>"},
+	}
+}
+
+func deliveries() []models.EmailDelivery {
+	var d [2]models.EmailDelivery
+	d[0].CreatedAt, d[0].To, d[0].Subject, d[0].Status, d[0].Attempts =
+		now.Add(-time.Hour), "ana@example.com", "Welcome to gastb", models.EmailSent, 1
+	d[1].CreatedAt, d[1].To, d[1].Subject, d[1].Status, d[1].Attempts, d[1].LastError =
+		now.Add(-2*time.Hour), "bruno@example.com", "Confirm <your> email", models.EmailDead, 5,
+		"550 mailbox unavailable"
+	return d[:]
+}
@@ -0,0 +1,157 @@
+package views_test
+
+// The golden test renders every view and email template with
+// representative data and compares the output with golden files in
+// testdata/golden, so template regressions (a field that no longer
+// exists, a change in escaping) show up before a page breaks in
+// production. After an intended template change, run
+//
+//	go test ./views -update
+//
+// and review the golden files in the diff.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gastb.ar/views"
+)
+
+var update = flag.Bool("update", false, "write the rendered output as the golden files")
+
+// goldenDir holds the golden files, relative to the module root
+const goldenDir = "views/testdata/golden"
+
+// goldenCase is a template rendered with fixed data
+type goldenCase struct {
+	// name is the template, such as "users/login" or "emails/welcome",
+	// optionally followed by a variant, such as "users/login:errors"
+	name   string
+	render func() ([]byte, error)
+}
+
+// template returns the name of the template c renders
+func (c goldenCase) template() string {
+	return strings.SplitN(c.name, ":", 2)[0]
+}
+
+// file returns the path of the golden file of c
+func (c goldenCase) file() string {
+	return filepath.Join(goldenDir, filepath.FromSlash(strings.Replace(c.name, ":", ".", 1))+".golden")
+}
+
+func TestGolden(t *testing.T) {
+	// Templates are parsed from views/, so the test runs from the module
+	// root, like the web server. Changing directory here rather than in
+	// TestMain lets go test see the files read, and cache accordingly.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	covered := make(map[string]bool)
+	for _, c := range goldenCases() {
+		covered[c.template()] = true
+		t.Run(c.name, func(t *testing.T) {
+			got, err := render(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := c.file()
+			want, err := os.ReadFile(file)
+			switch {
+			case err != nil && !os.IsNotExist(err):
+				t.Fatal(err)
+			case *update && (err != nil || !bytes.Equal(got, want)):
+				if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(file, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			case err != nil:
+				t.Errorf("%s is missing; run with -update to write it", file)
+			case !bytes.Equal(got, want):
+				t.Errorf("output differs from %s; run with -update once the change "+
+					"is intended\n%s", file, diff(string(want), string(got)))
+			}
+		})
+	}
+
+	templates, err := templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range templates {
+		if !covered[name] {
+			t.Errorf("no golden case renders %s", name)
+		}
+	}
+}
+
+// render runs c, turning the panics of views.NewView and
+// views.NewEmail on invalid templates into errors
+func render(c goldenCase) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return c.render()
+}
+
+// templates lists the page and email templates, without layouts
+func templates() ([]string, error) {
+	files, err := filepath.Glob(views.TemplateDir + "*/*" + views.TemplateExt)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		name := filepath.ToSlash(strings.TrimSuffix(strings.TrimPrefix(f, views.TemplateDir), views.TemplateExt))
+		if !strings.HasPrefix(name, "layouts/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// diffContext is how many lines around the first difference diff shows
+const diffContext = 3
+
+// diff shows the lines around the first line that differs between want
+// and got; a template change rarely needs more to be found
+func diff(want, got string) string {
+	w, g := strings.Split(want, "\n"), strings.Split(got, "\n")
+	i := 0
+	for i < len(w) && i < len(g) && w[i] == g[i] {
+		i++
+	}
+	start := i - diffContext
+	if start < 0 {
+		start = 0
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "first difference at line %d:\n", i+1)
+	for _, l := range w[start:i] {
+		b.WriteString("  " + l + "\n")
+	}
+	for _, l := range w[i:min(len(w), i+diffContext)] {
+		b.WriteString("- " + l + "\n")
+	}
+	for _, l := range g[i:min(len(g), i+diffContext)] {
+		b.WriteString("+ " + l + "\n")
+	}
+	return b.String()
+}
@@ -1,9 +1,18 @@
 package views
 
 import (
+	"errors"
 	"html/template"
 	"path/filepath"
 	"net/http"
+
+	"github.com/gorilla/csrf"
+
+	"gastb.ar/assets"
+	"gastb.ar/captcha"
+	"gastb.ar/context"
+	"gastb.ar/flash"
+	"gastb.ar/i18n"
 )
 
 //Function to read all .gohtml files in layouts directory
@@ -13,6 +22,13 @@ var (
 	TemplateExt string = ".gohtml"
 )
 
+// SSO shows the single sign-on button on the login form
+var SSO bool
+
+// Captcha is the widget shown on the signup and password reset forms, if
+// any
+var Captcha *captcha.Widget
+
 func layoutFiles() []string {
 	files, err := filepath.Glob(LayoutDir + "*" + TemplateExt)
 	if err != nil {
@@ -31,7 +47,28 @@ func NewView(layout string, files ...string) *View {
 	addTemplatePath(files)
 	addTemplateExt(files)
 	files = append(files,layoutFiles()...)
-	t,err := template.ParseFiles(files...)
+	t,err := template.New("").Funcs(template.FuncMap{
+		"assetPath":    assets.Path,
+		"languages":    i18n.Languages,
+		"languageName": i18n.Name,
+		"sso":          func() bool { return SSO },
+		"captcha":      func() *captcha.Widget { return Captcha },
+		// csrfField, cspNonce, T and locale are replaced in Render with
+		// the values of the request being served; these placeholders only
+		// let templates parse.
+		"csrfField": func() (template.HTML, error) {
+			return "", errors.New("csrfField is not implemented")
+		},
+		"cspNonce": func() (string, error) {
+			return "", errors.New("cspNonce is not implemented")
+		},
+		"T": func(msg string, args ...interface{}) (string, error) {
+			return "", errors.New("T is not implemented")
+		},
+		"locale": func() (string, error) {
+			return "", errors.New("locale is not implemented")
+		},
+	}).ParseFiles(files...)
 	if err != nil{
 		panic(err)
 	}
@@ -42,13 +79,57 @@ func NewView(layout string, files ...string) *View {
 	}
 }
 
-func (v *View) Render(w http.ResponseWriter,data interface{}) error {
+// Render executes the view's layout with data, filling in the request
+// dependent template functions (such as csrfField, or T translating into
+// the request's language) for r. Unless data
+// already carries an alert, the request's flash message is shown.
+func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	var vd Data
+	switch d := data.(type) {
+	case Data:
+		vd = d
+	case *Data:
+		if d != nil {
+			vd = *d
+		}
+	default:
+		vd = Data{Yield: data}
+	}
+	if vd.Alert == nil {
+		vd.Alert = flash.Pop(w, r)
+	}
+	vd.User = context.User(r.Context())
+	vd.Locale = context.Locale(r.Context())
+	if vd.Locale == "" {
+		vd.Locale = i18n.Default
+	}
+
 	w.Header().Set("Content-Type", "text/html")
-	return v.Template.ExecuteTemplate(w,v.Layout,data)
+	tpl, err := v.Template.Clone()
+	if err != nil {
+		return err
+	}
+	csrfField := csrf.TemplateField(r)
+	nonce := context.CSPNonce(r.Context())
+	tpl.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return csrfField
+		},
+		"cspNonce": func() string {
+			return nonce
+		},
+		"T": func(msg string, args ...interface{}) string {
+			return i18n.T(vd.Locale, msg, args...)
+		},
+		"locale": func() string {
+			return vd.Locale
+		},
+	})
+	return tpl.ExecuteTemplate(w,v.Layout,vd)
 }
 
 func (v *View) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := v.Render(w, nil); err != nil {
+	if err := v.Render(w, r, nil); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,130 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"gastb.ar/jobs"
+	"gastb.ar/models"
+)
+
+// ChatJobKind is the kind of the jobs posting messages to chat channels
+const ChatJobKind = "webhooks.chat"
+
+// Chat services messages can be posted to
+const (
+	Slack   = "slack"
+	Discord = "discord"
+)
+
+// discordMaxContent is the longest message Discord accepts, in
+// characters
+const discordMaxContent = 2000
+
+// chatArgs are the args of a chat job
+type chatArgs struct {
+	UserID  uint   `json:"user_id"`
+	Service string `json:"service"`
+	Text    string `json:"text"`
+}
+
+// Chat posts a plain text message to the Slack and Discord channels in a
+// user's notification settings. Like events, messages are posted by jobs
+// and retried with backoff; only errors looking up the settings or
+// enqueueing are returned.
+func (d *Dispatcher) Chat(userID uint, text string) error {
+	ns, err := d.nss.ForUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		service string
+		url     string
+	}{
+		{Slack, ns.SlackWebhookURL},
+		{Discord, ns.DiscordWebhookURL},
+	} {
+		if c.url == "" {
+			continue
+		}
+		args := chatArgs{UserID: userID, Service: c.service, Text: text}
+		err := d.queue.Enqueue(ChatJobKind, args, jobs.Options{MaxAttempts: d.MaxAttempts})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverChat is the job handler posting a message once. The URL is read
+// from the settings again, so messages to channels removed in the
+// meantime are dropped.
+func (d *Dispatcher) deliverChat(ctx context.Context, job *models.Job) error {
+	var args chatArgs
+	if err := jobs.Args(job, &args); err != nil {
+		return err
+	}
+	ns, err := d.nss.ForUser(args.UserID)
+	if err != nil {
+		return err
+	}
+	var url string
+	var payload interface{}
+	switch args.Service {
+	case Slack:
+		url = ns.SlackWebhookURL
+		payload = map[string]string{"text": args.Text}
+	case Discord:
+		url = ns.DiscordWebhookURL
+		text := []rune(args.Text)
+		if len(text) > discordMaxContent {
+			text = append(text[:discordMaxContent-1], '…')
+		}
+		payload = map[string]interface{}{
+			"content": string(text),
+			// Don't let message text ping anyone
+			"allowed_mentions": map[string][]string{"parse": {}},
+		}
+	default:
+		return fmt.Errorf("webhooks: unknown chat service %q", args.Service)
+	}
+	if url == "" {
+		return nil
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = d.postChat(ctx, url, body)
+	if err != nil {
+		deliveries.Inc("chat."+args.Service, "failure")
+		return err
+	}
+	deliveries.Inc("chat."+args.Service, "success")
+	return nil
+}
+
+// postChat posts a message to an incoming webhook and treats any non-2xx
+// response as a failure
+func (d *Dispatcher) postChat(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gastb-webhooks/1")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhooks: chat webhook responded %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"gastb.ar/models"
+)
+
+// changeEvents maps the operations of outbox changes to the events of
+// stocklists
+var changeEvents = map[string]string{
+	models.ChangeCreate: models.EventStocklistCreated,
+	models.ChangeUpdate: models.EventStocklistUpdated,
+	models.ChangeDelete: models.EventStocklistDeleted,
+}
+
+// StocklistChanges is an outbox consumer sending stocklist.created,
+// stocklist.updated and stocklist.deleted events to the webhooks of the
+// user who owns, or for organizations created, each stocklist. The data
+// is a models.StocklistPayload. Payload IDs are derived from the change,
+// so that receivers can drop the events the outbox delivers again.
+func (d *Dispatcher) StocklistChanges(ctx context.Context, changes []models.Change) error {
+	for _, c := range changes {
+		event, ok := changeEvents[c.Op]
+		if c.Entity != models.ChangeStocklist || !ok {
+			continue
+		}
+		whs, err := d.ws.Subscribers(c.UserID, event)
+		if err != nil {
+			return err
+		}
+		if len(whs) == 0 {
+			continue
+		}
+		id := "chg_" + strconv.FormatUint(c.Seq, 10)
+		if err := d.sendAs(whs, id, event, json.RawMessage(c.Payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package webhooks
+
+import (
+	"time"
+
+	"gastb.ar/models"
+)
+
+// UserData is the data of user lifecycle events, the user as the API
+// describes them
+type UserData struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	// Username is null for users who didn't pick one
+	Username      *string   `json:"username"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// NewUserData describes a user in an event
+func NewUserData(user *models.User) UserData {
+	return UserData{
+		ID:            user.ID,
+		Name:          user.Name,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		CreatedAt:     user.CreatedAt,
+	}
+}
+
+// Why accounts are deleted, in user.deleted events
+const (
+	// DeletedByAdmin is an account an admin deleted
+	DeletedByAdmin = "deleted"
+	// DeletedByMerge is a duplicate account merged into another one
+	DeletedByMerge = "merged"
+	// DeletedByProvider is an account the identity provider deleted
+	// through SCIM, which deactivates it here
+	DeletedByProvider = "deprovisioned"
+)
+
+// DeletedReasons lists the reasons of user.deleted events
+var DeletedReasons = []string{DeletedByAdmin, DeletedByMerge, DeletedByProvider}
+
+// DeletedUserData is the data of user.deleted events: the user as they
+// were before the deletion and why it happened
+type DeletedUserData struct {
+	UserData
+	// Reason is one of DeletedReasons
+	Reason string `json:"reason"`
+	// MergedInto is the ID of the account a merged duplicate went into
+	MergedInto *uint `json:"merged_into"`
+}
+
+// UserCreated notifies admin webhooks of a new account
+func (d *Dispatcher) UserCreated(user *models.User) error {
+	return d.Broadcast(models.EventUserCreated, NewUserData(user))
+}
+
+// UserVerified notifies admin webhooks that a user confirmed their email
+// address
+func (d *Dispatcher) UserVerified(user *models.User) error {
+	return d.Broadcast(models.EventUserVerified, NewUserData(user))
+}
+
+// UserDeleted notifies admin webhooks that an account is gone, for
+// reason. mergedInto is the ID of the primary account of a merge, and 0
+// otherwise.
+func (d *Dispatcher) UserDeleted(user *models.User, reason string, mergedInto uint) error {
+	data := DeletedUserData{UserData: NewUserData(user), Reason: reason}
+	if mergedInto != 0 {
+		data.MergedInto = &mergedInto
+	}
+	return d.Broadcast(models.EventUserDeleted, data)
+}
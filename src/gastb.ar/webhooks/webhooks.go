@@ -0,0 +1,240 @@
+package webhooks
+
+// The webhooks package delivers events to the endpoints users registered
+// for them. Payloads are signed with the endpoint's secret, deliveries
+// run as background jobs so failures are retried with exponential backoff,
+// and every attempt is logged in the database. Plain text messages are
+// posted to users' Slack and Discord channels the same way.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gastb.ar/jobs"
+	"gastb.ar/metrics"
+	"gastb.ar/models"
+	"gastb.ar/netguard"
+	"gastb.ar/rand"
+	"gastb.ar/tracing"
+)
+
+// Headers sent with every delivery
+const (
+	EventHeader     = "X-Gastb-Event"
+	DeliveryHeader  = "X-Gastb-Delivery"
+	SignatureHeader = "X-Gastb-Signature"
+)
+
+// Delivery defaults
+const (
+	DefaultMaxAttempts = 6
+	DefaultTimeout     = 10 * time.Second
+)
+
+// JobKind is the kind of the jobs delivering events
+const JobKind = "webhooks.deliver"
+
+var deliveries = metrics.NewCounter("webhook_deliveries_total",
+	"Webhook delivery attempts by event and result.", "event", "result")
+
+// Payload is the JSON body posted to webhook endpoints
+type Payload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Sign returns the signature header of a body sent at timestamp t, in
+// the form "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">".
+// Receivers recompute it with their secret to check the payload came
+// from us and was not replayed long after t.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher sends events to webhooks through the job queue
+type Dispatcher struct {
+	ws     *models.WebhookService
+	nss    *models.NotificationSettingService
+	queue  *jobs.Queue
+	client *http.Client
+
+	// MaxAttempts is how many times a delivery is tried
+	MaxAttempts int
+}
+
+// NewDispatcher creates a Dispatcher and registers its job handler on
+// the queue. Events are only sent to the webhooks of users whose
+// notification settings allow it.
+func NewDispatcher(ws *models.WebhookService, nss *models.NotificationSettingService,
+	queue *jobs.Queue) *Dispatcher {
+	d := &Dispatcher {
+		ws:    ws,
+		nss:   nss,
+		queue: queue,
+		// Deliveries only connect to public addresses, so that users
+		// can't reach the internal network through their webhooks
+		client: &http.Client{
+			Timeout:   DefaultTimeout,
+			Transport: &tracing.Transport{Base: netguard.Transport()},
+		},
+		MaxAttempts: DefaultMaxAttempts,
+	}
+	queue.Register(JobKind, d.deliver)
+	queue.Register(ChatJobKind, d.deliverChat)
+	return d
+}
+
+// Dispatch sends an event to the webhooks of a user subscribed to it.
+// Deliveries happen in the background; only errors looking up the
+// webhooks, encoding the payload or enqueueing are returned.
+func (d *Dispatcher) Dispatch(userID uint, event string, data interface{}) error {
+	whs, err := d.ws.Subscribers(userID, event)
+	if err != nil {
+		return err
+	}
+	return d.send(whs, event, data)
+}
+
+// Broadcast sends a site-wide event, such as a new signup, to the
+// webhooks of admins subscribed to it.
+func (d *Dispatcher) Broadcast(event string, data interface{}) error {
+	whs, err := d.ws.AdminSubscribers(event)
+	if err != nil {
+		return err
+	}
+	return d.send(whs, event, data)
+}
+
+// deliveryArgs are the args of a delivery job
+type deliveryArgs struct {
+	WebhookID uint   `json:"webhook_id"`
+	EventID   string `json:"event_id"`
+	Event     string `json:"event"`
+	Payload   string `json:"payload"`
+}
+
+func (d *Dispatcher) send(whs []models.Webhook, event string, data interface{}) error {
+	if len(whs) == 0 {
+		return nil
+	}
+	id, err := rand.String(16)
+	if err != nil {
+		return err
+	}
+	return d.sendAs(whs, id, event, data)
+}
+
+// sendAs sends an event with a given payload ID, which is the same when
+// the event is sent again
+func (d *Dispatcher) sendAs(whs []models.Webhook, id, event string, data interface{}) error {
+	body, err := json.Marshal(Payload{
+		ID:        id,
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	for _, wh := range whs {
+		enabled, err := d.nss.Enabled(wh.UserID, models.NotifyWebhooks)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			continue
+		}
+		args := deliveryArgs{
+			WebhookID: wh.ID,
+			EventID:   id,
+			Event:     event,
+			Payload:   string(body),
+		}
+		err = d.queue.Enqueue(JobKind, args, jobs.Options{MaxAttempts: d.MaxAttempts})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver is the job handler posting an event to a webhook once and
+// logging the outcome. Deliveries to webhooks deleted in the meantime
+// are dropped.
+func (d *Dispatcher) deliver(ctx context.Context, job *models.Job) error {
+	var args deliveryArgs
+	if err := jobs.Args(job, &args); err != nil {
+		return err
+	}
+	wh, err := d.ws.ByID(args.WebhookID)
+	if err == models.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	delivery := &models.WebhookDelivery{
+		WebhookID: wh.ID,
+		EventID:   args.EventID,
+		Event:     args.Event,
+		Payload:   args.Payload,
+		Attempt:   job.Attempts,
+	}
+	status, postErr := d.post(ctx, wh, args.EventID, args.Event, []byte(args.Payload))
+	delivery.StatusCode = status
+	if postErr == nil {
+		delivery.Succeeded = true
+		deliveries.Inc(args.Event, "success")
+	} else {
+		delivery.Error = postErr.Error()
+		deliveries.Inc(args.Event, "failure")
+		if job.Attempts < job.MaxAttempts {
+			next := time.Now().Add(jobs.Backoff(d.queue.Backoff, job.Attempts))
+			delivery.NextAttemptAt = &next
+		}
+	}
+	if err := d.ws.LogDelivery(delivery); err != nil {
+		return err
+	}
+	return postErr
+}
+
+// post sends a signed payload and treats any non-2xx response as a
+// failure
+func (d *Dispatcher) post(ctx context.Context, wh *models.Webhook, id, event string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gastb-webhooks/1")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, id)
+	req.Header.Set(SignatureHeader, Sign(wh.Secret, time.Now(), body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}